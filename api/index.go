@@ -2,20 +2,78 @@ package handler
 
 import (
 	"database/sql"
+	_ "embed"
 	"encoding/json"
+	"encoding/xml"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
 	"strings"
 
 
+	"bufio"
 	"bytes"	
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"math/bits"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
 	"net/url"
+	"os/signal"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
 	"github.com/joho/godotenv"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/spf13/cobra"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+	"gopkg.in/yaml.v3"
 )
 
 type Recipe struct {
@@ -27,15 +85,69 @@ type Recipe struct {
 	CookTimeMinutes  *int              `json:"cook_time_minutes"`
 	TotalTimeMinutes *int              `json:"total_time_minutes"`
 	Servings         *int              `json:"servings"`
-	Rating           *float64          `json:"rating"`
-	Ingredients      []string          `json:"ingredients"`
-	Instructions     []string          `json:"instructions"`
-	Calories         *int              `json:"calories"`
-	Protein          *float64          `json:"protein"`
-	Fat              *float64          `json:"fat"`
-	Carbs            *float64          `json:"carbs"`
-	Fiber            *float64          `json:"fiber"`
-	Sodium           *float64          `json:"sodium"`
+	// Rating is the Bayesian average of user ratings, or the imported
+	// rating for a recipe nobody has rated.
+	Rating         *float64 `json:"rating"`
+	Ingredients    []string `json:"ingredients"`
+	Instructions   []string `json:"instructions"`
+	Calories       *int     `json:"calories"`
+	Protein        *float64 `json:"protein"`
+	Fat            *float64 `json:"fat"`
+	Carbs          *float64 `json:"carbs"`
+	Fiber          *float64 `json:"fiber"`
+	Sodium         *float64 `json:"sodium"`
+	Difficulty     *string  `json:"difficulty"`
+	CostPerServing *float64 `json:"cost_per_serving"`
+	SpiceLevel     *int     `json:"spice_level"`
+	KidFriendly    *bool    `json:"kid_friendly"`
+	// CO2ePerServing is the estimated footprint in kg CO2-equivalent.
+	CO2ePerServing *float64 `json:"co2e_per_serving"`
+	// GlycemicIndex and GlycemicLoad are estimated per serving; see
+	// estimateGlycemic.
+	GlycemicIndex *float64 `json:"glycemic_index"`
+	GlycemicLoad  *float64 `json:"glycemic_load"`
+	// TimesMade counts "made it" events and Views detail views; see
+	// countRecipeMade and recordRecipeView.
+	TimesMade int `json:"times_made"`
+	Views     int `json:"views"`
+	// TenantID is the tenant whose catalog the recipe belongs to; nil for
+	// the global catalog.
+	TenantID *string `json:"tenant_id,omitempty"`
+	// Equipment is loaded on single-recipe responses only.
+	Equipment []string `json:"equipment,omitempty"`
+	// Storage is loaded on single-recipe responses only.
+	Storage *Storability `json:"storage,omitempty"`
+	// Steps are the timers and temperatures found in each instruction,
+	// loaded on single-recipe responses only.
+	Steps []StepMetadata `json:"steps,omitempty"`
+	// Cuisines are the approved cuisine labels, loaded on single-recipe
+	// responses only.
+	Cuisines []string `json:"cuisines,omitempty"`
+	// RatingStats is loaded on single-recipe responses only.
+	RatingStats *RatingStats `json:"rating_stats,omitempty"`
+	// NutritionEstimated marks nutrition summed from the ingredient table
+	// rather than entered; it is loaded on single-recipe responses only.
+	NutritionEstimated  bool     `json:"nutrition_estimated,omitempty"`
+	NutritionConfidence *float64 `json:"nutrition_confidence,omitempty"`
+	// NutritionUnits names the unit of each nutrient. Responses always
+	// carry nutrientUnits; on ingest it declares the units of the values
+	// given, which are converted before storing.
+	NutritionUnits map[string]string `json:"nutrition_units,omitempty"`
+	// ImagePlaceholder is set when Image stands in for a dead image.
+	ImagePlaceholder bool `json:"image_placeholder,omitempty"`
+	// MacroSplit is set on searches with a macro_split target.
+	MacroSplit map[string]float64 `json:"macro_split,omitempty"`
+	// FitScore is set on searches and meal plans for callers with
+	// nutrition targets; see NutritionBudget.fitScore.
+	FitScore   *int          `json:"fit_score,omitempty"`
+	Gallery    []RecipeImage `json:"gallery,omitempty"`
+	StepPhotos []RecipeImage `json:"step_photos,omitempty"`
+	// Highlights is set on search results: the matched fields with each hit
+	// wrapped in <em>, HTML-escaped.
+	Highlights map[string][]string `json:"highlights,omitempty"`
+	// Locale is set when the name, description or instructions are served
+	// from a translation.
+	Locale string `json:"locale,omitempty"`
 }
 
 type DietPlan struct {
@@ -82,8 +194,13 @@ type MCPResource struct {
 	MimeType    string `json:"mimeType"`
 }
 
-var db *sql.DB
+var db *instrumentedDB
 
+// dietPlans is the diet registry: the presets below plus any plans from
+// cfg.DietPlansFile, loaded by initConfig. Tenants add their own on top; see
+// Tenant.dietPlans. Plan filters are min_/max_ bounds on any
+// searchNumericFilters param, include_ingredients and exclude_ingredients,
+// so a new diet needs no code beyond its entry.
 var dietPlans = map[string]DietPlan{
 	"keto": {
 		Name:        "Ketogenic Diet",
@@ -161,12 +278,13 @@ var dietPlans = map[string]DietPlan{
 	},
 	"low_sugar": {
 		Name:        "Low sugar",
-		Description: "Low sugar, controlled carbs",
+		Description: "Low sugar, controlled carbs and a low glycemic load, for diabetic eating",
 		Filters: map[string]interface{}{
-			"max_carbs": 45,
+			"max_carbs":           45,
+			"max_gl":              15,
 			"exclude_ingredients": []string{"sugar", "honey", "syrup", "candy"},
-			"sort_by": "carbs",
-			"sort_order": "asc",
+			"sort_by":             "glycemic_load",
+			"sort_order":          "asc",
 		},
 	},
 	"heart_healthy": {
@@ -180,1107 +298,25427 @@ var dietPlans = map[string]DietPlan{
 			"sort_order": "desc",
 		},
 	},
+	"whole30": {
+		Name:        "Whole30",
+		Description: "Thirty days of whole foods: no sugar, grains, legumes, dairy or alcohol",
+		Filters: map[string]interface{}{
+			"exclude_ingredients": []string{"sugar", "honey", "syrup", "wheat", "flour", "rice", "oats", "corn", "pasta", "bread",
+				"bean", "lentil", "chickpea", "peanut", "soy", "tofu", "milk", "cheese", "butter", "cream", "yogurt", "wine", "beer"},
+			"sort_by":    "protein",
+			"sort_order": "desc",
+		},
+	},
+	"dash": {
+		Name:        "DASH Diet",
+		Description: "Dietary Approaches to Stop Hypertension: low sodium, high fiber, little processed meat",
+		Filters: map[string]interface{}{
+			"max_sodium":          600,
+			"min_fiber":           4,
+			"exclude_ingredients": []string{"bacon", "sausage", "salami", "fried"},
+			"sort_by":             "sodium",
+			"sort_order":          "asc",
+		},
+	},
+	"aip": {
+		Name:        "Autoimmune Protocol",
+		Description: "Paleo without eggs, nightshades, nuts, seeds or seed spices",
+		Filters: map[string]interface{}{
+			"exclude_ingredients": []string{"wheat", "flour", "grain", "rice", "oats", "corn", "bean", "lentil", "chickpea", "soy", "tofu",
+				"milk", "cheese", "butter", "cream", "yogurt", "sugar", "egg", "tomato", "potato", "pepper", "paprika", "chili", "cayenne",
+				"almond", "walnut", "pecan", "cashew", "peanut", "hazelnut", "pistachio", "sesame", "cumin", "nutmeg", "coffee"},
+			"sort_by":    "protein",
+			"sort_order": "desc",
+		},
+	},
+	"carnivore": {
+		Name:        "Carnivore Diet",
+		Description: "Animal foods only: meat, fish, eggs and little else",
+		Filters: map[string]interface{}{
+			"max_carbs":           5,
+			"min_protein":         25,
+			"exclude_ingredients": []string{"flour", "sugar", "bean", "lentil", "tofu", "tempeh", "seitan", "mushroom", "vegetable"},
+			"sort_by":             "protein",
+			"sort_order":          "desc",
+		},
+	},
 }
 
-func initDB() {
-	godotenv.Load()
-	
-	host := os.Getenv("DB_HOST")
-	port := os.Getenv("DB_PORT")
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	database := os.Getenv("DB_NAME")
-	
-	dsn := user + ":" + password + "@tcp(" + host + ":" + port + ")/" + database
-	
-	var err error
-	db, err = sql.Open("mysql", dsn)
-	if err != nil {
-		panic(err)
+// dietKeyPattern is the shape of a diet plan key, as used in ?diet=.
+var dietKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// dietBoundColumn resolves a min_<param> or max_<param> diet filter to its
+// column and comparison, for any param in searchNumericFilters.
+func dietBoundColumn(key string) (column, op string, ok bool) {
+	op = ">="
+	param, found := strings.CutPrefix(key, "min_")
+	if !found {
+		op = "<="
+		if param, found = strings.CutPrefix(key, "max_"); !found {
+			return "", "", false
+		}
+	}
+	for _, filter := range searchNumericFilters {
+		if filter.Param == param {
+			return filter.Column, op, true
+		}
 	}
+	return "", "", false
 }
 
-// MCP Server Handlers
-func handleMCPRequest(c *gin.Context) {
-	var req MCPRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, MCPResponse{
-			JSONRPC: "2.0",
-			ID:      req.ID,
-			Error: &MCPError{
-				Code:    -32700,
-				Message: "Parse error",
-			},
-		})
-		return
+// dietFilterNumber reads a bound set in Go or decoded from JSON or YAML.
+func dietFilterNumber(value interface{}) (float64, bool) {
+	switch val := value.(type) {
+	case int:
+		return float64(val), true
+	case float64:
+		return val, true
 	}
+	return 0, false
+}
 
-	switch req.Method {
-	case "initialize":
-		handleMCPInitialize(c, req)
-	case "tools/list":
-		handleMCPToolsList(c, req)
-	case "tools/call":
-		handleMCPToolCall(c, req)
-	case "resources/list":
-		handleMCPResourcesList(c, req)
-	case "resources/read":
-		handleMCPResourcesRead(c, req)
-	default:
-		c.JSON(http.StatusOK, MCPResponse{
-			JSONRPC: "2.0",
-			ID:      req.ID,
-			Error: &MCPError{
-				Code:    -32601,
-				Message: "Method not found",
-			},
-		})
+// normalizeDietPlan checks a plan from outside the code and converts its
+// filters to the types the built-in plans use: whole numbers to int and
+// ingredient lists to []string. It returns what's wrong with the plan.
+func normalizeDietPlan(key string, plan *DietPlan) (problems []string) {
+	if !dietKeyPattern.MatchString(key) {
+		problems = append(problems, fmt.Sprintf("%s: key must be lowercase letters, digits or underscores", key))
+	}
+	if strings.TrimSpace(plan.Name) == "" {
+		problems = append(problems, key+": name is required")
+	}
+	for _, name := range sortedKeys(plan.Filters) {
+		value := plan.Filters[name]
+		switch name {
+		case "include_ingredients", "exclude_ingredients":
+			words, ok := value.([]string)
+			if list, isList := value.([]interface{}); isList {
+				ok = true
+				words = make([]string, 0, len(list))
+				for _, item := range list {
+					word, isString := item.(string)
+					word = strings.ToLower(strings.TrimSpace(word))
+					if !isString || word == "" {
+						ok = false
+						break
+					}
+					words = append(words, word)
+				}
+			}
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: %s must be a list of ingredients", key, name))
+				continue
+			}
+			plan.Filters[name] = words
+		case "sort_by":
+			if _, ok := value.(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s: sort_by must be a string", key))
+			}
+		case "sort_order":
+			if value != "asc" && value != "desc" {
+				problems = append(problems, fmt.Sprintf("%s: sort_order must be asc or desc", key))
+			}
+		default:
+			if _, _, ok := dietBoundColumn(name); !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown filter %s", key, name))
+				continue
+			}
+			number, ok := dietFilterNumber(value)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: %s must be a number", key, name))
+				continue
+			}
+			if number == math.Trunc(number) {
+				plan.Filters[name] = int(number)
+			}
+		}
 	}
+	return problems
 }
 
-func handleMCPInitialize(c *gin.Context, req MCPRequest) {
-	result := map[string]interface{}{
-		"protocolVersion": "2024-11-05",
-		"capabilities": map[string]interface{}{
-			"tools": map[string]interface{}{
-				"listChanged": false,
-			},
-			"resources": map[string]interface{}{
-				"subscribe": false,
-				"listChanged": false,
-			},
-		},
-		"serverInfo": map[string]interface{}{
-			"name":    "recipe-server",
-			"version": "1.0.0",
-		},
+// loadDietPlansFile adds the plans in a JSON or YAML file (by extension)
+// to dietPlans, replacing built-in plans with the same key. It runs once at
+// startup; a file with any bad plan is rejected whole.
+func loadDietPlansFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading diet plans file: %w", err)
+	}
+	var plans map[string]DietPlan
+	switch strings.ToLower(path.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &plans)
+	default:
+		err = json.Unmarshal(data, &plans)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing diet plans file: %w", err)
+	}
+	var problems []string
+	for _, key := range sortedKeys(plans) {
+		plan := plans[key]
+		problems = append(problems, normalizeDietPlan(key, &plan)...)
+		plans[key] = plan
 	}
+	if len(problems) > 0 {
+		return fmt.Errorf("diet plans file: %s", strings.Join(problems, "; "))
+	}
+	for key, plan := range plans {
+		dietPlans[key] = plan
+	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, MCPResponse{
-		JSONRPC: "2.0",
-		ID:      req.ID,
-		Result:  result,
-	})
+// Config is every tunable the API reads. Values come from the defaults in
+// defaultConfig, then the JSON file named by CONFIG_FILE, then environment
+// variables (a .env file is loaded first). Fields tagged secret are redacted
+// from /api/admin/config.
+type Config struct {
+	Port            string        `json:"port" env:"PORT"`
+	ShutdownTimeout time.Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	LogLevel        string        `json:"log_level" env:"LOG_LEVEL"`
+	CORSOrigins     []string      `json:"cors_origins" env:"CORS_ORIGINS"`
+	PublicBaseURL   string        `json:"public_base_url" env:"PUBLIC_BASE_URL"`
+	// TenantDomain lets tenants be reached at <subdomain>.<TenantDomain>.
+	TenantDomain   string `json:"tenant_domain" env:"TENANT_BASE_DOMAIN"`
+	AdminToken     string `json:"admin_token" env:"ADMIN_TOKEN" secret:"true"`
+	AdminJWTSecret string `json:"admin_jwt_secret" env:"ADMIN_JWT_SECRET" secret:"true"`
+	MetricsToken   string `json:"metrics_token" env:"METRICS_TOKEN" secret:"true"`
+	// DietPlansFile is a JSON or YAML file of diet plans added to the
+	// built-in ones; see loadDietPlansFile.
+	DietPlansFile string          `json:"diet_plans_file" env:"DIET_PLANS_FILE"`
+	DB            DBConfig        `json:"db"`
+	LLM           LLMConfig       `json:"llm"`
+	MCP           MCPConfig       `json:"mcp"`
+	Search        SearchConfig    `json:"search"`
+	Storage       StorageConfig   `json:"storage"`
+	Alerts        AlertsConfig    `json:"alerts"`
+	Retailers     RetailersConfig `json:"retailers"`
+	Images        ImagesConfig    `json:"images"`
+	Scheduler     SchedulerConfig `json:"scheduler"`
+	Snapshots     SnapshotsConfig `json:"snapshots"`
+	Cache         CacheConfig     `json:"cache"`
+	Usage         UsageConfig     `json:"usage"`
+	Features      FeaturesConfig  `json:"features"`
 }
 
-func handleMCPToolsList(c *gin.Context, req MCPRequest) {
-	tools := []MCPTool{
-		{
-			Name:        "search_recipes",
-			Description: "Search for recipes based on various criteria including diet plans, ingredients, nutritional values, and preparation time",
-			InputSchema: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"search": map[string]interface{}{
-						"type":        "string",
-						"description": "Text search in recipe name or description",
-					},
-					"diet": map[string]interface{}{
-						"type":        "string",
-						"description": "Diet plan filter (keto, paleo, mediterranean, vegan, vegetarian, low_carb, high_protein, low_sodium, heart_healthy)",
-					},
-					"include_ingredients": map[string]interface{}{
-						"type":        "string",
-						"description": "Comma-separated ingredients to include",
-					},
-					"exclude_ingredients": map[string]interface{}{
-						"type":        "string",
-						"description": "Comma-separated ingredients to exclude",
-					},
-					"max_calories": map[string]interface{}{
-						"type":        "integer",
-						"description": "Maximum calories per serving",
-					},
-					"min_protein": map[string]interface{}{
-						"type":        "number",
-						"description": "Minimum protein in grams",
-					},
-					"max_carbs": map[string]interface{}{
-						"type":        "number",
-						"description": "Maximum carbs in grams",
-					},
-					"max_prep_time": map[string]interface{}{
-						"type":        "integer",
-						"description": "Maximum preparation time in minutes",
-					},
-					"sort_by": map[string]interface{}{
-						"type":        "string",
-						"description": "Sort field (rating, calories, protein, carbs, prep_time_minutes, etc.)",
-					},
-					"sort_order": map[string]interface{}{
-						"type":        "string",
-						"description": "Sort order (asc or desc)",
-					},
-				},
-				"additionalProperties": true,
-			},
-		},
-		{
-			Name:        "get_recipe",
-			Description: "Get detailed information about a specific recipe by ID",
-			InputSchema: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"id": map[string]interface{}{
-						"type":        "integer",
-						"description": "Recipe ID",
-					},
-				},
-				"required": []string{"id"},
-			},
-		},
-		{
-			Name:        "get_diet_plans",
-			Description: "Get list of available diet plans with their descriptions and filters",
-			InputSchema: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{},
-			},
-		},
-	}
+// DBConfig locates the database either as DATABASE_URL or as the separate
+// DB_* settings. DB_TLS_CA is a PEM bundle to verify the server with, and
+// DB_AUTH switches the password for an IAM token: aws-iam for RDS, gcp-iam
+// for Cloud SQL.
+type DBConfig struct {
+	URL       string `json:"url" env:"DATABASE_URL" secret:"true"`
+	Host      string `json:"host" env:"DB_HOST"`
+	Port      string `json:"port" env:"DB_PORT"`
+	User      string `json:"user" env:"DB_USER"`
+	Password  string `json:"password" env:"DB_PASSWORD" secret:"true"`
+	Name      string `json:"name" env:"DB_NAME"`
+	TLS       string `json:"tls" env:"DB_TLS"`
+	TLSCA     string `json:"tls_ca" env:"DB_TLS_CA"`
+	Auth      string `json:"auth" env:"DB_AUTH"`
+	AWSRegion string `json:"aws_region" env:"DB_AWS_REGION"`
+}
 
-	c.JSON(http.StatusOK, MCPResponse{
-		JSONRPC: "2.0",
-		ID:      req.ID,
-		Result: map[string]interface{}{
-			"tools": tools,
-		},
-	})
+type LLMConfig struct {
+	URL              string                `json:"url" env:"LLM_URL"`
+	Token            string                `json:"token" env:"HF_TOKEN" secret:"true"`
+	Model            string                `json:"model" env:"LLM_MODEL"`
+	FallbackModel    string                `json:"fallback_model" env:"LLM_FALLBACK_MODEL"`
+	VisionModel      string                `json:"vision_model" env:"LLM_VISION_MODEL"`
+	Timeout          time.Duration         `json:"timeout" env:"LLM_TIMEOUT"`
+	MaxRetries       int                   `json:"max_retries" env:"LLM_MAX_RETRIES"`
+	RetryBackoff     time.Duration         `json:"retry_backoff" env:"LLM_RETRY_BACKOFF"`
+	BreakerThreshold int                   `json:"breaker_threshold" env:"LLM_BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration         `json:"breaker_cooldown" env:"LLM_BREAKER_COOLDOWN"`
+	DailyBudgetUSD   float64               `json:"daily_budget_usd" env:"LLM_DAILY_BUDGET_USD"`
+	Pricing          map[string][2]float64 `json:"pricing" env:"LLM_PRICING"`
 }
 
-func handleMCPToolCall(c *gin.Context, req MCPRequest) {
-	params, ok := req.Params.(map[string]interface{})
-	if !ok {
-		c.JSON(http.StatusOK, MCPResponse{
-			JSONRPC: "2.0",
-			ID:      req.ID,
-			Error: &MCPError{Code: -32602, Message: "Invalid params"},
-		})
-		return
-	}
+type MCPConfig struct {
+	SessionSecret    string        `json:"session_secret" env:"MCP_SESSION_SECRET" secret:"true"`
+	SessionTTL       time.Duration `json:"session_ttl" env:"MCP_SESSION_TTL"`
+	AllowAnonymous   bool          `json:"allow_anonymous" env:"MCP_ALLOW_ANONYMOUS"`
+	SSEKeepalive     time.Duration `json:"sse_keepalive" env:"MCP_SSE_KEEPALIVE"`
+	ListPollInterval time.Duration `json:"list_poll_interval" env:"MCP_LIST_POLL_INTERVAL"`
+}
 
-	name, _ := params["name"].(string)
-	arguments, _ := params["arguments"].(map[string]interface{})
 
-	var result interface{}
+type SearchConfig struct {
+	DefaultLimit    int           `json:"default_limit" env:"SEARCH_DEFAULT_LIMIT"`
+	MaxLimit        int           `json:"max_limit" env:"SEARCH_MAX_LIMIT"`
+	MCPDefaultLimit int           `json:"mcp_default_limit" env:"MCP_SEARCH_DEFAULT_LIMIT"`
+	ChatResultLimit int           `json:"chat_result_limit" env:"CHAT_RESULT_LIMIT"`
+	SpellRefresh    time.Duration `json:"spell_refresh" env:"SEARCH_SPELL_REFRESH"`
+	SynonymRefresh  time.Duration `json:"synonym_refresh" env:"SEARCH_SYNONYM_REFRESH"`
+	// RatingPriorWeight is how many ratings' worth of weight a recipe's
+	// prior carries in its Bayesian average rating.
+	RatingPriorWeight float64 `json:"rating_prior_weight" env:"SEARCH_RATING_PRIOR_WEIGHT"`
+}
 
-	switch name {
-	case "search_recipes":
-		result = mcpSearchRecipesJSON(arguments)
-	case "get_recipe":
-		if id, ok := arguments["id"].(float64); ok {
-			result = mcpGetRecipeJSON(int(id))
-		} else {
-			c.JSON(http.StatusOK, MCPResponse{
-				JSONRPC: "2.0", ID: req.ID,
-				Error: &MCPError{Code: -32602, Message: "Invalid recipe ID"},
-			})
-			return
-		}
-	case "get_diet_plans":
-		result = mcpGetDietPlansJSON()
-	default:
-		c.JSON(http.StatusOK, MCPResponse{
-			JSONRPC: "2.0", ID: req.ID,
-			Error: &MCPError{Code: -32601, Message: "Tool not found"},
-		})
-		return
-	}
+// StorageConfig points at an S3-compatible bucket for uploaded images.
+// Uploads are disabled while Bucket is empty.
+type StorageConfig struct {
+	Endpoint        string `json:"endpoint" env:"STORAGE_ENDPOINT"`
+	Region          string `json:"region" env:"STORAGE_REGION"`
+	Bucket          string `json:"bucket" env:"STORAGE_BUCKET"`
+	AccessKeyID     string `json:"access_key_id" env:"STORAGE_ACCESS_KEY_ID"`
+	SecretAccessKey string `json:"secret_access_key" env:"STORAGE_SECRET_ACCESS_KEY" secret:"true"`
+	PathStyle       bool   `json:"path_style" env:"STORAGE_PATH_STYLE"`
+	PublicURL       string `json:"public_url" env:"STORAGE_PUBLIC_URL"`
+	MaxUploadBytes  int    `json:"max_upload_bytes" env:"STORAGE_MAX_UPLOAD_BYTES"`
+}
 
-	c.JSON(http.StatusOK, MCPResponse{
-		JSONRPC: "2.0",
-		ID:      req.ID,
-		Result: map[string]interface{}{
-			"content": []map[string]interface{}{
-				{"type": "application/json", "data": result},
-			},
-		},
-	})
+// AlertsConfig controls saved-search notifications. Email alerts are
+// disabled while SMTPHost is empty; webhooks need no setup.
+type AlertsConfig struct {
+	SMTPHost       string        `json:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort       string        `json:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername   string        `json:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword   string        `json:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	From           string        `json:"from" env:"ALERTS_FROM"`
+	WebhookTimeout time.Duration `json:"webhook_timeout" env:"ALERTS_WEBHOOK_TIMEOUT"`
+	MaxAttempts    int           `json:"max_attempts" env:"ALERTS_MAX_ATTEMPTS"`
+	RetryInterval  time.Duration `json:"retry_interval" env:"ALERTS_RETRY_INTERVAL"`
 }
 
-func handleMCPResourcesList(c *gin.Context, req MCPRequest) {
-	resources := []MCPResource{
-		{
-			URI:         "recipe://diet-plans",
-			Name:        "Diet Plans",
-			Description: "Available diet plans and their configurations",
-			MimeType:    "application/json",
-		},
-	}
+// RetailersConfig holds grocery API credentials for cart links. Each
+// retailer is offered only once its credentials are set.
+type RetailersConfig struct {
+	InstacartAPIKey    string        `json:"instacart_api_key" env:"INSTACART_API_KEY" secret:"true"`
+	InstacartBaseURL   string        `json:"instacart_base_url" env:"INSTACART_BASE_URL"`
+	KrogerClientID     string        `json:"kroger_client_id" env:"KROGER_CLIENT_ID"`
+	KrogerClientSecret string        `json:"kroger_client_secret" env:"KROGER_CLIENT_SECRET" secret:"true"`
+	KrogerBaseURL      string        `json:"kroger_base_url" env:"KROGER_BASE_URL"`
+	KrogerLocationID   string        `json:"kroger_location_id" env:"KROGER_LOCATION_ID"`
+	Timeout            time.Duration `json:"timeout" env:"RETAILER_TIMEOUT"`
+}
 
-	c.JSON(http.StatusOK, MCPResponse{
-		JSONRPC: "2.0",
-		ID:      req.ID,
-		Result: map[string]interface{}{
-			"resources": resources,
-		},
-	})
+// ImagesConfig controls the recipe image checker. Images failing
+// BrokenAfter checks in a row are replaced by PlaceholderURL, or a
+// generated placeholder when it is empty. A zero CheckInterval leaves
+// checks to the admin endpoint.
+type ImagesConfig struct {
+	CheckInterval  time.Duration `json:"check_interval" env:"IMAGE_CHECK_INTERVAL"`
+	CheckBatch     int           `json:"check_batch" env:"IMAGE_CHECK_BATCH"`
+	RecheckAfter   time.Duration `json:"recheck_after" env:"IMAGE_RECHECK_AFTER"`
+	BrokenAfter    int           `json:"broken_after" env:"IMAGE_BROKEN_AFTER"`
+	PlaceholderURL string        `json:"placeholder_url" env:"IMAGE_PLACEHOLDER_URL"`
 }
 
-func handleMCPResourcesRead(c *gin.Context, req MCPRequest) {
-	params, ok := req.Params.(map[string]interface{})
-	if !ok {
-		c.JSON(http.StatusOK, MCPResponse{
-			JSONRPC: "2.0",
-			ID:      req.ID,
-			Error: &MCPError{
-				Code:    -32602,
-				Message: "Invalid params",
-			},
-		})
-		return
-	}
+// SchedulerConfig sets how often long-running servers run periodic tasks;
+// zero disables one. The image check runs every IMAGE_CHECK_INTERVAL.
+// CRON_SECRET authenticates a platform cron calling /api/cron/<task>.
+type SchedulerConfig struct {
+	CronSecret        string        `json:"cron_secret" env:"CRON_SECRET" secret:"true"`
+	WarmupInterval    time.Duration `json:"warmup_interval" env:"SCHEDULE_WARMUP_INTERVAL"`
+	NutritionInterval time.Duration `json:"nutrition_interval" env:"SCHEDULE_NUTRITION_INTERVAL"`
+	RatingsInterval   time.Duration `json:"ratings_interval" env:"SCHEDULE_RATINGS_INTERVAL"`
+}
 
-	uri, _ := params["uri"].(string)
+// SnapshotsConfig controls static snapshots of recipe details and the
+// TopSearches most popular anonymous searches, published to the storage
+// bucket under Prefix every Interval (zero leaves it to the admin
+// endpoint). With Serve, anonymous requests are answered from snapshots no
+// older than MaxAge.
+type SnapshotsConfig struct {
+	Prefix      string        `json:"prefix" env:"SNAPSHOT_PREFIX"`
+	TopSearches int           `json:"top_searches" env:"SNAPSHOT_TOP_SEARCHES"`
+	Interval    time.Duration `json:"interval" env:"SNAPSHOT_INTERVAL"`
+	Serve       bool          `json:"serve" env:"SNAPSHOT_SERVE"`
+	MaxAge      time.Duration `json:"max_age" env:"SNAPSHOT_MAX_AGE"`
+}
 
-	switch uri {
-	case "recipe://diet-plans":
-		data, _ := json.MarshalIndent(dietPlans, "", "  ")
-		c.JSON(http.StatusOK, MCPResponse{
-			JSONRPC: "2.0",
-			ID:      req.ID,
-			Result: map[string]interface{}{
-				"contents": []map[string]interface{}{
-					{
-						"uri":      uri,
-						"mimeType": "application/json",
-						"text":     string(data),
-					},
-				},
+// CacheConfig sets the Cache-Control policy of each endpoint class as JSON,
+// for example {"search":{"max_age":0,"s_maxage":30}}. A class given
+// replaces its default; classes are reference (diet plans and catalog
+// stats), recipe (recipe details) and search.
+type CacheConfig struct {
+	Policies map[string]CachePolicy `json:"policies" env:"CACHE_POLICIES"`
+}
+
+// UsageConfig sets the default monthly request quotas: per API key, and
+// per client IP for callers without one. Zero means unlimited; per-key
+// overrides are managed through /api/admin/quotas.
+type UsageConfig struct {
+	MonthlyQuota          int `json:"monthly_quota" env:"USAGE_MONTHLY_QUOTA"`
+	AnonymousMonthlyQuota int `json:"anonymous_monthly_quota" env:"USAGE_ANONYMOUS_MONTHLY_QUOTA"`
+}
+
+// FeaturesConfig sets feature flag rollouts as a JSON object, for example
+// {"llm_chat":{"percent":25,"tenants":["acme"]}}. Rollouts set through
+// /api/admin/feature-flags take precedence.
+type FeaturesConfig struct {
+	Flags map[string]FeatureFlag `json:"flags" env:"FEATURE_FLAGS"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:            "8080",
+		ShutdownTimeout: 20 * time.Second,
+		LogLevel:        "info",
+		CORSOrigins:     []string{"*"},
+		PublicBaseURL:   "https://emealapi.ledraa.com",
+		LLM: LLMConfig{
+			URL:              defaultLLMURL,
+			Model:            defaultLLMModel,
+			FallbackModel:    defaultLLMFallbackModel,
+			VisionModel:      defaultLLMVisionModel,
+			Timeout:          20 * time.Second,
+			MaxRetries:       2,
+			RetryBackoff:     500 * time.Millisecond,
+			BreakerThreshold: 5,
+			BreakerCooldown:  30 * time.Second,
+			Pricing: map[string][2]float64{
+				defaultLLMModel:         {0.90, 0.90},
+				defaultLLMFallbackModel: {0.20, 0.20},
+				defaultLLMVisionModel:   {0.18, 0.59},
 			},
-		})
-	default:
-		c.JSON(http.StatusOK, MCPResponse{
-			JSONRPC: "2.0",
-			ID:      req.ID,
-			Error: &MCPError{
-				Code:    -32601,
-				Message: "Resource not found",
+		},
+		MCP: MCPConfig{
+			SessionTTL:       24 * time.Hour,
+			SSEKeepalive:     25 * time.Second,
+			ListPollInterval: 10 * time.Second,
+		},
+		Search: SearchConfig{
+			DefaultLimit:      100,
+			MaxLimit:          100,
+			MCPDefaultLimit:   20,
+			ChatResultLimit:   20,
+			SpellRefresh:      10 * time.Minute,
+			SynonymRefresh:    5 * time.Minute,
+			RatingPriorWeight: 10,
+		},
+		Storage: StorageConfig{
+			Endpoint:       "https://s3.amazonaws.com",
+			Region:         "us-east-1",
+			PathStyle:      true,
+			MaxUploadBytes: 5 << 20,
+		},
+		Alerts: AlertsConfig{
+			SMTPPort:       "587",
+			WebhookTimeout: 10 * time.Second,
+			MaxAttempts:    5,
+			RetryInterval:  time.Minute,
+		},
+		Retailers: RetailersConfig{
+			InstacartBaseURL: "https://connect.instacart.com",
+			KrogerBaseURL:    "https://api.kroger.com",
+			Timeout:          15 * time.Second,
+		},
+		Images: ImagesConfig{
+			CheckInterval: 6 * time.Hour,
+			CheckBatch:    200,
+			RecheckAfter:  7 * 24 * time.Hour,
+			BrokenAfter:   2,
+		},
+		Scheduler: SchedulerConfig{
+			WarmupInterval:    15 * time.Minute,
+			NutritionInterval: 24 * time.Hour,
+			RatingsInterval:   24 * time.Hour,
+		},
+		Snapshots: SnapshotsConfig{
+			Prefix:      "snapshots",
+			TopSearches: 200,
+			MaxAge:      6 * time.Hour,
+		},
+		Cache: CacheConfig{
+			Policies: map[string]CachePolicy{
+				"reference": {MaxAge: 3600, SMaxAge: 86400, StaleWhileRevalidate: 86400},
+				"recipe":    {MaxAge: 300, SMaxAge: 3600, StaleWhileRevalidate: 86400},
+				"search":    {MaxAge: 0, SMaxAge: 60, StaleWhileRevalidate: 300},
 			},
-		})
+		},
 	}
 }
 
-func mcpSearchRecipesJSON(args map[string]interface{}) interface{} {
-	query := "SELECT id, name, description, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium FROM recipes WHERE 1=1"
-	sqlArgs := []interface{}{}
+var (
+	cfg          = defaultConfig()
+	cfgErr       error
+	configOnce   sync.Once
+	durationType = reflect.TypeOf(time.Duration(0))
+)
 
-	if diet, ok := args["diet"].(string); ok && diet != "" {
-		if plan, exists := dietPlans[diet]; exists {
-			query, sqlArgs = applyDietFilters(query, sqlArgs, plan.Filters)
+// initConfig loads and validates the configuration once per process.
+func initConfig() error {
+	configOnce.Do(func() {
+		godotenv.Load()
+		cfg, cfgErr = loadConfig()
+		if cfgErr == nil && cfg.DietPlansFile != "" {
+			cfgErr = loadDietPlansFile(cfg.DietPlansFile)
 		}
-	}
+	})
+	return cfgErr
+}
 
-	filters := map[string]string{
-		"search": "AND (name LIKE ? OR description LIKE ?)",
-		"include_ingredients": "AND ingredients LIKE ?",
-		"exclude_ingredients": "AND ingredients NOT LIKE ?",
-		"min_calories": "AND calories >= ?",
-		"max_calories": "AND calories <= ?",
-		"min_protein": "AND protein >= ?",
-		"max_protein": "AND protein <= ?",
-		"min_carbs": "AND carbs >= ?",
-		"max_carbs": "AND carbs <= ?",
-		"max_prep_time": "AND prep_time_minutes <= ?",
-	}
+func loadConfig() (Config, error) {
+	config := defaultConfig()
 
-	for key, condition := range filters {
-		if value, ok := args[key]; ok && value != nil {
-			switch key {
-			case "search":
-				if str, ok := value.(string); ok && str != "" {
-					query += " " + condition
-					searchTerm := "%" + str + "%"
-					sqlArgs = append(sqlArgs, searchTerm, searchTerm)
-				}
-			case "include_ingredients", "exclude_ingredients":
-				if str, ok := value.(string); ok && str != "" {
-					ingredients := strings.Split(str, ",")
-					for _, ingredient := range ingredients {
-						query += " " + condition
-						sqlArgs = append(sqlArgs, "%"+strings.TrimSpace(ingredient)+"%")
-					}
-				}
-			default:
-				if str, ok := value.(string); ok && str != "" {
-					query += " " + condition
-					if val, err := strconv.ParseFloat(str, 64); err == nil {
-						sqlArgs = append(sqlArgs, val)
-					}
-				} else if num, ok := value.(float64); ok {
-					query += " " + condition
-					sqlArgs = append(sqlArgs, num)
-				}
-			}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("reading config file: %w", err)
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return config, fmt.Errorf("parsing config file: %w", err)
+		}
+		if err := applyConfigFile(reflect.ValueOf(&config).Elem(), raw); err != nil {
+			return config, err
 		}
 	}
 
-	sortBy := "id"
-	sortOrder := "asc"
-	if val, ok := args["sort_by"].(string); ok && val != "" {
-		sortBy = val
-	}
-	if val, ok := args["sort_order"].(string); ok && val != "" {
-		sortOrder = val
+	if err := applyConfigEnv(reflect.ValueOf(&config).Elem()); err != nil {
+		return config, err
 	}
 
-	validSortColumns := map[string]bool{
-		"id": true, "name": true, "prep_time_minutes": true, "cook_time_minutes": true,
-		"total_time_minutes": true, "servings": true, "rating": true, "calories": true,
-		"protein": true, "fat": true, "carbs": true, "fiber": true, "sodium": true,
-	}
+	return config, config.validate()
+}
 
-	if validSortColumns[sortBy] {
-		if sortOrder == "desc" {
-			query += " ORDER BY " + sortBy + " DESC"
-		} else {
-			query += " ORDER BY " + sortBy + " ASC"
+func applyConfigFile(v reflect.Value, raw map[string]json.RawMessage) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value, ok := raw[field.Tag.Get("json")]
+		if !ok {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			var nested map[string]json.RawMessage
+			if err := json.Unmarshal(value, &nested); err != nil {
+				return fmt.Errorf("config %s: %w", field.Tag.Get("json"), err)
+			}
+			if err := applyConfigFile(v.Field(i), nested); err != nil {
+				return err
+			}
+			continue
 		}
-	}
-
-	query += " LIMIT 20"
 
-	rows, err := db.Query(query, sqlArgs...)
-	if err != nil {
-		return map[string]interface{}{"error": err.Error()}
+		var str string
+		if json.Unmarshal(value, &str) == nil {
+			if err := setConfigField(v.Field(i), str); err != nil {
+				return fmt.Errorf("config %s: %w", field.Tag.Get("json"), err)
+			}
+		} else if err := json.Unmarshal(value, v.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("config %s: %w", field.Tag.Get("json"), err)
+		}
 	}
-	defer rows.Close()
-
-	var recipes []Recipe
-	for rows.Next() {
-		var recipe Recipe
-		var ingredientsJSON, instructionsJSON string
-
-		err := rows.Scan(&recipe.ID, &recipe.Name, &recipe.Description, &recipe.Image,
-			&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes, &recipe.TotalTimeMinutes,
-			&recipe.Servings, &recipe.Rating, &ingredientsJSON, &instructionsJSON,
-			&recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium)
+	return nil
+}
 
-		if err != nil {
+func applyConfigEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyConfigEnv(v.Field(i)); err != nil {
+				return err
+			}
 			continue
 		}
-
-		if ingredientsJSON != "" {
-			json.Unmarshal([]byte(ingredientsJSON), &recipe.Ingredients)
-		}
-		if instructionsJSON != "" {
-			json.Unmarshal([]byte(instructionsJSON), &recipe.Instructions)
+		name := field.Tag.Get("env")
+		if raw, ok := os.LookupEnv(name); ok && name != "" && raw != "" {
+			if err := setConfigField(v.Field(i), raw); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
 		}
-
-		recipes = append(recipes, recipe)
 	}
+	return nil
+}
 
-	return map[string]interface{}{
-		"recipes": recipes,
-		"count":   len(recipes),
+// setConfigField parses a string into the field: durations use
+// time.ParseDuration, lists are comma-separated and maps are JSON.
+func setConfigField(field reflect.Value, raw string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(raw)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case field.Kind() == reflect.Map:
+		return json.Unmarshal([]byte(raw), field.Addr().Interface())
+	default:
+		return fmt.Errorf("unsupported config type %s", field.Type())
 	}
+	return nil
 }
 
+func (config Config) validate() error {
+	var problems []string
 
-func mcpGetRecipeJSON(id int) interface{} {
-	query := "SELECT id, name, description, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium FROM recipes WHERE id = ?"
-
-	var recipe Recipe
-	var ingredientsJSON, instructionsJSON string
-
-	err := db.QueryRow(query, id).Scan(
-		&recipe.ID, &recipe.Name, &recipe.Description, &recipe.Image,
-		&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes, &recipe.TotalTimeMinutes,
-		&recipe.Servings, &recipe.Rating, &ingredientsJSON, &instructionsJSON,
-		&recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium)
-
-	if err == sql.ErrNoRows {
-		return map[string]interface{}{"error": "Recipe not found"}
+	if config.DB.URL != "" {
+		if u, err := url.Parse(config.DB.URL); err != nil || u.Scheme != "mysql" || u.Hostname() == "" {
+			problems = append(problems, "DATABASE_URL must be a mysql:// URL with a host")
+		}
+	} else if config.DB.Host == "" || config.DB.User == "" || config.DB.Name == "" {
+		problems = append(problems, "DATABASE_URL, or DB_HOST, DB_USER and DB_NAME, are required")
 	}
-	if err != nil {
-		return map[string]interface{}{"error": err.Error()}
+	if _, err := strconv.Atoi(config.DB.Port); config.DB.Port != "" && err != nil {
+		problems = append(problems, "DB_PORT must be a number")
 	}
-
-	if ingredientsJSON != "" {
-		json.Unmarshal([]byte(ingredientsJSON), &recipe.Ingredients)
+	if !slices.Contains(dbTLSModes, config.DB.TLS) {
+		problems = append(problems, "DB_TLS must be true, false, skip-verify or preferred")
 	}
-	if instructionsJSON != "" {
-		json.Unmarshal([]byte(instructionsJSON), &recipe.Instructions)
+	if config.DB.Auth != "" && config.DB.Auth != "aws-iam" && config.DB.Auth != "gcp-iam" {
+		problems = append(problems, "DB_AUTH must be aws-iam or gcp-iam")
 	}
-
-	return recipe
-}
-
-func mcpGetDietPlansJSON() interface{} {
-	return map[string]interface{}{
-		"diet_plans": dietPlans,
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		problems = append(problems, "LOG_LEVEL must be debug, info, warn or error")
 	}
-}
-
-// Original API Handlers (unchanged)
-func searchRecipes(c *gin.Context) {
-	query := "SELECT id, name, description, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium FROM recipes WHERE 1=1"
-	args := []interface{}{}
-	
-	// Apply diet plan filters if specified
-	if diet := c.Query("diet"); diet != "" {
-		if plan, exists := dietPlans[diet]; exists {
-			query, args = applyDietFilters(query, args, plan.Filters)
-		}
+	if _, err := url.ParseRequestURI(config.PublicBaseURL); err != nil {
+		problems = append(problems, "PUBLIC_BASE_URL must be an absolute URL")
 	}
-	
-	// Text search
-	if search := c.Query("search"); search != "" {
-		query += " AND (name LIKE ? OR description LIKE ?)"
-		searchTerm := "%" + search + "%"
-		args = append(args, searchTerm, searchTerm)
+	if config.LLM.Timeout <= 0 {
+		problems = append(problems, "LLM_TIMEOUT must be positive")
 	}
-	
-	// Ingredient filters
-	if includeIngredients := c.Query("include_ingredients"); includeIngredients != "" {
-		ingredients := strings.Split(includeIngredients, ",")
-		for _, ingredient := range ingredients {
-			query += " AND ingredients LIKE ?"
-			args = append(args, "%"+strings.TrimSpace(ingredient)+"%")
-		}
+	if config.LLM.MaxRetries < 0 || config.LLM.MaxRetries > 10 {
+		problems = append(problems, "LLM_MAX_RETRIES must be between 0 and 10")
 	}
-	
-	if excludeIngredients := c.Query("exclude_ingredients"); excludeIngredients != "" {
-		ingredients := strings.Split(excludeIngredients, ",")
-		for _, ingredient := range ingredients {
-			query += " AND ingredients NOT LIKE ?"
-			args = append(args, "%"+strings.TrimSpace(ingredient)+"%")
-		}
+	if config.LLM.BreakerThreshold < 1 {
+		problems = append(problems, "LLM_BREAKER_THRESHOLD must be at least 1")
 	}
-	
-	// Numeric filters
-	if minCalories := c.Query("min_calories"); minCalories != "" {
-		if val, err := strconv.Atoi(minCalories); err == nil {
-			query += " AND calories >= ?"
-			args = append(args, val)
-		}
+	if config.LLM.DailyBudgetUSD < 0 {
+		problems = append(problems, "LLM_DAILY_BUDGET_USD must not be negative")
 	}
-	
-	if maxCalories := c.Query("max_calories"); maxCalories != "" {
-		if val, err := strconv.Atoi(maxCalories); err == nil {
-			query += " AND calories <= ?"
-			args = append(args, val)
-		}
+	if config.Search.SpellRefresh <= 0 || config.Search.SynonymRefresh <= 0 {
+		problems = append(problems, "SEARCH_SPELL_REFRESH and SEARCH_SYNONYM_REFRESH must be positive")
 	}
-	
-	if minProtein := c.Query("min_protein"); minProtein != "" {
-		if val, err := strconv.ParseFloat(minProtein, 64); err == nil {
-			query += " AND protein >= ?"
-			args = append(args, val)
-		}
+	if config.Search.MaxLimit < 1 || config.Search.MaxLimit > 1000 {
+		problems = append(problems, "SEARCH_MAX_LIMIT must be between 1 and 1000")
 	}
-	
-	if maxProtein := c.Query("max_protein"); maxProtein != "" {
-		if val, err := strconv.ParseFloat(maxProtein, 64); err == nil {
-			query += " AND protein <= ?"
-			args = append(args, val)
+	for name, limit := range map[string]int{
+		"SEARCH_DEFAULT_LIMIT":     config.Search.DefaultLimit,
+		"MCP_SEARCH_DEFAULT_LIMIT": config.Search.MCPDefaultLimit,
+		"CHAT_RESULT_LIMIT":        config.Search.ChatResultLimit,
+	} {
+		if limit < 1 || limit > config.Search.MaxLimit {
+			problems = append(problems, name+" must be between 1 and SEARCH_MAX_LIMIT")
 		}
 	}
-	
-	if minFat := c.Query("min_fat"); minFat != "" {
-		if val, err := strconv.ParseFloat(minFat, 64); err == nil {
-			query += " AND fat >= ?"
-			args = append(args, val)
+	if config.Storage.Bucket != "" {
+		if _, err := url.ParseRequestURI(config.Storage.Endpoint); err != nil {
+			problems = append(problems, "STORAGE_ENDPOINT must be an absolute URL")
 		}
-	}
-	
-	if maxFat := c.Query("max_fat"); maxFat != "" {
-		if val, err := strconv.ParseFloat(maxFat, 64); err == nil {
-			query += " AND fat <= ?"
-			args = append(args, val)
+		if _, err := url.ParseRequestURI(config.Storage.PublicURL); err != nil {
+			problems = append(problems, "STORAGE_PUBLIC_URL must be an absolute URL")
 		}
-	}
-	
-	if minCarbs := c.Query("min_carbs"); minCarbs != "" {
-		if val, err := strconv.ParseFloat(minCarbs, 64); err == nil {
-			query += " AND carbs >= ?"
-			args = append(args, val)
+		if config.Storage.AccessKeyID == "" || config.Storage.SecretAccessKey == "" {
+			problems = append(problems, "STORAGE_ACCESS_KEY_ID and STORAGE_SECRET_ACCESS_KEY are required with STORAGE_BUCKET")
 		}
 	}
-	
-	if maxCarbs := c.Query("max_carbs"); maxCarbs != "" {
-		if val, err := strconv.ParseFloat(maxCarbs, 64); err == nil {
-			query += " AND carbs <= ?"
-			args = append(args, val)
-		}
+	if config.Storage.MaxUploadBytes < 1 {
+		problems = append(problems, "STORAGE_MAX_UPLOAD_BYTES must be positive")
 	}
-	
-	if minFiber := c.Query("min_fiber"); minFiber != "" {
-		if val, err := strconv.ParseFloat(minFiber, 64); err == nil {
-			query += " AND fiber >= ?"
-			args = append(args, val)
-		}
+	if config.Snapshots.Serve && config.Storage.Bucket == "" {
+		problems = append(problems, "SNAPSHOT_SERVE needs STORAGE_BUCKET")
 	}
-	
-	if maxFiber := c.Query("max_fiber"); maxFiber != "" {
-		if val, err := strconv.ParseFloat(maxFiber, 64); err == nil {
-			query += " AND fiber <= ?"
-			args = append(args, val)
-		}
+	if config.Snapshots.TopSearches < 0 || config.Snapshots.MaxAge <= 0 || strings.Trim(config.Snapshots.Prefix, "/") == "" {
+		problems = append(problems, "SNAPSHOT_TOP_SEARCHES must not be negative, SNAPSHOT_MAX_AGE must be positive and SNAPSHOT_PREFIX must be set")
 	}
-	
-	if minSodium := c.Query("min_sodium"); minSodium != "" {
-		if val, err := strconv.ParseFloat(minSodium, 64); err == nil {
-			query += " AND sodium >= ?"
-			args = append(args, val)
+	if config.Alerts.SMTPHost != "" {
+		if _, err := mail.ParseAddress(config.Alerts.From); err != nil {
+			problems = append(problems, "ALERTS_FROM must be an email address when SMTP_HOST is set")
 		}
 	}
-	
-	if maxSodium := c.Query("max_sodium"); maxSodium != "" {
-		if val, err := strconv.ParseFloat(maxSodium, 64); err == nil {
-			query += " AND sodium <= ?"
-			args = append(args, val)
-		}
+	if config.Alerts.MaxAttempts < 1 {
+		problems = append(problems, "ALERTS_MAX_ATTEMPTS must be at least 1")
 	}
-	
-	if minPrepTime := c.Query("min_prep_time"); minPrepTime != "" {
-		if val, err := strconv.Atoi(minPrepTime); err == nil {
-			query += " AND prep_time_minutes >= ?"
-			args = append(args, val)
-		}
+	if config.MCP.SSEKeepalive <= 0 || config.MCP.ListPollInterval <= 0 {
+		problems = append(problems, "MCP_SSE_KEEPALIVE and MCP_LIST_POLL_INTERVAL must be positive")
 	}
-	
-	if maxPrepTime := c.Query("max_prep_time"); maxPrepTime != "" {
-		if val, err := strconv.Atoi(maxPrepTime); err == nil {
-			query += " AND prep_time_minutes <= ?"
-			args = append(args, val)
-		}
+	if config.MCP.SessionTTL <= 0 {
+		problems = append(problems, "MCP_SESSION_TTL must be positive")
 	}
-	
-	if minCookTime := c.Query("min_cook_time"); minCookTime != "" {
-		if val, err := strconv.Atoi(minCookTime); err == nil {
-			query += " AND cook_time_minutes >= ?"
-			args = append(args, val)
-		}
+	if config.ShutdownTimeout <= 0 {
+		problems = append(problems, "SHUTDOWN_TIMEOUT must be positive")
 	}
-	
-	if maxCookTime := c.Query("max_cook_time"); maxCookTime != "" {
-		if val, err := strconv.Atoi(maxCookTime); err == nil {
-			query += " AND cook_time_minutes <= ?"
-			args = append(args, val)
-		}
+	if config.Alerts.WebhookTimeout <= 0 || config.Alerts.RetryInterval <= 0 {
+		problems = append(problems, "ALERTS_WEBHOOK_TIMEOUT and ALERTS_RETRY_INTERVAL must be positive")
 	}
-	
-	if minTotalTime := c.Query("min_total_time"); minTotalTime != "" {
-		if val, err := strconv.Atoi(minTotalTime); err == nil {
-			query += " AND total_time_minutes >= ?"
-			args = append(args, val)
+	for name, base := range map[string]string{"INSTACART_BASE_URL": config.Retailers.InstacartBaseURL, "KROGER_BASE_URL": config.Retailers.KrogerBaseURL} {
+		if _, err := url.ParseRequestURI(base); err != nil {
+			problems = append(problems, name+" must be a URL")
 		}
 	}
-	
-	if maxTotalTime := c.Query("max_total_time"); maxTotalTime != "" {
-		if val, err := strconv.Atoi(maxTotalTime); err == nil {
-			query += " AND total_time_minutes <= ?"
-			args = append(args, val)
-		}
+	if config.Retailers.Timeout <= 0 {
+		problems = append(problems, "RETAILER_TIMEOUT must be positive")
 	}
-	
-	if minServings := c.Query("min_servings"); minServings != "" {
-		if val, err := strconv.Atoi(minServings); err == nil {
-			query += " AND servings >= ?"
-			args = append(args, val)
-		}
+	if config.Images.CheckBatch < 1 || config.Images.CheckBatch > maxImageChecks {
+		problems = append(problems, fmt.Sprintf("IMAGE_CHECK_BATCH must be between 1 and %d", maxImageChecks))
 	}
-	
-	if maxServings := c.Query("max_servings"); maxServings != "" {
-		if val, err := strconv.Atoi(maxServings); err == nil {
-			query += " AND servings <= ?"
-			args = append(args, val)
+	if config.Images.RecheckAfter <= 0 || config.Images.BrokenAfter < 1 {
+		problems = append(problems, "IMAGE_RECHECK_AFTER and IMAGE_BROKEN_AFTER must be positive")
+	}
+	if config.Images.PlaceholderURL != "" {
+		if _, err := url.ParseRequestURI(config.Images.PlaceholderURL); err != nil {
+			problems = append(problems, "IMAGE_PLACEHOLDER_URL must be a URL")
 		}
 	}
-	
-	if minRating := c.Query("min_rating"); minRating != "" {
-		if val, err := strconv.ParseFloat(minRating, 64); err == nil {
-			query += " AND rating >= ?"
-			args = append(args, val)
+	if config.Scheduler.WarmupInterval < 0 || config.Scheduler.NutritionInterval < 0 || config.Scheduler.RatingsInterval < 0 {
+		problems = append(problems, "SCHEDULE_WARMUP_INTERVAL, SCHEDULE_NUTRITION_INTERVAL and SCHEDULE_RATINGS_INTERVAL must not be negative")
+	}
+	if config.Search.RatingPriorWeight < 0 {
+		problems = append(problems, "SEARCH_RATING_PRIOR_WEIGHT must not be negative")
+	}
+	if config.Usage.MonthlyQuota < 0 || config.Usage.AnonymousMonthlyQuota < 0 {
+		problems = append(problems, "USAGE_MONTHLY_QUOTA and USAGE_ANONYMOUS_MONTHLY_QUOTA must not be negative")
+	}
+	knownClasses := map[string]bool{}
+	for _, class := range cacheClasses {
+		knownClasses[class] = true
+	}
+	for name, policy := range config.Cache.Policies {
+		if !knownClasses[name] {
+			problems = append(problems, "CACHE_POLICIES names an unknown class "+name)
+		} else if policy.MaxAge < 0 || policy.SMaxAge < 0 || policy.StaleWhileRevalidate < 0 {
+			problems = append(problems, "CACHE_POLICIES ages for "+name+" must not be negative")
 		}
 	}
-	
-	if maxRating := c.Query("max_rating"); maxRating != "" {
-		if val, err := strconv.ParseFloat(maxRating, 64); err == nil {
-			query += " AND rating <= ?"
-			args = append(args, val)
+	for name, flag := range config.Features.Flags {
+		if _, ok := featureFlags[name]; !ok {
+			problems = append(problems, "FEATURE_FLAGS names an unknown flag "+name)
+		} else if flag.Percent < 0 || flag.Percent > 100 {
+			problems = append(problems, "FEATURE_FLAGS percent for "+name+" must be between 0 and 100")
 		}
 	}
-	
-	// Sorting
-	sortBy := c.DefaultQuery("sort_by", "id")
-	sortOrder := c.DefaultQuery("sort_order", "asc")
-	
-	validSortColumns := map[string]bool{
-		"id": true, "name": true, "prep_time_minutes": true, "cook_time_minutes": true,
-		"total_time_minutes": true, "servings": true, "rating": true, "calories": true,
-		"protein": true, "fat": true, "carbs": true, "fiber": true, "sodium": true,
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
 	}
-	
-	if validSortColumns[sortBy] {
-		if sortOrder == "desc" {
-			query += " ORDER BY " + sortBy + " DESC"
-		} else {
-			query += " ORDER BY " + sortBy + " ASC"
+	return nil
+}
+
+// sanitizedConfig renders the config for display with secrets redacted.
+func sanitizedConfig(v reflect.Value) map[string]interface{} {
+	out := map[string]interface{}{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("json")
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			out[name] = sanitizedConfig(v.Field(i))
+		case field.Tag.Get("secret") == "true":
+			out[name] = ""
+			if v.Field(i).String() != "" {
+				out[name] = "[redacted]"
+			}
+		case field.Type == durationType:
+			out[name] = time.Duration(v.Field(i).Int()).String()
+		default:
+			out[name] = v.Field(i).Interface()
 		}
 	}
+	return out
+}
+
+func getAdminConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"config": sanitizedConfig(reflect.ValueOf(cfg))})
+}
+
+func initDB() error {
+	if err := openDB(); err != nil {
+		return err
+	}
+	if err := ensureSchema(); err != nil {
+		return err
+	}
+	dbReady.Store(true)
+	return nil
+}
+
+func openDB() error {
+	mysqlConfig, err := databaseConfig(cfg.DB)
+	if err != nil {
+		return err
+	}
+	connector, err := mysql.NewConnector(mysqlConfig)
+	if err != nil {
+		return err
+	}
+	db = &instrumentedDB{DB: sql.OpenDB(connector)}
+	return nil
+}
+
+// dbReady is set once the database has answered and the schema is in
+// place; dbConnectMu serialises the attempts before that.
+var (
+	dbReady     atomic.Bool
+	dbConnectMu sync.Mutex
+)
+
+// connectDB opens the database on first use and checks that it answers
+// before applying the schema. A failed attempt is not remembered, so an
+// instance that starts during a database outage recovers by itself.
+func connectDB(ctx context.Context) error {
+	if dbReady.Load() {
+		return nil
+	}
+	dbConnectMu.Lock()
+	defer dbConnectMu.Unlock()
+	if dbReady.Load() {
+		return nil
+	}
+	if db == nil {
+		if err := openDB(); err != nil {
+			return err
+		}
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+	if err := ensureSchema(); err != nil {
+		return err
+	}
+	dbReady.Store(true)
+	return nil
+}
+
+// requireDB answers 503 while the database can't be reached rather than
+// letting every handler fail on its own.
+func requireDB() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := connectDB(c.Request.Context()); err != nil {
+			requestLogger(c).Error("database unavailable", "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Database unavailable"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// dbTLSModes are the DB_TLS values, as the MySQL driver names them.
+var dbTLSModes = []string{"", "false", "true", "skip-verify", "preferred"}
+
+// databaseConfig builds the driver configuration from DATABASE_URL or the
+// separate DB_* settings. URL query parameters are passed to the driver,
+// with the TLS parameters other clients use (PlanetScale's sslaccept and
+// ssl, MySQL's ssl-mode) translated to its tls. DB_TLS overrides the URL.
+func databaseConfig(c DBConfig) (*mysql.Config, error) {
+	user, password, addr, name := c.User, c.Password, net.JoinHostPort(c.Host, cmp.Or(c.Port, "3306")), c.Name
+	params := url.Values{}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Scheme != "mysql" {
+			return nil, errors.New("DATABASE_URL must be a mysql:// URL")
+		}
+		user = u.User.Username()
+		password, _ = u.User.Password()
+		addr = net.JoinHostPort(u.Hostname(), cmp.Or(u.Port(), "3306"))
+		name = strings.TrimPrefix(u.Path, "/")
+		for key, values := range u.Query() {
+			value := values[len(values)-1]
+			switch key {
+			case "sslaccept":
+				params.Set("tls", map[string]string{"strict": "true", "accept_invalid_certs": "skip-verify"}[value])
+			case "ssl":
+				var ssl struct {
+					RejectUnauthorized *bool `json:"rejectUnauthorized"`
+				}
+				if json.Unmarshal([]byte(value), &ssl) != nil || ssl.RejectUnauthorized == nil || *ssl.RejectUnauthorized {
+					params.Set("tls", "true")
+				} else {
+					params.Set("tls", "skip-verify")
+				}
+			case "ssl-mode", "sslmode":
+				modes := map[string]string{"disabled": "false", "preferred": "preferred", "required": "skip-verify", "verify_ca": "true", "verify_identity": "true"}
+				params.Set("tls", modes[strings.ToLower(value)])
+			default:
+				params[key] = values
+			}
+		}
+	}
+	if c.TLS != "" {
+		params.Set("tls", c.TLS)
+	}
+	params.Set("parseTime", "true")
+
+	mysqlConfig, err := mysql.ParseDSN(user + "@tcp(" + addr + ")/" + name + "?" + params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("database settings: %w", err)
+	}
+	mysqlConfig.Passwd = password
+
+	if c.TLSCA != "" {
+		pem, err := os.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading DB_TLS_CA: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("DB_TLS_CA has no PEM certificates")
+		}
+		mysqlConfig.TLS = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+
+	switch c.Auth {
+	case "aws-iam", "gcp-iam":
+		// Both send a short-lived token as a cleartext password, which
+		// is only safe over TLS.
+		if mysqlConfig.TLS == nil || mysqlConfig.AllowFallbackToPlaintext {
+			return nil, errors.New("DB_AUTH " + c.Auth + " needs TLS; set DB_TLS=true")
+		}
+		mysqlConfig.AllowCleartextPasswords = true
+		token := awsRDSAuthToken
+		if c.Auth == "gcp-iam" {
+			token = gcpAccessToken
+		}
+		err = mysqlConfig.Apply(mysql.BeforeConnect(func(ctx context.Context, conn *mysql.Config) error {
+			password, err := token(ctx, conn.Addr, conn.User)
+			if err != nil {
+				return fmt.Errorf("%s database token: %w", c.Auth, err)
+			}
+			conn.Passwd = password
+			return nil
+		}))
+	}
+	return mysqlConfig, err
+}
+
+// awsRDSAuthToken signs an RDS IAM authentication token, a SigV4
+// presigned connect request valid for 15 minutes, with the credentials in
+// the standard AWS_* environment variables.
+func awsRDSAuthToken(ctx context.Context, addr, user string) (string, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	region := cmp.Or(cfg.DB.AWSRegion, os.Getenv("AWS_REGION"))
+	if accessKey == "" || secretKey == "" || region == "" {
+		return "", errors.New("AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION are required")
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/rds-db/aws4_request"
+	query := url.Values{
+		"Action":              {"connect"},
+		"DBUser":              {user},
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {accessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {"900"},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if sessionToken := os.Getenv("AWS_SESSION_TOKEN"); sessionToken != "" {
+		query.Set("X-Amz-Security-Token", sessionToken)
+	}
+	// SigV4 escapes spaces as %20, not the + url.Values uses.
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	emptyPayload := sha256.Sum256(nil)
+	canonicalRequest := "GET\n/\n" + canonicalQuery + "\nhost:" + addr + "\n\nhost\n" + hex.EncodeToString(emptyPayload[:])
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + query.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "rds-db", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return addr + "/?" + canonicalQuery + "&X-Amz-Signature=" + hex.EncodeToString(key), nil
+}
+
+// gcpToken caches the service account access token Cloud SQL IAM
+// database authentication takes as the password.
+var gcpToken struct {
+	sync.Mutex
+	value   string
+	expires time.Time
+}
+
+// gcpAccessToken fetches the instance service account's token from the
+// metadata server, so it works on Cloud Run, GKE and Compute Engine.
+func gcpAccessToken(ctx context.Context, addr, user string) (string, error) {
+	gcpToken.Lock()
+	defer gcpToken.Unlock()
+	if gcpToken.value != "" && time.Now().Before(gcpToken.expires) {
+		return gcpToken.value, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	// Refresh a minute early so a connection never starts with a token
+	// about to expire.
+	gcpToken.value = token.AccessToken
+	gcpToken.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return gcpToken.value, nil
+}
+
+// schemaStatements creates the tables the API manages alongside recipes.
+// They run again whenever the list changes (see schemaVersion), so each one
+// must be idempotent.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS recipes (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		description TEXT NOT NULL,
+		image VARCHAR(1024) NOT NULL DEFAULT '',
+		prep_time_minutes INT NULL,
+		cook_time_minutes INT NULL,
+		total_time_minutes INT NULL,
+		servings INT NULL,
+		rating DECIMAL(3,2) NULL,
+		ingredients TEXT NOT NULL,
+		instructions TEXT NOT NULL,
+		calories INT NULL,
+		protein DECIMAL(8,2) NULL,
+		fat DECIMAL(8,2) NULL,
+		carbs DECIMAL(8,2) NULL,
+		fiber DECIMAL(8,2) NULL,
+		sodium DECIMAL(10,2) NULL,
+		INDEX idx_recipes_name (name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS llm_usage (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		api_key VARCHAR(64) NOT NULL,
+		endpoint VARCHAR(64) NOT NULL,
+		model VARCHAR(128) NOT NULL,
+		prompt_tokens INT NOT NULL DEFAULT 0,
+		completion_tokens INT NOT NULL DEFAULT 0,
+		cost_usd DECIMAL(12,6) NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_llm_usage_key_created (api_key, created_at)
+	)`,
+	`ALTER TABLE recipes ADD COLUMN ai_generated BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE recipes ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'published'`,
+	`ALTER TABLE recipes ADD COLUMN status_reason TEXT NULL`,
+	`ALTER TABLE recipes ADD COLUMN status_updated_at TIMESTAMP NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_status (status)`,
+	`ALTER TABLE recipes ADD COLUMN deleted_at TIMESTAMP NULL`,
+	`ALTER TABLE recipes ADD COLUMN difficulty VARCHAR(8) NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_difficulty (difficulty)`,
+	`ALTER TABLE recipes ADD COLUMN cost_per_serving DECIMAL(10,2) NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_cost_per_serving (cost_per_serving)`,
+	`ALTER TABLE recipes ADD COLUMN spice_level TINYINT NULL`,
+	`ALTER TABLE recipes ADD COLUMN spice_level_overridden BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE recipes ADD COLUMN kid_friendly BOOLEAN NULL`,
+	`ALTER TABLE recipes ADD COLUMN kid_friendly_overridden BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_spice_level (spice_level)`,
+	`ALTER TABLE recipes ADD COLUMN co2e_per_serving DECIMAL(10,3) NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_co2e_per_serving (co2e_per_serving)`,
+	`CREATE TABLE IF NOT EXISTS ingredient_emissions (
+		ingredient VARCHAR(128) PRIMARY KEY,
+		unit VARCHAR(16) NOT NULL,
+		co2e DECIMAL(10,4) NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// Seed typical kg CO2e per kg of food (Poore & Nemecek 2018 medians)
+	// once; after that the admin API owns the table.
+	`INSERT INTO ingredient_emissions (ingredient, unit, co2e)
+		SELECT seed.ingredient, seed.unit, seed.co2e FROM (
+			SELECT 'beef' AS ingredient, 'kg' AS unit, 60.0 AS co2e UNION ALL SELECT 'lamb', 'kg', 24.5
+			UNION ALL SELECT 'cheese', 'kg', 21.2 UNION ALL SELECT 'chocolate', 'kg', 18.7
+			UNION ALL SELECT 'coffee', 'kg', 16.5 UNION ALL SELECT 'shrimp', 'kg', 11.8
+			UNION ALL SELECT 'butter', 'kg', 9.0 UNION ALL SELECT 'pork', 'kg', 7.2
+			UNION ALL SELECT 'chicken', 'kg', 6.1 UNION ALL SELECT 'turkey', 'kg', 6.1
+			UNION ALL SELECT 'salmon', 'kg', 5.1 UNION ALL SELECT 'fish', 'kg', 5.1
+			UNION ALL SELECT 'egg', 'each', 0.27 UNION ALL SELECT 'rice', 'kg', 4.0
+			UNION ALL SELECT 'milk', 'l', 3.2 UNION ALL SELECT 'cream', 'l', 5.6
+			UNION ALL SELECT 'tofu', 'kg', 3.2 UNION ALL SELECT 'sugar', 'kg', 3.2
+			UNION ALL SELECT 'olive oil', 'l', 5.5 UNION ALL SELECT 'oil', 'l', 3.8
+			UNION ALL SELECT 'tomato', 'kg', 2.1 UNION ALL SELECT 'pasta', 'kg', 1.6
+			UNION ALL SELECT 'flour', 'kg', 1.4 UNION ALL SELECT 'bread', 'kg', 1.6
+			UNION ALL SELECT 'beans', 'kg', 2.0 UNION ALL SELECT 'lentils', 'kg', 1.8
+			UNION ALL SELECT 'chickpea', 'kg', 1.8 UNION ALL SELECT 'nuts', 'kg', 0.4
+			UNION ALL SELECT 'potato', 'kg', 0.5 UNION ALL SELECT 'onion', 'kg', 0.5
+			UNION ALL SELECT 'carrot', 'kg', 0.4 UNION ALL SELECT 'apple', 'kg', 0.4
+			UNION ALL SELECT 'banana', 'kg', 0.9 UNION ALL SELECT 'oats', 'kg', 2.5
+		) seed
+		WHERE NOT EXISTS (SELECT 1 FROM ingredient_emissions)`,
+	`ALTER TABLE recipes ADD COLUMN nutrition_estimated BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE recipes ADD COLUMN nutrition_confidence DECIMAL(3,2) NULL`,
+	`CREATE TABLE IF NOT EXISTS ingredient_nutrition (
+		ingredient VARCHAR(128) PRIMARY KEY,
+		calories DECIMAL(8,2) NOT NULL,
+		protein DECIMAL(8,2) NOT NULL,
+		fat DECIMAL(8,2) NOT NULL,
+		carbs DECIMAL(8,2) NOT NULL,
+		fiber DECIMAL(8,2) NOT NULL DEFAULT 0,
+		sodium DECIMAL(10,2) NOT NULL DEFAULT 0,
+		grams_per_ml DECIMAL(6,3) NULL,
+		grams_each DECIMAL(8,2) NULL,
+		fdc_id INT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// Seed per-100 g values from USDA FoodData Central (SR Legacy) once;
+	// after that the admin API owns the table.
+	`INSERT INTO ingredient_nutrition (ingredient, calories, protein, fat, carbs, fiber, sodium, grams_per_ml, grams_each)
+		SELECT seed.ingredient, seed.calories, seed.protein, seed.fat, seed.carbs, seed.fiber, seed.sodium, seed.grams_per_ml, seed.grams_each FROM (
+			SELECT 'chicken breast' AS ingredient, 120 AS calories, 22.5 AS protein, 2.6 AS fat, 0 AS carbs, 0 AS fiber, 45 AS sodium, NULL AS grams_per_ml, 174 AS grams_each
+			UNION ALL SELECT 'chicken', 119, 21.4, 3.1, 0, 0, 77, NULL, NULL
+			UNION ALL SELECT 'beef', 215, 18.6, 15.0, 0, 0, 66, NULL, NULL
+			UNION ALL SELECT 'pork', 143, 21.2, 5.7, 0, 0, 52, NULL, NULL
+			UNION ALL SELECT 'bacon', 417, 12.6, 39.7, 1.4, 0, 833, NULL, 28
+			UNION ALL SELECT 'salmon', 208, 20.4, 13.4, 0, 0, 59, NULL, NULL
+			UNION ALL SELECT 'shrimp', 85, 20.1, 0.5, 0, 0, 119, NULL, NULL
+			UNION ALL SELECT 'tofu', 76, 8.1, 4.8, 1.9, 0.3, 7, NULL, NULL
+			UNION ALL SELECT 'egg', 143, 12.6, 9.5, 0.7, 0, 142, NULL, 50
+			UNION ALL SELECT 'milk', 61, 3.2, 3.3, 4.8, 0, 43, 1.03, NULL
+			UNION ALL SELECT 'butter', 717, 0.9, 81.1, 0.1, 0, 643, 0.96, NULL
+			UNION ALL SELECT 'cream', 340, 2.8, 36.1, 2.7, 0, 27, 1.0, NULL
+			UNION ALL SELECT 'cheese', 403, 24.9, 33.1, 1.3, 0, 621, 0.47, NULL
+			UNION ALL SELECT 'parmesan', 431, 38.5, 28.6, 4.1, 0, 1529, 0.42, NULL
+			UNION ALL SELECT 'yogurt', 61, 3.5, 3.3, 4.7, 0, 46, 1.03, NULL
+			UNION ALL SELECT 'olive oil', 884, 0, 100, 0, 0, 2, 0.91, NULL
+			UNION ALL SELECT 'oil', 884, 0, 100, 0, 0, 0, 0.92, NULL
+			UNION ALL SELECT 'flour', 364, 10.3, 1.0, 76.3, 2.7, 2, 0.53, NULL
+			UNION ALL SELECT 'sugar', 387, 0, 0, 100, 0, 1, 0.85, NULL
+			UNION ALL SELECT 'brown sugar', 380, 0.1, 0, 98.1, 0, 28, 0.93, NULL
+			UNION ALL SELECT 'honey', 304, 0.3, 0, 82.4, 0.2, 4, 1.42, NULL
+			UNION ALL SELECT 'rice', 365, 7.1, 0.7, 80.0, 1.3, 5, 0.79, NULL
+			UNION ALL SELECT 'pasta', 371, 13.0, 1.5, 74.7, 3.2, 6, 0.42, NULL
+			UNION ALL SELECT 'bread', 266, 8.9, 3.3, 49.4, 2.7, 491, NULL, 28
+			UNION ALL SELECT 'oats', 389, 16.9, 6.9, 66.3, 10.6, 2, 0.34, NULL
+			UNION ALL SELECT 'potato', 77, 2.0, 0.1, 17.5, 2.2, 6, NULL, 213
+			UNION ALL SELECT 'onion', 40, 1.1, 0.1, 9.3, 1.7, 4, 0.67, 110
+			UNION ALL SELECT 'garlic', 149, 6.4, 0.5, 33.1, 2.1, 17, 0.57, 3
+			UNION ALL SELECT 'carrot', 41, 0.9, 0.2, 9.6, 2.8, 69, 0.54, 61
+			UNION ALL SELECT 'tomato', 18, 0.9, 0.2, 3.9, 1.2, 5, 0.76, 123
+			UNION ALL SELECT 'bell pepper', 31, 1.0, 0.3, 6.0, 2.1, 4, 0.62, 119
+			UNION ALL SELECT 'spinach', 23, 2.9, 0.4, 3.6, 2.2, 79, 0.13, NULL
+			UNION ALL SELECT 'broccoli', 34, 2.8, 0.4, 6.6, 2.6, 33, 0.37, NULL
+			UNION ALL SELECT 'mushroom', 22, 3.1, 0.3, 3.3, 1.0, 5, 0.29, 18
+			UNION ALL SELECT 'banana', 89, 1.1, 0.3, 22.8, 2.6, 1, NULL, 118
+			UNION ALL SELECT 'apple', 52, 0.3, 0.2, 13.8, 2.4, 1, NULL, 182
+			UNION ALL SELECT 'lemon juice', 22, 0.4, 0.2, 6.9, 0.3, 1, 1.03, NULL
+			UNION ALL SELECT 'lemon', 29, 1.1, 0.3, 9.3, 2.8, 2, NULL, 84
+			UNION ALL SELECT 'beans', 132, 8.9, 0.5, 23.7, 8.7, 1, 0.72, NULL
+			UNION ALL SELECT 'chickpea', 164, 8.9, 2.6, 27.4, 7.6, 7, 0.66, NULL
+			UNION ALL SELECT 'lentils', 352, 24.6, 1.1, 63.4, 10.7, 6, 0.81, NULL
+			UNION ALL SELECT 'peanut butter', 588, 25.1, 50.0, 19.6, 6.0, 459, 1.08, NULL
+			UNION ALL SELECT 'nuts', 579, 21.2, 49.9, 21.6, 12.5, 1, 0.6, NULL
+			UNION ALL SELECT 'coconut milk', 197, 2.0, 21.3, 2.8, 0, 13, 0.97, NULL
+			UNION ALL SELECT 'soy sauce', 53, 8.1, 0.6, 4.9, 0.8, 5493, 1.08, NULL
+			UNION ALL SELECT 'broth', 6, 0.6, 0.2, 0.4, 0, 343, 1.0, NULL
+			UNION ALL SELECT 'salt', 0, 0, 0, 0, 0, 38758, 1.22, NULL
+			UNION ALL SELECT 'water', 0, 0, 0, 0, 0, 0, 1.0, NULL
+		) seed
+		WHERE NOT EXISTS (SELECT 1 FROM ingredient_nutrition)`,
+	`CREATE TABLE IF NOT EXISTS beverage_pairings (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		match_type VARCHAR(16) NOT NULL,
+		match_value VARCHAR(255) NOT NULL DEFAULT '',
+		beverage VARCHAR(128) NOT NULL,
+		category VARCHAR(16) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		weight INT NOT NULL DEFAULT 1
+	)`,
+	// Seed a starter rule set once; after that the admin API owns the table.
+	`INSERT INTO beverage_pairings (match_type, match_value, beverage, category, reason, weight)
+		SELECT seed.match_type, seed.match_value, seed.beverage, seed.category, seed.reason, seed.weight FROM (
+			SELECT 'protein' AS match_type, 'beef,steak,lamb,venison' AS match_value, 'Cabernet Sauvignon' AS beverage, 'wine' AS category, 'Firm tannins cut through rich red meat' AS reason, 3 AS weight
+			UNION ALL SELECT 'protein', 'beef,steak,lamb,venison', 'Syrah', 'wine', 'Peppery reds stand up to red meat', 2
+			UNION ALL SELECT 'protein', 'pork,sausage,ham,duck', 'Pinot Noir', 'wine', 'A light red flatters pork and duck', 2
+			UNION ALL SELECT 'protein', 'chicken,turkey', 'Chardonnay', 'wine', 'A rounded white suits poultry', 2
+			UNION ALL SELECT 'protein', 'salmon,tuna,mushroom', 'Pinot Noir', 'wine', 'Light reds work with oily fish and earthy mushrooms', 2
+			UNION ALL SELECT 'protein', 'fish,cod,shrimp,prawn,scallop,mussel,clam,crab', 'Sauvignon Blanc', 'wine', 'Crisp acidity lifts seafood', 3
+			UNION ALL SELECT 'protein', 'fish,cod,shrimp,prawn,scallop,mussel,clam,crab', 'Albariño', 'wine', 'A saline white made for seafood', 2
+			UNION ALL SELECT 'protein', 'chicken,pork,fish', 'Pilsner', 'beer', 'A clean lager refreshes without overpowering', 1
+			UNION ALL SELECT 'cuisine', 'pasta,pizza,risotto,lasagna,italian,bolognese', 'Chianti', 'wine', 'Italian food with an Italian red', 3
+			UNION ALL SELECT 'cuisine', 'taco,burrito,enchilada,quesadilla,mexican,fajita', 'Mexican lager', 'beer', 'A light lager with lime suits Mexican dishes', 3
+			UNION ALL SELECT 'cuisine', 'taco,burrito,enchilada,quesadilla,mexican,fajita', 'Agua fresca', 'non_alcoholic', 'Fruity and cooling alongside Mexican dishes', 2
+			UNION ALL SELECT 'cuisine', 'curry,tikka,masala,korma,dal,indian', 'Mango lassi', 'non_alcoholic', 'Yogurt and mango soothe curry spices', 3
+			UNION ALL SELECT 'cuisine', 'thai,pad thai,laksa,vietnamese', 'Gewürztraminer', 'wine', 'Aromatic whites echo lemongrass and ginger', 2
+			UNION ALL SELECT 'cuisine', 'sushi,ramen,teriyaki,japanese,miso', 'Sake', 'wine', 'Rice wine for Japanese flavours', 3
+			UNION ALL SELECT 'cuisine', 'sushi,ramen,teriyaki,japanese,miso', 'Green tea', 'non_alcoholic', 'A clean, grassy match for Japanese dishes', 2
+			UNION ALL SELECT 'cuisine', 'bbq,barbecue,burger,ribs,brisket', 'Zinfandel', 'wine', 'Jammy fruit for smoky barbecue', 2
+			UNION ALL SELECT 'cuisine', 'bbq,barbecue,burger,ribs,brisket', 'Amber ale', 'beer', 'Caramel malt meets charred meat', 2
+			UNION ALL SELECT 'cuisine', 'chocolate,brownie,cake', 'Tawny port', 'wine', 'Sweet wine for a sweet finish', 2
+			UNION ALL SELECT 'cuisine', 'salad,ceviche', 'Rosé', 'wine', 'Light and dry for fresh dishes', 1
+			UNION ALL SELECT 'spice', '2', 'Off-dry Riesling', 'wine', 'A touch of sweetness and low alcohol calm heat', 3
+			UNION ALL SELECT 'spice', '2', 'Wheat beer', 'beer', 'Soft, low-bitterness beer eases chilli heat', 2
+			UNION ALL SELECT 'spice', '2', 'Mango lassi', 'non_alcoholic', 'Dairy tames chilli heat', 2
+			UNION ALL SELECT 'any', '', 'Sparkling water with lemon', 'non_alcoholic', 'A neutral palate cleanser for any dish', 1
+		) seed
+		WHERE NOT EXISTS (SELECT 1 FROM beverage_pairings)`,
+	`CREATE TABLE IF NOT EXISTS recipe_equipment (
+		recipe_id INT NOT NULL,
+		equipment VARCHAR(32) NOT NULL,
+		source VARCHAR(16) NOT NULL,
+		PRIMARY KEY (recipe_id, equipment),
+		INDEX idx_recipe_equipment_equipment (equipment)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_storage (
+		recipe_id INT PRIMARY KEY,
+		fridge_days TINYINT NOT NULL,
+		freezer_months TINYINT NOT NULL,
+		reheat VARCHAR(500) NOT NULL DEFAULT '',
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`ALTER TABLE recipes ADD COLUMN merged_into INT NULL`,
+	`ALTER TABLE recipes ADD COLUMN image_status VARCHAR(8) NULL`,
+	`ALTER TABLE recipes ADD COLUMN image_failures TINYINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE recipes ADD COLUMN image_checked_at TIMESTAMP NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_image_status (image_status)`,
+	`CREATE TABLE IF NOT EXISTS recipe_image_hashes (
+		recipe_id INT PRIMARY KEY,
+		image_url VARCHAR(1024) NOT NULL,
+		hash BIGINT NULL,
+		checked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS ingredient_prices (
+		ingredient VARCHAR(128) PRIMARY KEY,
+		unit VARCHAR(16) NOT NULL,
+		price DECIMAL(10,4) NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		actor VARCHAR(128) NOT NULL,
+		method VARCHAR(8) NOT NULL,
+		endpoint VARCHAR(255) NOT NULL,
+		path VARCHAR(255) NOT NULL,
+		payload_hash CHAR(64) NOT NULL DEFAULT '',
+		client_ip VARCHAR(64) NOT NULL,
+		status INT NOT NULL,
+		request_id VARCHAR(64) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_audit_log_actor_created (actor, created_at),
+		INDEX idx_audit_log_created (created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_scan_failures (
+		recipe_id INT PRIMARY KEY,
+		failures INT NOT NULL DEFAULT 1,
+		last_error TEXT NOT NULL,
+		first_seen TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_seen TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS admin_jobs (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		kind VARCHAR(32) NOT NULL,
+		params JSON NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'queued',
+		result JSON NULL,
+		error TEXT NULL,
+		created_by VARCHAR(128) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		started_at TIMESTAMP NULL,
+		finished_at TIMESTAMP NULL,
+		INDEX idx_admin_jobs_kind_created (kind, created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_images (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		recipe_id INT NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		step INT NULL,
+		position INT NOT NULL DEFAULT 0,
+		storage_key VARCHAR(255) NOT NULL,
+		url VARCHAR(1024) NOT NULL,
+		caption VARCHAR(512) NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_recipe_images_recipe (recipe_id, kind, step, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS share_links (
+		token VARCHAR(16) PRIMARY KEY,
+		recipe_id INT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS saved_searches (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		owner VARCHAR(64) NOT NULL,
+		name VARCHAR(128) NOT NULL,
+		filters JSON NOT NULL,
+		email VARCHAR(255) NULL,
+		webhook_url VARCHAR(1024) NULL,
+		webhook_secret CHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_saved_searches_owner (owner)
+	)`,
+	`CREATE TABLE IF NOT EXISTS saved_search_notifications (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		saved_search_id INT NOT NULL,
+		recipe_id INT NOT NULL,
+		channel VARCHAR(16) NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP NULL,
+		UNIQUE KEY uniq_saved_search_notification (saved_search_id, recipe_id, channel),
+		INDEX idx_saved_search_notifications_status (status, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ingredient_synonyms (
+		term VARCHAR(128) PRIMARY KEY,
+		canonical VARCHAR(128) NOT NULL,
+		INDEX idx_ingredient_synonyms_canonical (canonical)
+	)`,
+	// Seed common regional names once; after that the admin API owns the
+	// table, so an edited or emptied list is left alone.
+	`INSERT INTO ingredient_synonyms (term, canonical)
+		SELECT seed.term, seed.canonical FROM (
+			SELECT 'eggplant' AS term, 'eggplant' AS canonical UNION ALL SELECT 'aubergine', 'eggplant'
+			UNION ALL SELECT 'cilantro', 'cilantro' UNION ALL SELECT 'coriander', 'cilantro'
+			UNION ALL SELECT 'chickpea', 'chickpea' UNION ALL SELECT 'garbanzo', 'chickpea'
+			UNION ALL SELECT 'zucchini', 'zucchini' UNION ALL SELECT 'courgette', 'zucchini'
+			UNION ALL SELECT 'arugula', 'arugula' UNION ALL SELECT 'rocket', 'arugula'
+			UNION ALL SELECT 'scallion', 'scallion' UNION ALL SELECT 'spring onion', 'scallion' UNION ALL SELECT 'green onion', 'scallion'
+			UNION ALL SELECT 'bell pepper', 'bell pepper' UNION ALL SELECT 'capsicum', 'bell pepper'
+			UNION ALL SELECT 'shrimp', 'shrimp' UNION ALL SELECT 'prawn', 'shrimp'
+		) seed
+		WHERE NOT EXISTS (SELECT 1 FROM ingredient_synonyms)`,
+	`ALTER TABLE ingredient_synonyms ADD COLUMN locale VARCHAR(16) NULL`,
+	// Seed localized names once, the same way. Terms already in use keep
+	// their group.
+	`INSERT IGNORE INTO ingredient_synonyms (term, canonical, locale)
+		SELECT seed.term, seed.canonical, seed.locale FROM (
+			SELECT 'koriander' AS term, 'cilantro' AS canonical, 'de' AS locale UNION ALL SELECT 'coriandre', 'cilantro', 'fr'
+			UNION ALL SELECT 'berenjena', 'eggplant', 'es' UNION ALL SELECT 'melanzana', 'eggplant', 'it'
+			UNION ALL SELECT 'kichererbse', 'chickpea', 'de' UNION ALL SELECT 'pois chiche', 'chickpea', 'fr' UNION ALL SELECT 'cece', 'chickpea', 'it'
+			UNION ALL SELECT 'calabacín', 'zucchini', 'es' UNION ALL SELECT 'zucchina', 'zucchini', 'it'
+			UNION ALL SELECT 'garnele', 'shrimp', 'de' UNION ALL SELECT 'gamba', 'shrimp', 'es' UNION ALL SELECT 'crevette', 'shrimp', 'fr'
+			UNION ALL SELECT 'pimiento', 'bell pepper', 'es' UNION ALL SELECT 'poivron', 'bell pepper', 'fr'
+			UNION ALL SELECT 'onion', 'onion', NULL UNION ALL SELECT 'zwiebel', 'onion', 'de'
+			UNION ALL SELECT 'cebolla', 'onion', 'es' UNION ALL SELECT 'oignon', 'onion', 'fr'
+			UNION ALL SELECT 'garlic', 'garlic', NULL UNION ALL SELECT 'knoblauch', 'garlic', 'de'
+			UNION ALL SELECT 'ajo', 'garlic', 'es' UNION ALL SELECT 'aglio', 'garlic', 'it'
+			UNION ALL SELECT 'spinach', 'spinach', NULL UNION ALL SELECT 'spinat', 'spinach', 'de'
+			UNION ALL SELECT 'espinaca', 'spinach', 'es' UNION ALL SELECT 'épinards', 'spinach', 'fr'
+		) seed
+		WHERE NOT EXISTS (SELECT 1 FROM ingredient_synonyms WHERE locale IS NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS meal_log (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		owner VARCHAR(64) NOT NULL,
+		recipe_id INT NOT NULL,
+		servings DECIMAL(6,2) NOT NULL DEFAULT 1,
+		eaten_at DATETIME NOT NULL,
+		planned BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_meal_log_owner_eaten (owner, eaten_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS hidden_recipes (
+		owner VARCHAR(64) NOT NULL,
+		recipe_id INT NOT NULL,
+		reason VARCHAR(16) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (owner, recipe_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS mcp_tokens (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(128) NOT NULL,
+		token_hash CHAR(64) NOT NULL UNIQUE,
+		tools JSON NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP NULL,
+		revoked_at TIMESTAMP NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS mcp_list_versions (
+		list VARCHAR(32) PRIMARY KEY,
+		version BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS tenants (
+		id VARCHAR(20) PRIMARY KEY,
+		name VARCHAR(128) NOT NULL,
+		subdomain VARCHAR(20) NULL UNIQUE,
+		include_global BOOLEAN NOT NULL DEFAULT TRUE,
+		diet_plans JSON NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS tenant_api_keys (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		key_hash CHAR(64) NOT NULL UNIQUE,
+		tenant_id VARCHAR(20) NOT NULL,
+		name VARCHAR(128) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP NULL,
+		INDEX idx_tenant_api_keys_tenant (tenant_id)
+	)`,
+	`ALTER TABLE recipes ADD COLUMN tenant_id VARCHAR(20) NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_tenant (tenant_id)`,
+	`ALTER TABLE mcp_tokens ADD COLUMN tenant_id VARCHAR(20) NULL`,
+	`ALTER TABLE saved_searches ADD COLUMN tenant_id VARCHAR(20) NULL`,
+	`CREATE TABLE IF NOT EXISTS api_usage (
+		api_key VARCHAR(64) NOT NULL,
+		month CHAR(7) NOT NULL,
+		endpoint VARCHAR(160) NOT NULL,
+		requests BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (api_key, month, endpoint)
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_quotas (
+		api_key VARCHAR(64) PRIMARY KEY,
+		monthly_requests INT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS feature_flags (
+		name VARCHAR(64) PRIMARY KEY,
+		percent TINYINT NOT NULL,
+		tenants JSON NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS ranking_experiments (
+		name VARCHAR(64) PRIMARY KEY,
+		variants JSON NOT NULL,
+		started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		ended_at TIMESTAMP NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS ranking_events (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		search_id CHAR(24) NOT NULL,
+		experiment VARCHAR(64) NOT NULL,
+		variant VARCHAR(32) NOT NULL,
+		event VARCHAR(16) NOT NULL,
+		recipe_id INT NULL,
+		position INT NULL,
+		api_key VARCHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ranking_events_search (search_id),
+		INDEX idx_ranking_events_variant (experiment, variant, event)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_translations (
+		recipe_id INT NOT NULL,
+		locale VARCHAR(16) NOT NULL,
+		name VARCHAR(255) NOT NULL DEFAULT '',
+		description TEXT NOT NULL,
+		instructions JSON NULL,
+		source VARCHAR(16) NOT NULL DEFAULT 'manual',
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (recipe_id, locale),
+		INDEX idx_recipe_translations_locale (locale)
+	)`,
+	`ALTER TABLE recipes ADD COLUMN submitted_by VARCHAR(64) NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_submitted_by (submitted_by)`,
+	`CREATE TABLE IF NOT EXISTS recipe_reports (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		recipe_id INT NOT NULL,
+		reporter VARCHAR(64) NOT NULL,
+		reason VARCHAR(16) NOT NULL,
+		details TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'open',
+		resolution VARCHAR(16) NULL,
+		resolution_note TEXT NULL,
+		resolved_by VARCHAR(128) NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP NULL,
+		INDEX idx_recipe_reports_recipe (recipe_id, status),
+		INDEX idx_recipe_reports_status (status, created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_comments (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		recipe_id INT NOT NULL,
+		parent_id BIGINT NULL,
+		author VARCHAR(64) NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		edited_at TIMESTAMP NULL,
+		deleted_at TIMESTAMP NULL,
+		INDEX idx_recipe_comments_thread (recipe_id, parent_id, id),
+		INDEX idx_recipe_comments_parent (parent_id, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_ratings (
+		recipe_id INT NOT NULL,
+		rater VARCHAR(64) NOT NULL,
+		stars TINYINT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (recipe_id, rater)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_rating_stats (
+		recipe_id INT PRIMARY KEY,
+		rating_count INT NOT NULL,
+		stars_1 INT NOT NULL,
+		stars_2 INT NOT NULL,
+		stars_3 INT NOT NULL,
+		stars_4 INT NOT NULL,
+		stars_5 INT NOT NULL,
+		average DECIMAL(4,3) NOT NULL,
+		weighted DECIMAL(4,3) NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`,
+	`ALTER TABLE recipes ADD COLUMN source_rating DECIMAL(3,2) NULL`,
+	`UPDATE recipes SET source_rating = rating
+		WHERE source_rating IS NULL AND rating IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM recipe_rating_stats s WHERE s.recipe_id = recipes.id)`,
+	`CREATE TABLE IF NOT EXISTS recipe_history (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		owner VARCHAR(64) NOT NULL,
+		recipe_id INT NOT NULL,
+		event VARCHAR(8) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_recipe_history_owner (owner, created_at),
+		INDEX idx_recipe_history_recipe (owner, recipe_id, event, created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cook_sessions (
+		id CHAR(24) PRIMARY KEY,
+		owner VARCHAR(64) NOT NULL,
+		recipe_id INT NOT NULL,
+		completed_steps TEXT NOT NULL,
+		timers TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		finished_at TIMESTAMP NULL,
+		INDEX idx_cook_sessions_owner (owner, recipe_id, updated_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_cuisines (
+		recipe_id INT NOT NULL,
+		cuisine VARCHAR(32) NOT NULL,
+		confidence DECIMAL(3,2) NOT NULL,
+		source VARCHAR(8) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		reviewed_by VARCHAR(128) NULL,
+		reviewed_at TIMESTAMP NULL,
+		PRIMARY KEY (recipe_id, cuisine),
+		INDEX idx_recipe_cuisines_status (status, cuisine, confidence)
+	)`,
+	`CREATE TABLE IF NOT EXISTS search_queries (
+		query_key VARCHAR(512) NOT NULL,
+		day DATE NOT NULL,
+		searches INT NOT NULL DEFAULT 0,
+		PRIMARY KEY (query_key, day),
+		INDEX idx_search_queries_day (day)
+	)`,
+	`CREATE TABLE IF NOT EXISTS recipe_steps (
+		recipe_id INT NOT NULL,
+		step SMALLINT NOT NULL,
+		timers TEXT NOT NULL,
+		temperature TEXT NULL,
+		PRIMARY KEY (recipe_id, step)
+	)`,
+	`ALTER TABLE recipes ADD COLUMN times_made INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE recipes ADD COLUMN views INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_times_made (times_made)`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_views (views)`,
+	`CREATE TABLE IF NOT EXISTS recipe_made (
+		recipe_id INT NOT NULL,
+		caller CHAR(32) NOT NULL,
+		made_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (recipe_id, caller)
+	)`,
+	`CREATE TABLE IF NOT EXISTS featured_recipes (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		recipe_id INT NOT NULL,
+		slot VARCHAR(32) NOT NULL,
+		position INT NOT NULL DEFAULT 0,
+		headline VARCHAR(200) NOT NULL DEFAULT '',
+		starts_at TIMESTAMP NULL,
+		ends_at TIMESTAMP NULL,
+		created_by VARCHAR(128) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_featured_recipes_slot (slot, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS collections (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		slug VARCHAR(64) NOT NULL UNIQUE,
+		title VARCHAR(200) NOT NULL,
+		description TEXT NOT NULL,
+		cover_image VARCHAR(500) NOT NULL DEFAULT '',
+		published BOOLEAN NOT NULL DEFAULT TRUE,
+		created_by VARCHAR(128) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_collections_published (published, updated_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS collection_recipes (
+		collection_id INT NOT NULL,
+		recipe_id INT NOT NULL,
+		position INT NOT NULL,
+		PRIMARY KEY (collection_id, recipe_id),
+		INDEX idx_collection_recipes_position (collection_id, position)
+	)`,
+	`ALTER TABLE ingredient_nutrition ADD COLUMN glycemic_index DECIMAL(5,1) NULL`,
+	// Seed glycemic indexes (glucose = 100) from the international GI
+	// tables once; after that the admin API owns them.
+	`UPDATE ingredient_nutrition SET glycemic_index = CASE ingredient
+			WHEN 'flour' THEN 70 WHEN 'sugar' THEN 65 WHEN 'brown sugar' THEN 64 WHEN 'honey' THEN 58
+			WHEN 'rice' THEN 73 WHEN 'pasta' THEN 49 WHEN 'bread' THEN 75 WHEN 'oats' THEN 55
+			WHEN 'potato' THEN 78 WHEN 'carrot' THEN 39 WHEN 'banana' THEN 51 WHEN 'apple' THEN 36
+			WHEN 'beans' THEN 24 WHEN 'chickpea' THEN 28 WHEN 'lentils' THEN 32 WHEN 'milk' THEN 39
+			WHEN 'yogurt' THEN 41 WHEN 'peanut butter' THEN 14 WHEN 'nuts' THEN 15
+			ELSE 15 END
+		WHERE ingredient IN ('flour', 'sugar', 'brown sugar', 'honey', 'rice', 'pasta', 'bread', 'oats', 'potato', 'carrot',
+			'banana', 'apple', 'beans', 'chickpea', 'lentils', 'milk', 'yogurt', 'peanut butter', 'nuts',
+			'onion', 'garlic', 'tomato', 'bell pepper', 'spinach', 'broccoli', 'mushroom', 'lemon', 'lemon juice', 'tofu')
+		AND NOT EXISTS (SELECT 1 FROM (SELECT 1 FROM ingredient_nutrition WHERE glycemic_index IS NOT NULL) seeded)`,
+	`ALTER TABLE recipes ADD COLUMN glycemic_index DECIMAL(5,1) NULL`,
+	`ALTER TABLE recipes ADD COLUMN glycemic_load DECIMAL(6,1) NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_glycemic_load (glycemic_load)`,
+	`CREATE TABLE IF NOT EXISTS nutrition_targets (
+		owner VARCHAR(64) PRIMARY KEY,
+		calories INT NOT NULL,
+		min_protein DECIMAL(6,1) NULL,
+		max_protein DECIMAL(6,1) NULL,
+		min_carbs DECIMAL(6,1) NULL,
+		max_carbs DECIMAL(6,1) NULL,
+		min_fat DECIMAL(6,1) NULL,
+		max_fat DECIMAL(6,1) NULL,
+		max_sodium DECIMAL(7,1) NULL,
+		time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`,
+	`ALTER TABLE recipes ADD COLUMN submitted_from VARCHAR(64) NULL`,
+	`ALTER TABLE recipes ADD INDEX idx_recipes_submitted_from (submitted_from, status)`,
+	// A reporter has at most one open report per recipe. Drop duplicates
+	// left by the old update-then-insert before adding the unique key.
+	`DELETE older FROM recipe_reports older JOIN recipe_reports newer
+		ON newer.recipe_id = older.recipe_id AND newer.reporter = older.reporter
+		AND newer.status = 'open' AND older.status = 'open' AND newer.id > older.id`,
+	`ALTER TABLE recipe_reports ADD COLUMN open_reporter VARCHAR(64) AS (IF(status = 'open', reporter, NULL)) STORED`,
+	`ALTER TABLE recipe_reports ADD UNIQUE INDEX idx_recipe_reports_open (recipe_id, open_reporter)`,
+	`ALTER TABLE recipe_reports ADD COLUMN issued BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE saved_searches ADD COLUMN email_confirm_token CHAR(64) NULL`,
+	`ALTER TABLE saved_searches ADD COLUMN email_confirmed_at TIMESTAMP NULL`,
+	`ALTER TABLE saved_searches ADD UNIQUE INDEX idx_saved_searches_confirm (email_confirm_token)`,
+	// Addresses saved before confirmation existed keep their alerts.
+	`UPDATE saved_searches SET email_confirmed_at = created_at WHERE email IS NOT NULL AND email_confirmed_at IS NULL AND email_confirm_token IS NULL`,
+}
+
+// schemaVersion identifies this build's schemaStatements. It is recorded
+// once they have all applied, so later starts skip them until the list
+// changes.
+var schemaVersion = func() string {
+	hash := sha256.New()
+	for _, stmt := range schemaStatements {
+		hash.Write([]byte(stmt))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}()
+
+// ensureSchema applies schemaStatements unless the database already records
+// schemaVersion. A failed statement is logged and the rest still run; the
+// failures are returned together, and the version is only recorded when
+// there are none.
+func ensureSchema() error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		id TINYINT PRIMARY KEY,
+		version CHAR(64) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`); err != nil {
+		return err
+	}
+	var applied string
+	if err := db.QueryRow(`SELECT version FROM schema_version WHERE id = 1`).Scan(&applied); err == nil && applied == schemaVersion {
+		return nil
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var failures []error
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil && !isDuplicateSchemaError(err) {
+			slog.Error("schema statement failed", "error", err)
+			failures = append(failures, err)
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Join(failures...)
+	}
+	_, err := db.Exec(`INSERT INTO schema_version (id, version) VALUES (1, ?)
+		ON DUPLICATE KEY UPDATE version = VALUES(version)`, schemaVersion)
+	return err
+}
+
+// isDuplicateSchemaError matches MySQL's duplicate column and duplicate key
+// errors, which mean an ALTER statement has already been applied.
+func isDuplicateSchemaError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1060 || mysqlErr.Number == 1061)
+}
+
+func bearerToken(c *gin.Context) string {
+	return strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+}
+
+// Admin permissions, checked per endpoint by requirePermission.
+const (
+	permConfigRead      = "config:read"
+	permUsageRead       = "usage:read"
+	permMCPTokensManage = "mcp_tokens:manage"
+	permRecipesModerate = "recipes:moderate"
+	permRecipesWrite    = "recipes:write"
+	permDietPlansWrite  = "diet_plans:write"
+	permCachePurge      = "cache:purge"
+	permSearchReindex   = "search:reindex"
+	permAuditRead       = "audit:read"
+	permSynonymsWrite   = "synonyms:write"
+	permPricesWrite     = "prices:write"
+	permEmissionsWrite  = "emissions:write"
+	permPairingsWrite   = "pairings:write"
+	permNutritionWrite  = "nutrition:write"
+	permTenantsManage   = "tenants:manage"
+	permQuotasWrite     = "quotas:write"
+	permFeaturesWrite   = "features:write"
+	permBackupManage    = "backup:manage"
+	permCurationWrite   = "curation:write"
+)
+
+// rolePermissions maps admin roles to what they may do. "admin" has every
+// permission.
+var rolePermissions = map[string][]string{
+	"admin":  {"*"},
+	"editor": {permRecipesModerate, permRecipesWrite, permDietPlansWrite, permSynonymsWrite, permPricesWrite, permEmissionsWrite, permPairingsWrite, permNutritionWrite, permCurationWrite},
+	"ops":    {permConfigRead, permUsageRead, permMCPTokensManage, permCachePurge, permSearchReindex, permAuditRead, permTenantsManage, permQuotasWrite, permFeaturesWrite},
+}
+
+// AdminPrincipal is the authenticated caller of an admin endpoint.
+type AdminPrincipal struct {
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles"`
+}
+
+func (p AdminPrincipal) can(permission string) bool {
+	for _, role := range p.Roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == "*" || granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p AdminPrincipal) permissions() []string {
+	seen := map[string]bool{}
+	perms := []string{}
+	for _, role := range p.Roles {
+		for _, granted := range rolePermissions[role] {
+			if !seen[granted] {
+				seen[granted] = true
+				perms = append(perms, granted)
+			}
+		}
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+// parseAdminJWT verifies an HS256 token signed with ADMIN_JWT_SECRET and
+// returns its subject and roles. Roles come from a "roles" array or a single
+// "role" claim.
+func parseAdminJWT(token string) (AdminPrincipal, error) {
+	if cfg.AdminJWTSecret == "" {
+		return AdminPrincipal{}, errors.New("JWT auth is not configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return AdminPrincipal{}, errors.New("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return AdminPrincipal{}, errors.New("malformed token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if json.Unmarshal(headerJSON, &header) != nil || header.Alg != "HS256" {
+		return AdminPrincipal{}, errors.New("unsupported token algorithm")
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.AdminJWTSecret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return AdminPrincipal{}, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return AdminPrincipal{}, errors.New("malformed token payload")
+	}
+	var claims struct {
+		Sub   string   `json:"sub"`
+		Role  string   `json:"role"`
+		Roles []string `json:"roles"`
+		Exp   int64    `json:"exp"`
+		Nbf   int64    `json:"nbf"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return AdminPrincipal{}, errors.New("malformed token claims")
+	}
+	now := time.Now().Unix()
+	if claims.Exp == 0 || now >= claims.Exp {
+		return AdminPrincipal{}, errors.New("token expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return AdminPrincipal{}, errors.New("token not yet valid")
+	}
+
+	roles := claims.Roles
+	if claims.Role != "" {
+		roles = append(roles, claims.Role)
+	}
+	return AdminPrincipal{Subject: claims.Sub, Roles: roles}, nil
+}
+
+// requireAdmin authenticates the admin group. The static ADMIN_TOKEN acts
+// as a full admin; anything else must be a signed JWT carrying admin roles.
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		principal, err := adminPrincipal(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if len(principal.permissions()) == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "No admin role"})
+			return
+		}
+
+		c.Set("admin", principal)
+		c.Next()
+	}
+}
+
+// adminPrincipal authenticates an admin bearer token: the static
+// ADMIN_TOKEN or a signed JWT.
+func adminPrincipal(token string) (AdminPrincipal, error) {
+	if cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1 {
+		return AdminPrincipal{Subject: "admin-token", Roles: []string{"admin"}}, nil
+	}
+	return parseAdminJWT(token)
+}
+
+func adminFromContext(c *gin.Context) AdminPrincipal {
+	if principal, ok := c.Get("admin"); ok {
+		return principal.(AdminPrincipal)
+	}
+	return AdminPrincipal{}
+}
+
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !adminFromContext(c).can(permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission})
+			return
+		}
+		c.Next()
+	}
+}
+
+func getAdminMe(c *gin.Context) {
+	principal := adminFromContext(c)
+	c.JSON(http.StatusOK, gin.H{
+		"subject":     principal.Subject,
+		"roles":       principal.Roles,
+		"permissions": principal.permissions(),
+	})
+}
+
+// MCP Server Handlers
+
+// handleMCPRequest implements the POST side of the MCP Streamable HTTP
+// transport. A body may hold a single message or a batch; when it holds only
+// notifications or responses the reply is 202 with no body. Requests are
+// answered as JSON, or as an SSE stream for clients that only accept
+// text/event-stream.
+//
+// Sessions are optional: initialize hands out an Mcp-Session-Id, and a request
+// carrying an unknown, expired or terminated one gets a 404 so the client
+// re-initializes. Requests without the header are served statelessly.
+// initialize must be sent on its own, never in a batch.
+func handleMCPRequest(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, MCPResponse{
+			JSONRPC: "2.0",
+			Error:   &MCPError{Code: -32700, Message: "Parse error"},
+		})
+		return
+	}
+
+	sessionID := c.GetHeader("Mcp-Session-Id")
+	if sessionID != "" && !validMCPSession(sessionID) {
+		c.JSON(http.StatusNotFound, MCPResponse{
+			JSONRPC: "2.0",
+			Error:   &MCPError{Code: -32001, Message: "Session not found"},
+		})
+		return
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	batch := len(trimmed) > 0 && trimmed[0] == '['
+
+	var reqs []MCPRequest
+	if batch {
+		err = json.Unmarshal(trimmed, &reqs)
+	} else {
+		var req MCPRequest
+		err = json.Unmarshal(trimmed, &req)
+		reqs = []MCPRequest{req}
+	}
+	if err != nil || len(reqs) == 0 {
+		c.JSON(http.StatusBadRequest, MCPResponse{
+			JSONRPC: "2.0",
+			Error:   &MCPError{Code: -32700, Message: "Parse error"},
+		})
+		return
+	}
+
+	responses := []MCPResponse{}
+	for _, req := range reqs {
+		if req.ID == nil || req.Method == "" {
+			continue
+		}
+		if req.Method == "initialize" && batch {
+			responses = append(responses, MCPResponse{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Error:   &MCPError{Code: -32600, Message: "initialize must not be part of a batch"},
+			})
+			continue
+		}
+		if req.Method == "initialize" && sessionID == "" {
+			sessionID = newMCPSessionID()
+			c.Header("Mcp-Session-Id", sessionID)
+		}
+		responses = append(responses, dispatchMCP(mcpClientFromContext(c), req))
+	}
+
+	if len(responses) == 0 {
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	var payload interface{} = responses[0]
+	if batch {
+		payload = responses
+	}
+
+	accept := c.GetHeader("Accept")
+	if strings.Contains(accept, "text/event-stream") && !strings.Contains(accept, "application/json") {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Status(http.StatusOK)
+		writeSSEMessage(c.Writer, payload)
+		return
+	}
+
+	c.JSON(http.StatusOK, payload)
+}
+
+// MCPNotification is a server-to-client JSON-RPC notification.
+type MCPNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+var (
+	mcpSessionSecret     []byte
+	mcpSessionSecretOnce sync.Once
+	mcpClosedSessions    sync.Map // session ID -> when it would have expired
+	mcpStreams           = &mcpStreamHub{streams: map[chan []byte]string{}}
+)
+
+// mcpSecret signs session IDs so any instance can validate them. Without
+// MCP_SESSION_SECRET sessions only survive within one process.
+func mcpSecret() []byte {
+	mcpSessionSecretOnce.Do(func() {
+		if secret := cfg.MCP.SessionSecret; secret != "" {
+			mcpSessionSecret = []byte(secret)
+			return
+		}
+		mcpSessionSecret = make([]byte, 32)
+		rand.Read(mcpSessionSecret)
+	})
+	return mcpSessionSecret
+}
+
+func signMCPSession(nonce string) string {
+	mac := hmac.New(sha256.New, mcpSecret())
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// newMCPSessionID returns a signed ID carrying its issue time, so every
+// instance can tell when it expires.
+func newMCPSessionID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	nonce := hex.EncodeToString(raw) + "-" + strconv.FormatInt(time.Now().Unix(), 10)
+	return nonce + "." + signMCPSession(nonce)
+}
+
+// mcpSessionExpiry returns when a session ID stops being valid, or false if
+// it isn't one we signed.
+func mcpSessionExpiry(id string) (time.Time, bool) {
+	nonce, signature, ok := strings.Cut(id, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signMCPSession(nonce))) {
+		return time.Time{}, false
+	}
+	_, issued, ok := strings.Cut(nonce, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0).Add(cfg.MCP.SessionTTL), true
+}
+
+func validMCPSession(id string) bool {
+	expires, ok := mcpSessionExpiry(id)
+	if !ok || !time.Now().Before(expires) {
+		return false
+	}
+	_, closed := mcpClosedSessions.Load(id)
+	return !closed
+}
+
+// closeMCPSession terminates a session on this instance. A closed session
+// is only remembered until it would have expired anyway, which keeps the
+// set bounded by the sessions closed within one MCP_SESSION_TTL.
+func closeMCPSession(id string) {
+	now := time.Now()
+	mcpClosedSessions.Range(func(key, value interface{}) bool {
+		if !now.Before(value.(time.Time)) {
+			mcpClosedSessions.Delete(key)
+		}
+		return true
+	})
+	if expires, ok := mcpSessionExpiry(id); ok {
+		mcpClosedSessions.Store(id, expires)
+	}
+}
+
+// mcpStreamHub tracks the open GET /mcp event streams on this instance.
+type mcpStreamHub struct {
+	mu      sync.Mutex
+	streams map[chan []byte]string
+}
+
+func (h *mcpStreamHub) subscribe(sessionID string) chan []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan []byte, 16)
+	h.streams[ch] = sessionID
+	return ch
+}
+
+// unsubscribe closes the stream unless closeSession or closeAll already did.
+func (h *mcpStreamHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.streams[ch]; ok {
+		delete(h.streams, ch)
+		close(ch)
+	}
+}
+
+func (h *mcpStreamHub) closeSession(sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, id := range h.streams {
+		if id == sessionID {
+			delete(h.streams, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *mcpStreamHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.streams {
+		delete(h.streams, ch)
+		close(ch)
+	}
+}
+
+// broadcast sends a notification to every open stream, dropping it for
+// clients too slow to keep up.
+func (h *mcpStreamHub) broadcast(notification MCPNotification) {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.streams {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+func writeSSEMessage(w gin.ResponseWriter, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+	w.Flush()
+}
+
+// handleMCPStream is the GET side of the Streamable HTTP transport: an SSE
+// stream carrying server-initiated notifications for the session.
+func handleMCPStream(c *gin.Context) {
+	if !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := c.GetHeader("Mcp-Session-Id")
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing Mcp-Session-Id"})
+		return
+	}
+	if !validMCPSession(sessionID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	startMCPListWatcher()
+	ch := mcpStreams.subscribe(sessionID)
+	defer mcpStreams.unsubscribe(ch)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(cfg.MCP.SSEKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(c.Writer, ": keepalive\n\n")
+			c.Writer.Flush()
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(c.Writer, "event: message\ndata: %s\n\n", data)
+			c.Writer.Flush()
+		}
+	}
+}
+
+var mcpWatcherOnce sync.Once
+
+// startMCPListWatcher polls the list versions table and notifies every open
+// stream on this instance when the tool or resource list has changed,
+// wherever the change was made.
+func startMCPListWatcher() {
+	mcpWatcherOnce.Do(func() {
+		go func() {
+			seen, _ := mcpListVersions()
+			ticker := time.NewTicker(cfg.MCP.ListPollInterval)
+			for range ticker.C {
+				current, err := mcpListVersions()
+				if err != nil {
+					continue
+				}
+				for list, version := range current {
+					if version != seen[list] {
+						mcpStreams.broadcast(MCPNotification{JSONRPC: "2.0", Method: "notifications/" + list + "/list_changed"})
+					}
+				}
+				seen = current
+			}
+		}()
+	})
+}
+
+func mcpListVersions() (map[string]int64, error) {
+	rows, err := db.Query("SELECT list, version FROM mcp_list_versions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[string]int64{}
+	for rows.Next() {
+		var list string
+		var version int64
+		if err := rows.Scan(&list, &version); err != nil {
+			return nil, err
+		}
+		versions[list] = version
+	}
+	return versions, rows.Err()
+}
+
+// notifyMCPListChanged records that the "tools" or "resources" list changed
+// so connected MCP clients re-fetch it.
+func notifyMCPListChanged(list string) {
+	_, err := db.Exec("INSERT INTO mcp_list_versions (list, version) VALUES (?, 1) ON DUPLICATE KEY UPDATE version = version + 1", list)
+	if err != nil {
+		slog.Error("mcp list version update failed", "list", list, "error", err)
+	}
+}
+
+// handleMCPDelete lets a client terminate its session explicitly.
+func handleMCPDelete(c *gin.Context) {
+	sessionID := c.GetHeader("Mcp-Session-Id")
+	if sessionID == "" || !validMCPSession(sessionID) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	closeMCPSession(sessionID)
+	mcpStreams.closeSession(sessionID)
+	c.Status(http.StatusNoContent)
+}
+
+// MCPClient is the caller behind an MCP request and the tools it may use.
+// A "*" entry allows every tool.
+type MCPClient struct {
+	TokenID int      `json:"token_id,omitempty"`
+	Name    string   `json:"name"`
+	Tools   []string `json:"tools"`
+	// Tenant is the token's tenant, or for anonymous clients the one the
+	// request resolved to.
+	Tenant *Tenant `json:"-"`
+}
+
+func (client MCPClient) canUse(tool string) bool {
+	for _, allowed := range client.Tools {
+		if allowed == "*" || allowed == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// mcpReadOnlyTools are the tools that never modify data. They are what
+// anonymous clients get when MCP_ALLOW_ANONYMOUS is set.
+var mcpReadOnlyTools = []string{
+	"search_recipes", "get_recipe", "get_diet_plans",
+	"generate_meal_plan", "build_shopping_list", "summarize_nutrition",
+}
+
+// mcpLocalClient is used for the stdio transport, where the operator who
+// launched the process already has full access.
+var mcpLocalClient = MCPClient{Name: "local", Tools: []string{"*"}}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requireMCPToken authenticates /mcp requests with a bearer token minted
+// through the admin API.
+func requireMCPToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			if cfg.MCP.AllowAnonymous {
+				c.Set("mcp_client", MCPClient{Name: "anonymous", Tools: mcpReadOnlyTools, Tenant: tenantFromContext(c)})
+				c.Next()
+				return
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="mcp"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+
+		var client MCPClient
+		var toolsJSON string
+		var tenantID sql.NullString
+		err := db.QueryRow("SELECT id, name, tools, tenant_id FROM mcp_tokens WHERE token_hash = ? AND revoked_at IS NULL", hashToken(token)).
+			Scan(&client.TokenID, &client.Name, &toolsJSON, &tenantID)
+		if err == sql.ErrNoRows {
+			c.Header("WWW-Authenticate", `Bearer realm="mcp", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		json.Unmarshal([]byte(toolsJSON), &client.Tools)
+		if tenantID.Valid {
+			client.Tenant, err = tenants.get(tenantID.String)
+			if err != nil || client.Tenant == nil {
+				// Serving the global catalog instead would leak across tenants.
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Tenant unavailable"})
+				return
+			}
+		}
+
+		touchMCPToken(client.TokenID, requestLogger(c))
+		c.Set("mcp_client", client)
+		c.Next()
+	}
+}
+
+// mcpTokenTouchInterval is how stale a token's last_used_at may get; it
+// only has to tell active tokens from abandoned ones.
+const mcpTokenTouchInterval = time.Minute
+
+var mcpTokenTouched sync.Map // token ID -> when last_used_at was last written
+
+// touchMCPToken records that a token was used, at most once per interval
+// and off the request path.
+func touchMCPToken(id int, logger *slog.Logger) {
+	now := time.Now()
+	if last, ok := mcpTokenTouched.Load(id); ok && now.Sub(last.(time.Time)) < mcpTokenTouchInterval {
+		return
+	}
+	mcpTokenTouched.Store(id, now)
+	go func() {
+		if _, err := db.Exec("UPDATE mcp_tokens SET last_used_at = NOW() WHERE id = ?", id); err != nil {
+			logger.Warn("mcp token last_used_at update failed", "token_id", id, "error", err)
+		}
+	}()
+}
+
+func mcpClientFromContext(c *gin.Context) MCPClient {
+	if client, ok := c.Get("mcp_client"); ok {
+		return client.(MCPClient)
+	}
+	return MCPClient{}
+}
+
+type CreateMCPTokenRequest struct {
+	Name     string   `json:"name" binding:"required"`
+	Tools    []string `json:"tools"`
+	TenantID *string  `json:"tenant_id"`
+}
+
+// createMCPToken mints a token. The plaintext is only returned here; we
+// store its hash.
+func createMCPToken(c *gin.Context) {
+	var req CreateMCPTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if len(req.Tools) == 0 {
+		req.Tools = mcpReadOnlyTools
+	}
+	if req.TenantID != nil {
+		if tenant, err := tenants.get(*req.TenantID); err != nil || tenant == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tenant"})
+			return
+		}
+	}
+
+	id, token, err := mintMCPToken(req.Name, req.Tools, req.TenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":        id,
+		"name":      req.Name,
+		"tools":     req.Tools,
+		"tenant_id": req.TenantID,
+		"token":     token,
+	})
+}
+
+func mintMCPToken(name string, tools []string, tenantID *string) (int64, string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, "", err
+	}
+	token := "mcp_" + hex.EncodeToString(raw)
+	toolsJSON, _ := json.Marshal(tools)
+
+	res, err := db.Exec("INSERT INTO mcp_tokens (name, token_hash, tools, tenant_id) VALUES (?, ?, ?, ?)", name, hashToken(token), string(toolsJSON), tenantID)
+	if err != nil {
+		return 0, "", err
+	}
+	id, _ := res.LastInsertId()
+	return id, token, nil
+}
+
+func listMCPTokens(c *gin.Context) {
+	rows, err := db.Query("SELECT id, name, tools, created_at, last_used_at, revoked_at FROM mcp_tokens ORDER BY id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	tokens := []gin.H{}
+	for rows.Next() {
+		var id int
+		var name, toolsJSON string
+		var createdAt time.Time
+		var lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&id, &name, &toolsJSON, &createdAt, &lastUsedAt, &revokedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var tools []string
+		json.Unmarshal([]byte(toolsJSON), &tools)
+
+		token := gin.H{"id": id, "name": name, "tools": tools, "created_at": createdAt, "last_used_at": nil, "revoked_at": nil}
+		if lastUsedAt.Valid {
+			token["last_used_at"] = lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			token["revoked_at"] = revokedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+type UpdateMCPTokenRequest struct {
+	Tools []string `json:"tools" binding:"required"`
+}
+
+// updateMCPToken replaces a token's tool allowlist, which changes the tool
+// list its clients see.
+func updateMCPToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	var req UpdateMCPTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	toolsJSON, _ := json.Marshal(req.Tools)
+	res, err := db.Exec("UPDATE mcp_tokens SET tools = ? WHERE id = ? AND revoked_at IS NULL", string(toolsJSON), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	notifyMCPListChanged("tools")
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "tools": req.Tools})
+}
+
+func revokeMCPToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	res, err := db.Exec("UPDATE mcp_tokens SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "revoked": true})
+}
+
+// dispatchMCP routes a JSON-RPC request to its MCP method. It is shared by
+// the HTTP endpoint and the stdio transport.
+func dispatchMCP(client MCPClient, req MCPRequest) MCPResponse {
+	switch req.Method {
+	case "initialize":
+		return mcpInitialize(req)
+	case "ping":
+		return MCPResponse{JSONRPC: "2.0", ID: req.ID, Result: map[string]interface{}{}}
+	case "tools/list":
+		return mcpToolsList(client, req)
+	case "tools/call":
+		return mcpToolCall(client, req)
+	case "resources/list":
+		return mcpResourcesList(req)
+	case "resources/read":
+		return mcpResourcesRead(client, req)
+	case "resources/templates/list":
+		return MCPResponse{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Result: map[string]interface{}{
+				"resourceTemplates": []map[string]interface{}{
+					{
+						"uriTemplate": "recipe://recipes/{id}",
+						"name":        "Recipe",
+						"description": "A single recipe by ID",
+						"mimeType":    "application/json",
+					},
+				},
+			},
+		}
+	default:
+		return MCPResponse{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Error: &MCPError{
+				Code:    -32601,
+				Message: "Method not found",
+			},
+		}
+	}
+}
+
+// ServeMCPStdio speaks newline-delimited JSON-RPC over the given streams, as
+// MCP clients expect when they spawn the server as a subprocess. Notifications
+// get no reply, and logs must go to stderr to keep stdout clean.
+func ServeMCPStdio(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(out)
+	encode := func(v interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return encoder.Encode(v)
+	}
+
+	startMCPListWatcher()
+	notifications := mcpStreams.subscribe("stdio")
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for data := range notifications {
+			encode(json.RawMessage(data))
+		}
+	}()
+	// Nothing may reach out once we return.
+	defer func() {
+		mcpStreams.unsubscribe(notifications)
+		<-forwarded
+	}()
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var req MCPRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			if err := encode(MCPResponse{
+				JSONRPC: "2.0",
+				Error:   &MCPError{Code: -32700, Message: "Parse error"},
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if req.ID == nil {
+			continue
+		}
+
+		if err := encode(dispatchMCP(mcpLocalClient, req)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// mcpProtocolVersions lists the protocol revisions we speak, newest first.
+var mcpProtocolVersions = []string{"2025-03-26", "2024-11-05"}
+
+func mcpInitialize(req MCPRequest) MCPResponse {
+	version := mcpProtocolVersions[0]
+	if params, ok := req.Params.(map[string]interface{}); ok {
+		if requested, ok := params["protocolVersion"].(string); ok {
+			for _, supported := range mcpProtocolVersions {
+				if requested == supported {
+					version = requested
+				}
+			}
+		}
+	}
+
+	result := map[string]interface{}{
+		"protocolVersion": version,
+		"capabilities": map[string]interface{}{
+			"tools": map[string]interface{}{
+				"listChanged": true,
+			},
+			"resources": map[string]interface{}{
+				"subscribe": false,
+				"listChanged": true,
+			},
+		},
+		"serverInfo": map[string]interface{}{
+			"name":    "recipe-server",
+			"version": "1.0.0",
+		},
+	}
+
+	return MCPResponse{
+		JSONRPC: "2.0",
+		ID:      req.ID,
+		Result:  result,
+	}
+}
+
+// mcpTools are the tools we offer; tools/list shows each client the ones
+// it may use.
+func mcpTools(tenant *Tenant) []MCPTool {
+	return []MCPTool{
+		{
+			Name:        "search_recipes",
+			Description: "Search for recipes based on various criteria including diet plans, ingredients, nutritional values, and preparation time",
+			InputSchema: searchRecipesSchema(tenant),
+		},
+		{
+			Name:        "get_recipe",
+			Description: "Get detailed information about a specific recipe by ID",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"id": map[string]interface{}{
+						"type":        "integer",
+						"description": "Recipe ID",
+					},
+				},
+				"required": []string{"id"},
+			},
+		},
+		{
+			Name:        "get_diet_plans",
+			Description: "Get list of available diet plans with their descriptions and filters",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{},
+			},
+		},
+		{
+			Name:        "generate_meal_plan",
+			Description: "Build a multi-day meal plan from catalog recipes that fits a daily calorie target, diet and ingredient constraints",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"days": map[string]interface{}{
+						"type":        "integer",
+						"description": "Number of days to plan (1-14, default 7)",
+						"minimum":     1,
+						"maximum":     14,
+					},
+					"calories_per_day": map[string]interface{}{
+						"type":        "integer",
+						"description": "Daily calorie target (default 2000)",
+					},
+					"meals_per_day": map[string]interface{}{
+						"type":        "integer",
+						"description": "Meals per day: 2 (lunch, dinner), 3 (adds breakfast) or 4 (adds a snack)",
+						"enum":        []int{2, 3, 4},
+					},
+					"diet": map[string]interface{}{
+						"type":        "string",
+						"description": "Diet plan key, see get_diet_plans",
+					},
+					"include_ingredients": map[string]interface{}{
+						"type":        "array",
+						"description": "Ingredients to prefer",
+						"items":       map[string]interface{}{"type": "string"},
+					},
+					"exclude_ingredients": map[string]interface{}{
+						"type":        "array",
+						"description": "Ingredients to avoid",
+						"items":       map[string]interface{}{"type": "string"},
+					},
+					"max_time": map[string]interface{}{
+						"type":        "integer",
+						"description": "Maximum total time in minutes for every meal",
+					},
+					"max_dinner_time": map[string]interface{}{
+						"type":        "integer",
+						"description": "Maximum total time in minutes for dinners",
+					},
+					"max_cost_per_serving": map[string]interface{}{
+						"type":        "number",
+						"description": "Maximum estimated cost per serving; recipes without an estimate are skipped",
+					},
+					"macro_split": map[string]interface{}{
+						"type":        "string",
+						"description": "Target share of calories from protein/carbs/fat in percent, e.g. 30/40/30",
+					},
+					"macro_tolerance": map[string]interface{}{
+						"type":        "number",
+						"description": "Percentage points each macro may differ from macro_split (default 5)",
+					},
+				},
+			},
+		},
+		{
+			Name:        "build_shopping_list",
+			Description: "Consolidate the ingredients of several recipes, scaled to the requested servings, into one shopping list",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"recipes": map[string]interface{}{
+						"type":        "array",
+						"description": "Recipes to include, each with an optional number of servings (defaults to the recipe's yield)",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"id":       map[string]interface{}{"type": "integer", "description": "Recipe ID"},
+								"servings": map[string]interface{}{"type": "number", "description": "Number of servings"},
+							},
+							"required": []string{"id"},
+						},
+					},
+				},
+				"required": []string{"recipes"},
+			},
+		},
+		{
+			Name:        "summarize_nutrition",
+			Description: "Total the nutrition of several recipes at the given servings, with per-recipe breakdown and macro split",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"recipes": map[string]interface{}{
+						"type":        "array",
+						"description": "Recipes to include, each with an optional number of servings (defaults to the recipe's yield)",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"id":       map[string]interface{}{"type": "integer", "description": "Recipe ID"},
+								"servings": map[string]interface{}{"type": "number", "description": "Number of servings"},
+							},
+							"required": []string{"id"},
+						},
+					},
+				},
+				"required": []string{"recipes"},
+			},
+		},
+	}
+}
+
+func mcpToolsList(client MCPClient, req MCPRequest) MCPResponse {
+	allowed := []MCPTool{}
+	for _, tool := range mcpTools(client.Tenant) {
+		if client.canUse(tool.Name) {
+			allowed = append(allowed, tool)
+		}
+	}
+
+	return MCPResponse{
+		JSONRPC: "2.0",
+		ID:      req.ID,
+		Result: map[string]interface{}{
+			"tools": allowed,
+		},
+	}
+}
+
+// mcpToolCall runs a tool. Malformed calls and unknown tools are JSON-RPC
+// errors; failures while executing a valid call are reported in the result
+// with isError so the model can see and react to them.
+func mcpToolCall(client MCPClient, req MCPRequest) MCPResponse {
+	params, ok := req.Params.(map[string]interface{})
+	if !ok {
+		return MCPResponse{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Error: &MCPError{Code: -32602, Message: "Invalid params"},
+		}
+	}
+
+	name, _ := params["name"].(string)
+	arguments, _ := params["arguments"].(map[string]interface{})
+
+	if !client.canUse(name) {
+		return MCPResponse{
+			JSONRPC: "2.0", ID: req.ID,
+			Error: &MCPError{Code: -32003, Message: "Tool not permitted for this client: " + name},
+		}
+	}
+
+	var result interface{}
+	var err error
+
+	switch name {
+	case "search_recipes":
+		result, err = mcpSearchRecipesJSON(client.Tenant, arguments)
+	case "get_recipe":
+		id, ok := arguments["id"].(float64)
+		if !ok {
+			return MCPResponse{
+				JSONRPC: "2.0", ID: req.ID,
+				Error: &MCPError{Code: -32602, Message: "Invalid recipe ID"},
+			}
+		}
+		var recipe Recipe
+		recipe, err = mcpGetRecipeJSON(client.Tenant, int(id))
+		if err == nil {
+			data, _ := json.MarshalIndent(recipe, "", "  ")
+			return MCPResponse{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Result: map[string]interface{}{
+					"content": []map[string]interface{}{
+						{
+							"type": "resource",
+							"resource": map[string]interface{}{
+								"uri":      fmt.Sprintf("recipe://recipes/%d", recipe.ID),
+								"mimeType": "application/json",
+								"text":     string(data),
+							},
+						},
+					},
+				},
+			}
+		}
+	case "get_diet_plans":
+		result = mcpGetDietPlansJSON(client.Tenant)
+	case "generate_meal_plan":
+		var planReq MealPlanRequest
+		if err := decodeMCPArguments(arguments, &planReq); err != nil {
+			return MCPResponse{
+				JSONRPC: "2.0", ID: req.ID,
+				Error: &MCPError{Code: -32602, Message: "Invalid arguments: " + err.Error()},
+			}
+		}
+		planReq.tenant = client.Tenant
+		result, err = buildMealPlan(planReq)
+	case "build_shopping_list", "summarize_nutrition":
+		var portionsReq PortionsRequest
+		if err := decodeMCPArguments(arguments, &portionsReq); err != nil || len(portionsReq.Recipes) == 0 {
+			return MCPResponse{
+				JSONRPC: "2.0", ID: req.ID,
+				Error: &MCPError{Code: -32602, Message: "Invalid arguments: recipes is required"},
+			}
+		}
+		if name == "build_shopping_list" {
+			result, err = buildShoppingList(client.Tenant, portionsReq.Recipes)
+		} else {
+			result, err = summarizeNutrition(client.Tenant, portionsReq.Recipes)
+		}
+	default:
+		return MCPResponse{
+			JSONRPC: "2.0", ID: req.ID,
+			Error: &MCPError{Code: -32602, Message: "Unknown tool: " + name},
+		}
+	}
+
+	return MCPResponse{
+		JSONRPC: "2.0",
+		ID:      req.ID,
+		Result:  mcpToolResult(result, err),
+	}
+}
+
+func mcpToolResult(result interface{}, err error) map[string]interface{} {
+	if err != nil {
+		return map[string]interface{}{
+			"content": []map[string]interface{}{
+				{"type": "text", "text": err.Error()},
+			},
+			"isError": true,
+		}
+	}
+
+	data, _ := json.MarshalIndent(result, "", "  ")
+	return map[string]interface{}{
+		"content": []map[string]interface{}{
+			{"type": "text", "text": string(data)},
+		},
+	}
+}
+
+func mcpResourcesList(req MCPRequest) MCPResponse {
+	resources := []MCPResource{
+		{
+			URI:         "recipe://diet-plans",
+			Name:        "Diet Plans",
+			Description: "Available diet plans and their configurations",
+			MimeType:    "application/json",
+		},
+	}
+
+	return MCPResponse{
+		JSONRPC: "2.0",
+		ID:      req.ID,
+		Result: map[string]interface{}{
+			"resources": resources,
+		},
+	}
+}
+
+func mcpResourcesRead(client MCPClient, req MCPRequest) MCPResponse {
+	params, ok := req.Params.(map[string]interface{})
+	if !ok {
+		return MCPResponse{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Error: &MCPError{
+				Code:    -32602,
+				Message: "Invalid params",
+			},
+		}
+	}
+
+	uri, _ := params["uri"].(string)
+
+	switch uri {
+	case "recipe://diet-plans":
+		data, _ := json.MarshalIndent(client.Tenant.dietPlans(), "", "  ")
+		return MCPResponse{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Result: map[string]interface{}{
+				"contents": []map[string]interface{}{
+					{
+						"uri":      uri,
+						"mimeType": "application/json",
+						"text":     string(data),
+					},
+				},
+			},
+		}
+	default:
+		if idStr, ok := strings.CutPrefix(uri, "recipe://recipes/"); ok {
+			if id, err := strconv.Atoi(idStr); err == nil {
+				if recipe, err := mcpGetRecipeJSON(client.Tenant, id); err == nil {
+					data, _ := json.MarshalIndent(recipe, "", "  ")
+					return MCPResponse{
+						JSONRPC: "2.0",
+						ID:      req.ID,
+						Result: map[string]interface{}{
+							"contents": []map[string]interface{}{
+								{
+									"uri":      uri,
+									"mimeType": "application/json",
+									"text":     string(data),
+								},
+							},
+						},
+					}
+				}
+			}
+		}
+		return MCPResponse{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Error: &MCPError{
+				Code:    -32002,
+				Message: "Resource not found",
+			},
+		}
+	}
+}
+
+func mcpSearchRecipesJSON(tenant *Tenant, args map[string]interface{}) (interface{}, error) {
+	scope, sqlArgs := tenant.recipeScope()
+	query := "SELECT " + recipeColumns + " FROM recipes WHERE " + scope
+
+	dietMode, _ := args["diet_mode"].(string)
+	dietMode, err := parseDietMode(dietMode)
+	if err != nil {
+		return nil, err
+	}
+	var dietPlan *DietPlan
+	if diet, ok := args["diet"].(string); ok && diet != "" {
+		if plan, exists := tenant.dietPlans()[diet]; exists {
+			query, sqlArgs = dietFilterSQL(query, sqlArgs, plan, dietMode)
+			dietPlan = &plan
+		}
+	}
+
+	if str, ok := args["restrictions"].(string); ok && str != "" {
+		condition, restrictionArgs, err := restrictionFilterSQL(str)
+		if err != nil {
+			return nil, err
+		}
+		query += condition
+		sqlArgs = append(sqlArgs, restrictionArgs...)
+	}
+
+	if str, ok := args["search"].(string); ok && str != "" {
+		condition, searchArgs := textSearchSQL(str)
+		query += condition
+		sqlArgs = append(sqlArgs, searchArgs...)
+	}
+
+	for key, exclude := range map[string]bool{
+		"include_ingredients": false,
+		"exclude_ingredients": true,
+	} {
+		if str, ok := args[key].(string); ok && str != "" {
+			for _, ingredient := range strings.Split(str, ",") {
+				condition, ingredientArgs := ingredientFilterSQL(ingredient, exclude)
+				query += condition
+				sqlArgs = append(sqlArgs, ingredientArgs...)
+			}
+		}
+	}
+
+	if str, ok := args["difficulty"].(string); ok && str != "" {
+		condition, difficultyArgs, err := difficultyFilterSQL(str)
+		if err != nil {
+			return nil, err
+		}
+		query += condition
+		sqlArgs = append(sqlArgs, difficultyArgs...)
+	}
+
+	for key, exclude := range map[string]bool{"equipment": false, "exclude_equipment": true} {
+		if str, ok := args[key].(string); ok && str != "" {
+			condition, equipmentArgs, err := equipmentFilterSQL(str, exclude)
+			if err != nil {
+				return nil, err
+			}
+			query += condition
+			sqlArgs = append(sqlArgs, equipmentArgs...)
+		}
+	}
+
+	if str, ok := args["cuisine"].(string); ok && str != "" {
+		condition, cuisineArgs, err := cuisineFilterSQL(str)
+		if err != nil {
+			return nil, err
+		}
+		query += condition
+		sqlArgs = append(sqlArgs, cuisineArgs...)
+	}
+
+	if val, ok := args["kid_friendly"].(bool); ok {
+		query += " AND kid_friendly = ?"
+		sqlArgs = append(sqlArgs, val)
+	}
+	if val, ok := args["has_image"].(bool); ok {
+		query += hasImageSQL(val)
+	}
+
+	split, _ := args["macro_split"].(string)
+	tolerance, _ := mcpNumberArg(args, "tolerance")
+	macro, err := parseMacroTarget(split, tolerance)
+	if err != nil {
+		return nil, err
+	}
+	if macro != nil {
+		condition, macroArgs := macro.filterSQL()
+		query += condition
+		sqlArgs = append(sqlArgs, macroArgs...)
+	}
+
+	for _, filter := range searchNumericFilters {
+		for _, bound := range []struct{ prefix, op string }{{"min_", ">="}, {"max_", "<="}} {
+			if val, ok := mcpNumberArg(args, bound.prefix+filter.Param); ok {
+				query += " AND " + filter.Column + " " + bound.op + " ?"
+				sqlArgs = append(sqlArgs, val)
+			}
+		}
+	}
+
+	sortBy := "id"
+	sortOrder := "asc"
+	if val, ok := args["sort_by"].(string); ok && val != "" {
+		sortBy = val
+	}
+	if val, ok := args["sort_order"].(string); ok && val != "" {
+		sortOrder = val
+	}
+	_, sortGiven := args["sort_by"].(string)
+
+	validSortColumns := map[string]bool{
+		"id": true, "name": true, "prep_time_minutes": true, "cook_time_minutes": true,
+		"total_time_minutes": true, "servings": true, "rating": true, "calories": true,
+		"protein": true, "fat": true, "carbs": true, "fiber": true, "sodium": true,
+		"difficulty": true, "cost_per_serving": true, "co2e_per_serving": true,
+		"times_made": true, "views": true, "glycemic_load": true,
+	}
+
+	if macro != nil && !sortGiven {
+		distance, distanceArgs := macro.distanceSQL()
+		query += " ORDER BY " + distance + ", id"
+		sqlArgs = append(sqlArgs, distanceArgs...)
+	} else if validSortColumns[sortBy] {
+		if sortOrder == "desc" {
+			query += " ORDER BY " + sortColumnSQL(sortBy) + " DESC"
+		} else {
+			query += " ORDER BY " + sortColumnSQL(sortBy) + " ASC"
+		}
+	}
+
+	limit := cfg.Search.MCPDefaultLimit
+	if val, ok := mcpNumberArg(args, "limit"); ok && val >= 1 && int(val) <= cfg.Search.MaxLimit {
+		limit = int(val)
+	}
+	offset := 0
+	if val, ok := mcpNumberArg(args, "offset"); ok && val > 0 {
+		offset = int(val)
+	}
+	query += " LIMIT ? OFFSET ?"
+	sqlArgs = append(sqlArgs, limit, offset)
+
+	rows, err := db.Query(query, sqlArgs...)
+	if err != nil {
+		return nil, err
+	}
+	recipes, skipped, err := scanRecipes(rows)
+	if err != nil {
+		return nil, err
+	}
+	if macro != nil {
+		annotateMacroSplits(recipes)
+	}
+
+	result := map[string]interface{}{
+		"recipes": recipes,
+		"count":   len(recipes),
+		"limit":   limit,
+		"offset":  offset,
+	}
+	if skipped > 0 {
+		result["skipped"] = skipped
+	}
+	if dietPlan != nil {
+		result["diet_mode"] = dietMode
+		if dietMode == dietModeLenient {
+			if flags := dietBorderline(recipes, *dietPlan); len(flags) > 0 {
+				result["diet_flags"] = flags
+			}
+		}
+	}
+	return result, nil
+}
+
+// mcpNumberArg reads a numeric tool argument sent either as a JSON number or
+// as a numeric string.
+func mcpNumberArg(args map[string]interface{}, key string) (float64, bool) {
+	switch value := args[key].(type) {
+	case float64:
+		return value, true
+	case string:
+		val, err := strconv.ParseFloat(value, 64)
+		return val, err == nil
+	}
+	return 0, false
+}
+
+// searchNumericFilters lists the range filters accepted as min_<param> and
+// max_<param> by both the REST search and the search_recipes tool.
+var searchNumericFilters = []struct {
+	Param       string
+	Column      string
+	Type        string
+	Description string
+}{
+	{"calories", "calories", "integer", "calories per serving"},
+	{"protein", "protein", "number", "protein in grams"},
+	{"fat", "fat", "number", "fat in grams"},
+	{"carbs", "carbs", "number", "carbs in grams"},
+	{"fiber", "fiber", "number", "fiber in grams"},
+	{"sodium", "sodium", "number", "sodium in mg"},
+	{"prep_time", "prep_time_minutes", "integer", "preparation time in minutes"},
+	{"cook_time", "cook_time_minutes", "integer", "cooking time in minutes"},
+	{"total_time", "total_time_minutes", "integer", "total time in minutes"},
+	{"servings", "servings", "integer", "number of servings"},
+	{"rating", "rating", "number", "rating (0-5)"},
+	{"cost", "cost_per_serving", "number", "estimated cost per serving"},
+	{"spice", "spice_level", "integer", "spice level from 0 (none) to 3 (hot)"},
+	{"co2e", "co2e_per_serving", "number", "estimated kg CO2e per serving"},
+	{"gi", "glycemic_index", "number", "estimated glycemic index (glucose = 100)"},
+	{"gl", "glycemic_load", "number", "estimated glycemic load per serving"},
+}
+
+func searchRecipesSchema(tenant *Tenant) map[string]interface{} {
+	plans := tenant.dietPlans()
+	dietKeys := make([]string, 0, len(plans))
+	for key := range plans {
+		dietKeys = append(dietKeys, key)
+	}
+	sort.Strings(dietKeys)
+
+	properties := map[string]interface{}{
+		"search": map[string]interface{}{
+			"type":        "string",
+			"description": "Text search in recipe name or description. Words must all match; use \"quoted phrases\" for exact phrases and -word to exclude",
+		},
+		"diet": map[string]interface{}{
+			"type":        "string",
+			"description": "Diet plan filter",
+			"enum":        dietKeys,
+		},
+		"diet_mode": map[string]interface{}{
+			"type":        "string",
+			"description": "How strictly diet excludes ingredients: lenient (default) matches the plan's keywords and flags borderline ingredients in diet_flags; strict also excludes whole ingredient classes and synonyms",
+			"enum":        []string{dietModeLenient, dietModeStrict},
+		},
+		"restrictions": map[string]interface{}{
+			"type":        "string",
+			"description": "Comma-separated religious or ethical restrictions, combinable with any diet: " + strings.Join(sortedKeys(restrictionBundles), ", "),
+		},
+		"include_ingredients": map[string]interface{}{
+			"type":        "string",
+			"description": "Comma-separated ingredients to include",
+		},
+		"exclude_ingredients": map[string]interface{}{
+			"type":        "string",
+			"description": "Comma-separated ingredients to exclude",
+		},
+		"sort_by": map[string]interface{}{
+			"type":        "string",
+			"description": "Sort field",
+			"enum": []string{"id", "name", "prep_time_minutes", "cook_time_minutes", "total_time_minutes",
+				"servings", "rating", "calories", "protein", "fat", "carbs", "fiber", "sodium", "difficulty", "cost_per_serving", "co2e_per_serving",
+				"times_made", "views", "glycemic_load"},
+		},
+		"difficulty": map[string]interface{}{
+			"type":        "string",
+			"description": "Comma-separated difficulty levels to include: easy, medium, hard",
+		},
+		"equipment": map[string]interface{}{
+			"type":        "string",
+			"description": "Comma-separated equipment, any of which the recipe uses: " + strings.Join(equipmentTags(), ", "),
+		},
+		"exclude_equipment": map[string]interface{}{
+			"type":        "string",
+			"description": "Comma-separated equipment the recipe must not need",
+		},
+		"cuisine": map[string]interface{}{
+			"type":        "string",
+			"description": "Comma-separated cuisines, any of which the recipe is labelled with: " + strings.Join(cuisineNames(), ", "),
+		},
+		"kid_friendly": map[string]interface{}{
+			"type":        "boolean",
+			"description": "Only recipes suitable (true) or unsuitable (false) for children",
+		},
+		"has_image": map[string]interface{}{
+			"type":        "boolean",
+			"description": "Only recipes with (true) or without (false) a working image",
+		},
+		"macro_split": map[string]interface{}{
+			"type":        "string",
+			"description": "Target share of calories from protein/carbs/fat in percent, e.g. 30/40/30; results are ordered by closeness unless sort_by is set",
+		},
+		"tolerance": map[string]interface{}{
+			"type":        "number",
+			"description": "Percentage points each macro may differ from macro_split (default 5)",
+		},
+		"sort_order": map[string]interface{}{
+			"type":        "string",
+			"description": "Sort order",
+			"enum":        []string{"asc", "desc"},
+		},
+		"limit": map[string]interface{}{
+			"type":        "integer",
+			"description": fmt.Sprintf("Maximum number of results (1-%d, default %d)", cfg.Search.MaxLimit, cfg.Search.MCPDefaultLimit),
+			"default":     cfg.Search.MCPDefaultLimit,
+			"minimum":     1,
+			"maximum":     cfg.Search.MaxLimit,
+		},
+		"offset": map[string]interface{}{
+			"type":        "integer",
+			"description": "Number of results to skip, for pagination",
+			"minimum":     0,
+		},
+	}
+
+	for _, filter := range searchNumericFilters {
+		properties["min_"+filter.Param] = map[string]interface{}{
+			"type":        filter.Type,
+			"description": "Minimum " + filter.Description,
+		}
+		properties["max_"+filter.Param] = map[string]interface{}{
+			"type":        filter.Type,
+			"description": "Maximum " + filter.Description,
+		}
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func mcpGetRecipeJSON(tenant *Tenant, id int) (Recipe, error) {
+	recipe, err := selectRecipes().Where("id = ?", id).Visible(tenant).Prepared().One()
+	if err == sql.ErrNoRows {
+		return recipe, fmt.Errorf("Recipe %d not found", id)
+	}
+	if err != nil {
+		return recipe, err
+	}
+
+	if err := loadRecipeEquipment(&recipe); err != nil {
+		return recipe, err
+	}
+	if err := loadRecipeStorage(&recipe); err != nil {
+		return recipe, err
+	}
+	if err := loadRecipeSteps(&recipe); err != nil {
+		return recipe, err
+	}
+	if err := loadNutritionEstimate(&recipe); err != nil {
+		return recipe, err
+	}
+	return recipe, loadRecipeImages(&recipe)
+}
+
+// decodeMCPArguments maps tool arguments onto the request struct used by
+// the matching REST endpoint.
+func decodeMCPArguments(arguments map[string]interface{}, dst interface{}) error {
+	data, err := json.Marshal(arguments)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func mcpGetDietPlansJSON(tenant *Tenant) interface{} {
+	return map[string]interface{}{
+		"diet_plans":   tenant.dietPlans(),
+		"restrictions": restrictionBundles,
+	}
+}
+
+// spellDictionary counts the words in published recipe names and
+// ingredients. It is rebuilt from the database every SEARCH_SPELL_REFRESH.
+type spellDictionary struct {
+	mu      sync.Mutex
+	words   map[string]int
+	builtAt time.Time
+}
+
+var searchSpelling = &spellDictionary{}
+
+// tenantSpelling holds a *spellDictionary per tenant, keyed by cacheKey.
+var tenantSpelling sync.Map
+
+// spellDictionaryFor returns the dictionary of the catalog the tenant sees.
+func spellDictionaryFor(tenant *Tenant) *spellDictionary {
+	if tenant == nil {
+		return searchSpelling
+	}
+	d, _ := tenantSpelling.LoadOrStore(tenant.cacheKey("spell_dictionary"), &spellDictionary{})
+	return d.(*spellDictionary)
+}
+
+func invalidateSpellDictionaries() {
+	searchSpelling.invalidate()
+	tenantSpelling.Range(func(key, _ interface{}) bool {
+		tenantSpelling.Delete(key)
+		return true
+	})
+}
+
+var searchWordPattern = regexp.MustCompile(`\pL+`)
+
+func (d *spellDictionary) load(tenant *Tenant) (map[string]int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.words != nil && time.Since(d.builtAt) < cfg.Search.SpellRefresh {
+		recordCacheLookup("spell_dictionary", true)
+		return d.words, nil
+	}
+	recordCacheLookup("spell_dictionary", false)
+
+	scope, args := tenant.recipeScope()
+	rows, err := db.Query("SELECT name, ingredients FROM recipes WHERE "+scope, args...)
+	if err != nil {
+		// A stale dictionary is better than no suggestions.
+		return d.words, err
+	}
+	defer rows.Close()
+
+	words := map[string]int{}
+	for rows.Next() {
+		var name, ingredients string
+		if err := rows.Scan(&name, &ingredients); err != nil {
+			continue
+		}
+		for _, word := range searchWordPattern.FindAllString(strings.ToLower(name+" "+ingredients), -1) {
+			words[word]++
+		}
+	}
+	d.words = words
+	d.builtAt = time.Now()
+	return words, rows.Err()
+}
+
+func (d *spellDictionary) invalidate() {
+	d.mu.Lock()
+	d.words = nil
+	d.mu.Unlock()
+}
+
+// editDistance is the optimal string alignment distance between a and b,
+// so a swapped pair of letters counts as one edit. It gives up and returns
+// limit+1 once every alignment is over limit.
+func editDistance(a, b []rune, limit int) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				curr[j] = min(curr[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, curr[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, curr = prev, curr, prev2
+	}
+	return prev[len(b)]
+}
+
+// closestWord finds the dictionary word nearest to word: one edit away for
+// short words, two for longer ones, preferring the most frequent on ties.
+func closestWord(word string, words map[string]int) (string, bool) {
+	target := []rune(word)
+	limit := 1
+	if len(target) > 4 {
+		limit = 2
+	}
+
+	best, bestDistance, bestCount := "", limit+1, 0
+	for candidate, count := range words {
+		runes := []rune(candidate)
+		if abs(len(runes)-len(target)) > limit {
+			continue
+		}
+		distance := editDistance(target, runes, limit)
+		if distance < bestDistance || (distance == bestDistance && (count > bestCount || (count == bestCount && candidate < best))) {
+			best, bestDistance, bestCount = candidate, distance, count
+		}
+	}
+	return best, bestDistance <= limit
+}
+
+// suggestSpelling replaces words in text that never appear in the catalog
+// with their closest known word ("chiken soup" -> "chicken soup"). It
+// reports false when nothing was changed.
+func suggestSpelling(tenant *Tenant, text string) (string, bool) {
+	words, err := spellDictionaryFor(tenant).load(tenant)
+	if err != nil {
+		slog.Warn("spell dictionary refresh failed", "error", err)
+	}
+	if len(words) == 0 {
+		return "", false
+	}
+
+	// Synonyms are real words even when the catalog only uses another name
+	// for the ingredient.
+	synonyms := ingredientSynonyms.load()
+	changed := false
+	corrected := searchWordPattern.ReplaceAllStringFunc(text, func(word string) string {
+		lower := strings.ToLower(word)
+		if utf8.RuneCountInString(lower) < 3 || words[lower] > 0 || len(synonyms[lower]) > 0 {
+			return word
+		}
+		if replacement, ok := closestWord(lower, words); ok {
+			changed = true
+			return replacement
+		}
+		return word
+	})
+	return corrected, changed
+}
+
+// synonymIndex maps each lowercase term to every term in its synonym group,
+// itself included. It is reloaded every SEARCH_SYNONYM_REFRESH, and at once
+// on the instance that handled an admin change.
+type synonymIndex struct {
+	mu     sync.Mutex
+	groups map[string][]string
+	// localized lists, per locale, each unlocalized term of a group with
+	// the group's name in that locale, longest term first.
+	localized map[string][]localizedName
+	// patterns holds every term with its compiled termPattern, in term
+	// order, so searches don't compile them per request.
+	patterns []synonymPattern
+	loadedAt time.Time
+}
+
+// localizedName is a term to rename in a locale, with its compiled
+// termPattern.
+type localizedName struct {
+	term    string
+	pattern *regexp.Regexp
+	name    string
+}
+
+type synonymPattern struct {
+	term    string
+	pattern *regexp.Regexp
+	group   []string
+}
+
+var ingredientSynonyms = &synonymIndex{}
+
+// maxSearchVariants caps how many synonym rewrites of one search string are
+// matched, since each adds two LIKE conditions.
+const maxSearchVariants = 8
+
+func (s *synonymIndex) load() map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.groups != nil && time.Since(s.loadedAt) < cfg.Search.SynonymRefresh {
+		recordCacheLookup("ingredient_synonyms", true)
+		return s.groups
+	}
+	recordCacheLookup("ingredient_synonyms", false)
+
+	rows, err := db.Query("SELECT term, canonical, locale FROM ingredient_synonyms ORDER BY canonical, term")
+	if err != nil {
+		slog.Warn("synonym reload failed", "error", err)
+		return s.groups
+	}
+	defer rows.Close()
+
+	members := map[string][]string{}
+	canonicalOf := map[string]string{}
+	localeOf := map[string]string{}
+	for rows.Next() {
+		var term, canonical string
+		var locale sql.NullString
+		if err := rows.Scan(&term, &canonical, &locale); err != nil {
+			continue
+		}
+		members[canonical] = append(members[canonical], term)
+		canonicalOf[term] = canonical
+		if locale.Valid {
+			localeOf[term] = locale.String
+		}
+	}
+	groups := map[string][]string{}
+	localized := map[string]map[string]string{}
+	for term, canonical := range canonicalOf {
+		groups[term] = members[canonical]
+		locale, ok := localeOf[term]
+		if !ok {
+			continue
+		}
+		if localized[locale] == nil {
+			localized[locale] = map[string]string{}
+		}
+		for _, member := range members[canonical] {
+			if _, isLocalized := localeOf[member]; !isLocalized {
+				if current, taken := localized[locale][member]; !taken || term < current {
+					localized[locale][member] = term
+				}
+			}
+		}
+	}
+	patterns := make([]synonymPattern, 0, len(groups))
+	for _, term := range sortedKeys(groups) {
+		patterns = append(patterns, synonymPattern{term: term, pattern: termPattern(term), group: groups[term]})
+	}
+	localizedNames := map[string][]localizedName{}
+	for locale, names := range localized {
+		terms := sortedKeys(names)
+		sort.SliceStable(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+		for _, term := range terms {
+			localizedNames[locale] = append(localizedNames[locale], localizedName{term: term, pattern: termPattern(term), name: names[term]})
+		}
+	}
+	s.groups, s.localized, s.patterns = groups, localizedNames, patterns
+	s.loadedAt = time.Now()
+	return groups
+}
+
+// names returns the ingredient names for a locale with the terms they
+// replace, or nil when the dictionary has none for it.
+func (s *synonymIndex) names(locale string) []localizedName {
+	s.load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.localized[locale]
+}
+
+// termPatterns returns the terms with their compiled patterns.
+func (s *synonymIndex) termPatterns() []synonymPattern {
+	s.load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.patterns
+}
+
+// termPattern matches term as a whole word, case-insensitively, with an
+// optional plural "s" or "es". Unlike \b it treats accented letters as
+// part of a word, so localized terms such as "épinards" match too. The
+// characters either side are captured.
+func termPattern(term string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(^|[^\p{L}\p{N}])` + regexp.QuoteMeta(term) + `(?:e?s)?($|[^\p{L}\p{N}])`)
+}
+
+// replaceTerm replaces whole-word matches of pattern in text, capitalizing
+// the replacement where the match was capitalized.
+func replaceTerm(text string, pattern *regexp.Regexp, with string) string {
+	return pattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := pattern.FindStringSubmatch(match)
+		replacement := with
+		word := strings.TrimSuffix(strings.TrimPrefix(match, parts[1]), parts[2])
+		if first, _ := utf8.DecodeRuneInString(word); unicode.IsUpper(first) {
+			r, size := utf8.DecodeRuneInString(with)
+			replacement = string(unicode.ToUpper(r)) + with[size:]
+		}
+		return parts[1] + replacement + parts[2]
+	})
+}
+
+// localizeIngredients names ingredients in the words of a locale's
+// dictionary, longest terms first so "spring onion" wins over "onion".
+func localizeIngredients(lines []string, names []localizedName) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		lower := strings.ToLower(line)
+		for _, name := range names {
+			if strings.Contains(lower, name.term) {
+				line = replaceTerm(line, name.pattern, name.name)
+				lower = strings.ToLower(line)
+			}
+		}
+		out[i] = line
+	}
+	return out
+}
+
+func (s *synonymIndex) invalidate() {
+	s.mu.Lock()
+	s.groups = nil
+	s.mu.Unlock()
+}
+
+// expand returns term followed by its synonyms.
+func (s *synonymIndex) expand(term string) []string {
+	terms := []string{term}
+	for _, synonym := range s.load()[strings.ToLower(term)] {
+		if synonym != strings.ToLower(term) {
+			terms = append(terms, synonym)
+		}
+	}
+	return terms
+}
+
+// searchVariants returns text plus rewrites of it with each synonym swapped
+// in for the terms it contains ("eggplant curry" -> "aubergine curry").
+func searchVariants(text string) []string {
+	variants := []string{text}
+	for _, entry := range ingredientSynonyms.termPatterns() {
+		if !entry.pattern.MatchString(text) {
+			continue
+		}
+		for _, variant := range variants {
+			for _, synonym := range entry.group {
+				if synonym == entry.term || len(variants) >= maxSearchVariants {
+					continue
+				}
+				rewritten := replaceTerm(variant, entry.pattern, synonym)
+				if rewritten != variant && !slices.Contains(variants, rewritten) {
+					variants = append(variants, rewritten)
+				}
+			}
+		}
+	}
+	return variants
+}
+
+// searchTerms is search text split into what must and must not appear.
+type searchTerms struct {
+	Include []string
+	Exclude []string
+}
+
+// parseSearchText splits search text into words and "quoted phrases"; a
+// leading minus (-word, -"some phrase") excludes the term instead. An
+// unclosed quote runs to the end of the text.
+func parseSearchText(text string) searchTerms {
+	var terms searchTerms
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		exclude := false
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			exclude = true
+			i++
+		}
+
+		var term string
+		if runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			term = strings.Join(strings.Fields(string(runes[i+1:end])), " ")
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) {
+				end++
+			}
+			term = string(runes[i:end])
+			i = end
+		}
+
+		if term == "" || term == "-" {
+			continue
+		}
+		if exclude {
+			terms.Exclude = append(terms.Exclude, term)
+		} else {
+			terms.Include = append(terms.Include, term)
+		}
+	}
+	return terms
+}
+
+// textSearchSQL matches search text against recipe names and descriptions.
+// Every word and quoted phrase must appear and every minus-prefixed one must
+// not; each term also matches with ingredient synonyms swapped in.
+func textSearchSQL(search string) (string, []interface{}) {
+	terms := parseSearchText(search)
+	query := ""
+	args := []interface{}{}
+	for _, term := range terms.Include {
+		conditions := []string{}
+		for _, variant := range searchVariants(term) {
+			conditions = append(conditions, "name LIKE ? OR description LIKE ?")
+			args = append(args, "%"+variant+"%", "%"+variant+"%")
+		}
+		query += " AND (" + strings.Join(conditions, " OR ") + ")"
+	}
+	for _, term := range terms.Exclude {
+		for _, variant := range searchVariants(term) {
+			query += " AND name NOT LIKE ? AND description NOT LIKE ?"
+			args = append(args, "%"+variant+"%", "%"+variant+"%")
+		}
+	}
+	return query, args
+}
+
+// ingredientFilterSQL requires an ingredient, or any of its synonyms, to
+// appear in the recipe; with exclude it forbids all of them.
+func ingredientFilterSQL(ingredient string, exclude bool) (string, []interface{}) {
+	terms := ingredientSynonyms.expand(strings.TrimSpace(ingredient))
+	conditions := make([]string, len(terms))
+	args := make([]interface{}, len(terms))
+	for i, term := range terms {
+		conditions[i] = "ingredients LIKE ?"
+		if exclude {
+			conditions[i] = "ingredients NOT LIKE ?"
+		}
+		args[i] = "%" + term + "%"
+	}
+	if exclude {
+		return " AND " + strings.Join(conditions, " AND "), args
+	}
+	return " AND (" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// recipeDifficulties lists the difficulty levels, easiest first.
+var recipeDifficulties = []string{"easy", "medium", "hard"}
+
+// difficultySortSQL orders by level rather than alphabetically; recipes with
+// no difficulty yet sort before easy ones.
+const difficultySortSQL = "FIELD(difficulty, 'easy', 'medium', 'hard')"
+
+// sortColumnSQL returns the ORDER BY expression for a validated sort_by.
+func sortColumnSQL(sortBy string) string {
+	if sortBy == "difficulty" {
+		return difficultySortSQL
+	}
+	return sortBy
+}
+
+// difficultyFilterSQL restricts results to a comma-separated list of
+// difficulty levels.
+func difficultyFilterSQL(value string) (string, []interface{}, error) {
+	placeholders := []string{}
+	args := []interface{}{}
+	for _, level := range strings.Split(value, ",") {
+		level = strings.ToLower(strings.TrimSpace(level))
+		if level == "" {
+			continue
+		}
+		if !slices.Contains(recipeDifficulties, level) {
+			return "", nil, fmt.Errorf("difficulty must be one of: %s", strings.Join(recipeDifficulties, ", "))
+		}
+		placeholders = append(placeholders, "?")
+		args = append(args, level)
+	}
+	if len(args) == 0 {
+		return "", nil, nil
+	}
+	return " AND difficulty IN (" + strings.Join(placeholders, ", ") + ")", args, nil
+}
+
+// Technique keywords looked for in instructions by inferDifficulty. Hard
+// ones count double.
+var (
+	hardTechniques = []string{"tempering", "temper the", "sous vide", "laminat", "souffl", "flambé", "flambe",
+		"puff pastry", "choux", "candy thermometer", "soft ball", "hard crack", "spun sugar", "debone", "emulsif", "clarif"}
+	mediumTechniques = []string{"knead", "proof", "braise", "deglaze", "julienne", "fold in", "stiff peaks",
+		"caramel", "roux", "blanch", "poach", "sear", "fillet", "marinate", "reduce"}
+)
+
+// inferDifficulty estimates a recipe's difficulty from its step count, total
+// time, ingredient count and the techniques its instructions mention. Each
+// signal adds points and the total picks the level.
+func inferDifficulty(recipe Recipe) string {
+	score := 0
+	switch steps := len(recipe.Instructions); {
+	case steps > 12:
+		score += 2
+	case steps > 7:
+		score++
+	}
+	if recipe.TotalTimeMinutes != nil {
+		switch {
+		case *recipe.TotalTimeMinutes > 120:
+			score += 2
+		case *recipe.TotalTimeMinutes > 60:
+			score++
+		}
+	}
+	if len(recipe.Ingredients) > 12 {
+		score++
+	}
+
+	text := strings.ToLower(strings.Join(recipe.Instructions, " "))
+	techniques := 0
+	for _, keyword := range hardTechniques {
+		if strings.Contains(text, keyword) {
+			techniques += 2
+		}
+	}
+	for _, keyword := range mediumTechniques {
+		if strings.Contains(text, keyword) {
+			techniques++
+		}
+	}
+	score += min(techniques, 4)
+
+	switch {
+	case score <= 1:
+		return "easy"
+	case score <= 3:
+		return "medium"
+	}
+	return "hard"
+}
+
+// inferRecipeDifficulties sets the inferred difficulty on recipes that have
+// none, or on every recipe with overwrite, and returns how many it updated.
+// Deleted and unpublished recipes are included so they are ready if restored.
+func inferRecipeDifficulties(overwrite bool) (int, error) {
+	const batchSize = 500
+	updated := 0
+	lastID := 0
+	for {
+		query := selectRecipes().Where("id > ?", lastID)
+		if !overwrite {
+			query.Where("difficulty IS NULL")
+		}
+		recipes, err := query.OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return updated, err
+		}
+		for _, recipe := range recipes {
+			if _, err := db.Exec("UPDATE recipes SET difficulty = ? WHERE id = ?", inferDifficulty(recipe), recipe.ID); err != nil {
+				return updated, err
+			}
+			updated++
+			lastID = recipe.ID
+		}
+		if len(recipes) < batchSize {
+			return updated, nil
+		}
+	}
+}
+
+// equipmentPatterns maps each equipment tag to the instruction wording that
+// implies it. no_cook has no pattern: it is tagged when nothing applies heat.
+var equipmentPatterns = map[string]*regexp.Regexp{
+	"air_fryer":      regexp.MustCompile(`\bair[- ]?fr(y|ied|yer)`),
+	"instant_pot":    regexp.MustCompile(`\b(instant pot|pressure[- ]cook|multi-?cooker)`),
+	"slow_cooker":    regexp.MustCompile(`\b(slow[- ]cook|crock[- ]?pot)`),
+	"oven":           regexp.MustCompile(`\b(oven|bak(e|ing)|roast|broil|preheat)`),
+	"stovetop":       regexp.MustCompile(`\b(skillet|saucepan|frying pan|stockpot|wok|saut[eé]|simmer|boil|stir[- ]fry|pan[- ]fry)`),
+	"grill":          regexp.MustCompile(`\b(grill|barbecue|bbq)`),
+	"microwave":      regexp.MustCompile(`\bmicrowave`),
+	"blender":        regexp.MustCompile(`\b(blender|blend until)`),
+	"food_processor": regexp.MustCompile(`\b(food processor|pulse (until|the))`),
+	"stand_mixer":    regexp.MustCompile(`\b(stand mixer|electric mixer|hand mixer|dough hook)`),
+}
+
+// heatEquipment is the equipment whose use means a recipe is not no-cook.
+var heatEquipment = []string{"air_fryer", "instant_pot", "slow_cooker", "oven", "stovetop", "grill", "microwave"}
+
+// heatPattern rules out no_cook when instructions apply heat without naming
+// an appliance ("cook the pasta", "melt the butter").
+var heatPattern = regexp.MustCompile(`\b(cook|heat|fr(y|ied)|toast|sear|melt|warm)`)
+
+// equipmentTags is every tag accepted by the filters and manual tagging.
+func equipmentTags() []string {
+	return append(sortedKeys(equipmentPatterns), "no_cook")
+}
+
+// inferEquipment extracts equipment tags from a recipe's instructions.
+func inferEquipment(recipe Recipe) []string {
+	text := strings.ToLower(strings.Join(recipe.Instructions, " "))
+	if strings.TrimSpace(text) == "" {
+		return []string{}
+	}
+	tags := []string{}
+	for _, tag := range sortedKeys(equipmentPatterns) {
+		if equipmentPatterns[tag].MatchString(text) {
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range tags {
+		if slices.Contains(heatEquipment, tag) {
+			return tags
+		}
+	}
+	if recipe.CookTimeMinutes != nil && *recipe.CookTimeMinutes > 0 {
+		return tags
+	}
+	if heatPattern.MatchString(text) {
+		return tags
+	}
+	return append(tags, "no_cook")
+}
+
+// normalizeEquipmentTags lowercases tags, accepting spaces or hyphens for
+// underscores ("air fryer", "no-cook"), and rejects unknown ones.
+func normalizeEquipmentTags(values []string) ([]string, error) {
+	known := equipmentTags()
+	tags := []string{}
+	for _, value := range values {
+		tag := strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(value)))
+		if tag == "" {
+			continue
+		}
+		if !slices.Contains(known, tag) {
+			return nil, fmt.Errorf("unknown equipment %q; expected one of: %s", value, strings.Join(known, ", "))
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// equipmentFilterSQL keeps recipes tagged with any of a comma-separated
+// list of equipment, or with exclude drops them.
+func equipmentFilterSQL(value string, exclude bool) (string, []interface{}, error) {
+	tags, err := normalizeEquipmentTags(strings.Split(value, ","))
+	if err != nil || len(tags) == 0 {
+		return "", nil, err
+	}
+	placeholders := make([]string, len(tags))
+	args := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		placeholders[i] = "?"
+		args[i] = tag
+	}
+	operator := "IN"
+	if exclude {
+		operator = "NOT IN"
+	}
+	return " AND id " + operator + " (SELECT recipe_id FROM recipe_equipment WHERE equipment IN (" + strings.Join(placeholders, ", ") + "))", args, nil
+}
+
+// storeInferredEquipment replaces a recipe's inferred equipment tags.
+// Recipes with manual tags are left alone.
+func storeInferredEquipment(recipe Recipe) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := writeInferredEquipment(tx, recipe); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeInferredEquipment(tx sqlExecutor, recipe Recipe) error {
+	var manual bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM recipe_equipment WHERE recipe_id = ? AND source = 'manual')", recipe.ID).Scan(&manual); err != nil {
+		return err
+	}
+	if manual {
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM recipe_equipment WHERE recipe_id = ?", recipe.ID); err != nil {
+		return err
+	}
+	for _, tag := range inferEquipment(recipe) {
+		if _, err := tx.Exec("INSERT INTO recipe_equipment (recipe_id, equipment, source) VALUES (?, ?, 'inferred')", recipe.ID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inferRecipeEquipment tags recipes that have no equipment yet, or with
+// overwrite re-infers every recipe without manual tags. It returns how many
+// recipes it processed.
+func inferRecipeEquipment(overwrite bool) (int, error) {
+	const batchSize = 500
+	processed := 0
+	lastID := 0
+	for {
+		query := selectRecipes().Where("id > ?", lastID)
+		if !overwrite {
+			query.Where("id NOT IN (SELECT recipe_id FROM recipe_equipment)")
+		}
+		recipes, err := query.OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return processed, err
+		}
+		for _, recipe := range recipes {
+			if err := storeInferredEquipment(recipe); err != nil {
+				return processed, err
+			}
+			processed++
+			lastID = recipe.ID
+		}
+		if len(recipes) < batchSize {
+			return processed, nil
+		}
+	}
+}
+
+// loadRecipeEquipment fills the equipment tags of a recipe.
+func loadRecipeEquipment(recipe *Recipe) error {
+	rows, err := db.Query("SELECT equipment FROM recipe_equipment WHERE recipe_id = ? AND equipment <> '' ORDER BY equipment", recipe.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	recipe.Equipment = []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return err
+		}
+		recipe.Equipment = append(recipe.Equipment, tag)
+	}
+	return rows.Err()
+}
+
+// Spice levels, from none to hot.
+const (
+	spiceNone = iota
+	spiceMild
+	spiceMedium
+	spiceHot
+)
+
+// spicePatterns maps spice levels to the ingredients that reach them.
+// Black pepper and sweet paprika are deliberately absent.
+var spicePatterns = []struct {
+	Level   int
+	Pattern *regexp.Regexp
+}{
+	{spiceHot, regexp.MustCompile(`\b(habanero|scotch bonnet|ghost pepper|bhut jolokia|carolina reaper|bird'?s[- ]eye|thai chil(i|e)s?)\b`)},
+	{spiceMedium, regexp.MustCompile(`\b(jalape[nñ]o|serrano|chipotle|cayenne|red pepper flakes|chil(i|e) flakes|crushed red pepper|hot sauce|sriracha|gochujang|harissa|sambal|chil(i|e) oil|chil(i|e) paste|curry paste|fresh chil(i|e)s?|red chil(i|e)s?|green chil(i|e)s?)\b`)},
+	{spiceMild, regexp.MustCompile(`\b(chil(i|e) powder|poblano|ancho|pasilla|guajillo|hot paprika|curry powder|horseradish|wasabi|chil(i|e)s?)\b`)},
+}
+
+// inferSpiceLevel rates a recipe by its hottest ingredient. Three or more
+// medium ingredients together count as hot.
+func inferSpiceLevel(recipe Recipe) int {
+	level := spiceNone
+	medium := 0
+	for _, line := range recipe.Ingredients {
+		line = strings.ToLower(line)
+		for _, spice := range spicePatterns {
+			if spice.Pattern.MatchString(line) {
+				level = max(level, spice.Level)
+				if spice.Level == spiceMedium {
+					medium++
+				}
+				break
+			}
+		}
+	}
+	if medium >= 3 {
+		level = spiceHot
+	}
+	return level
+}
+
+// notKidFriendlyPattern matches ingredients most parents avoid or most
+// children refuse: alcohol that may not cook off, raw fish and strong
+// flavours.
+var notKidFriendlyPattern = regexp.MustCompile(`\b(wine|beer|stout|rum|bourbon|whiske?y|vodka|brandy|cognac|sherry|liqueur|tequila|gin|sake|raw (egg|fish|salmon|tuna)s?|tartare|ceviche|sashimi|anchov(y|ies)|blue cheese|gorgonzola|liver|oysters?|capers)\b`)
+
+// inferKidFriendly treats a recipe as kid-friendly when it is at most
+// mildly spicy and avoids notKidFriendlyPattern.
+func inferKidFriendly(recipe Recipe, spiceLevel int) bool {
+	if spiceLevel > spiceMild {
+		return false
+	}
+	for _, line := range recipe.Ingredients {
+		if notKidFriendlyPattern.MatchString(strings.ToLower(line)) {
+			return false
+		}
+	}
+	return true
+}
+
+// inferRecipeTraits sets the inferred spice level and kid-friendly flag on
+// recipes missing them, or on every recipe with overwrite. Values an editor
+// has overridden are kept either way. It returns how many recipes it updated.
+func inferRecipeTraits(overwrite bool) (int, error) {
+	const batchSize = 500
+	updated := 0
+	lastID := 0
+	for {
+		query := selectRecipes().Where("id > ?", lastID)
+		if !overwrite {
+			query.Where("(spice_level IS NULL OR kid_friendly IS NULL)")
+		}
+		recipes, err := query.OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return updated, err
+		}
+		for _, recipe := range recipes {
+			if err := storeInferredTraits(recipe); err != nil {
+				return updated, err
+			}
+			updated++
+			lastID = recipe.ID
+		}
+		if len(recipes) < batchSize {
+			return updated, nil
+		}
+	}
+}
+
+// storeInferredTraits writes a recipe's inferred spice level and
+// kid-friendly flag, skipping whichever an editor has overridden. An
+// overridden spice level still feeds the kid-friendly inference.
+func storeInferredTraits(recipe Recipe) error {
+	return writeInferredTraits(db, recipe)
+}
+
+func writeInferredTraits(q sqlExecutor, recipe Recipe) error {
+	spiceLevel := inferSpiceLevel(recipe)
+	var spiceOverridden bool
+	var storedSpice sql.NullInt64
+	if err := q.QueryRow("SELECT spice_level_overridden, spice_level FROM recipes WHERE id = ?", recipe.ID).Scan(&spiceOverridden, &storedSpice); err != nil {
+		return err
+	}
+	if spiceOverridden && storedSpice.Valid {
+		spiceLevel = int(storedSpice.Int64)
+	}
+	_, err := q.Exec(`UPDATE recipes SET
+		spice_level = IF(spice_level_overridden, spice_level, ?),
+		kid_friendly = IF(kid_friendly_overridden, kid_friendly, ?)
+		WHERE id = ?`, spiceLevel, inferKidFriendly(recipe, spiceLevel), recipe.ID)
+	return err
+}
+
+// Storability is how long a cooked recipe keeps and how to reheat it.
+// FreezerMonths is zero for dishes that do not freeze well.
+type Storability struct {
+	FridgeDays    int    `json:"fridge_days"`
+	FreezerMonths int    `json:"freezer_months"`
+	Reheat        string `json:"reheat"`
+	Source        string `json:"source"`
+}
+
+var (
+	// freezesWellPattern matches saucy, braised and baked-together dishes
+	// that keep their texture through freezing and reheating.
+	freezesWellPattern = regexp.MustCompile(`\b(soup|stew|chil(i|e) con|chili|curry|casserole|lasagna|lasagne|bolognese|rag[uù]|meatballs?|braise[d]?|enchiladas?|dh?al|dahl|goulash|tagine|pulled pork|burritos?|shepherd'?s pie|cottage pie|pot pie|mac(aroni)? (and|&) cheese|beans)\b`)
+	// keepsPoorlyPattern matches dishes best eaten the day they are made.
+	keepsPoorlyPattern = regexp.MustCompile(`\b(salad|sashimi|ceviche|tartare|poke|crispy|tempura|fried|fritters?|sandwich(es)?|souffl[eé]|poached eggs?|guacamole|avocado toast)\b`)
+	// noFreezePattern matches ingredients that split or go watery once frozen.
+	noFreezePattern = regexp.MustCompile(`\b(cream|sour cream|yogh?urt|mayo(nnaise)?|cucumber|lettuce|hard[- ]boiled eggs?|raw (egg|fish)|fresh herbs)\b`)
+	seafoodPattern  = regexp.MustCompile(`\b(fish|salmon|tuna|cod|shrimp|prawns?|scallops?|mussels|clams|crab|lobster|squid)\b`)
+	bakedPattern    = regexp.MustCompile(`\b(casserole|lasagna|lasagne|bake[d]?|gratin|enchiladas?|pie)\b`)
+	soupPattern     = regexp.MustCompile(`\b(soup|stew|chili|curry|dh?al|dahl|sauce|bolognese|rag[uù]|goulash|tagine|beans)\b`)
+)
+
+// inferStorability estimates storage from the recipe's name and
+// ingredients, using common food-safety guidance: three to four days in
+// the fridge for most cooked food, less for seafood.
+func inferStorability(recipe Recipe) Storability {
+	name := strings.ToLower(recipe.Name)
+	ingredients := strings.ToLower(strings.Join(recipe.Ingredients, " "))
+	storage := Storability{FridgeDays: 4, FreezerMonths: 2, Source: "inferred"}
+
+	switch {
+	case keepsPoorlyPattern.MatchString(name):
+		storage.FridgeDays, storage.FreezerMonths = 1, 0
+	case freezesWellPattern.MatchString(name):
+		storage.FreezerMonths = 3
+	case noFreezePattern.MatchString(ingredients):
+		storage.FreezerMonths = 0
+	}
+	if seafoodPattern.MatchString(name + " " + ingredients) {
+		storage.FridgeDays = min(storage.FridgeDays, 2)
+	}
+
+	equipment := inferEquipment(recipe)
+	heated := slices.ContainsFunc(equipment, func(tag string) bool { return slices.Contains(heatEquipment, tag) })
+	switch {
+	case storage.FridgeDays == 1 && !heated:
+		storage.Reheat = "Serve cold; do not reheat."
+	case soupPattern.MatchString(name):
+		storage.Reheat = "Reheat covered on the stovetop over medium-low heat, stirring, until steaming (74°C / 165°F). Add a splash of water if it has thickened."
+	case bakedPattern.MatchString(name) || slices.Contains(equipment, "oven"):
+		storage.Reheat = "Reheat covered in a 175°C / 350°F oven for 20-25 minutes until hot through (74°C / 165°F)."
+	default:
+		storage.Reheat = "Microwave covered, stirring halfway, until steaming hot (74°C / 165°F)."
+	}
+	return storage
+}
+
+// loadStorabilities returns the storage guidance for each recipe: an
+// editor's entry when there is one, otherwise the inferred estimate.
+func loadStorabilities(recipes []Recipe) (map[int]Storability, error) {
+	result := map[int]Storability{}
+	if len(recipes) == 0 {
+		return result, nil
+	}
+	placeholders := make([]string, len(recipes))
+	args := make([]interface{}, len(recipes))
+	for i, recipe := range recipes {
+		placeholders[i] = "?"
+		args[i] = recipe.ID
+	}
+	rows, err := db.Query("SELECT recipe_id, fridge_days, freezer_months, reheat FROM recipe_storage WHERE recipe_id IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		storage := Storability{Source: "manual"}
+		if err := rows.Scan(&id, &storage.FridgeDays, &storage.FreezerMonths, &storage.Reheat); err != nil {
+			return nil, err
+		}
+		result[id] = storage
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, recipe := range recipes {
+		if _, ok := result[recipe.ID]; !ok {
+			result[recipe.ID] = inferStorability(recipe)
+		}
+	}
+	return result, nil
+}
+
+// loadRecipeStorage fills the storage guidance of a recipe.
+func loadRecipeStorage(recipe *Recipe) error {
+	storages, err := loadStorabilities([]Recipe{*recipe})
+	if err != nil {
+		return err
+	}
+	storage := storages[recipe.ID]
+	recipe.Storage = &storage
+	return nil
+}
+
+// highlightPattern matches any of terms, longest first, case-insensitively.
+func highlightPattern(terms []string) *regexp.Regexp {
+	sorted := slices.Clone(terms)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	quoted := []string{}
+	for _, term := range sorted {
+		if term = strings.TrimSpace(term); term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+}
+
+// highlightText HTML-escapes text and wraps every match of pattern in
+// <em>. It reports false when nothing matched.
+func highlightText(text string, pattern *regexp.Regexp) (string, bool) {
+	matches := pattern.FindAllStringIndex(text, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(template.HTMLEscapeString(text[last:m[0]]))
+		b.WriteString("<em>" + template.HTMLEscapeString(text[m[0]:m[1]]) + "</em>")
+		last = m[1]
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return b.String(), true
+}
+
+// highlightRecipes fills Highlights with where the search text matched the
+// name and description, and where it or the include_ingredients filter
+// matched ingredient lines. Synonym rewrites count as matches, as they do
+// in the query.
+func highlightRecipes(recipes []Recipe, search, includeIngredients string) {
+	textTerms := []string{}
+	for _, term := range parseSearchText(search).Include {
+		textTerms = append(textTerms, searchVariants(term)...)
+	}
+	ingredientTerms := slices.Clone(textTerms)
+	if includeIngredients != "" {
+		for _, ingredient := range strings.Split(includeIngredients, ",") {
+			ingredientTerms = append(ingredientTerms, ingredientSynonyms.expand(strings.TrimSpace(ingredient))...)
+		}
+	}
+
+	textPattern := highlightPattern(textTerms)
+	ingredientPattern := highlightPattern(ingredientTerms)
+	if textPattern == nil && ingredientPattern == nil {
+		return
+	}
+
+	for i := range recipes {
+		highlights := map[string][]string{}
+		if textPattern != nil {
+			if name, ok := highlightText(recipes[i].Name, textPattern); ok {
+				highlights["name"] = []string{name}
+			}
+			if description, ok := highlightText(recipes[i].Description, textPattern); ok {
+				highlights["description"] = []string{description}
+			}
+		}
+		if ingredientPattern != nil {
+			for _, line := range recipes[i].Ingredients {
+				if ingredient, ok := highlightText(line, ingredientPattern); ok {
+					highlights["ingredients"] = append(highlights["ingredients"], ingredient)
+				}
+			}
+		}
+		if len(highlights) > 0 {
+			recipes[i].Highlights = highlights
+		}
+	}
+}
+
+// searchFilter is the WHERE clause built from the REST search parameters,
+// with what the search response reports about how it was built.
+type searchFilter struct {
+	where         string
+	args          []interface{}
+	search        string
+	suggestion    string
+	autocorrected bool
+	macro         *macroTarget
+	dietMode      string
+}
+
+// parseSearchFilter builds the WHERE clause of a REST search: scope, diet,
+// text, ingredient, range and flag filters, and repeat suppression. On a
+// bad parameter it writes the error response and returns false.
+func parseSearchFilter(c *gin.Context) (searchFilter, bool) {
+	tenant := tenantFromContext(c)
+	query, args := tenant.recipeScope()
+	
+	// Apply diet plan filters if specified
+	dietMode, err := parseDietMode(c.Query("diet_mode"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return searchFilter{}, false
+	}
+	if diet := c.Query("diet"); diet != "" {
+		if plan, exists := tenant.dietPlans()[diet]; exists {
+			query, args = dietFilterSQL(query, args, plan, dietMode)
+		}
+	}
+	condition, restrictionArgs, err := restrictionFilterSQL(c.Query("restrictions"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return searchFilter{}, false
+	}
+	query += condition
+	args = append(args, restrictionArgs...)
+	
+	// Text search, with a spelling suggestion for unknown words. The
+	// correction is only applied when the caller opts in.
+	search := c.Query("search")
+	suggestion := ""
+	autocorrected := false
+	if search != "" && featureEnabled(c, "spelling_suggestions") {
+		if corrected, ok := suggestSpelling(tenant, search); ok {
+			suggestion = corrected
+			if c.Query("autocorrect") == "true" {
+				search = corrected
+				autocorrected = true
+			}
+		}
+	}
+	if search != "" {
+		condition, searchArgs := textSearchSQL(search)
+		query += condition
+		args = append(args, searchArgs...)
+	}
+	
+	// Ingredient filters, widened to known synonyms
+	if includeIngredients := c.Query("include_ingredients"); includeIngredients != "" {
+		ingredients := strings.Split(includeIngredients, ",")
+		for _, ingredient := range ingredients {
+			condition, ingredientArgs := ingredientFilterSQL(ingredient, false)
+			query += condition
+			args = append(args, ingredientArgs...)
+		}
+	}
+	
+	if excludeIngredients := c.Query("exclude_ingredients"); excludeIngredients != "" {
+		ingredients := strings.Split(excludeIngredients, ",")
+		for _, ingredient := range ingredients {
+			condition, ingredientArgs := ingredientFilterSQL(ingredient, true)
+			query += condition
+			args = append(args, ingredientArgs...)
+		}
+	}
+	
+	// Numeric filters
+	if minCalories := c.Query("min_calories"); minCalories != "" {
+		if val, err := strconv.Atoi(minCalories); err == nil {
+			query += " AND calories >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxCalories := c.Query("max_calories"); maxCalories != "" {
+		if val, err := strconv.Atoi(maxCalories); err == nil {
+			query += " AND calories <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minProtein := c.Query("min_protein"); minProtein != "" {
+		if val, err := strconv.ParseFloat(minProtein, 64); err == nil {
+			query += " AND protein >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxProtein := c.Query("max_protein"); maxProtein != "" {
+		if val, err := strconv.ParseFloat(maxProtein, 64); err == nil {
+			query += " AND protein <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minFat := c.Query("min_fat"); minFat != "" {
+		if val, err := strconv.ParseFloat(minFat, 64); err == nil {
+			query += " AND fat >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxFat := c.Query("max_fat"); maxFat != "" {
+		if val, err := strconv.ParseFloat(maxFat, 64); err == nil {
+			query += " AND fat <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minCarbs := c.Query("min_carbs"); minCarbs != "" {
+		if val, err := strconv.ParseFloat(minCarbs, 64); err == nil {
+			query += " AND carbs >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxCarbs := c.Query("max_carbs"); maxCarbs != "" {
+		if val, err := strconv.ParseFloat(maxCarbs, 64); err == nil {
+			query += " AND carbs <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minFiber := c.Query("min_fiber"); minFiber != "" {
+		if val, err := strconv.ParseFloat(minFiber, 64); err == nil {
+			query += " AND fiber >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxFiber := c.Query("max_fiber"); maxFiber != "" {
+		if val, err := strconv.ParseFloat(maxFiber, 64); err == nil {
+			query += " AND fiber <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minSodium := c.Query("min_sodium"); minSodium != "" {
+		if val, err := strconv.ParseFloat(minSodium, 64); err == nil {
+			query += " AND sodium >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxSodium := c.Query("max_sodium"); maxSodium != "" {
+		if val, err := strconv.ParseFloat(maxSodium, 64); err == nil {
+			query += " AND sodium <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minPrepTime := c.Query("min_prep_time"); minPrepTime != "" {
+		if val, err := strconv.Atoi(minPrepTime); err == nil {
+			query += " AND prep_time_minutes >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxPrepTime := c.Query("max_prep_time"); maxPrepTime != "" {
+		if val, err := strconv.Atoi(maxPrepTime); err == nil {
+			query += " AND prep_time_minutes <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minCookTime := c.Query("min_cook_time"); minCookTime != "" {
+		if val, err := strconv.Atoi(minCookTime); err == nil {
+			query += " AND cook_time_minutes >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxCookTime := c.Query("max_cook_time"); maxCookTime != "" {
+		if val, err := strconv.Atoi(maxCookTime); err == nil {
+			query += " AND cook_time_minutes <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minTotalTime := c.Query("min_total_time"); minTotalTime != "" {
+		if val, err := strconv.Atoi(minTotalTime); err == nil {
+			query += " AND total_time_minutes >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxTotalTime := c.Query("max_total_time"); maxTotalTime != "" {
+		if val, err := strconv.Atoi(maxTotalTime); err == nil {
+			query += " AND total_time_minutes <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minServings := c.Query("min_servings"); minServings != "" {
+		if val, err := strconv.Atoi(minServings); err == nil {
+			query += " AND servings >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxServings := c.Query("max_servings"); maxServings != "" {
+		if val, err := strconv.Atoi(maxServings); err == nil {
+			query += " AND servings <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minRating := c.Query("min_rating"); minRating != "" {
+		if val, err := strconv.ParseFloat(minRating, 64); err == nil {
+			query += " AND rating >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxRating := c.Query("max_rating"); maxRating != "" {
+		if val, err := strconv.ParseFloat(maxRating, 64); err == nil {
+			query += " AND rating <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minCost := c.Query("min_cost"); minCost != "" {
+		if val, err := strconv.ParseFloat(minCost, 64); err == nil {
+			query += " AND cost_per_serving >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxCost := c.Query("max_cost"); maxCost != "" {
+		if val, err := strconv.ParseFloat(maxCost, 64); err == nil {
+			query += " AND cost_per_serving <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minCO2e := c.Query("min_co2e"); minCO2e != "" {
+		if val, err := strconv.ParseFloat(minCO2e, 64); err == nil {
+			query += " AND co2e_per_serving >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxCO2e := c.Query("max_co2e"); maxCO2e != "" {
+		if val, err := strconv.ParseFloat(maxCO2e, 64); err == nil {
+			query += " AND co2e_per_serving <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minGI := c.Query("min_gi"); minGI != "" {
+		if val, err := strconv.ParseFloat(minGI, 64); err == nil {
+			query += " AND glycemic_index >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxGI := c.Query("max_gi"); maxGI != "" {
+		if val, err := strconv.ParseFloat(maxGI, 64); err == nil {
+			query += " AND glycemic_index <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minGL := c.Query("min_gl"); minGL != "" {
+		if val, err := strconv.ParseFloat(minGL, 64); err == nil {
+			query += " AND glycemic_load >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxGL := c.Query("max_gl"); maxGL != "" {
+		if val, err := strconv.ParseFloat(maxGL, 64); err == nil {
+			query += " AND glycemic_load <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if minSpice := c.Query("min_spice"); minSpice != "" {
+		if val, err := strconv.Atoi(minSpice); err == nil {
+			query += " AND spice_level >= ?"
+			args = append(args, val)
+		}
+	}
+	
+	if maxSpice := c.Query("max_spice"); maxSpice != "" {
+		if val, err := strconv.Atoi(maxSpice); err == nil {
+			query += " AND spice_level <= ?"
+			args = append(args, val)
+		}
+	}
+	
+	condition, difficultyArgs, err := difficultyFilterSQL(c.Query("difficulty"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return searchFilter{}, false
+	}
+	query += condition
+	args = append(args, difficultyArgs...)
+
+	for key, exclude := range map[string]bool{"equipment": false, "exclude_equipment": true} {
+		condition, equipmentArgs, err := equipmentFilterSQL(c.Query(key), exclude)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return searchFilter{}, false
+		}
+		query += condition
+		args = append(args, equipmentArgs...)
+	}
+
+	condition, cuisineArgs, err := cuisineFilterSQL(c.Query("cuisine"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return searchFilter{}, false
+	}
+	query += condition
+	args = append(args, cuisineArgs...)
+
+	if kidFriendly := c.Query("kid_friendly"); kidFriendly != "" {
+		val, err := strconv.ParseBool(kidFriendly)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "kid_friendly must be true or false"})
+			return searchFilter{}, false
+		}
+		query += " AND kid_friendly = ?"
+		args = append(args, val)
+	}
+
+	if hasImage := c.Query("has_image"); hasImage != "" {
+		val, err := strconv.ParseBool(hasImage)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "has_image must be true or false"})
+			return searchFilter{}, false
+		}
+		query += hasImageSQL(val)
+	}
+
+	// Macro split target, e.g. macro_split=30/40/30&tolerance=5
+	tolerance := 0.0
+	if raw := c.Query("tolerance"); raw != "" {
+		if tolerance, err = strconv.ParseFloat(raw, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tolerance must be a number"})
+			return searchFilter{}, false
+		}
+	}
+	macro, err := parseMacroTarget(c.Query("macro_split"), tolerance)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return searchFilter{}, false
+	}
+	if macro != nil {
+		condition, macroArgs := macro.filterSQL()
+		query += condition
+		args = append(args, macroArgs...)
+	}
+
+	// Repeat suppression for endless scroll: explicit IDs, and with
+	// exclude_hidden the recipes this API key has hidden or recently cooked.
+	excludeIDs, err := parseIDList(c.Query("exclude_ids"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return searchFilter{}, false
+	}
+	hiddenFor := ""
+	if c.Query("exclude_hidden") == "true" {
+		owner, ok := apiKeyOwner(c)
+		if !ok {
+			return searchFilter{}, false
+		}
+		hiddenFor = owner
+	}
+	if condition, excludeArgs := excludeRecipesSQL(excludeIDs, hiddenFor); condition != "" {
+		query += condition
+		args = append(args, excludeArgs...)
+	}
+
+	return searchFilter{query, args, search, suggestion, autocorrected, macro, dietMode}, true
+}
+
+// Original API Handlers (unchanged)
+func searchRecipes(c *gin.Context) {
+	tenant := tenantFromContext(c)
+	filter, ok := parseSearchFilter(c)
+	if !ok {
+		return
+	}
+	query, args := "SELECT "+recipeColumns+" FROM recipes WHERE "+filter.where, filter.args
+	search, suggestion, autocorrected, macro := filter.search, filter.suggestion, filter.autocorrected, filter.macro
+
+	// Sorting
+	sortBy := c.DefaultQuery("sort_by", "id")
+	sortOrder := c.DefaultQuery("sort_order", "asc")
+	
+	validSortColumns := map[string]bool{
+		"id": true, "name": true, "prep_time_minutes": true, "cook_time_minutes": true,
+		"total_time_minutes": true, "servings": true, "rating": true, "calories": true,
+		"protein": true, "fat": true, "carbs": true, "fiber": true, "sodium": true,
+		"difficulty": true, "cost_per_serving": true, "co2e_per_serving": true,
+		"times_made": true, "views": true, "glycemic_load": true,
+	}
+	
+	// Searches left in the default order may be enrolled in a ranking
+	// experiment instead.
+	var experiment *RankingExperiment
+	variant := ""
+	if macro == nil && c.Query("sort_by") == "" && c.Query("format") != "assistant" && !c.GetBool(snapshotRenderKey) {
+		experiment, variant = rankingAssignment(c)
+	}
+
+	if macro != nil && c.Query("sort_by") == "" {
+		// Closest to the wanted split first
+		distance, distanceArgs := macro.distanceSQL()
+		query += " ORDER BY " + distance + ", id"
+		args = append(args, distanceArgs...)
+	} else if experiment != nil {
+		order, orderArgs := rankingVariants[variant](search)
+		query += " ORDER BY " + order
+		args = append(args, orderArgs...)
+	} else if validSortColumns[sortBy] {
+		if sortOrder == "desc" {
+			query += " ORDER BY " + sortColumnSQL(sortBy) + " DESC"
+		} else {
+			query += " ORDER BY " + sortColumnSQL(sortBy) + " ASC"
+		}
+	}
+	
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+	
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipes, skipped, err := scanRecipes(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if macro != nil {
+		annotateMacroSplits(recipes)
+	}
+	budget := nutritionBudgetFor(c)
+	if budget != nil {
+		annotateFitScores(recipes, *budget)
+	}
+	if err := localizeRecipes(c, recipes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("highlight") != "false" {
+		highlightRecipes(recipes, search, c.Query("include_ingredients"))
+	}
+
+	if c.Query("format") == "assistant" {
+		c.JSON(http.StatusOK, assistantSearchResults(recipes))
+		return
+	}
+
+	response := gin.H{
+		"recipes": recipes,
+		"count":   len(recipes),
+		"limit":   limit,
+		"offset":  offset,
+	}
+	if skipped > 0 {
+		response["skipped"] = skipped
+	}
+	if budget != nil {
+		response["nutrition_budget"] = budget
+	}
+	if experiment != nil {
+		response["experiment"] = gin.H{"name": experiment.Name, "variant": variant, "search_id": recordImpression(c, experiment, variant)}
+	}
+	if suggestion != "" {
+		response["did_you_mean"] = suggestion
+		if autocorrected {
+			response["autocorrected"] = true
+			response["original_search"] = c.Query("search")
+		}
+	}
+	
+	// Include diet plan info if used
+	if diet := c.Query("diet"); diet != "" {
+		if plan, exists := tenant.dietPlans()[diet]; exists {
+			response["diet_plan"] = plan
+			response["diet_mode"] = filter.dietMode
+			if filter.dietMode == dietModeLenient {
+				if flags := dietBorderline(recipes, plan); len(flags) > 0 {
+					response["diet_flags"] = flags
+				}
+			}
+		}
+	}
+	recordSearchQuery(c)
+	
+	c.JSON(http.StatusOK, response)
+}
+
+// FilterBound is the range of a numeric filter's column among matching
+// recipes; both ends are nil when none has a value.
+type FilterBound struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// getFilterBounds reports, for each min_/max_ range filter, the smallest
+// and largest value among the recipes the same search parameters match,
+// so range sliders can start from what is actually there.
+func getFilterBounds(c *gin.Context) {
+	filter, ok := parseSearchFilter(c)
+	if !ok {
+		return
+	}
+	columns := []string{"COUNT(*)"}
+	for _, f := range searchNumericFilters {
+		columns = append(columns, "MIN("+f.Column+")", "MAX("+f.Column+")")
+	}
+
+	var count int
+	values := make([]sql.NullFloat64, 2*len(searchNumericFilters))
+	dest := []interface{}{&count}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	if err := db.QueryRow("SELECT "+strings.Join(columns, ", ")+" FROM recipes WHERE "+filter.where, filter.args...).Scan(dest...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	bounds := map[string]FilterBound{}
+	for i, f := range searchNumericFilters {
+		var bound FilterBound
+		if low, high := values[2*i], values[2*i+1]; low.Valid && high.Valid {
+			bound.Min, bound.Max = &low.Float64, &high.Float64
+		}
+		bounds[f.Param] = bound
+	}
+	c.JSON(http.StatusOK, gin.H{"bounds": bounds, "count": count})
+}
+
+// LeftoverIngredient is an item to use up and the days until it spoils.
+type LeftoverIngredient struct {
+	Name          string  `json:"name"`
+	ExpiresInDays float64 `json:"expires_in_days"`
+}
+
+type UseUpResult struct {
+	Recipe  Recipe   `json:"recipe"`
+	Score   float64  `json:"score"`
+	Matched []string `json:"matched"`
+	// Primary lists the matched items that are central to the recipe: named
+	// in its title or among its first ingredients.
+	Primary []string `json:"primary"`
+}
+
+const (
+	maxLeftoverIngredients = 20
+	// defaultExpiresInDays applies when neither the item nor expires_in
+	// gives a shelf life.
+	defaultExpiresInDays = 7
+)
+
+// parseShelfLife reads a shelf life such as "2d", "36h", "1w" or a bare
+// number of days.
+func parseShelfLife(input string) (float64, error) {
+	raw := strings.ToLower(strings.TrimSpace(input))
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(raw, "h"):
+		unit, raw = 1.0/24, strings.TrimSuffix(raw, "h")
+	case strings.HasSuffix(raw, "w"):
+		unit, raw = 7, strings.TrimSuffix(raw, "w")
+	case strings.HasSuffix(raw, "d"):
+		raw = strings.TrimSuffix(raw, "d")
+	}
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid shelf life %q; use e.g. 2d, 36h or 1w", input)
+	}
+	return val * unit, nil
+}
+
+// parseLeftovers reads "spinach,feta:5d" where an item's own shelf life
+// overrides the shared one.
+func parseLeftovers(raw string, expiresIn float64) ([]LeftoverIngredient, error) {
+	leftovers := []LeftoverIngredient{}
+	for _, part := range strings.Split(raw, ",") {
+		name, shelfLife, hasShelfLife := strings.Cut(part, ":")
+		name = strings.Join(strings.Fields(strings.ToLower(name)), " ")
+		if name == "" {
+			continue
+		}
+		leftover := LeftoverIngredient{Name: name, ExpiresInDays: expiresIn}
+		if hasShelfLife {
+			days, err := parseShelfLife(shelfLife)
+			if err != nil {
+				return nil, err
+			}
+			leftover.ExpiresInDays = days
+		}
+		leftovers = append(leftovers, leftover)
+	}
+	if len(leftovers) == 0 {
+		return nil, fmt.Errorf("ingredients is required")
+	}
+	if len(leftovers) > maxLeftoverIngredients {
+		return nil, fmt.Errorf("at most %d ingredients can be listed", maxLeftoverIngredients)
+	}
+	return leftovers, nil
+}
+
+// leftoverUrgency weights items that spoil sooner more heavily.
+func leftoverUrgency(days float64) float64 {
+	switch {
+	case days <= 1:
+		return 2
+	case days <= 3:
+		return 1.5
+	}
+	return 1
+}
+
+// scoreUseUp rates how well a recipe uses up leftovers. Each matched item
+// counts its urgency, doubled when it is primary; a small bonus for the
+// share of the recipe covered prefers dishes needing little else.
+func scoreUseUp(recipe Recipe, leftovers []LeftoverIngredient, patterns []*regexp.Regexp) UseUpResult {
+	result := UseUpResult{Recipe: recipe, Matched: []string{}, Primary: []string{}}
+	primaryLines := max(3, len(recipe.Ingredients)/3)
+	coveredLines := map[int]bool{}
+	for i, leftover := range leftovers {
+		line := slices.IndexFunc(recipe.Ingredients, patterns[i].MatchString)
+		if line < 0 {
+			continue
+		}
+		coveredLines[line] = true
+		weight := leftoverUrgency(leftover.ExpiresInDays)
+		result.Matched = append(result.Matched, leftover.Name)
+		if line < primaryLines || patterns[i].MatchString(recipe.Name) {
+			result.Primary = append(result.Primary, leftover.Name)
+			weight *= 2
+		}
+		result.Score += weight
+	}
+	if len(recipe.Ingredients) > 0 {
+		result.Score += float64(len(coveredLines)) / float64(len(recipe.Ingredients))
+	}
+	result.Score = math.Round(result.Score*100) / 100
+	return result
+}
+
+// useUpRecipes ranks recipes by how many of the listed leftovers they use,
+// favouring those where the items are primary and those about to spoil.
+func useUpRecipes(c *gin.Context) {
+	expiresIn := float64(defaultExpiresInDays)
+	if raw := c.Query("expires_in"); raw != "" {
+		days, err := parseShelfLife(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		expiresIn = days
+	}
+	leftovers, err := parseLeftovers(c.Query("ingredients"), expiresIn)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit := 20
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+
+	patterns := make([]*regexp.Regexp, len(leftovers))
+	conditions := []string{}
+	args := []interface{}{}
+	for i, leftover := range leftovers {
+		terms := ingredientSynonyms.expand(leftover.Name)
+		patterns[i] = keywordPattern(strings.Join(terms, ","))
+		for _, term := range terms {
+			conditions = append(conditions, "ingredients LIKE ?")
+			args = append(args, "%"+term+"%")
+		}
+	}
+	scope, scopeArgs := tenantFromContext(c).recipeScope()
+	query := "SELECT " + recipeColumns + " FROM recipes WHERE " + scope + " AND (" +
+		strings.Join(conditions, " OR ") + ") ORDER BY rating DESC LIMIT 500"
+	candidates, err := queryRecipes(query, append(scopeArgs, args...)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	results := []UseUpResult{}
+	for _, recipe := range candidates {
+		// LIKE also matches inside longer words; the word patterns decide.
+		if result := scoreUseUp(recipe, leftovers, patterns); len(result.Matched) > 0 {
+			results = append(results, result)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ingredients": leftovers,
+		"recipes":     results,
+		"count":       len(results),
+	})
+}
+
+func applyDietFilters(query string, args []interface{}, filters map[string]interface{}) (string, []interface{}) {
+	for key, value := range filters {
+		switch key {
+		case "exclude_ingredients":
+			if ingredients, ok := value.([]string); ok {
+				for _, ingredient := range ingredients {
+					query += " AND ingredients NOT LIKE ?"
+					args = append(args, "%"+ingredient+"%")
+				}
+			}
+		case "include_ingredients":
+			if ingredients, ok := value.([]string); ok {
+				for _, ingredient := range ingredients {
+					query += " AND ingredients LIKE ?"
+					args = append(args, "%"+ingredient+"%")
+				}
+			}
+		default:
+			column, op, ok := dietBoundColumn(key)
+			if !ok {
+				continue
+			}
+			if val, ok := dietFilterNumber(value); ok {
+				query += " AND " + column + " " + op + " ?"
+				args = append(args, val)
+			}
+		}
+	}
+	return query, args
+}
+
+// Diet modes for diet_mode. Lenient matches a plan's excluded ingredients
+// as keywords in the ingredient text, as diets always have. Strict also
+// excludes every member of an excluded ingredient class and their synonyms.
+const (
+	dietModeLenient = "lenient"
+	dietModeStrict  = "strict"
+)
+
+// dietIngredientClasses lists what strict mode takes a class named in
+// exclude_ingredients to cover, so "dairy" also rules out ghee and whey.
+// Strict terms are matched as substrings like lenient ones, so words that
+// sit inside common ingredient names ("pea" in peach, "corn" in
+// peppercorn) are left out.
+var dietIngredientClasses = map[string][]string{
+	"dairy":     {"milk", "cheese", "butter", "cream", "yogurt", "ghee", "whey", "casein", "kefir", "buttermilk", "parmesan", "mozzarella", "ricotta", "feta"},
+	"meat":      {"beef", "pork", "chicken", "lamb", "veal", "turkey", "duck", "venison", "bacon", "sausage", "prosciutto", "salami", "chorizo", "pancetta", "gelatin"},
+	"fish":      {"salmon", "tuna", "cod", "anchovy", "sardine", "trout", "halibut", "tilapia", "mackerel", "fish sauce"},
+	"seafood":   {"shrimp", "crab", "lobster", "mussel", "clam", "oyster", "scallop", "squid", "octopus"},
+	"egg":       {"mayonnaise", "meringue"},
+	"grain":     {"wheat", "flour", "rice", "oats", "barley", "rye", "cornmeal", "cornstarch", "polenta", "pasta", "bread", "couscous", "bulgur", "noodle"},
+	"legume":    {"bean", "lentil", "chickpea", "peas", "peanut", "soy", "tofu", "tempeh", "edamame"},
+	"sugar":     {"honey", "syrup", "molasses", "agave"},
+	"processed": {"bacon", "sausage", "salami", "hot dog"},
+	"pork":      {"bacon", "ham", "prosciutto", "pancetta", "chorizo", "pepperoni", "lard", "guanciale"},
+	"alcohol":   {"wine", "beer", "rum", "vodka", "whiskey", "whisky", "brandy", "bourbon", "sherry", "sake", "mirin", "liqueur", "cognac", "tequila", "kirsch", "champagne", "stout", "cider"},
+}
+
+// DietFlag is an ingredient of a lenient match that strict mode would
+// have excluded: Matched is what was found, Excluded the plan's term it
+// falls under.
+type DietFlag struct {
+	RecipeID   int    `json:"recipe_id"`
+	Ingredient string `json:"ingredient"`
+	Matched    string `json:"matched"`
+	Excluded   string `json:"excluded"`
+}
+
+// parseDietMode reads diet_mode, defaulting to lenient.
+func parseDietMode(value string) (string, error) {
+	switch value {
+	case "", dietModeLenient:
+		return dietModeLenient, nil
+	case dietModeStrict:
+		return dietModeStrict, nil
+	}
+	return "", fmt.Errorf("diet_mode must be %s or %s", dietModeStrict, dietModeLenient)
+}
+
+// strictDietTerms maps each term strict mode excludes beyond the plan's
+// own exclude_ingredients, synonyms included, to the entry it comes from.
+func strictDietTerms(plan DietPlan) map[string]string {
+	excluded, _ := plan.Filters["exclude_ingredients"].([]string)
+	terms := map[string]string{}
+	for _, word := range excluded {
+		for _, term := range classTerms(word) {
+			if _, seen := terms[term]; !seen && !slices.Contains(excluded, term) {
+				terms[term] = word
+			}
+		}
+	}
+	return terms
+}
+
+// strictDietPattern is a strict term with its compiled termPattern and
+// the plan entry it comes from.
+type strictDietPattern struct {
+	term     string
+	excluded string
+	pattern  *regexp.Regexp
+}
+
+// strictDietPatternCache holds strictDietPatterns results keyed by the
+// terms they were built from, so each plan's patterns compile once.
+var strictDietPatternCache sync.Map
+
+// strictDietPatterns returns strictDietTerms in term order with their
+// patterns.
+func strictDietPatterns(plan DietPlan) []strictDietPattern {
+	terms := strictDietTerms(plan)
+	keys := sortedKeys(terms)
+	var key strings.Builder
+	for _, term := range keys {
+		key.WriteString(term + "=" + terms[term] + "\n")
+	}
+	if cached, ok := strictDietPatternCache.Load(key.String()); ok {
+		return cached.([]strictDietPattern)
+	}
+	patterns := make([]strictDietPattern, len(keys))
+	for i, term := range keys {
+		patterns[i] = strictDietPattern{term: term, excluded: terms[term], pattern: termPattern(term)}
+	}
+	strictDietPatternCache.Store(key.String(), patterns)
+	return patterns
+}
+
+// dietFilterSQL applies a plan in the given mode.
+func dietFilterSQL(query string, args []interface{}, plan DietPlan, mode string) (string, []interface{}) {
+	query, args = applyDietFilters(query, args, plan.Filters)
+	if mode != dietModeStrict {
+		return query, args
+	}
+	for _, term := range sortedKeys(strictDietTerms(plan)) {
+		query += " AND ingredients NOT LIKE ?"
+		args = append(args, "%"+term+"%")
+	}
+	return query, args
+}
+
+// dietBorderline flags the ingredients of lenient matches that name, as a
+// whole word of the parsed ingredient, something strict mode excludes.
+func dietBorderline(recipes []Recipe, plan DietPlan) []DietFlag {
+	patterns := strictDietPatterns(plan)
+	flags := []DietFlag{}
+	for _, recipe := range recipes {
+		for _, line := range recipe.Ingredients {
+			name := parseIngredientLine(line).Name
+			if name == "" {
+				name = line
+			}
+			for _, strict := range patterns {
+				if strict.pattern.MatchString(name) {
+					flags = append(flags, DietFlag{RecipeID: recipe.ID, Ingredient: line, Matched: strict.term, Excluded: strict.excluded})
+					break
+				}
+			}
+		}
+	}
+	return flags
+}
+
+// RestrictionBundle is a religious or ethical rule set that combines with
+// any diet through restrictions=. Exclude names ingredient classes from
+// dietIngredientClasses or plain words; Separate lists pairs of classes a
+// recipe may not contain together. Bundles always match like strict diets,
+// erring towards exclusion, so "ham" also rules out graham crackers.
+type RestrictionBundle struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Exclude     []string    `json:"exclude"`
+	Separate    [][2]string `json:"separate,omitempty"`
+}
+
+var restrictionBundles = map[string]RestrictionBundle{
+	"halal": {
+		Name:        "Halal",
+		Description: "No pork, alcohol or gelatin",
+		Exclude:     []string{"pork", "alcohol", "gelatin"},
+	},
+	"kosher": {
+		Name:        "Kosher",
+		Description: "No pork or shellfish, and meat never with dairy",
+		Exclude:     []string{"pork", "seafood"},
+		Separate:    [][2]string{{"meat", "dairy"}},
+	},
+	"pescatarian": {
+		Name:        "Pescatarian",
+		Description: "Fish and seafood but no meat",
+		Exclude:     []string{"meat"},
+	},
+	"no_alcohol": {
+		Name:        "No alcohol",
+		Description: "No wine, beer, spirits or cooking alcohol",
+		Exclude:     []string{"alcohol"},
+	},
+}
+
+// classTerms returns word, the members of its class if it names one, and
+// the synonyms of each.
+func classTerms(word string) []string {
+	terms := []string{}
+	for _, member := range append([]string{word}, dietIngredientClasses[word]...) {
+		for _, term := range ingredientSynonyms.expand(member) {
+			if !slices.Contains(terms, term) {
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms
+}
+
+// restrictionFilterSQL applies a comma-separated list of restriction
+// bundles.
+func restrictionFilterSQL(value string) (string, []interface{}, error) {
+	query := ""
+	args := []interface{}{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		bundle, ok := restrictionBundles[name]
+		if !ok {
+			return "", nil, fmt.Errorf("restrictions must be among: %s", strings.Join(sortedKeys(restrictionBundles), ", "))
+		}
+		for _, word := range bundle.Exclude {
+			for _, term := range classTerms(word) {
+				query += " AND ingredients NOT LIKE ?"
+				args = append(args, "%"+term+"%")
+			}
+		}
+		for _, pair := range bundle.Separate {
+			var sides [2]string
+			for i, class := range pair {
+				conditions := []string{}
+				for _, term := range classTerms(class) {
+					conditions = append(conditions, "ingredients LIKE ?")
+					args = append(args, "%"+term+"%")
+				}
+				sides[i] = "(" + strings.Join(conditions, " OR ") + ")"
+			}
+			query += " AND NOT (" + sides[0] + " AND " + sides[1] + ")"
+		}
+	}
+	return query, args, nil
+}
+
+func getDietPlans(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"diet_plans": tenantFromContext(c).dietPlans(), "restrictions": restrictionBundles})
+}
+
+func getRecipeByID(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	
+	recipe, err := selectRecipes().Where("id = ?", id).Visible(tenantFromContext(c)).Prepared().One()
+	if err == sql.ErrNoRows {
+		// A recipe merged into another as a duplicate redirects to it.
+		var mergedInto int
+		if db.QueryRow("SELECT merged_into FROM recipes WHERE id = ? AND merged_into IS NOT NULL", id).Scan(&mergedInto) == nil {
+			c.Redirect(http.StatusMovedPermanently, "/api/recipe/"+strconv.Itoa(mergedInto))
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	
+	if err := loadRecipeImages(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRecipeEquipment(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRecipeStorage(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRecipeSteps(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadNutritionEstimate(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRatingStats(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRecipeCuisines(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	translated := []Recipe{recipe}
+	if err := localizeRecipes(c, translated); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipe = translated[0]
+	c.Header("Content-Language", cmp.Or(recipe.Locale, sourceLocale))
+	recordRecipeView(c, recipe.ID)
+
+	switch c.Query("format") {
+	case "assistant":
+		c.JSON(http.StatusOK, assistantRecipe(recipe))
+		return
+	case "markdown":
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(recipeMarkdown(recipe, 1)))
+		return
+	}
 	
-	query += " LIMIT 100"
-	
+	c.JSON(http.StatusOK, recipe)
+}
+
+// sourceLocale is the language recipes are written in. Translations are
+// stored per recipe and locale; fields a translation leaves empty fall
+// back to the source.
+const sourceLocale = "en"
+
+// maxPreferredLocales caps how many Accept-Language entries are tried.
+const maxPreferredLocales = 5
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})?$`)
+
+// normalizeLocale canonicalizes a language tag such as "pt_br" to "pt-BR".
+func normalizeLocale(tag string) (string, bool) {
+	tag = strings.TrimSpace(tag)
+	if !localePattern.MatchString(tag) {
+		return "", false
+	}
+	language, region, hasRegion := strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+	language = strings.ToLower(language)
+	if !hasRegion {
+		return language, true
+	}
+	if len(region) == 2 {
+		return language + "-" + strings.ToUpper(region), true
+	}
+	return language + "-" + strings.ToLower(region), true
+}
+
+// preferredLocales lists the locales to look for translations in, best
+// first: lang= when given, otherwise Accept-Language by quality. A
+// regional tag is followed by its base language. The list stops at the
+// source language, since nothing ranked below it would be used.
+func preferredLocales(c *gin.Context) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	entries := []weighted{}
+	if lang := c.Query("lang"); lang != "" {
+		entries = append(entries, weighted{lang, 1})
+	} else {
+		for _, part := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+			tag, params, _ := strings.Cut(part, ";")
+			q := 1.0
+			if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+			if q > 0 {
+				entries = append(entries, weighted{tag, q})
+			}
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+	}
+
+	locales := []string{}
+	for _, entry := range entries {
+		locale, ok := normalizeLocale(entry.tag)
+		if !ok {
+			continue
+		}
+		base, _, _ := strings.Cut(locale, "-")
+		if base == sourceLocale {
+			return locales
+		}
+		for _, candidate := range []string{locale, base} {
+			if !slices.Contains(locales, candidate) && len(locales) < maxPreferredLocales {
+				locales = append(locales, candidate)
+			}
+		}
+	}
+	return locales
+}
+
+// RecipeTranslation holds a recipe's text in one locale. Source is
+// "manual" for translations entered by an admin and "machine" for ones
+// from the LLM backfill.
+type RecipeTranslation struct {
+	RecipeID     int       `json:"recipe_id"`
+	Locale       string    `json:"locale"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Instructions []string  `json:"instructions"`
+	Source       string    `json:"source"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// loadTranslations returns, per recipe, its translations in the given
+// locales keyed by locale.
+func loadTranslations(ids []int, locales []string) (map[int]map[string]RecipeTranslation, error) {
+	out := map[int]map[string]RecipeTranslation{}
+	if len(ids) == 0 || len(locales) == 0 {
+		return out, nil
+	}
+	idPlaceholders := make([]string, len(ids))
+	localePlaceholders := make([]string, len(locales))
+	args := []interface{}{}
+	for i, id := range ids {
+		idPlaceholders[i] = "?"
+		args = append(args, id)
+	}
+	for i, locale := range locales {
+		localePlaceholders[i] = "?"
+		args = append(args, locale)
+	}
+	rows, err := db.Query("SELECT recipe_id, locale, name, description, instructions, source, updated_at FROM recipe_translations WHERE recipe_id IN ("+
+		strings.Join(idPlaceholders, ", ")+") AND locale IN ("+strings.Join(localePlaceholders, ", ")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t RecipeTranslation
+		var instructionsJSON sql.NullString
+		if err := rows.Scan(&t.RecipeID, &t.Locale, &t.Name, &t.Description, &instructionsJSON, &t.Source, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if instructionsJSON.Valid {
+			json.Unmarshal([]byte(instructionsJSON.String), &t.Instructions)
+		}
+		if out[t.RecipeID] == nil {
+			out[t.RecipeID] = map[string]RecipeTranslation{}
+		}
+		out[t.RecipeID][t.Locale] = t
+	}
+	return out, rows.Err()
+}
+
+// localizeRecipes swaps in the caller's best available translation of each
+// recipe's name, description and instructions, and sets Locale on the
+// recipes it changed. Translated instructions are used only when they have
+// as many steps as the source, so step photos and timers still line up.
+// Ingredient lines keep their text but name ingredients from the synonym
+// dictionary's entries for the best locale it has.
+//
+// localizeResponses does this for every response; handlers call it
+// themselves only when they go on to use the translated text, and the
+// layer then leaves their body alone.
+func localizeRecipes(c *gin.Context, recipes []Recipe) error {
+	c.Set(recipesLocalizedKey, true)
+	locales := preferredLocales(c)
+	if len(locales) == 0 || len(recipes) == 0 {
+		return nil
+	}
+	ids := make([]int, len(recipes))
+	for i, recipe := range recipes {
+		ids[i] = recipe.ID
+	}
+	translations, err := loadTranslations(ids, locales)
+	if err != nil {
+		return err
+	}
+	for i := range recipes {
+		for _, locale := range locales {
+			t, ok := translations[recipes[i].ID][locale]
+			if !ok {
+				continue
+			}
+			if t.Name != "" {
+				recipes[i].Name = t.Name
+			}
+			if t.Description != "" {
+				recipes[i].Description = t.Description
+			}
+			if len(t.Instructions) == len(recipes[i].Instructions) {
+				recipes[i].Instructions = t.Instructions
+			}
+			recipes[i].Locale = locale
+			break
+		}
+	}
+	for _, locale := range locales {
+		if names := ingredientSynonyms.names(locale); names != nil {
+			for i := range recipes {
+				recipes[i].Ingredients = localizeIngredients(recipes[i].Ingredients, names)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// recipesLocalizedKey marks a request whose handler ran localizeRecipes.
+const recipesLocalizedKey = "recipes_localized"
+
+// localizeResponses applies localizeRecipes to the recipes in any JSON
+// response, so every endpoint returning recipes honours lang and
+// Accept-Language. Like formatForLocale it treats any object carrying
+// nutrition_units as a recipe. Admin responses keep the source text, which
+// is what admins edit. If localizing fails the body goes out untranslated.
+func localizeResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if strings.HasPrefix(c.FullPath(), "/api/admin") {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept-Language")
+		locales := preferredLocales(c)
+		if len(locales) == 0 {
+			c.Next()
+			return
+		}
+
+		w := &encodingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		if !w.transcode {
+			return
+		}
+		raw := w.body.Bytes()
+		if c.GetBool(recipesLocalizedKey) {
+			w.ResponseWriter.Write(raw)
+			return
+		}
+		body, err := localizeRecipeJSON(raw, locales)
+		if err != nil {
+			requestLogger(c).Error("response localization failed", "error", err)
+			body = raw
+		}
+		w.ResponseWriter.Write(body)
+	}
+}
+
+// localizeRecipeJSON localizes the recipe objects in a JSON body, returning
+// it unchanged when there are none.
+func localizeRecipeJSON(raw []byte, locales []string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	recipes := []map[string]interface{}{}
+	ids := []int{}
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if _, ok := v["nutrition_units"].(map[string]interface{}); ok {
+				if number, ok := v["id"].(json.Number); ok {
+					if id, err := number.Int64(); err == nil {
+						recipes = append(recipes, v)
+						ids = append(ids, int(id))
+					}
+				}
+			}
+			for _, item := range v {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(value)
+	if len(recipes) == 0 {
+		return raw, nil
+	}
+
+	translations, err := loadTranslations(ids, locales)
+	if err != nil {
+		return nil, err
+	}
+	var names []localizedName
+	for _, locale := range locales {
+		if names = ingredientSynonyms.names(locale); names != nil {
+			break
+		}
+	}
+	for i, recipe := range recipes {
+		for _, locale := range locales {
+			t, ok := translations[ids[i]][locale]
+			if !ok {
+				continue
+			}
+			if t.Name != "" {
+				recipe["name"] = t.Name
+			}
+			if t.Description != "" {
+				recipe["description"] = t.Description
+			}
+			if instructions, ok := recipe["instructions"].([]interface{}); ok && len(t.Instructions) == len(instructions) {
+				recipe["instructions"] = t.Instructions
+			}
+			recipe["locale"] = locale
+			break
+		}
+		if ingredients, ok := recipe["ingredients"].([]interface{}); ok && names != nil {
+			lines := make([]string, len(ingredients))
+			for j, line := range ingredients {
+				lines[j], _ = line.(string)
+			}
+			recipe["ingredients"] = localizeIngredients(lines, names)
+		}
+	}
+	return json.Marshal(value)
+}
+
+func listRecipeTranslations(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	rows, err := db.Query("SELECT locale FROM recipe_translations WHERE recipe_id = ? ORDER BY locale", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	locales := []string{}
+	for rows.Next() {
+		var locale string
+		if err := rows.Scan(&locale); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		locales = append(locales, locale)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	translations, err := loadTranslations([]int{id}, locales)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	list := []RecipeTranslation{}
+	for _, locale := range locales {
+		list = append(list, translations[id][locale])
+	}
+	c.JSON(http.StatusOK, gin.H{"recipe_id": id, "source_locale": sourceLocale, "translations": list})
+}
+
+// PutTranslationRequest sets a recipe's text in one locale. Empty fields
+// fall back to the source language.
+type PutTranslationRequest struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Instructions []string `json:"instructions"`
+}
+
+func putRecipeTranslation(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	locale, ok := normalizeLocale(c.Param("locale"))
+	if !ok || locale == sourceLocale {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid locale"})
+		return
+	}
+	var req PutTranslationRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Name == "" && req.Description == "" && len(req.Instructions) == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ?)", id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	if err := saveTranslation(RecipeTranslation{RecipeID: id, Locale: locale, Name: req.Name, Description: req.Description, Instructions: req.Instructions, Source: "manual"}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("translation saved", "recipe_id", id, "locale", locale, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"recipe_id": id, "locale": locale, "name": req.Name, "description": req.Description, "instructions": req.Instructions, "source": "manual"})
+}
+
+func saveTranslation(t RecipeTranslation) error {
+	var instructionsJSON interface{}
+	if len(t.Instructions) > 0 {
+		data, _ := json.Marshal(t.Instructions)
+		instructionsJSON = string(data)
+	}
+	_, err := db.Exec(`INSERT INTO recipe_translations (recipe_id, locale, name, description, instructions, source) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE name = VALUES(name), description = VALUES(description), instructions = VALUES(instructions), source = VALUES(source), updated_at = CURRENT_TIMESTAMP`,
+		t.RecipeID, t.Locale, t.Name, t.Description, instructionsJSON, t.Source)
+	return err
+}
+
+func deleteRecipeTranslation(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	locale, _ := normalizeLocale(c.Param("locale"))
+	res, err := db.Exec("DELETE FROM recipe_translations WHERE recipe_id = ? AND locale = ?", id, locale)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Translation not found"})
+		return
+	}
+	requestLogger(c).Info("translation removed", "recipe_id", id, "locale", locale, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"recipe_id": id, "locale": locale, "deleted": true})
+}
+
+// TranslationBackfillRequest asks the LLM to translate up to Limit recipes
+// that have no translation in Locale yet.
+type TranslationBackfillRequest struct {
+	Locale string `json:"locale" binding:"required"`
+	Limit  int    `json:"limit"`
+}
+
+const (
+	defaultTranslationBackfill = 50
+	maxTranslationBackfill     = 500
+)
+
+// backfillTranslations starts a job machine-translating recipes into a
+// locale. Recipes that already have a translation there, manual or
+// machine, are left alone.
+func backfillTranslations(c *gin.Context) {
+	var req TranslationBackfillRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Limit < 0 || req.Limit > maxTranslationBackfill {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	locale, ok := normalizeLocale(req.Locale)
+	if !ok || locale == sourceLocale {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid locale"})
+		return
+	}
+	req.Locale = locale
+	if req.Limit == 0 {
+		req.Limit = defaultTranslationBackfill
+	}
+
+	by := adminFromContext(c).Subject
+	id, err := startJob("translation_backfill", req, by, false, func(ctx context.Context) (interface{}, error) {
+		return machineTranslate(ctx, locale, req.Limit)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("translation backfill started", "job", id, "locale", locale, "limit", req.Limit, "by", by)
+	c.Header("Location", fmt.Sprintf("/api/admin/jobs/%d", id))
+	c.JSON(http.StatusAccepted, gin.H{"job_id": id, "status": jobQueued, "status_url": fmt.Sprintf("/api/admin/jobs/%d", id)})
+}
+
+// machineTranslate translates recipes missing from a locale one at a time,
+// stopping at the first LLM failure so a dead provider doesn't burn
+// through the whole batch. LLM spend is recorded against the job.
+func machineTranslate(ctx context.Context, locale string, limit int) (interface{}, error) {
+	recipes, err := selectRecipes().
+		Where("NOT EXISTS (SELECT 1 FROM recipe_translations t WHERE t.recipe_id = recipes.id AND t.locale = ?)", locale).
+		OrderBy("id").Limit(limit).All()
+	if err != nil {
+		return nil, err
+	}
+
+	systemPrompt := `You translate recipes from English into the language with BCP 47 tag ` + locale + `.
+Translate naturally for home cooks; keep quantities, units and numbers as they are.
+
+Respond ONLY with a JSON object: {"name": string, "description": string, "instructions": [string]}
+with exactly one translated instruction per instruction given.`
+
+	translated := 0
+	for _, recipe := range recipes {
+		if err := ctx.Err(); err != nil {
+			return gin.H{"locale": locale, "translated": translated}, err
+		}
+		source, _ := json.Marshal(gin.H{"name": recipe.Name, "description": recipe.Description, "instructions": recipe.Instructions})
+		result, err := callLLM(ctx, []map[string]interface{}{
+			{"role": "system", "content": systemPrompt},
+			{"role": "user", "content": string(source)},
+		})
+		insertLLMUsage("job:translation_backfill", "translations/backfill", result)
+		if err != nil {
+			return gin.H{"locale": locale, "translated": translated}, err
+		}
+
+		var t RecipeTranslation
+		if err := json.Unmarshal([]byte(extractJSONObject(result.Content)), &t); err != nil || t.Name == "" {
+			slog.Warn("unusable machine translation", "recipe_id", recipe.ID, "locale", locale)
+			continue
+		}
+		t.RecipeID, t.Locale, t.Source = recipe.ID, locale, "machine"
+		if err := saveTranslation(t); err != nil {
+			return gin.H{"locale": locale, "translated": translated}, err
+		}
+		translated++
+	}
+	return gin.H{"locale": locale, "translated": translated, "candidates": len(recipes)}, nil
+}
+
+// Cuisine labels. Classification proposes labels with a confidence, from
+// keyword rules and optionally the LLM; editors approve or reject them
+// through the admin API. Only approved labels are served and searchable.
+const (
+	cuisineProposed = "proposed"
+	cuisineApproved = "approved"
+	cuisineRejected = "rejected"
+
+	// minCuisineConfidence is the least confidence a proposal is kept at.
+	minCuisineConfidence = 0.4
+	// confidentCuisine is the rules confidence above which the LLM isn't
+	// asked.
+	confidentCuisine  = 0.8
+	maxRecipeCuisines = 2
+	cuisineLLMBatch   = 20
+
+	defaultCuisineClassification = 200
+	maxCuisineClassification     = 2000
+)
+
+// cuisineNamePatterns match dish names typical of a cuisine, which is
+// strong evidence. cuisineIngredients are signature ingredients, weak
+// evidence on their own that adds up.
+var (
+	cuisineNamePatterns = map[string]*regexp.Regexp{
+		"american":       regexp.MustCompile(`(?i)\b(burgers?|mac(aroni)? (and|&|n) cheese|meatloaf|cornbread|buffalo wings?|sloppy joes?|pot roast|cobbler|brownies?)\b`),
+		"chinese":        regexp.MustCompile(`(?i)\b(chow mein|lo mein|kung pao|dumplings?|wontons?|fried rice|sweet and sour|mapo|char siu|dim sum|bao|szechuan|sichuan|cantonese|hoisin)\b`),
+		"french":         regexp.MustCompile(`(?i)\b(ratatouille|coq au vin|bourguignon|quiche|souffl[eé]s?|cr[eê]pes?|gratin|bouillabaisse|ni[cç]oise|cassoulet|tarte|cr[eè]me br[uû]l[eé]e|croque)\b`),
+		"greek":          regexp.MustCompile(`(?i)\b(moussaka|souvlaki|spanakopita|tzatziki|gyros?|pastitsio|dolmades|greek)\b`),
+		"indian":         regexp.MustCompile(`(?i)\b(curry|tikka|masala|korma|dal|dhal|biryani|tandoori|vindaloo|paneer|samosas?|chana|aloo|naan|raita|indian)\b`),
+		"italian":        regexp.MustCompile(`(?i)\b(pasta|spaghetti|lasagn[ae]s?|risotto|pizza|carbonara|bolognese|gnocchi|penne|fettuccine|ravioli|tortellini|parmigiana|minestrone|focaccia|tiramisu|bruschetta|pesto|italian)\b`),
+		"japanese":       regexp.MustCompile(`(?i)\b(sushi|ramen|teriyaki|miso|tempura|udon|soba|katsu|yakitori|donburi|gyoza|onigiri|japanese)\b`),
+		"korean":         regexp.MustCompile(`(?i)\b(kimchi|bibimbap|bulgogi|gochujang|japchae|tteokbokki|korean)\b`),
+		"mexican":        regexp.MustCompile(`(?i)\b(tacos?|burritos?|enchiladas?|quesadillas?|fajitas?|nachos|guacamole|salsa|tamales?|pozole|chilaquiles|mole|mexican)\b`),
+		"middle_eastern": regexp.MustCompile(`(?i)\b(hummus|falafel|shawarma|tabbouleh|fattoush|baba ganoush|shakshuka|kofta|kebabs?|tahini|za'?atar|lebanese|persian)\b`),
+		"spanish":        regexp.MustCompile(`(?i)\b(paella|gazpacho|tapas|patatas bravas|churros|tortilla espa[nñ]ola|chorizo|spanish)\b`),
+		"thai":           regexp.MustCompile(`(?i)\b(pad thai|tom yum|tom kha|green curry|red curry|massaman|larb|som tam|thai)\b`),
+		"vietnamese":     regexp.MustCompile(`(?i)\b(pho|banh mi|b[aá]nh|spring rolls?|bun cha|vietnamese)\b`),
+	}
+	cuisineIngredients = map[string][]string{
+		"chinese":        {"soy sauce", "oyster sauce", "hoisin", "five spice", "shaoxing", "sesame oil", "bok choy", "star anise"},
+		"french":         {"shallot", "tarragon", "dijon", "gruyere", "creme fraiche", "herbes de provence", "cognac"},
+		"greek":          {"feta", "kalamata", "oregano", "phyllo", "greek yogurt"},
+		"indian":         {"garam masala", "turmeric", "cumin", "cardamom", "ghee", "fenugreek", "curry leaves", "mustard seeds", "coriander"},
+		"italian":        {"parmesan", "mozzarella", "basil", "ricotta", "prosciutto", "pancetta", "balsamic", "pecorino", "marinara"},
+		"japanese":       {"mirin", "sake", "dashi", "nori", "wasabi", "bonito", "panko", "miso"},
+		"korean":         {"gochujang", "gochugaru", "kimchi", "doenjang"},
+		"mexican":        {"tortilla", "jalapeno", "chipotle", "cilantro", "black beans", "queso fresco", "poblano"},
+		"middle_eastern": {"tahini", "sumac", "za'atar", "chickpeas", "pomegranate molasses", "bulgur"},
+		"spanish":        {"smoked paprika", "saffron", "chorizo", "manchego", "sherry vinegar"},
+		"thai":           {"fish sauce", "lemongrass", "galangal", "thai basil", "coconut milk", "kaffir lime", "palm sugar"},
+		"vietnamese":     {"fish sauce", "rice paper", "rice noodles", "vietnamese mint", "star anise"},
+	}
+	cuisineIngredientPatterns = func() map[string][]*regexp.Regexp {
+		patterns := map[string][]*regexp.Regexp{}
+		for cuisine, ingredients := range cuisineIngredients {
+			for _, ingredient := range ingredients {
+				patterns[cuisine] = append(patterns[cuisine], termPattern(ingredient))
+			}
+		}
+		return patterns
+	}()
+)
+
+type CuisineLabel struct {
+	Cuisine    string  `json:"cuisine"`
+	Confidence float64 `json:"confidence"`
+}
+
+// CuisineProposal is a label as editors review it.
+type CuisineProposal struct {
+	RecipeID   int        `json:"recipe_id"`
+	RecipeName string     `json:"recipe_name"`
+	Cuisine    string     `json:"cuisine"`
+	Confidence float64    `json:"confidence"`
+	Source     string     `json:"source"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReviewedBy *string    `json:"reviewed_by"`
+	ReviewedAt *time.Time `json:"reviewed_at"`
+}
+
+type CuisineClassificationRequest struct {
+	Limit  int  `json:"limit"`
+	UseLLM bool `json:"use_llm"`
+}
+
+type ReviewCuisinesRequest struct {
+	Approve []string `json:"approve"`
+	Reject  []string `json:"reject"`
+}
+
+type ApproveCuisinesRequest struct {
+	MinConfidence float64 `json:"min_confidence" binding:"required"`
+	Source        string  `json:"source"`
+}
+
+type SetCuisinesRequest struct {
+	Cuisines []string `json:"cuisines" binding:"required"`
+}
+
+// cuisineNames is every label classification proposes and search accepts.
+func cuisineNames() []string {
+	return sortedKeys(cuisineNamePatterns)
+}
+
+// normalizeCuisines lowercases and de-duplicates labels, rejecting unknown
+// ones.
+func normalizeCuisines(values []string) ([]string, error) {
+	cuisines := []string{}
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" || slices.Contains(cuisines, value) {
+			continue
+		}
+		if cuisineNamePatterns[value] == nil {
+			return nil, fmt.Errorf("unknown cuisine %q; use one of %s", value, strings.Join(cuisineNames(), ", "))
+		}
+		cuisines = append(cuisines, value)
+	}
+	return cuisines, nil
+}
+
+// cuisineFilterSQL keeps recipes with any of the comma-separated approved
+// cuisine labels.
+func cuisineFilterSQL(value string) (string, []interface{}, error) {
+	cuisines, err := normalizeCuisines(strings.Split(value, ","))
+	if err != nil || len(cuisines) == 0 {
+		return "", nil, err
+	}
+	args := []interface{}{cuisineApproved}
+	for _, cuisine := range cuisines {
+		args = append(args, cuisine)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(cuisines)), ", ")
+	return " AND id IN (SELECT recipe_id FROM recipe_cuisines WHERE status = ? AND cuisine IN (" + placeholders + "))", args, nil
+}
+
+// classifyCuisineByRules scores each cuisine on the recipe's name and
+// ingredients, best first. A name match is worth 0.85; each signature
+// ingredient 0.25, counting from the second.
+func classifyCuisineByRules(recipe Recipe) []CuisineLabel {
+	ingredients := strings.Join(recipe.Ingredients, "\n")
+	labels := []CuisineLabel{}
+	for _, cuisine := range cuisineNames() {
+		hits := 0
+		for _, pattern := range cuisineIngredientPatterns[cuisine] {
+			if pattern.MatchString(ingredients) {
+				hits++
+			}
+		}
+		confidence := 0.0
+		if cuisineNamePatterns[cuisine].MatchString(recipe.Name) {
+			confidence = math.Min(0.95, 0.85+0.05*float64(hits))
+		} else if hits >= 2 {
+			confidence = math.Min(0.75, 0.25*float64(hits))
+		}
+		if confidence >= minCuisineConfidence {
+			labels = append(labels, CuisineLabel{cuisine, math.Round(confidence*100) / 100})
+		}
+	}
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].Confidence > labels[j].Confidence })
+	if len(labels) > maxRecipeCuisines {
+		labels = labels[:maxRecipeCuisines]
+	}
+	return labels
+}
+
+// classifyCuisinesWithLLM labels a batch of recipes in one prompt. Labels
+// outside cuisineNames or below minCuisineConfidence are dropped.
+func classifyCuisinesWithLLM(ctx context.Context, recipes []Recipe) (map[int][]CuisineLabel, error) {
+	type item struct {
+		ID          int      `json:"id"`
+		Name        string   `json:"name"`
+		Ingredients []string `json:"ingredients"`
+	}
+	items := make([]item, len(recipes))
+	for i, recipe := range recipes {
+		items[i] = item{recipe.ID, recipe.Name, recipe.Ingredients}
+	}
+	batch, _ := json.Marshal(items)
+
+	systemPrompt := `You label recipes with their cuisine. Allowed cuisines: ` + strings.Join(cuisineNames(), ", ") + `.
+Give at most ` + strconv.Itoa(maxRecipeCuisines) + ` cuisines per recipe with a confidence from 0 to 1, and none when the dish has no clear cuisine.
+
+Respond ONLY with a JSON object: {"results": [{"id": number, "cuisines": [{"cuisine": string, "confidence": number}]}]}`
+
+	result, err := callLLM(ctx, []map[string]interface{}{
+		{"role": "system", "content": systemPrompt},
+		{"role": "user", "content": string(batch)},
+	})
+	insertLLMUsage("job:cuisine_classification", "cuisines/classify", result)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Results []struct {
+			ID       int            `json:"id"`
+			Cuisines []CuisineLabel `json:"cuisines"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(extractJSONObject(result.Content)), &parsed); err != nil {
+		return nil, fmt.Errorf("unusable classification: %w", err)
+	}
+	labels := map[int][]CuisineLabel{}
+	for _, r := range parsed.Results {
+		for _, label := range r.Cuisines {
+			label.Cuisine = strings.ToLower(strings.TrimSpace(label.Cuisine))
+			if cuisineNamePatterns[label.Cuisine] == nil || label.Confidence < minCuisineConfidence || len(labels[r.ID]) >= maxRecipeCuisines {
+				continue
+			}
+			label.Confidence = math.Round(math.Min(label.Confidence, 1)*100) / 100
+			labels[r.ID] = append(labels[r.ID], label)
+		}
+	}
+	return labels, nil
+}
+
+// classifyCuisines proposes labels for recipes that have none, by rules
+// and, with useLLM, by the LLM for those the rules aren't confident about.
+// LLM batches stop at the first failure, keeping the rules' proposals.
+func classifyCuisines(ctx context.Context, limit int, useLLM bool) (interface{}, error) {
+	recipes, err := selectRecipes().
+		Where("deleted_at IS NULL").
+		Where("NOT EXISTS (SELECT 1 FROM recipe_cuisines rc WHERE rc.recipe_id = recipes.id)").
+		OrderBy("id").Limit(limit).All()
+	if err != nil {
+		return nil, err
+	}
+
+	proposals := map[int][]CuisineLabel{}
+	sources := map[int]string{}
+	unsure := []Recipe{}
+	for _, recipe := range recipes {
+		labels := classifyCuisineByRules(recipe)
+		if len(labels) > 0 {
+			proposals[recipe.ID], sources[recipe.ID] = labels, "rules"
+		}
+		if len(labels) == 0 || labels[0].Confidence < confidentCuisine {
+			unsure = append(unsure, recipe)
+		}
+	}
+
+	batches := 0
+	var llmErr error
+	for start := 0; useLLM && start < len(unsure); start += cuisineLLMBatch {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch := unsure[start:min(start+cuisineLLMBatch, len(unsure))]
+		labels, err := classifyCuisinesWithLLM(ctx, batch)
+		if err != nil {
+			llmErr = err
+			break
+		}
+		batches++
+		for id, recipeLabels := range labels {
+			if len(recipeLabels) > 0 {
+				proposals[id], sources[id] = recipeLabels, "llm"
+			}
+		}
+	}
+
+	stored := 0
+	for _, id := range sortedKeys(proposals) {
+		for _, label := range proposals[id] {
+			if _, err := db.Exec("INSERT IGNORE INTO recipe_cuisines (recipe_id, cuisine, confidence, source, status) VALUES (?, ?, ?, ?, ?)",
+				id, label.Cuisine, label.Confidence, sources[id], cuisineProposed); err != nil {
+				return gin.H{"recipes_labeled": len(proposals), "proposals": stored}, err
+			}
+			stored++
+		}
+	}
+	result := gin.H{"candidates": len(recipes), "recipes_labeled": len(proposals), "proposals": stored, "llm_batches": batches}
+	if llmErr != nil {
+		result["llm_error"] = llmErr.Error()
+	}
+	return result, nil
+}
+
+// startCuisineClassification starts a job proposing cuisine labels for up
+// to limit unlabeled recipes.
+func startCuisineClassification(c *gin.Context) {
+	var req CuisineClassificationRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil || req.Limit < 0 || req.Limit > maxCuisineClassification {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultCuisineClassification
+	}
+
+	by := adminFromContext(c).Subject
+	id, err := startJob("cuisine_classification", req, by, false, func(ctx context.Context) (interface{}, error) {
+		return classifyCuisines(ctx, req.Limit, req.UseLLM)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("cuisine classification started", "job", id, "limit", req.Limit, "use_llm", req.UseLLM, "by", by)
+	c.Header("Location", fmt.Sprintf("/api/admin/jobs/%d", id))
+	c.JSON(http.StatusAccepted, gin.H{"job_id": id, "status": jobQueued, "status_url": fmt.Sprintf("/api/admin/jobs/%d", id)})
+}
+
+// listCuisineProposals lists labels in one ?status=, proposed by default,
+// most confident first; ?cuisine= and ?source= narrow the list.
+func listCuisineProposals(c *gin.Context) {
+	status := c.DefaultQuery("status", cuisineProposed)
+	if status != cuisineProposed && status != cuisineApproved && status != cuisineRejected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be proposed, approved or rejected"})
+		return
+	}
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+
+	query := `SELECT rc.recipe_id, r.name, rc.cuisine, rc.confidence, rc.source, rc.status, rc.created_at, rc.reviewed_by, rc.reviewed_at
+		FROM recipe_cuisines rc JOIN recipes r ON r.id = rc.recipe_id
+		WHERE rc.status = ?`
+	args := []interface{}{status}
+	if cuisine := c.Query("cuisine"); cuisine != "" {
+		query += " AND rc.cuisine = ?"
+		args = append(args, strings.ToLower(cuisine))
+	}
+	if source := c.Query("source"); source != "" {
+		query += " AND rc.source = ?"
+		args = append(args, source)
+	}
+	query += " ORDER BY rc.confidence DESC, rc.recipe_id LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	proposals := []CuisineProposal{}
+	for rows.Next() {
+		var p CuisineProposal
+		if err := rows.Scan(&p.RecipeID, &p.RecipeName, &p.Cuisine, &p.Confidence, &p.Source, &p.Status, &p.CreatedAt, &p.ReviewedBy, &p.ReviewedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		proposals = append(proposals, p)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"proposals": proposals, "count": len(proposals), "limit": limit, "offset": offset})
+}
+
+// reviewRecipeCuisines approves and rejects a recipe's labels.
+func reviewRecipeCuisines(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req ReviewCuisinesRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Approve)+len(req.Reject) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	by := adminFromContext(c).Subject
+	reviewed := 0
+	for status, cuisines := range map[string][]string{cuisineApproved: req.Approve, cuisineRejected: req.Reject} {
+		for _, cuisine := range cuisines {
+			res, err := db.Exec("UPDATE recipe_cuisines SET status = ?, reviewed_by = ?, reviewed_at = NOW() WHERE recipe_id = ? AND cuisine = ?",
+				status, by, id, strings.ToLower(strings.TrimSpace(cuisine)))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			n, _ := res.RowsAffected()
+			reviewed += int(n)
+		}
+	}
+	if reviewed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No matching cuisine labels"})
+		return
+	}
+	requestLogger(c).Info("cuisines reviewed", "recipe_id", id, "approved", req.Approve, "rejected", req.Reject, "by", by)
+	recipe := Recipe{ID: id}
+	if err := loadRecipeCuisines(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "cuisines": recipe.Cuisines, "reviewed": reviewed})
+}
+
+// approveCuisineProposals approves every proposal at or above
+// min_confidence, optionally from one source only.
+func approveCuisineProposals(c *gin.Context) {
+	var req ApproveCuisinesRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.MinConfidence < minCuisineConfidence || req.MinConfidence > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("min_confidence must be between %g and 1", minCuisineConfidence)})
+		return
+	}
+	by := adminFromContext(c).Subject
+	query := "UPDATE recipe_cuisines SET status = ?, reviewed_by = ?, reviewed_at = NOW() WHERE status = ? AND confidence >= ?"
+	args := []interface{}{cuisineApproved, by, cuisineProposed, req.MinConfidence}
+	if req.Source != "" {
+		query += " AND source = ?"
+		args = append(args, req.Source)
+	}
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	approved, _ := res.RowsAffected()
+	requestLogger(c).Info("cuisine proposals approved", "min_confidence", req.MinConfidence, "source", req.Source, "approved", approved, "by", by)
+	c.JSON(http.StatusOK, gin.H{"approved": approved})
+}
+
+// setRecipeCuisines sets a recipe's labels by hand, approved at once; its
+// other labels are rejected.
+func setRecipeCuisines(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req SetCuisinesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	cuisines, err := normalizeCuisines(req.Cuisines)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ? AND deleted_at IS NULL)", id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	by := adminFromContext(c).Subject
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE recipe_cuisines SET status = ?, reviewed_by = ?, reviewed_at = NOW() WHERE recipe_id = ?", cuisineRejected, by, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, cuisine := range cuisines {
+		if _, err := tx.Exec(`INSERT INTO recipe_cuisines (recipe_id, cuisine, confidence, source, status, reviewed_by, reviewed_at) VALUES (?, ?, 1, 'manual', ?, ?, NOW())
+			ON DUPLICATE KEY UPDATE confidence = 1, source = 'manual', status = VALUES(status), reviewed_by = VALUES(reviewed_by), reviewed_at = NOW()`,
+			id, cuisine, cuisineApproved, by); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("recipe cuisines set", "recipe_id", id, "cuisines", cuisines, "by", by)
+	c.JSON(http.StatusOK, gin.H{"id": id, "cuisines": cuisines})
+}
+
+func loadRecipeCuisines(recipe *Recipe) error {
+	rows, err := db.Query("SELECT cuisine FROM recipe_cuisines WHERE recipe_id = ? AND status = ? ORDER BY confidence DESC, cuisine", recipe.ID, cuisineApproved)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	recipe.Cuisines = []string{}
+	for rows.Next() {
+		var cuisine string
+		if err := rows.Scan(&cuisine); err != nil {
+			return err
+		}
+		recipe.Cuisines = append(recipe.Cuisines, cuisine)
+	}
+	return rows.Err()
+}
+
+type ChatRequest struct {
+	Message string `json:"message" binding:"required"`
+}
+
+type ChatResponse struct {
+	GeneratedURL string      `json:"generated_url"`
+	ParsedQuery  string      `json:"parsed_query"`
+	Recipes      interface{} `json:"recipes,omitempty"`
+	Degraded     bool        `json:"degraded,omitempty"`
+	Usage        *ChatUsage  `json:"usage,omitempty"`
+}
+
+type ChatUsage struct {
+	Model            string  `json:"model"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+const (
+	defaultLLMURL           = "https://router.huggingface.co/v1/chat/completions"
+	defaultLLMModel         = "meta-llama/Llama-3.3-70B-Instruct:fireworks-ai"
+	defaultLLMFallbackModel = "meta-llama/Llama-3.1-8B-Instruct:fireworks-ai"
+	defaultLLMVisionModel   = "meta-llama/Llama-4-Scout-17B-16E-Instruct:groq"
+)
+
+var errLLMUnavailable = errors.New("LLM temporarily unavailable")
+
+type llmHTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *llmHTTPError) Error() string {
+	return fmt.Sprintf("LLM request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *llmHTTPError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// circuitBreaker stops calling the LLM after repeated failures and lets a
+// single probe through once the cooldown has passed. Other calls are
+// refused until the probe reports back; a failed probe reopens it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var llmBreaker = &circuitBreaker{}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.probing || b.failures >= cfg.LLM.BreakerThreshold {
+		b.openUntil = time.Now().Add(cfg.LLM.BreakerCooldown)
+		b.failures = 0
+		b.probing = false
+	}
+}
+
+// llmMaxRetryAfter caps how long a Retry-After header can hold a request
+// before its next attempt.
+const llmMaxRetryAfter = 30 * time.Second
+
+// llmResult is a completed chat completion along with the token usage
+// reported by the provider. Attempts lists every upstream request made for
+// it, failed ones included, and is set on errors too.
+type llmResult struct {
+	Content          string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Attempts         []llmAttempt
+}
+
+// llmAttempt is one upstream request. A failed one reports no usage, so it
+// is charged the estimated prompt: providers may bill timed-out requests,
+// and retries must not be free against the daily budget.
+type llmAttempt struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// estimatePromptTokens counts the text of messages at about four
+// characters a token. Images are left out.
+func estimatePromptTokens(messages []map[string]interface{}) int {
+	chars := 0
+	for _, message := range messages {
+		switch content := message["content"].(type) {
+		case string:
+			chars += len(content)
+		case []map[string]interface{}:
+			for _, part := range content {
+				if text, ok := part["text"].(string); ok {
+					chars += len(text)
+				}
+			}
+		}
+	}
+	return (chars + 3) / 4
+}
+
+// callLLM sends a chat completion to the primary model, then the fallback
+// model, retrying each on timeouts, 429 and 5xx responses. It gives up
+// when ctx is done.
+func callLLM(ctx context.Context, messages []map[string]interface{}) (llmResult, error) {
+	if !llmBreaker.allow() {
+		return llmResult{}, errLLMUnavailable
+	}
+
+	models := []string{cfg.LLM.Model}
+	if fallback := cfg.LLM.FallbackModel; fallback != "" && fallback != models[0] {
+		models = append(models, fallback)
+	}
+
+	var lastErr error
+	var attempts []llmAttempt
+	for _, model := range models {
+		if ctx.Err() != nil {
+			break
+		}
+		result, err := callLLMModel(ctx, model, messages)
+		attempts = append(attempts, result.Attempts...)
+		if err == nil {
+			llmBreaker.success()
+			result.Attempts = attempts
+			return result, nil
+		}
+		lastErr = err
+	}
+
+	llmBreaker.failure()
+	return llmResult{Attempts: attempts}, lastErr
+}
+
+func callLLMModel(ctx context.Context, model string, messages []map[string]interface{}) (llmResult, error) {
+	retries := cfg.LLM.MaxRetries
+	backoff := cfg.LLM.RetryBackoff
+
+	var err error
+	var attempts []llmAttempt
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			wait := backoff << (attempt - 1)
+			var httpErr *llmHTTPError
+			if errors.As(err, &httpErr) && httpErr.RetryAfter > wait {
+				wait = min(httpErr.RetryAfter, llmMaxRetryAfter)
+			}
+			// A retry that can't finish before the deadline isn't worth
+			// waiting for.
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				return llmResult{Attempts: attempts}, err
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return llmResult{Attempts: attempts}, err
+			case <-timer.C:
+			}
+		}
+
+		var result llmResult
+		start := time.Now()
+		result, err = doLLMRequest(ctx, model, messages)
+		llmRequestDuration.since(start, model)
+		if err == nil {
+			llmRequestsTotal.inc(model, "success")
+			result.Attempts = append(attempts, llmAttempt{model, result.PromptTokens, result.CompletionTokens})
+			return result, nil
+		}
+		llmRequestsTotal.inc(model, "error")
+		attempts = append(attempts, llmAttempt{Model: model, PromptTokens: estimatePromptTokens(messages)})
+
+		var httpErr *llmHTTPError
+		if errors.As(err, &httpErr) && !httpErr.retryable() {
+			return llmResult{Attempts: attempts}, err
+		}
+	}
+	return llmResult{Attempts: attempts}, err
+}
+
+// callVisionLLM asks LLM_VISION_MODEL about an image, sent inline as a
+// data URL in an OpenAI-style image_url content part. There is no
+// fallback model, since the text models can't see.
+func callVisionLLM(ctx context.Context, prompt string, image []byte, contentType string) (llmResult, error) {
+	if cfg.LLM.VisionModel == "" {
+		return llmResult{}, errLLMUnavailable
+	}
+	if !llmBreaker.allow() {
+		return llmResult{}, errLLMUnavailable
+	}
+	result, err := callLLMModel(ctx, cfg.LLM.VisionModel, []map[string]interface{}{
+		{"role": "user", "content": []map[string]interface{}{
+			{"type": "text", "text": prompt},
+			{"type": "image_url", "image_url": map[string]string{
+				"url": "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(image),
+			}},
+		}},
+	})
+	if err != nil {
+		llmBreaker.failure()
+		return result, err
+	}
+	llmBreaker.success()
+	return result, nil
+}
+
+// Search by photo. The vision model names the dish and the ingredients it
+// can see; recipes are then ranked on the dish name's words in their name
+// and on how many of those ingredients they use.
+const (
+	maxIdentifiedIngredients = 10
+	imageSearchPool          = 500
+	defaultImageSearchLimit  = 10
+)
+
+// DishIdentification is what the vision model made of a photo.
+type DishIdentification struct {
+	Dish        string   `json:"dish"`
+	Cuisine     string   `json:"cuisine,omitempty"`
+	Ingredients []string `json:"ingredients"`
+	Confidence  float64  `json:"confidence"`
+}
+
+const identifyDishPrompt = `Identify the dish in this photo for a recipe search.
+
+Respond ONLY with a JSON object: {"dish": string, "cuisine": string or null, "ingredients": [string], "confidence": number}
+where dish is the dish's common English name, ingredients are the main ingredients you can see (plain names like "chickpeas"), and confidence is 0 to 1. If the photo shows no food, use an empty dish.`
+
+// searchByImage identifies the dish in an uploaded photo and returns the
+// recipes closest to it.
+func searchByImage(c *gin.Context) {
+	if !featureEnabled(c, "llm_vision") || llmBudgetExceeded(c) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image search is unavailable"})
+		return
+	}
+	data, contentType, ok := readUploadedImage(c)
+	if !ok {
+		return
+	}
+	limit := defaultImageSearchLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+
+	result, err := callVisionLLM(c.Request.Context(), identifyDishPrompt, data, contentType)
+	recordLLMUsage(c, "recipes/search-by-image", result)
+	if err != nil {
+		requestLogger(c).Warn("dish identification failed", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image search is unavailable"})
+		return
+	}
+
+	var dish DishIdentification
+	if err := json.Unmarshal([]byte(extractJSONObject(result.Content)), &dish); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not identify the dish"})
+		return
+	}
+	dish.Dish = strings.TrimSpace(dish.Dish)
+	ingredients := []string{}
+	for _, ingredient := range dish.Ingredients {
+		ingredient = strings.ToLower(strings.TrimSpace(ingredient))
+		if ingredient != "" && !slices.Contains(ingredients, ingredient) && len(ingredients) < maxIdentifiedIngredients {
+			ingredients = append(ingredients, ingredient)
+		}
+	}
+	dish.Ingredients = ingredients
+	words := []string{}
+	for _, word := range strings.Fields(strings.ToLower(dish.Dish)) {
+		if len(word) >= 3 && !slices.Contains(words, word) {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 && len(ingredients) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "No dish recognized in the image", "identified": dish})
+		return
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+	for _, word := range words {
+		conditions = append(conditions, "name LIKE ?")
+		args = append(args, "%"+word+"%")
+	}
+	for _, ingredient := range ingredients {
+		for _, term := range ingredientSynonyms.expand(ingredient) {
+			conditions = append(conditions, "ingredients LIKE ?")
+			args = append(args, "%"+term+"%")
+		}
+	}
+	candidates, err := selectRecipes().Visible(tenantFromContext(c)).
+		Where("("+strings.Join(conditions, " OR ")+")", args...).
+		OrderBy("rating DESC, id").Limit(imageSearchPool).All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	wordPatterns := make([]*regexp.Regexp, len(words))
+	for i, word := range words {
+		wordPatterns[i] = termPattern(word)
+	}
+	scores := make(map[int]float64, len(candidates))
+	for _, recipe := range candidates {
+		score := 0.0
+		for _, pattern := range wordPatterns {
+			if pattern.MatchString(recipe.Name) {
+				score += 2 / float64(len(wordPatterns))
+			}
+		}
+		text := strings.ToLower(strings.Join(recipe.Ingredients, "\n"))
+		for _, ingredient := range ingredients {
+			for _, term := range ingredientSynonyms.expand(ingredient) {
+				if strings.Contains(text, strings.ToLower(term)) {
+					score += 1 / float64(len(ingredients))
+					break
+				}
+			}
+		}
+		if recipe.Rating != nil {
+			score += *recipe.Rating / 50
+		}
+		scores[recipe.ID] = score
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return scores[candidates[i].ID] > scores[candidates[j].ID] })
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"identified": dish, "recipes": candidates, "count": len(candidates)})
+}
+
+func doLLMRequest(ctx context.Context, model string, messages []map[string]interface{}) (llmResult, error) {
+	reqBody := map[string]interface{}{
+		"messages": messages,
+		"model":    model,
+		"stream":   false,
+	}
+
+	reqBodyJSON, _ := json.Marshal(reqBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.LLM.URL, bytes.NewBuffer(reqBodyJSON))
+	if err != nil {
+		return llmResult{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.LLM.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: cfg.LLM.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return llmResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		httpErr := &llmHTTPError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			httpErr.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return llmResult{}, httpErr
+	}
+
+	var aiResponse struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&aiResponse); err != nil {
+		return llmResult{}, err
+	}
+
+	if len(aiResponse.Choices) == 0 {
+		return llmResult{}, fmt.Errorf("empty response")
+	}
+
+	return llmResult{
+		Content:          aiResponse.Choices[0].Message.Content,
+		Model:            model,
+		PromptTokens:     aiResponse.Usage.PromptTokens,
+		CompletionTokens: aiResponse.Usage.CompletionTokens,
+	}, nil
+}
+
+var keywordStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "the": true, "with": true, "without": true, "for": true,
+	"of": true, "in": true, "on": true, "to": true, "me": true, "my": true, "some": true, "any": true,
+	"want": true, "need": true, "make": true, "find": true, "show": true, "give": true, "please": true,
+	"recipe": true, "recipes": true, "meal": true, "meals": true, "dish": true, "dishes": true, "food": true,
+	"high": true, "low": true, "under": true, "over": true, "less": true, "more": true, "than": true,
+	"minutes": true, "minute": true, "mins": true, "hour": true, "hours": true, "quick": true, "easy": true,
+	"healthy": true, "calorie": true, "calories": true, "protein": true, "carb": true, "carbs": true,
+	"fat": true, "sodium": true, "fiber": true, "diet": true, "no": true, "free": true,
+}
+
+// keywordSearchURL builds search parameters straight from the user's message
+// and is used when the LLM cannot be reached.
+func keywordSearchURL(message string) string {
+	params := url.Values{}
+	lower := strings.ToLower(message)
+
+	dietKeys := make([]string, 0, len(dietPlans))
+	for key := range dietPlans {
+		dietKeys = append(dietKeys, key)
+	}
+	sort.Strings(dietKeys)
+	// Keys match whole words, so "ketone" isn't keto.
+	padded := " " + strings.Join(strings.FieldsFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}), " ") + " "
+	for _, key := range dietKeys {
+		if strings.Contains(padded, " "+key+" ") || strings.Contains(padded, " "+strings.ReplaceAll(key, "_", " ")+" ") {
+			params.Set("diet", key)
+			lower = strings.ReplaceAll(strings.ReplaceAll(lower, key, " "), strings.ReplaceAll(key, "_", " "), " ")
+			break
+		}
+	}
+
+	words := strings.FieldsFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		if len(word) >= 3 && !keywordStopWords[word] {
+			params.Set("search", word)
+			break
+		}
+	}
+
+	return "?" + params.Encode()
+}
+
+// llmCost estimates the USD cost of a call from cfg.LLM.Pricing, which holds
+// the price per million prompt and completion tokens for each model.
+func llmCost(result llmResult) float64 {
+	price := cfg.LLM.Pricing[result.Model]
+	return (float64(result.PromptTokens)*price[0] + float64(result.CompletionTokens)*price[1]) / 1e6
+}
+
+// apiKeyID identifies the caller for usage accounting: a hash of the API key
+// when one is sent, otherwise the client IP. Callers of a tenant are
+// prefixed with its ID, so per-caller data never crosses tenants.
+func apiKeyID(c *gin.Context) string {
+	id := "ip:" + c.ClientIP()
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		id = "key:" + hex.EncodeToString(sum[:8])
+	}
+	if tenant := tenantFromContext(c); tenant != nil {
+		return tenant.ID + "/" + id
+	}
+	return id
+}
+
+// verifiedCallerID is apiKeyID for callers whose key was issued through
+// the admin API and not revoked; anyone else, including a caller sending
+// a key nobody issued, is identified by IP. Quotas, budgets and votes use
+// it, so a made-up key never earns a fresh allowance. issued reports
+// which it was.
+func verifiedCallerID(c *gin.Context) (id string, issued bool) {
+	key := c.GetHeader("X-API-Key")
+	if key != "" && tenants.issued(key) {
+		return apiKeyID(c), true
+	}
+	id = "ip:" + c.ClientIP()
+	if tenant := tenantFromContext(c); tenant != nil {
+		return tenant.ID + "/" + id, false
+	}
+	return id, false
+}
+
+// Tenant is a white-label deployment sharing this API. A request belongs
+// to a tenant through one of its API keys or its subdomain of
+// TENANT_BASE_DOMAIN; a request matching neither is served the global
+// catalog. Tenant diet plans are added to the global ones, replacing any
+// with the same key.
+type Tenant struct {
+	ID            string              `json:"id"`
+	Name          string              `json:"name"`
+	Subdomain     *string             `json:"subdomain"`
+	IncludeGlobal bool                `json:"include_global"`
+	DietPlans     map[string]DietPlan `json:"diet_plans"`
+	CreatedAt     time.Time           `json:"created_at"`
+}
+
+// tenantIDPattern keeps tenant IDs short enough to prefix an owner key
+// and still fit the 64-character owner columns.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,19}$`)
+
+// recipeScope is the condition for recipes the tenant may see in public
+// responses: its own and, unless it opted out, the global catalog. The nil
+// tenant sees only global recipes.
+func (t *Tenant) recipeScope() (string, []interface{}) {
+	switch {
+	case t == nil:
+		return publishedRecipe + " AND tenant_id IS NULL", nil
+	case t.IncludeGlobal:
+		return publishedRecipe + " AND (tenant_id = ? OR tenant_id IS NULL)", []interface{}{t.ID}
+	default:
+		return publishedRecipe + " AND tenant_id = ?", []interface{}{t.ID}
+	}
+}
+
+// canSee is recipeScope's tenant rule for a recipe already loaded.
+func (t *Tenant) canSee(recipe Recipe) bool {
+	if recipe.TenantID == nil {
+		return t == nil || t.IncludeGlobal
+	}
+	return t != nil && *recipe.TenantID == t.ID
+}
+
+func (t *Tenant) dietPlans() map[string]DietPlan {
+	if t == nil || len(t.DietPlans) == 0 {
+		return dietPlans
+	}
+	plans := make(map[string]DietPlan, len(dietPlans)+len(t.DietPlans))
+	for key, plan := range dietPlans {
+		plans[key] = plan
+	}
+	for key, plan := range t.DietPlans {
+		plans[key] = plan
+	}
+	return plans
+}
+
+// cacheKey namespaces a cache key by tenant, so one tenant's entries are
+// never served to another.
+func (t *Tenant) cacheKey(key string) string {
+	if t == nil {
+		return key
+	}
+	return "tenant:" + t.ID + ":" + key
+}
+
+// tenantDirectory caches the tenants and their API keys. It is reloaded
+// every tenantRefresh, so changes made through another instance apply
+// within that time, and at once on the instance that made them.
+type tenantDirectory struct {
+	mu          sync.Mutex
+	byID        map[string]*Tenant
+	byKey       map[string]*Tenant
+	bySubdomain map[string]*Tenant
+	loadedAt    time.Time
+}
+
+const tenantRefresh = time.Minute
+
+var tenants = &tenantDirectory{}
+
+// load rereads the tables when the cache is stale. The caller holds d.mu.
+// A failed reread keeps the previous maps.
+func (d *tenantDirectory) load() error {
+	if d.byID != nil && time.Since(d.loadedAt) < tenantRefresh {
+		recordCacheLookup("tenants", true)
+		return nil
+	}
+	recordCacheLookup("tenants", false)
+
+	rows, err := db.Query("SELECT id, name, subdomain, include_global, diet_plans, created_at FROM tenants")
+	if err != nil {
+		return err
+	}
+	byID, bySubdomain := map[string]*Tenant{}, map[string]*Tenant{}
+	for rows.Next() {
+		var tenant Tenant
+		var subdomain, plansJSON sql.NullString
+		if err := rows.Scan(&tenant.ID, &tenant.Name, &subdomain, &tenant.IncludeGlobal, &plansJSON, &tenant.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		if subdomain.Valid {
+			tenant.Subdomain = &subdomain.String
+			bySubdomain[subdomain.String] = &tenant
+		}
+		if plansJSON.Valid {
+			json.Unmarshal([]byte(plansJSON.String), &tenant.DietPlans)
+			for key, plan := range tenant.DietPlans {
+				normalizeDietPlan(key, &plan)
+				tenant.DietPlans[key] = plan
+			}
+		}
+		byID[tenant.ID] = &tenant
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT key_hash, tenant_id FROM tenant_api_keys WHERE revoked_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	byKey := map[string]*Tenant{}
+	for rows.Next() {
+		var keyHash, tenantID string
+		if err := rows.Scan(&keyHash, &tenantID); err != nil {
+			return err
+		}
+		if tenant := byID[tenantID]; tenant != nil {
+			byKey[keyHash] = tenant
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	d.byID, d.byKey, d.bySubdomain, d.loadedAt = byID, byKey, bySubdomain, time.Now()
+	return nil
+}
+
+// resolve finds the tenant for an API key or, failing that, a subdomain.
+// Neither matching is not an error: the caller gets the global catalog.
+func (d *tenantDirectory) resolve(apiKey, subdomain string) (*Tenant, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.load()
+	if apiKey != "" {
+		if tenant := d.byKey[hashToken(apiKey)]; tenant != nil {
+			return tenant, err
+		}
+	}
+	if subdomain != "" {
+		return d.bySubdomain[subdomain], err
+	}
+	return nil, err
+}
+
+// issued reports whether an API key was issued and not revoked. When the
+// key table can't be read, the last loaded directory decides.
+func (d *tenantDirectory) issued(apiKey string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.load()
+	return d.byKey[hashToken(apiKey)] != nil
+}
+
+func (d *tenantDirectory) get(id string) (*Tenant, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.load()
+	return d.byID[id], err
+}
+
+func (d *tenantDirectory) list() ([]*Tenant, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	list := make([]*Tenant, 0, len(d.byID))
+	for _, id := range sortedKeys(d.byID) {
+		list = append(list, d.byID[id])
+	}
+	return list, nil
+}
+
+func (d *tenantDirectory) invalidate() {
+	d.mu.Lock()
+	d.byID = nil
+	d.mu.Unlock()
+	invalidateSpellDictionaries()
+}
+
+// tenantSubdomain returns the label in front of TENANT_BASE_DOMAIN in a
+// Host header, or "" when the host is not a subdomain of it.
+func tenantSubdomain(host string) string {
+	base := strings.ToLower(cfg.TenantDomain)
+	if base == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+base)
+	if !ok || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
+
+// resolveTenant attaches the caller's tenant, if any, to the request.
+// Responses then depend on the API key and host, so both are in Vary.
+// When the tenant tables can't be read, the last loaded directory is
+// used.
+func resolveTenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "X-API-Key")
+		tenant, err := tenants.resolve(c.GetHeader("X-API-Key"), tenantSubdomain(c.Request.Host))
+		if err != nil {
+			requestLogger(c).Warn("tenant lookup failed", "error", err)
+		}
+		if tenant != nil {
+			c.Set("tenant", tenant)
+		}
+		c.Next()
+	}
+}
+
+func tenantFromContext(c *gin.Context) *Tenant {
+	if tenant, ok := c.Get("tenant"); ok {
+		return tenant.(*Tenant)
+	}
+	return nil
+}
+
+// PutTenantRequest creates or replaces a tenant.
+type PutTenantRequest struct {
+	Name          string              `json:"name" binding:"required"`
+	Subdomain     *string             `json:"subdomain"`
+	IncludeGlobal *bool               `json:"include_global"`
+	DietPlans     map[string]DietPlan `json:"diet_plans"`
+}
+
+func listTenants(c *gin.Context) {
+	list, err := tenants.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tenants": list, "count": len(list)})
+}
+
+// putTenant creates or replaces a tenant. include_global defaults to true,
+// so a new tenant starts with the shared catalog.
+func putTenant(c *gin.Context) {
+	id := c.Param("id")
+	if !tenantIDPattern.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tenant ID must be 1-20 lowercase letters, digits or dashes"})
+		return
+	}
+	var req PutTenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Subdomain != nil && !tenantIDPattern.MatchString(*req.Subdomain) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subdomain must be 1-20 lowercase letters, digits or dashes"})
+		return
+	}
+	var problems []string
+	for _, key := range sortedKeys(req.DietPlans) {
+		plan := req.DietPlans[key]
+		problems = append(problems, normalizeDietPlan(key, &plan)...)
+		req.DietPlans[key] = plan
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid diet plans", "problems": problems})
+		return
+	}
+	includeGlobal := req.IncludeGlobal == nil || *req.IncludeGlobal
+	var plansJSON interface{}
+	if len(req.DietPlans) > 0 {
+		data, _ := json.Marshal(req.DietPlans)
+		plansJSON = string(data)
+	}
+
+	_, err := db.Exec(`INSERT INTO tenants (id, name, subdomain, include_global, diet_plans) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE name = VALUES(name), subdomain = VALUES(subdomain), include_global = VALUES(include_global), diet_plans = VALUES(diet_plans)`,
+		id, req.Name, req.Subdomain, includeGlobal, plansJSON)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subdomain is already in use"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tenants.invalidate()
+	requestLogger(c).Info("tenant saved", "tenant_id", id, "by", adminFromContext(c).Subject)
+
+	tenant, err := tenants.get(id)
+	if err != nil || tenant == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "tenant saved but could not be reloaded"})
+		return
+	}
+	c.JSON(http.StatusOK, tenant)
+}
+
+// deleteTenant removes a tenant and its API keys. A tenant that still owns
+// recipes is refused; move or delete them first.
+func deleteTenant(c *gin.Context) {
+	id := c.Param("id")
+	var owned int
+	if err := db.QueryRow("SELECT COUNT(*) FROM recipes WHERE tenant_id = ? AND deleted_at IS NULL", id).Scan(&owned); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if owned > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Tenant still owns %d recipes", owned)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM tenants WHERE id = ?", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM tenant_api_keys WHERE tenant_id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	tenants.invalidate()
+	requestLogger(c).Info("tenant deleted", "tenant_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+type CreateTenantKeyRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// createTenantKey mints an API key for a tenant. Like MCP tokens, the
+// plaintext is only returned here.
+func createTenantKey(c *gin.Context) {
+	tenantID := c.Param("id")
+	var req CreateTenantKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	tenant, err := tenants.get(tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tenant == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	key := "emk_" + hex.EncodeToString(raw)
+	res, err := db.Exec("INSERT INTO tenant_api_keys (key_hash, tenant_id, name) VALUES (?, ?, ?)", hashToken(key), tenantID, req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, _ := res.LastInsertId()
+	tenants.invalidate()
+	requestLogger(c).Info("tenant API key created", "tenant_id", tenantID, "key_id", id, "by", adminFromContext(c).Subject)
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "tenant_id": tenantID, "name": req.Name, "key": key})
+}
+
+func listTenantKeys(c *gin.Context) {
+	rows, err := db.Query("SELECT id, name, created_at, revoked_at FROM tenant_api_keys WHERE tenant_id = ? ORDER BY id", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	keys := []gin.H{}
+	for rows.Next() {
+		var id int
+		var name string
+		var createdAt time.Time
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&id, &name, &createdAt, &revokedAt); err != nil {
+			continue
+		}
+		key := gin.H{"id": id, "name": name, "created_at": createdAt, "revoked_at": nil}
+		if revokedAt.Valid {
+			key["revoked_at"] = revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func revokeTenantKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("key_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+	res, err := db.Exec("UPDATE tenant_api_keys SET revoked_at = NOW() WHERE id = ? AND tenant_id = ? AND revoked_at IS NULL", id, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+	tenants.invalidate()
+	requestLogger(c).Info("tenant API key revoked", "tenant_id", c.Param("id"), "key_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "revoked": true})
+}
+
+type SetRecipeTenantRequest struct {
+	TenantID *string `json:"tenant_id"`
+}
+
+// setRecipeTenant moves a recipe to a tenant's catalog, or to the global
+// catalog with a null tenant_id.
+func setRecipeTenant(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req SetRecipeTenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.TenantID != nil {
+		tenant, err := tenants.get(*req.TenantID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if tenant == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tenant"})
+			return
+		}
+	}
+
+	res, err := db.Exec("UPDATE recipes SET tenant_id = ? WHERE id = ? AND deleted_at IS NULL", req.TenantID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ? AND deleted_at IS NULL)", id).Scan(&exists); !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+	}
+	invalidateSpellDictionaries()
+	requestLogger(c).Info("recipe tenant set", "recipe_id", id, "tenant_id", req.TenantID, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "tenant_id": req.TenantID})
+}
+
+// recordLLMUsage charges the caller for every upstream attempt behind
+// result, failed or not. Call it whether or not the call succeeded.
+func recordLLMUsage(c *gin.Context, endpoint string, result llmResult) {
+	key, _ := verifiedCallerID(c)
+	if err := insertLLMUsage(key, endpoint, result); err != nil {
+		requestLogger(c).Error("llm usage insert failed", "error", err)
+	}
+}
+
+// insertLLMUsage writes a row per attempt, under api_key: a caller, or a
+// job: name for background work.
+func insertLLMUsage(apiKey, endpoint string, result llmResult) error {
+	for _, attempt := range result.Attempts {
+		cost := llmCost(llmResult{Model: attempt.Model, PromptTokens: attempt.PromptTokens, CompletionTokens: attempt.CompletionTokens})
+		if _, err := db.Exec("INSERT INTO llm_usage (api_key, endpoint, model, prompt_tokens, completion_tokens, cost_usd) VALUES (?, ?, ?, ?, ?, ?)",
+			apiKey, endpoint, attempt.Model, attempt.PromptTokens, attempt.CompletionTokens, cost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// llmBudgetExceeded reports whether the caller has spent their daily LLM
+// budget (LLM_DAILY_BUDGET_USD). No budget means no cap. Callers with a
+// key nobody issued share their IP's budget.
+func llmBudgetExceeded(c *gin.Context) bool {
+	budget := cfg.LLM.DailyBudgetUSD
+	if budget <= 0 {
+		return false
+	}
+	key, _ := verifiedCallerID(c)
+	var spent float64
+	err := db.QueryRow("SELECT COALESCE(SUM(cost_usd), 0) FROM llm_usage WHERE api_key = ? AND created_at >= CURDATE()", key).Scan(&spent)
+	if err != nil {
+		requestLogger(c).Error("llm budget lookup failed", "error", err)
+		return false
+	}
+	return spent >= budget
+}
+
+func getLLMUsage(c *gin.Context) {
+	groupColumns := map[string]string{
+		"api_key":  "api_key",
+		"model":    "model",
+		"endpoint": "endpoint",
+		"day":      "DATE(created_at)",
+	}
+
+	groupBy := c.DefaultQuery("group_by", "api_key")
+	column, ok := groupColumns[groupBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group_by"})
+		return
+	}
+
+	query := "SELECT " + column + ", COUNT(*), SUM(prompt_tokens), SUM(completion_tokens), SUM(cost_usd) FROM llm_usage WHERE 1=1"
+	args := []interface{}{}
+
+	if from := c.Query("from"); from != "" {
+		query += " AND created_at >= ?"
+		args = append(args, from)
+	}
+	if to := c.Query("to"); to != "" {
+		query += " AND created_at < DATE_ADD(?, INTERVAL 1 DAY)"
+		args = append(args, to)
+	}
+	if key := c.Query("api_key"); key != "" {
+		query += " AND api_key = ?"
+		args = append(args, key)
+	}
+
+	query += " GROUP BY " + column + " ORDER BY SUM(cost_usd) DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	usage := []gin.H{}
+	var totalCost float64
+	for rows.Next() {
+		var group string
+		var requests, promptTokens, completionTokens int
+		var cost float64
+		if err := rows.Scan(&group, &requests, &promptTokens, &completionTokens, &cost); err != nil {
+			continue
+		}
+		totalCost += cost
+		usage = append(usage, gin.H{
+			groupBy:             group,
+			"requests":          requests,
+			"prompt_tokens":     promptTokens,
+			"completion_tokens": completionTokens,
+			"cost_usd":          cost,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"usage":          usage,
+		"total_cost_usd": totalCost,
+	})
+}
+
+// usageExemptRoutes are neither counted nor limited, so callers can always
+// check their usage and platforms can always probe health.
+var usageExemptRoutes = map[string]bool{
+	"/api/usage":  true,
+	"/api/health": true,
+	"/api/warmup": true,
+}
+
+// UsageQuota is a caller's monthly request allowance. Limit 0 means
+// unlimited.
+type UsageQuota struct {
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// loadUsageQuota reads the caller's quota for the current month: an
+// override from api_quotas if there is one, otherwise the default for
+// keyed or anonymous callers.
+func loadUsageQuota(key string, keyed bool) (UsageQuota, error) {
+	now := time.Now().UTC()
+	quota := UsageQuota{ResetsAt: time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)}
+	var override sql.NullInt64
+	var hasOverride bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM api_quotas WHERE api_key = ?), (SELECT monthly_requests FROM api_quotas WHERE api_key = ?),
+		COALESCE((SELECT SUM(requests) FROM api_usage WHERE api_key = ? AND month = ?), 0)`, key, key, key, usageMonth(now)).
+		Scan(&hasOverride, &override, &quota.Used)
+	if err != nil {
+		return quota, err
+	}
+	switch {
+	case hasOverride:
+		quota.Limit = int(override.Int64)
+	case keyed:
+		quota.Limit = cfg.Usage.MonthlyQuota
+	default:
+		quota.Limit = cfg.Usage.AnonymousMonthlyQuota
+	}
+	if quota.Limit > 0 {
+		quota.Remaining = max(quota.Limit-quota.Used, 0)
+	}
+	return quota, nil
+}
+
+// meterUsage counts requests per caller and route, and refuses them once
+// the monthly quota is spent: 402 for API keys, whose plan has run out,
+// and 429 for anonymous callers, until the quota resets.
+func meterUsage() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" || usageExemptRoutes[route] || strings.HasPrefix(route, "/api/admin") {
+			c.Next()
+			return
+		}
+
+		// Unknown keys are metered by IP, so inventing one doesn't reset
+		// the allowance.
+		key, keyed := verifiedCallerID(c)
+		quota, err := loadUsageQuota(key, keyed)
+		if err != nil {
+			// Metering must not take the API down with it.
+			requestLogger(c).Error("usage quota lookup failed", "error", err)
+		} else if quota.Limit > 0 {
+			c.Header("X-Quota-Limit", strconv.Itoa(quota.Limit))
+			c.Header("X-Quota-Remaining", strconv.Itoa(max(quota.Remaining-1, 0)))
+			c.Header("X-Quota-Reset", quota.ResetsAt.Format(time.RFC3339))
+			if quota.Remaining == 0 {
+				status := http.StatusPaymentRequired
+				if !keyed {
+					status = http.StatusTooManyRequests
+					c.Header("Retry-After", strconv.Itoa(int(time.Until(quota.ResetsAt).Seconds())+1))
+				}
+				c.AbortWithStatusJSON(status, gin.H{"error": "Monthly request quota exceeded", "quota": quota})
+				return
+			}
+		}
+
+		c.Next()
+
+		if _, err := db.Exec(`INSERT INTO api_usage (api_key, month, endpoint, requests) VALUES (?, ?, ?, 1)
+			ON DUPLICATE KEY UPDATE requests = requests + 1`, key, usageMonth(time.Now()), c.Request.Method+" "+route); err != nil {
+			requestLogger(c).Error("usage insert failed", "error", err)
+		}
+	}
+}
+
+// getUsage shows the caller their own consumption for a month (default the
+// current one): requests by endpoint, LLM spend, and the quota.
+func getUsage(c *gin.Context) {
+	key, keyed := verifiedCallerID(c)
+	month := c.DefaultQuery("month", usageMonth(time.Now()))
+	start, err := time.Parse("2006-01", month)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "month must be YYYY-MM"})
+		return
+	}
+
+	rows, err := db.Query("SELECT endpoint, requests FROM api_usage WHERE api_key = ? AND month = ? ORDER BY requests DESC, endpoint", key, month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	endpoints := []gin.H{}
+	total := 0
+	for rows.Next() {
+		var endpoint string
+		var requests int
+		if err := rows.Scan(&endpoint, &requests); err != nil {
+			continue
+		}
+		total += requests
+		endpoints = append(endpoints, gin.H{"endpoint": endpoint, "requests": requests})
+	}
+
+	var llmRequests int
+	var llmCost float64
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(cost_usd), 0) FROM llm_usage WHERE api_key = ? AND created_at >= ? AND created_at < ?",
+		key, start, start.AddDate(0, 1, 0)).Scan(&llmRequests, &llmCost); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{
+		"api_key":   key,
+		"month":     month,
+		"requests":  total,
+		"endpoints": endpoints,
+		"llm":       gin.H{"requests": llmRequests, "cost_usd": math.Round(llmCost*10000) / 10000},
+	}
+	if month == usageMonth(time.Now()) {
+		quota, err := loadUsageQuota(key, keyed)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		response["quota"] = quota
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// PutQuotaRequest sets a caller's monthly quota. APIKey is the caller ID
+// as reported by /api/usage and the usage tables; null MonthlyRequests
+// means unlimited.
+type PutQuotaRequest struct {
+	APIKey          string `json:"api_key" binding:"required"`
+	MonthlyRequests *int   `json:"monthly_requests"`
+}
+
+func listQuotas(c *gin.Context) {
+	rows, err := db.Query(`SELECT q.api_key, q.monthly_requests, q.updated_at, COALESCE(SUM(u.requests), 0)
+		FROM api_quotas q LEFT JOIN api_usage u ON u.api_key = q.api_key AND u.month = ?
+		GROUP BY q.api_key, q.monthly_requests, q.updated_at ORDER BY q.api_key`, usageMonth(time.Now()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	quotas := []gin.H{}
+	for rows.Next() {
+		var key string
+		var limit sql.NullInt64
+		var updatedAt time.Time
+		var used int
+		if err := rows.Scan(&key, &limit, &updatedAt, &used); err != nil {
+			continue
+		}
+		quota := gin.H{"api_key": key, "monthly_requests": nil, "used": used, "updated_at": updatedAt}
+		if limit.Valid {
+			quota["monthly_requests"] = limit.Int64
+		}
+		quotas = append(quotas, quota)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"quotas":                  quotas,
+		"default_monthly_quota":   cfg.Usage.MonthlyQuota,
+		"anonymous_monthly_quota": cfg.Usage.AnonymousMonthlyQuota,
+	})
+}
+
+func putQuota(c *gin.Context) {
+	var req PutQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.MonthlyRequests != nil && *req.MonthlyRequests < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO api_quotas (api_key, monthly_requests) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE monthly_requests = VALUES(monthly_requests), updated_at = CURRENT_TIMESTAMP`, req.APIKey, req.MonthlyRequests); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("quota set", "api_key", req.APIKey, "monthly_requests", req.MonthlyRequests, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, req)
+}
+
+// deleteQuota drops an override, returning the caller to the default.
+func deleteQuota(c *gin.Context) {
+	key := c.Query("api_key")
+	res, err := db.Exec("DELETE FROM api_quotas WHERE api_key = ?", key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quota not found"})
+		return
+	}
+	requestLogger(c).Info("quota removed", "api_key", key, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"api_key": key, "deleted": true})
+}
+
+// FeatureFlag is the rollout of a feature: on for Percent of callers, and
+// always on for the listed tenants. Callers are bucketed by apiKeyID, so
+// one caller gets the same answer on every request.
+type FeatureFlag struct {
+	Percent int      `json:"percent"`
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// featureFlags lists the flags handlers consult, with the rollout each has
+// until config or an admin sets one. A feature switched off falls back to
+// the behaviour it replaced rather than failing the request.
+var featureFlags = map[string]struct {
+	Description string
+	Default     FeatureFlag
+}{
+	"llm_chat":             {"/chat asks the LLM for search parameters; off uses keyword search", FeatureFlag{Percent: 100}},
+	"llm_meal_plans":       {"/meal-plans/generate asks the LLM to read the request; off uses keywords", FeatureFlag{Percent: 100}},
+	"spelling_suggestions": {"recipe search suggests and autocorrects misspelled words", FeatureFlag{Percent: 100}},
+	"ranking_experiments":  {"searches without sort_by may be ranked by the running experiment", FeatureFlag{Percent: 100}},
+	"llm_parse_text":       {"/recipes/parse-text asks the LLM about fields the heuristics are unsure of; off uses heuristics only", FeatureFlag{Percent: 100}},
+	"llm_vision":           {"/recipes/search-by-image and /recipes/import-image send photos to the vision model", FeatureFlag{Percent: 100}},
+}
+
+// enabledFor buckets a caller by a hash of the flag name and caller ID, so
+// each flag rolls out to a different slice of callers.
+func (f FeatureFlag) enabledFor(name string, tenant *Tenant, caller string) bool {
+	if tenant != nil && slices.Contains(f.Tenants, tenant.ID) {
+		return true
+	}
+	if f.Percent <= 0 || f.Percent >= 100 {
+		return f.Percent >= 100
+	}
+	sum := sha256.Sum256([]byte(name + ":" + caller))
+	return (int(sum[0])<<8|int(sum[1]))%100 < f.Percent
+}
+
+// featureFlagStore caches the rollouts set through the admin API. Like the
+// tenant directory it rereads the table every featureFlagRefresh.
+type featureFlagStore struct {
+	mu       sync.Mutex
+	flags    map[string]FeatureFlag
+	loadedAt time.Time
+}
+
+const featureFlagRefresh = time.Minute
+
+var features = &featureFlagStore{}
+
+// load rereads the table when the cache is stale. The caller holds s.mu.
+// A failed reread keeps the previous flags.
+func (s *featureFlagStore) load() error {
+	if s.flags != nil && time.Since(s.loadedAt) < featureFlagRefresh {
+		recordCacheLookup("feature_flags", true)
+		return nil
+	}
+	recordCacheLookup("feature_flags", false)
+
+	rows, err := db.Query("SELECT name, percent, tenants FROM feature_flags")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	flags := map[string]FeatureFlag{}
+	for rows.Next() {
+		var name string
+		var flag FeatureFlag
+		var tenantsJSON sql.NullString
+		if err := rows.Scan(&name, &flag.Percent, &tenantsJSON); err != nil {
+			return err
+		}
+		if tenantsJSON.Valid {
+			json.Unmarshal([]byte(tenantsJSON.String), &flag.Tenants)
+		}
+		flags[name] = flag
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.flags, s.loadedAt = flags, time.Now()
+	return nil
+}
+
+// lookup returns a flag's rollout and where it came from: "admin", "config"
+// or "default".
+func (s *featureFlagStore) lookup(name string) (FeatureFlag, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load()
+	if flag, ok := s.flags[name]; ok {
+		return flag, "admin", err
+	}
+	if flag, ok := cfg.Features.Flags[name]; ok {
+		return flag, "config", err
+	}
+	return featureFlags[name].Default, "default", err
+}
+
+func (s *featureFlagStore) invalidate() {
+	s.mu.Lock()
+	s.flags = nil
+	s.mu.Unlock()
+}
+
+// featureEnabled reports whether a flag is on for the caller. When the
+// table can't be read, the last loaded rollouts are used.
+func featureEnabled(c *gin.Context, name string) bool {
+	flag, _, err := features.lookup(name)
+	if err != nil {
+		requestLogger(c).Warn("feature flag lookup failed", "flag", name, "error", err)
+	}
+	return flag.enabledFor(name, tenantFromContext(c), apiKeyID(c))
+}
+
+// getFeatures lists which flags are on for the caller, so clients can hide
+// what they won't be served.
+func getFeatures(c *gin.Context) {
+	enabled := map[string]bool{}
+	for name := range featureFlags {
+		enabled[name] = featureEnabled(c, name)
+	}
+	c.JSON(http.StatusOK, gin.H{"features": enabled})
+}
+
+func listFeatureFlags(c *gin.Context) {
+	list := []gin.H{}
+	for _, name := range sortedKeys(featureFlags) {
+		flag, source, err := features.lookup(name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		list = append(list, gin.H{
+			"name":        name,
+			"description": featureFlags[name].Description,
+			"percent":     flag.Percent,
+			"tenants":     flag.Tenants,
+			"source":      source,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"feature_flags": list})
+}
+
+// putFeatureFlag sets a flag's rollout, overriding config and the default.
+func putFeatureFlag(c *gin.Context) {
+	name := c.Param("name")
+	if _, ok := featureFlags[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feature flag not found"})
+		return
+	}
+	var flag FeatureFlag
+	if err := c.ShouldBindJSON(&flag); err != nil || flag.Percent < 0 || flag.Percent > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	var tenantsJSON interface{}
+	if len(flag.Tenants) > 0 {
+		data, _ := json.Marshal(flag.Tenants)
+		tenantsJSON = string(data)
+	}
+	if _, err := db.Exec(`INSERT INTO feature_flags (name, percent, tenants) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE percent = VALUES(percent), tenants = VALUES(tenants), updated_at = CURRENT_TIMESTAMP`, name, flag.Percent, tenantsJSON); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	features.invalidate()
+	requestLogger(c).Info("feature flag set", "flag", name, "percent", flag.Percent, "tenants", flag.Tenants, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"name": name, "percent": flag.Percent, "tenants": flag.Tenants, "source": "admin"})
+}
+
+// deleteFeatureFlag drops an admin rollout, returning the flag to its
+// configured or default one.
+func deleteFeatureFlag(c *gin.Context) {
+	name := c.Param("name")
+	res, err := db.Exec("DELETE FROM feature_flags WHERE name = ?", name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feature flag not found"})
+		return
+	}
+	features.invalidate()
+	requestLogger(c).Info("feature flag reset", "flag", name, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"name": name, "deleted": true})
+}
+
+// rankingVariants are the orderings a ranking experiment can compare, as
+// ORDER BY clauses for a search. "default" is the usual ID order.
+var rankingVariants = map[string]func(search string) (string, []interface{}){
+	"default":   func(string) (string, []interface{}) { return "id", nil },
+	"rating":    func(string) (string, []interface{}) { return "rating DESC, id", nil },
+	"relevance": relevanceOrderSQL,
+}
+
+// relevanceOrderSQL ranks recipes by how many searched terms their name
+// contains, then by rating.
+func relevanceOrderSQL(search string) (string, []interface{}) {
+	clauses := []string{}
+	args := []interface{}{}
+	for _, term := range parseSearchText(search).Include {
+		clauses = append(clauses, "(name LIKE ?)")
+		args = append(args, "%"+term+"%")
+	}
+	if len(clauses) == 0 {
+		return "rating DESC, id", nil
+	}
+	return "(" + strings.Join(clauses, " + ") + ") DESC, rating DESC, id", args
+}
+
+// RankingExperiment splits searches without an explicit sort between
+// ranking variants by weight. At most one runs at a time.
+type RankingExperiment struct {
+	Name      string         `json:"name"`
+	Variants  map[string]int `json:"variants"`
+	StartedAt time.Time      `json:"started_at"`
+	EndedAt   *time.Time     `json:"ended_at"`
+}
+
+// variantFor assigns a caller to a variant. Callers are bucketed by a hash
+// of the experiment name and caller ID, so they keep their variant for the
+// whole experiment.
+func (e *RankingExperiment) variantFor(caller string) string {
+	names := sortedKeys(e.Variants)
+	total := 0
+	for _, name := range names {
+		total += e.Variants[name]
+	}
+	if total <= 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(e.Name + ":" + caller))
+	bucket := (int(sum[0])<<16 | int(sum[1])<<8 | int(sum[2])) % total
+	for _, name := range names {
+		if bucket -= e.Variants[name]; bucket < 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// experimentCache holds the running experiment, rereading it every
+// featureFlagRefresh.
+type experimentCache struct {
+	mu         sync.Mutex
+	experiment *RankingExperiment
+	loadedAt   time.Time
+}
+
+var rankingExperiment = &experimentCache{}
+
+func (e *experimentCache) current() (*RankingExperiment, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.loadedAt.IsZero() && time.Since(e.loadedAt) < featureFlagRefresh {
+		recordCacheLookup("ranking_experiment", true)
+		return e.experiment, nil
+	}
+	recordCacheLookup("ranking_experiment", false)
+
+	var experiment RankingExperiment
+	var variantsJSON string
+	err := db.QueryRow("SELECT name, variants, started_at FROM ranking_experiments WHERE ended_at IS NULL ORDER BY started_at DESC LIMIT 1").
+		Scan(&experiment.Name, &variantsJSON, &experiment.StartedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		e.experiment = nil
+	case err != nil:
+		return e.experiment, err
+	default:
+		json.Unmarshal([]byte(variantsJSON), &experiment.Variants)
+		e.experiment = &experiment
+	}
+	e.loadedAt = time.Now()
+	return e.experiment, nil
+}
+
+func (e *experimentCache) invalidate() {
+	e.mu.Lock()
+	e.loadedAt = time.Time{}
+	e.mu.Unlock()
+}
+
+// rankingAssignment picks the caller's variant of the running experiment,
+// or returns nil when none runs or the caller is outside the
+// ranking_experiments rollout.
+func rankingAssignment(c *gin.Context) (*RankingExperiment, string) {
+	if !featureEnabled(c, "ranking_experiments") {
+		return nil, ""
+	}
+	experiment, err := rankingExperiment.current()
+	if err != nil {
+		requestLogger(c).Warn("ranking experiment lookup failed", "error", err)
+	}
+	if experiment == nil {
+		return nil, ""
+	}
+	variant := experiment.variantFor(apiKeyID(c))
+	if rankingVariants[variant] == nil {
+		return nil, ""
+	}
+	return experiment, variant
+}
+
+// recordImpression logs a search served under an experiment and returns
+// the search ID that clicks on its results are reported against.
+func recordImpression(c *gin.Context, experiment *RankingExperiment, variant string) string {
+	searchID := newRequestID()
+	if _, err := db.Exec("INSERT INTO ranking_events (search_id, experiment, variant, event, api_key) VALUES (?, ?, ?, 'impression', ?)",
+		searchID, experiment.Name, variant, apiKeyID(c)); err != nil {
+		requestLogger(c).Warn("impression not recorded", "experiment", experiment.Name, "error", err)
+	}
+	return searchID
+}
+
+// SearchClickRequest reports that a result of a search was opened.
+// Position is the result's zero-based index in the response.
+type SearchClickRequest struct {
+	SearchID string `json:"search_id" binding:"required"`
+	RecipeID int    `json:"recipe_id" binding:"required"`
+	Position *int   `json:"position"`
+}
+
+// recordSearchClick logs a click against the variant that served the
+// search. Only searches tagged with an experiment can be reported.
+func recordSearchClick(c *gin.Context) {
+	var req SearchClickRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	var experiment, variant string
+	err := db.QueryRow("SELECT experiment, variant FROM ranking_events WHERE search_id = ? AND event = 'impression'", req.SearchID).
+		Scan(&experiment, &variant)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Search not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := db.Exec("INSERT INTO ranking_events (search_id, experiment, variant, event, recipe_id, position, api_key) VALUES (?, ?, ?, 'click', ?, ?, ?)",
+		req.SearchID, experiment, variant, req.RecipeID, req.Position, apiKeyID(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// PutExperimentRequest starts a ranking experiment with variant weights,
+// e.g. {"variants": {"default": 50, "rating": 50}}.
+type PutExperimentRequest struct {
+	Variants map[string]int `json:"variants" binding:"required"`
+}
+
+// listExperiments reports each experiment with, per variant, the searches
+// served, the clicks they got, click-through rate and mean click position.
+func listExperiments(c *gin.Context) {
+	rows, err := db.Query("SELECT name, variants, started_at, ended_at FROM ranking_experiments ORDER BY started_at DESC")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	experiments := []RankingExperiment{}
+	for rows.Next() {
+		var experiment RankingExperiment
+		var variantsJSON string
+		var endedAt sql.NullTime
+		if err := rows.Scan(&experiment.Name, &variantsJSON, &experiment.StartedAt, &endedAt); err != nil {
+			continue
+		}
+		json.Unmarshal([]byte(variantsJSON), &experiment.Variants)
+		if endedAt.Valid {
+			experiment.EndedAt = &endedAt.Time
+		}
+		experiments = append(experiments, experiment)
+	}
+	rows.Close()
+
+	results := map[string]map[string]gin.H{}
+	rows, err = db.Query(`SELECT experiment, variant, SUM(event = 'impression'), SUM(event = 'click'), AVG(position)
+		FROM ranking_events GROUP BY experiment, variant`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var experiment, variant string
+		var impressions, clicks int
+		var meanPosition sql.NullFloat64
+		if err := rows.Scan(&experiment, &variant, &impressions, &clicks, &meanPosition); err != nil {
+			continue
+		}
+		result := gin.H{"searches": impressions, "clicks": clicks, "click_through_rate": 0.0, "mean_click_position": nil}
+		if impressions > 0 {
+			result["click_through_rate"] = math.Round(float64(clicks)/float64(impressions)*1000) / 1000
+		}
+		if meanPosition.Valid {
+			result["mean_click_position"] = math.Round(meanPosition.Float64*100) / 100
+		}
+		if results[experiment] == nil {
+			results[experiment] = map[string]gin.H{}
+		}
+		results[experiment][variant] = result
+	}
+
+	out := []gin.H{}
+	for _, experiment := range experiments {
+		out = append(out, gin.H{"experiment": experiment, "results": results[experiment.Name]})
+	}
+	c.JSON(http.StatusOK, gin.H{"experiments": out, "available_variants": sortedKeys(rankingVariants)})
+}
+
+// putExperiment starts an experiment, ending any other that is running.
+// Restarting an ended experiment keeps its earlier events.
+func putExperiment(c *gin.Context) {
+	name := c.Param("name")
+	var req PutExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(name) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	total := 0
+	for variant, weight := range req.Variants {
+		if rankingVariants[variant] == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown variant " + variant, "available_variants": sortedKeys(rankingVariants)})
+			return
+		}
+		if weight < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Variant weights must not be negative"})
+			return
+		}
+		total += weight
+	}
+	if total == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one variant needs a positive weight"})
+		return
+	}
+
+	variantsJSON, _ := json.Marshal(req.Variants)
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE ranking_experiments SET ended_at = CURRENT_TIMESTAMP WHERE ended_at IS NULL AND name <> ?", name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := tx.Exec(`INSERT INTO ranking_experiments (name, variants) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE variants = VALUES(variants), started_at = CURRENT_TIMESTAMP, ended_at = NULL`, name, string(variantsJSON)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rankingExperiment.invalidate()
+	requestLogger(c).Info("ranking experiment started", "experiment", name, "variants", req.Variants, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"name": name, "variants": req.Variants})
+}
+
+func stopExperiment(c *gin.Context) {
+	name := c.Param("name")
+	res, err := db.Exec("UPDATE ranking_experiments SET ended_at = CURRENT_TIMESTAMP WHERE name = ? AND ended_at IS NULL", name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Running experiment not found"})
+		return
+	}
+	rankingExperiment.invalidate()
+	requestLogger(c).Info("ranking experiment stopped", "experiment", name, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"name": name, "stopped": true})
+}
+
+func GenerateRecipeURL(ctx context.Context, message string) (string, llmResult, error) {
+	systemPrompt := `You are a recipe search API parameter generator. Convert natural language requests into URL query parameters for a recipe search API.
+
+Available parameters:
+- search: text search in recipe name/description
+- diet: ` + strings.Join(sortedKeys(dietPlans), ", ") + `
+- include_ingredients: comma-separated ingredients to include
+- exclude_ingredients: comma-separated ingredients to exclude
+- min_calories, max_calories: calorie range
+- min_protein, max_protein: protein range in grams
+- min_carbs, max_carbs: carbs range in grams
+- min_fat, max_fat: fat range in grams
+- min_fiber, max_fiber: fiber range in grams
+- min_sodium, max_sodium: sodium range in mg
+- min_prep_time, max_prep_time: preparation time in minutes
+- min_cook_time, max_cook_time: cooking time in minutes
+- min_total_time, max_total_time: total time in minutes
+- min_servings, max_servings: serving size range
+- min_rating, max_rating: rating range (0-5)
+- difficulty: comma-separated levels from easy, medium, hard
+- min_cost, max_cost: estimated cost per serving
+- min_spice, max_spice: spice level from 0 (none) to 3 (hot)
+- min_co2e, max_co2e: estimated kg CO2e per serving
+- min_gi, max_gi: estimated glycemic index (glucose = 100)
+- min_gl, max_gl: estimated glycemic load per serving (10 or less is low)
+- kid_friendly: true or false
+- has_image: true for recipes with a working image
+- macro_split: protein/carbs/fat calorie percentages adding up to 100, e.g. 30/40/30, with optional tolerance in percentage points (default 5)
+- equipment, exclude_equipment: comma-separated from air_fryer, blender, food_processor, grill, instant_pot, microwave, oven, slow_cooker, stand_mixer, stovetop, no_cook
+- cuisine: comma-separated from american, chinese, french, greek, indian, italian, japanese, korean, mexican, middle_eastern, spanish, thai, vietnamese
+- sort_by: rating, calories, protein, carbs, prep_time_minutes, difficulty, cost_per_serving, co2e_per_serving, glycemic_load, times_made, views, etc.
+- sort_order: asc or desc
+
+Examples:
+"high calorie meal with potato" -> "?min_calories=800&include_ingredients=potato&sort_by=calories&sort_order=desc"
+"vegan low carb under 30 minutes" -> "?diet=vegan&max_carbs=20&max_prep_time=30"
+"keto recipes with chicken" -> "?diet=keto&include_ingredients=chicken"
+"healthy low sodium meals" -> "?max_sodium=1000&diet=heart_healthy"
+
+Respond ONLY with the URL query string starting with "?". No explanations.`
+
+	messages := []map[string]interface{}{
+		{"role": "system", "content": systemPrompt},
+		{"role": "user", "content": fmt.Sprintf("Convert this request to URL parameters: %s", message)},
+	}
+
+	result, err := callLLM(ctx, messages)
+	if err != nil {
+		return "", result, err
+	}
+
+	generatedURL := strings.TrimSpace(result.Content)
+	if !strings.HasPrefix(generatedURL, "?") {
+		generatedURL = "?" + generatedURL
+	}
+
+	return generatedURL, result, nil
+}
+
+func ExecuteSearch(tenant *Tenant, urlParams string) (interface{}, error) {
+	u, err := url.Parse(cfg.PublicBaseURL + "/api" + urlParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %v", err)
+	}
+
+	scope, args := tenant.recipeScope()
+	query := "SELECT " + recipeColumns + " FROM recipes WHERE " + scope
+
+	params := u.Query()
+
+	if diet := params.Get("diet"); diet != "" {
+		if plan, exists := tenant.dietPlans()[diet]; exists {
+			query, args = applyDietFilters(query, args, plan.Filters)
+		}
+	}
+
+	filterMap := map[string]string{
+		"min_calories": "AND calories >= ?",
+		"max_calories": "AND calories <= ?",
+		"min_protein":  "AND protein >= ?",
+		"max_protein":  "AND protein <= ?",
+		"min_carbs":    "AND carbs >= ?",
+		"max_carbs":    "AND carbs <= ?",
+		"min_fat":      "AND fat >= ?",
+		"max_fat":      "AND fat <= ?",
+		"min_fiber":    "AND fiber >= ?",
+		"max_fiber":    "AND fiber <= ?",
+		"min_sodium":   "AND sodium >= ?",
+		"max_sodium":   "AND sodium <= ?",
+		"max_prep_time": "AND prep_time_minutes <= ?",
+		"min_prep_time": "AND prep_time_minutes >= ?",
+		"min_cost":      "AND cost_per_serving >= ?",
+		"max_cost":      "AND cost_per_serving <= ?",
+		"min_spice":     "AND spice_level >= ?",
+		"max_spice":     "AND spice_level <= ?",
+		"min_co2e":      "AND co2e_per_serving >= ?",
+		"max_co2e":      "AND co2e_per_serving <= ?",
+		"min_gi":        "AND glycemic_index >= ?",
+		"max_gi":        "AND glycemic_index <= ?",
+		"min_gl":        "AND glycemic_load >= ?",
+		"max_gl":        "AND glycemic_load <= ?",
+	}
+
+	for param, condition := range filterMap {
+		if value := params.Get(param); value != "" {
+			if val, err := strconv.ParseFloat(value, 64); err == nil {
+				query += " " + condition
+				args = append(args, val)
+			}
+		}
+	}
+
+	if includeIngredients := params.Get("include_ingredients"); includeIngredients != "" {
+		ingredients := strings.Split(includeIngredients, ",")
+		for _, ingredient := range ingredients {
+			condition, ingredientArgs := ingredientFilterSQL(ingredient, false)
+			query += condition
+			args = append(args, ingredientArgs...)
+		}
+	}
+
+	if excludeIngredients := params.Get("exclude_ingredients"); excludeIngredients != "" {
+		ingredients := strings.Split(excludeIngredients, ",")
+		for _, ingredient := range ingredients {
+			condition, ingredientArgs := ingredientFilterSQL(ingredient, true)
+			query += condition
+			args = append(args, ingredientArgs...)
+		}
+	}
+
+	if search := params.Get("search"); search != "" {
+		condition, searchArgs := textSearchSQL(search)
+		query += condition
+		args = append(args, searchArgs...)
+	}
+
+	if difficulty := params.Get("difficulty"); difficulty != "" {
+		if condition, difficultyArgs, err := difficultyFilterSQL(difficulty); err == nil {
+			query += condition
+			args = append(args, difficultyArgs...)
+		}
+	}
+
+	for key, exclude := range map[string]bool{"equipment": false, "exclude_equipment": true} {
+		if condition, equipmentArgs, err := equipmentFilterSQL(params.Get(key), exclude); err == nil {
+			query += condition
+			args = append(args, equipmentArgs...)
+		}
+	}
+
+	if condition, cuisineArgs, err := cuisineFilterSQL(params.Get("cuisine")); err == nil {
+		query += condition
+		args = append(args, cuisineArgs...)
+	}
+
+	if val, err := strconv.ParseBool(params.Get("kid_friendly")); err == nil {
+		query += " AND kid_friendly = ?"
+		args = append(args, val)
+	}
+	if val, err := strconv.ParseBool(params.Get("has_image")); err == nil {
+		query += hasImageSQL(val)
+	}
+
+	tolerance, _ := strconv.ParseFloat(params.Get("tolerance"), 64)
+	if macro, err := parseMacroTarget(params.Get("macro_split"), tolerance); err == nil && macro != nil {
+		condition, macroArgs := macro.filterSQL()
+		query += condition
+		args = append(args, macroArgs...)
+	}
+
+	sortBy := params.Get("sort_by")
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	sortOrder := params.Get("sort_order")
+	if sortOrder == "" {
+		sortOrder = "asc"
+	}
+
+	validSortColumns := map[string]bool{
+		"id": true, "name": true, "prep_time_minutes": true, "cook_time_minutes": true,
+		"total_time_minutes": true, "servings": true, "rating": true, "calories": true,
+		"protein": true, "fat": true, "carbs": true, "fiber": true, "sodium": true,
+		"difficulty": true, "cost_per_serving": true, "co2e_per_serving": true,
+		"times_made": true, "views": true, "glycemic_load": true,
+	}
+
+	if validSortColumns[sortBy] {
+		if sortOrder == "desc" {
+			query += " ORDER BY " + sortColumnSQL(sortBy) + " DESC"
+		} else {
+			query += " ORDER BY " + sortColumnSQL(sortBy) + " ASC"
+		}
+	}
+
+	query += " LIMIT ?"
+	args = append(args, cfg.Search.ChatResultLimit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	recipes, skipped, err := scanRecipes(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{
+		"recipes": recipes,
+		"count":   len(recipes),
+	}
+	if skipped > 0 {
+		result["skipped"] = skipped
+	}
+	return result, nil
+}
+func handleChat(c *gin.Context) {
+	var req ChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	degraded := !featureEnabled(c, "llm_chat") || llmBudgetExceeded(c)
+	var generatedURL string
+	var usage *ChatUsage
+	if !degraded {
+		var result llmResult
+		var err error
+		generatedURL, result, err = GenerateRecipeURL(c.Request.Context(), req.Message)
+		recordLLMUsage(c, "chat", result)
+		if err != nil {
+			degraded = true
+		} else {
+			usage = &ChatUsage{
+				Model:            result.Model,
+				PromptTokens:     result.PromptTokens,
+				CompletionTokens: result.CompletionTokens,
+				CostUSD:          llmCost(result),
+			}
+		}
+	}
+	if degraded {
+		generatedURL = keywordSearchURL(req.Message)
+	}
+
+	response := ChatResponse{
+		GeneratedURL: generatedURL,
+		ParsedQuery:  req.Message,
+		Degraded:     degraded,
+		Usage:        usage,
+	}
+
+	if c.Query("execute") == "true" {
+		recipes, err := ExecuteSearch(tenantFromContext(c), generatedURL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to execute search: " + err.Error()})
+			return
+		}
+		response.Recipes = recipes
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+type GenerateRecipeRequest struct {
+	Diet        string   `json:"diet"`
+	Ingredients []string `json:"ingredients"`
+	MaxTime     int      `json:"max_time"`
+	Cuisine     string   `json:"cuisine"`
+	Servings    int      `json:"servings"`
+	Save        bool     `json:"save"`
+}
+
+// extractJSONObject pulls the outermost JSON object out of an LLM reply,
+// which is often wrapped in Markdown fences or surrounded by prose.
+func extractJSONObject(content string) string {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start == -1 || end < start {
+		return ""
+	}
+	return content[start : end+1]
+}
+
+// validateGeneratedRecipe returns structural errors, which make the recipe
+// unusable, and plausibility warnings, which prevent it from being saved.
+func validateGeneratedRecipe(recipe Recipe, req GenerateRecipeRequest, plans map[string]DietPlan) (errs []string, warnings []string) {
+	if strings.TrimSpace(recipe.Name) == "" {
+		errs = append(errs, "name is missing")
+	}
+	if len(recipe.Ingredients) == 0 {
+		errs = append(errs, "ingredients are missing")
+	}
+	if len(recipe.Instructions) == 0 {
+		errs = append(errs, "instructions are missing")
+	}
+	if recipe.Calories == nil || recipe.Protein == nil || recipe.Fat == nil || recipe.Carbs == nil {
+		errs = append(errs, "calories, protein, fat and carbs are required")
+	}
+	if len(errs) > 0 {
+		return errs, nil
+	}
+
+	for _, value := range []*int{recipe.PrepTimeMinutes, recipe.CookTimeMinutes, recipe.TotalTimeMinutes, recipe.Servings} {
+		if value != nil && *value < 0 {
+			warnings = append(warnings, "times and servings must not be negative")
+			break
+		}
+	}
+	if recipe.PrepTimeMinutes != nil && recipe.CookTimeMinutes != nil && recipe.TotalTimeMinutes != nil &&
+		*recipe.TotalTimeMinutes < *recipe.PrepTimeMinutes+*recipe.CookTimeMinutes {
+		warnings = append(warnings, "total_time_minutes is less than prep plus cook time")
+	}
+	if req.MaxTime > 0 && recipe.TotalTimeMinutes != nil && *recipe.TotalTimeMinutes > req.MaxTime {
+		warnings = append(warnings, fmt.Sprintf("total time %d exceeds max_time %d", *recipe.TotalTimeMinutes, req.MaxTime))
+	}
+
+	calories := float64(*recipe.Calories)
+	if calories <= 0 || calories > 3000 {
+		warnings = append(warnings, "calories per serving outside 1-3000")
+	}
+	if *recipe.Protein < 0 || *recipe.Fat < 0 || *recipe.Carbs < 0 {
+		warnings = append(warnings, "macros must not be negative")
+	}
+	macroCalories := *recipe.Protein*4 + *recipe.Carbs*4 + *recipe.Fat*9
+	if calories > 0 && (macroCalories < calories*0.65 || macroCalories > calories*1.35) {
+		warnings = append(warnings, fmt.Sprintf("macros add up to %.0f kcal but calories is %.0f", macroCalories, calories))
+	}
+	if recipe.Fiber != nil && (*recipe.Fiber < 0 || *recipe.Fiber > *recipe.Carbs) {
+		warnings = append(warnings, "fiber must be between 0 and carbs")
+	}
+	if recipe.Sodium != nil && (*recipe.Sodium < 0 || *recipe.Sodium > 6000) {
+		warnings = append(warnings, "sodium outside 0-6000 mg")
+	}
+
+	if plan, exists := plans[req.Diet]; exists {
+		if excluded, ok := plan.Filters["exclude_ingredients"].([]string); ok {
+			for _, ingredient := range recipe.Ingredients {
+				for _, word := range excluded {
+					if strings.Contains(strings.ToLower(ingredient), word) {
+						warnings = append(warnings, fmt.Sprintf("ingredient %q conflicts with the %s diet", ingredient, req.Diet))
+					}
+				}
+			}
+		}
+		if maxCarbs, ok := plan.Filters["max_carbs"].(int); ok && *recipe.Carbs > float64(maxCarbs) {
+			warnings = append(warnings, fmt.Sprintf("carbs exceed the %s limit of %d g", req.Diet, maxCarbs))
+		}
+	}
+
+	return errs, warnings
+}
+
+func saveGeneratedRecipe(recipe Recipe) (int, error) {
+	recipe.Rating, recipe.Difficulty = nil, nil
+	return insertRecipe(recipe, recipeStatusPending, true)
+}
+
+// insertRecipe stores a new recipe with its inferred difficulty, estimates,
+// traits, equipment and step metadata. A valid difficulty given on the recipe is kept.
+func insertRecipe(recipe Recipe, status string, aiGenerated bool) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	id, err := insertRecipeTx(tx, recipe, status, aiGenerated)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// insertRecipeTx is insertRecipe inside the caller's transaction.
+func insertRecipeTx(tx *sql.Tx, recipe Recipe, status string, aiGenerated bool) (int, error) {
+	if err := normalizeNutrition(&recipe); err != nil {
+		return 0, err
+	}
+	ingredientsJSON, _ := json.Marshal(recipe.Ingredients)
+	instructionsJSON, _ := json.Marshal(recipe.Instructions)
+	difficulty := inferDifficulty(recipe)
+	if recipe.Difficulty != nil && slices.Contains(recipeDifficulties, *recipe.Difficulty) {
+		difficulty = *recipe.Difficulty
+	}
+
+	res, err := tx.Exec(`INSERT INTO recipes (name, description, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, source_rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium, difficulty, cost_per_serving, co2e_per_serving, ai_generated, status, tenant_id, status_updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())`,
+		recipe.Name, recipe.Description, recipe.Image, recipe.PrepTimeMinutes, recipe.CookTimeMinutes, recipe.TotalTimeMinutes,
+		recipe.Servings, recipe.Rating, recipe.Rating, string(ingredientsJSON), string(instructionsJSON),
+		recipe.Calories, recipe.Protein, recipe.Fat, recipe.Carbs, recipe.Fiber, recipe.Sodium, difficulty, costEstimate.estimate(recipe), emissionsEstimate.estimate(recipe), aiGenerated, status, recipe.TenantID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	recipe.ID = int(id)
+	if err := writeInferredTraits(tx, recipe); err != nil {
+		return recipe.ID, err
+	}
+	if err := writeRecipeSteps(tx, recipe); err != nil {
+		return recipe.ID, err
+	}
+	// A missing nutrition table only costs the estimate, as with cost.
+	if factors, err := nutritionFactors.get(); err == nil {
+		if _, err := writeGlycemicEstimate(tx, recipe, factors); err != nil {
+			return recipe.ID, err
+		}
+	}
+	return recipe.ID, writeInferredEquipment(tx, recipe)
+}
+
+// nutrientUnits is the unit each nutrient is stored, filtered and served
+// in, per serving.
+var nutrientUnits = map[string]string{
+	"calories": "kcal", "protein": "g", "fat": "g", "carbs": "g", "fiber": "g", "sodium": "mg",
+}
+
+// nutritionUnitScales converts a unit to the base of its dimension: grams
+// for mass, kcal for energy. Keys are lowercase.
+var nutritionUnitScales = map[string]struct {
+	dimension string
+	scale     float64
+}{
+	"kg": {"mass", 1000}, "g": {"mass", 1}, "mg": {"mass", 1e-3}, "mcg": {"mass", 1e-6}, "ug": {"mass", 1e-6}, "µg": {"mass", 1e-6},
+	"oz":   {"mass", 28.349523125},
+	"kcal": {"energy", 1}, "kj": {"energy", 1 / 4.184},
+}
+
+// nutritionUnitFactor returns what a value of nutrient in unit is
+// multiplied by to reach the nutrient's canonical unit.
+func nutritionUnitFactor(nutrient, unit string) (float64, error) {
+	canonical, ok := nutrientUnits[nutrient]
+	if !ok {
+		return 0, fmt.Errorf("unknown nutrient %q", nutrient)
+	}
+	from, ok := nutritionUnitScales[strings.ToLower(strings.TrimSpace(unit))]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q for %s", unit, nutrient)
+	}
+	to := nutritionUnitScales[canonical]
+	if from.dimension != to.dimension {
+		return 0, fmt.Errorf("%s cannot be given in %s; use %s", nutrient, unit, canonical)
+	}
+	return from.scale / to.scale, nil
+}
+
+// normalizeNutrition converts nutrition declared in NutritionUnits to
+// nutrientUnits. Nutrients without a declared unit are taken to be in
+// their canonical unit already.
+func normalizeNutrition(recipe *Recipe) error {
+	values := map[string]**float64{
+		"protein": &recipe.Protein, "fat": &recipe.Fat, "carbs": &recipe.Carbs, "fiber": &recipe.Fiber, "sodium": &recipe.Sodium,
+	}
+	for _, nutrient := range sortedKeys(recipe.NutritionUnits) {
+		factor, err := nutritionUnitFactor(nutrient, recipe.NutritionUnits[nutrient])
+		if err != nil {
+			return err
+		}
+		if nutrient == "calories" {
+			if recipe.Calories != nil {
+				calories := int(math.Round(float64(*recipe.Calories) * factor))
+				recipe.Calories = &calories
+			}
+			continue
+		}
+		if value := values[nutrient]; *value != nil {
+			converted := **value * factor
+			*value = &converted
+		}
+	}
+	recipe.NutritionUnits = nil
+	return nil
+}
+
+func generateRecipe(c *gin.Context) {
+	var req GenerateRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	// Saving adds to the catalog, so it takes an admin token that may
+	// write recipes; anyone may generate one to look at.
+	if req.Save {
+		principal, err := adminPrincipal(bearerToken(c))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if !principal.can(permRecipesWrite) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permRecipesWrite})
+			return
+		}
+	}
+	tenant := tenantFromContext(c)
+	plans := tenant.dietPlans()
+	if req.Diet != "" {
+		if _, exists := plans[req.Diet]; !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown diet plan"})
+			return
+		}
+	}
+	if llmBudgetExceeded(c) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Daily LLM budget exceeded"})
+		return
+	}
+
+	systemPrompt := `You are a recipe developer. Create one original recipe that satisfies the user's constraints.
+
+Respond ONLY with a JSON object with these fields:
+{"name": string, "description": string, "prep_time_minutes": int, "cook_time_minutes": int, "total_time_minutes": int,
+ "servings": int, "ingredients": [string], "instructions": [string], "calories": int, "protein": number, "fat": number,
+ "carbs": number, "fiber": number, "sodium": number}
+
+Ingredients include quantities. Nutrition is per serving: calories in kcal, protein/fat/carbs/fiber in grams, sodium in mg.`
+
+	constraints := []string{}
+	if req.Diet != "" {
+		constraints = append(constraints, fmt.Sprintf("Diet: %s (%s)", plans[req.Diet].Name, plans[req.Diet].Description))
+	}
+	if len(req.Ingredients) > 0 {
+		constraints = append(constraints, "Ingredients on hand: "+strings.Join(req.Ingredients, ", "))
+	}
+	if req.MaxTime > 0 {
+		constraints = append(constraints, fmt.Sprintf("Total time at most %d minutes", req.MaxTime))
+	}
+	if req.Cuisine != "" {
+		constraints = append(constraints, "Cuisine: "+req.Cuisine)
+	}
+	if req.Servings > 0 {
+		constraints = append(constraints, fmt.Sprintf("Servings: %d", req.Servings))
+	}
+	if len(constraints) == 0 {
+		constraints = append(constraints, "No constraints; make a popular home-cooked dish")
+	}
+
+	result, err := callLLM(c.Request.Context(), []map[string]interface{}{
+		{"role": "system", "content": systemPrompt},
+		{"role": "user", "content": strings.Join(constraints, "\n")},
+	})
+	recordLLMUsage(c, "recipes/generate", result)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to generate recipe: " + err.Error()})
+		return
+	}
+
+	// Models often give calories with decimals; the field shadows the
+	// integer one so those round instead of failing to decode.
+	var generated struct {
+		Recipe
+		Calories *float64 `json:"calories"`
+	}
+	if err := json.Unmarshal([]byte(extractJSONObject(result.Content)), &generated); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Model returned an invalid recipe"})
+		return
+	}
+	recipe := generated.Recipe
+	if generated.Calories != nil {
+		calories := int(math.Round(*generated.Calories))
+		recipe.Calories = &calories
+	}
+
+	errs, warnings := validateGeneratedRecipe(recipe, req, plans)
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Model returned an incomplete recipe", "details": errs})
+		return
+	}
+
+	response := gin.H{
+		"recipe":       recipe,
+		"ai_generated": true,
+		"warnings":     warnings,
+		"saved":        false,
+	}
+
+	if req.Save && len(warnings) == 0 {
+		if tenant != nil {
+			recipe.TenantID = &tenant.ID
+		}
+		id, err := saveGeneratedRecipe(recipe)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		recipe.ID = id
+		response["recipe"] = recipe
+		response["saved"] = true
+		response["status"] = recipeStatusPending
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// recipeColumns are the columns every recipe query selects, in the order
+// scanRecipe reads them.
+const recipeColumns = "id, name, description, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium, difficulty, cost_per_serving, spice_level, kid_friendly, co2e_per_serving, glycemic_index, glycemic_load, times_made, views, tenant_id"
+
+// publishedRecipe is the condition for recipes the public API may show.
+const publishedRecipe = "status = 'published' AND deleted_at IS NULL"
+
+// recipeVisible reports whether a published recipe exists and the tenant
+// may see it.
+func recipeVisible(tenant *Tenant, id int) (bool, error) {
+	scope, args := tenant.recipeScope()
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ? AND "+scope+")", append([]interface{}{id}, args...)...).Scan(&exists)
+	return exists, err
+}
+
+// scanRecipe reads one row of recipeColumns and decodes the ingredient and
+// instruction JSON.
+func scanRecipe(row interface{ Scan(...interface{}) error }) (Recipe, error) {
+	var recipe Recipe
+	var ingredientsJSON, instructionsJSON string
+	err := row.Scan(&recipe.ID, &recipe.Name, &recipe.Description, &recipe.Image,
+		&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes, &recipe.TotalTimeMinutes,
+		&recipe.Servings, &recipe.Rating, &ingredientsJSON, &instructionsJSON,
+		&recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium, &recipe.Difficulty, &recipe.CostPerServing, &recipe.SpiceLevel, &recipe.KidFriendly, &recipe.CO2ePerServing, &recipe.GlycemicIndex, &recipe.GlycemicLoad, &recipe.TimesMade, &recipe.Views, &recipe.TenantID)
+	if err != nil {
+		return recipe, err
+	}
+
+	if ingredientsJSON != "" {
+		json.Unmarshal([]byte(ingredientsJSON), &recipe.Ingredients)
+	}
+	if instructionsJSON != "" {
+		json.Unmarshal([]byte(instructionsJSON), &recipe.Instructions)
+	}
+	applyImageFallback(&recipe)
+	recipe.NutritionUnits = nutrientUnits
+	return recipe, nil
+}
+
+// queryRecipes runs a SELECT returning the standard recipe columns and
+// decodes the ingredient and instruction JSON.
+func queryRecipes(query string, args ...interface{}) ([]Recipe, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return collectRecipes(rows)
+}
+
+// collectRecipes scans and closes rows of recipeColumns.
+func collectRecipes(rows *sql.Rows) ([]Recipe, error) {
+	recipes, _, err := scanRecipes(rows)
+	return recipes, err
+}
+
+// scanRecipes scans and closes rows of recipeColumns. A row that fails to
+// scan is left out and counted in skipped rather than failing the whole
+// result; recordScanFailure logs it for the quality report.
+func scanRecipes(rows *sql.Rows) (recipes []Recipe, skipped int, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		recipe, err := scanRecipe(rows)
+		if err != nil {
+			skipped++
+			recordScanFailure(recipe.ID, err)
+			continue
+		}
+		recipes = append(recipes, recipe)
+	}
+	dbRowsScannedTotal.add(float64(len(recipes)))
+	return recipes, skipped, rows.Err()
+}
+
+// recordScanFailure logs a recipe row that could not be scanned. Scan
+// assigns columns in order, so id is known unless it is the bad column.
+func recordScanFailure(id int, err error) {
+	dbRowsSkippedTotal.inc()
+	slog.Warn("Skipped unreadable recipe row", "recipe_id", id, "error", err)
+	if id == 0 {
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO recipe_scan_failures (recipe_id, last_error) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE failures = failures + 1, last_error = VALUES(last_error), last_seen = CURRENT_TIMESTAMP`, id, err.Error()); err != nil {
+		slog.Warn("Failed to record scan failure", "recipe_id", id, "error", err)
+	}
+}
+
+// recipeQuery builds a SELECT of recipeColumns from recipes. Conditions
+// are ANDed, and their arguments bound in the order they were added.
+type recipeQuery struct {
+	conditions []string
+	args       []interface{}
+	orderBy    string
+	limit      int
+	prepared   bool
+}
+
+func selectRecipes() *recipeQuery {
+	return &recipeQuery{}
+}
+
+func (q *recipeQuery) Where(condition string, args ...interface{}) *recipeQuery {
+	q.conditions = append(q.conditions, condition)
+	q.args = append(q.args, args...)
+	return q
+}
+
+// Visible limits the query to published recipes the tenant may see.
+func (q *recipeQuery) Visible(tenant *Tenant) *recipeQuery {
+	condition, args := tenant.recipeScope()
+	return q.Where(condition, args...)
+}
+
+func (q *recipeQuery) OrderBy(order string) *recipeQuery {
+	q.orderBy = order
+	return q
+}
+
+func (q *recipeQuery) Limit(n int) *recipeQuery {
+	q.limit = n
+	return q
+}
+
+// Prepared runs the query through a cached prepared statement. It is for
+// hot queries whose SQL doesn't vary with their input, since each distinct
+// statement stays cached.
+func (q *recipeQuery) Prepared() *recipeQuery {
+	q.prepared = true
+	return q
+}
+
+// SQL returns the statement and its arguments.
+func (q *recipeQuery) SQL() (string, []interface{}) {
+	query := "SELECT " + recipeColumns + " FROM recipes"
+	args := append([]interface{}{}, q.args...)
+	if len(q.conditions) > 0 {
+		query += " WHERE " + strings.Join(q.conditions, " AND ")
+	}
+	if q.orderBy != "" {
+		query += " ORDER BY " + q.orderBy
+	}
+	if q.limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.limit)
+	}
+	return query, args
+}
+
+func (q *recipeQuery) All() ([]Recipe, error) {
+	query, args := q.SQL()
+	if !q.prepared {
+		return queryRecipes(query, args...)
+	}
+	rows, err := db.QueryPrepared(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return collectRecipes(rows)
+}
+
+// One returns the first matching recipe, or sql.ErrNoRows.
+func (q *recipeQuery) One() (Recipe, error) {
+	query, args := q.Limit(1).SQL()
+	if q.prepared {
+		return scanRecipe(db.QueryRowPrepared(query, args...))
+	}
+	return scanRecipe(db.QueryRow(query, args...))
+}
+
+type MealPlanRequest struct {
+	Days               int      `json:"days"`
+	CaloriesPerDay     int      `json:"calories_per_day"`
+	MealsPerDay        int      `json:"meals_per_day"`
+	Diet               string   `json:"diet"`
+	IncludeIngredients []string `json:"include_ingredients"`
+	ExcludeIngredients []string `json:"exclude_ingredients"`
+	MaxTime            int      `json:"max_time"`
+	MaxDinnerTime      int      `json:"max_dinner_time"`
+	MaxCostPerServing  float64  `json:"max_cost_per_serving,omitempty"`
+	MacroSplit         string   `json:"macro_split,omitempty"`
+	MacroTolerance     float64  `json:"macro_tolerance,omitempty"`
+	ExcludeIDs         []int    `json:"exclude_ids,omitempty"`
+	ExcludeHidden      bool     `json:"exclude_hidden,omitempty"`
+
+	// hiddenFor is the API key owner whose hidden recipes are skipped.
+	hiddenFor string
+	// tenant limits candidates to the tenant's catalog.
+	tenant *Tenant
+	// macro is the parsed MacroSplit.
+	macro *macroTarget
+}
+
+type MealPlanMeal struct {
+	Slot           string `json:"slot"`
+	TargetCalories int    `json:"target_calories"`
+	Recipe         Recipe `json:"recipe"`
+}
+
+type MealPlanTotals struct {
+	Calories int     `json:"calories"`
+	Protein  float64 `json:"protein"`
+	Fat      float64 `json:"fat"`
+	Carbs    float64 `json:"carbs"`
+	Fiber    float64 `json:"fiber"`
+	Sodium   float64 `json:"sodium"`
+	// Cost sums the recipes that have an estimated cost per serving.
+	Cost float64 `json:"cost,omitempty"`
+}
+
+type MealPlanDay struct {
+	Day    int            `json:"day"`
+	Meals  []MealPlanMeal `json:"meals"`
+	Totals MealPlanTotals `json:"totals"`
+}
+
+type MealPlan struct {
+	Request  MealPlanRequest `json:"request"`
+	Days     []MealPlanDay   `json:"days"`
+	Warnings []string        `json:"warnings,omitempty"`
+	// NutritionBudget is set, with a fit score on each recipe, for callers
+	// with nutrition targets.
+	NutritionBudget *NutritionBudget `json:"nutrition_budget,omitempty"`
+}
+
+// scoreFit scores the plan's recipes against the caller's budget, if any.
+func (plan *MealPlan) scoreFit(c *gin.Context) {
+	budget := nutritionBudgetFor(c)
+	if budget == nil {
+		return
+	}
+	plan.NutritionBudget = budget
+	for i := range plan.Days {
+		for j := range plan.Days[i].Meals {
+			plan.Days[i].Meals[j].Recipe.FitScore = budget.fitScore(plan.Days[i].Meals[j].Recipe)
+		}
+	}
+}
+
+// mealSlots splits the daily calories across meals for the supported
+// meals-per-day counts.
+var mealSlots = map[int][]struct {
+	Name  string
+	Share float64
+}{
+	2: {{"lunch", 0.45}, {"dinner", 0.55}},
+	3: {{"breakfast", 0.25}, {"lunch", 0.35}, {"dinner", 0.40}},
+	4: {{"breakfast", 0.25}, {"lunch", 0.30}, {"dinner", 0.35}, {"snack", 0.10}},
+}
+
+func (req *MealPlanRequest) normalize() error {
+	if req.Days <= 0 {
+		req.Days = 7
+	}
+	if req.Days > 14 {
+		return fmt.Errorf("days must be at most 14")
+	}
+	if req.MealsPerDay == 0 {
+		req.MealsPerDay = 3
+	}
+	if _, ok := mealSlots[req.MealsPerDay]; !ok {
+		return fmt.Errorf("meals_per_day must be 2, 3 or 4")
+	}
+	if req.CaloriesPerDay <= 0 {
+		req.CaloriesPerDay = 2000
+	}
+	if req.Diet != "" {
+		if _, exists := req.tenant.dietPlans()[req.Diet]; !exists {
+			return fmt.Errorf("unknown diet plan %q", req.Diet)
+		}
+	}
+	macro, err := parseMacroTarget(req.MacroSplit, req.MacroTolerance)
+	if err != nil {
+		return err
+	}
+	req.macro = macro
+	return nil
+}
+
+func addToTotals(totals *MealPlanTotals, recipe Recipe, servings float64) {
+	if recipe.Calories != nil {
+		totals.Calories += int(math.Round(float64(*recipe.Calories) * servings))
+	}
+	for _, pair := range []struct {
+		dst *float64
+		src *float64
+	}{{&totals.Protein, recipe.Protein}, {&totals.Fat, recipe.Fat}, {&totals.Carbs, recipe.Carbs}, {&totals.Fiber, recipe.Fiber}, {&totals.Sodium, recipe.Sodium}} {
+		if pair.src != nil {
+			*pair.dst += *pair.src * servings
+		}
+	}
+	if recipe.CostPerServing != nil {
+		totals.Cost = math.Round((totals.Cost+*recipe.CostPerServing*servings)*100) / 100
+	}
+}
+
+// mealPlanCandidates loads the top-rated recipes with calories that pass
+// the plan's diet, exclusion, time and cost filters.
+func mealPlanCandidates(req MealPlanRequest) ([]Recipe, error) {
+	scope, args := req.tenant.recipeScope()
+	query := "SELECT " + recipeColumns + " FROM recipes WHERE " + scope + " AND calories IS NOT NULL AND calories > 0"
+
+	if plan, exists := req.tenant.dietPlans()[req.Diet]; exists {
+		query, args = applyDietFilters(query, args, plan.Filters)
+	}
+	for _, ingredient := range req.ExcludeIngredients {
+		// A blank term would be NOT LIKE '%%' and exclude everything.
+		if strings.TrimSpace(ingredient) == "" {
+			continue
+		}
+		condition, excludeArgs := ingredientFilterSQL(ingredient, true)
+		query += condition
+		args = append(args, excludeArgs...)
+	}
+	if req.MaxTime > 0 {
+		query += " AND total_time_minutes <= ?"
+		args = append(args, req.MaxTime)
+	}
+	if req.MaxCostPerServing > 0 {
+		query += " AND cost_per_serving <= ?"
+		args = append(args, req.MaxCostPerServing)
+	}
+	if req.macro != nil {
+		condition, macroArgs := req.macro.filterSQL()
+		query += condition
+		args = append(args, macroArgs...)
+	}
+	condition, excludeArgs := excludeRecipesSQL(req.ExcludeIDs, req.hiddenFor)
+	query += condition
+	args = append(args, excludeArgs...)
+	query += " ORDER BY rating DESC LIMIT 500"
+	return queryRecipes(query, args...)
+}
+
+// preferredRecipe reports whether a recipe uses any of the ingredients or
+// their synonyms.
+func preferredRecipe(recipe Recipe, ingredients []string) bool {
+	for _, ingredient := range ingredients {
+		if strings.TrimSpace(ingredient) == "" {
+			continue
+		}
+		for _, term := range ingredientSynonyms.expand(strings.TrimSpace(ingredient)) {
+			for _, line := range recipe.Ingredients {
+				if strings.Contains(strings.ToLower(line), strings.ToLower(term)) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// buildMealPlan picks real catalog recipes for each meal slot, choosing the
+// unused recipe whose calories are closest to the slot's share of the day.
+func buildMealPlan(req MealPlanRequest) (MealPlan, error) {
+	if err := req.normalize(); err != nil {
+		return MealPlan{}, err
+	}
+
+	candidates, err := mealPlanCandidates(req)
+	if err != nil {
+		return MealPlan{}, err
+	}
+
+	plan := MealPlan{Request: req, Days: []MealPlanDay{}}
+	if len(candidates) == 0 {
+		plan.Warnings = append(plan.Warnings, "No recipes match these constraints")
+		return plan, nil
+	}
+
+	used := map[int]bool{}
+	for day := 1; day <= req.Days; day++ {
+		planDay := MealPlanDay{Day: day, Meals: []MealPlanMeal{}}
+		for _, slot := range mealSlots[req.MealsPerDay] {
+			target := int(float64(req.CaloriesPerDay) * slot.Share)
+
+			best := -1
+			bestScore := math.MaxFloat64
+			for i, recipe := range candidates {
+				if slot.Name == "dinner" && req.MaxDinnerTime > 0 &&
+					(recipe.TotalTimeMinutes == nil || *recipe.TotalTimeMinutes > req.MaxDinnerTime) {
+					continue
+				}
+				score := math.Abs(float64(*recipe.Calories - target))
+				if used[recipe.ID] {
+					score += float64(req.CaloriesPerDay)
+				}
+				if req.macro != nil {
+					// Each point off the split weighs like 1% of the slot's calories.
+					if distance, ok := req.macro.distance(recipe); ok {
+						score += distance * float64(target) / 100
+					}
+				}
+				if preferredRecipe(recipe, req.IncludeIngredients) {
+					score *= 0.8
+				}
+				if score < bestScore {
+					best, bestScore = i, score
+				}
+			}
+
+			if best == -1 {
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("Day %d: no recipe fits the %s constraints", day, slot.Name))
+				continue
+			}
+
+			recipe := candidates[best]
+			used[recipe.ID] = true
+			planDay.Meals = append(planDay.Meals, MealPlanMeal{Slot: slot.Name, TargetCalories: target, Recipe: recipe})
+			addToTotals(&planDay.Totals, recipe, 1)
+		}
+
+		if diff := planDay.Totals.Calories - req.CaloriesPerDay; diff > req.CaloriesPerDay/10 || -diff > req.CaloriesPerDay/10 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("Day %d: %d kcal is more than 10%% off the %d kcal target", day, planDay.Totals.Calories, req.CaloriesPerDay))
+		}
+		plan.Days = append(plan.Days, planDay)
+	}
+
+	return plan, nil
+}
+
+func createMealPlan(c *gin.Context) {
+	var req MealPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.ExcludeIDs) > maxExcludeIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.ExcludeHidden {
+		owner, ok := apiKeyOwner(c)
+		if !ok {
+			return
+		}
+		req.hiddenFor = owner
+	}
+	req.tenant = tenantFromContext(c)
+
+	plan, err := buildMealPlan(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	plan.scoreFit(c)
+
+	if c.Query("format") == "markdown" {
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(mealPlanMarkdown(plan)))
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// markdownCell escapes text for a Markdown table cell.
+func markdownCell(text string) string {
+	return strings.ReplaceAll(strings.Join(strings.Fields(text), " "), "|", `\|`)
+}
+
+// recipeMarkdown renders a recipe for note apps and static sites: an
+// ingredient checklist, numbered steps and a nutrition table per serving.
+// level is the heading level of the title, so plans can nest recipes.
+func recipeMarkdown(recipe Recipe, level int) string {
+	var b strings.Builder
+	heading := strings.Repeat("#", level)
+	fmt.Fprintf(&b, "%s %s\n\n", heading, recipe.Name)
+	if recipe.Image != "" {
+		fmt.Fprintf(&b, "![%s](%s)\n\n", markdownCell(recipe.Name), recipe.Image)
+	}
+	if description := strings.TrimSpace(recipe.Description); description != "" {
+		b.WriteString(description + "\n\n")
+	}
+
+	facts := []string{}
+	for _, fact := range []struct {
+		label string
+		value *int
+	}{
+		{"Prep", recipe.PrepTimeMinutes}, {"Cook", recipe.CookTimeMinutes}, {"Total", recipe.TotalTimeMinutes},
+	} {
+		if fact.value != nil && *fact.value > 0 {
+			facts = append(facts, fmt.Sprintf("**%s:** %d min", fact.label, *fact.value))
+		}
+	}
+	if recipe.Servings != nil && *recipe.Servings > 0 {
+		facts = append(facts, fmt.Sprintf("**Serves:** %d", *recipe.Servings))
+	}
+	if len(facts) > 0 {
+		b.WriteString(strings.Join(facts, " · ") + "\n\n")
+	}
+
+	fmt.Fprintf(&b, "%s# Ingredients\n\n", heading)
+	for _, ingredient := range recipe.Ingredients {
+		if ingredient = strings.TrimSpace(ingredient); ingredient != "" {
+			fmt.Fprintf(&b, "- [ ] %s\n", ingredient)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n%s# Instructions\n\n", heading)
+	number := 0
+	for _, step := range recipe.Instructions {
+		if step = strings.TrimSpace(step); step != "" {
+			number++
+			fmt.Fprintf(&b, "%d. %s\n", number, step)
+		}
+	}
+
+	rows := []string{}
+	if recipe.Calories != nil {
+		rows = append(rows, fmt.Sprintf("| Calories | %d %s |", *recipe.Calories, nutrientUnits["calories"]))
+	}
+	for _, nutrient := range []struct {
+		key, label string
+		value      *float64
+	}{
+		{"protein", "Protein", recipe.Protein}, {"fat", "Fat", recipe.Fat}, {"carbs", "Carbs", recipe.Carbs},
+		{"fiber", "Fiber", recipe.Fiber}, {"sodium", "Sodium", recipe.Sodium},
+	} {
+		if nutrient.value != nil {
+			rows = append(rows, fmt.Sprintf("| %s | %s %s |", nutrient.label, formatAmount(*nutrient.value), nutrientUnits[nutrient.key]))
+		}
+	}
+	if len(rows) > 0 {
+		fmt.Fprintf(&b, "\n%s# Nutrition\n\n| Per serving | Amount |\n| --- | ---: |\n%s\n", heading, strings.Join(rows, "\n"))
+	}
+	return b.String()
+}
+
+// mealPlanMarkdown renders a plan day by day with each day's totals,
+// followed by every recipe in the plan once.
+func mealPlanMarkdown(plan MealPlan) string {
+	var b strings.Builder
+	b.WriteString("# Meal plan\n")
+	recipes := []Recipe{}
+	seen := map[int]bool{}
+	for _, day := range plan.Days {
+		fmt.Fprintf(&b, "\n## Day %d\n\n| Meal | Recipe | Calories |\n| --- | --- | ---: |\n", day.Day)
+		for _, meal := range day.Meals {
+			calories := ""
+			if meal.Recipe.Calories != nil {
+				calories = strconv.Itoa(*meal.Recipe.Calories)
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", strings.ToUpper(meal.Slot[:1])+meal.Slot[1:], markdownCell(meal.Recipe.Name), calories)
+			if !seen[meal.Recipe.ID] {
+				seen[meal.Recipe.ID] = true
+				recipes = append(recipes, meal.Recipe)
+			}
+		}
+		totals := day.Totals
+		fmt.Fprintf(&b, "\n**Totals:** %d kcal · %s g protein · %s g fat · %s g carbs · %s g fiber · %s mg sodium\n",
+			totals.Calories, formatAmount(totals.Protein), formatAmount(totals.Fat), formatAmount(totals.Carbs), formatAmount(totals.Fiber), formatAmount(totals.Sodium))
+	}
+	if len(plan.Warnings) > 0 {
+		b.WriteString("\n## Notes\n\n")
+		for _, warning := range plan.Warnings {
+			fmt.Fprintf(&b, "- %s\n", warning)
+		}
+	}
+	if len(recipes) > 0 {
+		b.WriteString("\n## Recipes\n")
+		for _, recipe := range recipes {
+			b.WriteString("\n" + recipeMarkdown(recipe, 3))
+		}
+	}
+	return b.String()
+}
+
+// BatchPlanRequest asks for a meal-prep plan: a few recipes cooked on one
+// prep day and portioned into containers covering days × meals_per_day
+// meals. The meal plan filters apply to the recipe choice.
+type BatchPlanRequest struct {
+	MealPlanRequest
+	// Recipes is how many different dishes to cook.
+	Recipes int `json:"recipes"`
+}
+
+// BatchContainers splits a recipe's portions between the fridge and the
+// freezer, one container per meal.
+type BatchContainers struct {
+	Fridge  int `json:"fridge"`
+	Freezer int `json:"freezer"`
+}
+
+type BatchPlanRecipe struct {
+	Recipe     Recipe          `json:"recipe"`
+	Servings   float64         `json:"servings"`
+	Scale      float64         `json:"scale"`
+	EatOnDays  []int           `json:"eat_on_days"`
+	Containers BatchContainers `json:"containers"`
+	Storage    Storability     `json:"storage"`
+	// Reheat adds thawing to the storage instructions when some portions
+	// go in the freezer.
+	Reheat string `json:"reheat"`
+}
+
+type BatchPlan struct {
+	Request           BatchPlanRequest  `json:"request"`
+	Recipes           []BatchPlanRecipe `json:"recipes"`
+	Containers        int               `json:"containers"`
+	SharedIngredients []string          `json:"shared_ingredients"`
+	PrepDay           CookPlan          `json:"prep_day"`
+	ShoppingList      ShoppingList      `json:"shopping_list"`
+	Warnings          []string          `json:"warnings,omitempty"`
+}
+
+const (
+	defaultBatchRecipes = 3
+	maxBatchRecipes     = 5
+)
+
+var (
+	// scalesPoorlyPattern matches recipes that depend on exact ratios, pan
+	// size or an uncrowded pan, so doubling them rarely works first time.
+	scalesPoorlyPattern = regexp.MustCompile(`\b(cakes?|bread|cookies?|muffins?|pastry|souffl[eé]|meringue|macarons?|tempura|stir[- ]fr(y|ied)|risotto|omelet(te)?s?|cr[eê]pes?|pancakes?)\b`)
+)
+
+// batchScaleScore rates how well a recipe scales up: one-pot dishes that
+// freeze well best, ratio-sensitive baking and pan-limited frying worst.
+func batchScaleScore(recipe Recipe) float64 {
+	text := strings.ToLower(recipe.Name + " " + strings.Join(recipe.Instructions, " "))
+	switch {
+	case scalesPoorlyPattern.MatchString(text):
+		return 0.3
+	case freezesWellPattern.MatchString(strings.ToLower(recipe.Name)):
+		return 1
+	}
+	return 0.6
+}
+
+// ingredientNames is the set of parsed ingredient names of a recipe.
+func ingredientNames(recipe Recipe) map[string]bool {
+	names := map[string]bool{}
+	for _, line := range recipe.Ingredients {
+		if name := parseIngredientLine(line).Name; name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// buildBatchPlan picks recipes that scale, keep for the plan's length and
+// share ingredients with those already picked, then portions them out
+// across the days in rotation.
+func buildBatchPlan(req BatchPlanRequest) (BatchPlan, error) {
+	if req.MealsPerDay == 0 {
+		req.MealsPerDay = 2
+	}
+	if req.Days == 0 {
+		req.Days = 5
+	}
+	if req.Recipes == 0 {
+		req.Recipes = defaultBatchRecipes
+	}
+	if req.Recipes < 1 || req.Recipes > maxBatchRecipes {
+		return BatchPlan{}, fmt.Errorf("recipes must be between 1 and %d", maxBatchRecipes)
+	}
+	if err := req.MealPlanRequest.normalize(); err != nil {
+		return BatchPlan{}, err
+	}
+
+	plan := BatchPlan{Request: req, Recipes: []BatchPlanRecipe{}, SharedIngredients: []string{}}
+	candidates, err := mealPlanCandidates(req.MealPlanRequest)
+	if err != nil {
+		return plan, err
+	}
+	storages, err := loadStorabilities(candidates)
+	if err != nil {
+		return plan, err
+	}
+
+	target := float64(req.CaloriesPerDay) / float64(req.MealsPerDay)
+	names := make([]map[string]bool, len(candidates))
+	base := make([]float64, len(candidates))
+	for i, recipe := range candidates {
+		names[i] = ingredientNames(recipe)
+		storage := storages[recipe.ID]
+		keeps := 1.0
+		switch {
+		case storage.FridgeDays >= req.Days:
+		case storage.FreezerMonths > 0:
+			keeps = 0.5
+		default:
+			// It would spoil before the last portion is eaten.
+			base[i] = math.Inf(-1)
+			continue
+		}
+		score := 2*batchScaleScore(recipe) + keeps - math.Abs(float64(*recipe.Calories)-target)/target
+		if recipe.Rating != nil {
+			score += *recipe.Rating / 5
+		}
+		if preferredRecipe(recipe, req.IncludeIngredients) {
+			score += 0.5
+		}
+		base[i] = score
+	}
+
+	picked := []int{}
+	shared := map[string]int{}
+	for len(picked) < req.Recipes {
+		best, bestScore := -1, math.Inf(-1)
+		for i := range candidates {
+			if math.IsInf(base[i], -1) || slices.Contains(picked, i) {
+				continue
+			}
+			score := base[i]
+			if len(names[i]) > 0 && len(shared) > 0 {
+				overlap := 0
+				for name := range names[i] {
+					if shared[name] > 0 {
+						overlap++
+					}
+				}
+				score += 1.5 * float64(overlap) / float64(len(names[i]))
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best == -1 {
+			break
+		}
+		picked = append(picked, best)
+		for name := range names[best] {
+			shared[name]++
+		}
+	}
+	if len(picked) == 0 {
+		plan.Warnings = append(plan.Warnings, "No recipes match these constraints")
+		return plan, nil
+	}
+	if len(picked) < req.Recipes {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("Only %d recipes keep for %d days with these constraints", len(picked), req.Days))
+	}
+
+	// Meals rotate through the recipes so no dish runs for days on end.
+	for _, i := range picked {
+		recipe := candidates[i]
+		plan.Recipes = append(plan.Recipes, BatchPlanRecipe{Recipe: recipe, EatOnDays: []int{}, Storage: storages[recipe.ID]})
+	}
+	meal := 0
+	for day := 1; day <= req.Days; day++ {
+		for range req.MealsPerDay {
+			entry := &plan.Recipes[meal%len(plan.Recipes)]
+			entry.Servings++
+			entry.EatOnDays = append(entry.EatOnDays, day)
+			// Portions for the day after the fridge limit go in the
+			// freezer; the day counts from prep day as day one.
+			if day <= entry.Storage.FridgeDays {
+				entry.Containers.Fridge++
+			} else {
+				entry.Containers.Freezer++
+			}
+			meal++
+		}
+	}
+
+	portions := []RecipePortion{}
+	recipes := []Recipe{}
+	for i := range plan.Recipes {
+		entry := &plan.Recipes[i]
+		entry.Scale = entry.Servings
+		if entry.Recipe.Servings != nil && *entry.Recipe.Servings > 0 {
+			entry.Scale = math.Round(entry.Servings/float64(*entry.Recipe.Servings)*100) / 100
+		}
+		entry.Reheat = entry.Storage.Reheat
+		if entry.Containers.Freezer > 0 {
+			entry.Reheat = "Move frozen containers to the fridge the night before. " + entry.Reheat
+		}
+		plan.Containers += entry.Containers.Fridge + entry.Containers.Freezer
+		portions = append(portions, RecipePortion{ID: entry.Recipe.ID, Servings: entry.Servings})
+		recipes = append(recipes, entry.Recipe)
+	}
+	for name, count := range shared {
+		if count > 1 {
+			plan.SharedIngredients = append(plan.SharedIngredients, name)
+		}
+	}
+	sort.Strings(plan.SharedIngredients)
+
+	plan.PrepDay = buildCookPlan(recipes)
+	plan.ShoppingList, err = buildShoppingList(req.tenant, portions)
+	return plan, err
+}
+
+// createBatchPlan is the meal-prep variant of createMealPlan.
+func createBatchPlan(c *gin.Context) {
+	var req BatchPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.ExcludeIDs) > maxExcludeIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.ExcludeHidden {
+		owner, ok := apiKeyOwner(c)
+		if !ok {
+			return
+		}
+		req.hiddenFor = owner
+	}
+	req.tenant = tenantFromContext(c)
+
+	plan, err := buildBatchPlan(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// DayPlanRequest asks for one day of meals adding up to a calorie budget,
+// give or take Tolerance percent. The filters mean the same as in
+// MealPlanRequest.
+type DayPlanRequest struct {
+	Calories           int      `json:"calories" binding:"required"`
+	Meals              int      `json:"meals"`
+	Tolerance          float64  `json:"tolerance"`
+	Diet               string   `json:"diet"`
+	IncludeIngredients []string `json:"include_ingredients"`
+	ExcludeIngredients []string `json:"exclude_ingredients"`
+	MaxTime            int      `json:"max_time"`
+	MacroSplit         string   `json:"macro_split,omitempty"`
+	ExcludeIDs         []int    `json:"exclude_ids,omitempty"`
+	ExcludeHidden      bool     `json:"exclude_hidden,omitempty"`
+}
+
+type DayPlan struct {
+	Calories        int            `json:"calories"`
+	Tolerance       float64        `json:"tolerance"`
+	Meals           []MealPlanMeal `json:"meals"`
+	Totals          MealPlanTotals `json:"totals"`
+	Difference      int            `json:"difference"`
+	WithinTolerance bool           `json:"within_tolerance"`
+	Warnings        []string       `json:"warnings,omitempty"`
+}
+
+const (
+	defaultDayPlanTolerance = 5
+	// dayPlanSlotCandidates is how many recipes closest to each slot's
+	// target are tried in combination.
+	dayPlanSlotCandidates = 20
+)
+
+// buildDayPlan tries combinations of the recipes nearest each slot's share
+// of the budget and keeps the one that lands within tolerance with the
+// smallest per-slot deviation, preferring higher ratings. When nothing
+// lands within tolerance it returns the closest total.
+func buildDayPlan(req DayPlanRequest, hiddenFor string, tenant *Tenant) (DayPlan, error) {
+	if req.Calories < 800 || req.Calories > 6000 {
+		return DayPlan{}, fmt.Errorf("calories must be between 800 and 6000")
+	}
+	if req.Meals == 0 {
+		req.Meals = 3
+	}
+	slots, ok := mealSlots[req.Meals]
+	if !ok {
+		return DayPlan{}, fmt.Errorf("meals must be 2, 3 or 4")
+	}
+	if req.Tolerance == 0 {
+		req.Tolerance = defaultDayPlanTolerance
+	}
+	if req.Tolerance < 1 || req.Tolerance > 25 {
+		return DayPlan{}, fmt.Errorf("tolerance must be between 1 and 25 percent")
+	}
+
+	planReq := MealPlanRequest{
+		Days:               1,
+		CaloriesPerDay:     req.Calories,
+		MealsPerDay:        req.Meals,
+		Diet:               req.Diet,
+		ExcludeIngredients: req.ExcludeIngredients,
+		MaxTime:            req.MaxTime,
+		MacroSplit:         req.MacroSplit,
+		ExcludeIDs:         req.ExcludeIDs,
+		hiddenFor:          hiddenFor,
+		tenant:             tenant,
+	}
+	if err := planReq.normalize(); err != nil {
+		return DayPlan{}, err
+	}
+	candidates, err := mealPlanCandidates(planReq)
+	if err != nil {
+		return DayPlan{}, err
+	}
+
+	plan := DayPlan{Calories: req.Calories, Tolerance: req.Tolerance, Meals: []MealPlanMeal{}}
+	if len(candidates) == 0 {
+		plan.Warnings = append(plan.Warnings, "No recipes match these constraints")
+		return plan, nil
+	}
+
+	targets := make([]int, len(slots))
+	options := make([][]int, len(slots))
+	for s, slot := range slots {
+		targets[s] = int(float64(req.Calories) * slot.Share)
+		indexes := make([]int, len(candidates))
+		for i := range candidates {
+			indexes[i] = i
+		}
+		sort.SliceStable(indexes, func(a, b int) bool {
+			return math.Abs(float64(*candidates[indexes[a]].Calories-targets[s])) < math.Abs(float64(*candidates[indexes[b]].Calories-targets[s]))
+		})
+		options[s] = indexes[:min(dayPlanSlotCandidates, len(indexes))]
+	}
+
+	// slotCost is a recipe's relative deviation from its slot target, less
+	// a little for rating and for using a preferred ingredient.
+	slotCost := func(s, i int) float64 {
+		recipe := candidates[i]
+		cost := math.Abs(float64(*recipe.Calories-targets[s])) / float64(targets[s])
+		if recipe.Rating != nil {
+			cost -= *recipe.Rating / 50
+		}
+		if preferredRecipe(recipe, req.IncludeIngredients) {
+			cost -= 0.1
+		}
+		return cost
+	}
+
+	allowed := float64(req.Calories) * req.Tolerance / 100
+	best, closest := []int(nil), []int(nil)
+	bestCost, closestDiff := math.Inf(1), math.Inf(1)
+	picked := make([]int, len(slots))
+	var search func(s, calories int, cost float64)
+	search = func(s, calories int, cost float64) {
+		if s == len(slots) {
+			diff := math.Abs(float64(calories - req.Calories))
+			if diff <= allowed && cost < bestCost {
+				best, bestCost = slices.Clone(picked), cost
+			}
+			if diff < closestDiff {
+				closest, closestDiff = slices.Clone(picked), diff
+			}
+			return
+		}
+		for _, i := range options[s] {
+			if slices.Contains(picked[:s], i) {
+				continue
+			}
+			picked[s] = i
+			search(s+1, calories+*candidates[i].Calories, cost+slotCost(s, i))
+		}
+	}
+	search(0, 0, 0)
+
+	plan.WithinTolerance = best != nil
+	if best == nil {
+		best = closest
+	}
+	if best == nil {
+		plan.Warnings = append(plan.Warnings, "Not enough distinct recipes for every meal")
+		return plan, nil
+	}
+	for s, i := range best {
+		recipe := candidates[i]
+		plan.Meals = append(plan.Meals, MealPlanMeal{Slot: slots[s].Name, TargetCalories: targets[s], Recipe: recipe})
+		addToTotals(&plan.Totals, recipe, 1)
+	}
+	plan.Difference = plan.Totals.Calories - req.Calories
+	if !plan.WithinTolerance {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("No combination is within %g%% of %d kcal; this is the closest", req.Tolerance, req.Calories))
+	}
+	return plan, nil
+}
+
+// createDayPlan picks one day of meals within a calorie budget.
+func createDayPlan(c *gin.Context) {
+	var req DayPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.ExcludeIDs) > maxExcludeIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	hiddenFor := ""
+	if req.ExcludeHidden {
+		owner, ok := apiKeyOwner(c)
+		if !ok {
+			return
+		}
+		hiddenFor = owner
+	}
+
+	plan, err := buildDayPlan(req, hiddenFor, tenantFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// NutritionTargets are the daily goals a weekly report measures against.
+type NutritionTargets struct {
+	Calories  int     `json:"calories"`
+	MaxSodium float64 `json:"max_sodium"`
+	MinFiber  float64 `json:"min_fiber"`
+	// MacroSplit is an optional protein/carbs/fat percentage target.
+	MacroSplit string `json:"macro_split,omitempty"`
+}
+
+// Daily targets used when the request sets none: a 2000 kcal reference
+// diet, the 2300 mg sodium limit and 28 g of fiber.
+var defaultNutritionTargets = NutritionTargets{Calories: 2000, MaxSodium: 2300, MinFiber: 28}
+
+// DailyNutrition is one day's meals and nutrition totals.
+type DailyNutrition struct {
+	Date    string         `json:"date"`
+	Logged  int            `json:"logged"`
+	Planned int            `json:"planned"`
+	Totals  MealPlanTotals `json:"totals"`
+	// MacroSplit is the share of calories from protein, carbs and fat.
+	MacroSplit map[string]float64 `json:"macro_split"`
+	// Adherence says which targets the day met; empty days have none.
+	Adherence map[string]bool `json:"adherence,omitempty"`
+}
+
+type WeeklyReport struct {
+	WeekStart string           `json:"week_start"`
+	WeekEnd   string           `json:"week_end"`
+	TimeZone  string           `json:"time_zone"`
+	Targets   NutritionTargets `json:"targets"`
+	Days      []DailyNutrition `json:"days"`
+	// Average is per day with any meals, so unlogged days don't drag it down.
+	Average     MealPlanTotals `json:"average"`
+	TrackedDays int            `json:"tracked_days"`
+	// Adherence is the share of tracked days meeting each target, in percent.
+	Adherence map[string]float64 `json:"adherence"`
+	// Trends is the change in the daily average against the prior week, in
+	// percent; a nutrient is left out when the prior week has no data.
+	Trends map[string]float64 `json:"trends"`
+}
+
+// mealLogTotals sums the logged (and with planned, planned) meals of owner
+// between from and to per local day, keyed by date in loc.
+func mealLogTotals(owner string, from, to time.Time, loc *time.Location, planned bool) (map[string]*DailyNutrition, error) {
+	query := `SELECT m.servings, m.eaten_at, m.planned, r.calories, r.protein, r.fat, r.carbs, r.fiber, r.sodium, r.cost_per_serving
+		FROM meal_log m JOIN recipes r ON r.id = m.recipe_id
+		WHERE m.owner = ? AND m.eaten_at >= ? AND m.eaten_at < ?`
+	if !planned {
+		query += " AND m.planned = FALSE"
+	}
+	rows, err := db.Query(query, owner, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := map[string]*DailyNutrition{}
+	for rows.Next() {
+		var servings float64
+		var eatenAt time.Time
+		var isPlanned bool
+		var recipe Recipe
+		if err := rows.Scan(&servings, &eatenAt, &isPlanned, &recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium, &recipe.CostPerServing); err != nil {
+			return nil, err
+		}
+		date := eatenAt.In(loc).Format(time.DateOnly)
+		day, ok := days[date]
+		if !ok {
+			day = &DailyNutrition{Date: date}
+			days[date] = day
+		}
+		if isPlanned {
+			day.Planned++
+		} else {
+			day.Logged++
+		}
+		addToTotals(&day.Totals, recipe, servings)
+	}
+	return days, rows.Err()
+}
+
+// averageTotals averages the days that have any meals.
+func averageTotals(days []*DailyNutrition) (MealPlanTotals, int) {
+	var sum MealPlanTotals
+	tracked := 0
+	for _, day := range days {
+		if day == nil || day.Logged+day.Planned == 0 {
+			continue
+		}
+		tracked++
+		sum.Calories += day.Totals.Calories
+		sum.Protein += day.Totals.Protein
+		sum.Fat += day.Totals.Fat
+		sum.Carbs += day.Totals.Carbs
+		sum.Fiber += day.Totals.Fiber
+		sum.Sodium += day.Totals.Sodium
+		sum.Cost += day.Totals.Cost
+	}
+	if tracked == 0 {
+		return sum, 0
+	}
+	n := float64(tracked)
+	round := func(v float64) float64 { return math.Round(v/n*10) / 10 }
+	return MealPlanTotals{
+		Calories: int(math.Round(float64(sum.Calories) / n)),
+		Protein:  round(sum.Protein),
+		Fat:      round(sum.Fat),
+		Carbs:    round(sum.Carbs),
+		Fiber:    round(sum.Fiber),
+		Sodium:   round(sum.Sodium),
+		Cost:     math.Round(sum.Cost/n*100) / 100,
+	}, tracked
+}
+
+// buildWeeklyReport reports on the seven days from weekStart, a local
+// midnight in loc, comparing against the seven days before.
+func buildWeeklyReport(owner string, weekStart time.Time, loc *time.Location, targets NutritionTargets, planned bool) (WeeklyReport, error) {
+	macro, err := parseMacroTarget(targets.MacroSplit, 0)
+	if err != nil {
+		return WeeklyReport{}, err
+	}
+	weekEnd := weekStart.AddDate(0, 0, 7)
+	current, err := mealLogTotals(owner, weekStart, weekEnd, loc, planned)
+	if err != nil {
+		return WeeklyReport{}, err
+	}
+	prior, err := mealLogTotals(owner, weekStart.AddDate(0, 0, -7), weekStart, loc, planned)
+	if err != nil {
+		return WeeklyReport{}, err
+	}
+
+	report := WeeklyReport{
+		WeekStart: weekStart.Format(time.DateOnly),
+		WeekEnd:   weekEnd.AddDate(0, 0, -1).Format(time.DateOnly),
+		TimeZone:  loc.String(),
+		Targets:   targets,
+		Days:      []DailyNutrition{},
+		Adherence: map[string]float64{},
+		Trends:    map[string]float64{},
+	}
+	met := map[string]int{}
+	days := []*DailyNutrition{}
+	for i := 0; i < 7; i++ {
+		date := weekStart.AddDate(0, 0, i).Format(time.DateOnly)
+		day, ok := current[date]
+		if !ok {
+			day = &DailyNutrition{Date: date}
+		}
+		day.MacroSplit = macroSplit(day.Totals)
+		if day.Logged+day.Planned > 0 {
+			calories := float64(day.Totals.Calories - targets.Calories)
+			day.Adherence = map[string]bool{
+				"calories": math.Abs(calories) <= float64(targets.Calories)/10,
+				"sodium":   day.Totals.Sodium <= targets.MaxSodium,
+				"fiber":    day.Totals.Fiber >= targets.MinFiber,
+			}
+			if macro != nil {
+				day.Adherence["macro_split"] = math.Abs(day.MacroSplit["protein"]-macro.Protein) <= macro.Tolerance &&
+					math.Abs(day.MacroSplit["carbs"]-macro.Carbs) <= macro.Tolerance &&
+					math.Abs(day.MacroSplit["fat"]-macro.Fat) <= macro.Tolerance
+			}
+			for key, ok := range day.Adherence {
+				if ok {
+					met[key]++
+				} else if _, seen := met[key]; !seen {
+					met[key] = 0
+				}
+			}
+		}
+		days = append(days, day)
+		report.Days = append(report.Days, *day)
+	}
+
+	report.Average, report.TrackedDays = averageTotals(days)
+	for key, count := range met {
+		report.Adherence[key] = math.Round(float64(count)/float64(report.TrackedDays)*1000) / 10
+	}
+
+	priorDays := []*DailyNutrition{}
+	for _, day := range prior {
+		priorDays = append(priorDays, day)
+	}
+	priorAverage, priorTracked := averageTotals(priorDays)
+	if report.TrackedDays > 0 && priorTracked > 0 {
+		for _, pair := range []struct {
+			name           string
+			current, prior float64
+		}{
+			{"calories", float64(report.Average.Calories), float64(priorAverage.Calories)},
+			{"protein", report.Average.Protein, priorAverage.Protein},
+			{"fat", report.Average.Fat, priorAverage.Fat},
+			{"carbs", report.Average.Carbs, priorAverage.Carbs},
+			{"fiber", report.Average.Fiber, priorAverage.Fiber},
+			{"sodium", report.Average.Sodium, priorAverage.Sodium},
+		} {
+			if pair.prior > 0 {
+				report.Trends[pair.name] = math.Round((pair.current-pair.prior)/pair.prior*1000) / 10
+			}
+		}
+	}
+	return report, nil
+}
+
+// reportLines formats a weekly report as fixed-width text for the PDF and
+// email renderings.
+func reportLines(report WeeklyReport) []string {
+	lines := []string{
+		fmt.Sprintf("Week %s to %s (%s)", report.WeekStart, report.WeekEnd, report.TimeZone),
+		fmt.Sprintf("Targets: %d kcal, sodium <= %g mg, fiber >= %g g", report.Targets.Calories, report.Targets.MaxSodium, report.Targets.MinFiber),
+		"",
+		fmt.Sprintf("%-10s %5s %6s %6s %6s %6s %7s %5s", "Date", "Meals", "kcal", "Prot", "Carbs", "Fat", "Sodium", "Fiber"),
+	}
+	for _, day := range report.Days {
+		t := day.Totals
+		lines = append(lines, fmt.Sprintf("%-10s %5d %6d %6.0f %6.0f %6.0f %7.0f %5.0f", day.Date, day.Logged+day.Planned, t.Calories, t.Protein, t.Carbs, t.Fat, t.Sodium, t.Fiber))
+	}
+	a := report.Average
+	lines = append(lines,
+		fmt.Sprintf("%-10s %5d %6d %6.0f %6.0f %6.0f %7.0f %5.0f", "Average", report.TrackedDays, a.Calories, a.Protein, a.Carbs, a.Fat, a.Sodium, a.Fiber),
+		"",
+		"Days on target:",
+	)
+	for _, key := range sortedKeys(report.Adherence) {
+		lines = append(lines, fmt.Sprintf("  %-12s %5.1f%%", key, report.Adherence[key]))
+	}
+	if len(report.Trends) > 0 {
+		lines = append(lines, "", "Change vs prior week:")
+		for _, key := range sortedKeys(report.Trends) {
+			lines = append(lines, fmt.Sprintf("  %-12s %+5.1f%%", key, report.Trends[key]))
+		}
+	}
+	return lines
+}
+
+// weeklyReportRequest reads the week, time zone and targets shared by the
+// JSON, PDF and email forms of the report. week is any date in the wanted
+// Monday-to-Sunday week and defaults to the current one.
+func weeklyReportRequest(c *gin.Context) (time.Time, *time.Location, NutritionTargets, bool) {
+	loc, ok := requestLocation(c)
+	if !ok {
+		return time.Time{}, nil, NutritionTargets{}, false
+	}
+	day := time.Now().In(loc)
+	if week := c.Query("week"); week != "" {
+		var err error
+		if day, err = time.ParseInLocation(time.DateOnly, week, loc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "week must be a date like 2024-01-15"})
+			return time.Time{}, nil, NutritionTargets{}, false
+		}
+	}
+	offset := (int(day.Weekday()) + 6) % 7
+	weekStart := time.Date(day.Year(), day.Month(), day.Day()-offset, 0, 0, 0, 0, loc)
+
+	targets := defaultNutritionTargets
+	for _, param := range []struct {
+		name string
+		dst  *float64
+	}{{"max_sodium", &targets.MaxSodium}, {"min_fiber", &targets.MinFiber}} {
+		if raw := c.Query(param.name); raw != "" {
+			val, err := strconv.ParseFloat(raw, 64)
+			if err != nil || val < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param.name + " must be a non-negative number"})
+				return time.Time{}, nil, NutritionTargets{}, false
+			}
+			*param.dst = val
+		}
+	}
+	if raw := c.Query("calories"); raw != "" {
+		val, err := strconv.Atoi(raw)
+		if err != nil || val <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "calories must be a positive integer"})
+			return time.Time{}, nil, NutritionTargets{}, false
+		}
+		targets.Calories = val
+	}
+	targets.MacroSplit = c.Query("macro_split")
+	if _, err := parseMacroTarget(targets.MacroSplit, 0); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return time.Time{}, nil, NutritionTargets{}, false
+	}
+	return weekStart, loc, targets, true
+}
+
+// getWeeklyReport returns the caller's weekly nutrition report as JSON, or
+// with format=pdf as a PDF download. Planned meals count unless
+// include_planned=false.
+func getWeeklyReport(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	weekStart, loc, targets, ok := weeklyReportRequest(c)
+	if !ok {
+		return
+	}
+
+	report, err := buildWeeklyReport(owner, weekStart, loc, targets, c.Query("include_planned") != "false")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch c.Query("format") {
+	case "", "json":
+		c.JSON(http.StatusOK, report)
+	case "pdf":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="nutrition-%s.pdf"`, report.WeekStart))
+		c.Data(http.StatusOK, "application/pdf", renderTextPDF("Weekly nutrition report", reportLines(report)))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or pdf"})
+	}
+}
+
+type EmailReportRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// emailWeeklyReport sends the weekly report as text with the PDF attached.
+// It takes the same query parameters as getWeeklyReport.
+func emailWeeklyReport(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	var req EmailReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
+	if cfg.Alerts.SMTPHost == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email is not configured"})
+		return
+	}
+	weekStart, loc, targets, ok := weeklyReportRequest(c)
+	if !ok {
+		return
+	}
+
+	report, err := buildWeeklyReport(owner, weekStart, loc, targets, c.Query("include_planned") != "false")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	lines := reportLines(report)
+	err = sendEmail(addr.Address, "Your nutrition report for the week of "+report.WeekStart, strings.Join(lines, "\n")+"\n",
+		emailAttachment{Filename: "nutrition-" + report.WeekStart + ".pdf", ContentType: "application/pdf", Data: renderTextPDF("Weekly nutrition report", lines)})
+	if err != nil {
+		requestLogger(c).Error("weekly report email failed", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sent": true, "email": addr.Address, "week_start": report.WeekStart})
+}
+
+// UserNutritionTargets are a caller's saved daily goals. Searches and meal
+// plans score recipes against what is left of them today; see
+// NutritionBudget. Macro bounds are grams per day and each is optional.
+type UserNutritionTargets struct {
+	Calories   int      `json:"calories" binding:"required"`
+	MinProtein *float64 `json:"min_protein"`
+	MaxProtein *float64 `json:"max_protein"`
+	MinCarbs   *float64 `json:"min_carbs"`
+	MaxCarbs   *float64 `json:"max_carbs"`
+	MinFat     *float64 `json:"min_fat"`
+	MaxFat     *float64 `json:"max_fat"`
+	MaxSodium  *float64 `json:"max_sodium"`
+	// TimeZone decides when today starts; it defaults to UTC.
+	TimeZone  string    `json:"time_zone"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const nutritionTargetColumns = "calories, min_protein, max_protein, min_carbs, max_carbs, min_fat, max_fat, max_sodium, time_zone, updated_at"
+
+// validate checks a targets update and fills in the time zone.
+func (t *UserNutritionTargets) validate() []string {
+	problems := []string{}
+	if t.Calories < 500 || t.Calories > 10000 {
+		problems = append(problems, "calories must be between 500 and 10000")
+	}
+	for _, bound := range []struct {
+		name     string
+		min, max *float64
+	}{{"protein", t.MinProtein, t.MaxProtein}, {"carbs", t.MinCarbs, t.MaxCarbs}, {"fat", t.MinFat, t.MaxFat}, {"sodium", nil, t.MaxSodium}} {
+		if bound.min != nil && *bound.min < 0 {
+			problems = append(problems, "min_"+bound.name+" must not be negative")
+		}
+		if bound.max != nil && *bound.max <= 0 {
+			problems = append(problems, "max_"+bound.name+" must be positive")
+		}
+		if bound.min != nil && bound.max != nil && *bound.min > *bound.max {
+			problems = append(problems, fmt.Sprintf("min_%s must not exceed max_%s", bound.name, bound.name))
+		}
+	}
+	if t.TimeZone == "" {
+		t.TimeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(t.TimeZone); err != nil {
+		problems = append(problems, "time_zone must be an IANA zone such as Europe/London")
+	}
+	return problems
+}
+
+// loadNutritionTargets returns the owner's targets, or nil when none are set.
+func loadNutritionTargets(owner string) (*UserNutritionTargets, error) {
+	var targets UserNutritionTargets
+	err := db.QueryRow("SELECT "+nutritionTargetColumns+" FROM nutrition_targets WHERE owner = ?", owner).Scan(
+		&targets.Calories, &targets.MinProtein, &targets.MaxProtein, &targets.MinCarbs, &targets.MaxCarbs,
+		&targets.MinFat, &targets.MaxFat, &targets.MaxSodium, &targets.TimeZone, &targets.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &targets, nil
+}
+
+// NutritionBudget is what a caller has eaten today against their targets.
+// Planned meals don't count until they are logged as eaten.
+type NutritionBudget struct {
+	Date    string               `json:"date"`
+	Targets UserNutritionTargets `json:"targets"`
+	Eaten   MealPlanTotals       `json:"eaten"`
+}
+
+// todayBudget totals the owner's meals logged today in their time zone.
+func todayBudget(owner string, targets UserNutritionTargets) (NutritionBudget, error) {
+	loc, err := time.LoadLocation(targets.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	budget := NutritionBudget{Date: today.Format(time.DateOnly), Targets: targets}
+	days, err := mealLogTotals(owner, today, today.AddDate(0, 0, 1), loc, false)
+	if err != nil {
+		return budget, err
+	}
+	if day, ok := days[budget.Date]; ok {
+		budget.Eaten, _ = averageTotals([]*DailyNutrition{day})
+	}
+	return budget, nil
+}
+
+// nutritionBudgetFor is the caller's budget for annotating results, or nil
+// when they have no API key or no targets. A failed lookup only costs the
+// fit scores.
+func nutritionBudgetFor(c *gin.Context) *NutritionBudget {
+	if c.GetHeader("X-API-Key") == "" {
+		return nil
+	}
+	owner := apiKeyID(c)
+	targets, err := loadNutritionTargets(owner)
+	if err == nil && targets != nil {
+		budget, err := todayBudget(owner, *targets)
+		if err == nil {
+			return &budget
+		}
+	}
+	if err != nil {
+		requestLogger(c).Warn("nutrition budget lookup failed", "error", err)
+	}
+	return nil
+}
+
+// fitScore rates from 0 to 100 how well a serving of recipe fits what is
+// left of today. Each limit scores 1 while the recipe stays within what
+// remains of it, falling to 0 as it overshoots by a quarter of the daily
+// limit. Each minimum scores how much of the remaining need the recipe
+// covers, measured against its share of the remaining calories. The score
+// is their average, or nil for recipes without calories.
+func (b NutritionBudget) fitScore(recipe Recipe) *int {
+	if recipe.Calories == nil {
+		return nil
+	}
+	within := func(value, eaten, limit float64) float64 {
+		over := value - max(0, limit-eaten)
+		if over <= 0 {
+			return 1
+		}
+		return max(0, 1-over/(limit/4))
+	}
+	t := b.Targets
+	calories := float64(*recipe.Calories)
+	remaining := float64(t.Calories - b.Eaten.Calories)
+	parts := []float64{within(calories, float64(b.Eaten.Calories), float64(t.Calories))}
+	for _, nutrient := range []struct {
+		value    *float64
+		eaten    float64
+		min, max *float64
+	}{
+		{recipe.Protein, b.Eaten.Protein, t.MinProtein, t.MaxProtein},
+		{recipe.Carbs, b.Eaten.Carbs, t.MinCarbs, t.MaxCarbs},
+		{recipe.Fat, b.Eaten.Fat, t.MinFat, t.MaxFat},
+		{recipe.Sodium, b.Eaten.Sodium, nil, t.MaxSodium},
+	} {
+		if nutrient.value == nil {
+			continue
+		}
+		if nutrient.max != nil {
+			parts = append(parts, within(*nutrient.value, nutrient.eaten, *nutrient.max))
+		}
+		if nutrient.min != nil {
+			need := *nutrient.min - nutrient.eaten
+			share := 1.0
+			if remaining > calories {
+				share = calories / remaining
+			}
+			if need*share <= 0 {
+				parts = append(parts, 1)
+			} else {
+				parts = append(parts, min(1, *nutrient.value/(need*share)))
+			}
+		}
+	}
+	sum := 0.0
+	for _, part := range parts {
+		sum += part
+	}
+	score := int(math.Round(sum / float64(len(parts)) * 100))
+	return &score
+}
+
+// annotateFitScores sets each recipe's fit score against the budget.
+func annotateFitScores(recipes []Recipe, budget NutritionBudget) {
+	for i := range recipes {
+		recipes[i].FitScore = budget.fitScore(recipes[i])
+	}
+}
+
+// getNutritionTargets returns the caller's targets and today's budget.
+func getNutritionTargets(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	targets, err := loadNutritionTargets(owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if targets == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Nutrition targets not found"})
+		return
+	}
+	budget, err := todayBudget(owner, *targets)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, budget)
+}
+
+// putNutritionTargets sets the caller's targets, replacing any before.
+func putNutritionTargets(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	var req UserNutritionTargets
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if problems := req.validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid nutrition targets", "problems": problems})
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO nutrition_targets (owner, calories, min_protein, max_protein, min_carbs, max_carbs, min_fat, max_fat, max_sodium, time_zone)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE calories = VALUES(calories), min_protein = VALUES(min_protein), max_protein = VALUES(max_protein),
+			min_carbs = VALUES(min_carbs), max_carbs = VALUES(max_carbs), min_fat = VALUES(min_fat), max_fat = VALUES(max_fat),
+			max_sodium = VALUES(max_sodium), time_zone = VALUES(time_zone)`,
+		owner, req.Calories, req.MinProtein, req.MaxProtein, req.MinCarbs, req.MaxCarbs, req.MinFat, req.MaxFat, req.MaxSodium, req.TimeZone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	getNutritionTargets(c)
+}
+
+func deleteNutritionTargets(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	res, err := db.Exec("DELETE FROM nutrition_targets WHERE owner = ?", owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Nutrition targets not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+// DiaryEntry is one meal in a caller's food diary. Nutrition is the
+// recipe's per-serving values scaled to Servings.
+type DiaryEntry struct {
+	ID         int64          `json:"id"`
+	RecipeID   int            `json:"recipe_id"`
+	RecipeName string         `json:"recipe_name"`
+	Servings   float64        `json:"servings"`
+	EatenAt    time.Time      `json:"eaten_at"`
+	Planned    bool           `json:"planned"`
+	Nutrition  MealPlanTotals `json:"nutrition"`
+}
+
+// DiaryEntryRequest logs a meal. EatenAt is RFC 3339 and defaults to now;
+// Planned marks a meal that is scheduled rather than eaten.
+type DiaryEntryRequest struct {
+	RecipeID int        `json:"recipe_id" binding:"required"`
+	Servings float64    `json:"servings"`
+	EatenAt  *time.Time `json:"eaten_at"`
+	Planned  bool       `json:"planned"`
+}
+
+const (
+	maxDiaryServings = 20
+	maxDiaryDays     = 92
+)
+
+// validate fills defaults and checks the recipe is published.
+func (req *DiaryEntryRequest) validate(tenant *Tenant) (int, error) {
+	if req.Servings == 0 {
+		req.Servings = 1
+	}
+	if req.Servings < 0 || req.Servings > maxDiaryServings {
+		return http.StatusBadRequest, fmt.Errorf("servings must be between 0 and %d", maxDiaryServings)
+	}
+	if req.EatenAt == nil {
+		now := time.Now()
+		req.EatenAt = &now
+	}
+	exists, err := recipeVisible(tenant, req.RecipeID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !exists {
+		return http.StatusNotFound, errors.New("Recipe not found")
+	}
+	return 0, nil
+}
+
+// requestLocation reads the tz query parameter, defaulting to UTC.
+func requestLocation(c *gin.Context) (*time.Location, bool) {
+	tz := c.Query("tz")
+	if tz == "" {
+		return time.UTC, true
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tz"})
+		return nil, false
+	}
+	return loc, true
+}
+
+// diaryRange reads from and to (inclusive dates in tz), defaulting to
+// today, and returns the half-open interval of instants they cover.
+func diaryRange(c *gin.Context) (time.Time, time.Time, *time.Location, bool) {
+	loc, ok := requestLocation(c)
+	if !ok {
+		return time.Time{}, time.Time{}, nil, false
+	}
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from, to := today, today
+	for _, param := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if raw := c.Query(param.name); raw != "" {
+			date, err := time.ParseInLocation(time.DateOnly, raw, loc)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param.name + " must be a date like 2024-01-15"})
+				return time.Time{}, time.Time{}, nil, false
+			}
+			*param.dst = date
+		}
+	}
+	if c.Query("to") == "" && c.Query("from") != "" {
+		to = from
+	}
+	end := to.AddDate(0, 0, 1)
+	if !end.After(from) || end.Sub(from) > maxDiaryDays*24*time.Hour+time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("from must not be after to, and the range at most %d days", maxDiaryDays)})
+		return time.Time{}, time.Time{}, nil, false
+	}
+	return from, end, loc, true
+}
+
+// queryDiary loads the caller's entries between from and to, oldest first.
+func queryDiary(owner string, from, to time.Time) ([]DiaryEntry, error) {
+	rows, err := db.Query(`SELECT m.id, m.recipe_id, r.name, m.servings, m.eaten_at, m.planned, r.calories, r.protein, r.fat, r.carbs, r.fiber, r.sodium, r.cost_per_serving
+		FROM meal_log m JOIN recipes r ON r.id = m.recipe_id
+		WHERE m.owner = ? AND m.eaten_at >= ? AND m.eaten_at < ?
+		ORDER BY m.eaten_at, m.id`, owner, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []DiaryEntry{}
+	for rows.Next() {
+		var entry DiaryEntry
+		var recipe Recipe
+		if err := rows.Scan(&entry.ID, &entry.RecipeID, &entry.RecipeName, &entry.Servings, &entry.EatenAt, &entry.Planned,
+			&recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium, &recipe.CostPerServing); err != nil {
+			return nil, err
+		}
+		addToTotals(&entry.Nutrition, recipe, entry.Servings)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func listDiary(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	from, to, loc, ok := diaryRange(c)
+	if !ok {
+		return
+	}
+
+	entries, err := queryDiary(owner, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range entries {
+		entries[i].EatenAt = entries[i].EatenAt.In(loc)
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "count": len(entries)})
+}
+
+func createDiaryEntry(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	var req DiaryEntryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if status, err := req.validate(tenantFromContext(c)); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := db.Exec("INSERT INTO meal_log (owner, recipe_id, servings, eaten_at, planned) VALUES (?, ?, ?, ?, ?)",
+		owner, req.RecipeID, req.Servings, req.EatenAt.UTC(), req.Planned)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, _ := res.LastInsertId()
+	c.JSON(http.StatusCreated, gin.H{"id": id, "recipe_id": req.RecipeID, "servings": req.Servings, "eaten_at": req.EatenAt, "planned": req.Planned})
+}
+
+// updateDiaryEntry replaces an entry, for correcting servings or time or
+// marking a planned meal as eaten.
+func updateDiaryEntry(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid diary entry ID"})
+		return
+	}
+	var req DiaryEntryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if status, err := req.validate(tenantFromContext(c)); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM meal_log WHERE id = ? AND owner = ?)", id, owner).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Diary entry not found"})
+		return
+	}
+	_, err = db.Exec("UPDATE meal_log SET recipe_id = ?, servings = ?, eaten_at = ?, planned = ? WHERE id = ? AND owner = ?",
+		req.RecipeID, req.Servings, req.EatenAt.UTC(), req.Planned, id, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "recipe_id": req.RecipeID, "servings": req.Servings, "eaten_at": req.EatenAt, "planned": req.Planned})
+}
+
+func deleteDiaryEntry(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid diary entry ID"})
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM meal_log WHERE id = ? AND owner = ?", id, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Diary entry not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+// getDiarySummary totals the diary per day over from..to in tz. Planned
+// meals count unless include_planned=false.
+func getDiarySummary(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	from, to, loc, ok := diaryRange(c)
+	if !ok {
+		return
+	}
+
+	totals, err := mealLogTotals(owner, from, to, loc, c.Query("include_planned") != "false")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	days := []DailyNutrition{}
+	for date := from; date.Before(to); date = date.AddDate(0, 0, 1) {
+		key := date.Format(time.DateOnly)
+		day, ok := totals[key]
+		if !ok {
+			day = &DailyNutrition{Date: key}
+		}
+		day.MacroSplit = macroSplit(day.Totals)
+		days = append(days, *day)
+	}
+	c.JSON(http.StatusOK, gin.H{"days": days, "time_zone": loc.String()})
+}
+
+// diaryMealName names the meal an entry belongs to by its local time, the
+// way both trackers group a day.
+func diaryMealName(at time.Time) string {
+	minutes := at.Hour()*60 + at.Minute()
+	switch {
+	case minutes >= 4*60 && minutes < 10*60+30:
+		return "Breakfast"
+	case minutes >= 11*60 && minutes < 15*60:
+		return "Lunch"
+	case minutes >= 17*60 && minutes < 22*60:
+		return "Dinner"
+	}
+	return "Snacks"
+}
+
+// diaryExportFormats maps each ?format= to its CSV header and row layout,
+// following the column names each app's importer expects.
+var diaryExportFormats = map[string]struct {
+	Header []string
+	Row    func(entry DiaryEntry) []string
+}{
+	"mfp": {
+		Header: []string{"Date", "Meal", "Food", "Servings", "Calories", "Fat (g)", "Sodium (mg)", "Carbohydrates (g)", "Fiber", "Protein (g)", "Note"},
+		Row: func(entry DiaryEntry) []string {
+			n := entry.Nutrition
+			return []string{
+				entry.EatenAt.Format(time.DateOnly), diaryMealName(entry.EatenAt), entry.RecipeName, formatAmount(entry.Servings),
+				strconv.Itoa(n.Calories), formatAmount(n.Fat), formatAmount(n.Sodium), formatAmount(n.Carbs), formatAmount(n.Fiber), formatAmount(n.Protein),
+				fmt.Sprintf("emeal recipe %d", entry.RecipeID),
+			}
+		},
+	},
+	"cronometer": {
+		Header: []string{"Day", "Time", "Group", "Food Name", "Amount", "Energy (kcal)", "Protein (g)", "Carbs (g)", "Fat (g)", "Fiber (g)", "Sodium (mg)"},
+		Row: func(entry DiaryEntry) []string {
+			n := entry.Nutrition
+			return []string{
+				entry.EatenAt.Format(time.DateOnly), entry.EatenAt.Format("15:04"), diaryMealName(entry.EatenAt), entry.RecipeName,
+				formatAmount(entry.Servings) + " serving",
+				strconv.Itoa(n.Calories), formatAmount(n.Protein), formatAmount(n.Carbs), formatAmount(n.Fat), formatAmount(n.Fiber), formatAmount(n.Sodium),
+			}
+		},
+	},
+}
+
+// formatAmount prints a quantity with at most one decimal.
+func formatAmount(value float64) string {
+	return strconv.FormatFloat(math.Round(value*10)/10, 'f', -1, 64)
+}
+
+// exportDiary downloads the diary over from..to as a CSV for MyFitnessPal
+// (format=mfp) or Cronometer (format=cronometer), in tz local time.
+// Planned meals are left out unless include_planned=true.
+func exportDiary(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	format, ok := diaryExportFormats[c.Query("format")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be mfp or cronometer"})
+		return
+	}
+	from, to, loc, ok := diaryRange(c)
+	if !ok {
+		return
+	}
+
+	entries, err := queryDiary(owner, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	w.Write(format.Header)
+	for _, entry := range entries {
+		if entry.Planned && c.Query("include_planned") != "true" {
+			continue
+		}
+		entry.EatenAt = entry.EatenAt.In(loc)
+		w.Write(format.Row(entry))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := fmt.Sprintf("diary-%s-%s-%s.csv", c.Query("format"), from.Format(time.DateOnly), to.AddDate(0, 0, -1).Format(time.DateOnly))
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", out.Bytes())
+}
+
+const (
+	pdfPageWidth  = 595 // A4 in points
+	pdfPageHeight = 842
+	pdfMargin     = 50
+	pdfFontSize   = 10
+	pdfLeading    = 14
+)
+
+// pdfEscape makes text safe inside a PDF string literal. The standard
+// fonts use WinAnsiEncoding, so Latin-1 passes through and anything else
+// becomes "?".
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r < 32:
+		case r < 256:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// renderTextPDF lays out a title and lines of monospaced text on A4 pages
+// using the built-in PDF fonts, which is all reports need and keeps font
+// files out of the binary.
+func renderTextPDF(title string, lines []string) []byte {
+	perPage := (pdfPageHeight - 2*pdfMargin - 2*pdfLeading) / pdfLeading
+	pages := [][]string{}
+	for len(lines) > perPage {
+		pages = append(pages, lines[:perPage])
+		lines = lines[perPage:]
+	}
+	pages = append(pages, lines)
+
+	var out bytes.Buffer
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		var content strings.Builder
+		y := pdfPageHeight - pdfMargin
+		content.WriteString("BT\n")
+		fmt.Fprintf(&content, "/F1 14 Tf %d %d Td (%s) Tj\n", pdfMargin, y, pdfEscape(title))
+		fmt.Fprintf(&content, "/F2 %d Tf %d TL 0 %d Td\n", pdfFontSize, pdfLeading, -2*pdfLeading)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+		}
+		fmt.Fprintf(&content, "ET\nBT /F2 8 Tf %d %d Td (Page %d of %d) Tj ET\n", pdfMargin, pdfMargin/2, i+1, len(pages))
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+var (
+	caloriesPattern = regexp.MustCompile(`(\d{3,4})\s*(kcal|calories|cal)`)
+	minutesPattern  = regexp.MustCompile(`(\d{1,3})[- ]?(minute|min)`)
+	daysPattern     = regexp.MustCompile(`(\d{1,2})[- ]?days?`)
+)
+
+// keywordMealPlanRequest is the LLM-free fallback for parsing a meal plan
+// request, covering the diet, calories, time and day count.
+func keywordMealPlanRequest(message string) MealPlanRequest {
+	lower := strings.ToLower(message)
+	req := MealPlanRequest{}
+
+	params, _ := url.ParseQuery(strings.TrimPrefix(keywordSearchURL(message), "?"))
+	req.Diet = params.Get("diet")
+
+	if m := caloriesPattern.FindStringSubmatch(lower); m != nil {
+		req.CaloriesPerDay, _ = strconv.Atoi(m[1])
+	}
+	if m := minutesPattern.FindStringSubmatch(lower); m != nil {
+		minutes, _ := strconv.Atoi(m[1])
+		if strings.Contains(lower, "dinner") {
+			req.MaxDinnerTime = minutes
+		} else {
+			req.MaxTime = minutes
+		}
+	}
+	if m := daysPattern.FindStringSubmatch(lower); m != nil {
+		req.Days, _ = strconv.Atoi(m[1])
+	}
+	return req
+}
+
+func generateMealPlan(c *gin.Context) {
+	var chatReq ChatRequest
+	if err := c.ShouldBindJSON(&chatReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	systemPrompt := `You convert meal planning requests into JSON constraints for a meal planner.
+
+Respond ONLY with a JSON object using these fields (omit unknown ones):
+{"days": int, "calories_per_day": int, "meals_per_day": 2|3|4, "diet": string, "include_ingredients": [string],
+ "exclude_ingredients": [string], "max_time": int, "max_dinner_time": int, "max_cost_per_serving": number,
+ "macro_split": "protein/carbs/fat percentages, e.g. 30/40/30"}
+
+diet must be one of: ` + strings.Join(sortedKeys(tenantFromContext(c).dietPlans()), ", ") + `.
+"Plan my week" means 7 days. Times are in minutes.
+
+Example: "Plan my week: 1800 kcal/day, vegetarian, no mushrooms, 30-minute dinners" ->
+{"days": 7, "calories_per_day": 1800, "diet": "vegetarian", "exclude_ingredients": ["mushroom"], "max_dinner_time": 30}`
+
+	var req MealPlanRequest
+	degraded := !featureEnabled(c, "llm_meal_plans") || llmBudgetExceeded(c)
+	if !degraded {
+		result, err := callLLM(c.Request.Context(), []map[string]interface{}{
+			{"role": "system", "content": systemPrompt},
+			{"role": "user", "content": chatReq.Message},
+		})
+		recordLLMUsage(c, "meal-plans/generate", result)
+		if err != nil || json.Unmarshal([]byte(extractJSONObject(result.Content)), &req) != nil {
+			degraded = true
+		}
+	}
+	if degraded {
+		req = keywordMealPlanRequest(chatReq.Message)
+	}
+	req.tenant = tenantFromContext(c)
+	if _, exists := req.tenant.dietPlans()[req.Diet]; !exists {
+		req.Diet = ""
+	}
+	// Repeat suppression comes from the caller, never from the model.
+	excludeIDs, err := parseIDList(c.Query("exclude_ids"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.ExcludeIDs, req.ExcludeHidden = excludeIDs, false
+	if c.Query("exclude_hidden") == "true" {
+		owner, ok := apiKeyOwner(c)
+		if !ok {
+			return
+		}
+		req.ExcludeHidden, req.hiddenFor = true, owner
+	}
+
+	plan, err := buildMealPlan(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	plan.scoreFit(c)
+
+	if c.Query("format") == "markdown" {
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(mealPlanMarkdown(plan)))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"parsed_query": chatReq.Message,
+		"degraded":     degraded,
+		"plan":         plan,
+	})
+}
+
+type RecipePortion struct {
+	ID       int     `json:"id"`
+	Servings float64 `json:"servings"`
+}
+
+type ParsedIngredient struct {
+	Quantity float64 `json:"quantity,omitempty"`
+	Unit     string  `json:"unit,omitempty"`
+	Name     string  `json:"name"`
+	Raw      string  `json:"raw"`
+}
+
+var unicodeFractions = map[rune]float64{
+	'¼': 0.25, '½': 0.5, '¾': 0.75, '⅓': 1.0 / 3, '⅔': 2.0 / 3, '⅛': 0.125,
+}
+
+// ingredientUnits maps spellings found in recipe text to a canonical unit.
+var ingredientUnits = map[string]string{
+	"cup": "cup", "cups": "cup", "c": "cup",
+	"tablespoon": "tbsp", "tablespoons": "tbsp", "tbsp": "tbsp", "tbs": "tbsp", "tbsps": "tbsp",
+	"teaspoon": "tsp", "teaspoons": "tsp", "tsp": "tsp", "tsps": "tsp",
+	"gram": "g", "grams": "g", "g": "g", "kilogram": "kg", "kilograms": "kg", "kg": "kg",
+	"ounce": "oz", "ounces": "oz", "oz": "oz", "pound": "lb", "pounds": "lb", "lb": "lb", "lbs": "lb",
+	"milliliter": "ml", "milliliters": "ml", "ml": "ml", "liter": "l", "liters": "l", "l": "l",
+	"clove": "clove", "cloves": "clove", "can": "can", "cans": "can", "pinch": "pinch",
+	"slice": "slice", "slices": "slice", "bunch": "bunch", "package": "package", "packages": "package",
+}
+
+func parseQuantity(token string) (float64, bool) {
+	if token == "" {
+		return 0, false
+	}
+	runes := []rune(token)
+	if frac, ok := unicodeFractions[runes[len(runes)-1]]; ok {
+		whole := 0.0
+		if len(runes) > 1 {
+			var ok bool
+			if whole, ok = parseQuantity(string(runes[:len(runes)-1])); !ok {
+				return 0, false
+			}
+		}
+		return whole + frac, true
+	}
+	if num, den, ok := strings.Cut(token, "/"); ok {
+		n, err1 := strconv.ParseFloat(num, 64)
+		d, err2 := strconv.ParseFloat(den, 64)
+		if err1 != nil || err2 != nil || d == 0 {
+			return 0, false
+		}
+		return n / d, true
+	}
+	if low, _, ok := strings.Cut(token, "-"); ok {
+		return parseQuantity(low)
+	}
+	val, err := strconv.ParseFloat(token, 64)
+	return val, err == nil
+}
+
+// parseIngredientLine splits free-text like "1 1/2 cups onion, diced" into
+// quantity, unit and a normalized name. Unparseable parts are left at zero.
+func parseIngredientLine(line string) ParsedIngredient {
+	parsed := ParsedIngredient{Raw: line}
+	fields := strings.Fields(strings.ToLower(line))
+
+	for len(fields) > 0 {
+		qty, ok := parseQuantity(fields[0])
+		if !ok {
+			break
+		}
+		parsed.Quantity += qty
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && parsed.Quantity > 0 {
+		if unit, ok := ingredientUnits[strings.TrimSuffix(fields[0], ".")]; ok {
+			parsed.Unit = unit
+			fields = fields[1:]
+			if len(fields) > 0 && fields[0] == "of" {
+				fields = fields[1:]
+			}
+		}
+	}
+
+	name := strings.Join(fields, " ")
+	if i := strings.Index(name, "("); i >= 0 {
+		if j := strings.Index(name[i:], ")"); j >= 0 {
+			name = name[:i] + name[i+j+1:]
+		}
+	}
+	if i := strings.Index(name, ","); i >= 0 {
+		name = name[:i]
+	}
+	parsed.Name = strings.Join(strings.Fields(name), " ")
+	return parsed
+}
+
+// fetchRecipesByIDs loads the given recipes keyed by ID; missing IDs are
+// simply absent from the map.
+func fetchRecipesByIDs(tenant *Tenant, ids []int) (map[int]Recipe, error) {
+	found := map[int]Recipe{}
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	recipes, err := selectRecipes().Visible(tenant).Where("id IN ("+strings.Join(placeholders, ",")+")", args...).All()
+	if err != nil {
+		return nil, err
+	}
+	for _, recipe := range recipes {
+		found[recipe.ID] = recipe
+	}
+	return found, nil
+}
+
+// loadPortions resolves portions to recipes, defaulting servings to the
+// recipe's own yield and reporting IDs that don't exist.
+func loadPortions(tenant *Tenant, portions []RecipePortion) ([]RecipePortion, map[int]Recipe, []int, error) {
+	ids := make([]int, len(portions))
+	for i, portion := range portions {
+		ids[i] = portion.ID
+	}
+	recipes, err := fetchRecipesByIDs(tenant, ids)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	resolved := []RecipePortion{}
+	missing := []int{}
+	for _, portion := range portions {
+		recipe, ok := recipes[portion.ID]
+		if !ok {
+			missing = append(missing, portion.ID)
+			continue
+		}
+		if portion.Servings <= 0 {
+			portion.Servings = 1
+			if recipe.Servings != nil && *recipe.Servings > 0 {
+				portion.Servings = float64(*recipe.Servings)
+			}
+		}
+		resolved = append(resolved, portion)
+	}
+	return resolved, recipes, missing, nil
+}
+
+type ShoppingListItem struct {
+	Name     string   `json:"name"`
+	Quantity float64  `json:"quantity,omitempty"`
+	Unit     string   `json:"unit,omitempty"`
+	Aisle    string   `json:"aisle"`
+	Recipes  []int    `json:"recipes"`
+	Notes    []string `json:"notes,omitempty"`
+}
+
+type ShoppingList struct {
+	Items   []ShoppingListItem `json:"items"`
+	Missing []int              `json:"missing_recipes,omitempty"`
+}
+
+// buildShoppingList scales each recipe to the requested servings and merges
+// ingredients with the same name and unit. Lines without a quantity are kept
+// as notes on the merged item.
+func buildShoppingList(tenant *Tenant, portions []RecipePortion) (ShoppingList, error) {
+	resolved, recipes, missing, err := loadPortions(tenant, portions)
+	if err != nil {
+		return ShoppingList{}, err
+	}
+	list := mergeShoppingList(resolved, recipes)
+	list.Missing = missing
+	return list, nil
+}
+
+// mergeShoppingList is the merge behind buildShoppingList, for portions
+// already resolved to recipes. Quantities are rounded to two places once
+// summed.
+func mergeShoppingList(resolved []RecipePortion, recipes map[int]Recipe) ShoppingList {
+	list := ShoppingList{Items: []ShoppingListItem{}}
+	index := map[string]int{}
+	for _, portion := range resolved {
+		recipe := recipes[portion.ID]
+		scale := portion.Servings
+		if recipe.Servings != nil && *recipe.Servings > 0 {
+			scale = portion.Servings / float64(*recipe.Servings)
+		}
+
+		for _, line := range recipe.Ingredients {
+			parsed := parseIngredientLine(line)
+			if parsed.Name == "" {
+				continue
+			}
+			key := parsed.Name + "|" + parsed.Unit
+			i, ok := index[key]
+			if !ok {
+				i = len(list.Items)
+				index[key] = i
+				list.Items = append(list.Items, ShoppingListItem{Name: parsed.Name, Unit: parsed.Unit, Aisle: ingredientAisle(parsed.Name), Recipes: []int{}})
+			}
+			item := &list.Items[i]
+			if parsed.Quantity > 0 {
+				item.Quantity = math.Round((item.Quantity+parsed.Quantity*scale)*100) / 100
+			} else {
+				item.Notes = append(item.Notes, line)
+			}
+			if len(item.Recipes) == 0 || item.Recipes[len(item.Recipes)-1] != recipe.ID {
+				item.Recipes = append(item.Recipes, recipe.ID)
+			}
+		}
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	return list
+}
+
+// shoppingAisles assigns ingredients to store sections, checked in order so
+// "chicken stock" lands in pantry before "chicken" reaches meat. Anything
+// unmatched goes to "other".
+var shoppingAisles = []struct {
+	Aisle   string
+	Pattern *regexp.Regexp
+}{
+	{"frozen", regexp.MustCompile(`\bfrozen\b`)},
+	{"pantry", regexp.MustCompile(`\b(stock|broth|bouillon|canned|tinned|flour|sugar|rice|pasta|noodles|spaghetti|oats|lentils|beans|chickpeas|oil|vinegar|soy sauce|honey|syrup|baking (soda|powder)|yeast|cornstarch|breadcrumbs|nuts?|almonds|walnuts|peanut butter|tomato paste|coconut milk|quinoa|couscous|chocolate|cocoa|vanilla)\b`)},
+	{"spices", regexp.MustCompile(`\b(salt|(black|white|ground) pepper|peppercorns|^pepper$|cumin|paprika|turmeric|cinnamon|oregano|thyme|rosemary|chil(i|e) (powder|flakes)|curry powder|garam masala|nutmeg|cloves|bay lea(f|ves)|cayenne|coriander seeds?|spice)\b`)},
+	{"meat & seafood", regexp.MustCompile(`\b(chicken|beef|pork|lamb|turkey|bacon|sausages?|ham|mince|steak|fish|salmon|tuna|cod|shrimp|prawns?|scallops?|mussels|crab)\b`)},
+	{"dairy & eggs", regexp.MustCompile(`\b(milk|butter|cream|cheese|yogh?urt|eggs?|parmesan|mozzarella|cheddar|feta|ricotta)\b`)},
+	{"bakery", regexp.MustCompile(`\b(bread|baguette|buns?|rolls?|tortillas?|pita|naan|croissants?)\b`)},
+	{"produce", regexp.MustCompile(`\b(onions?|garlic|shallots?|tomato(es)?|potato(es)?|carrots?|celery|peppers?|lettuce|spinach|kale|cabbage|broccoli|cauliflower|zucchini|eggplant|cucumber|mushrooms?|ginger|lemons?|limes?|oranges?|apples?|bananas?|berries|avocados?|herbs?|parsley|cilantro|basil|mint|scallions?|leeks?|squash|corn|peas|beans? sprouts|chil(i|e)s?|jalape[nñ]os?)\b`)},
+}
+
+// shoppingAisleOrder is the walk through a typical store.
+var shoppingAisleOrder = []string{"produce", "bakery", "meat & seafood", "dairy & eggs", "pantry", "spices", "frozen", "other"}
+
+func ingredientAisle(name string) string {
+	for _, aisle := range shoppingAisles {
+		if aisle.Pattern.MatchString(name) {
+			return aisle.Aisle
+		}
+	}
+	return "other"
+}
+
+// shoppingItemText renders an item as one line, e.g. "1.5 cup flour".
+func shoppingItemText(item ShoppingListItem) string {
+	text := item.Name
+	if item.Quantity > 0 {
+		amount := formatAmount(item.Quantity)
+		if item.Unit != "" {
+			amount += " " + item.Unit
+		}
+		text = amount + " " + text
+	}
+	return text
+}
+
+// shoppingListByAisle groups items in store order, skipping empty aisles.
+func shoppingListByAisle(list ShoppingList) [][]ShoppingListItem {
+	groups := [][]ShoppingListItem{}
+	for _, aisle := range shoppingAisleOrder {
+		group := []ShoppingListItem{}
+		for _, item := range list.Items {
+			if item.Aisle == aisle {
+				group = append(group, item)
+			}
+		}
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// shoppingListText renders the list grouped by aisle. markdown writes
+// headings and task-list checkboxes; otherwise it is plain text.
+func shoppingListText(list ShoppingList, markdown bool) string {
+	var b strings.Builder
+	if markdown {
+		b.WriteString("# Shopping list\n")
+	}
+	for _, group := range shoppingListByAisle(list) {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		if markdown {
+			fmt.Fprintf(&b, "## %s\n\n", strings.ToUpper(group[0].Aisle[:1])+group[0].Aisle[1:])
+		} else {
+			fmt.Fprintf(&b, "%s\n", strings.ToUpper(group[0].Aisle))
+		}
+		for _, item := range group {
+			if markdown {
+				fmt.Fprintf(&b, "- [ ] %s\n", shoppingItemText(item))
+			} else {
+				fmt.Fprintf(&b, "- %s\n", shoppingItemText(item))
+			}
+		}
+	}
+	return b.String()
+}
+
+// shoppingListAnyList renders one item per line in aisle order, the format
+// AnyList's "paste items" import splits into separate entries.
+func shoppingListAnyList(list ShoppingList) string {
+	var b strings.Builder
+	for _, group := range shoppingListByAisle(list) {
+		for _, item := range group {
+			b.WriteString(shoppingItemText(item) + "\n")
+		}
+	}
+	return b.String()
+}
+
+const todoistAPIBase = "https://api.todoist.com/api/v1"
+
+var todoistHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// todoistPost creates a Todoist object with the caller's token and returns
+// its ID.
+func todoistPost(ctx context.Context, token, path string, body map[string]interface{}) (string, error) {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, todoistAPIBase+path, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := todoistHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return "", fmt.Errorf("todoist returned status %d for %s", resp.StatusCode, path)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// exportToTodoist creates a project with a section per aisle and a task per
+// item, returning the project ID.
+func exportToTodoist(ctx context.Context, token, name string, list ShoppingList) (string, error) {
+	projectID, err := todoistPost(ctx, token, "/projects", map[string]interface{}{"name": name})
+	if err != nil {
+		return "", err
+	}
+	for _, group := range shoppingListByAisle(list) {
+		sectionID, err := todoistPost(ctx, token, "/sections", map[string]interface{}{"project_id": projectID, "name": group[0].Aisle})
+		if err != nil {
+			return projectID, err
+		}
+		for _, item := range group {
+			task := map[string]interface{}{"content": shoppingItemText(item), "project_id": projectID, "section_id": sectionID}
+			if len(item.Notes) > 0 {
+				task["description"] = strings.Join(item.Notes, "\n")
+			}
+			if _, err := todoistPost(ctx, token, "/tasks", task); err != nil {
+				return projectID, err
+			}
+		}
+	}
+	return projectID, nil
+}
+
+type NutritionSummary struct {
+	Recipes []gin.H        `json:"recipes"`
+	Totals  MealPlanTotals `json:"totals"`
+	// MacroSplit is the share of calories from protein, carbs and fat.
+	MacroSplit map[string]float64 `json:"macro_split"`
+	Missing    []int              `json:"missing_recipes,omitempty"`
+}
+
+func summarizeNutrition(tenant *Tenant, portions []RecipePortion) (NutritionSummary, error) {
+	resolved, recipes, missing, err := loadPortions(tenant, portions)
+	if err != nil {
+		return NutritionSummary{}, err
+	}
+
+	summary := NutritionSummary{Recipes: []gin.H{}, Missing: missing}
+	for _, portion := range resolved {
+		recipe := recipes[portion.ID]
+		var totals MealPlanTotals
+		addToTotals(&totals, recipe, portion.Servings)
+		addToTotals(&summary.Totals, recipe, portion.Servings)
+		summary.Recipes = append(summary.Recipes, gin.H{
+			"id":       recipe.ID,
+			"name":     recipe.Name,
+			"servings": portion.Servings,
+			"totals":   totals,
+		})
+	}
+
+	summary.MacroSplit = macroSplit(summary.Totals)
+	return summary, nil
+}
+
+// macroSplit returns the percentage of calories from protein, carbs and fat.
+func macroSplit(totals MealPlanTotals) map[string]float64 {
+	macroCalories := totals.Protein*4 + totals.Carbs*4 + totals.Fat*9
+	split := map[string]float64{"protein": 0, "carbs": 0, "fat": 0}
+	if macroCalories > 0 {
+		split["protein"] = math.Round(totals.Protein*4/macroCalories*1000) / 10
+		split["carbs"] = math.Round(totals.Carbs*4/macroCalories*1000) / 10
+		split["fat"] = math.Round(totals.Fat*9/macroCalories*1000) / 10
+	}
+	return split
+}
+
+// macroTarget is a wanted split of calories between protein, carbs and fat,
+// in percent, and how many percentage points each may stray.
+type macroTarget struct {
+	Protein   float64
+	Carbs     float64
+	Fat       float64
+	Tolerance float64
+}
+
+const defaultMacroTolerance = 5
+
+// macroPercentSQL computes a macro's share of a recipe's macro calories.
+// It is NULL when any macro is missing or they add up to nothing.
+var macroPercentSQL = map[string]string{
+	"protein": "(protein * 400 / NULLIF(protein * 4 + carbs * 4 + fat * 9, 0))",
+	"carbs":   "(carbs * 400 / NULLIF(protein * 4 + carbs * 4 + fat * 9, 0))",
+	"fat":     "(fat * 900 / NULLIF(protein * 4 + carbs * 4 + fat * 9, 0))",
+}
+
+// parseMacroTarget reads a protein/carbs/fat split such as "30/40/30",
+// which must add up to 100. An empty split means no target; a zero
+// tolerance means defaultMacroTolerance.
+func parseMacroTarget(split string, tolerance float64) (*macroTarget, error) {
+	split = strings.TrimSpace(split)
+	if split == "" {
+		return nil, nil
+	}
+	parts := strings.Split(split, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("macro_split must be protein/carbs/fat percentages, e.g. 30/40/30")
+	}
+	values := make([]float64, 3)
+	sum := 0.0
+	for i, part := range parts {
+		val, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || val < 0 || val > 100 {
+			return nil, fmt.Errorf("macro_split must be protein/carbs/fat percentages, e.g. 30/40/30")
+		}
+		values[i] = val
+		sum += val
+	}
+	if math.Abs(sum-100) > 1 {
+		return nil, fmt.Errorf("macro_split must add up to 100, got %g", sum)
+	}
+	if tolerance == 0 {
+		tolerance = defaultMacroTolerance
+	}
+	if tolerance < 0 || tolerance > 50 {
+		return nil, fmt.Errorf("tolerance must be between 0 and 50 percentage points")
+	}
+	return &macroTarget{Protein: values[0], Carbs: values[1], Fat: values[2], Tolerance: tolerance}, nil
+}
+
+// filterSQL keeps recipes whose every macro share is within tolerance.
+func (t *macroTarget) filterSQL() (string, []interface{}) {
+	return " AND ABS(" + macroPercentSQL["protein"] + " - ?) <= ?" +
+			" AND ABS(" + macroPercentSQL["carbs"] + " - ?) <= ?" +
+			" AND ABS(" + macroPercentSQL["fat"] + " - ?) <= ?",
+		[]interface{}{t.Protein, t.Tolerance, t.Carbs, t.Tolerance, t.Fat, t.Tolerance}
+}
+
+// distanceSQL orders recipes by how far their split is from the target,
+// summed over the three macros.
+func (t *macroTarget) distanceSQL() (string, []interface{}) {
+	return "ABS(" + macroPercentSQL["protein"] + " - ?) + ABS(" + macroPercentSQL["carbs"] + " - ?) + ABS(" + macroPercentSQL["fat"] + " - ?)",
+		[]interface{}{t.Protein, t.Carbs, t.Fat}
+}
+
+// distance is distanceSQL for a loaded recipe. It reports false when the
+// recipe lacks macros.
+func (t *macroTarget) distance(recipe Recipe) (float64, bool) {
+	if recipe.Protein == nil || recipe.Carbs == nil || recipe.Fat == nil {
+		return 0, false
+	}
+	split := macroSplit(MealPlanTotals{Protein: *recipe.Protein, Carbs: *recipe.Carbs, Fat: *recipe.Fat})
+	if split["protein"]+split["carbs"]+split["fat"] == 0 {
+		return 0, false
+	}
+	return math.Abs(split["protein"]-t.Protein) + math.Abs(split["carbs"]-t.Carbs) + math.Abs(split["fat"]-t.Fat), true
+}
+
+// annotateMacroSplits sets the calorie split on recipes with all macros.
+func annotateMacroSplits(recipes []Recipe) {
+	for i := range recipes {
+		recipe := &recipes[i]
+		if recipe.Protein != nil && recipe.Carbs != nil && recipe.Fat != nil {
+			recipe.MacroSplit = macroSplit(MealPlanTotals{Protein: *recipe.Protein, Carbs: *recipe.Carbs, Fat: *recipe.Fat})
+		}
+	}
+}
+
+type PortionsRequest struct {
+	Recipes []RecipePortion `json:"recipes" binding:"required"`
+}
+
+func createShoppingList(c *gin.Context) {
+	var req PortionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Recipes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	token := c.GetHeader("X-Todoist-Token")
+	switch format {
+	case "json", "text", "markdown", "anylist":
+	case "todoist":
+		if token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "X-Todoist-Token header is required for format=todoist"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, text, markdown, anylist or todoist"})
+		return
+	}
+
+	list, err := buildShoppingList(tenantFromContext(c), req.Recipes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch format {
+	case "text":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(shoppingListText(list, false)))
+	case "markdown":
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(shoppingListText(list, true)))
+	case "anylist":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(shoppingListAnyList(list)))
+	case "todoist":
+		// The token is the caller's own and is never stored or logged.
+		name := "Shopping list " + time.Now().Format(time.DateOnly)
+		projectID, err := exportToTodoist(c.Request.Context(), token, name, list)
+		if err != nil {
+			requestLogger(c).Warn("todoist export failed", "error", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Todoist export failed", "project_id": projectID})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"exported": true, "project_id": projectID, "items": len(list.Items)})
+	default:
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// CartItem is a shopping-list item as sent to a retailer, with the product
+// it was matched to when the retailer's API reports one. Retailers that match
+// products themselves at checkout, like Instacart, accept every item.
+type CartItem struct {
+	Name      string   `json:"name"`
+	Quantity  float64  `json:"quantity,omitempty"`
+	Unit      string   `json:"unit,omitempty"`
+	Matched   bool     `json:"matched"`
+	ProductID string   `json:"product_id,omitempty"`
+	Product   string   `json:"product,omitempty"`
+	Price     *float64 `json:"price,omitempty"`
+	URL       string   `json:"url,omitempty"`
+}
+
+// Cart is a retailer's view of a shopping list. Unmatched counts items the
+// retailer had no product for; CartURL is empty when nothing was added.
+type Cart struct {
+	Retailer  string     `json:"retailer"`
+	CartURL   string     `json:"cart_url,omitempty"`
+	Items     []CartItem `json:"items"`
+	Unmatched int        `json:"unmatched"`
+	Warnings  []string   `json:"warnings,omitempty"`
+}
+
+// cartRetailers are the supported grocery integrations. CreateCart gets the
+// caller's own retailer token, if any, for APIs that act on a user's cart.
+var cartRetailers = map[string]struct {
+	Enabled    func() bool
+	CreateCart func(ctx context.Context, list ShoppingList, userToken string) (Cart, error)
+}{
+	"instacart": {
+		Enabled:    func() bool { return cfg.Retailers.InstacartAPIKey != "" },
+		CreateCart: instacartCart,
+	},
+	"kroger": {
+		Enabled:    func() bool { return cfg.Retailers.KrogerClientID != "" && cfg.Retailers.KrogerClientSecret != "" },
+		CreateCart: krogerCart,
+	},
+}
+
+var retailerHTTPClient = &http.Client{}
+
+// retailerJSON sends a request to a retailer API and decodes a JSON reply
+// into out, when out is non-nil.
+func retailerJSON(req *http.Request, out interface{}) error {
+	ctx, cancel := context.WithTimeout(req.Context(), cfg.Retailers.Timeout)
+	defer cancel()
+	resp, err := retailerHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return fmt.Errorf("%s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(out)
+}
+
+// instacartCart creates an Instacart shopping-list page. Instacart matches
+// the free-text items to products itself when the shopper opens the link.
+func instacartCart(ctx context.Context, list ShoppingList, _ string) (Cart, error) {
+	cart := Cart{Retailer: "instacart", Items: []CartItem{}}
+	lineItems := []map[string]interface{}{}
+	for _, item := range list.Items {
+		line := map[string]interface{}{"name": item.Name}
+		if item.Quantity > 0 {
+			line["quantity"] = item.Quantity
+			if item.Unit != "" {
+				line["unit"] = item.Unit
+			}
+		}
+		lineItems = append(lineItems, line)
+		cart.Items = append(cart.Items, CartItem{Name: item.Name, Quantity: item.Quantity, Unit: item.Unit, Matched: true})
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"title":      "Shopping list " + time.Now().Format(time.DateOnly),
+		"link_type":  "shopping_list",
+		"line_items": lineItems,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Retailers.InstacartBaseURL+"/idp/v1/products/products_link", bytes.NewReader(body))
+	if err != nil {
+		return cart, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Retailers.InstacartAPIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	var created struct {
+		URL string `json:"products_link_url"`
+	}
+	if err := retailerJSON(req, &created); err != nil {
+		return cart, err
+	}
+	cart.CartURL = created.URL
+	return cart, nil
+}
+
+// krogerToken is the cached client-credentials token for product search.
+var krogerToken struct {
+	sync.Mutex
+	value   string
+	expires time.Time
+}
+
+func krogerAccessToken(ctx context.Context) (string, error) {
+	krogerToken.Lock()
+	defer krogerToken.Unlock()
+	if krogerToken.value != "" && time.Now().Before(krogerToken.expires) {
+		return krogerToken.value, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {"product.compact"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Retailers.KrogerBaseURL+"/v1/connect/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(cfg.Retailers.KrogerClientID, cfg.Retailers.KrogerClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := retailerJSON(req, &token); err != nil {
+		return "", err
+	}
+	krogerToken.value = token.AccessToken
+	// Refresh a minute early so a token never expires mid-request.
+	krogerToken.expires = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	return token.AccessToken, nil
+}
+
+// krogerProduct finds the top product for an item name.
+func krogerProduct(ctx context.Context, token, name string) (CartItem, error) {
+	item := CartItem{Name: name}
+	query := url.Values{"filter.term": {name}, "filter.limit": {"1"}}
+	if cfg.Retailers.KrogerLocationID != "" {
+		query.Set("filter.locationId", cfg.Retailers.KrogerLocationID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.Retailers.KrogerBaseURL+"/v1/products?"+query.Encode(), nil)
+	if err != nil {
+		return item, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	var found struct {
+		Data []struct {
+			ProductID   string `json:"productId"`
+			UPC         string `json:"upc"`
+			Description string `json:"description"`
+			Items       []struct {
+				Price struct {
+					Regular float64 `json:"regular"`
+				} `json:"price"`
+			} `json:"items"`
+		} `json:"data"`
+	}
+	if err := retailerJSON(req, &found); err != nil {
+		return item, err
+	}
+	if len(found.Data) == 0 {
+		return item, nil
+	}
+	product := found.Data[0]
+	item.Matched = true
+	item.ProductID = product.UPC
+	if item.ProductID == "" {
+		item.ProductID = product.ProductID
+	}
+	item.Product = product.Description
+	item.URL = "https://www.kroger.com/p/item/" + url.PathEscape(product.ProductID)
+	if len(product.Items) > 0 && product.Items[0].Price.Regular > 0 {
+		price := product.Items[0].Price.Regular
+		item.Price = &price
+	}
+	return item, nil
+}
+
+// krogerCart matches every item to a Kroger product. With the shopper's own
+// token (cart.basic:write scope) the products are also added to their
+// cart; without one the matches come back for the client to add.
+func krogerCart(ctx context.Context, list ShoppingList, userToken string) (Cart, error) {
+	cart := Cart{Retailer: "kroger", Items: make([]CartItem, len(list.Items))}
+	token, err := krogerAccessToken(ctx)
+	if err != nil {
+		return cart, err
+	}
+
+	// A few lookups at a time keeps a long list quick without tripping the
+	// API's rate limit.
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	errs := make([]error, len(list.Items))
+	for i, listItem := range list.Items {
+		wg.Add(1)
+		go func(i int, listItem ShoppingListItem) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			item, err := krogerProduct(ctx, token, listItem.Name)
+			item.Quantity, item.Unit = listItem.Quantity, listItem.Unit
+			cart.Items[i], errs[i] = item, err
+		}(i, listItem)
+	}
+	wg.Wait()
+
+	add := []map[string]interface{}{}
+	for i, item := range cart.Items {
+		if errs[i] != nil {
+			cart.Warnings = append(cart.Warnings, fmt.Sprintf("%s: product lookup failed", item.Name))
+		}
+		if !item.Matched {
+			cart.Unmatched++
+			continue
+		}
+		// Recipe quantities rarely map to package counts, so whole items
+		// are only used when the list counts pieces.
+		quantity := 1
+		if item.Unit == "" && item.Quantity > 1 {
+			quantity = int(math.Ceil(item.Quantity))
+		}
+		add = append(add, map[string]interface{}{"upc": item.ProductID, "quantity": quantity})
+	}
+	if userToken == "" || len(add) == 0 {
+		return cart, nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"items": add})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, cfg.Retailers.KrogerBaseURL+"/v1/cart/add", bytes.NewReader(body))
+	if err != nil {
+		return cart, err
+	}
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	req.Header.Set("Content-Type", "application/json")
+	if err := retailerJSON(req, nil); err != nil {
+		return cart, err
+	}
+	cart.CartURL = "https://www.kroger.com/cart"
+	return cart, nil
+}
+
+// createRetailerCart builds the shopping list for the posted recipes and
+// hands it to ?retailer=. Shoppers pass their own retailer token, where the
+// retailer needs one, in X-Retailer-Token; it is not stored.
+func createRetailerCart(c *gin.Context) {
+	name := c.Query("retailer")
+	retailer, ok := cartRetailers[name]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "retailer must be one of: " + strings.Join(sortedKeys(cartRetailers), ", ")})
+		return
+	}
+	if !retailer.Enabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": name + " is not configured"})
+		return
+	}
+	var req PortionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Recipes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	list, err := buildShoppingList(tenantFromContext(c), req.Recipes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cart, err := retailer.CreateCart(c.Request.Context(), list, c.GetHeader("X-Retailer-Token"))
+	if err != nil {
+		requestLogger(c).Warn("retailer cart failed", "retailer", name, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Retailer request failed", "retailer": name})
+		return
+	}
+	if len(list.Missing) > 0 {
+		cart.Warnings = append(cart.Warnings, fmt.Sprintf("Recipes not found: %v", list.Missing))
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
+func createNutritionSummary(c *gin.Context) {
+	var req PortionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Recipes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	summary, err := summarizeNutrition(tenantFromContext(c), req.Recipes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+type PartyDish struct {
+	ID     int    `json:"id" binding:"required"`
+	Course string `json:"course"`
+}
+
+type PartyPlanRequest struct {
+	Adults   int `json:"adults"`
+	Children int `json:"children"`
+	// ChildPortion is a child's share of an adult portion.
+	ChildPortion float64     `json:"child_portion"`
+	ServeAt      *time.Time  `json:"serve_at"`
+	Dishes       []PartyDish `json:"dishes" binding:"required"`
+}
+
+type PartyPortion struct {
+	ID       int     `json:"id"`
+	Name     string  `json:"name"`
+	Course   string  `json:"course"`
+	Servings float64 `json:"servings"`
+	// Scale is servings over the recipe's own yield.
+	Scale float64 `json:"scale"`
+}
+
+// PrepTimelineEntry is one step of a prep timeline, timed backward from
+// serving. At is only set when the plan has a serving time.
+type PrepTimelineEntry struct {
+	MinutesBefore int        `json:"minutes_before"`
+	At            *time.Time `json:"at,omitempty"`
+	RecipeID      int        `json:"recipe_id"`
+	Recipe        string     `json:"recipe"`
+	Action        string     `json:"action"`
+}
+
+type PartyPlan struct {
+	Guests       float64             `json:"guest_portions"`
+	Portions     []PartyPortion      `json:"portions"`
+	ShoppingList ShoppingList        `json:"shopping_list"`
+	Timeline     []PrepTimelineEntry `json:"timeline"`
+}
+
+const (
+	maxPartyDishes      = 20
+	maxPartyGuests      = 500
+	defaultChildPortion = 0.5
+	// courseOverlap is how much more than one portion a guest eats in total
+	// for each extra dish offered in the same course: with two mains most
+	// people take some of both, but not a full plate of each.
+	courseOverlap = 0.25
+)
+
+// partyPortions splits the guests' appetite across the dishes. Within a
+// course of k dishes each gets (1 + courseOverlap*(k-1))/k of the guest
+// portions.
+func partyPortions(dishes []PartyDish, guestPortions float64) []RecipePortion {
+	perCourse := map[string]int{}
+	for _, dish := range dishes {
+		perCourse[dish.Course]++
+	}
+	portions := make([]RecipePortion, len(dishes))
+	for i, dish := range dishes {
+		k := float64(perCourse[dish.Course])
+		servings := guestPortions * (1 + courseOverlap*(k-1)) / k
+		portions[i] = RecipePortion{ID: dish.ID, Servings: math.Ceil(servings*2) / 2}
+	}
+	return portions
+}
+
+// prepTimeline works backward from serving: each recipe starts prep its
+// total time ahead and goes on the heat its cook time ahead. Prep for a
+// batch scaled beyond the recipe's yield takes longer, by the square root
+// of the scale, since chopping grows but setup does not.
+func prepTimeline(portions []PartyPortion, recipes map[int]Recipe, serveAt *time.Time) []PrepTimelineEntry {
+	timeline := []PrepTimelineEntry{}
+	add := func(minutes int, recipe Recipe, action string) {
+		entry := PrepTimelineEntry{MinutesBefore: minutes, RecipeID: recipe.ID, Recipe: recipe.Name, Action: action}
+		if serveAt != nil {
+			at := serveAt.Add(-time.Duration(minutes) * time.Minute)
+			entry.At = &at
+		}
+		timeline = append(timeline, entry)
+	}
+
+	for _, portion := range portions {
+		recipe := recipes[portion.ID]
+		prep, cook := 0, 0
+		if recipe.PrepTimeMinutes != nil {
+			prep = *recipe.PrepTimeMinutes
+		}
+		if recipe.CookTimeMinutes != nil {
+			cook = *recipe.CookTimeMinutes
+		}
+		if recipe.TotalTimeMinutes != nil && *recipe.TotalTimeMinutes > prep+cook {
+			prep = *recipe.TotalTimeMinutes - cook
+		}
+		if portion.Scale > 1 {
+			prep = int(math.Ceil(float64(prep) * math.Sqrt(portion.Scale)))
+		}
+
+		if prep > 0 {
+			add(prep+cook, recipe, fmt.Sprintf("Start prep (%d min, %.1fx batch)", prep, portion.Scale))
+		}
+		if cook > 0 {
+			add(cook, recipe, fmt.Sprintf("Start cooking (%d min)", cook))
+		}
+		add(0, recipe, "Ready to serve")
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].MinutesBefore > timeline[j].MinutesBefore
+	})
+	return timeline
+}
+
+// createPartyPlan scales a menu to a guest list, merges the shopping list
+// and lays out a prep timeline ending at serve_at.
+func createPartyPlan(c *gin.Context) {
+	var req PartyPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Dishes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if len(req.Dishes) > maxPartyDishes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d dishes can be planned", maxPartyDishes)})
+		return
+	}
+	if req.Adults < 0 || req.Children < 0 || req.Adults+req.Children == 0 || req.Adults+req.Children > maxPartyGuests {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("adults and children must add up to between 1 and %d", maxPartyGuests)})
+		return
+	}
+	if req.ChildPortion == 0 {
+		req.ChildPortion = defaultChildPortion
+	}
+	if req.ChildPortion < 0 || req.ChildPortion > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "child_portion must be between 0 and 1"})
+		return
+	}
+	for i := range req.Dishes {
+		if req.Dishes[i].Course == "" {
+			req.Dishes[i].Course = "main"
+		}
+	}
+
+	guestPortions := float64(req.Adults) + float64(req.Children)*req.ChildPortion
+	resolved, recipes, missing, err := loadPortions(tenantFromContext(c), partyPortions(req.Dishes, guestPortions))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found", "missing_recipes": missing})
+		return
+	}
+
+	plan := PartyPlan{Guests: guestPortions, Portions: []PartyPortion{}}
+	for i, portion := range resolved {
+		recipe := recipes[portion.ID]
+		scale := portion.Servings
+		if recipe.Servings != nil && *recipe.Servings > 0 {
+			scale = portion.Servings / float64(*recipe.Servings)
+		}
+		plan.Portions = append(plan.Portions, PartyPortion{
+			ID:       recipe.ID,
+			Name:     recipe.Name,
+			Course:   req.Dishes[i].Course,
+			Servings: portion.Servings,
+			Scale:    math.Round(scale*100) / 100,
+		})
+	}
+
+	plan.ShoppingList, err = buildShoppingList(tenantFromContext(c), resolved)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	plan.Timeline = prepTimeline(plan.Portions, recipes, req.ServeAt)
+
+	c.JSON(http.StatusOK, plan)
+}
+
+type CookPlanRequest struct {
+	RecipeIDs []int      `json:"recipe_ids" binding:"required"`
+	ReadyAt   *time.Time `json:"ready_at"`
+}
+
+// CookPlanStep is one recipe step placed on the shared schedule. Offsets
+// count minutes from the start of the plan; hands-on steps never overlap,
+// while timed steps (simmering, baking) run alongside other work.
+type CookPlanStep struct {
+	RecipeID    int        `json:"recipe_id"`
+	Recipe      string     `json:"recipe"`
+	Step        int        `json:"step"`
+	Text        string     `json:"text"`
+	HandsOn     bool       `json:"hands_on"`
+	StartMinute int        `json:"start_minute"`
+	EndMinute   int        `json:"end_minute"`
+	StartsAt    *time.Time `json:"starts_at,omitempty"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+}
+
+type CookPlan struct {
+	TotalMinutes int            `json:"total_minutes"`
+	StartAt      *time.Time     `json:"start_at,omitempty"`
+	ReadyAt      *time.Time     `json:"ready_at,omitempty"`
+	Steps        []CookPlanStep `json:"steps"`
+	// Early lists recipes whose last step had to finish before the others
+	// because it competed for the cook's hands, in minutes early.
+	Early map[int]int `json:"early,omitempty"`
+}
+
+const (
+	maxCookPlanRecipes = 6
+	// minStepSeconds is the floor for an untimed step, so a recipe with no
+	// times at all still gets a plausible schedule.
+	minStepSeconds = 2 * 60
+)
+
+type scheduledStep struct {
+	step    CookingStep
+	seconds int
+	handsOn bool
+}
+
+// cookPlanSteps parses a recipe's instructions into timed steps. Steps that
+// mention a duration take the longest timer and are treated as hands-off;
+// the rest share whatever is left of the recipe's total time.
+func cookPlanSteps(recipe Recipe) []scheduledStep {
+	steps := []scheduledStep{}
+	timed, untimed := 0, 0
+	for _, text := range recipe.Instructions {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		step := parseCookingStep(len(steps)+1, text)
+		seconds := 0
+		for _, timer := range step.Timers {
+			seconds = max(seconds, timer.Seconds)
+		}
+		if seconds > 0 {
+			timed += seconds
+		} else {
+			untimed++
+		}
+		steps = append(steps, scheduledStep{step: step, seconds: seconds, handsOn: seconds == 0})
+	}
+
+	total := 0
+	if recipe.TotalTimeMinutes != nil {
+		total = *recipe.TotalTimeMinutes * 60
+	} else if recipe.PrepTimeMinutes != nil || recipe.CookTimeMinutes != nil {
+		if recipe.PrepTimeMinutes != nil {
+			total += *recipe.PrepTimeMinutes * 60
+		}
+		if recipe.CookTimeMinutes != nil {
+			total += *recipe.CookTimeMinutes * 60
+		}
+	}
+	share := minStepSeconds
+	if untimed > 0 && total > timed {
+		share = max(minStepSeconds, (total-timed)/untimed/60*60)
+	}
+	for i := range steps {
+		if steps[i].seconds == 0 {
+			steps[i].seconds = share
+		}
+	}
+	return steps
+}
+
+// latestFreeStart returns the latest start at which a hands-on step of the
+// given length ends by end without overlapping any busy interval.
+func latestFreeStart(busy [][2]int, end, seconds int) int {
+	start := end - seconds
+	for {
+		moved := false
+		for _, interval := range busy {
+			if start < interval[1] && interval[0] < start+seconds {
+				start = interval[0] - seconds
+				moved = true
+			}
+		}
+		if !moved {
+			return start
+		}
+	}
+}
+
+// buildCookPlan schedules every recipe backward from a common finish at
+// time zero. Recipes are placed longest first so the short ones fill gaps
+// around them; each step ends no later than the next one starts.
+func buildCookPlan(recipes []Recipe) CookPlan {
+	type recipeSteps struct {
+		recipe Recipe
+		steps  []scheduledStep
+		length int
+	}
+	all := make([]recipeSteps, len(recipes))
+	for i, recipe := range recipes {
+		steps := cookPlanSteps(recipe)
+		length := 0
+		for _, step := range steps {
+			length += step.seconds
+		}
+		all[i] = recipeSteps{recipe: recipe, steps: steps, length: length}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].length > all[j].length })
+
+	plan := CookPlan{Steps: []CookPlanStep{}, Early: map[int]int{}}
+	busy := [][2]int{}
+	starts := []int{}
+	earliest := 0
+	for _, rs := range all {
+		end := 0
+		for i := len(rs.steps) - 1; i >= 0; i-- {
+			step := rs.steps[i]
+			start := end - step.seconds
+			if step.handsOn {
+				start = latestFreeStart(busy, end, step.seconds)
+				busy = append(busy, [2]int{start, start + step.seconds})
+			}
+			if i == len(rs.steps)-1 && start+step.seconds < 0 {
+				plan.Early[rs.recipe.ID] = -(start + step.seconds) / 60
+			}
+			plan.Steps = append(plan.Steps, CookPlanStep{
+				RecipeID: rs.recipe.ID,
+				Recipe:   rs.recipe.Name,
+				Step:     step.step.Number,
+				Text:     step.step.Text,
+				HandsOn:  step.handsOn,
+			})
+			starts = append(starts, start, start+step.seconds)
+			earliest = min(earliest, start)
+			end = start
+		}
+	}
+
+	// Shift everything so the plan starts at minute zero.
+	for i := range plan.Steps {
+		plan.Steps[i].StartMinute = (starts[2*i] - earliest + 30) / 60
+		plan.Steps[i].EndMinute = (starts[2*i+1] - earliest + 30) / 60
+	}
+	plan.TotalMinutes = (-earliest + 30) / 60
+	sort.SliceStable(plan.Steps, func(i, j int) bool {
+		return plan.Steps[i].StartMinute < plan.Steps[j].StartMinute
+	})
+	if len(plan.Early) == 0 {
+		plan.Early = nil
+	}
+	return plan
+}
+
+// createCookPlan interleaves several recipes so they are ready together,
+// optionally anchored to a ready_at time.
+func createCookPlan(c *gin.Context) {
+	var req CookPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.RecipeIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if len(req.RecipeIDs) > maxCookPlanRecipes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d recipes can be planned together", maxCookPlanRecipes)})
+		return
+	}
+
+	found, err := fetchRecipesByIDs(tenantFromContext(c), req.RecipeIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipes := []Recipe{}
+	missing := []int{}
+	for _, id := range req.RecipeIDs {
+		recipe, ok := found[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		recipes = append(recipes, recipe)
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found", "missing_recipes": missing})
+		return
+	}
+
+	plan := buildCookPlan(recipes)
+	if req.ReadyAt != nil {
+		start := req.ReadyAt.Add(-time.Duration(plan.TotalMinutes) * time.Minute)
+		plan.StartAt, plan.ReadyAt = &start, req.ReadyAt
+		for i := range plan.Steps {
+			startsAt := start.Add(time.Duration(plan.Steps[i].StartMinute) * time.Minute)
+			endsAt := start.Add(time.Duration(plan.Steps[i].EndMinute) * time.Minute)
+			plan.Steps[i].StartsAt, plan.Steps[i].EndsAt = &startsAt, &endsAt
+		}
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+type AskRecipeRequest struct {
+	Question string `json:"question" binding:"required"`
+}
+
+// askRecipe answers a question about one recipe, grounding the LLM in the
+// stored recipe JSON and returning the fields it relied on.
+func askRecipe(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	var req AskRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	recipes, err := selectRecipes().Where("id = ?", id).Visible(tenantFromContext(c)).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	if llmBudgetExceeded(c) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Daily LLM budget exceeded"})
+		return
+	}
+
+	recipeJSON, _ := json.Marshal(recipes[0])
+	var fields map[string]interface{}
+	json.Unmarshal(recipeJSON, &fields)
+
+	systemPrompt := `You answer cooking and nutrition questions about a single recipe. Use ONLY the recipe JSON below as the source of facts;
+if the answer depends on something not in the recipe, say so. Nutrition is per serving: grams for macros, mg for sodium.
+
+Respond ONLY with a JSON object: {"answer": string, "referenced_fields": [string]}
+where referenced_fields lists the recipe JSON keys your answer relies on.
+
+Recipe:
+` + string(recipeJSON)
+
+	result, err := callLLM(c.Request.Context(), []map[string]interface{}{
+		{"role": "system", "content": systemPrompt},
+		{"role": "user", "content": req.Question},
+	})
+	recordLLMUsage(c, "recipe/ask", result)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to answer question: " + err.Error()})
+		return
+	}
+
+	var answer struct {
+		Answer           string   `json:"answer"`
+		ReferencedFields []string `json:"referenced_fields"`
+	}
+	if err := json.Unmarshal([]byte(extractJSONObject(result.Content)), &answer); err != nil || answer.Answer == "" {
+		answer.Answer = strings.TrimSpace(result.Content)
+		answer.ReferencedFields = nil
+	}
+
+	referenced := gin.H{}
+	for _, field := range answer.ReferencedFields {
+		if value, ok := fields[field]; ok {
+			referenced[field] = value
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recipe_id":         id,
+		"question":          req.Question,
+		"answer":            answer.Answer,
+		"referenced_fields": referenced,
+	})
+}
+
+// PairingRule is one row of beverage_pairings. MatchType picks what
+// MatchValue is tested against: "cuisine" keywords against the recipe name
+// and description, "protein" keywords against its ingredients, "spice" a
+// minimum spice level, and "any" matches every recipe.
+type PairingRule struct {
+	ID         int    `json:"id"`
+	MatchType  string `json:"match_type" binding:"required"`
+	MatchValue string `json:"match_value"`
+	Beverage   string `json:"beverage" binding:"required"`
+	Category   string `json:"category" binding:"required"`
+	Reason     string `json:"reason" binding:"required"`
+	Weight     int    `json:"weight"`
+}
+
+// BeveragePairing is a suggested beverage with the reasons of every rule
+// that picked it; Score sums their weights.
+type BeveragePairing struct {
+	Beverage string   `json:"beverage"`
+	Category string   `json:"category"`
+	Score    int      `json:"score"`
+	Reasons  []string `json:"reasons"`
+}
+
+var (
+	pairingMatchTypes = []string{"cuisine", "protein", "spice", "any"}
+	pairingCategories = []string{"wine", "beer", "spirit", "non_alcoholic"}
+)
+
+const (
+	defaultPairingLimit = 5
+	maxPairingLimit     = 20
+)
+
+// keywordPattern matches any of a comma-separated keyword list as whole
+// words, allowing a plural s.
+func keywordPattern(keywords string) *regexp.Regexp {
+	alternatives := []string{}
+	for _, keyword := range strings.Split(keywords, ",") {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			alternatives = append(alternatives, regexp.QuoteMeta(keyword))
+		}
+	}
+	if len(alternatives) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(alternatives, "|") + `)s?\b`)
+}
+
+// pairingRuleMatches reports whether a rule applies to a recipe.
+func pairingRuleMatches(rule PairingRule, recipe Recipe, spiceLevel int) bool {
+	switch rule.MatchType {
+	case "any":
+		return true
+	case "spice":
+		minimum, err := strconv.Atoi(rule.MatchValue)
+		return err == nil && spiceLevel >= minimum
+	case "cuisine":
+		pattern := keywordPattern(rule.MatchValue)
+		return pattern != nil && pattern.MatchString(recipe.Name+" "+recipe.Description)
+	case "protein":
+		pattern := keywordPattern(rule.MatchValue)
+		return pattern != nil && pattern.MatchString(strings.Join(recipe.Ingredients, "\n"))
+	}
+	return false
+}
+
+// suggestPairings applies every rule to a recipe and ranks the beverages by
+// combined weight. An empty category keeps all of them.
+func suggestPairings(recipe Recipe, category string, limit int) ([]BeveragePairing, error) {
+	query := "SELECT id, match_type, match_value, beverage, category, reason, weight FROM beverage_pairings"
+	args := []interface{}{}
+	if category != "" {
+		query += " WHERE category = ?"
+		args = append(args, category)
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spiceLevel := inferSpiceLevel(recipe)
+	if recipe.SpiceLevel != nil {
+		spiceLevel = *recipe.SpiceLevel
+	}
+
+	pairings := []BeveragePairing{}
+	index := map[string]int{}
+	for rows.Next() {
+		var rule PairingRule
+		if err := rows.Scan(&rule.ID, &rule.MatchType, &rule.MatchValue, &rule.Beverage, &rule.Category, &rule.Reason, &rule.Weight); err != nil {
+			continue
+		}
+		if !pairingRuleMatches(rule, recipe, spiceLevel) {
+			continue
+		}
+		key := strings.ToLower(rule.Beverage)
+		i, ok := index[key]
+		if !ok {
+			i = len(pairings)
+			index[key] = i
+			pairings = append(pairings, BeveragePairing{Beverage: rule.Beverage, Category: rule.Category, Reasons: []string{}})
+		}
+		pairings[i].Score += rule.Weight
+		if !slices.Contains(pairings[i].Reasons, rule.Reason) {
+			pairings[i].Reasons = append(pairings[i].Reasons, rule.Reason)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(pairings, func(i, j int) bool {
+		return pairings[i].Score > pairings[j].Score
+	})
+	if len(pairings) > limit {
+		pairings = pairings[:limit]
+	}
+	return pairings, nil
+}
+
+// getRecipePairings suggests beverages for a recipe from the pairing rules.
+// With explain=true an LLM adds a short explanation; without LLM budget the
+// rule-based pairings are still returned, marked degraded.
+func getRecipePairings(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	category := c.Query("category")
+	if category != "" && !slices.Contains(pairingCategories, category) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "category must be one of: " + strings.Join(pairingCategories, ", ")})
+		return
+	}
+	limit := defaultPairingLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= maxPairingLimit {
+		limit = val
+	}
+
+	recipes, err := selectRecipes().Where("id = ?", id).Visible(tenantFromContext(c)).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	recipe := recipes[0]
+
+	pairings, err := suggestPairings(recipe, category, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	response := gin.H{"recipe_id": id, "pairings": pairings}
+
+	if c.Query("explain") == "true" && len(pairings) > 0 {
+		if llmBudgetExceeded(c) {
+			response["degraded"] = true
+			c.JSON(http.StatusOK, response)
+			return
+		}
+
+		beverages := make([]string, len(pairings))
+		for i, pairing := range pairings {
+			beverages[i] = pairing.Beverage
+		}
+		systemPrompt := `You are a sommelier writing for a home cook planning a dinner party. In two or three sentences, explain why the
+suggested beverages suit the recipe, mentioning specific ingredients. Do not suggest other beverages. Respond with plain text only.`
+		userPrompt := fmt.Sprintf("Recipe: %s\nIngredients: %s\nSuggested beverages: %s",
+			recipe.Name, strings.Join(recipe.Ingredients, "; "), strings.Join(beverages, ", "))
+
+		result, err := callLLM(c.Request.Context(), []map[string]interface{}{
+			{"role": "system", "content": systemPrompt},
+			{"role": "user", "content": userPrompt},
+		})
+		recordLLMUsage(c, "recipe/pairings", result)
+		if err != nil {
+			response["degraded"] = true
+		} else {
+			response["explanation"] = strings.TrimSpace(result.Content)
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func listPairingRules(c *gin.Context) {
+	rows, err := db.Query("SELECT id, match_type, match_value, beverage, category, reason, weight FROM beverage_pairings ORDER BY match_type, id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	rules := []PairingRule{}
+	for rows.Next() {
+		var rule PairingRule
+		if err := rows.Scan(&rule.ID, &rule.MatchType, &rule.MatchValue, &rule.Beverage, &rule.Category, &rule.Reason, &rule.Weight); err != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func createPairingRule(c *gin.Context) {
+	var rule PairingRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if !slices.Contains(pairingMatchTypes, rule.MatchType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "match_type must be one of: " + strings.Join(pairingMatchTypes, ", ")})
+		return
+	}
+	if !slices.Contains(pairingCategories, rule.Category) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "category must be one of: " + strings.Join(pairingCategories, ", ")})
+		return
+	}
+	switch rule.MatchType {
+	case "spice":
+		if level, err := strconv.Atoi(rule.MatchValue); err != nil || level < spiceNone || level > spiceHot {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("match_value must be a spice level between %d and %d", spiceNone, spiceHot)})
+			return
+		}
+	case "cuisine", "protein":
+		if keywordPattern(rule.MatchValue) == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "match_value must list at least one keyword"})
+			return
+		}
+	}
+	if rule.Weight == 0 {
+		rule.Weight = 1
+	}
+
+	res, err := db.Exec("INSERT INTO beverage_pairings (match_type, match_value, beverage, category, reason, weight) VALUES (?, ?, ?, ?, ?, ?)",
+		rule.MatchType, rule.MatchValue, rule.Beverage, rule.Category, rule.Reason, rule.Weight)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, _ := res.LastInsertId()
+	rule.ID = int(id)
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+func deletePairingRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return
+	}
+	res, err := db.Exec("DELETE FROM beverage_pairings WHERE id = ?", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pairing rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+// courseKeywords recognise courses by name, since recipes carry no course
+// of their own.
+var courseKeywords = map[string][]string{
+	"starter": {"soup", "appetizer", "starter", "bruschetta", "crostini", "dip", "deviled eggs", "spring rolls", "dumplings", "ceviche", "carpaccio"},
+	"main":    {"roast", "chicken", "beef", "pork", "lamb", "salmon", "fish", "turkey", "lasagna", "curry", "stew", "casserole", "steak", "risotto", "tofu"},
+	"side":    {"salad", "slaw", "side", "roasted vegetables", "greens", "beans", "rice", "pilaf", "couscous", "quinoa", "mash", "fries", "bread", "rolls", "steamed", "sautéed", "green beans", "broccoli", "asparagus", "carrots"},
+	"dessert": {"cake", "cookie", "pie", "tart", "pudding", "brownie", "mousse", "crumble", "cobbler", "sorbet", "ice cream", "cheesecake", "dessert", "parfait"},
+}
+
+const (
+	defaultMenuSides = 2
+	maxMenuSides     = 3
+	// defaultMenuSodium caps a whole menu at roughly half the 2,300 mg
+	// daily value, leaving room for the rest of the day.
+	defaultMenuSodium = 1200
+)
+
+type MenuCourse struct {
+	Course string `json:"course"`
+	Recipe Recipe `json:"recipe"`
+}
+
+type Menu struct {
+	Courses    []MenuCourse       `json:"courses"`
+	Totals     MealPlanTotals     `json:"totals"`
+	MacroSplit map[string]float64 `json:"macro_split"`
+	Warnings   []string           `json:"warnings,omitempty"`
+}
+
+// courseCandidates loads published recipes whose names suggest course.
+func courseCandidates(tenant *Tenant, course string, excludeID int) ([]Recipe, error) {
+	scope, args := tenant.recipeScope()
+	conditions := []string{}
+	args = append(args, excludeID)
+	for _, keyword := range courseKeywords[course] {
+		conditions = append(conditions, "name LIKE ?")
+		args = append(args, "%"+keyword+"%")
+	}
+	query := "SELECT " + recipeColumns + " FROM recipes WHERE " + scope + " AND id <> ? AND calories IS NOT NULL AND (" +
+		strings.Join(conditions, " OR ") + ") ORDER BY rating DESC LIMIT 200"
+	return queryRecipes(query, args...)
+}
+
+// menuScore rates a candidate course against the menu so far: fiber and
+// rating count in its favour, sodium against, and calories far from the
+// course's target against. ok is false when it would break the sodium or
+// calorie cap.
+func menuScore(recipe Recipe, totals MealPlanTotals, targetCalories, maxSodium, maxCalories float64) (float64, bool) {
+	sodium, fiber, rating := 0.0, 0.0, 0.0
+	if recipe.Sodium != nil {
+		sodium = *recipe.Sodium
+	}
+	if recipe.Fiber != nil {
+		fiber = *recipe.Fiber
+	}
+	if recipe.Rating != nil {
+		rating = *recipe.Rating
+	}
+	calories := float64(*recipe.Calories)
+	if totals.Sodium+sodium > maxSodium {
+		return 0, false
+	}
+	if maxCalories > 0 && float64(totals.Calories)+calories > maxCalories {
+		return 0, false
+	}
+	return fiber*3 + rating - sodium/200 - math.Abs(calories-targetCalories)/100, true
+}
+
+// composeMenu builds a menu around a main course: up to sides side dishes
+// and optionally a dessert, picked greedily to add fiber while keeping the
+// whole menu's sodium under maxSodium and, if set, calories under
+// maxCalories.
+func composeMenu(tenant *Tenant, main Recipe, sides int, dessert bool, maxSodium, maxCalories float64) (Menu, error) {
+	menu := Menu{Courses: []MenuCourse{{Course: "main", Recipe: main}}}
+	addToTotals(&menu.Totals, main, 1)
+	if menu.Totals.Sodium > maxSodium {
+		menu.Warnings = append(menu.Warnings, fmt.Sprintf("The main course alone has %.0f mg sodium, over the %.0f mg cap", menu.Totals.Sodium, maxSodium))
+	}
+
+	mainCalories := float64(menu.Totals.Calories)
+	if mainCalories <= 0 {
+		mainCalories = 600
+	}
+	// Each course aims for a share of the main course's calories.
+	type courseSlot struct {
+		Name   string
+		Count  int
+		Target float64
+	}
+	courses := []courseSlot{{"side", sides, mainCalories * 0.35}}
+	if dessert {
+		courses = append(courses, courseSlot{"dessert", 1, mainCalories * 0.4})
+	}
+
+	used := map[int]bool{main.ID: true}
+	for _, course := range courses {
+		if course.Count == 0 {
+			continue
+		}
+		candidates, err := courseCandidates(tenant, course.Name, main.ID)
+		if err != nil {
+			return Menu{}, err
+		}
+		for n := 0; n < course.Count; n++ {
+			best, bestScore := -1, math.Inf(-1)
+			for i, candidate := range candidates {
+				if used[candidate.ID] {
+					continue
+				}
+				score, ok := menuScore(candidate, menu.Totals, course.Target, maxSodium, maxCalories)
+				if ok && score > bestScore {
+					best, bestScore = i, score
+				}
+			}
+			if best == -1 {
+				menu.Warnings = append(menu.Warnings, fmt.Sprintf("No %s fits the remaining sodium and calorie budget", course.Name))
+				break
+			}
+			used[candidates[best].ID] = true
+			menu.Courses = append(menu.Courses, MenuCourse{Course: course.Name, Recipe: candidates[best]})
+			addToTotals(&menu.Totals, candidates[best], 1)
+		}
+	}
+
+	menu.MacroSplit = macroSplit(menu.Totals)
+	return menu, nil
+}
+
+// getRecipeMenu composes a menu of sides and a dessert around a main-course
+// recipe, one serving of each.
+func getRecipeMenu(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	sides := defaultMenuSides
+	if raw := c.Query("sides"); raw != "" {
+		if sides, err = strconv.Atoi(raw); err != nil || sides < 0 || sides > maxMenuSides {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("sides must be between 0 and %d", maxMenuSides)})
+			return
+		}
+	}
+	maxSodium := float64(defaultMenuSodium)
+	if raw := c.Query("max_sodium"); raw != "" {
+		if maxSodium, err = strconv.ParseFloat(raw, 64); err != nil || maxSodium <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_sodium must be a positive number"})
+			return
+		}
+	}
+	maxCalories := 0.0
+	if raw := c.Query("max_calories"); raw != "" {
+		if maxCalories, err = strconv.ParseFloat(raw, 64); err != nil || maxCalories <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_calories must be a positive number"})
+			return
+		}
+	}
+
+	recipes, err := selectRecipes().Where("id = ?", id).Visible(tenantFromContext(c)).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	menu, err := composeMenu(tenantFromContext(c), recipes[0], sides, c.Query("dessert") != "false", maxSodium, maxCalories)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, menu)
+}
+
+// MenuOccasion is a holiday or season the menu generator knows. Recipes
+// carry no occasion tags, so, as with courseKeywords, keywords in a
+// recipe's name or ingredients stand in for them; courses without a match
+// fall back to courseKeywords.
+type MenuOccasion struct {
+	Name    string              `json:"name"`
+	Courses map[string][]string `json:"-"`
+}
+
+var menuOccasions = map[string]MenuOccasion{
+	"thanksgiving": {"Thanksgiving", map[string][]string{
+		"starter": {"squash soup", "pumpkin soup", "deviled eggs", "cheese ball"},
+		"main":    {"turkey", "ham", "stuffed squash"},
+		"side":    {"stuffing", "mashed potato", "sweet potato", "cranberry", "green bean casserole", "gravy", "cornbread", "brussels sprouts"},
+		"dessert": {"pumpkin pie", "pecan pie", "apple pie", "sweet potato pie"},
+	}},
+	"christmas": {"Christmas", map[string][]string{
+		"starter": {"smoked salmon", "prawn cocktail", "shrimp cocktail", "pâté", "chestnut soup"},
+		"main":    {"turkey", "roast beef", "prime rib", "ham", "goose", "beef wellington", "nut roast"},
+		"side":    {"roast potatoes", "brussels sprouts", "parsnip", "red cabbage", "pigs in blankets", "stuffing", "yorkshire pudding"},
+		"dessert": {"christmas pudding", "yule log", "gingerbread", "mince pie", "trifle", "eggnog"},
+	}},
+	"easter": {"Easter", map[string][]string{
+		"starter": {"deviled eggs", "asparagus", "pea soup"},
+		"main":    {"lamb", "ham", "salmon"},
+		"side":    {"asparagus", "new potatoes", "spring greens", "carrots", "peas"},
+		"dessert": {"hot cross bun", "carrot cake", "simnel", "lemon tart"},
+	}},
+	"lunar_new_year": {"Lunar New Year", map[string][]string{
+		"starter": {"dumpling", "spring roll", "wonton", "potsticker"},
+		"main":    {"whole fish", "steamed fish", "roast duck", "char siu", "noodle"},
+		"side":    {"bok choy", "fried rice", "noodles", "greens", "lotus"},
+		"dessert": {"nian gao", "sesame ball", "tang yuan", "mandarin"},
+	}},
+	"diwali": {"Diwali", map[string][]string{
+		"starter": {"samosa", "pakora", "bhaji", "chaat"},
+		"main":    {"biryani", "paneer", "curry", "dal makhani", "korma"},
+		"side":    {"naan", "pulao", "raita", "dal", "aloo"},
+		"dessert": {"gulab jamun", "barfi", "ladoo", "kheer", "halwa", "jalebi"},
+	}},
+	"bbq": {"Summer barbecue", map[string][]string{
+		"starter": {"guacamole", "salsa", "corn", "bruschetta"},
+		"main":    {"burger", "ribs", "grilled", "bbq", "kebab", "skewers", "pulled pork"},
+		"side":    {"coleslaw", "potato salad", "corn on the cob", "pasta salad", "baked beans"},
+		"dessert": {"s'mores", "peach", "berry", "watermelon", "ice cream"},
+	}},
+	"spring": {"Spring", map[string][]string{
+		"starter": {"asparagus", "pea", "radish"},
+		"main":    {"lamb", "spring", "asparagus"},
+		"side":    {"asparagus", "peas", "new potatoes", "artichoke"},
+		"dessert": {"rhubarb", "strawberr", "lemon"},
+	}},
+	"summer": {"Summer", map[string][]string{
+		"starter": {"gazpacho", "tomato", "caprese", "zucchini"},
+		"main":    {"grilled", "zucchini", "tomato", "salmon"},
+		"side":    {"tomato", "corn", "zucchini", "cucumber"},
+		"dessert": {"berry", "peach", "cherry", "sorbet"},
+	}},
+	"autumn": {"Autumn", map[string][]string{
+		"starter": {"squash", "pumpkin", "mushroom"},
+		"main":    {"squash", "pumpkin", "mushroom", "braise", "stew"},
+		"side":    {"squash", "sweet potato", "brussels sprouts", "beet"},
+		"dessert": {"apple", "pear", "pumpkin", "cinnamon"},
+	}},
+	"winter": {"Winter", map[string][]string{
+		"starter": {"soup", "chowder", "leek"},
+		"main":    {"stew", "roast", "braise", "pot pie", "casserole"},
+		"side":    {"root vegetables", "parsnip", "cabbage", "kale", "mash"},
+		"dessert": {"chocolate", "crumble", "citrus", "gingerbread"},
+	}},
+}
+
+// seasonOccasions picks the northern-hemisphere season by month, the
+// occasion when none is given.
+var seasonOccasions = [12]string{"winter", "winter", "spring", "spring", "spring", "summer", "summer", "summer", "autumn", "autumn", "autumn", "winter"}
+
+// occasionMenuShares is each course's share of a guest's menu calories.
+var occasionMenuShares = map[string]float64{"starter": 0.15, "main": 0.4, "side": 0.15, "dessert": 0.2}
+
+var occasionMenuCourses = []string{"starter", "main", "side", "dessert"}
+
+const (
+	defaultOccasionGuests   = 6
+	defaultOccasionCalories = 1500
+	// defaultOccasionSodium is the daily value: a feast is most of the
+	// day's eating.
+	defaultOccasionSodium = 2300
+)
+
+type OccasionCourse struct {
+	Course   string  `json:"course"`
+	Recipe   Recipe  `json:"recipe"`
+	Servings float64 `json:"servings"`
+	Scale    float64 `json:"scale"`
+	// Themed is set when the recipe matched the occasion rather than only
+	// the course.
+	Themed bool `json:"themed"`
+}
+
+type OccasionMenu struct {
+	Occasion     string             `json:"occasion"`
+	Name         string             `json:"name"`
+	Guests       int                `json:"guests"`
+	Diet         string             `json:"diet,omitempty"`
+	Courses      []OccasionCourse   `json:"courses"`
+	PerGuest     MealPlanTotals     `json:"per_guest"`
+	MacroSplit   map[string]float64 `json:"macro_split"`
+	ShoppingList ShoppingList       `json:"shopping_list"`
+	Warnings     []string           `json:"warnings,omitempty"`
+}
+
+// occasionCandidates loads published recipes for a course that pass the
+// diet: those matching the occasion's keywords for it, then those matching
+// courseKeywords. themed holds the IDs of the first kind.
+func occasionCandidates(tenant *Tenant, occasion MenuOccasion, course string, diet map[string]interface{}) ([]Recipe, map[int]bool, error) {
+	themed := map[int]bool{}
+	seen := map[int]bool{}
+	candidates := []Recipe{}
+	for i, keywords := range [][]string{occasion.Courses[course], courseKeywords[course]} {
+		if len(keywords) == 0 {
+			continue
+		}
+		scope, args := tenant.recipeScope()
+		query := "SELECT " + recipeColumns + " FROM recipes WHERE " + scope + " AND calories IS NOT NULL AND calories > 0"
+		query, args = applyDietFilters(query, args, diet)
+		conditions := []string{}
+		for _, keyword := range keywords {
+			if i == 0 {
+				conditions = append(conditions, "name LIKE ? OR ingredients LIKE ?")
+				args = append(args, "%"+keyword+"%", "%"+keyword+"%")
+			} else {
+				conditions = append(conditions, "name LIKE ?")
+				args = append(args, "%"+keyword+"%")
+			}
+		}
+		recipes, err := queryRecipes(query+" AND ("+strings.Join(conditions, " OR ")+") ORDER BY rating DESC LIMIT 200", args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, recipe := range recipes {
+			if seen[recipe.ID] {
+				continue
+			}
+			seen[recipe.ID] = true
+			themed[recipe.ID] = i == 0
+			candidates = append(candidates, recipe)
+		}
+	}
+	return candidates, themed, nil
+}
+
+// composeOccasionMenu picks each course greedily, as composeMenu does,
+// preferring recipes themed for the occasion and keeping a guest's share
+// of the whole menu within maxSodium and maxCalories.
+func composeOccasionMenu(tenant *Tenant, occasion MenuOccasion, counts map[string]int, diet map[string]interface{}, maxSodium, maxCalories float64) ([]OccasionCourse, MealPlanTotals, []string, error) {
+	// themedBonus outweighs a few points of the nutrition score, so the
+	// theme wins unless the themed dish is clearly worse.
+	const themedBonus = 5
+
+	courses := []OccasionCourse{}
+	totals := MealPlanTotals{}
+	warnings := []string{}
+	used := map[int]bool{}
+	for _, course := range occasionMenuCourses {
+		if counts[course] == 0 {
+			continue
+		}
+		candidates, themed, err := occasionCandidates(tenant, occasion, course, diet)
+		if err != nil {
+			return nil, totals, nil, err
+		}
+		// Several dishes in a course share its calories.
+		target := maxCalories * occasionMenuShares[course] / float64(counts[course])
+		for n := 0; n < counts[course]; n++ {
+			best, bestScore := -1, math.Inf(-1)
+			for i, candidate := range candidates {
+				if used[candidate.ID] {
+					continue
+				}
+				score, ok := menuScore(candidate, totals, target, maxSodium, maxCalories)
+				if themed[candidate.ID] {
+					score += themedBonus
+				}
+				if ok && score > bestScore {
+					best, bestScore = i, score
+				}
+			}
+			if best == -1 {
+				warnings = append(warnings, fmt.Sprintf("No %s fits the diet and the remaining sodium and calorie budget", course))
+				break
+			}
+			recipe := candidates[best]
+			used[recipe.ID] = true
+			courses = append(courses, OccasionCourse{Course: course, Recipe: recipe, Themed: themed[recipe.ID]})
+			// A guest eats of each dish in the course as partyPortions
+			// portions them.
+			k := float64(counts[course])
+			addToTotals(&totals, recipe, (1+courseOverlap*(k-1))/k)
+		}
+	}
+	return courses, totals, warnings, nil
+}
+
+// generateOccasionMenu composes a multi-course menu for an ?occasion= (the
+// current season by default) and a number of ?guests=: a starter, a main,
+// sides and a dessert, or the ?courses= listed. Sides and mains grow with
+// the party. ?diet= filters every course, ?calories= and ?max_sodium= bound
+// one guest's share of the whole menu, and the answer includes portions
+// and the combined shopping list.
+func generateOccasionMenu(c *gin.Context) {
+	key := c.Query("occasion")
+	if key == "" {
+		key = seasonOccasions[time.Now().Month()-1]
+	}
+	occasion, ok := menuOccasions[key]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown occasion", "occasions": sortedKeys(menuOccasions)})
+		return
+	}
+	guests := defaultOccasionGuests
+	if raw := c.Query("guests"); raw != "" {
+		var err error
+		if guests, err = strconv.Atoi(raw); err != nil || guests < 1 || guests > maxPartyGuests {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("guests must be between 1 and %d", maxPartyGuests)})
+			return
+		}
+	}
+	tenant := tenantFromContext(c)
+	var diet map[string]interface{}
+	if name := c.Query("diet"); name != "" {
+		plan, ok := tenant.dietPlans()[name]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown diet", "diets": sortedKeys(tenant.dietPlans())})
+			return
+		}
+		diet = plan.Filters
+	}
+	bounds := map[string]float64{"calories": defaultOccasionCalories, "max_sodium": defaultOccasionSodium}
+	for _, name := range sortedKeys(bounds) {
+		if raw := c.Query(name); raw != "" {
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil || value <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a positive number"})
+				return
+			}
+			bounds[name] = value
+		}
+	}
+
+	counts := map[string]int{"starter": 1, "main": 1, "side": 2, "dessert": 1}
+	if guests >= 8 {
+		counts["side"]++
+	}
+	if guests > 12 {
+		counts["main"]++
+	}
+	if raw := c.Query("courses"); raw != "" {
+		wanted := map[string]bool{}
+		for _, course := range strings.Split(raw, ",") {
+			course = strings.TrimSpace(course)
+			if !slices.Contains(occasionMenuCourses, course) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "courses must list any of: " + strings.Join(occasionMenuCourses, ", ")})
+				return
+			}
+			wanted[course] = true
+		}
+		for course := range counts {
+			if !wanted[course] {
+				counts[course] = 0
+			}
+		}
+	}
+
+	courses, perGuest, warnings, err := composeOccasionMenu(tenant, occasion, counts, diet, bounds["max_sodium"], bounds["calories"])
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(courses) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No recipes fit this menu", "warnings": warnings})
+		return
+	}
+
+	dishes := make([]PartyDish, len(courses))
+	for i, course := range courses {
+		dishes[i] = PartyDish{ID: course.Recipe.ID, Course: course.Course}
+	}
+	portions := partyPortions(dishes, float64(guests))
+	for i, portion := range portions {
+		courses[i].Servings = portion.Servings
+		courses[i].Scale = portion.Servings
+		if servings := courses[i].Recipe.Servings; servings != nil && *servings > 0 {
+			courses[i].Scale = math.Round(portion.Servings/float64(*servings)*100) / 100
+		}
+	}
+	shoppingList, err := buildShoppingList(tenant, portions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, OccasionMenu{
+		Occasion:     key,
+		Name:         occasion.Name,
+		Guests:       guests,
+		Diet:         c.Query("diet"),
+		Courses:      courses,
+		PerGuest:     perGuest,
+		MacroSplit:   macroSplit(perGuest),
+		ShoppingList: shoppingList,
+		Warnings:     warnings,
+	})
+}
+
+var loggingOnce sync.Once
+
+// initLogging installs a JSON slog logger as the process default, which also
+// routes the standard log package through it. LOG_LEVEL picks the minimum
+// level (debug, info, warn, error).
+func initLogging() {
+	loggingOnce.Do(func() {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			level = slog.LevelInfo
+		}
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	})
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// requestLogger returns the logger for the current request, carrying its
+// request ID.
+func requestLogger(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get("logger"); ok {
+		return logger.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+// loggingMiddleware assigns each request an ID (reusing a sane incoming
+// X-Request-ID), echoes it back, and writes one access log line per request.
+func loggingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		c.Header("X-Request-ID", requestID)
+		c.Set("request_id", requestID)
+		c.Set("logger", slog.Default().With("request_id", requestID))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", requestID),
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("api_key", apiKeyID(c)),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", c.Errors.String()))
+		}
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Prometheus metrics, rendered in the text exposition format.
+
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (v *counterVec) add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[strings.Join(labelValues, "\xff")] += delta
+}
+
+func (v *counterVec) inc(labelValues ...string) {
+	v.add(1, labelValues...)
+}
+
+func (v *counterVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %g\n", v.name, formatLabels(v.labels, key, ""), v.values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: defaultLatencyBuckets, series: map[string]*histogram{}}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.series[key] = h
+	}
+	for i, bound := range v.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) since(start time.Time, labelValues ...string) {
+	v.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (v *histogramVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	for _, key := range sortedKeys(v.series) {
+		h := v.series[key]
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, key, strconv.FormatFloat(bound, 'g', -1, 64)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, key, "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", v.name, formatLabels(v.labels, key, ""), h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, key, ""), h.count)
+	}
+}
+
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatLabels(names []string, key string, le string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], value))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	httpRequestsTotal   = newCounterVec("http_requests_total", "HTTP requests by route and status.", "method", "route", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds", "HTTP request latency by route.", "method", "route")
+	dbQueryDuration     = newHistogramVec("db_query_duration_seconds", "Database call latency by operation.", "operation")
+	dbErrorsTotal       = newCounterVec("db_errors_total", "Database calls that returned an error.", "operation")
+	dbRowsScannedTotal  = newCounterVec("db_rows_scanned_total", "Recipe rows read from query results.")
+	dbRowsSkippedTotal  = newCounterVec("db_rows_skipped_total", "Recipe rows left out of results because they failed to scan.")
+	llmRequestDuration  = newHistogramVec("llm_request_duration_seconds", "LLM call latency by model.", "model")
+	llmRequestsTotal    = newCounterVec("llm_requests_total", "LLM calls by model and outcome.", "model", "outcome")
+	cacheLookupsTotal   = newCounterVec("cache_lookups_total", "Cache lookups by cache and result (hit or miss).", "cache", "result")
+	alertsSentTotal     = newCounterVec("saved_search_alerts_total", "Saved search notification attempts by channel and result.", "channel", "result")
+)
+
+func recordCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookupsTotal.inc(cache, result)
+}
+
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestsTotal.inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+		httpRequestDuration.since(start, c.Request.Method, route)
+	}
+}
+
+// responseEncoders render a decoded JSON body in the other media types
+// read endpoints can be asked for with Accept.
+var responseEncoders = map[string]func(w http.ResponseWriter, value interface{}) error{
+	"application/msgpack":   encodeMsgPack,
+	"application/x-msgpack": encodeMsgPack,
+	"application/xml":       encodeXML,
+	"text/xml":              encodeXML,
+}
+
+// encodingWriter holds back a JSON body so negotiateEncoding or
+// formatForLocale can rewrite it. Anything else, such as images or event
+// streams, passes straight through.
+type encodingWriter struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	decided   bool
+	transcode bool
+}
+
+func (w *encodingWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		w.transcode = strings.HasPrefix(w.Header().Get("Content-Type"), binding.MIMEJSON)
+	}
+	if !w.transcode {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.body.Write(data)
+}
+
+func (w *encodingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// negotiateEncoding serves GET responses as MessagePack or XML when the
+// Accept header prefers one over JSON. Handlers keep writing JSON; the
+// body is decoded and re-encoded, so field names and omissions match the
+// JSON exactly.
+func negotiateEncoding() gin.HandlerFunc {
+	offered := []string{binding.MIMEJSON}
+	for mediaType := range responseEncoders {
+		offered = append(offered, mediaType)
+	}
+	sort.Strings(offered[1:])
+
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept")
+		encode, ok := responseEncoders[c.NegotiateFormat(offered...)]
+		if !ok {
+			c.Next()
+			return
+		}
+
+		w := &encodingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		if !w.transcode {
+			return
+		}
+
+		// The JSON goes out as it was if it can't be decoded.
+		raw := w.body.Bytes()
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			requestLogger(c).Error("response re-encoding failed", "error", err)
+			w.ResponseWriter.Write(raw)
+			return
+		}
+		w.Header().Del("Content-Type")
+		if err := encode(w.ResponseWriter, value); err != nil {
+			requestLogger(c).Error("response re-encoding failed", "error", err)
+		}
+	}
+}
+
+// CachePolicy is the Cache-Control for one class of endpoints: MaxAge for
+// browsers, SMaxAge for shared caches such as Vercel's edge, and how long
+// either may serve a stale copy while revalidating. All are in seconds.
+type CachePolicy struct {
+	MaxAge               int `json:"max_age"`
+	SMaxAge              int `json:"s_maxage"`
+	StaleWhileRevalidate int `json:"stale_while_revalidate"`
+}
+
+// header renders the policy. Callers with an API key or token get private
+// responses, so shared caches only hold what every anonymous caller sees.
+func (p CachePolicy) header(private bool) string {
+	if private {
+		return fmt.Sprintf("private, max-age=%d", p.MaxAge)
+	}
+	value := fmt.Sprintf("public, max-age=%d, s-maxage=%d", p.MaxAge, p.SMaxAge)
+	if p.StaleWhileRevalidate > 0 {
+		value += fmt.Sprintf(", stale-while-revalidate=%d", p.StaleWhileRevalidate)
+	}
+	return value
+}
+
+// cacheClasses assigns read endpoints to a CACHE_POLICIES class. Routes
+// not listed, including everything under /users/me, send no policy.
+var cacheClasses = map[string]string{
+	"/api/diet-plans":                             "reference",
+	"/api/stats/ingredients":                      "reference",
+	"/api/stats/nutrition":                        "reference",
+	"/api/recipe/:id":                             "recipe",
+	"/api/recipe/:id/pairings":                    "recipe",
+	"/api/recipe/:id/menu":                        "recipe",
+	"/api/recipe/:id/steps":                       "recipe",
+	"/api/recipe/:id/nutrition-label":             "recipe",
+	"/api/recipes/search":                         "search",
+	"/api/recipes/use-up":                         "search",
+	"/api/recipes/filter-bounds":                  "search",
+	"/api/recipes/featured":                       "search",
+	"/api/collections":                            "recipe",
+	"/api/collections/:slug":                      "recipe",
+	"/api/shopping-list":                          "search",
+	"/api/recipe/:id/comments":                    "search",
+	"/api/recipe/:id/comments/:commentId/replies": "search",
+}
+
+// cachePolicyWriter adds Cache-Control when the headers go out, if the
+// response is a 200 and the handler hasn't set its own.
+type cachePolicyWriter struct {
+	gin.ResponseWriter
+	value string
+}
+
+func (w *cachePolicyWriter) apply() {
+	if !w.Written() && w.Status() == http.StatusOK && w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", w.value)
+	}
+}
+
+func (w *cachePolicyWriter) WriteHeaderNow() {
+	w.apply()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *cachePolicyWriter) Write(data []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *cachePolicyWriter) WriteString(s string) (int, error) {
+	w.apply()
+	return w.ResponseWriter.WriteString(s)
+}
+
+// cacheControl sends the CACHE_POLICIES policy of the route's class on
+// successful GETs, so edge caches can answer repeat reads. Errors are
+// never marked cacheable.
+func cacheControl() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy, ok := cfg.Cache.Policies[cacheClasses[c.FullPath()]]
+		if !ok || (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "X-API-Key, Authorization")
+		private := c.GetHeader("X-API-Key") != "" || c.GetHeader("Authorization") != ""
+		w := &cachePolicyWriter{ResponseWriter: c.Writer, value: policy.header(private)}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+	}
+}
+
+// encodeMsgPack writes a decoded JSON value as MessagePack, with integral
+// numbers as integers.
+func encodeMsgPack(w http.ResponseWriter, value interface{}) error {
+	var convert func(value interface{}) interface{}
+	convert = func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return n
+			}
+			f, _ := v.Float64()
+			return f
+		case map[string]interface{}:
+			for key, item := range v {
+				v[key] = convert(item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				v[i] = convert(item)
+			}
+		}
+		return value
+	}
+	return render.WriteMsgPack(w, convert(value))
+}
+
+// encodeXML writes a decoded JSON value as XML under a <response> root.
+// Object keys become elements in sorted order, array items become <item>
+// elements, and null becomes an empty element marked nil="true". Keys that
+// are not XML names are written as <entry key="...">.
+func encodeXML(w http.ResponseWriter, value interface{}) error {
+	w.Header().Set("Content-Type", binding.MIMEXML+"; charset=utf-8")
+	encoder := xml.NewEncoder(w)
+	var write func(start xml.StartElement, value interface{}) error
+	write = func(start xml.StartElement, value interface{}) error {
+		switch v := value.(type) {
+		case nil:
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "nil"}, Value: "true"})
+			if err := encoder.EncodeToken(start); err != nil {
+				return err
+			}
+		case map[string]interface{}:
+			if err := encoder.EncodeToken(start); err != nil {
+				return err
+			}
+			for _, key := range sortedKeys(v) {
+				child := xml.StartElement{Name: xml.Name{Local: key}}
+				if !xmlNamePattern.MatchString(key) {
+					child = xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}}}
+				}
+				if err := write(child, v[key]); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			if err := encoder.EncodeToken(start); err != nil {
+				return err
+			}
+			for _, item := range v {
+				if err := write(xml.StartElement{Name: xml.Name{Local: "item"}}, item); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := encoder.EncodeToken(start); err != nil {
+				return err
+			}
+			if err := encoder.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	if err := write(xml.StartElement{Name: xml.Name{Local: "response"}}, value); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+// xmlNamePattern matches keys usable as XML element names as they are.
+var xmlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// numberStyle is how a locale writes numbers.
+type numberStyle struct {
+	Decimal string
+	Group   string
+}
+
+// numberStyles is keyed by locale or base language; languages missing here
+// are written the English way.
+var numberStyles = map[string]numberStyle{
+	"en": {".", ","}, "ja": {".", ","}, "zh": {".", ","}, "ko": {".", ","}, "he": {".", ","},
+	"de": {",", "."}, "es": {",", "."}, "it": {",", "."}, "pt": {",", "."}, "nl": {",", "."},
+	"da": {",", "."}, "id": {",", "."}, "tr": {",", "."}, "el": {",", "."},
+	"fr": {",", " "}, "ru": {",", " "}, "uk": {",", " "}, "pl": {",", " "},
+	"cs": {",", " "}, "sv": {",", " "}, "fi": {",", " "}, "nb": {",", " "},
+	"de-CH": {".", "'"}, "pt-BR": {",", "."}, "es-MX": {".", ","},
+}
+
+// kilojouleRegions label food energy in kJ rather than kcal.
+var kilojouleRegions = []string{"AU", "NZ"}
+
+func numberStyleFor(locale string) numberStyle {
+	if style, ok := numberStyles[locale]; ok {
+		return style
+	}
+	base, _, _ := strings.Cut(locale, "-")
+	if style, ok := numberStyles[base]; ok {
+		return style
+	}
+	return numberStyles["en"]
+}
+
+// format writes v with up to decimals places, dropping trailing zeros,
+// and groups thousands.
+func (s numberStyle) format(v float64, decimals int) string {
+	text := strconv.FormatFloat(v, 'f', decimals, 64)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	whole, fraction, hasFraction := strings.Cut(text, ".")
+	sign := ""
+	if strings.HasPrefix(whole, "-") {
+		sign, whole = "-", whole[1:]
+	}
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + s.Group + whole[i:]
+	}
+	if hasFraction {
+		return sign + whole + s.Decimal + fraction
+	}
+	return sign + whole
+}
+
+// measureUnits describes the ingredient units that can be converted: what
+// they measure, their size in grams or millilitres, and their system.
+var measureUnits = map[string]struct {
+	Measure string
+	Size    float64
+	System  string
+}{
+	"cup": {"volume", 236.588, "us"}, "tbsp": {"volume", 14.787, "us"}, "tsp": {"volume", 4.929, "us"},
+	"ml": {"volume", 1, "metric"}, "l": {"volume", 1000, "metric"},
+	"oz": {"mass", 28.3495, "us"}, "lb": {"mass", 453.592, "us"},
+	"g": {"mass", 1, "metric"}, "kg": {"mass", 1000, "metric"},
+}
+
+// unitSystems are the values of units=; imperial is taken to mean US
+// customary.
+var unitSystems = map[string]string{"metric": "metric", "us": "us", "imperial": "us"}
+
+// convertMeasure expresses amount of unit in system, in the largest of the
+// system's units that keeps the amount at least 1, or else the smallest.
+// An empty system keeps the unit. ok is false for units with no
+// conversion, such as cloves or cans.
+func convertMeasure(amount float64, unit, system string) (float64, string, bool) {
+	from, ok := measureUnits[unit]
+	if !ok {
+		return 0, "", false
+	}
+	if system == "" || from.System == system {
+		return amount, unit, true
+	}
+	candidates := []string{}
+	for name, to := range measureUnits {
+		if to.Measure == from.Measure && to.System == system {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return measureUnits[candidates[i]].Size > measureUnits[candidates[j]].Size })
+	base := amount * from.Size
+	for _, name := range candidates {
+		if base/measureUnits[name].Size >= 1 {
+			return base / measureUnits[name].Size, name, true
+		}
+	}
+	smallest := candidates[len(candidates)-1]
+	return base / measureUnits[smallest].Size, smallest, true
+}
+
+// convertIngredientLine rewrites the leading quantity and unit of a line
+// such as "1 1/2 cups milk" into system, formatted for style. Quantities
+// already in system are rewritten only if they have a decimal point to
+// localize. Lines it can't read are returned unchanged.
+func convertIngredientLine(line, system string, style numberStyle) string {
+	fields := strings.Fields(line)
+	amount, used, decimal := 0.0, 0, false
+	for used < len(fields) {
+		qty, ok := parseQuantity(fields[used])
+		if !ok {
+			break
+		}
+		amount += qty
+		decimal = decimal || strings.Contains(fields[used], ".")
+		used++
+	}
+	if used == 0 || used == len(fields) {
+		return line
+	}
+	unit, ok := ingredientUnits[strings.ToLower(strings.TrimSuffix(fields[used], "."))]
+	if !ok {
+		return line
+	}
+	converted, toUnit, ok := convertMeasure(amount, unit, system)
+	if !ok || (toUnit == unit && !decimal) {
+		return line
+	}
+	decimals := 2
+	if toUnit == "g" || toUnit == "ml" {
+		decimals = 0
+	}
+	return style.format(converted, decimals) + " " + toUnit + " " + strings.Join(fields[used+1:], " ")
+}
+
+// nutrientDecimals is how precisely each nutrient is shown.
+var nutrientDecimals = map[string]int{"calories": 0, "protein": 1, "fat": 1, "carbs": 1, "fiber": 1, "sodium": 0}
+
+// formatForLocale adds locale-formatted copies of recipe nutrition and
+// rewrites ingredient quantities with the locale's decimal separator,
+// converting them to metric or US measures with units=, for callers
+// passing lang or units. Handlers are unaware of it: any JSON
+// object carrying nutrition_units is treated as a recipe. Numbers keep
+// their JSON type; the text goes in formatted_nutrition.
+func formatForLocale() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lang, units := c.Query("lang"), c.Query("units")
+		if lang == "" && units == "" {
+			c.Next()
+			return
+		}
+		system, ok := unitSystems[units]
+		if units != "" && !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "units must be metric or us"})
+			return
+		}
+		locale, ok := normalizeLocale(lang)
+		if !ok {
+			locale = sourceLocale
+		}
+		style := numberStyleFor(locale)
+		_, region, _ := strings.Cut(locale, "-")
+		kilojoules := slices.Contains(kilojouleRegions, region)
+
+		w := &encodingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		if !w.transcode {
+			return
+		}
+
+		raw := w.body.Bytes()
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			requestLogger(c).Error("response formatting failed", "error", err)
+			w.ResponseWriter.Write(raw)
+			return
+		}
+
+		var walk func(value interface{})
+		walk = func(value interface{}) {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				if nutrientUnits, ok := v["nutrition_units"].(map[string]interface{}); ok {
+					formatted := map[string]string{}
+					for nutrient, unit := range nutrientUnits {
+						number, ok := v[nutrient].(json.Number)
+						if !ok {
+							continue
+						}
+						amount, _ := number.Float64()
+						unitName := fmt.Sprint(unit)
+						if nutrient == "calories" && kilojoules {
+							amount, unitName = amount*4.184, "kJ"
+						}
+						formatted[nutrient] = style.format(amount, nutrientDecimals[nutrient]) + " " + unitName
+					}
+					v["formatted_nutrition"] = formatted
+					if ingredients, ok := v["ingredients"].([]interface{}); ok {
+						for i, line := range ingredients {
+							if text, ok := line.(string); ok {
+								ingredients[i] = convertIngredientLine(text, system, style)
+							}
+						}
+					}
+					if system != "" {
+						v["units"] = system
+					}
+				}
+				for _, item := range v {
+					walk(item)
+				}
+			case []interface{}:
+				for _, item := range v {
+					walk(item)
+				}
+			}
+		}
+		walk(value)
+
+		body, err := json.Marshal(value)
+		if err != nil {
+			requestLogger(c).Error("response formatting failed", "error", err)
+			w.ResponseWriter.Write(raw)
+			return
+		}
+		if lang != "" {
+			c.Header("Content-Language", locale)
+		}
+		w.ResponseWriter.Write(body)
+	}
+}
+
+// handleMetrics serves the registry. Set METRICS_TOKEN to require it as a
+// bearer token.
+func handleMetrics(c *gin.Context) {
+	if token := cfg.MetricsToken; token != "" && subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(http.StatusOK)
+	for _, metric := range []interface{ write(io.Writer) }{
+		httpRequestsTotal, httpRequestDuration,
+		dbQueryDuration, dbErrorsTotal, dbRowsScannedTotal, dbRowsSkippedTotal,
+		llmRequestDuration, llmRequestsTotal,
+		cacheLookupsTotal,
+		alertsSentTotal,
+	} {
+		metric.write(c.Writer)
+	}
+}
+
+// instrumentedDB times every query and counts errors for /metrics. It
+// embeds *sql.DB so the rest of the pool API is unchanged.
+type instrumentedDB struct {
+	*sql.DB
+	stmts sync.Map
+}
+
+// sqlExecutor is the part of *instrumentedDB and *sql.Tx the recipe
+// writers use, so they run alone or inside a caller's transaction.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func sqlOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToLower(fields[0])
+}
+
+func (d *instrumentedDB) observe(query string, start time.Time, err error) {
+	operation := sqlOperation(query)
+	dbQueryDuration.since(start, operation)
+	if err != nil && err != sql.ErrNoRows {
+		dbErrorsTotal.inc(operation)
+	}
+}
+
+func (d *instrumentedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := d.DB.Query(query, args...)
+	d.observe(query, start, err)
+	return rows, err
+}
+
+func (d *instrumentedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := d.DB.QueryRow(query, args...)
+	d.observe(query, start, row.Err())
+	return row
+}
+
+func (d *instrumentedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := d.DB.Exec(query, args...)
+	d.observe(query, start, err)
+	return res, err
+}
+
+// prepared returns the cached statement for query, preparing it on first
+// use. database/sql prepares it again on each connection that runs it.
+func (d *instrumentedDB) prepared(query string) (*sql.Stmt, error) {
+	if stmt, ok := d.stmts.Load(query); ok {
+		return stmt.(*sql.Stmt), nil
+	}
+	stmt, err := d.DB.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if existing, loaded := d.stmts.LoadOrStore(query, stmt); loaded {
+		stmt.Close()
+		return existing.(*sql.Stmt), nil
+	}
+	return stmt, nil
+}
+
+// QueryPrepared is Query through a cached prepared statement, for hot
+// queries of a fixed shape. A statement that can't be prepared runs
+// unprepared.
+func (d *instrumentedDB) QueryPrepared(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	var rows *sql.Rows
+	stmt, err := d.prepared(query)
+	if err == nil {
+		rows, err = stmt.Query(args...)
+	} else {
+		rows, err = d.DB.Query(query, args...)
+	}
+	d.observe(query, start, err)
+	return rows, err
+}
+
+func (d *instrumentedDB) QueryRowPrepared(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	var row *sql.Row
+	if stmt, err := d.prepared(query); err == nil {
+		row = stmt.QueryRow(args...)
+	} else {
+		row = d.DB.QueryRow(query, args...)
+	}
+	d.observe(query, start, row.Err())
+	return row
+}
+
+// allowedCORSOrigin returns the Access-Control-Allow-Origin value for a
+// request origin, or "" when the origin isn't allowed.
+func allowedCORSOrigin(origin string) string {
+	for _, allowed := range cfg.CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Recipe moderation statuses. Only published recipes are visible through the
+// public API and MCP tools; rejected recipes go back to draft with a reason.
+const (
+	recipeStatusDraft     = "draft"
+	recipeStatusPending   = "pending"
+	recipeStatusPublished = "published"
+)
+
+// ModerationItem is a recipe as seen by moderators, including its status.
+type ModerationItem struct {
+	Recipe
+	AIGenerated     bool       `json:"ai_generated"`
+	Status          string     `json:"status"`
+	StatusReason    *string    `json:"status_reason"`
+	StatusUpdatedAt *time.Time `json:"status_updated_at"`
+	DeletedAt       *time.Time `json:"deleted_at"`
+	// SubmittedBy is the caller who submitted the recipe, if a user did.
+	SubmittedBy *string `json:"submitted_by"`
+}
+
+type RejectRecipeRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// listModerationRecipes lists recipes in one status, or soft-deleted recipes
+// of any status when deleted=true.
+func listModerationRecipes(c *gin.Context) {
+	deleted := c.Query("deleted") == "true"
+	status := c.DefaultQuery("status", recipeStatusPending)
+	if deleted {
+		status = c.Query("status")
+	}
+	if status != "" && status != recipeStatusDraft && status != recipeStatusPending && status != recipeStatusPublished {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be draft, pending or published"})
+		return
+	}
+
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+
+	query := "SELECT id, name, description, ai_generated, status, status_reason, status_updated_at, deleted_at, submitted_by FROM recipes WHERE deleted_at IS NULL"
+	order := " ORDER BY COALESCE(status_updated_at, '1970-01-01') DESC, id DESC"
+	if deleted {
+		query = "SELECT id, name, description, ai_generated, status, status_reason, status_updated_at, deleted_at, submitted_by FROM recipes WHERE deleted_at IS NOT NULL"
+		order = " ORDER BY deleted_at DESC, id DESC"
+	}
+	args := []interface{}{}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query+order+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	items := []ModerationItem{}
+	for rows.Next() {
+		var item ModerationItem
+		if err := rows.Scan(&item.ID, &item.Name, &item.Description, &item.AIGenerated,
+			&item.Status, &item.StatusReason, &item.StatusUpdatedAt, &item.DeletedAt, &item.SubmittedBy); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recipes": items,
+		"count":   len(items),
+		"status":  status,
+		"deleted": deleted,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+func getModerationRecipe(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	recipes, err := selectRecipes().Where("id = ?", id).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	item := ModerationItem{Recipe: recipes[0]}
+	if err := loadRecipeImages(&item.Recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRecipeEquipment(&item.Recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = db.QueryRow("SELECT ai_generated, status, status_reason, status_updated_at, deleted_at, submitted_by FROM recipes WHERE id = ?", id).
+		Scan(&item.AIGenerated, &item.Status, &item.StatusReason, &item.StatusUpdatedAt, &item.DeletedAt, &item.SubmittedBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// transitionRecipe moves a recipe from one of the allowed statuses to the
+// target one and reports the outcome as the HTTP response.
+func transitionRecipe(c *gin.Context, from []string, to string, reason *string) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	placeholders := make([]string, len(from))
+	args := []interface{}{to, reason, id}
+	for i, status := range from {
+		placeholders[i] = "?"
+		args = append(args, status)
+	}
+
+	res, err := db.Exec("UPDATE recipes SET status = ?, status_reason = ?, status_updated_at = NOW() WHERE id = ? AND deleted_at IS NULL AND status IN ("+strings.Join(placeholders, ",")+")", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var current string
+		err := db.QueryRow("SELECT status FROM recipes WHERE id = ? AND deleted_at IS NULL", id).Scan(&current)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot move a %s recipe to %s", current, to)})
+		return
+	}
+
+	// Publishing or unpublishing changes what resources/list returns.
+	if to == recipeStatusPublished || from[len(from)-1] == recipeStatusPublished {
+		notifyMCPListChanged("resources")
+	}
+	if to == recipeStatusPublished {
+		go matchSavedSearches(id)
+	}
+
+	requestLogger(c).Info("recipe status changed", "recipe_id", id, "status", to, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "status": to, "status_reason": reason})
+}
+
+func submitRecipe(c *gin.Context) {
+	transitionRecipe(c, []string{recipeStatusDraft}, recipeStatusPending, nil)
+}
+
+func approveRecipe(c *gin.Context) {
+	transitionRecipe(c, []string{recipeStatusPending}, recipeStatusPublished, nil)
+}
+
+func rejectRecipe(c *gin.Context) {
+	var req RejectRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A rejection reason is required"})
+		return
+	}
+	reason := strings.TrimSpace(req.Reason)
+	transitionRecipe(c, []string{recipeStatusPending, recipeStatusPublished}, recipeStatusDraft, &reason)
+}
+
+// deleteRecipe soft-deletes a recipe. The row is kept so it can be restored,
+// but every public query filters it out.
+func deleteRecipe(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	res, err := db.Exec("UPDATE recipes SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	notifyMCPListChanged("resources")
+
+	requestLogger(c).Info("recipe deleted", "recipe_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+func restoreRecipe(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	res, err := db.Exec("UPDATE recipes SET deleted_at = NULL, merged_into = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted recipe not found"})
+		return
+	}
+	notifyMCPListChanged("resources")
+
+	requestLogger(c).Info("recipe restored", "recipe_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": false})
+}
+
+// Limits on user submissions, which moderators have to read in full. The
+// pending cap is per issued key; any other key counts against its IP, so
+// a fresh header doesn't buy another 20.
+const (
+	maxPendingSubmissions  = 20
+	maxSubmissionLines     = 100
+	maxSubmissionNameBytes = 255
+)
+
+// RecipeSubmission is a recipe as written by a user. Nutrition is not
+// taken from the submitter; it is estimated from the ingredients.
+type RecipeSubmission struct {
+	Name             string   `json:"name" binding:"required"`
+	Description      string   `json:"description"`
+	PrepTimeMinutes  *int     `json:"prep_time_minutes"`
+	CookTimeMinutes  *int     `json:"cook_time_minutes"`
+	TotalTimeMinutes *int     `json:"total_time_minutes"`
+	Servings         *int     `json:"servings"`
+	Ingredients      []string `json:"ingredients" binding:"required"`
+	Instructions     []string `json:"instructions" binding:"required"`
+}
+
+// validate trims the submission and reports what is wrong with it.
+func (s *RecipeSubmission) validate() []string {
+	problems := []string{}
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" || len(s.Name) > maxSubmissionNameBytes {
+		problems = append(problems, fmt.Sprintf("name must be 1-%d bytes", maxSubmissionNameBytes))
+	}
+	clean := func(lines []string) []string {
+		kept := []string{}
+		for _, line := range lines {
+			if line = strings.TrimSpace(line); line != "" {
+				kept = append(kept, line)
+			}
+		}
+		return kept
+	}
+	s.Ingredients, s.Instructions = clean(s.Ingredients), clean(s.Instructions)
+	if len(s.Ingredients) == 0 || len(s.Ingredients) > maxSubmissionLines {
+		problems = append(problems, fmt.Sprintf("ingredients must have 1-%d lines", maxSubmissionLines))
+	}
+	if len(s.Instructions) == 0 || len(s.Instructions) > maxSubmissionLines {
+		problems = append(problems, fmt.Sprintf("instructions must have 1-%d steps", maxSubmissionLines))
+	}
+	for name, value := range map[string]*int{"prep_time_minutes": s.PrepTimeMinutes, "cook_time_minutes": s.CookTimeMinutes, "total_time_minutes": s.TotalTimeMinutes, "servings": s.Servings} {
+		if value != nil && *value < 0 {
+			problems = append(problems, name+" must not be negative")
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Submission is a user's recipe with its place in the review queue. A
+// rejected submission is back in draft with the moderator's reason.
+type Submission struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Status          string     `json:"status"`
+	StatusReason    *string    `json:"status_reason"`
+	StatusUpdatedAt *time.Time `json:"status_updated_at"`
+	Recipe          *Recipe    `json:"recipe,omitempty"`
+}
+
+// createSubmission files a user's recipe for review. Derived fields, and
+// nutrition, are computed as for any new recipe; an estimate that can't be
+// made leaves nutrition empty for the moderator to see.
+func createSubmission(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	var req RecipeSubmission
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if problems := req.validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe", "problems": problems})
+		return
+	}
+
+	from, issued := verifiedCallerID(c)
+	limitColumn, limitKey := "submitted_by", owner
+	if !issued {
+		limitColumn, limitKey = "submitted_from", from
+	}
+	var pending int
+	if err := db.QueryRow("SELECT COUNT(*) FROM recipes WHERE "+limitColumn+" = ? AND status = ? AND deleted_at IS NULL", limitKey, recipeStatusPending).Scan(&pending); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if pending >= maxPendingSubmissions {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("At most %d submissions can await review at once", maxPendingSubmissions)})
+		return
+	}
+
+	recipe := Recipe{
+		Name: req.Name, Description: req.Description,
+		PrepTimeMinutes: req.PrepTimeMinutes, CookTimeMinutes: req.CookTimeMinutes, TotalTimeMinutes: req.TotalTimeMinutes,
+		Servings: req.Servings, Ingredients: req.Ingredients, Instructions: req.Instructions,
+	}
+	if tenant := tenantFromContext(c); tenant != nil {
+		recipe.TenantID = &tenant.ID
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	id, err := insertRecipeTx(tx, recipe, recipeStatusPending, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := tx.Exec("UPDATE recipes SET submitted_by = ?, submitted_from = ? WHERE id = ?", owner, from, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := reindexRecipe(c.Request.Context(), id); err != nil {
+		requestLogger(c).Warn("submission reindex failed", "recipe_id", id, "error", err)
+	}
+	requestLogger(c).Info("recipe submitted", "recipe_id", id)
+	c.Header("Location", fmt.Sprintf("/api/users/me/recipes/%d", id))
+	submission, err := loadSubmission(owner, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, submission)
+}
+
+// Importing a recipe from a photo takes two model calls: the vision model
+// transcribes the page, then the text model sorts the transcript into a
+// submission. Nothing is stored; the caller corrects the draft and posts
+// it to /api/users/me/recipes.
+const transcribeRecipePrompt = `Transcribe the recipe in this photo of a cookbook page or handwritten card exactly as written, keeping its line breaks. Include the title, any notes, times and servings, the ingredient list and the method. Do not add, fix or explain anything. If there is no recipe in the photo, respond with an empty message.`
+
+const structureRecipePrompt = `You turn recipe text into structured data. Use only what the text says; leave a field null when the text doesn't give it.
+
+Respond ONLY with a JSON object with these fields:
+{"name": string, "description": string, "prep_time_minutes": int or null, "cook_time_minutes": int or null,
+ "total_time_minutes": int or null, "servings": int or null, "ingredients": [string], "instructions": [string]}
+
+Each ingredient is one line with its quantity as written. Each instruction is one step; split a paragraph of method into its steps.`
+
+// structureRecipeText asks the LLM to read recipe text into a submission.
+func structureRecipeText(ctx context.Context, text string) (RecipeSubmission, llmResult, error) {
+	var draft RecipeSubmission
+	result, err := callLLM(ctx, []map[string]interface{}{
+		{"role": "system", "content": structureRecipePrompt},
+		{"role": "user", "content": text},
+	})
+	if err != nil {
+		return draft, result, err
+	}
+	if err := json.Unmarshal([]byte(extractJSONObject(result.Content)), &draft); err != nil {
+		return draft, result, fmt.Errorf("model returned an invalid recipe: %w", err)
+	}
+	return draft, result, nil
+}
+
+// importRecipeImage reads a photographed recipe into a draft submission,
+// with the transcript so the caller can check what the model read.
+func importRecipeImage(c *gin.Context) {
+	if !featureEnabled(c, "llm_vision") || llmBudgetExceeded(c) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Recipe import is unavailable"})
+		return
+	}
+	data, contentType, ok := readUploadedImage(c)
+	if !ok {
+		return
+	}
+
+	result, err := callVisionLLM(c.Request.Context(), transcribeRecipePrompt, data, contentType)
+	recordLLMUsage(c, "recipes/import-image", result)
+	if err != nil {
+		requestLogger(c).Warn("recipe transcription failed", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Recipe import is unavailable"})
+		return
+	}
+	transcript := strings.TrimSpace(result.Content)
+	if transcript == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "No recipe found in the image"})
+		return
+	}
+
+	draft, result, err := structureRecipeText(c.Request.Context(), transcript)
+	recordLLMUsage(c, "recipes/import-image", result)
+	if errors.Is(err, errLLMUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Recipe import is unavailable"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not read a recipe from the image", "transcript": transcript})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"draft":      draft,
+		"transcript": transcript,
+		"problems":   draft.validate(),
+		"submit_url": "/api/users/me/recipes",
+	})
+}
+
+// FieldConfidence is how sure parse-text is of one field and where its
+// value came from: heuristic, llm, both (they agreed) or missing.
+type FieldConfidence struct {
+	Source     string  `json:"source"`
+	Confidence float64 `json:"confidence"`
+}
+
+type ParseTextRequest struct {
+	Text   string `json:"text" binding:"required"`
+	UseLLM *bool  `json:"use_llm"`
+}
+
+// Parse-text limits. Fields the heuristics are less sure of than
+// confidentParse are sent to the LLM for a second reading.
+const (
+	maxParseTextBytes = 20000
+	confidentParse    = 0.8
+)
+
+var (
+	markdownHeadingPattern     = regexp.MustCompile(`^#{1,6}\s+`)
+	listMarkerPattern          = regexp.MustCompile(`^(?:[-*+•]|(?:step\s*)?\d{1,2}[.):])\s+`)
+	ingredientsHeadingPattern  = regexp.MustCompile(`(?i)^(ingredients?|you(?:'ll)? need|what you need)\b`)
+	instructionsHeadingPattern = regexp.MustCompile(`(?i)^(instructions?|method|directions?|steps|preparation|how to make(?: it)?)\b`)
+	recipeServingsPattern      = regexp.MustCompile(`(?i)^(?:serves|servings?|yield|makes)\s*:?\s*(\d{1,3})\b`)
+	recipeTimePattern          = regexp.MustCompile(`(?i)^(prep(?:aration)?|cook(?:ing)?|total)(?:\s+time\s*:?|\s*:)\s*(.+)$`)
+	markdownEmphasis           = strings.NewReplacer("**", "", "__", "", "`", "")
+)
+
+// textMinutes adds up the durations in text like "1 hour 20 minutes".
+func textMinutes(text string) *int {
+	seconds := 0
+	for _, timer := range parseCookingStep(0, text).Timers {
+		seconds += timer.Seconds
+	}
+	if seconds == 0 {
+		return nil
+	}
+	minutes := (seconds + 59) / 60
+	return &minutes
+}
+
+// readRecipeText reads pasted recipe text or Markdown with heuristics: a
+// title heading or first line, "Ingredients" and "Method" style sections,
+// list markers, and "Serves 4" or "Prep time: 15 min" lines. Text without
+// sections is split on whether lines start with a quantity, with lower
+// confidence.
+func readRecipeText(text string) (RecipeSubmission, map[string]FieldConfidence) {
+	var draft RecipeSubmission
+	confidence := map[string]FieldConfidence{}
+	found := func(field string, value float64) {
+		if _, ok := confidence[field]; !ok {
+			confidence[field] = FieldConfidence{Source: "heuristic", Confidence: value}
+		}
+	}
+
+	const (
+		sectionNone = iota
+		sectionIngredients
+		sectionInstructions
+	)
+	section := sectionNone
+	description := []string{}
+	sawHeadings := false
+	continues := false
+	for _, raw := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line := strings.TrimSpace(markdownEmphasis.Replace(raw))
+		if line == "" {
+			continues = false
+			continue
+		}
+		heading := markdownHeadingPattern.MatchString(line)
+		line = strings.TrimSpace(markdownHeadingPattern.ReplaceAllString(line, ""))
+		listItem := listMarkerPattern.MatchString(line)
+		line = strings.TrimSpace(listMarkerPattern.ReplaceAllString(line, ""))
+		short := len(line) <= 40
+
+		label := strings.TrimSuffix(line, ":")
+		if short && ingredientsHeadingPattern.MatchString(label) && !listItem {
+			section, sawHeadings, continues = sectionIngredients, true, false
+			continue
+		}
+		if short && instructionsHeadingPattern.MatchString(label) && !listItem {
+			section, sawHeadings, continues = sectionInstructions, true, false
+			continue
+		}
+		if m := recipeServingsPattern.FindStringSubmatch(line); m != nil && len(line) <= 60 {
+			servings, _ := strconv.Atoi(m[1])
+			draft.Servings = &servings
+			found("servings", 0.9)
+			continue
+		}
+		if m := recipeTimePattern.FindStringSubmatch(line); m != nil && len(line) <= 60 {
+			if minutes := textMinutes(m[2]); minutes != nil {
+				switch strings.ToLower(m[1])[0] {
+				case 'p':
+					draft.PrepTimeMinutes = minutes
+					found("prep_time_minutes", 0.9)
+				case 'c':
+					draft.CookTimeMinutes = minutes
+					found("cook_time_minutes", 0.9)
+				case 't':
+					draft.TotalTimeMinutes = minutes
+					found("total_time_minutes", 0.9)
+				}
+				continue
+			}
+		}
+
+		switch {
+		case draft.Name == "" && section == sectionNone:
+			draft.Name = line
+			if heading {
+				found("name", 0.9)
+			} else {
+				found("name", 0.6)
+			}
+		case section == sectionIngredients:
+			// "For the sauce:" groups ingredients; it isn't one.
+			if strings.HasSuffix(line, ":") && parseIngredientLine(line).Quantity == 0 {
+				continue
+			}
+			draft.Ingredients = append(draft.Ingredients, line)
+		case section == sectionInstructions:
+			// A step wrapped over several lines continues until a blank
+			// line or the next list item.
+			if continues && !listItem && len(draft.Instructions) > 0 {
+				draft.Instructions[len(draft.Instructions)-1] += " " + line
+			} else {
+				draft.Instructions = append(draft.Instructions, line)
+			}
+			continues = true
+		case heading:
+			// An unrecognized heading before any section, like a
+			// chapter or a "Notes" heading, carries no field.
+		case listItem && len(line) > 60, len(draft.Instructions) > 0:
+			draft.Instructions = append(draft.Instructions, line)
+		case parseIngredientLine(line).Quantity > 0 && len(line) <= 80:
+			draft.Ingredients = append(draft.Ingredients, line)
+		case len(draft.Ingredients) == 0:
+			description = append(description, line)
+		default:
+			draft.Instructions = append(draft.Instructions, line)
+		}
+	}
+	draft.Description = strings.Join(description, " ")
+	if draft.Description != "" {
+		found("description", 0.5)
+	}
+
+	// Listed ingredients without a quantity are less likely to be
+	// ingredients at all.
+	if n := len(draft.Ingredients); n > 0 {
+		quantified := 0
+		for _, line := range draft.Ingredients {
+			if parseIngredientLine(line).Quantity > 0 {
+				quantified++
+			}
+		}
+		share := float64(quantified) / float64(n)
+		if sawHeadings {
+			found("ingredients", 0.7+0.25*share)
+		} else {
+			found("ingredients", 0.3+0.3*share)
+		}
+	}
+	if len(draft.Instructions) > 0 {
+		if sawHeadings {
+			found("instructions", 0.9)
+		} else {
+			found("instructions", 0.5)
+		}
+	}
+	for _, field := range []string{"name", "description", "prep_time_minutes", "cook_time_minutes", "total_time_minutes", "servings", "ingredients", "instructions"} {
+		if _, ok := confidence[field]; !ok {
+			confidence[field] = FieldConfidence{Source: "missing"}
+		}
+	}
+	return draft, confidence
+}
+
+// mergeParsedRecipe fills draft from the LLM's reading wherever the
+// heuristics were unsure. Agreement raises confidence; a confident
+// heuristic the LLM disagrees with is kept with less.
+func mergeParsedRecipe(draft *RecipeSubmission, llm RecipeSubmission, confidence map[string]FieldConfidence) {
+	merge := func(field string, have, agree bool, take func()) {
+		current := confidence[field]
+		switch {
+		case current.Source == "missing" && !have:
+		case current.Source != "missing" && agree:
+			confidence[field] = FieldConfidence{Source: "both", Confidence: math.Max(current.Confidence, 0.95)}
+		case current.Confidence >= confidentParse:
+			if have {
+				current.Confidence -= 0.2
+				confidence[field] = current
+			}
+		case have:
+			take()
+			confidence[field] = FieldConfidence{Source: "llm", Confidence: 0.7}
+		}
+	}
+	sameText := func(a, b string) bool {
+		return strings.EqualFold(strings.Join(strings.Fields(a), " "), strings.Join(strings.Fields(b), " "))
+	}
+	sameInt := func(a, b *int) bool { return a != nil && b != nil && *a == *b }
+
+	merge("name", strings.TrimSpace(llm.Name) != "", sameText(draft.Name, llm.Name), func() { draft.Name = llm.Name })
+	merge("description", strings.TrimSpace(llm.Description) != "", sameText(draft.Description, llm.Description), func() { draft.Description = llm.Description })
+	merge("prep_time_minutes", llm.PrepTimeMinutes != nil, sameInt(draft.PrepTimeMinutes, llm.PrepTimeMinutes), func() { draft.PrepTimeMinutes = llm.PrepTimeMinutes })
+	merge("cook_time_minutes", llm.CookTimeMinutes != nil, sameInt(draft.CookTimeMinutes, llm.CookTimeMinutes), func() { draft.CookTimeMinutes = llm.CookTimeMinutes })
+	merge("total_time_minutes", llm.TotalTimeMinutes != nil, sameInt(draft.TotalTimeMinutes, llm.TotalTimeMinutes), func() { draft.TotalTimeMinutes = llm.TotalTimeMinutes })
+	merge("servings", llm.Servings != nil, sameInt(draft.Servings, llm.Servings), func() { draft.Servings = llm.Servings })
+	// Lists agree when they have as many lines; wording differs too
+	// easily to compare line by line.
+	merge("ingredients", len(llm.Ingredients) > 0, len(draft.Ingredients) == len(llm.Ingredients), func() { draft.Ingredients = llm.Ingredients })
+	merge("instructions", len(llm.Instructions) > 0, len(draft.Instructions) == len(llm.Instructions), func() { draft.Instructions = llm.Instructions })
+}
+
+// parseRecipeText turns pasted recipe text into a draft submission with a
+// confidence for each field. The LLM is only asked when the name,
+// ingredients or instructions are unsure, since many recipes simply have
+// no description or times; its failure leaves the heuristic reading.
+func parseRecipeText(c *gin.Context) {
+	var req ParseTextRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if len(req.Text) > maxParseTextBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("text must be at most %d bytes", maxParseTextBytes)})
+		return
+	}
+
+	draft, confidence := readRecipeText(req.Text)
+	unsure := false
+	for _, field := range []string{"name", "ingredients", "instructions"} {
+		if confidence[field].Confidence < confidentParse {
+			unsure = true
+		}
+	}
+
+	llmStatus := "not_needed"
+	switch {
+	case !unsure:
+	case req.UseLLM != nil && !*req.UseLLM:
+		llmStatus = "skipped"
+	case !featureEnabled(c, "llm_parse_text") || llmBudgetExceeded(c):
+		llmStatus = "unavailable"
+	default:
+		llm, result, err := structureRecipeText(c.Request.Context(), req.Text)
+		recordLLMUsage(c, "recipes/parse-text", result)
+		if err != nil {
+			requestLogger(c).Warn("recipe text structuring failed", "error", err)
+			llmStatus = "unavailable"
+			break
+		}
+		mergeParsedRecipe(&draft, llm, confidence)
+		llmStatus = "used"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"draft":      draft,
+		"confidence": confidence,
+		"llm":        llmStatus,
+		"problems":   draft.validate(),
+		"submit_url": "/api/users/me/recipes",
+	})
+}
+
+// loadSubmission returns one of owner's submissions with the recipe as
+// stored, or sql.ErrNoRows.
+func loadSubmission(owner string, id int) (Submission, error) {
+	var submission Submission
+	err := db.QueryRow("SELECT id, name, status, status_reason, status_updated_at FROM recipes WHERE id = ? AND submitted_by = ? AND deleted_at IS NULL", id, owner).
+		Scan(&submission.ID, &submission.Name, &submission.Status, &submission.StatusReason, &submission.StatusUpdatedAt)
+	if err != nil {
+		return submission, err
+	}
+	recipe, err := selectRecipes().Where("id = ?", id).One()
+	if err != nil {
+		return submission, err
+	}
+	if err := loadNutritionEstimate(&recipe); err != nil {
+		return submission, err
+	}
+	submission.Recipe = &recipe
+	return submission, nil
+}
+
+func listSubmissions(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	rows, err := db.Query("SELECT id, name, status, status_reason, status_updated_at FROM recipes WHERE submitted_by = ? AND deleted_at IS NULL ORDER BY id DESC", owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	submissions := []Submission{}
+	for rows.Next() {
+		var submission Submission
+		if err := rows.Scan(&submission.ID, &submission.Name, &submission.Status, &submission.StatusReason, &submission.StatusUpdatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		submissions = append(submissions, submission)
+	}
+	c.JSON(http.StatusOK, gin.H{"submissions": submissions, "count": len(submissions)})
+}
+
+func getSubmission(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	submission, err := loadSubmission(owner, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Submission not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, submission)
+}
+
+// updateSubmission replaces an unpublished submission and puts it back in
+// the queue, which is how a rejected recipe is revised and resubmitted.
+// Published recipes belong to the catalog and can't be edited this way.
+func updateSubmission(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req RecipeSubmission
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if problems := req.validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe", "problems": problems})
+		return
+	}
+
+	ingredientsJSON, _ := json.Marshal(req.Ingredients)
+	instructionsJSON, _ := json.Marshal(req.Instructions)
+	res, err := db.Exec(`UPDATE recipes SET name = ?, description = ?, prep_time_minutes = ?, cook_time_minutes = ?, total_time_minutes = ?, servings = ?,
+		ingredients = ?, instructions = ?, difficulty = NULL, calories = NULL, protein = NULL, fat = NULL, carbs = NULL, fiber = NULL, sodium = NULL,
+		nutrition_estimated = FALSE, nutrition_confidence = NULL, status = ?, status_reason = NULL, status_updated_at = NOW()
+		WHERE id = ? AND submitted_by = ? AND deleted_at IS NULL AND status <> ?`,
+		req.Name, req.Description, req.PrepTimeMinutes, req.CookTimeMinutes, req.TotalTimeMinutes, req.Servings,
+		string(ingredientsJSON), string(instructionsJSON), recipeStatusPending, id, owner, recipeStatusPublished)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		submission, err := loadSubmission(owner, id)
+		switch {
+		case err == sql.ErrNoRows:
+			c.JSON(http.StatusNotFound, gin.H{"error": "Submission not found"})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A %s recipe can't be edited", submission.Status)})
+		}
+		return
+	}
+	if _, err := reindexRecipe(c.Request.Context(), id); err != nil {
+		requestLogger(c).Warn("submission reindex failed", "recipe_id", id, "error", err)
+	}
+	requestLogger(c).Info("recipe resubmitted", "recipe_id", id)
+	submission, err := loadSubmission(owner, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, submission)
+}
+
+// uploadSubmissionImage sets the photo of an unpublished submission.
+func uploadSubmissionImage(c *gin.Context) {
+	if cfg.Storage.Bucket == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image storage is not configured"})
+		return
+	}
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var status string
+	err = db.QueryRow("SELECT status FROM recipes WHERE id = ? AND submitted_by = ? AND deleted_at IS NULL", id, owner).Scan(&status)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Submission not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if status == recipeStatusPublished {
+		c.JSON(http.StatusConflict, gin.H{"error": "A published recipe can't be edited"})
+		return
+	}
+
+	upload, ok := storeUploadedImage(c, id)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec("UPDATE recipes SET image = ?, image_status = NULL, image_failures = 0, image_checked_at = NULL WHERE id = ?", upload.URL, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": id, "image": upload.URL, "content_type": upload.ContentType, "size": upload.Size})
+}
+
+// reportReasons are the categories a recipe can be reported under.
+var reportReasons = []string{"spam", "offensive", "incorrect", "unsafe", "copyright", "other"}
+
+// Report triage. A recipe reported by reportHideThreshold different
+// issued keys is taken out of the catalog until a moderator resolves the
+// reports; dismissing them puts it back. Other reports, filed per IP, go
+// to the moderators but never hide anything on their own.
+const (
+	reportHideThreshold = 3
+	reportHiddenReason  = "Hidden pending review of reports"
+	maxReportDetails    = 2000
+)
+
+// Report resolutions, set when a moderator closes a recipe's open reports.
+const (
+	reportDismissed = "dismissed"
+	reportHidden    = "hidden"
+	reportRemoved   = "removed"
+)
+
+type ReportRecipeRequest struct {
+	Reason  string `json:"reason" binding:"required"`
+	Details string `json:"details"`
+}
+
+type RecipeReport struct {
+	ID             int64      `json:"id"`
+	RecipeID       int        `json:"recipe_id"`
+	RecipeName     string     `json:"recipe_name"`
+	Reporter       string     `json:"reporter"`
+	Reason         string     `json:"reason"`
+	Details        string     `json:"details"`
+	Status         string     `json:"status"`
+	Resolution     *string    `json:"resolution"`
+	ResolutionNote *string    `json:"resolution_note"`
+	ResolvedBy     *string    `json:"resolved_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+}
+
+// reportRecipe files a report against a recipe the caller can see. A
+// caller has at most one open report per recipe; reporting again updates
+// it.
+func reportRecipe(c *gin.Context) {
+	if _, ok := apiKeyOwner(c); !ok {
+		return
+	}
+	reporter, issued := verifiedCallerID(c)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req ReportRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if !slices.Contains(reportReasons, req.Reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be one of " + strings.Join(reportReasons, ", ")})
+		return
+	}
+	req.Details = strings.TrimSpace(req.Details)
+	if len(req.Details) > maxReportDetails {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("details must be at most %d bytes", maxReportDetails)})
+		return
+	}
+	visible, err := recipeVisible(tenantFromContext(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !visible {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO recipe_reports (recipe_id, reporter, reason, details, issued) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE reason = VALUES(reason), details = VALUES(details), created_at = NOW()`,
+		id, reporter, req.Reason, req.Details, issued)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("recipe reported", "recipe_id", id, "reason", req.Reason, "issued", issued)
+
+	var reporters int
+	if err := db.QueryRow("SELECT COUNT(DISTINCT reporter) FROM recipe_reports WHERE recipe_id = ? AND status = 'open' AND issued", id).Scan(&reporters); err != nil {
+		requestLogger(c).Error("report count failed", "recipe_id", id, "error", err)
+	} else if reporters >= reportHideThreshold {
+		res, err := db.Exec("UPDATE recipes SET status = ?, status_reason = ?, status_updated_at = NOW() WHERE id = ? AND status = ?",
+			recipeStatusPending, reportHiddenReason, id, recipeStatusPublished)
+		if err != nil {
+			requestLogger(c).Error("hiding reported recipe failed", "recipe_id", id, "error", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			notifyMCPListChanged("resources")
+			requestLogger(c).Warn("reported recipe hidden", "recipe_id", id, "reporters", reporters)
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"recipe_id": id, "reason": req.Reason, "status": "open"})
+}
+
+// listReports lists reports in one status, open by default, with the
+// recipes reported most often first.
+func listReports(c *gin.Context) {
+	status := c.DefaultQuery("status", "open")
+	if status != "open" && status != "resolved" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open or resolved"})
+		return
+	}
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+
+	query := `SELECT p.id, p.recipe_id, r.name, p.reporter, p.reason, p.details, p.status, p.resolution, p.resolution_note, p.resolved_by, p.created_at, p.resolved_at
+		FROM recipe_reports p JOIN recipes r ON r.id = p.recipe_id
+		WHERE p.status = ?`
+	args := []interface{}{status}
+	if id, err := strconv.Atoi(c.Query("recipe_id")); err == nil {
+		query += " AND p.recipe_id = ?"
+		args = append(args, id)
+	}
+	query += ` ORDER BY (SELECT COUNT(*) FROM recipe_reports o WHERE o.recipe_id = p.recipe_id AND o.status = p.status) DESC, p.recipe_id, p.created_at
+		LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	reports := []RecipeReport{}
+	for rows.Next() {
+		var report RecipeReport
+		if err := rows.Scan(&report.ID, &report.RecipeID, &report.RecipeName, &report.Reporter, &report.Reason, &report.Details, &report.Status,
+			&report.Resolution, &report.ResolutionNote, &report.ResolvedBy, &report.CreatedAt, &report.ResolvedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reports = append(reports, report)
+	}
+	c.JSON(http.StatusOK, gin.H{"reports": reports, "count": len(reports), "status": status, "limit": limit, "offset": offset})
+}
+
+type ResolveReportsRequest struct {
+	Resolution string `json:"resolution" binding:"required"`
+	Note       string `json:"note"`
+}
+
+// resolveReports closes every open report on a recipe. dismissed keeps the
+// recipe, republishing it if reports had hidden it; hidden takes it out of
+// the catalog back to pending review; removed soft-deletes it.
+func resolveReports(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req ResolveReportsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	var recipeUpdate string
+	var recipeArgs []interface{}
+	switch req.Resolution {
+	case reportDismissed:
+		recipeUpdate = "UPDATE recipes SET status = ?, status_reason = NULL, status_updated_at = NOW() WHERE id = ? AND status = ? AND status_reason = ?"
+		recipeArgs = []interface{}{recipeStatusPublished, id, recipeStatusPending, reportHiddenReason}
+	case reportHidden:
+		recipeUpdate = "UPDATE recipes SET status = ?, status_reason = ?, status_updated_at = NOW() WHERE id = ? AND status = ?"
+		recipeArgs = []interface{}{recipeStatusPending, reportHiddenReason, id, recipeStatusPublished}
+	case reportRemoved:
+		recipeUpdate = "UPDATE recipes SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL"
+		recipeArgs = []interface{}{id}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resolution must be dismissed, hidden or removed"})
+		return
+	}
+	by := adminFromContext(c).Subject
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE recipe_reports SET status = 'resolved', resolution = ?, resolution_note = ?, resolved_by = ?, resolved_at = NOW() WHERE recipe_id = ? AND status = 'open'",
+		req.Resolution, strings.TrimSpace(req.Note), by, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resolved, _ := res.RowsAffected()
+	if resolved == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No open reports for this recipe"})
+		return
+	}
+	res, err = tx.Exec(recipeUpdate, recipeArgs...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if changed, _ := res.RowsAffected(); changed > 0 {
+		notifyMCPListChanged("resources")
+	}
+
+	requestLogger(c).Info("reports resolved", "recipe_id", id, "resolution", req.Resolution, "reports", resolved, "by", by)
+	c.JSON(http.StatusOK, gin.H{"recipe_id": id, "resolution": req.Resolution, "resolved": resolved})
+}
+
+// Comment threads. Replies hang off a top-level comment; replying to a
+// reply joins the same thread, so threads are one level deep.
+const (
+	maxCommentBytes     = 4000
+	commentEditWindow   = 15 * time.Minute
+	commentReplyPreview = 3
+)
+
+type Comment struct {
+	ID         int64      `json:"id"`
+	RecipeID   int        `json:"recipe_id"`
+	ParentID   *int64     `json:"parent_id"`
+	Author     string     `json:"author"`
+	Body       string     `json:"body"`
+	CreatedAt  time.Time  `json:"created_at"`
+	EditedAt   *time.Time `json:"edited_at"`
+	Deleted    bool       `json:"deleted,omitempty"`
+	ReplyCount int        `json:"reply_count,omitempty"`
+	Replies    []Comment  `json:"replies,omitempty"`
+}
+
+type CommentRequest struct {
+	Body     string `json:"body" binding:"required"`
+	ParentID *int64 `json:"parent_id"`
+}
+
+// commentColumns is scanned by scanComment. Deleted comments keep their
+// place in a thread but not their text.
+const commentColumns = "id, recipe_id, parent_id, author, IF(deleted_at IS NULL, body, ''), created_at, edited_at, deleted_at IS NOT NULL"
+
+func scanComment(row interface{ Scan(...interface{}) error }) (Comment, error) {
+	var comment Comment
+	err := row.Scan(&comment.ID, &comment.RecipeID, &comment.ParentID, &comment.Author, &comment.Body, &comment.CreatedAt, &comment.EditedAt, &comment.Deleted)
+	return comment, err
+}
+
+func queryComments(query string, args ...interface{}) ([]Comment, error) {
+	rows, err := db.Query("SELECT "+commentColumns+" FROM recipe_comments WHERE "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := []Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// visibleRecipeID parses :id and checks the caller can see the recipe. On
+// failure it has already written the response.
+func visibleRecipeID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return 0, false
+	}
+	visible, err := recipeVisible(tenantFromContext(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if !visible {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+// listComments pages through a recipe's threads, newest first, each with
+// its reply count and first few replies. A deleted comment is listed only
+// while it still has replies.
+func listComments(c *gin.Context) {
+	id, ok := visibleRecipeID(c)
+	if !ok {
+		return
+	}
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+
+	threads, err := queryComments(`recipe_id = ? AND parent_id IS NULL
+		AND (deleted_at IS NULL OR EXISTS (SELECT 1 FROM recipe_comments r WHERE r.parent_id = recipe_comments.id AND r.deleted_at IS NULL))
+		ORDER BY id DESC LIMIT ? OFFSET ?`, id, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range threads {
+		if err := db.QueryRow("SELECT COUNT(*) FROM recipe_comments WHERE parent_id = ? AND deleted_at IS NULL", threads[i].ID).Scan(&threads[i].ReplyCount); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if threads[i].ReplyCount == 0 {
+			continue
+		}
+		threads[i].Replies, err = queryComments("parent_id = ? AND deleted_at IS NULL ORDER BY id LIMIT ?", threads[i].ID, commentReplyPreview)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM recipe_comments WHERE recipe_id = ? AND deleted_at IS NULL", id).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"comments": threads, "count": len(threads), "total_comments": total, "limit": limit, "offset": offset})
+}
+
+// listReplies pages through one thread's replies, oldest first.
+func listReplies(c *gin.Context) {
+	id, ok := visibleRecipeID(c)
+	if !ok {
+		return
+	}
+	commentID, err := strconv.ParseInt(c.Param("commentId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+	replies, err := queryComments("recipe_id = ? AND parent_id = ? AND deleted_at IS NULL ORDER BY id LIMIT ? OFFSET ?", id, commentID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"replies": replies, "count": len(replies), "limit": limit, "offset": offset})
+}
+
+func createComment(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, ok := visibleRecipeID(c)
+	if !ok {
+		return
+	}
+	var req CommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" || len(body) > maxCommentBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("body must be 1-%d bytes", maxCommentBytes)})
+		return
+	}
+
+	var parentID *int64
+	if req.ParentID != nil {
+		var parent, root sql.NullInt64
+		err := db.QueryRow("SELECT id, parent_id FROM recipe_comments WHERE id = ? AND recipe_id = ? AND deleted_at IS NULL", *req.ParentID, id).Scan(&parent, &root)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Parent comment not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		threadID := parent.Int64
+		if root.Valid {
+			threadID = root.Int64
+		}
+		parentID = &threadID
+	}
+
+	res, err := db.Exec("INSERT INTO recipe_comments (recipe_id, parent_id, author, body) VALUES (?, ?, ?, ?)", id, parentID, owner, body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	commentID, _ := res.LastInsertId()
+	comment, err := scanComment(db.QueryRow("SELECT "+commentColumns+" FROM recipe_comments WHERE id = ?", commentID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, comment)
+}
+
+// updateComment lets the author edit a comment within commentEditWindow
+// of posting it.
+func updateComment(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	commentID, err := strconv.ParseInt(c.Param("commentId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+	var req CommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" || len(body) > maxCommentBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("body must be 1-%d bytes", maxCommentBytes)})
+		return
+	}
+
+	comment, err := scanComment(db.QueryRow("SELECT "+commentColumns+" FROM recipe_comments WHERE id = ? AND recipe_id = ? AND author = ? AND deleted_at IS NULL",
+		commentID, c.Param("id"), owner))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if time.Since(comment.CreatedAt) > commentEditWindow {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Comments can only be edited for %s after posting", commentEditWindow)})
+		return
+	}
+	if _, err := db.Exec("UPDATE recipe_comments SET body = ?, edited_at = NOW() WHERE id = ?", body, commentID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	comment.Body, comment.EditedAt = body, &now
+	c.JSON(http.StatusOK, comment)
+}
+
+// deleteComment soft-deletes the caller's own comment. Its replies stay,
+// under a placeholder.
+func deleteComment(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	commentID, err := strconv.ParseInt(c.Param("commentId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+	res, err := db.Exec("UPDATE recipe_comments SET deleted_at = NOW() WHERE id = ? AND recipe_id = ? AND author = ? AND deleted_at IS NULL", commentID, c.Param("id"), owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": commentID, "deleted": true})
+}
+
+// moderateComment soft-deletes any comment.
+func moderateComment(c *gin.Context) {
+	commentID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid comment ID"})
+		return
+	}
+	res, err := db.Exec("UPDATE recipe_comments SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL", commentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return
+	}
+	requestLogger(c).Info("comment removed", "comment_id", commentID, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": commentID, "deleted": true})
+}
+
+// Ratings. Each caller rates a recipe 1-5 stars. recipes.rating, which
+// search sorts and filters on, holds a Bayesian average: the stars plus
+// cfg.Search.RatingPriorWeight votes at a prior, which is the recipe's
+// imported source_rating when it has one and the mean of all ratings
+// otherwise. So a single 5-star rating can't outrank a well-rated recipe.
+//
+// Aggregates are rebuilt whenever a rating changes; the rating_aggregates
+// task rebuilds them all, picking up a moved global mean or prior weight.
+
+// fallbackRatingPrior is the prior before anything has been rated.
+const fallbackRatingPrior = 3.5
+
+type RatingStats struct {
+	Count    int      `json:"count"`
+	Average  *float64 `json:"average"`
+	Weighted *float64 `json:"weighted"`
+	// Histogram counts ratings by stars, "1" to "5".
+	Histogram map[int]int `json:"histogram"`
+}
+
+type RateRecipeRequest struct {
+	Stars int `json:"stars" binding:"required"`
+}
+
+func globalRatingMean() (float64, error) {
+	var mean sql.NullFloat64
+	if err := db.QueryRow("SELECT AVG(stars) FROM recipe_ratings").Scan(&mean); err != nil {
+		return 0, err
+	}
+	if !mean.Valid {
+		return fallbackRatingPrior, nil
+	}
+	return mean.Float64, nil
+}
+
+// recalculateRating rebuilds a recipe's aggregate from its ratings and sets
+// recipes.rating to match. With no ratings left the recipe falls back to
+// its source rating.
+func recalculateRating(id int, globalMean float64) error {
+	histogram := [5]int{}
+	rows, err := db.Query("SELECT stars, COUNT(*) FROM recipe_ratings WHERE recipe_id = ? GROUP BY stars", id)
+	if err != nil {
+		return err
+	}
+	count, sum := 0, 0
+	for rows.Next() {
+		var stars, n int
+		if err := rows.Scan(&stars, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		if stars >= 1 && stars <= 5 {
+			histogram[stars-1] = n
+			count += n
+			sum += stars * n
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if count == 0 {
+		if _, err := tx.Exec("DELETE FROM recipe_rating_stats WHERE recipe_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE recipes SET rating = source_rating WHERE id = ?", id); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var source sql.NullFloat64
+	if err := tx.QueryRow("SELECT source_rating FROM recipes WHERE id = ?", id).Scan(&source); err != nil {
+		return err
+	}
+	prior := globalMean
+	if source.Valid {
+		prior = source.Float64
+	}
+	weight := cfg.Search.RatingPriorWeight
+	average := float64(sum) / float64(count)
+	weighted := (weight*prior + float64(sum)) / (weight + float64(count))
+
+	if _, err := tx.Exec(`INSERT INTO recipe_rating_stats (recipe_id, rating_count, stars_1, stars_2, stars_3, stars_4, stars_5, average, weighted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE rating_count = VALUES(rating_count), stars_1 = VALUES(stars_1), stars_2 = VALUES(stars_2), stars_3 = VALUES(stars_3),
+			stars_4 = VALUES(stars_4), stars_5 = VALUES(stars_5), average = VALUES(average), weighted = VALUES(weighted)`,
+		id, count, histogram[0], histogram[1], histogram[2], histogram[3], histogram[4], average, weighted); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE recipes SET rating = ? WHERE id = ?", math.Round(weighted*100)/100, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recalculateRatings rebuilds every aggregate, including those of recipes
+// whose last rating was withdrawn.
+func recalculateRatings(ctx context.Context) (interface{}, error) {
+	mean, err := globalRatingMean()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT recipe_id FROM recipe_ratings UNION SELECT recipe_id FROM recipe_rating_stats")
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return gin.H{"recalculated": i, "prior_mean": mean}, err
+		}
+		if err := recalculateRating(id, mean); err != nil {
+			return gin.H{"recalculated": i, "prior_mean": mean}, err
+		}
+	}
+	return gin.H{"recalculated": len(ids), "prior_mean": mean}, nil
+}
+
+// loadRatingStats fills recipe.RatingStats; a recipe nobody has rated gets
+// an empty histogram.
+func loadRatingStats(recipe *Recipe) error {
+	stats := RatingStats{Histogram: map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}}
+	var counts [5]int
+	err := db.QueryRow("SELECT rating_count, stars_1, stars_2, stars_3, stars_4, stars_5, average, weighted FROM recipe_rating_stats WHERE recipe_id = ?", recipe.ID).
+		Scan(&stats.Count, &counts[0], &counts[1], &counts[2], &counts[3], &counts[4], &stats.Average, &stats.Weighted)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	for i, n := range counts {
+		stats.Histogram[i+1] = n
+	}
+	recipe.RatingStats = &stats
+	return nil
+}
+
+// rateRecipe sets the caller's rating of a recipe, replacing any earlier
+// one, and answers with the new aggregate. Only issued keys may rate.
+func rateRecipe(c *gin.Context) {
+	owner, ok := issuedKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, ok := visibleRecipeID(c)
+	if !ok {
+		return
+	}
+	var req RateRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Stars < 1 || req.Stars > 5 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "stars must be between 1 and 5"})
+		return
+	}
+	if _, err := db.Exec("INSERT INTO recipe_ratings (recipe_id, rater, stars) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE stars = VALUES(stars)", id, owner, req.Stars); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondWithRating(c, id, &req.Stars)
+}
+
+// unrateRecipe withdraws the caller's rating.
+func unrateRecipe(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, ok := visibleRecipeID(c)
+	if !ok {
+		return
+	}
+	res, err := db.Exec("DELETE FROM recipe_ratings WHERE recipe_id = ? AND rater = ?", id, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rating not found"})
+		return
+	}
+	respondWithRating(c, id, nil)
+}
+
+func respondWithRating(c *gin.Context, id int, stars *int) {
+	mean, err := globalRatingMean()
+	if err == nil {
+		err = recalculateRating(id, mean)
+	}
+	recipe := Recipe{ID: id}
+	if err == nil {
+		err = loadRatingStats(&recipe)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recipe_id": id, "stars": stars, "rating_stats": recipe.RatingStats})
+}
+
+// recalculateRatingAggregates starts the rating_aggregates task by hand,
+// for instance after changing SEARCH_RATING_PRIOR_WEIGHT.
+func recalculateRatingAggregates(c *gin.Context) {
+	by := adminFromContext(c).Subject
+	wait := c.Query("wait") == "true"
+	id, err := startJob("rating_aggregates", nil, by, wait, recalculateRatings)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("rating recalculation started", "job", id, "by", by)
+	if !wait {
+		c.Header("Location", fmt.Sprintf("/api/admin/jobs/%d", id))
+		c.JSON(http.StatusAccepted, gin.H{"job_id": id, "status": jobQueued, "status_url": fmt.Sprintf("/api/admin/jobs/%d", id)})
+		return
+	}
+	job, err := loadJob(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// Near-duplicate scoring. A pair's score blends name similarity, the
+// Jaccard overlap of ingredient names and, when both images could be
+// hashed, the similarity of their perceptual hashes. Without image hashes
+// the name and ingredient weights are rescaled to sum to one.
+const (
+	duplicateNameWeight       = 0.5
+	duplicateIngredientWeight = 0.35
+	duplicateImageWeight      = 0.15
+	defaultDuplicateThreshold = 0.8
+	maxImageHashFetches       = 200
+)
+
+// duplicateNameFiller are words that dress up a recipe name without
+// changing the dish, so "The Best Easy Banana Bread" matches "Banana Bread".
+var duplicateNameFiller = map[string]bool{
+	"a": true, "an": true, "the": true, "and": true, "with": true, "my": true,
+	"best": true, "easy": true, "simple": true, "quick": true, "classic": true,
+	"homemade": true, "perfect": true, "ultimate": true, "recipe": true,
+}
+
+// imageHashHTTPClient fetches recipe images, whose URLs come from
+// submitters, so like webhooks it only reaches public addresses.
+var imageHashHTTPClient = publicHTTPClient(10 * time.Second)
+
+type DuplicateRecipe struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Image  string   `json:"image"`
+	Status string   `json:"status"`
+	Rating *float64 `json:"rating"`
+}
+
+// DuplicatePair explains one match. Image is null when either image could
+// not be hashed.
+type DuplicatePair struct {
+	IDs         [2]int   `json:"ids"`
+	Score       float64  `json:"score"`
+	Name        float64  `json:"name"`
+	Ingredients float64  `json:"ingredients"`
+	Image       *float64 `json:"image"`
+}
+
+// DuplicateCluster is a group of recipes linked by probable-duplicate
+// pairs. Keep is the suggested survivor for a merge: published first, then
+// the best rated.
+type DuplicateCluster struct {
+	Score   float64           `json:"score"`
+	Keep    int               `json:"keep"`
+	Recipes []DuplicateRecipe `json:"recipes"`
+	Pairs   []DuplicatePair   `json:"pairs"`
+}
+
+type duplicateCandidate struct {
+	DuplicateRecipe
+	nameKey     []rune
+	words       []string
+	ingredients map[string]bool
+}
+
+func duplicateNameWords(name string) []string {
+	words := []string{}
+	for _, word := range searchWordPattern.FindAllString(strings.ToLower(name), -1) {
+		if !duplicateNameFiller[word] {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+func nameSimilarity(a, b []rune) float64 {
+	longest := max(len(a), len(b))
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(editDistance(a, b, longest))/float64(longest)
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	shared := 0
+	for name := range a {
+		if b[name] {
+			shared++
+		}
+	}
+	union := len(a) + len(b) - shared
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+// imageDifferenceHash is a 64-bit dHash: the image shrunk to 9x8 greys,
+// one bit per horizontally adjacent pair that gets brighter. Resized or
+// recompressed copies of a photo land within a few bits of each other.
+func imageDifferenceHash(src image.Image) uint64 {
+	small := resizeImage(src, 9, 8, "fill")
+	grey := func(x, y int) uint32 {
+		r, g, b, _ := small.At(x, y).RGBA()
+		return (299*r + 587*g + 114*b) / 1000
+	}
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if grey(x+1, y) > grey(x, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// fetchImageHash downloads an image and hashes it. Formats the standard
+// library cannot decode report an error like any failed download.
+func fetchImageHash(ctx context.Context, imageURL string) (uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := imageHashHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("image returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(cfg.Storage.MaxUploadBytes)+1))
+	if err != nil {
+		return 0, err
+	}
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	if imgConfig.Width*imgConfig.Height > maxSourcePixels {
+		return 0, errors.New("image is too large to hash")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	return imageDifferenceHash(src), nil
+}
+
+// loadImageHashes returns the cached hashes of the recipes' current images
+// and, when fetch is set, hashes up to maxImageHashFetches uncached ones.
+// Failed downloads are cached too and retried after a day.
+func loadImageHashes(ctx context.Context, recipes map[int]*duplicateCandidate, ids []int, fetch bool) (map[int]uint64, error) {
+	hashes := map[int]uint64{}
+	checked := map[int]bool{}
+	rows, err := db.Query("SELECT recipe_id, image_url, hash FROM recipe_image_hashes WHERE hash IS NOT NULL OR checked_at > NOW() - INTERVAL 1 DAY")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var imageURL string
+		var hash sql.NullInt64
+		if err := rows.Scan(&id, &imageURL, &hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if recipe, ok := recipes[id]; ok && recipe.Image == imageURL {
+			checked[id] = true
+			if hash.Valid {
+				hashes[id] = uint64(hash.Int64)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || !fetch {
+		return hashes, err
+	}
+
+	pending := []int{}
+	for _, id := range ids {
+		image := recipes[id].Image
+		if !checked[id] && (strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "http://")) {
+			pending = append(pending, id)
+		}
+	}
+	if len(pending) > maxImageHashFetches {
+		pending = pending[:maxImageHashFetches]
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, id := range pending {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			imageURL := recipes[id].Image
+			// The hash is stored as its signed bit pattern in a BIGINT.
+			var stored interface{}
+			hash, err := fetchImageHash(ctx, imageURL)
+			if err == nil {
+				stored = int64(hash)
+				mu.Lock()
+				hashes[id] = hash
+				mu.Unlock()
+			}
+			if _, err := db.Exec(`INSERT INTO recipe_image_hashes (recipe_id, image_url, hash, checked_at) VALUES (?, ?, ?, NOW())
+				ON DUPLICATE KEY UPDATE image_url = VALUES(image_url), hash = VALUES(hash), checked_at = VALUES(checked_at)`, id, imageURL, stored); err != nil {
+				slog.Warn("image hash not cached", "recipe_id", id, "error", err)
+			}
+		}(id)
+	}
+	wg.Wait()
+	return hashes, nil
+}
+
+// findDuplicates scores candidate pairs among every non-deleted recipe.
+// Only recipes sharing one of the two rarest words of a name, or the same
+// image URL, are compared, which keeps the scan far below all pairs.
+func findDuplicates(ctx context.Context, threshold float64, fetchImages bool) ([]DuplicateCluster, error) {
+	rows, err := db.Query("SELECT id, name, image, status, rating, ingredients FROM recipes WHERE deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	recipes := map[int]*duplicateCandidate{}
+	order := []int{}
+	byWord := map[string][]int{}
+	byImage := map[string][]int{}
+	for rows.Next() {
+		candidate := &duplicateCandidate{}
+		var ingredientsJSON string
+		if err := rows.Scan(&candidate.ID, &candidate.Name, &candidate.Image, &candidate.Status, &candidate.Rating, &ingredientsJSON); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var recipe Recipe
+		json.Unmarshal([]byte(ingredientsJSON), &recipe.Ingredients)
+		candidate.ingredients = ingredientNames(recipe)
+		candidate.words = duplicateNameWords(candidate.Name)
+		candidate.nameKey = []rune(strings.Join(candidate.words, " "))
+		recipes[candidate.ID] = candidate
+		order = append(order, candidate.ID)
+		for _, word := range candidate.words {
+			byWord[word] = append(byWord[word], candidate.ID)
+		}
+		if candidate.Image != "" {
+			byImage[candidate.Image] = append(byImage[candidate.Image], candidate.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	type scoredPair struct {
+		a, b              int
+		name, ingredients float64
+	}
+	pairs := []scoredPair{}
+	seen := map[[2]int]bool{}
+	compare := func(a, b int) {
+		a, b = min(a, b), max(a, b)
+		if a == b || seen[[2]int{a, b}] {
+			return
+		}
+		seen[[2]int{a, b}] = true
+		x, y := recipes[a], recipes[b]
+		name := nameSimilarity(x.nameKey, y.nameKey)
+		ingredients := jaccard(x.ingredients, y.ingredients)
+		// An image match can add at most duplicateImageWeight, so pairs
+		// that cannot reach the threshold with it are dropped here.
+		best := duplicateNameWeight*name + duplicateIngredientWeight*ingredients + duplicateImageWeight
+		if best >= threshold || x.Image != "" && x.Image == y.Image {
+			pairs = append(pairs, scoredPair{a, b, name, ingredients})
+		}
+	}
+	for _, id := range order {
+		words := slices.Clone(recipes[id].words)
+		sort.SliceStable(words, func(i, j int) bool { return len(byWord[words[i]]) < len(byWord[words[j]]) })
+		for _, word := range words[:min(2, len(words))] {
+			for _, other := range byWord[word] {
+				compare(id, other)
+			}
+		}
+		for _, other := range byImage[recipes[id].Image] {
+			compare(id, other)
+		}
+	}
+
+	involved := []int{}
+	for _, pair := range pairs {
+		involved = append(involved, pair.a, pair.b)
+	}
+	hashes, err := loadImageHashes(ctx, recipes, involved, fetchImages)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := map[int]int{}
+	var find func(int) int
+	find = func(id int) int {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = find(p)
+			return parent[id]
+		}
+		return id
+	}
+	matched := []DuplicatePair{}
+	for _, pair := range pairs {
+		x, y := recipes[pair.a], recipes[pair.b]
+		result := DuplicatePair{IDs: [2]int{pair.a, pair.b}, Name: math.Round(pair.name*100) / 100, Ingredients: math.Round(pair.ingredients*100) / 100}
+		var image *float64
+		if x.Image != "" && x.Image == y.Image {
+			same := 1.0
+			image = &same
+		} else if hx, ok := hashes[pair.a]; ok {
+			if hy, ok := hashes[pair.b]; ok {
+				similarity := 1 - float64(bits.OnesCount64(hx^hy))/64
+				image = &similarity
+			}
+		}
+		score := (duplicateNameWeight*pair.name + duplicateIngredientWeight*pair.ingredients) / (duplicateNameWeight + duplicateIngredientWeight)
+		if image != nil {
+			score = duplicateNameWeight*pair.name + duplicateIngredientWeight*pair.ingredients + duplicateImageWeight**image
+			rounded := math.Round(*image*100) / 100
+			result.Image = &rounded
+		}
+		if score < threshold {
+			continue
+		}
+		result.Score = math.Round(score*100) / 100
+		matched = append(matched, result)
+		parent[find(pair.a)] = find(pair.b)
+	}
+
+	byRoot := map[int]*DuplicateCluster{}
+	clusters := []*DuplicateCluster{}
+	members := map[int]bool{}
+	for _, pair := range matched {
+		root := find(pair.IDs[0])
+		cluster, ok := byRoot[root]
+		if !ok {
+			cluster = &DuplicateCluster{}
+			byRoot[root] = cluster
+			clusters = append(clusters, cluster)
+		}
+		cluster.Pairs = append(cluster.Pairs, pair)
+		cluster.Score = math.Max(cluster.Score, pair.Score)
+		for _, id := range pair.IDs {
+			if !members[id] {
+				members[id] = true
+				cluster.Recipes = append(cluster.Recipes, recipes[id].DuplicateRecipe)
+			}
+		}
+	}
+
+	result := make([]DuplicateCluster, 0, len(clusters))
+	for _, cluster := range clusters {
+		sort.Slice(cluster.Recipes, func(i, j int) bool {
+			a, b := cluster.Recipes[i], cluster.Recipes[j]
+			if (a.Status == recipeStatusPublished) != (b.Status == recipeStatusPublished) {
+				return a.Status == recipeStatusPublished
+			}
+			ra, rb := -1.0, -1.0
+			if a.Rating != nil {
+				ra = *a.Rating
+			}
+			if b.Rating != nil {
+				rb = *b.Rating
+			}
+			if ra != rb {
+				return ra > rb
+			}
+			return a.ID < b.ID
+		})
+		cluster.Keep = cluster.Recipes[0].ID
+		result = append(result, *cluster)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Score > result[j].Score })
+	return result, nil
+}
+
+// listDuplicates reports probable duplicate clusters. Image hashes are
+// read from the cache; images=true also downloads and hashes uncached
+// images of candidate pairs, which can take a while on a first run.
+func listDuplicates(c *gin.Context) {
+	threshold := defaultDuplicateThreshold
+	if raw := c.Query("threshold"); raw != "" {
+		val, err := strconv.ParseFloat(raw, 64)
+		if err != nil || val <= 0 || val > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold must be between 0 and 1"})
+			return
+		}
+		threshold = val
+	}
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+
+	clusters, err := findDuplicates(c.Request.Context(), threshold, c.Query("images") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	total := len(clusters)
+	c.JSON(http.StatusOK, gin.H{"clusters": clusters[:min(limit, total)], "total": total, "threshold": threshold})
+}
+
+type MergeRecipeRequest struct {
+	DuplicateID int `json:"duplicate_id" binding:"required"`
+}
+
+// mergeRecipes folds a duplicate into the recipe in the path. Gaps in the
+// survivor's fields are filled from the duplicate, the two ratings are
+// averaged, and users' diary entries, hidden-recipe choices and gallery
+// photos move over. The duplicate is soft-deleted with merged_into set, so
+// its URL and share link keep working and a restore undoes the delete.
+func mergeRecipes(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req MergeRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.DuplicateID == id {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duplicate_id must be another recipe"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM recipes WHERE id IN (?, ?) AND deleted_at IS NULL FOR UPDATE", id, req.DuplicateID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	found := 0
+	for rows.Next() {
+		found++
+	}
+	rows.Close()
+	if found != 2 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE recipes r JOIN recipes d ON d.id = ?
+		SET r.description = COALESCE(NULLIF(r.description, ''), d.description),
+			r.image = COALESCE(NULLIF(r.image, ''), d.image),
+			r.prep_time_minutes = COALESCE(r.prep_time_minutes, d.prep_time_minutes),
+			r.cook_time_minutes = COALESCE(r.cook_time_minutes, d.cook_time_minutes),
+			r.total_time_minutes = COALESCE(r.total_time_minutes, d.total_time_minutes),
+			r.servings = COALESCE(r.servings, d.servings),
+			r.calories = COALESCE(r.calories, d.calories),
+			r.protein = COALESCE(r.protein, d.protein),
+			r.fat = COALESCE(r.fat, d.fat),
+			r.carbs = COALESCE(r.carbs, d.carbs),
+			r.fiber = COALESCE(r.fiber, d.fiber),
+			r.sodium = COALESCE(r.sodium, d.sodium),
+			r.cost_per_serving = COALESCE(r.cost_per_serving, d.cost_per_serving),
+			r.co2e_per_serving = COALESCE(r.co2e_per_serving, d.co2e_per_serving),
+			r.times_made = r.times_made + d.times_made,
+			r.views = r.views + d.views,
+			r.rating = CASE WHEN r.rating IS NULL THEN d.rating WHEN d.rating IS NULL THEN r.rating ELSE (r.rating + d.rating) / 2 END
+		WHERE r.id = ?`, req.DuplicateID, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	moved := map[string]int64{}
+	var galleryEnd int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position) + 1, 0) FROM recipe_images WHERE recipe_id = ? AND kind = 'gallery'", id).Scan(&galleryEnd); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Step photos stay behind: they illustrate the duplicate's own
+	// instructions. A user who hid both recipes keeps one hidden row.
+	for _, move := range []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{"diary_entries", "UPDATE meal_log SET recipe_id = ? WHERE recipe_id = ?", []interface{}{id, req.DuplicateID}},
+		{"hidden", "UPDATE IGNORE hidden_recipes SET recipe_id = ? WHERE recipe_id = ?", []interface{}{id, req.DuplicateID}},
+		{"", "DELETE FROM hidden_recipes WHERE recipe_id = ?", []interface{}{req.DuplicateID}},
+		{"gallery_images", "UPDATE recipe_images SET recipe_id = ?, position = position + ? WHERE recipe_id = ? AND kind = 'gallery'", []interface{}{id, galleryEnd, req.DuplicateID}},
+		{"", "UPDATE recipes SET merged_into = ? WHERE merged_into = ?", []interface{}{id, req.DuplicateID}},
+		{"", "UPDATE recipes SET merged_into = ?, deleted_at = NOW() WHERE id = ?", []interface{}{id, req.DuplicateID}},
+	} {
+		res, err := tx.Exec(move.query, move.args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if move.name != "" {
+			moved[move.name], _ = res.RowsAffected()
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	notifyMCPListChanged("resources")
+
+	requestLogger(c).Info("recipes merged", "recipe_id", id, "duplicate_id", req.DuplicateID, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "merged": req.DuplicateID, "moved": moved})
+}
+
+// Quality issue severities. Errors are data that is certainly wrong,
+// warnings are probably wrong and info is worth a look.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+const maxImageChecks = 500
+
+// nutritionCeilings are per-serving values no real recipe reaches; beyond
+// them a value is almost always a unit or per-recipe mix-up.
+var nutritionCeilings = map[string]float64{
+	"calories": 5000, "protein": 500, "fat": 500, "carbs": 800, "fiber": 150, "sodium": 20000,
+}
+
+// QualityIssue is one anomaly in one recipe. Fix, when present, maps
+// columns to the values that resolve the issue; null clears a value.
+type QualityIssue struct {
+	RecipeID int                    `json:"recipe_id"`
+	Name     string                 `json:"name"`
+	Check    string                 `json:"check"`
+	Severity string                 `json:"severity"`
+	Field    string                 `json:"field,omitempty"`
+	Message  string                 `json:"message"`
+	Value    interface{}            `json:"value,omitempty"`
+	Fix      map[string]interface{} `json:"fix,omitempty"`
+}
+
+type QualityReport struct {
+	GeneratedAt   time.Time      `json:"generated_at"`
+	Scanned       int            `json:"scanned"`
+	ImagesChecked int            `json:"images_checked"`
+	Counts        map[string]int `json:"counts"`
+	ByCheck       map[string]int `json:"by_check"`
+	Issues        []QualityIssue `json:"issues"`
+}
+
+type qualityRecord struct {
+	ID                                 int
+	Name, Image                        string
+	Prep, Cook, Total, Servings        sql.NullInt64
+	Rating                             sql.NullFloat64
+	Ingredients, Instructions          sql.NullString
+	Calories                           sql.NullInt64
+	Protein, Fat, Carbs, Fiber, Sodium sql.NullFloat64
+}
+
+// checkImageURL reports whether an image URL answers with an image. Hosts
+// that refuse HEAD get a GET, of which only the headers are read.
+func checkImageURL(ctx context.Context, imageURL string) error {
+	var resp *http.Response
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, imageURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err = imageHashHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			break
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("content type %s", contentType)
+	}
+	return nil
+}
+
+// recipeQualityIssues runs every per-recipe check except image reachability.
+func recipeQualityIssues(r qualityRecord) []QualityIssue {
+	issues := []QualityIssue{}
+	add := func(check, severity, field, message string, value interface{}, fix map[string]interface{}) {
+		issues = append(issues, QualityIssue{RecipeID: r.ID, Name: r.Name, Check: check, Severity: severity, Field: field, Message: message, Value: value, Fix: fix})
+	}
+
+	if strings.TrimSpace(r.Name) == "" {
+		add("name_empty", severityError, "name", "Recipe has no name", nil, nil)
+	}
+
+	var ingredients, instructions []string
+	switch {
+	case !r.Ingredients.Valid || strings.TrimSpace(r.Ingredients.String) == "":
+		add("ingredients_empty", severityError, "ingredients", "Ingredients are missing", nil, nil)
+	case json.Unmarshal([]byte(r.Ingredients.String), &ingredients) != nil:
+		add("ingredients_invalid", severityError, "ingredients", "Ingredients are not a JSON array of strings", nil, nil)
+	case len(ingredients) == 0:
+		add("ingredients_empty", severityError, "ingredients", "Ingredient list is empty", nil, nil)
+	}
+	if !r.Instructions.Valid || json.Unmarshal([]byte(r.Instructions.String), &instructions) != nil {
+		add("instructions_invalid", severityError, "instructions", "Instructions are not a JSON array of strings", nil, nil)
+	} else if len(instructions) == 0 {
+		add("instructions_empty", severityWarning, "instructions", "Instruction list is empty", nil, nil)
+	}
+
+	nutrition := map[string]sql.NullFloat64{
+		"calories": {Float64: float64(r.Calories.Int64), Valid: r.Calories.Valid},
+		"protein":  r.Protein, "fat": r.Fat, "carbs": r.Carbs, "fiber": r.Fiber, "sodium": r.Sodium,
+	}
+	for _, field := range sortedKeys(nutrition) {
+		value := nutrition[field]
+		switch {
+		case !value.Valid:
+		case value.Float64 < 0:
+			add("nutrition_negative", severityError, field, field+" is negative", value.Float64, map[string]interface{}{field: nil})
+		case value.Float64 > nutritionCeilings[field]:
+			add("nutrition_absurd", severityWarning, field, fmt.Sprintf("%s is above %g per serving", field, nutritionCeilings[field]), value.Float64, nil)
+		}
+	}
+	// Calories should roughly agree with 4/4/9 kcal per gram of protein,
+	// carbs and fat. Small recipes get slack for rounding.
+	if r.Calories.Valid && r.Protein.Valid && r.Carbs.Valid && r.Fat.Valid && r.Calories.Int64 > 0 {
+		fromMacros := 4*r.Protein.Float64 + 4*r.Carbs.Float64 + 9*r.Fat.Float64
+		gap := math.Abs(fromMacros - float64(r.Calories.Int64))
+		if gap > 100 && gap > 0.35*float64(r.Calories.Int64) {
+			add("calories_macros_mismatch", severityWarning, "calories", fmt.Sprintf("Macros add up to %.0f kcal", fromMacros), r.Calories.Int64, nil)
+		}
+	}
+
+	times := map[string]sql.NullInt64{"prep_time_minutes": r.Prep, "cook_time_minutes": r.Cook, "total_time_minutes": r.Total}
+	negativeTime := false
+	for _, field := range sortedKeys(times) {
+		if times[field].Valid && times[field].Int64 < 0 {
+			negativeTime = true
+			add("time_negative", severityError, field, field+" is negative", times[field].Int64, map[string]interface{}{field: nil})
+		}
+	}
+	if !negativeTime && r.Prep.Valid && r.Cook.Valid {
+		sum := r.Prep.Int64 + r.Cook.Int64
+		fix := map[string]interface{}{"total_time_minutes": sum}
+		switch {
+		case !r.Total.Valid:
+			add("time_mismatch", severityInfo, "total_time_minutes", "Total time is missing", nil, fix)
+		case r.Total.Int64 < sum:
+			add("time_mismatch", severityWarning, "total_time_minutes", fmt.Sprintf("Total time is less than prep + cook (%d)", sum), r.Total.Int64, fix)
+		case r.Total.Int64 > sum:
+			// Resting, rising and marinating legitimately add to the total.
+			add("time_mismatch", severityInfo, "total_time_minutes", fmt.Sprintf("Total time exceeds prep + cook (%d)", sum), r.Total.Int64, fix)
+		}
+	}
+
+	if r.Servings.Valid && r.Servings.Int64 <= 0 {
+		add("servings_invalid", severityError, "servings", "Servings must be positive", r.Servings.Int64, map[string]interface{}{"servings": nil})
+	}
+	if r.Rating.Valid && (r.Rating.Float64 < 0 || r.Rating.Float64 > 5) {
+		add("rating_out_of_range", severityError, "rating", "Rating is outside 0-5", r.Rating.Float64, map[string]interface{}{"rating": math.Max(0, math.Min(5, r.Rating.Float64))})
+	}
+	if strings.TrimSpace(r.Image) == "" {
+		add("image_missing", severityInfo, "image", "Recipe has no image", nil, nil)
+	}
+	return issues
+}
+
+// unreadableRecipeIssues reports recipes whose rows have failed to scan
+// in search and listing results. Each is re-read first; rows that now
+// scan, or no longer exist, are cleared instead of reported.
+func unreadableRecipeIssues() ([]QualityIssue, error) {
+	rows, err := db.Query(`SELECT f.recipe_id, COALESCE(r.name, ''), f.failures, f.last_error, f.last_seen
+		FROM recipe_scan_failures f LEFT JOIN recipes r ON r.id = f.recipe_id ORDER BY f.recipe_id`)
+	if err != nil {
+		return nil, err
+	}
+	type failure struct {
+		issue    QualityIssue
+		failures int
+	}
+	var failures []failure
+	for rows.Next() {
+		var f failure
+		var lastError string
+		var lastSeen time.Time
+		if err := rows.Scan(&f.issue.RecipeID, &f.issue.Name, &f.failures, &lastError, &lastSeen); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		f.issue.Check, f.issue.Severity = "row_unreadable", severityError
+		f.issue.Message = fmt.Sprintf("Row failed to scan %d times, last at %s: %s", f.failures, lastSeen.UTC().Format(time.RFC3339), lastError)
+		f.issue.Value = f.failures
+		failures = append(failures, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	issues := []QualityIssue{}
+	for _, f := range failures {
+		if _, err := selectRecipes().Where("id = ?", f.issue.RecipeID).One(); err == nil || errors.Is(err, sql.ErrNoRows) {
+			db.Exec("DELETE FROM recipe_scan_failures WHERE recipe_id = ?", f.issue.RecipeID)
+			continue
+		}
+		issues = append(issues, f.issue)
+	}
+	return issues, nil
+}
+
+// buildQualityReport scans every non-deleted recipe. With checkImages it
+// also requests up to maxImageChecks image URLs.
+func buildQualityReport(ctx context.Context, checkImages bool) (QualityReport, error) {
+	report := QualityReport{GeneratedAt: time.Now().UTC(), Counts: map[string]int{}, ByCheck: map[string]int{}, Issues: []QualityIssue{}}
+	rows, err := db.Query(`SELECT id, name, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium
+		FROM recipes WHERE deleted_at IS NULL ORDER BY id`)
+	if err != nil {
+		return report, err
+	}
+	images := map[int]qualityRecord{}
+	for rows.Next() {
+		var r qualityRecord
+		if err := rows.Scan(&r.ID, &r.Name, &r.Image, &r.Prep, &r.Cook, &r.Total, &r.Servings, &r.Rating, &r.Ingredients, &r.Instructions,
+			&r.Calories, &r.Protein, &r.Fat, &r.Carbs, &r.Fiber, &r.Sodium); err != nil {
+			rows.Close()
+			return report, err
+		}
+		report.Scanned++
+		report.Issues = append(report.Issues, recipeQualityIssues(r)...)
+		if checkImages && len(images) < maxImageChecks && (strings.HasPrefix(r.Image, "https://") || strings.HasPrefix(r.Image, "http://")) {
+			images[r.ID] = r
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	unreadable, err := unreadableRecipeIssues()
+	if err != nil {
+		return report, err
+	}
+	report.Issues = append(report.Issues, unreadable...)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, r := range images {
+		wg.Add(1)
+		go func(r qualityRecord) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := checkImageURL(ctx, r.Image); err != nil {
+				mu.Lock()
+				report.Issues = append(report.Issues, QualityIssue{RecipeID: r.ID, Name: r.Name, Check: "image_broken", Severity: severityWarning,
+					Field: "image", Message: "Image URL failed: " + err.Error(), Value: r.Image, Fix: map[string]interface{}{"image": ""}})
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	report.ImagesChecked = len(images)
+
+	severityRank := map[string]int{severityError: 0, severityWarning: 1, severityInfo: 2}
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.Severity != b.Severity {
+			return severityRank[a.Severity] < severityRank[b.Severity]
+		}
+		if a.RecipeID != b.RecipeID {
+			return a.RecipeID < b.RecipeID
+		}
+		return a.Check < b.Check
+	})
+	for _, issue := range report.Issues {
+		report.Counts[issue.Severity]++
+		report.ByCheck[issue.Check]++
+	}
+	return report, nil
+}
+
+// qualityIssueFilter keeps issues matching comma-separated severity and
+// check lists; an empty list matches everything.
+func qualityIssueFilter(severities, checks string) func(QualityIssue) bool {
+	split := func(raw string) map[string]bool {
+		set := map[string]bool{}
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				set[value] = true
+			}
+		}
+		return set
+	}
+	severitySet, checkSet := split(severities), split(checks)
+	return func(issue QualityIssue) bool {
+		return (len(severitySet) == 0 || severitySet[issue.Severity]) && (len(checkSet) == 0 || checkSet[issue.Check])
+	}
+}
+
+// getQualityReport scans the catalog for anomalies. Filter with severity
+// and check; check_images=true also requests image URLs, which is slow.
+func getQualityReport(c *gin.Context) {
+	report, err := buildQualityReport(c.Request.Context(), c.Query("check_images") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	keep := qualityIssueFilter(c.Query("severity"), c.Query("check"))
+	report.Issues = slices.DeleteFunc(report.Issues, func(issue QualityIssue) bool { return !keep(issue) })
+	c.JSON(http.StatusOK, report)
+}
+
+// FixQualityRequest selects which suggested fixes to apply. Empty lists
+// mean all; at least one of Checks or RecipeIDs is required so a bare
+// request cannot rewrite the whole catalog.
+type FixQualityRequest struct {
+	Checks      []string `json:"checks"`
+	RecipeIDs   []int    `json:"recipe_ids"`
+	CheckImages bool     `json:"check_images"`
+}
+
+// qualityFixColumns are the columns suggested fixes may write.
+var qualityFixColumns = map[string]bool{
+	"calories": true, "protein": true, "fat": true, "carbs": true, "fiber": true, "sodium": true,
+	"prep_time_minutes": true, "cook_time_minutes": true, "total_time_minutes": true,
+	"servings": true, "rating": true, "image": true,
+}
+
+// fixQualityIssues applies the suggested fixes from a fresh report.
+func fixQualityIssues(c *gin.Context) {
+	var req FixQualityRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (len(req.Checks) == 0 && len(req.RecipeIDs) == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "checks or recipe_ids is required"})
+		return
+	}
+
+	report, err := buildQualityReport(c.Request.Context(), req.CheckImages)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	keepCheck := qualityIssueFilter("", strings.Join(req.Checks, ","))
+	fixed, skipped := 0, 0
+	for _, issue := range report.Issues {
+		if !keepCheck(issue) || (len(req.RecipeIDs) > 0 && !slices.Contains(req.RecipeIDs, issue.RecipeID)) {
+			continue
+		}
+		if issue.Fix == nil {
+			skipped++
+			continue
+		}
+		sets, args := []string{}, []interface{}{}
+		for _, column := range sortedKeys(issue.Fix) {
+			if !qualityFixColumns[column] {
+				continue
+			}
+			sets = append(sets, column+" = ?")
+			args = append(args, issue.Fix[column])
+		}
+		if len(sets) == 0 {
+			skipped++
+			continue
+		}
+		if _, err := db.Exec("UPDATE recipes SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, issue.RecipeID)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "fixed": fixed})
+			return
+		}
+		fixed++
+	}
+	if fixed > 0 {
+		notifyMCPListChanged("resources")
+	}
+
+	requestLogger(c).Info("quality issues fixed", "fixed", fixed, "checks", req.Checks, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"fixed": fixed, "skipped": skipped})
+}
+
+// brokenImageRefresh is how often an instance reloads the broken-image
+// list, so every instance picks up a check run within a minute.
+const brokenImageRefresh = time.Minute
+
+// brokenImages holds the IDs of recipes whose image failed its checks.
+var brokenImages struct {
+	sync.Mutex
+	ids      map[int]bool
+	loadedAt time.Time
+}
+
+var imageCheckMu sync.Mutex
+
+func imageIsBroken(id int) bool {
+	brokenImages.Lock()
+	defer brokenImages.Unlock()
+	if brokenImages.ids == nil || time.Since(brokenImages.loadedAt) > brokenImageRefresh {
+		recordCacheLookup("broken_images", false)
+		rows, err := db.Query("SELECT id FROM recipes WHERE image_status = 'broken'")
+		if err != nil {
+			// Keep serving the last list rather than hiding every image.
+			slog.Warn("broken image list not loaded", "error", err)
+			return brokenImages.ids[id]
+		}
+		ids := map[int]bool{}
+		for rows.Next() {
+			var brokenID int
+			if rows.Scan(&brokenID) == nil {
+				ids[brokenID] = true
+			}
+		}
+		rows.Close()
+		brokenImages.ids, brokenImages.loadedAt = ids, time.Now()
+	} else {
+		recordCacheLookup("broken_images", true)
+	}
+	return brokenImages.ids[id]
+}
+
+// placeholderImageURL is IMAGE_PLACEHOLDER_URL when set, otherwise the
+// recipe's generated placeholder.
+func placeholderImageURL(id int) string {
+	if cfg.Images.PlaceholderURL != "" {
+		return cfg.Images.PlaceholderURL
+	}
+	return strings.TrimSuffix(cfg.PublicBaseURL, "/") + "/api/recipe/" + strconv.Itoa(id) + "/placeholder.svg"
+}
+
+// applyImageFallback swaps a dead image for a placeholder.
+func applyImageFallback(recipe *Recipe) {
+	if recipe.Image != "" && imageIsBroken(recipe.ID) {
+		recipe.Image = placeholderImageURL(recipe.ID)
+		recipe.ImagePlaceholder = true
+	}
+}
+
+// hasImageSQL filters on whether a recipe has a working image. Images not
+// checked yet count as working.
+func hasImageSQL(hasImage bool) string {
+	if hasImage {
+		return " AND image <> '' AND (image_status IS NULL OR image_status <> 'broken')"
+	}
+	return " AND (image = '' OR image_status = 'broken')"
+}
+
+type ImageCheckResult struct {
+	Checked   int `json:"checked"`
+	Broken    int `json:"broken"`
+	Recovered int `json:"recovered"`
+}
+
+// checkRecipeImages requests up to limit images that were never checked or
+// not within IMAGE_RECHECK_AFTER. An image is marked broken after
+// IMAGE_BROKEN_AFTER failures in a row, so one bad minute at a CDN does
+// not swap out every photo; a later success restores it. Images stored as
+// relative paths are served by this deployment and are not checked.
+func checkRecipeImages(ctx context.Context, limit int) (ImageCheckResult, error) {
+	var result ImageCheckResult
+	if !imageCheckMu.TryLock() {
+		return result, errors.New("an image check is already running")
+	}
+	defer imageCheckMu.Unlock()
+
+	rows, err := db.Query(`SELECT id, image, image_status FROM recipes
+		WHERE deleted_at IS NULL AND (image LIKE 'http://%' OR image LIKE 'https://%')
+			AND (image_checked_at IS NULL OR image_checked_at < NOW() - INTERVAL ? SECOND)
+		ORDER BY image_checked_at IS NOT NULL, image_checked_at, id LIMIT ?`, int(cfg.Images.RecheckAfter.Seconds()), limit)
+	if err != nil {
+		return result, err
+	}
+	type pendingImage struct {
+		id     int
+		url    string
+		status sql.NullString
+	}
+	pending := []pendingImage{}
+	for rows.Next() {
+		var image pendingImage
+		if err := rows.Scan(&image.id, &image.url, &image.status); err != nil {
+			rows.Close()
+			return result, err
+		}
+		pending = append(pending, image)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for _, image := range pending {
+		wg.Add(1)
+		go func(image pendingImage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			checkErr := checkImageURL(ctx, image.url)
+			var err error
+			if checkErr == nil {
+				_, err = db.Exec("UPDATE recipes SET image_status = 'ok', image_failures = 0, image_checked_at = NOW() WHERE id = ? AND image = ?", image.id, image.url)
+			} else {
+				_, err = db.Exec(`UPDATE recipes SET image_failures = LEAST(image_failures + 1, 100),
+					image_status = IF(image_failures >= ?, 'broken', image_status), image_checked_at = NOW() WHERE id = ? AND image = ?`,
+					cfg.Images.BrokenAfter, image.id, image.url)
+			}
+			if err != nil {
+				slog.Error("image check not recorded", "recipe_id", image.id, "error", err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Checked++
+			if checkErr != nil {
+				slog.Debug("recipe image check failed", "recipe_id", image.id, "error", checkErr)
+			} else if image.status.String == "broken" {
+				result.Recovered++
+			}
+		}(image)
+	}
+	wg.Wait()
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM recipes WHERE image_status = 'broken' AND deleted_at IS NULL").Scan(&result.Broken); err != nil {
+		return result, err
+	}
+	brokenImages.Lock()
+	brokenImages.ids = nil
+	brokenImages.Unlock()
+	return result, nil
+}
+
+// runImageCheck checks one batch now; ?limit= overrides IMAGE_CHECK_BATCH.
+func runImageCheck(c *gin.Context) {
+	limit := cfg.Images.CheckBatch
+	if raw := c.Query("limit"); raw != "" {
+		val, err := strconv.Atoi(raw)
+		if err != nil || val < 1 || val > maxImageChecks {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxImageChecks)})
+			return
+		}
+		limit = val
+	}
+
+	result, err := checkRecipeImages(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("recipe images checked", "checked", result.Checked, "broken", result.Broken, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, result)
+}
+
+type BrokenImage struct {
+	RecipeID  int        `json:"recipe_id"`
+	Name      string     `json:"name"`
+	Image     string     `json:"image"`
+	Failures  int        `json:"failures"`
+	CheckedAt *time.Time `json:"checked_at"`
+}
+
+func listBrokenImages(c *gin.Context) {
+	rows, err := db.Query("SELECT id, name, image, image_failures, image_checked_at FROM recipes WHERE image_status = 'broken' AND deleted_at IS NULL ORDER BY image_checked_at DESC, id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	images := []BrokenImage{}
+	for rows.Next() {
+		var image BrokenImage
+		if err := rows.Scan(&image.RecipeID, &image.Name, &image.Image, &image.Failures, &image.CheckedAt); err != nil {
+			continue
+		}
+		images = append(images, image)
+	}
+	c.JSON(http.StatusOK, gin.H{"images": images})
+}
+
+var placeholderTemplate = template.Must(template.New("placeholder").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="800" height="600" viewBox="0 0 800 600" role="img" aria-label="{{.Name}}">
+<rect width="800" height="600" fill="hsl({{.Hue}}, 45%, 88%)"/>
+<circle cx="400" cy="230" r="120" fill="hsl({{.Hue}}, 35%, 76%)"/>
+<circle cx="400" cy="230" r="84" fill="none" stroke="hsl({{.Hue}}, 35%, 66%)" stroke-width="6"/>
+<g font-family="Helvetica, Arial, sans-serif" font-size="40" font-weight="bold" fill="hsl({{.Hue}}, 40%, 25%)" text-anchor="middle">
+{{range $i, $line := .Lines}}<text x="400" y="{{index $.LineY $i}}">{{$line}}</text>
+{{end}}</g>
+</svg>
+`))
+
+// getRecipePlaceholder draws a placeholder for a recipe whose image is
+// missing or dead: a plate on a background coloured from the name, with the
+// name underneath.
+func getRecipePlaceholder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var name string
+	scope, args := tenantFromContext(c).recipeScope()
+	if err := db.QueryRow("SELECT name FROM recipes WHERE id = ? AND "+scope, append([]interface{}{id}, args...)...).Scan(&name); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	hue := 0
+	for _, r := range name {
+		hue = (hue*31 + int(r)) % 360
+	}
+	lines := wrapText(name, 28)
+	if len(lines) > 3 {
+		lines = append(lines[:2], strings.TrimSpace(lines[2])+"…")
+	}
+	lineY := []int{}
+	for i := range lines {
+		lineY = append(lineY, 430+i*50)
+	}
+
+	var out bytes.Buffer
+	if err := placeholderTemplate.Execute(&out, gin.H{"Name": name, "Hue": hue, "Lines": lines, "LineY": lineY}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, "image/svg+xml", out.Bytes())
+}
+
+type SetDifficultyRequest struct {
+	Difficulty string `json:"difficulty" binding:"required"`
+}
+
+// setRecipeDifficulty overrides the inferred difficulty of one recipe.
+func setRecipeDifficulty(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req SetDifficultyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if !slices.Contains(recipeDifficulties, req.Difficulty) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "difficulty must be one of: " + strings.Join(recipeDifficulties, ", ")})
+		return
+	}
+
+	res, err := db.Exec("UPDATE recipes SET difficulty = ? WHERE id = ?", req.Difficulty, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ?)", id).Scan(&exists); err != nil || !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+	}
+
+	requestLogger(c).Info("recipe difficulty set", "recipe_id", id, "difficulty", req.Difficulty, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "difficulty": req.Difficulty})
+}
+
+// inferDifficulties runs inferDifficulty over recipes without a difficulty,
+// or with overwrite=true over all of them, replacing manual overrides too.
+func inferDifficulties(c *gin.Context) {
+	overwrite := c.Query("overwrite") == "true"
+	updated, err := inferRecipeDifficulties(overwrite)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "updated": updated})
+		return
+	}
+
+	requestLogger(c).Info("recipe difficulty inferred", "updated", updated, "overwrite", overwrite, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"updated": updated, "overwrite": overwrite})
+}
+
+type SetEquipmentRequest struct {
+	Equipment []string `json:"equipment" binding:"required"`
+}
+
+// setRecipeEquipment replaces a recipe's equipment tags with a manual list,
+// which inference then leaves alone. An empty list is a valid override.
+func setRecipeEquipment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req SetEquipmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	tags, err := normalizeEquipmentTags(req.Equipment)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ?)", id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recipe_equipment WHERE recipe_id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// With no tags, a sentinel row records that the empty list is manual.
+	stored := tags
+	if len(stored) == 0 {
+		stored = []string{""}
+	}
+	for _, tag := range stored {
+		if _, err := tx.Exec("INSERT INTO recipe_equipment (recipe_id, equipment, source) VALUES (?, ?, 'manual')", id, tag); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Info("recipe equipment set", "recipe_id", id, "equipment", tags, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "equipment": tags, "source": "manual"})
+}
+
+// resetRecipeEquipment drops manual equipment tags and infers them again.
+func resetRecipeEquipment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	recipes, err := selectRecipes().Where("id = ?", id).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM recipe_equipment WHERE recipe_id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipe := recipes[0]
+	if err := storeInferredEquipment(recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRecipeEquipment(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Info("recipe equipment reset", "recipe_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "equipment": recipe.Equipment, "source": "inferred"})
+}
+
+// inferEquipmentTags tags recipes that have no equipment yet, or with
+// overwrite=true re-infers every recipe without manual tags.
+func inferEquipmentTags(c *gin.Context) {
+	overwrite := c.Query("overwrite") == "true"
+	processed, err := inferRecipeEquipment(overwrite)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "processed": processed})
+		return
+	}
+
+	requestLogger(c).Info("recipe equipment inferred", "processed", processed, "overwrite", overwrite, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"processed": processed, "overwrite": overwrite})
+}
+
+type SetTraitsRequest struct {
+	SpiceLevel  *int  `json:"spice_level"`
+	KidFriendly *bool `json:"kid_friendly"`
+}
+
+// setRecipeTraits overrides the spice level and/or kid-friendly flag of a
+// recipe; overridden values survive re-inference until reset.
+func setRecipeTraits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req SetTraitsRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.SpiceLevel == nil && req.KidFriendly == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.SpiceLevel != nil && (*req.SpiceLevel < spiceNone || *req.SpiceLevel > spiceHot) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("spice_level must be between %d and %d", spiceNone, spiceHot)})
+		return
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	if req.SpiceLevel != nil {
+		sets = append(sets, "spice_level = ?", "spice_level_overridden = TRUE")
+		args = append(args, *req.SpiceLevel)
+	}
+	if req.KidFriendly != nil {
+		sets = append(sets, "kid_friendly = ?", "kid_friendly_overridden = TRUE")
+		args = append(args, *req.KidFriendly)
+	}
+	res, err := db.Exec("UPDATE recipes SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, id)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ?)", id).Scan(&exists); err != nil || !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+	}
+
+	requestLogger(c).Info("recipe traits set", "recipe_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "spice_level": req.SpiceLevel, "kid_friendly": req.KidFriendly})
+}
+
+// resetRecipeTraits drops both overrides and infers the values again.
+func resetRecipeTraits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	if _, err := db.Exec("UPDATE recipes SET spice_level_overridden = FALSE, kid_friendly_overridden = FALSE WHERE id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipes, err := selectRecipes().Where("id = ?", id).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	recipe := recipes[0]
+	spiceLevel := inferSpiceLevel(recipe)
+	if err := storeInferredTraits(recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Info("recipe traits reset", "recipe_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "spice_level": spiceLevel, "kid_friendly": inferKidFriendly(recipe, spiceLevel)})
+}
+
+// inferTraits fills in spice levels and kid-friendly flags that are
+// missing, or with overwrite=true recomputes every value not overridden.
+func inferTraits(c *gin.Context) {
+	overwrite := c.Query("overwrite") == "true"
+	updated, err := inferRecipeTraits(overwrite)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "updated": updated})
+		return
+	}
+
+	requestLogger(c).Info("recipe traits inferred", "updated", updated, "overwrite", overwrite, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"updated": updated, "overwrite": overwrite})
+}
+
+type SetStorageRequest struct {
+	FridgeDays    *int   `json:"fridge_days" binding:"required"`
+	FreezerMonths *int   `json:"freezer_months" binding:"required"`
+	Reheat        string `json:"reheat"`
+}
+
+// setRecipeStorage records an editor's storage guidance, replacing the
+// inferred estimate.
+func setRecipeStorage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req SetStorageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if *req.FridgeDays < 0 || *req.FridgeDays > 14 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fridge_days must be between 0 and 14"})
+		return
+	}
+	if *req.FreezerMonths < 0 || *req.FreezerMonths > 12 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "freezer_months must be between 0 and 12"})
+		return
+	}
+	req.Reheat = strings.TrimSpace(req.Reheat)
+	if len(req.Reheat) > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reheat must be at most 500 characters"})
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ?)", id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	_, err = db.Exec(`INSERT INTO recipe_storage (recipe_id, fridge_days, freezer_months, reheat) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE fridge_days = VALUES(fridge_days), freezer_months = VALUES(freezer_months), reheat = VALUES(reheat), updated_at = CURRENT_TIMESTAMP`,
+		id, *req.FridgeDays, *req.FreezerMonths, req.Reheat)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Info("recipe storage set", "recipe_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "storage": Storability{FridgeDays: *req.FridgeDays, FreezerMonths: *req.FreezerMonths, Reheat: req.Reheat, Source: "manual"}})
+}
+
+// resetRecipeStorage drops the editor's entry so the estimate applies again.
+func resetRecipeStorage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	if _, err := db.Exec("DELETE FROM recipe_storage WHERE recipe_id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recipes, err := selectRecipes().Where("id = ?", id).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	requestLogger(c).Info("recipe storage reset", "recipe_id", id, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"id": id, "storage": inferStorability(recipes[0])})
+}
+
+// AuditEntry is one recorded admin or write action.
+type AuditEntry struct {
+	ID          int64     `json:"id"`
+	Actor       string    `json:"actor"`
+	Method      string    `json:"method"`
+	Endpoint    string    `json:"endpoint"`
+	Path        string    `json:"path"`
+	PayloadHash string    `json:"payload_hash"`
+	ClientIP    string    `json:"client_ip"`
+	Status      int       `json:"status"`
+	RequestID   string    `json:"request_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// auditLog records the request in audit_log once it has been handled. It
+// runs ahead of authentication so rejected attempts are recorded too. Only
+// a SHA-256 of the body is kept, never the payload itself.
+func auditLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The body is hashed as the handler reads it, and the rest after,
+		// so large uploads like backup imports are never held in memory.
+		hasher := sha256.New()
+		body := c.Request.Body
+		if body != nil {
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(body, hasher), body}
+		}
+
+		c.Next()
+
+		payloadHash := ""
+		if body != nil {
+			io.Copy(hasher, body)
+			if sum := hex.EncodeToString(hasher.Sum(nil)); sum != hashToken("") {
+				payloadHash = sum
+			}
+		}
+
+		actor := adminFromContext(c).Subject
+		if actor == "" {
+			actor = apiKeyID(c)
+		}
+
+		_, err := db.Exec(`INSERT INTO audit_log (actor, method, endpoint, path, payload_hash, client_ip, status, request_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			actor, c.Request.Method, c.FullPath(), c.Request.URL.Path, payloadHash, c.ClientIP(), c.Writer.Status(), c.GetString("request_id"))
+		if err != nil {
+			requestLogger(c).Error("failed to write audit log", "error", err)
+		}
+	}
+}
+
+func getAuditLog(c *gin.Context) {
+	query := "SELECT id, actor, method, endpoint, path, payload_hash, client_ip, status, request_id, created_at FROM audit_log WHERE 1=1"
+	args := []interface{}{}
+
+	if actor := c.Query("actor"); actor != "" {
+		query += " AND actor = ?"
+		args = append(args, actor)
+	}
+	if endpoint := c.Query("endpoint"); endpoint != "" {
+		query += " AND endpoint = ?"
+		args = append(args, endpoint)
+	}
+	if method := c.Query("method"); method != "" {
+		query += " AND method = ?"
+		args = append(args, strings.ToUpper(method))
+	}
+	if from := c.Query("from"); from != "" {
+		query += " AND created_at >= ?"
+		args = append(args, from)
+	}
+	if to := c.Query("to"); to != "" {
+		query += " AND created_at < DATE_ADD(?, INTERVAL 1 DAY)"
+		args = append(args, to)
+	}
+
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.Actor, &entry.Method, &entry.Endpoint, &entry.Path,
+			&entry.PayloadHash, &entry.ClientIP, &entry.Status, &entry.RequestID, &entry.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"count":   len(entries),
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// purgeableCaches are the caches ops can drop through the admin API. Each
+// rebuilds itself from the database on next use. The in-memory ones live
+// per instance, so a purge only reaches the instance that handles it; the
+// others pick up changes within their own refresh interval.
+var purgeableCaches = map[string]func() error{
+	"spell_dictionary":    func() error { invalidateSpellDictionaries(); return nil },
+	"tenants":             func() error { tenants.invalidate(); return nil },
+	"feature_flags":       func() error { features.invalidate(); return nil },
+	"ranking_experiment":  func() error { rankingExperiment.invalidate(); return nil },
+	"ingredient_synonyms": func() error { ingredientSynonyms.invalidate(); return nil },
+	"catalog_stats":       func() error { catalogStatistics.invalidate(); return nil },
+	"snapshot_manifest":   func() error { snapshots.invalidate(); return nil },
+	"broken_images": func() error {
+		brokenImages.Lock()
+		brokenImages.ids = nil
+		brokenImages.Unlock()
+		return nil
+	},
+	"kroger_token": func() error {
+		krogerToken.Lock()
+		krogerToken.value = ""
+		krogerToken.Unlock()
+		return nil
+	},
+	"image_hashes": func() error {
+		_, err := db.Exec("DELETE FROM recipe_image_hashes")
+		return err
+	},
+}
+
+type PurgeCacheRequest struct {
+	Pattern string `json:"pattern" binding:"required"`
+}
+
+// purgeCache drops every cache whose name matches the glob pattern, e.g.
+// "*" or "spell_*".
+func purgeCache(c *gin.Context) {
+	var req PurgeCacheRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if _, err := path.Match(req.Pattern, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pattern: " + err.Error()})
+		return
+	}
+
+	names := make([]string, 0, len(purgeableCaches))
+	for name := range purgeableCaches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	purged := []string{}
+	for _, name := range names {
+		if ok, _ := path.Match(req.Pattern, name); !ok {
+			continue
+		}
+		if err := purgeableCaches[name](); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "purged": purged})
+			return
+		}
+		purged = append(purged, name)
+	}
+	if len(purged) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no cache matches " + req.Pattern, "caches": names})
+		return
+	}
+
+	requestLogger(c).Info("caches purged", "caches", purged, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// Job statuses, in the order a job passes through them.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// Job is a long-running admin task. Jobs are recorded in admin_jobs so any
+// instance can report on them, but each runs on the instance that started
+// it.
+type Job struct {
+	ID         int64           `json:"id"`
+	Kind       string          `json:"kind"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	Status     string          `json:"status"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedBy  string          `json:"created_by"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at"`
+}
+
+// startJob records a job and runs it in the background, or before
+// returning with wait. Serverless platforms may freeze a function once it
+// has responded, so callers there should wait.
+func startJob(kind string, params interface{}, by string, wait bool, run func(ctx context.Context) (interface{}, error)) (int64, error) {
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec("INSERT INTO admin_jobs (kind, params, status, created_by) VALUES (?, ?, ?, ?)", kind, paramsJSON, jobQueued, by)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	execute := func() {
+		logger := slog.With("job", id, "kind", kind)
+		if _, err := db.Exec("UPDATE admin_jobs SET status = ?, started_at = NOW() WHERE id = ?", jobRunning, id); err != nil {
+			logger.Error("job not started", "error", err)
+			return
+		}
+		result, runErr := run(context.Background())
+		resultJSON, err := json.Marshal(result)
+		if err != nil && runErr == nil {
+			runErr = err
+		}
+		status, message := jobSucceeded, ""
+		if runErr != nil {
+			status, message = jobFailed, runErr.Error()
+			logger.Error("job failed", "error", runErr)
+		} else {
+			logger.Info("job succeeded")
+		}
+		if _, err := db.Exec("UPDATE admin_jobs SET status = ?, result = ?, error = ?, finished_at = NOW() WHERE id = ?", status, resultJSON, message, id); err != nil {
+			logger.Error("job status not recorded", "error", err)
+		}
+	}
+	if wait {
+		execute()
+	} else {
+		go execute()
+	}
+	return id, nil
+}
+
+func loadJob(id int64) (Job, error) {
+	var job Job
+	var params, result []byte
+	var message sql.NullString
+	err := db.QueryRow("SELECT id, kind, params, status, result, error, created_by, created_at, started_at, finished_at FROM admin_jobs WHERE id = ?", id).
+		Scan(&job.ID, &job.Kind, &params, &job.Status, &result, &message, &job.CreatedBy, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+	job.Params, job.Result, job.Error = params, result, message.String
+	return job, err
+}
+
+func getJob(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+	job, err := loadJob(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// reindexMu keeps full reindexes on one instance from overlapping.
+var reindexMu sync.Mutex
+
+// ReindexResult counts what a reindex changed.
+type ReindexResult struct {
+	Recipes      int `json:"recipes"`
+	Difficulties int `json:"difficulties"`
+	Equipment    int `json:"equipment"`
+	Steps        int `json:"steps"`
+	Traits       int `json:"traits"`
+	Costs        int `json:"costs"`
+	Emissions    int `json:"emissions"`
+	Nutrition    int `json:"nutrition"`
+	Glycemic     int `json:"glycemic"`
+}
+
+// reindexAll rebuilds the search dictionaries and recomputes every derived
+// recipe field. Manual difficulty, equipment and trait overrides are kept.
+func reindexAll(ctx context.Context) (interface{}, error) {
+	if !reindexMu.TryLock() {
+		return nil, fmt.Errorf("a reindex is already running")
+	}
+	defer reindexMu.Unlock()
+
+	invalidateSpellDictionaries()
+	ingredientSynonyms.invalidate()
+	if _, err := searchSpelling.load(nil); err != nil {
+		return nil, fmt.Errorf("spell dictionary: %w", err)
+	}
+
+	var result ReindexResult
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM recipes").Scan(&result.Recipes); err != nil {
+		return nil, err
+	}
+	steps := []struct {
+		name  string
+		count *int
+		run   func() (int, error)
+	}{
+		{"difficulty", &result.Difficulties, func() (int, error) { return inferRecipeDifficulties(false) }},
+		{"equipment", &result.Equipment, func() (int, error) { return inferRecipeEquipment(true) }},
+		{"steps", &result.Steps, func() (int, error) { return extractRecipeSteps(true) }},
+		{"traits", &result.Traits, func() (int, error) { return inferRecipeTraits(true) }},
+		{"cost", &result.Costs, func() (int, error) { return costEstimate.recompute(false) }},
+		{"co2e", &result.Emissions, func() (int, error) { return emissionsEstimate.recompute(false) }},
+		{"nutrition", &result.Nutrition, func() (int, error) { return recomputeNutritionEstimates(false) }},
+		{"glycemic", &result.Glycemic, func() (int, error) { return recomputeGlycemicEstimates(false) }},
+	}
+	for _, step := range steps {
+		n, err := step.run()
+		*step.count = n
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", step.name, err)
+		}
+	}
+	return result, nil
+}
+
+// reindexRecipe recomputes the derived fields of one recipe.
+func reindexRecipe(ctx context.Context, id int) (interface{}, error) {
+	recipes, err := selectRecipes().Where("id = ?", id).Prepared().All()
+	if err != nil {
+		return nil, err
+	}
+	if len(recipes) == 0 {
+		return nil, fmt.Errorf("recipe %d not found", id)
+	}
+	recipe := recipes[0]
+	result := ReindexResult{Recipes: 1}
+
+	res, err := db.ExecContext(ctx, "UPDATE recipes SET difficulty = ? WHERE id = ? AND difficulty IS NULL", inferDifficulty(recipe), id)
+	if err != nil {
+		return result, fmt.Errorf("difficulty: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		result.Difficulties = 1
+	}
+	if err := storeInferredEquipment(recipe); err != nil {
+		return result, fmt.Errorf("equipment: %w", err)
+	}
+	result.Equipment = 1
+	if err := storeRecipeSteps(recipe); err != nil {
+		return result, fmt.Errorf("steps: %w", err)
+	}
+	result.Steps = 1
+	if err := storeInferredTraits(recipe); err != nil {
+		return result, fmt.Errorf("traits: %w", err)
+	}
+	result.Traits = 1
+	estimates := map[*recipeEstimate]*int{costEstimate: &result.Costs, emissionsEstimate: &result.Emissions}
+	for e, count := range estimates {
+		res, err := db.ExecContext(ctx, "UPDATE recipes SET "+e.RecipeColumn+" = ? WHERE id = ?", e.estimate(recipe), id)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", e.Name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			*count = 1
+		}
+	}
+	factors, err := nutritionFactors.get()
+	if err != nil {
+		return result, fmt.Errorf("nutrition: %w", err)
+	}
+	if stored, err := storeNutritionEstimate(recipe, factors); err != nil {
+		return result, fmt.Errorf("nutrition: %w", err)
+	} else if stored {
+		result.Nutrition = 1
+	}
+	if stored, err := storeGlycemicEstimate(recipe, factors); err != nil {
+		return result, fmt.Errorf("glycemic: %w", err)
+	} else if stored {
+		result.Glycemic = 1
+	}
+	return result, nil
+}
+
+type ReindexRequest struct {
+	RecipeID *int `json:"recipe_id"`
+}
+
+// reindex starts a full or single-recipe reindex and answers with the job
+// to poll. ?wait=true runs it within the request, as serverless
+// deployments need.
+func reindex(c *gin.Context) {
+	var req ReindexRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+	wait := c.Query("wait") == "true"
+
+	kind := "reindex"
+	run := reindexAll
+	if req.RecipeID != nil {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ?)", *req.RecipeID).Scan(&exists); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+			return
+		}
+		id := *req.RecipeID
+		kind = "reindex_recipe"
+		run = func(ctx context.Context) (interface{}, error) { return reindexRecipe(ctx, id) }
+	}
+
+	by := adminFromContext(c).Subject
+	id, err := startJob(kind, req, by, wait, run)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("reindex started", "job", id, "recipe_id", req.RecipeID, "by", by)
+
+	if !wait {
+		c.Header("Location", fmt.Sprintf("/api/admin/jobs/%d", id))
+		c.JSON(http.StatusAccepted, gin.H{"job_id": id, "status": jobQueued, "status_url": fmt.Sprintf("/api/admin/jobs/%d", id)})
+		return
+	}
+	job, err := loadJob(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// scheduledTask is periodic upkeep. Long-running servers run each task
+// every Interval (zero disables it); serverless deployments have the
+// platform's cron call /api/cron/<name> instead.
+type scheduledTask struct {
+	Interval func() time.Duration
+	Run      func(ctx context.Context) (interface{}, error)
+}
+
+var scheduledTasks = map[string]scheduledTask{
+	"cache_warmup": {
+		Interval: func() time.Duration { return cfg.Scheduler.WarmupInterval },
+		Run:      warmCaches,
+	},
+	"image_check": {
+		Interval: func() time.Duration { return cfg.Images.CheckInterval },
+		Run: func(ctx context.Context) (interface{}, error) {
+			return checkRecipeImages(ctx, cfg.Images.CheckBatch)
+		},
+	},
+	"nutrition_estimates": {
+		Interval: func() time.Duration { return cfg.Scheduler.NutritionInterval },
+		Run: func(ctx context.Context) (interface{}, error) {
+			changed, err := recomputeNutritionEstimates(true)
+			return gin.H{"changed": changed}, err
+		},
+	},
+	"rating_aggregates": {
+		Interval: func() time.Duration { return cfg.Scheduler.RatingsInterval },
+		Run:      recalculateRatings,
+	},
+	"snapshots": {
+		Interval: func() time.Duration { return cfg.Snapshots.Interval },
+		Run:      publishSnapshots,
+	},
+	// Long-running servers retry alerts in startAlertDispatcher; this is
+	// for the platform's cron.
+	"saved_search_alerts": {
+		Interval: func() time.Duration { return 0 },
+		Run: func(ctx context.Context) (interface{}, error) {
+			sent, failed := deliverPendingAlerts()
+			return gin.H{"sent": sent, "failed": failed}, nil
+		},
+	},
+}
+
+// warmCaches loads the caches search and recipe responses depend on, so
+// the first requests after a deploy or purge don't pay for the rebuild.
+func warmCaches(ctx context.Context) (interface{}, error) {
+	words, err := searchSpelling.load(nil)
+	if err != nil {
+		return nil, fmt.Errorf("spell dictionary: %w", err)
+	}
+	imageIsBroken(0)
+	brokenImages.Lock()
+	broken := len(brokenImages.ids)
+	brokenImages.Unlock()
+	return gin.H{
+		"spell_dictionary":    len(words),
+		"ingredient_synonyms": len(ingredientSynonyms.load()),
+		"broken_images":       broken,
+	}, nil
+}
+
+// lastTaskRun is when the task last started on any instance, or the zero
+// time if it never has.
+func lastTaskRun(name string) (time.Time, error) {
+	var last sql.NullTime
+	err := db.QueryRow("SELECT MAX(created_at) FROM admin_jobs WHERE kind = ?", name).Scan(&last)
+	return last.Time, err
+}
+
+var schedulerOnce sync.Once
+
+// startScheduler checks every minute for tasks that are due. A task is due
+// once its interval has passed since it last ran anywhere, so several
+// instances, or a platform cron alongside, don't repeat each other's work.
+func startScheduler() {
+	schedulerOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			for range ticker.C {
+				for _, name := range sortedKeys(scheduledTasks) {
+					interval := scheduledTasks[name].Interval()
+					if interval <= 0 {
+						continue
+					}
+					last, err := lastTaskRun(name)
+					if err != nil {
+						slog.Error("scheduled task lookup failed", "task", name, "error", err)
+						continue
+					}
+					if time.Since(last) < interval {
+						continue
+					}
+					if _, err := startJob(name, nil, "scheduler", true, scheduledTasks[name].Run); err != nil {
+						slog.Error("scheduled task not started", "task", name, "error", err)
+					}
+				}
+			}
+		}()
+	})
+}
+
+// runCronTask runs a scheduled task for the platform's cron, which
+// authenticates with CRON_SECRET as a bearer token. The task runs within
+// the request; a failed run answers 500 so the platform reports it.
+func runCronTask(c *gin.Context) {
+	secret := cfg.Scheduler.CronSecret
+	if secret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "cron is not configured"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(secret)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid cron secret"})
+		return
+	}
+	name := c.Param("task")
+	task, ok := scheduledTasks[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown task " + name})
+		return
+	}
+
+	id, err := startJob(name, nil, "cron", true, task.Run)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	job, err := loadJob(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status := http.StatusOK
+	if job.Status == jobFailed {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, job)
+}
+
+type ScheduledTaskStatus struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
+	LastJob  *Job   `json:"last_job"`
+}
+
+// listScheduledTasks reports each task's interval and most recent run.
+func listScheduledTasks(c *gin.Context) {
+	tasks := []ScheduledTaskStatus{}
+	for _, name := range sortedKeys(scheduledTasks) {
+		status := ScheduledTaskStatus{Name: name, Interval: "disabled"}
+		if interval := scheduledTasks[name].Interval(); interval > 0 {
+			status.Interval = interval.String()
+		}
+		var id int64
+		err := db.QueryRow("SELECT id FROM admin_jobs WHERE kind = ? ORDER BY id DESC LIMIT 1", name).Scan(&id)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err == nil {
+			job, err := loadJob(id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			status.LastJob = &job
+		}
+		tasks = append(tasks, status)
+	}
+	c.JSON(http.StatusOK, gin.H{"tasks": tasks})
+}
+
+// uploadImageTypes maps the content types accepted for recipe images to the
+// file extension used in their storage key.
+var uploadImageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/webp": "webp",
+	"image/gif":  "gif",
+}
+
+// storageObjectURL returns the bucket URL for key, honouring path-style
+// addressing for MinIO and other S3-compatible servers.
+func storageObjectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(cfg.Storage.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Storage.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + cfg.Storage.Bucket + "/" + key
+	} else {
+		u.Host = cfg.Storage.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return u, nil
+}
+
+// storageRequest sends a SigV4-signed request for key to the configured
+// S3-compatible bucket. GCS accepts the same signature through its
+// interoperability API with HMAC keys.
+func storageRequest(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	u, err := storageObjectURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := hashToken(string(body))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+		signedHeaders = "content-type;" + signedHeaders
+		canonicalHeaders = "content-type:" + contentType + "\n" + canonicalHeaders
+	}
+
+	canonicalRequest := strings.Join([]string{method, u.EscapedPath(), "", canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + cfg.Storage.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashToken(canonicalRequest)
+
+	sign := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	signingKey := sign(sign(sign(sign([]byte("AWS4"+cfg.Storage.SecretAccessKey), date), cfg.Storage.Region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(sign(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.Storage.AccessKeyID, scope, signedHeaders, signature))
+
+	return http.DefaultClient.Do(req)
+}
+
+func putStorageObject(ctx context.Context, key string, body []byte, contentType string) error {
+	resp, err := storageRequest(ctx, http.MethodPut, key, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// uploadRecipeImage stores a multipart "image" upload and points the recipe
+// at its CDN URL. Keys are content-addressed, so re-uploading the same file
+// is harmless.
+func uploadRecipeImage(c *gin.Context) {
+	if cfg.Storage.Bucket == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image storage is not configured"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ? AND deleted_at IS NULL)", id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	upload, ok := storeUploadedImage(c, id)
+	if !ok {
+		return
+	}
+
+	if _, err := db.Exec("UPDATE recipes SET image = ?, image_status = NULL, image_failures = 0, image_checked_at = NULL WHERE id = ?", upload.URL, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":           id,
+		"image":        upload.URL,
+		"key":          upload.Key,
+		"content_type": upload.ContentType,
+		"size":         upload.Size,
+	})
+}
+
+type storedImage struct {
+	Key         string
+	URL         string
+	ContentType string
+	Size        int
+}
+
+// storeUploadedImage validates the multipart "image" field and writes it to
+// storage under the recipe's prefix. On failure it has already written the
+// error response.
+func storeUploadedImage(c *gin.Context, recipeID int) (storedImage, bool) {
+	data, contentType, ok := readUploadedImage(c)
+	if !ok {
+		return storedImage{}, false
+	}
+	ext := uploadImageTypes[contentType]
+
+	key := fmt.Sprintf("recipes/%d/%s.%s", recipeID, hashToken(string(data))[:16], ext)
+	if err := putStorageObject(c.Request.Context(), key, data, contentType); err != nil {
+		requestLogger(c).Error("image upload failed", "recipe_id", recipeID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store image"})
+		return storedImage{}, false
+	}
+
+	return storedImage{
+		Key:         key,
+		URL:         strings.TrimSuffix(cfg.Storage.PublicURL, "/") + "/" + key,
+		ContentType: contentType,
+		Size:        len(data),
+	}, true
+}
+
+// readUploadedImage reads the multipart "image" field, up to
+// STORAGE_MAX_UPLOAD_BYTES, and checks it is an image type we accept. On
+// failure it has already written the error response.
+func readUploadedImage(c *gin.Context) ([]byte, string, bool) {
+	// Leave room for the multipart framing around the file itself.
+	maxBytes := int64(cfg.Storage.MaxUploadBytes)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+64<<10)
+
+	header, err := c.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Image must be at most %d bytes", maxBytes)})
+			return nil, "", false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a multipart form with an image field"})
+		return nil, "", false
+	}
+	if header.Size > maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Image must be at most %d bytes", maxBytes)})
+		return nil, "", false
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+
+	// Trust the bytes, not the client's Content-Type.
+	contentType := http.DetectContentType(data)
+	if _, ok := uploadImageTypes[contentType]; !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Image must be JPEG, PNG, WebP or GIF"})
+		return nil, "", false
+	}
+
+	return data, contentType, true
+}
+
+// Static snapshots. publishSnapshots renders every public recipe and the
+// most popular anonymous searches, exactly as the API would answer them,
+// to JSON objects in the storage bucket under SNAPSHOT_PREFIX, then a
+// manifest listing them. With SNAPSHOT_SERVE, serveSnapshots answers
+// anonymous requests that have a snapshot from the CDN copy instead of the
+// database, until the manifest is older than SNAPSHOT_MAX_AGE.
+const (
+	snapshotRenderKey      = "snapshot_render"
+	snapshotManifestTTL    = 5 * time.Minute
+	popularSearchWindow    = 7 * 24 * time.Hour
+	maxSearchQueryKeyBytes = 512
+)
+
+var snapshotHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// SnapshotManifest lists the published snapshots. Searches maps the hash
+// naming each search's object to its normalized query.
+type SnapshotManifest struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Recipes     []int             `json:"recipes"`
+	Searches    map[string]string `json:"searches"`
+}
+
+// searchQueryKey normalizes a search's query string: empty parameters
+// dropped, the rest in sorted order.
+func searchQueryKey(query url.Values) string {
+	kept := url.Values{}
+	for name, values := range query {
+		for _, value := range values {
+			if value != "" {
+				kept.Add(name, value)
+			}
+		}
+	}
+	return kept.Encode()
+}
+
+// recordSearchQuery counts an anonymous search towards today's popular
+// searches, which publishSnapshots renders.
+func recordSearchQuery(c *gin.Context) {
+	if c.GetBool(snapshotRenderKey) || !snapshotEligible(c) {
+		return
+	}
+	key := searchQueryKey(c.Request.URL.Query())
+	if len(key) > maxSearchQueryKeyBytes {
+		return
+	}
+	if _, err := db.Exec("INSERT INTO search_queries (query_key, day, searches) VALUES (?, UTC_DATE(), 1) ON DUPLICATE KEY UPDATE searches = searches + 1", key); err != nil {
+		requestLogger(c).Warn("search query not recorded", "error", err)
+	}
+}
+
+// snapshotEligible reports whether the response to c would be the same for
+// every anonymous caller: no key, tenant or token, the source language and
+// JSON.
+func snapshotEligible(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet || c.GetHeader("X-API-Key") != "" || c.GetHeader("Authorization") != "" || tenantFromContext(c) != nil {
+		return false
+	}
+	if c.Query("units") != "" || len(preferredLocales(c)) > 0 {
+		return false
+	}
+	_, transcoded := responseEncoders[c.NegotiateFormat(append([]string{binding.MIMEJSON}, sortedKeys(responseEncoders)...)...)]
+	return !transcoded
+}
+
+var (
+	snapshotRendererOnce sync.Once
+	snapshotRenderer     *gin.Engine
+)
+
+// renderSnapshot answers an anonymous GET for target with the handlers
+// snapshots are taken of, leaving out the public middleware, and returns
+// the response.
+func renderSnapshot(target string) (int, []byte) {
+	snapshotRendererOnce.Do(func() {
+		snapshotRenderer = gin.New()
+		snapshotRenderer.Use(func(c *gin.Context) { c.Set(snapshotRenderKey, true) })
+		snapshotRenderer.GET("/api/recipe/:id", getRecipeByID)
+		snapshotRenderer.GET("/api/recipes/search", searchRecipes)
+	})
+	w := httptest.NewRecorder()
+	snapshotRenderer.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w.Code, w.Body.Bytes()
+}
+
+func snapshotKey(name string) string {
+	return strings.Trim(cfg.Snapshots.Prefix, "/") + "/" + name
+}
+
+// publishSnapshots renders and uploads the snapshots and their manifest.
+func publishSnapshots(ctx context.Context) (interface{}, error) {
+	if cfg.Storage.Bucket == "" {
+		return nil, errors.New("snapshots need STORAGE_BUCKET")
+	}
+	manifest := SnapshotManifest{GeneratedAt: time.Now().UTC(), Recipes: []int{}, Searches: map[string]string{}}
+	failed := 0
+	if _, err := db.Exec("DELETE FROM search_queries WHERE day < ?", manifest.GeneratedAt.Add(-2*popularSearchWindow).Format(time.DateOnly)); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT query_key FROM search_queries WHERE day >= ?
+		GROUP BY query_key ORDER BY SUM(searches) DESC, query_key LIMIT ?`, manifest.GeneratedAt.Add(-popularSearchWindow).Format(time.DateOnly), cfg.Snapshots.TopSearches)
+	if err != nil {
+		return nil, err
+	}
+	queries := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		queries = append(queries, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, query := range queries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		status, body := renderSnapshot("/api/recipes/search?" + query)
+		if status != http.StatusOK {
+			continue
+		}
+		hash := hashToken(query)[:16]
+		if err := putStorageObject(ctx, snapshotKey("searches/"+hash+".json"), body, "application/json"); err != nil {
+			failed++
+			slog.Warn("search snapshot not stored", "query", query, "error", err)
+			continue
+		}
+		manifest.Searches[hash] = query
+	}
+
+	_, err = eachRecipeBatch(recipeStatusPublished, func(recipes []Recipe) error {
+		for _, recipe := range recipes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			id := strconv.Itoa(recipe.ID)
+			status, body := renderSnapshot("/api/recipe/" + id)
+			if status != http.StatusOK {
+				// Tenant recipes aren't public.
+				continue
+			}
+			if err := putStorageObject(ctx, snapshotKey("recipes/"+id+".json"), body, "application/json"); err != nil {
+				failed++
+				slog.Warn("recipe snapshot not stored", "recipe_id", recipe.ID, "error", err)
+				continue
+			}
+			manifest.Recipes = append(manifest.Recipes, recipe.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := putStorageObject(ctx, snapshotKey("manifest.json"), data, "application/json"); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	snapshots.set(&manifest)
+	return gin.H{"recipes": len(manifest.Recipes), "searches": len(manifest.Searches), "failed": failed, "generated_at": manifest.GeneratedAt}, nil
+}
+
+// startSnapshotPublish starts a publishSnapshots job.
+func startSnapshotPublish(c *gin.Context) {
+	if cfg.Storage.Bucket == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Storage is not configured"})
+		return
+	}
+	by := adminFromContext(c).Subject
+	id, err := startJob("snapshot_publish", nil, by, c.Query("wait") == "true", publishSnapshots)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("snapshot publish started", "job", id, "by", by)
+	c.Header("Location", fmt.Sprintf("/api/admin/jobs/%d", id))
+	c.JSON(http.StatusAccepted, gin.H{"job_id": id, "status": jobQueued, "status_url": fmt.Sprintf("/api/admin/jobs/%d", id)})
+}
+
+// snapshotCache holds the published manifest, refetched from the CDN every
+// snapshotManifestTTL so every instance learns of a new publish.
+type snapshotCache struct {
+	mu       sync.Mutex
+	manifest *SnapshotManifest
+	recipes  map[int]bool
+	loadedAt time.Time
+}
+
+var snapshots = &snapshotCache{}
+
+func (s *snapshotCache) set(manifest *SnapshotManifest) {
+	recipes := make(map[int]bool, len(manifest.Recipes))
+	for _, id := range manifest.Recipes {
+		recipes[id] = true
+	}
+	s.mu.Lock()
+	s.manifest, s.recipes, s.loadedAt = manifest, recipes, time.Now()
+	s.mu.Unlock()
+}
+
+// get returns the manifest and its recipe set, or nil when there is none.
+// A failed fetch keeps the previous manifest until the next refresh.
+func (s *snapshotCache) get(ctx context.Context) (*SnapshotManifest, map[int]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.loadedAt) < snapshotManifestTTL {
+		recordCacheLookup("snapshot_manifest", true)
+		return s.manifest, s.recipes
+	}
+	recordCacheLookup("snapshot_manifest", false)
+	s.loadedAt = time.Now()
+
+	var manifest SnapshotManifest
+	if err := fetchSnapshot(ctx, "manifest.json", func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&manifest)
+	}); err != nil {
+		slog.Warn("snapshot manifest not loaded", "error", err)
+		return s.manifest, s.recipes
+	}
+	s.manifest, s.recipes = &manifest, make(map[int]bool, len(manifest.Recipes))
+	for _, id := range manifest.Recipes {
+		s.recipes[id] = true
+	}
+	return s.manifest, s.recipes
+}
+
+func (s *snapshotCache) invalidate() {
+	s.mu.Lock()
+	s.manifest, s.recipes, s.loadedAt = nil, nil, time.Time{}
+	s.mu.Unlock()
+}
+
+// fetchSnapshot GETs a published object from STORAGE_PUBLIC_URL.
+func fetchSnapshot(ctx context.Context, name string, read func(body io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(cfg.Storage.PublicURL, "/")+"/"+snapshotKey(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := snapshotHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot %s returned status %d", name, resp.StatusCode)
+	}
+	return read(resp.Body)
+}
+
+// serveSnapshots answers anonymous recipe and search requests from their
+// published snapshot when SNAPSHOT_SERVE is on. Anything without a fresh
+// snapshot, or whose snapshot can't be fetched, goes to the handler.
+func serveSnapshots() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !cfg.Snapshots.Serve || !snapshotEligible(c) {
+			c.Next()
+			return
+		}
+		manifest, recipes := snapshots.get(c.Request.Context())
+		if manifest == nil || time.Since(manifest.GeneratedAt) > cfg.Snapshots.MaxAge {
+			c.Next()
+			return
+		}
+		name := ""
+		switch c.FullPath() {
+		case "/api/recipe/:id":
+			if id, err := strconv.Atoi(c.Param("id")); err == nil && recipes[id] && c.Request.URL.RawQuery == "" {
+				name = "recipes/" + strconv.Itoa(id) + ".json"
+			}
+		case "/api/recipes/search":
+			query := searchQueryKey(c.Request.URL.Query())
+			hash := hashToken(query)[:16]
+			if published, ok := manifest.Searches[hash]; ok && published == query {
+				name = "searches/" + hash + ".json"
+			}
+		}
+		if name == "" {
+			c.Next()
+			return
+		}
+
+		err := fetchSnapshot(c.Request.Context(), name, func(body io.Reader) error {
+			c.Header("X-Snapshot-Generated-At", manifest.GeneratedAt.Format(time.RFC3339))
+			c.DataFromReader(http.StatusOK, -1, "application/json; charset=utf-8", body, nil)
+			return nil
+		})
+		if err != nil {
+			requestLogger(c).Warn("snapshot not served", "snapshot", name, "error", err)
+			c.Next()
+			return
+		}
+		// A search or view served from its snapshot still counts, or it
+		// would fall out of the next publish.
+		switch c.FullPath() {
+		case "/api/recipes/search":
+			recordSearchQuery(c)
+		case "/api/recipe/:id":
+			id, _ := strconv.Atoi(c.Param("id"))
+			recordRecipeView(c, id)
+		}
+		c.Abort()
+	}
+}
+
+const (
+	maxImageDimension = 2000
+	maxSourcePixels   = 40_000_000
+)
+
+var imageKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_\-]+(/[A-Za-z0-9_\-]+)*\.[a-z0-9]+$`)
+
+// imageEncoders lists the output formats the resizer can produce, in order
+// of preference when the client's Accept header allows them. Explicit
+// formats are only sent to clients that name them, since browsers that
+// can't show WebP still send image/*. There is no AVIF encoder in Go
+// without cgo, so AVIF is never offered.
+var imageEncoders = []struct {
+	ContentType string
+	Explicit    bool
+	Encode      func(io.Writer, image.Image) error
+}{
+	{"image/jpeg", false, func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, &jpeg.Options{Quality: 82}) }},
+	{"image/webp", true, encodeWebPLossless},
+	{"image/png", false, func(w io.Writer, img image.Image) error { return png.Encode(w, img) }},
+}
+
+// negotiateImageEncoder picks the first encoder the client accepts. Images
+// with transparency skip JPEG so the alpha channel survives: lossless WebP
+// where the client takes it, otherwise PNG. A media type with q=0 is
+// refused.
+func negotiateImageEncoder(accept string, opaque bool) int {
+	accepts := func(contentType string, explicit bool) bool {
+		if accept == "" {
+			return !explicit
+		}
+		for _, part := range strings.Split(accept, ",") {
+			params := strings.Split(part, ";")
+			mediaType := strings.TrimSpace(params[0])
+			if mediaType != contentType && (explicit || (mediaType != "image/*" && mediaType != "*/*")) {
+				continue
+			}
+			refused := false
+			for _, param := range params[1:] {
+				if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "q" {
+					q, err := strconv.ParseFloat(value, 64)
+					refused = err == nil && q == 0
+				}
+			}
+			if !refused {
+				return true
+			}
+		}
+		return false
+	}
+
+	fallback := 0
+	for i, encoder := range imageEncoders {
+		if !accepts(encoder.ContentType, encoder.Explicit) {
+			continue
+		}
+		if !opaque && encoder.ContentType == "image/jpeg" {
+			fallback = i
+			continue
+		}
+		return i
+	}
+	return fallback
+}
+
+// encodeWebPLossless writes img as a lossless WebP (VP8L). It uses the
+// subtract-green and select-predictor transforms, codes runs of repeated
+// pixels as backward references and has one set of Huffman codes for the
+// whole image: not libwebp's ratio, but alpha survives and flat areas cost
+// next to nothing.
+func encodeWebPLossless(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return fmt.Errorf("webp: cannot encode a %dx%d image", width, height)
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	// Pixels as ARGB with green subtracted from red and blue.
+	pixels := make([]uint32, width*height)
+	alphaUsed := false
+	for i := range pixels {
+		p := nrgba.Pix[i*4 : i*4+4]
+		pixels[i] = uint32(p[3])<<24 | uint32(p[0]-p[1])<<16 | uint32(p[1])<<8 | uint32(p[2]-p[1])
+		alphaUsed = alphaUsed || p[3] != 0xff
+	}
+	residuals := make([]uint32, len(pixels))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			var predicted uint32
+			switch {
+			case x == 0 && y == 0:
+				predicted = 0xff000000
+			case y == 0:
+				predicted = pixels[i-1]
+			case x == 0:
+				predicted = pixels[i-width]
+			default:
+				predicted = vp8lSelect(pixels[i-1], pixels[i-width], pixels[i-width-1])
+			}
+			residuals[i] = vp8lSubPixels(pixels[i], predicted)
+		}
+	}
+
+	bw := &vp8lBitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alphaUsed {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// Subtract green, then a predictor transform whose blocks all use
+	// Select (mode 11).
+	bw.write(1, 1)
+	bw.write(vp8lSubtractGreen, 2)
+	bw.write(1, 1)
+	bw.write(vp8lPredictor, 2)
+	const blockBits = 9
+	bw.write(blockBits-2, 3)
+	blocks := ((width + 1<<blockBits - 1) >> blockBits) * ((height + 1<<blockBits - 1) >> blockBits)
+	modes := make([]uint32, blocks)
+	for i := range modes {
+		modes[i] = 11 << 8
+	}
+	bw.write(0, 1)
+	bw.writeImage(modes, (width+1<<blockBits-1)>>blockBits)
+	bw.write(0, 1)
+
+	// The image itself: no color cache and no meta prefix codes.
+	bw.write(0, 1)
+	bw.write(0, 1)
+	bw.writeImage(residuals, width)
+
+	data := bw.bytes()
+	chunk := len(data) + len(data)&1
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(4+8+chunk))
+	out.WriteString("WEBPVP8L")
+	binary.Write(&out, binary.LittleEndian, uint32(len(data)))
+	out.Write(data)
+	if len(data)&1 == 1 {
+		out.WriteByte(0)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// VP8L transform types and alphabet sizes.
+const (
+	vp8lPredictor      = 0
+	vp8lSubtractGreen  = 2
+	vp8lLengthCodes    = 24
+	vp8lDistanceCodes  = 40
+	vp8lMaxLength      = 4096
+	vp8lMinLength      = 3
+	vp8lMaxDistance    = 1<<20 - 121
+	vp8lChainDepth     = 32
+	vp8lMaxCodeLength  = 15
+	vp8lMaxCodeLengthL = 7
+)
+
+// vp8lCodeLengthOrder is the order code length code lengths are written in.
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lSelect is predictor mode 11: whichever of the left and top pixels is
+// closer to their gradient estimate.
+func vp8lSelect(left, top, topLeft uint32) uint32 {
+	distLeft, distTop := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		l, t, tl := int(left>>shift&0xff), int(top>>shift&0xff), int(topLeft>>shift&0xff)
+		estimate := l + t - tl
+		distLeft += abs(estimate - l)
+		distTop += abs(estimate - t)
+	}
+	if distLeft < distTop {
+		return left
+	}
+	return top
+}
+
+// vp8lSubPixels subtracts b from a per channel, modulo 256.
+func vp8lSubPixels(a, b uint32) uint32 {
+	return ((a|0x00ff00ff)-(b&0xff00ff00))&0xff00ff00 | ((a|0xff00ff00)-(b&0x00ff00ff))&0x00ff00ff
+}
+
+// vp8lPrefix splits a backward reference length or distance into its
+// prefix symbol and extra bits.
+func vp8lPrefix(value int) (symbol int, extraBits uint, extra uint32) {
+	if value <= 4 {
+		return value - 1, 0, 0
+	}
+	value--
+	highest := bits.Len(uint(value)) - 1
+	second := value >> (highest - 1) & 1
+	extraBits = uint(highest - 1)
+	return 2*highest + second, extraBits, uint32(value) & (1<<extraBits - 1)
+}
+
+type vp8lBitWriter struct {
+	buf  []byte
+	acc  uint64
+	used uint
+}
+
+func (w *vp8lBitWriter) write(value uint32, n uint) {
+	w.acc |= uint64(value) << w.used
+	w.used += n
+	for w.used >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.used -= 8
+	}
+}
+
+func (w *vp8lBitWriter) bytes() []byte {
+	if w.used > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.used = 0, 0
+	}
+	return w.buf
+}
+
+// vp8lSymbol is one coded step of the image: a literal pixel, or a
+// backward reference copying length pixels from distance back.
+type vp8lSymbol struct {
+	pixel    uint32
+	length   int
+	distance int
+}
+
+// vp8lBackwardRefs finds repeats in pixels greedily, following a hash
+// chain of earlier positions with the same next two pixels.
+func vp8lBackwardRefs(pixels []uint32) []vp8lSymbol {
+	const hashBits = 16
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, len(pixels))
+	hash := func(i int) uint32 {
+		return (pixels[i]*0x1e35a7bd ^ pixels[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < len(pixels) {
+			h := hash(i)
+			chain[i], head[h] = head[h], int32(i)
+		}
+	}
+
+	symbols := []vp8lSymbol{}
+	for i := 0; i < len(pixels); {
+		best, bestDistance := 0, 0
+		if i+1 < len(pixels) {
+			limit := min(len(pixels)-i, vp8lMaxLength)
+			candidate := head[hash(i)]
+			for tries := 0; candidate >= 0 && tries < vp8lChainDepth && i-int(candidate) <= vp8lMaxDistance; tries++ {
+				start := int(candidate)
+				length := 0
+				for length < limit && pixels[start+length] == pixels[i+length] {
+					length++
+				}
+				if length > best {
+					best, bestDistance = length, i-start
+					if length == limit {
+						break
+					}
+				}
+				candidate = chain[start]
+			}
+		}
+		if best >= vp8lMinLength {
+			symbols = append(symbols, vp8lSymbol{length: best, distance: bestDistance})
+			for end := i + best; i < end; i++ {
+				insert(i)
+			}
+			continue
+		}
+		symbols = append(symbols, vp8lSymbol{pixel: pixels[i]})
+		insert(i)
+		i++
+	}
+	return symbols
+}
+
+// vp8lDistanceCode maps a distance in pixels to its distance code. The
+// pixel above and the one to the left have short codes of their own.
+func vp8lDistanceCode(distance, width int) int {
+	switch distance {
+	case width:
+		return 1
+	case 1:
+		return 2
+	}
+	return distance + 120
+}
+
+// writeImage writes the five prefix codes for pixels, width wide, and then
+// the pixels as literals and backward references.
+func (w *vp8lBitWriter) writeImage(pixels []uint32, width int) {
+	symbols := vp8lBackwardRefs(pixels)
+
+	green := make([]int, 256+vp8lLengthCodes)
+	red, blue, alpha := make([]int, 256), make([]int, 256), make([]int, 256)
+	distance := make([]int, vp8lDistanceCodes)
+	for _, s := range symbols {
+		if s.length > 0 {
+			lengthSymbol, _, _ := vp8lPrefix(s.length)
+			distanceSymbol, _, _ := vp8lPrefix(vp8lDistanceCode(s.distance, width))
+			green[256+lengthSymbol]++
+			distance[distanceSymbol]++
+			continue
+		}
+		green[s.pixel>>8&0xff]++
+		red[s.pixel>>16&0xff]++
+		blue[s.pixel&0xff]++
+		alpha[s.pixel>>24]++
+	}
+	codes := make([][]huffmanCode, 5)
+	for i, counts := range [][]int{green, red, blue, alpha, distance} {
+		codes[i] = w.writePrefixCode(counts)
+	}
+
+	for _, s := range symbols {
+		if s.length > 0 {
+			symbol, extraBits, extra := vp8lPrefix(s.length)
+			w.writeCode(codes[0][256+symbol])
+			w.write(extra, extraBits)
+			symbol, extraBits, extra = vp8lPrefix(vp8lDistanceCode(s.distance, width))
+			w.writeCode(codes[4][symbol])
+			w.write(extra, extraBits)
+			continue
+		}
+		w.writeCode(codes[0][s.pixel>>8&0xff])
+		w.writeCode(codes[1][s.pixel>>16&0xff])
+		w.writeCode(codes[2][s.pixel&0xff])
+		w.writeCode(codes[3][s.pixel>>24])
+	}
+}
+
+// huffmanCode is a symbol's code, bit-reversed for writing LSB first.
+type huffmanCode struct {
+	bits   uint32
+	length uint
+}
+
+func (w *vp8lBitWriter) writeCode(code huffmanCode) {
+	w.write(code.bits, code.length)
+}
+
+// writePrefixCode writes a prefix code for the symbol counts and returns
+// it. One or two small symbols use the simple form; a lone symbol then
+// takes no bits at all.
+func (w *vp8lBitWriter) writePrefixCode(counts []int) []huffmanCode {
+	used := []int{}
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+	lengths := make([]int, len(counts))
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		w.write(1, 1)
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+			lengths[used[0]], lengths[used[1]] = 1, 1
+		}
+		return canonicalHuffmanCodes(lengths)
+	}
+
+	lengths = huffmanLengths(counts, vp8lMaxCodeLength)
+	// Code lengths, with runs of zeros as codes 17 and 18.
+	type token struct {
+		symbol    int
+		extra     uint32
+		extraBits uint
+	}
+	tokens := []token{}
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			tokens = append(tokens, token{symbol: lengths[i]})
+			i++
+			continue
+		}
+		zeros := 0
+		for i+zeros < len(lengths) && lengths[i+zeros] == 0 {
+			zeros++
+		}
+		for zeros > 0 {
+			switch {
+			case zeros >= 11:
+				n := min(zeros, 138)
+				tokens = append(tokens, token{18, uint32(n - 11), 7})
+				zeros, i = zeros-n, i+n
+			case zeros >= 3:
+				n := min(zeros, 10)
+				tokens = append(tokens, token{17, uint32(n - 3), 3})
+				zeros, i = zeros-n, i+n
+			default:
+				tokens = append(tokens, token{symbol: 0})
+				zeros, i = zeros-1, i+1
+			}
+		}
+	}
+	lengthCounts := make([]int, 19)
+	for _, t := range tokens {
+		lengthCounts[t.symbol]++
+	}
+	lengthLengths := huffmanLengths(lengthCounts, vp8lMaxCodeLengthL)
+	lengthCodes := canonicalHuffmanCodes(lengthLengths)
+
+	w.write(0, 1)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && lengthLengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.write(uint32(n-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:n] {
+		w.write(uint32(lengthLengths[symbol]), 3)
+	}
+	w.write(0, 1)
+	for _, t := range tokens {
+		w.writeCode(lengthCodes[t.symbol])
+		w.write(t.extra, t.extraBits)
+	}
+	return canonicalHuffmanCodes(lengths)
+}
+
+// huffmanLengths builds code lengths of at most limit bits for counts.
+// At least two symbols get a code, so no code is zero bits long. Counts
+// are flattened until the tree fits the limit.
+func huffmanLengths(counts []int, limit int) []int {
+	weights := slices.Clone(counts)
+	used := 0
+	for _, n := range weights {
+		if n > 0 {
+			used++
+		}
+	}
+	for symbol := 0; used < 2; symbol++ {
+		if weights[symbol] == 0 {
+			weights[symbol] = 1
+			used++
+		}
+	}
+
+	for floor := 1; ; floor *= 2 {
+		type node struct{ weight, parent int }
+		nodes := []node{}
+		leaves := make([]int, len(weights))
+		open := []int{}
+		for symbol, n := range weights {
+			leaves[symbol] = -1
+			if n > 0 {
+				leaves[symbol] = len(nodes)
+				open = append(open, len(nodes))
+				nodes = append(nodes, node{max(n, floor), -1})
+			}
+		}
+		for len(open) > 1 {
+			slices.SortStableFunc(open, func(a, b int) int { return cmp.Compare(nodes[a].weight, nodes[b].weight) })
+			a, b := open[0], open[1]
+			nodes = append(nodes, node{nodes[a].weight + nodes[b].weight, -1})
+			nodes[a].parent, nodes[b].parent = len(nodes)-1, len(nodes)-1
+			open = append(open[2:], len(nodes)-1)
+		}
+		lengths := make([]int, len(weights))
+		fits := true
+		for symbol, leaf := range leaves {
+			for n := leaf; n >= 0 && nodes[n].parent >= 0; n = nodes[n].parent {
+				lengths[symbol]++
+			}
+			fits = fits && lengths[symbol] <= limit
+		}
+		if fits {
+			return lengths
+		}
+	}
+}
+
+// canonicalHuffmanCodes assigns canonical codes to code lengths, as
+// DEFLATE and VP8L do.
+func canonicalHuffmanCodes(lengths []int) []huffmanCode {
+	counts := make([]int, 16)
+	for _, length := range lengths {
+		counts[length]++
+	}
+	counts[0] = 0
+	next := make([]uint32, 16)
+	code := uint32(0)
+	for length := 1; length < 16; length++ {
+		code = (code + uint32(counts[length-1])) << 1
+		next[length] = code
+	}
+	codes := make([]huffmanCode, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		codes[symbol] = huffmanCode{uint32(bits.Reverse32(next[length]) >> (32 - length)), uint(length)}
+		next[length]++
+	}
+	return codes
+}
+
+// resizeImage scales src to the requested box. "contain" fits inside it,
+// "cover" fills it and crops the overflow from the centre, and "fill"
+// stretches to the exact size. A zero width or height follows the aspect
+// ratio.
+func resizeImage(src image.Image, width, height int, fit string) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if width == 0 {
+		width = int(math.Round(float64(srcW) * float64(height) / float64(srcH)))
+	}
+	if height == 0 {
+		height = int(math.Round(float64(srcH) * float64(width) / float64(srcW)))
+	}
+
+	crop := bounds
+	switch fit {
+	case "contain":
+		scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+		width = int(math.Max(1, math.Round(float64(srcW)*scale)))
+		height = int(math.Max(1, math.Round(float64(srcH)*scale)))
+	case "cover":
+		scale := math.Max(float64(width)/float64(srcW), float64(height)/float64(srcH))
+		cropW := int(math.Round(float64(width) / scale))
+		cropH := int(math.Round(float64(height) / scale))
+		x0 := bounds.Min.X + (srcW-cropW)/2
+		y0 := bounds.Min.Y + (srcH-cropH)/2
+		crop = image.Rect(x0, y0, x0+cropW, y0+cropH)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, crop.Min, draw.Src)
+
+	// Area-average each destination pixel over the source pixels it covers.
+	// This is exact for downscaling and degrades to nearest-neighbour when
+	// enlarging.
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	cw, ch := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	for y := 0; y < height; y++ {
+		sy0 := y * ch / height
+		sy1 := max((y+1)*ch/height, sy0+1)
+		for x := 0; x < width; x++ {
+			sx0 := x * cw / width
+			sx1 := max((x+1)*cw/width, sx0+1)
+			var r, g, b, a, n int
+			for sy := sy0; sy < sy1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := sx0; sx < sx1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			o := dst.PixOffset(x, y)
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(b / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// serveImage proxies a stored image, resizing it when w or h is given. Keys
+// are content-addressed, so responses are cached as immutable.
+func serveImage(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !imageKeyPattern.MatchString(key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image key"})
+		return
+	}
+	if cfg.Storage.Bucket == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image storage is not configured"})
+		return
+	}
+
+	var width, height int
+	for name, dim := range map[string]*int{"w": &width, "h": &height} {
+		if raw := c.Query(name); raw != "" {
+			val, err := strconv.Atoi(raw)
+			if err != nil || val < 1 || val > maxImageDimension {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be between 1 and %d", name, maxImageDimension)})
+				return
+			}
+			*dim = val
+		}
+	}
+	fit := c.DefaultQuery("fit", "cover")
+	if fit != "cover" && fit != "contain" && fit != "fill" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fit must be cover, contain or fill"})
+		return
+	}
+	if width == 0 || height == 0 {
+		// With one dimension every fit mode is the same aspect-preserving scale.
+		fit = "fill"
+	}
+	resize := width > 0 || height > 0
+
+	accept := c.GetHeader("Accept")
+	etag := `"` + hashToken(fmt.Sprintf("%s|%d|%d|%s|%s", key, width, height, fit, accept))[:32] + `"`
+	c.Header("Vary", "Accept")
+	// Only a served image is immutable; errors such as a storage outage
+	// must not be cached for a year.
+	cacheable := func() {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		c.Header("ETag", etag)
+	}
+	if c.GetHeader("If-None-Match") == etag {
+		cacheable()
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	resp, err := storageRequest(c.Request.Context(), http.MethodGet, key, nil, "")
+	if err != nil {
+		requestLogger(c).Error("image fetch failed", "key", key, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to fetch image"})
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Storage returned status %d", resp.StatusCode)})
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(cfg.Storage.MaxUploadBytes)+1))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read image"})
+		return
+	}
+	if !resize {
+		cacheable()
+		c.Data(http.StatusOK, http.DetectContentType(data), data)
+		return
+	}
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Image format cannot be resized"})
+		return
+	}
+	if imgConfig.Width*imgConfig.Height > maxSourcePixels {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Source image is too large to resize"})
+		return
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Image format cannot be resized"})
+		return
+	}
+
+	resized := resizeImage(src, width, height, fit)
+	opaque := true
+	if o, ok := src.(interface{ Opaque() bool }); ok {
+		opaque = o.Opaque()
+	}
+	encoder := imageEncoders[negotiateImageEncoder(accept, opaque)]
+
+	var out bytes.Buffer
+	if err := encoder.Encode(&out, resized); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cacheable()
+	c.Data(http.StatusOK, encoder.ContentType, out.Bytes())
+}
+
+// RecipeImage is a gallery image or a photo attached to one instruction
+// step. Step numbers are 1-based, matching how instructions are displayed.
+type RecipeImage struct {
+	ID       int     `json:"id"`
+	Kind     string  `json:"kind"`
+	Step     *int    `json:"step,omitempty"`
+	Position int     `json:"position"`
+	URL      string  `json:"url"`
+	Caption  *string `json:"caption"`
+}
+
+type UpdateRecipeImageRequest struct {
+	Caption  *string `json:"caption"`
+	Position *int    `json:"position"`
+	Step     *int    `json:"step"`
+}
+
+type ReorderRecipeImagesRequest struct {
+	ImageIDs []int `json:"image_ids" binding:"required"`
+}
+
+// loadRecipeImages fills the gallery and step photos of a recipe.
+func loadRecipeImages(recipe *Recipe) error {
+	rows, err := db.Query("SELECT id, kind, step, position, url, caption FROM recipe_images WHERE recipe_id = ? ORDER BY step, position, id", recipe.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var img RecipeImage
+		if err := rows.Scan(&img.ID, &img.Kind, &img.Step, &img.Position, &img.URL, &img.Caption); err != nil {
+			return err
+		}
+		if img.Kind == "step" {
+			recipe.StepPhotos = append(recipe.StepPhotos, img)
+		} else {
+			recipe.Gallery = append(recipe.Gallery, img)
+		}
+	}
+	return rows.Err()
+}
+
+// recipeStepCount returns how many instruction steps a recipe has, or
+// sql.ErrNoRows when it does not exist or was deleted.
+func recipeStepCount(id int) (int, error) {
+	var instructionsJSON string
+	if err := db.QueryRow("SELECT instructions FROM recipes WHERE id = ? AND deleted_at IS NULL", id).Scan(&instructionsJSON); err != nil {
+		return 0, err
+	}
+	var instructions []string
+	json.Unmarshal([]byte(instructionsJSON), &instructions)
+	return len(instructions), nil
+}
+
+// createRecipeImage uploads a gallery image, or a step photo when the form
+// has kind=step and a step number. New images go to the end of their list
+// unless a position is given.
+func createRecipeImage(c *gin.Context) {
+	if cfg.Storage.Bucket == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Image storage is not configured"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	steps, err := recipeStepCount(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	upload, ok := storeUploadedImage(c, id)
+	if !ok {
+		return
+	}
+
+	kind := c.DefaultPostForm("kind", "gallery")
+	var step *int
+	switch kind {
+	case "gallery":
+	case "step":
+		n, err := strconv.Atoi(c.PostForm("step"))
+		if err != nil || n < 1 || n > steps {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("step must be between 1 and %d", steps)})
+			return
+		}
+		step = &n
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be gallery or step"})
+		return
+	}
+
+	var caption *string
+	if text := strings.TrimSpace(c.PostForm("caption")); text != "" {
+		caption = &text
+	}
+
+	position := -1
+	if raw := c.PostForm("position"); raw != "" {
+		if position, err = strconv.Atoi(raw); err != nil || position < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "position must be a non-negative integer"})
+			return
+		}
+	}
+	if position < 0 {
+		err := db.QueryRow("SELECT COALESCE(MAX(position) + 1, 0) FROM recipe_images WHERE recipe_id = ? AND kind = ? AND step <=> ?", id, kind, step).Scan(&position)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	res, err := db.Exec("INSERT INTO recipe_images (recipe_id, kind, step, position, storage_key, url, caption) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, kind, step, position, upload.Key, upload.URL, caption)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	imageID, _ := res.LastInsertId()
+
+	c.JSON(http.StatusCreated, RecipeImage{
+		ID:       int(imageID),
+		Kind:     kind,
+		Step:     step,
+		Position: position,
+		URL:      upload.URL,
+		Caption:  caption,
+	})
+}
+
+func updateRecipeImage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	imageID, err := strconv.Atoi(c.Param("imageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var req UpdateRecipeImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	var img RecipeImage
+	err = db.QueryRow("SELECT id, kind, step, position, url, caption FROM recipe_images WHERE id = ? AND recipe_id = ?", imageID, id).
+		Scan(&img.ID, &img.Kind, &img.Step, &img.Position, &img.URL, &img.Caption)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Caption != nil {
+		if text := strings.TrimSpace(*req.Caption); text != "" {
+			img.Caption = &text
+		} else {
+			img.Caption = nil
+		}
+	}
+	if req.Position != nil {
+		if *req.Position < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "position must be a non-negative integer"})
+			return
+		}
+		img.Position = *req.Position
+	}
+	if req.Step != nil {
+		if img.Kind != "step" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only step photos have a step"})
+			return
+		}
+		steps, err := recipeStepCount(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if *req.Step < 1 || *req.Step > steps {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("step must be between 1 and %d", steps)})
+			return
+		}
+		img.Step = req.Step
+	}
+
+	if _, err := db.Exec("UPDATE recipe_images SET caption = ?, position = ?, step = ? WHERE id = ?", img.Caption, img.Position, img.Step, img.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, img)
+}
+
+// deleteRecipeImage removes the image from the recipe. The stored object is
+// left in place because content-addressed keys may be shared.
+func deleteRecipeImage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	imageID, err := strconv.Atoi(c.Param("imageId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM recipe_images WHERE id = ? AND recipe_id = ?", imageID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": imageID, "deleted": true})
+}
+
+// reorderRecipeImages sets gallery positions to the order of image_ids,
+// which must list every gallery image of the recipe exactly once.
+func reorderRecipeImages(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	var req ReorderRecipeImagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	rows, err := db.Query("SELECT id FROM recipe_images WHERE recipe_id = ? AND kind = 'gallery'", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	existing := map[int]bool{}
+	for rows.Next() {
+		var imageID int
+		if err := rows.Scan(&imageID); err == nil {
+			existing[imageID] = true
+		}
+	}
+	rows.Close()
+
+	seen := map[int]bool{}
+	for _, imageID := range req.ImageIDs {
+		if !existing[imageID] || seen[imageID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "image_ids must list each gallery image exactly once"})
+			return
+		}
+		seen[imageID] = true
+	}
+	if len(seen) != len(existing) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image_ids must list each gallery image exactly once"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	for position, imageID := range req.ImageIDs {
+		if _, err := tx.Exec("UPDATE recipe_images SET position = ? WHERE id = ?", position, imageID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "image_ids": req.ImageIDs})
+}
+
+// CookingStep is one instruction with the timers and oven temperature found
+// in its text, for guided-cooking and voice UIs.
+type CookingStep struct {
+	Number      int              `json:"number"`
+	Text        string           `json:"text"`
+	Timers      []StepTimer      `json:"timers"`
+	Temperature *StepTemperature `json:"temperature,omitempty"`
+	Photos      []RecipeImage    `json:"photos,omitempty"`
+}
+
+// StepTimer is a duration mentioned in a step. Ranges like "5-7 minutes"
+// report both ends; Seconds is the upper bound so a timer never ends early.
+type StepTimer struct {
+	Text       string `json:"text"`
+	Seconds    int    `json:"seconds"`
+	MinSeconds int    `json:"min_seconds"`
+}
+
+// StepTemperature is an oven or frying temperature mentioned in a step, as
+// written and converted to both scales. Converted values are rounded to the
+// nearest 5 degrees, as oven dials are marked; Unit is C, F or gas.
+type StepTemperature struct {
+	Text       string  `json:"text"`
+	Value      float64 `json:"value"`
+	Unit       string  `json:"unit"`
+	Celsius    float64 `json:"celsius"`
+	Fahrenheit float64 `json:"fahrenheit"`
+}
+
+// StepMetadata is what parseCookingStep finds in one instruction. It is
+// extracted at ingest and stored in recipe_steps.
+type StepMetadata struct {
+	Step        int              `json:"step"`
+	Timers      []StepTimer      `json:"timers"`
+	Temperature *StepTemperature `json:"temperature,omitempty"`
+}
+
+var (
+	stepDurationPattern    = regexp.MustCompile(`(?i)\b(\d+(?:\.\d+)?|an?|one|two|three|four|five|ten|fifteen|twenty|thirty)(?:\s*(?:-|–|to)\s*(\d+(?:\.\d+)?))?\s*(hours?|hrs?|minutes?|mins?|seconds?|secs?)\b`)
+	stepTemperaturePattern = regexp.MustCompile(`(?i)(\d{2,3})\s*(?:°|º|degrees?|deg\.?)\s*(C|F|Celsius|Fahrenheit|centigrade)\b`)
+	stepGasMarkPattern     = regexp.MustCompile(`(?i)\bgas(?:\s+mark)?\s+(\d)\b`)
+)
+
+// gasMarkCelsius is the oven temperature of each gas mark.
+var gasMarkCelsius = map[int]float64{1: 140, 2: 150, 3: 170, 4: 180, 5: 190, 6: 200, 7: 220, 8: 230, 9: 240}
+
+// roundToFive rounds a converted temperature to an oven dial setting.
+func roundToFive(degrees float64) float64 {
+	return math.Round(degrees/5) * 5
+}
+
+var stepNumberWords = map[string]float64{
+	"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5,
+	"ten": 10, "fifteen": 15, "twenty": 20, "thirty": 30,
+}
+
+// parseCookingStep extracts timers and the first temperature from a step.
+func parseCookingStep(number int, text string) CookingStep {
+	step := CookingStep{Number: number, Text: strings.TrimSpace(text), Timers: []StepTimer{}}
+
+	for _, m := range stepDurationPattern.FindAllStringSubmatch(step.Text, -1) {
+		low, ok := stepNumberWords[strings.ToLower(m[1])]
+		if !ok {
+			low, _ = strconv.ParseFloat(m[1], 64)
+		}
+		high := low
+		if m[2] != "" {
+			high, _ = strconv.ParseFloat(m[2], 64)
+		}
+
+		unit := 1.0
+		switch strings.ToLower(m[3])[0] {
+		case 'h':
+			unit = 3600
+		case 'm':
+			unit = 60
+		}
+		if high <= 0 {
+			continue
+		}
+		step.Timers = append(step.Timers, StepTimer{
+			Text:       m[0],
+			Seconds:    int(high * unit),
+			MinSeconds: int(low * unit),
+		})
+	}
+
+	if m := stepTemperaturePattern.FindStringSubmatch(step.Text); m != nil {
+		value, _ := strconv.ParseFloat(m[1], 64)
+		temperature := StepTemperature{Text: m[0], Value: value, Unit: strings.ToUpper(m[2][:1])}
+		if temperature.Unit == "F" {
+			temperature.Celsius, temperature.Fahrenheit = roundToFive((value-32)*5/9), value
+		} else {
+			temperature.Unit = "C"
+			temperature.Celsius, temperature.Fahrenheit = value, roundToFive(value*9/5+32)
+		}
+		step.Temperature = &temperature
+	} else if m := stepGasMarkPattern.FindStringSubmatch(step.Text); m != nil {
+		mark, _ := strconv.Atoi(m[1])
+		if celsius, ok := gasMarkCelsius[mark]; ok {
+			step.Temperature = &StepTemperature{Text: m[0], Value: float64(mark), Unit: "gas", Celsius: celsius, Fahrenheit: roundToFive(celsius*9/5 + 32)}
+		}
+	}
+
+	return step
+}
+
+// recipeStepMetadata parses the timers and temperatures of each non-empty
+// instruction, numbered as cookingSteps numbers them.
+func recipeStepMetadata(recipe Recipe) []StepMetadata {
+	steps := []StepMetadata{}
+	for _, text := range recipe.Instructions {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		step := parseCookingStep(len(steps)+1, text)
+		steps = append(steps, StepMetadata{Step: step.Number, Timers: step.Timers, Temperature: step.Temperature})
+	}
+	return steps
+}
+
+// storeRecipeSteps replaces the stored step metadata of a recipe.
+func storeRecipeSteps(recipe Recipe) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := writeRecipeSteps(tx, recipe); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeRecipeSteps(tx sqlExecutor, recipe Recipe) error {
+	if _, err := tx.Exec("DELETE FROM recipe_steps WHERE recipe_id = ?", recipe.ID); err != nil {
+		return err
+	}
+	for _, step := range recipeStepMetadata(recipe) {
+		timers, _ := json.Marshal(step.Timers)
+		var temperature *string
+		if step.Temperature != nil {
+			encoded, _ := json.Marshal(step.Temperature)
+			temperature = new(string)
+			*temperature = string(encoded)
+		}
+		if _, err := tx.Exec("INSERT INTO recipe_steps (recipe_id, step, timers, temperature) VALUES (?, ?, ?, ?)", recipe.ID, step.Step, string(timers), temperature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractRecipeSteps stores step metadata for recipes that have none yet,
+// or with overwrite re-extracts it for every recipe. It returns how many
+// recipes it processed.
+func extractRecipeSteps(overwrite bool) (int, error) {
+	const batchSize = 500
+	processed := 0
+	lastID := 0
+	for {
+		query := selectRecipes().Where("id > ?", lastID)
+		if !overwrite {
+			query.Where("id NOT IN (SELECT recipe_id FROM recipe_steps)")
+		}
+		recipes, err := query.OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return processed, err
+		}
+		for _, recipe := range recipes {
+			if err := storeRecipeSteps(recipe); err != nil {
+				return processed, err
+			}
+			processed++
+			lastID = recipe.ID
+		}
+		if len(recipes) < batchSize {
+			return processed, nil
+		}
+	}
+}
+
+// loadRecipeSteps fills the step metadata of a recipe. Recipes stored
+// before extraction, or whose stored steps no longer match the
+// instructions, are parsed on the fly.
+func loadRecipeSteps(recipe *Recipe) error {
+	rows, err := db.Query("SELECT step, timers, temperature FROM recipe_steps WHERE recipe_id = ? ORDER BY step", recipe.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	steps := []StepMetadata{}
+	for rows.Next() {
+		var step StepMetadata
+		var timers string
+		var temperature sql.NullString
+		if err := rows.Scan(&step.Step, &timers, &temperature); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(timers), &step.Timers); err != nil {
+			return err
+		}
+		if temperature.Valid {
+			step.Temperature = &StepTemperature{}
+			if err := json.Unmarshal([]byte(temperature.String), step.Temperature); err != nil {
+				return err
+			}
+		}
+		steps = append(steps, step)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	parsed := recipeStepMetadata(*recipe)
+	if len(steps) != len(parsed) {
+		steps = parsed
+	}
+	recipe.Steps = steps
+	return nil
+}
+
+func getRecipeSteps(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	recipes, err := selectRecipes().Where("id = ?", id).Visible(tenantFromContext(c)).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	recipe := recipes[0]
+	if err := loadRecipeImages(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := loadRecipeSteps(&recipe); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	steps, timedSeconds := cookingSteps(recipe)
+	c.JSON(http.StatusOK, gin.H{
+		"id":                  recipe.ID,
+		"name":                recipe.Name,
+		"steps":               steps,
+		"count":               len(steps),
+		"timed_seconds_total": timedSeconds,
+	})
+}
+
+// Cook sessions track a caller's progress through a recipe in cooking mode:
+// completed steps and running timers, stored server-side so any of the
+// caller's devices can pick the session up. Timer end times are computed
+// here, so devices agree on them whatever their clocks say.
+const (
+	// cookSessionTTL is how long an untouched session stays resumable.
+	cookSessionTTL     = 48 * time.Hour
+	maxCookSessions    = 20
+	maxCookTimers      = 10
+	maxCookTimerLength = 24 * time.Hour
+)
+
+type CookSession struct {
+	ID             string        `json:"id"`
+	RecipeID       int           `json:"recipe_id"`
+	RecipeName     string        `json:"recipe_name"`
+	Steps          []CookingStep `json:"steps"`
+	CompletedSteps []int         `json:"completed_steps"`
+	// CurrentStep is the first step not completed, or 0 once all are.
+	CurrentStep int            `json:"current_step"`
+	Timers      []SessionTimer `json:"timers"`
+	StartedAt   time.Time      `json:"started_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	FinishedAt  *time.Time     `json:"finished_at"`
+	// ServerTime lets clients correct their countdowns for clock skew.
+	ServerTime time.Time `json:"server_time"`
+}
+
+type SessionTimer struct {
+	ID               string    `json:"id"`
+	Step             int       `json:"step"`
+	Label            string    `json:"label"`
+	Seconds          int       `json:"seconds"`
+	StartedAt        time.Time `json:"started_at"`
+	EndsAt           time.Time `json:"ends_at"`
+	RemainingSeconds int       `json:"remaining_seconds"`
+}
+
+type StartCookSessionRequest struct {
+	RecipeID int `json:"recipe_id" binding:"required"`
+}
+
+type CookStepRequest struct {
+	Done bool `json:"done"`
+}
+
+// CookTimerRequest starts a timer for a step. Without Seconds the step's
+// first timer is used.
+type CookTimerRequest struct {
+	Step    int    `json:"step" binding:"required"`
+	Seconds int    `json:"seconds"`
+	Label   string `json:"label"`
+}
+
+// cookingSteps splits a recipe's instructions into numbered steps with
+// their step photos, and sums the time their timers call for. Step
+// metadata loaded by loadRecipeSteps is used when present.
+func cookingSteps(recipe Recipe) ([]CookingStep, int) {
+	steps := []CookingStep{}
+	timedSeconds := 0
+	for _, text := range recipe.Instructions {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		step := parseCookingStep(len(steps)+1, text)
+		if i := step.Number - 1; i < len(recipe.Steps) {
+			step.Timers, step.Temperature = recipe.Steps[i].Timers, recipe.Steps[i].Temperature
+		}
+		for _, photo := range recipe.StepPhotos {
+			if photo.Step != nil && *photo.Step == step.Number {
+				step.Photos = append(step.Photos, photo)
+			}
+		}
+		for _, timer := range step.Timers {
+			timedSeconds += timer.Seconds
+		}
+		steps = append(steps, step)
+	}
+	return steps, timedSeconds
+}
+
+const cookSessionColumns = "id, recipe_id, completed_steps, timers, created_at, updated_at, finished_at"
+
+func scanCookSession(row interface{ Scan(...interface{}) error }) (CookSession, error) {
+	var session CookSession
+	var completed, timers string
+	if err := row.Scan(&session.ID, &session.RecipeID, &completed, &timers, &session.StartedAt, &session.UpdatedAt, &session.FinishedAt); err != nil {
+		return session, err
+	}
+	if err := json.Unmarshal([]byte(completed), &session.CompletedSteps); err != nil {
+		return session, err
+	}
+	return session, json.Unmarshal([]byte(timers), &session.Timers)
+}
+
+// fillCookSession adds the recipe's steps and the derived fields.
+func fillCookSession(session *CookSession) error {
+	recipe, err := selectRecipes().Where("id = ?", session.RecipeID).One()
+	if err != nil {
+		return err
+	}
+	if err := loadRecipeImages(&recipe); err != nil {
+		return err
+	}
+	if err := loadRecipeSteps(&recipe); err != nil {
+		return err
+	}
+	session.RecipeName = recipe.Name
+	session.Steps, _ = cookingSteps(recipe)
+
+	session.CurrentStep = 0
+	for _, step := range session.Steps {
+		if !slices.Contains(session.CompletedSteps, step.Number) {
+			session.CurrentStep = step.Number
+			break
+		}
+	}
+	session.ServerTime = time.Now()
+	for i := range session.Timers {
+		session.Timers[i].RemainingSeconds = max(0, int(math.Ceil(session.Timers[i].EndsAt.Sub(session.ServerTime).Seconds())))
+	}
+	return nil
+}
+
+// startCookSession opens a session for a recipe, or resumes the caller's
+// unfinished one for it.
+func startCookSession(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	var req StartCookSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	visible, err := recipeVisible(tenantFromContext(c), req.RecipeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !visible {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	status := http.StatusOK
+	session, err := scanCookSession(db.QueryRow("SELECT "+cookSessionColumns+` FROM cook_sessions
+		WHERE owner = ? AND recipe_id = ? AND finished_at IS NULL AND updated_at >= ?
+		ORDER BY updated_at DESC LIMIT 1`, owner, req.RecipeID, time.Now().Add(-cookSessionTTL).UTC()))
+	if err == sql.ErrNoRows {
+		id := newRequestID()
+		if _, err := db.Exec("INSERT INTO cook_sessions (id, owner, recipe_id, completed_steps, timers) VALUES (?, ?, ?, '[]', '[]')", id, owner, req.RecipeID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		now := time.Now()
+		session = CookSession{ID: id, RecipeID: req.RecipeID, CompletedSteps: []int{}, Timers: []SessionTimer{}, StartedAt: now, UpdatedAt: now}
+		status = http.StatusCreated
+		c.Header("Location", "/api/users/me/cook-sessions/"+id)
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := fillCookSession(&session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, session)
+}
+
+// listCookSessions lists the caller's resumable sessions, most recently
+// used first; ?all=true includes finished and abandoned ones.
+func listCookSessions(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	query := "SELECT " + cookSessionColumns + " FROM cook_sessions WHERE owner = ?"
+	args := []interface{}{owner}
+	if c.Query("all") != "true" {
+		query += " AND finished_at IS NULL AND updated_at >= ?"
+		args = append(args, time.Now().Add(-cookSessionTTL).UTC())
+	}
+	query += " ORDER BY updated_at DESC LIMIT ?"
+	args = append(args, maxCookSessions)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	sessions := []CookSession{}
+	for rows.Next() {
+		session, err := scanCookSession(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range sessions {
+		if err := fillCookSession(&sessions[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "count": len(sessions)})
+}
+
+func getCookSession(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	session, err := scanCookSession(db.QueryRow("SELECT "+cookSessionColumns+" FROM cook_sessions WHERE id = ? AND owner = ?", c.Param("id"), owner))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cook session not found"})
+		return
+	}
+	if err == nil {
+		err = fillCookSession(&session)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// changeCookSession applies change to an unfinished session under a row
+// lock, so devices updating the same session at once don't undo each
+// other, and answers with the result. change sees the session filled in.
+func changeCookSession(c *gin.Context, change func(session *CookSession) (int, error)) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	session, err := scanCookSession(tx.QueryRow("SELECT "+cookSessionColumns+" FROM cook_sessions WHERE id = ? AND owner = ? FOR UPDATE", c.Param("id"), owner))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cook session not found"})
+		return
+	}
+	if err == nil {
+		err = fillCookSession(&session)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if session.FinishedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cook session is finished"})
+		return
+	}
+	if status, err := change(&session); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	completed, _ := json.Marshal(session.CompletedSteps)
+	timers, _ := json.Marshal(session.Timers)
+	if _, err := tx.Exec("UPDATE cook_sessions SET completed_steps = ?, timers = ?, finished_at = ? WHERE id = ?",
+		string(completed), string(timers), session.FinishedAt, session.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if session.FinishedAt != nil {
+		if _, err := tx.Exec("INSERT INTO recipe_history (owner, recipe_id, event, created_at) VALUES (?, ?, ?, ?)",
+			owner, session.RecipeID, historyCooked, session.FinishedAt.UTC()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	session.UpdatedAt = time.Now()
+	if err := fillCookSession(&session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// checkStep reports a step number the session's recipe doesn't have.
+func (session *CookSession) checkStep(number int) (int, error) {
+	if number < 1 || number > len(session.Steps) {
+		return http.StatusBadRequest, fmt.Errorf("step must be between 1 and %d", len(session.Steps))
+	}
+	return 0, nil
+}
+
+// updateCookStep marks a step done or not done.
+func updateCookStep(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("step"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid step"})
+		return
+	}
+	var req CookStepRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	changeCookSession(c, func(session *CookSession) (int, error) {
+		if status, err := session.checkStep(number); err != nil {
+			return status, err
+		}
+		done := slices.Contains(session.CompletedSteps, number)
+		switch {
+		case req.Done && !done:
+			session.CompletedSteps = append(session.CompletedSteps, number)
+			slices.Sort(session.CompletedSteps)
+		case !req.Done && done:
+			session.CompletedSteps = slices.DeleteFunc(session.CompletedSteps, func(n int) bool { return n == number })
+		}
+		return 0, nil
+	})
+}
+
+// startCookTimer starts a timer for a step; its end time is fixed now.
+func startCookTimer(c *gin.Context) {
+	var req CookTimerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	changeCookSession(c, func(session *CookSession) (int, error) {
+		if status, err := session.checkStep(req.Step); err != nil {
+			return status, err
+		}
+		now := time.Now()
+		session.Timers = slices.DeleteFunc(session.Timers, func(timer SessionTimer) bool { return timer.EndsAt.Before(now) })
+		if len(session.Timers) >= maxCookTimers {
+			return http.StatusConflict, fmt.Errorf("at most %d timers may run at once", maxCookTimers)
+		}
+		step := session.Steps[req.Step-1]
+		label := strings.TrimSpace(req.Label)
+		seconds := req.Seconds
+		if seconds == 0 && len(step.Timers) > 0 {
+			seconds = step.Timers[0].Seconds
+			label = cmp.Or(label, step.Timers[0].Text)
+		}
+		if seconds <= 0 || time.Duration(seconds)*time.Second > maxCookTimerLength {
+			return http.StatusBadRequest, fmt.Errorf("seconds must be between 1 and %d", int(maxCookTimerLength.Seconds()))
+		}
+		if len(label) > 100 {
+			return http.StatusBadRequest, errors.New("label must be at most 100 bytes")
+		}
+		session.Timers = append(session.Timers, SessionTimer{
+			ID:        newRequestID(),
+			Step:      req.Step,
+			Label:     cmp.Or(label, fmt.Sprintf("Step %d", req.Step)),
+			Seconds:   seconds,
+			StartedAt: now,
+			EndsAt:    now.Add(time.Duration(seconds) * time.Second),
+		})
+		return 0, nil
+	})
+}
+
+func cancelCookTimer(c *gin.Context) {
+	changeCookSession(c, func(session *CookSession) (int, error) {
+		n := len(session.Timers)
+		session.Timers = slices.DeleteFunc(session.Timers, func(timer SessionTimer) bool { return timer.ID == c.Param("timerId") })
+		if len(session.Timers) == n {
+			return http.StatusNotFound, errors.New("Timer not found")
+		}
+		return 0, nil
+	})
+}
+
+// finishCookSession closes a session, clearing its timers, and records the
+// recipe as cooked in the caller's history.
+func finishCookSession(c *gin.Context) {
+	changeCookSession(c, func(session *CookSession) (int, error) {
+		now := time.Now()
+		session.FinishedAt = &now
+		session.Timers = []SessionTimer{}
+		return 0, nil
+	})
+}
+
+// AssistantRecipe is a recipe shaped for voice assistants: SSML to speak,
+// plain text for the companion screen, and steps that can be read one at a
+// time.
+type AssistantRecipe struct {
+	ID          int             `json:"id"`
+	Title       string          `json:"title"`
+	Speech      string          `json:"speech"`
+	DisplayText string          `json:"display_text"`
+	Ingredients string          `json:"ingredients_readout"`
+	Steps       []AssistantStep `json:"steps"`
+	Image       string          `json:"image,omitempty"`
+}
+
+type AssistantStep struct {
+	Number int    `json:"number"`
+	Speech string `json:"speech"`
+	Text   string `json:"text"`
+}
+
+type AssistantSearchItem struct {
+	ID      int    `json:"id"`
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// assistantSpoken expands abbreviations a speech engine would read letter
+// by letter. Units that are also words or word fragments ("min", "oz")
+// only count after a number.
+var assistantSpoken = []struct {
+	pattern *regexp.Regexp
+	spoken  string
+}{
+	{regexp.MustCompile(`\s*°\s*F\b`), " degrees Fahrenheit"},
+	{regexp.MustCompile(`\s*°\s*C\b`), " degrees Celsius"},
+	{regexp.MustCompile(`(?i)\btbsps?\b`), "tablespoons"},
+	{regexp.MustCompile(`(?i)\btsps?\b`), "teaspoons"},
+	{regexp.MustCompile(`([\d½¼¾⅓⅔⅛])\s*oz\b`), "$1 ounces"},
+	{regexp.MustCompile(`([\d½¼¾⅓⅔⅛])\s*lbs?\b`), "$1 pounds"},
+	{regexp.MustCompile(`(\d)\s*mins?\b`), "$1 minutes"},
+	{regexp.MustCompile(`(\d)\s*hrs?\b`), "$1 hours"},
+}
+
+// spokenUnits applies assistantSpoken to text.
+func spokenUnits(text string) string {
+	for _, rule := range assistantSpoken {
+		text = rule.pattern.ReplaceAllString(text, rule.spoken)
+	}
+	return text
+}
+
+var ssmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
+// ssmlText prepares free text for an SSML body.
+func ssmlText(text string) string {
+	return ssmlEscaper.Replace(spokenUnits(strings.TrimSpace(text)))
+}
+
+// spokenList joins items as "a, b, and c".
+func spokenList(items []string) string {
+	switch len(items) {
+	case 0:
+		return ""
+	case 1:
+		return items[0]
+	case 2:
+		return items[0] + " and " + items[1]
+	}
+	return strings.Join(items[:len(items)-1], ", ") + ", and " + items[len(items)-1]
+}
+
+// ingredientReadout names the first few ingredients without quantities so
+// the list stays short enough to listen to.
+func ingredientReadout(ingredients []string) string {
+	const spoken = 5
+
+	names := []string{}
+	for _, line := range ingredients {
+		if len(names) == spoken {
+			break
+		}
+		parsed := parseIngredientLine(line)
+		if name := strings.TrimSpace(parsed.Name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	readout := "You'll need " + spokenList(names)
+	if extra := len(ingredients) - len(names); extra > 0 {
+		readout += fmt.Sprintf(", plus %d more", extra)
+	}
+	return readout + "."
+}
+
+func assistantRecipe(recipe Recipe) AssistantRecipe {
+	out := AssistantRecipe{
+		ID:          recipe.ID,
+		Title:       recipe.Name,
+		Ingredients: ingredientReadout(recipe.Ingredients),
+		Steps:       []AssistantStep{},
+		Image:       recipe.Image,
+	}
+
+	intro := recipe.Name + "."
+	if recipe.TotalTimeMinutes != nil && *recipe.TotalTimeMinutes > 0 {
+		intro += fmt.Sprintf(" It takes about %d minutes", *recipe.TotalTimeMinutes)
+		if recipe.Servings != nil && *recipe.Servings > 0 {
+			intro += fmt.Sprintf(" and serves %d", *recipe.Servings)
+		}
+		intro += "."
+	}
+	out.DisplayText = strings.TrimSpace(intro + " " + out.Ingredients)
+
+	for _, text := range recipe.Instructions {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		number := len(out.Steps) + 1
+		out.Steps = append(out.Steps, AssistantStep{
+			Number: number,
+			Speech: fmt.Sprintf(`<speak>Step %d. <break time="300ms"/>%s</speak>`, number, ssmlText(text)),
+			Text:   strings.TrimSpace(text),
+		})
+	}
+
+	speech := ssmlText(intro)
+	if out.Ingredients != "" {
+		speech += ` <break time="500ms"/>` + ssmlText(out.Ingredients)
+	}
+	if len(out.Steps) > 0 {
+		speech += fmt.Sprintf(` <break time="500ms"/>There are %d steps. Say next to hear the first one.`, len(out.Steps))
+	}
+	out.Speech = "<speak>" + speech + "</speak>"
+
+	return out
+}
+
+// assistantSearchResults summarises search results in one utterance and
+// lists them for follow-up selection.
+func assistantSearchResults(recipes []Recipe) gin.H {
+	const spoken = 3
+
+	items := []AssistantSearchItem{}
+	names := []string{}
+	for _, recipe := range recipes {
+		summary := recipe.Name
+		if recipe.TotalTimeMinutes != nil && *recipe.TotalTimeMinutes > 0 {
+			summary += fmt.Sprintf(", %d minutes", *recipe.TotalTimeMinutes)
+		}
+		if recipe.Calories != nil {
+			summary += fmt.Sprintf(", %d calories", *recipe.Calories)
+		}
+		items = append(items, AssistantSearchItem{ID: recipe.ID, Title: recipe.Name, Summary: summary})
+		if len(names) < spoken {
+			names = append(names, ssmlText(recipe.Name))
+		}
+	}
+
+	var speech string
+	switch len(items) {
+	case 0:
+		speech = "I couldn't find any recipes for that."
+	case 1:
+		speech = "I found one recipe: " + names[0] + "."
+	default:
+		speech = fmt.Sprintf("I found %d recipes. The top ones are %s.", len(items), spokenList(names))
+	}
+
+	return gin.H{
+		"speech": "<speak>" + speech + "</speak>",
+		"items":  items,
+		"count":  len(items),
+	}
+}
+
+const shareTokenAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newShareToken returns a short random token without look-alike characters.
+func newShareToken() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	token := make([]byte, len(raw))
+	for i, b := range raw {
+		token[i] = shareTokenAlphabet[int(b)%len(shareTokenAlphabet)]
+	}
+	return string(token)
+}
+
+func shareURL(token string) string {
+	return strings.TrimSuffix(cfg.PublicBaseURL, "/") + "/r/" + token
+}
+
+// createShareLink returns the share link for a published recipe, reusing
+// the existing token so a recipe has one stable URL.
+func createShareLink(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	exists, err := recipeVisible(tenantFromContext(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	token, err := shareTokenFor(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "token": token, "url": shareURL(token)})
+}
+
+// shareTokenFor returns the recipe's share token, creating one on first use.
+// INSERT IGNORE covers both a concurrent share of the same recipe and a
+// token collision; re-reading tells them apart.
+func shareTokenFor(id int) (string, error) {
+	var token string
+	err := db.QueryRow("SELECT token FROM share_links WHERE recipe_id = ?", id).Scan(&token)
+	for attempt := 0; attempt < 3 && err == sql.ErrNoRows; attempt++ {
+		if _, err = db.Exec("INSERT IGNORE INTO share_links (token, recipe_id) VALUES (?, ?)", newShareToken(), id); err != nil {
+			break
+		}
+		err = db.QueryRow("SELECT token FROM share_links WHERE recipe_id = ?", id).Scan(&token)
+	}
+	return token, err
+}
+
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<meta name="description" content="{{.Summary}}">
+<meta property="og:type" content="article">
+<meta property="og:title" content="{{.Name}}">
+<meta property="og:description" content="{{.Summary}}">
+<meta property="og:url" content="{{.URL}}">
+{{if .Image}}<meta property="og:image" content="{{.Image}}">
+{{end}}<meta name="twitter:card" content="{{if .Image}}summary_large_image{{else}}summary{{end}}">
+<meta name="twitter:title" content="{{.Name}}">
+<meta name="twitter:description" content="{{.Summary}}">
+{{if .Image}}<meta name="twitter:image" content="{{.Image}}">
+{{end}}<link rel="alternate" type="application/json" href="{{.APIURL}}">
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{if .Image}}<img src="{{.Image}}" alt="{{.Name}}" width="600">
+{{end}}<p>{{.Summary}}</p>
+<p><a href="{{.APIURL}}">View recipe data</a></p>
+</body>
+</html>
+`))
+
+// getShareLink resolves a share token. Browsers and link unfurlers get an
+// HTML page with Open Graph and Twitter card tags; API clients asking for
+// JSON get the recipe's API location.
+func getShareLink(c *gin.Context) {
+	recipes, err := queryRecipes(`SELECT r.id, r.name, r.description, r.image, r.prep_time_minutes, r.cook_time_minutes, r.total_time_minutes, r.servings, r.rating, r.ingredients, r.instructions, r.calories, r.protein, r.fat, r.carbs, r.fiber, r.sodium, r.difficulty, r.cost_per_serving, r.spice_level, r.kid_friendly, r.co2e_per_serving, r.glycemic_index, r.glycemic_load, r.times_made, r.views, r.tenant_id
+		FROM share_links s JOIN recipes shared ON shared.id = s.recipe_id JOIN recipes r ON r.id = COALESCE(shared.merged_into, shared.id)
+		WHERE s.token = ? AND r.status = 'published' AND r.deleted_at IS NULL`, c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 || !tenantFromContext(c).canSee(recipes[0]) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	recipe := recipes[0]
+	apiURL := fmt.Sprintf("%s/api/recipe/%d", strings.TrimSuffix(cfg.PublicBaseURL, "/"), recipe.ID)
+
+	if c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(http.StatusOK, gin.H{
+			"id":       recipe.ID,
+			"name":     recipe.Name,
+			"redirect": apiURL,
+		})
+		return
+	}
+
+	summary := recipe.Description
+	if len(summary) > 200 {
+		summary = strings.TrimSpace(summary[:strings.LastIndex(summary[:200], " ")+1]) + "…"
+	}
+	if recipe.Calories != nil {
+		summary = strings.TrimSpace(fmt.Sprintf("%d calories. %s", *recipe.Calories, summary))
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	sharePageTemplate.Execute(c.Writer, gin.H{
+		"Name":    recipe.Name,
+		"Summary": summary,
+		"Image":   recipe.Image,
+		"URL":     shareURL(c.Param("token")),
+		"APIURL":  apiURL,
+	})
+}
+
+// qrBlocks describes error correction level M for versions 1-10: EC
+// codewords per block, then the count and data length of the short blocks
+// and of the long blocks that follow them.
+var qrBlocks = [][5]int{
+	{10, 1, 16, 0, 0},
+	{16, 1, 28, 0, 0},
+	{26, 1, 44, 0, 0},
+	{18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0},
+	{18, 4, 31, 0, 0},
+	{22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37},
+	{26, 4, 43, 1, 44},
+}
+
+var qrAlignment = [][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+const (
+	qrQuietZone     = 4
+	defaultQRModule = 8
+	maxQRModule     = 32
+)
+
+var errQRTooLong = errors.New("content is too long for a QR code")
+
+// qrCode is a square grid of modules; true is dark.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func gfMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ byte(int(z>>7)*0x1D)
+		if y>>uint(i)&1 != 0 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+// reedSolomon returns the degree EC codewords for data.
+func reedSolomon(data []byte, degree int) []byte {
+	divisor := make([]byte, degree)
+	divisor[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range divisor {
+			divisor[j] = gfMultiply(divisor[j], root)
+			if j+1 < degree {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+
+	result := make([]byte, degree)
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[degree-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// encodeQR encodes text in byte mode at error correction level M, using the
+// smallest version that fits and the mask with the lowest penalty.
+func encodeQR(text string) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= len(qrBlocks); v++ {
+		blocks := qrBlocks[v-1]
+		capacity := (blocks[1]*blocks[2] + blocks[3]*blocks[4]) * 8
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(text)*8 <= capacity {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+	blocks := qrBlocks[version-1]
+	dataLen := blocks[1]*blocks[2] + blocks[3]*blocks[4]
+
+	var bits []bool
+	appendBits := func(val, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, val>>uint(i)&1 != 0)
+		}
+	}
+	appendBits(0x4, 4)
+	if version >= 10 {
+		appendBits(len(text), 16)
+	} else {
+		appendBits(len(text), 8)
+	}
+	for i := 0; i < len(text); i++ {
+		appendBits(int(text[i]), 8)
+	}
+	appendBits(0, min(4, dataLen*8-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	data := make([]byte, dataLen)
+	for i, bit := range bits {
+		if bit {
+			data[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	for i, pad := len(bits)/8, byte(0xEC); i < dataLen; i, pad = i+1, pad^0xEC^0x11 {
+		data[i] = pad
+	}
+
+	var dataBlocks, ecBlocks [][]byte
+	for i, offset := 0, 0; i < blocks[1]+blocks[3]; i++ {
+		n := blocks[2]
+		if i >= blocks[1] {
+			n = blocks[4]
+		}
+		dataBlocks = append(dataBlocks, data[offset:offset+n])
+		ecBlocks = append(ecBlocks, reedSolomon(data[offset:offset+n], blocks[0]))
+		offset += n
+	}
+	var codewords []byte
+	for i := 0; i < max(blocks[2], blocks[4]); i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				codewords = append(codewords, block[i])
+			}
+		}
+	}
+	for i := 0; i < blocks[0]; i++ {
+		for _, block := range ecBlocks {
+			codewords = append(codewords, block[i])
+		}
+	}
+
+	qr := newQRCode(version)
+	qr.placeData(codewords)
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormat(mask)
+		if penalty := qr.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask)
+	}
+	qr.applyMask(best)
+	qr.drawFormat(best)
+	return qr, nil
+}
+
+// newQRCode lays out the finder, timing, alignment and version patterns and
+// reserves the format areas.
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	qr := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range qr.modules {
+		qr.modules[i] = make([]bool, size)
+		qr.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		qr.set(6, i, i%2 == 0)
+		qr.set(i, 6, i%2 == 0)
+	}
+	for _, corner := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x < 0 || x >= size || y < 0 || y >= size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				qr.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+	positions := qrAlignment[version-1]
+	for i, cx := range positions {
+		for j, cy := range positions {
+			last := len(positions) - 1
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	qr.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 != 0
+			a, b := size-11+i%3, i/3
+			qr.set(a, b, dark)
+			qr.set(b, a, dark)
+		}
+	}
+	return qr
+}
+
+func (qr *qrCode) set(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// drawFormat writes both copies of the format bits for level M and mask.
+func (qr *qrCode) drawFormat(mask int) {
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		qr.set(8, i, bit(i))
+	}
+	qr.set(8, 7, bit(6))
+	qr.set(8, 8, bit(7))
+	qr.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		qr.set(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.set(8, qr.size-15+i, bit(i))
+	}
+	qr.set(8, qr.size-8, true)
+}
+
+// placeData fills the non-function modules in the standard zigzag, two
+// columns at a time from the bottom right; leftover modules are remainder
+// bits and stay light.
+func (qr *qrCode) placeData(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert
+				}
+				if qr.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				qr.modules[y][x] = codewords[i/8]>>uint(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask XORs the mask pattern over the data modules; applying it twice
+// restores them.
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.function[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the four mask evaluation rules.
+func (qr *qrCode) penalty() int {
+	n := qr.size
+	score, dark := 0, 0
+	finder := []bool{true, false, true, true, true, false, true}
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < n; a++ {
+			at := func(b int) bool {
+				if b < 0 || b >= n {
+					return false
+				}
+				if pass == 0 {
+					return qr.modules[a][b]
+				}
+				return qr.modules[b][a]
+			}
+			run := 1
+			for b := 1; b <= n; b++ {
+				if b < n && at(b) == at(b-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			for b := -4; b < n; b++ {
+				match := true
+				for k, want := range finder {
+					if at(b+k) != want {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				before, after := true, true
+				for k := 1; k <= 4; k++ {
+					before = before && !at(b-k)
+					after = after && !at(b+6+k)
+				}
+				if before || after {
+					score += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := qr.modules[y][x]
+				if qr.modules[y][x+1] == c && qr.modules[y+1][x] == c && qr.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	score += ((abs(dark*20-total*10)+total-1)/total - 1) * 10
+	return score
+}
+
+// image renders the code with a quiet zone, scale pixels per module.
+func (qr *qrCode) image(scale int) image.Image {
+	side := (qr.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.modules[y][x] {
+				continue
+			}
+			px, py := (x+qrQuietZone)*scale, (y+qrQuietZone)*scale
+			draw.Draw(img, image.Rect(px, py, px+scale, py+scale), image.Black, image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// writeQRCode renders text as a PNG QR code; ?size= sets the pixels per
+// module.
+func writeQRCode(c *gin.Context, text string) {
+	scale := defaultQRModule
+	if raw := c.Query("size"); raw != "" {
+		val, err := strconv.Atoi(raw)
+		if err != nil || val < 1 || val > maxQRModule {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be between 1 and %d", maxQRModule)})
+			return
+		}
+		scale = val
+	}
+
+	qr, err := encodeQR(text)
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, qr.image(scale)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Header("X-QR-Content", text)
+	c.Data(http.StatusOK, "image/png", out.Bytes())
+}
+
+// getRecipeQR returns a QR code for the recipe's share link, creating the
+// link if the recipe hasn't been shared yet.
+func getRecipeQR(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	exists, err := recipeVisible(tenantFromContext(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	token, err := shareTokenFor(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeQRCode(c, shareURL(token))
+}
+
+// parsePortionsQuery reads the compact "id:servings,id" form used in
+// shopping list links; servings may be omitted to use the recipe's yield.
+func parsePortionsQuery(raw string) ([]RecipePortion, error) {
+	portions := []RecipePortion{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idPart, servingsPart, hasServings := strings.Cut(part, ":")
+		id, err := strconv.Atoi(idPart)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid recipe ID %q", idPart)
+		}
+		portion := RecipePortion{ID: id}
+		if hasServings {
+			servings, err := strconv.ParseFloat(servingsPart, 64)
+			if err != nil || servings <= 0 {
+				return nil, fmt.Errorf("invalid servings %q", servingsPart)
+			}
+			portion.Servings = servings
+		}
+		portions = append(portions, portion)
+	}
+	if len(portions) == 0 {
+		return nil, errors.New("recipes is required")
+	}
+	return portions, nil
+}
+
+// shoppingListURL is the GET form of a shopping list, suitable for links.
+func shoppingListURL(portions []RecipePortion) string {
+	parts := make([]string, len(portions))
+	for i, portion := range portions {
+		parts[i] = strconv.Itoa(portion.ID)
+		if portion.Servings > 0 {
+			parts[i] += ":" + strconv.FormatFloat(portion.Servings, 'f', -1, 64)
+		}
+	}
+	return strings.TrimSuffix(cfg.PublicBaseURL, "/") + "/api/shopping-list?recipes=" + strings.Join(parts, ",")
+}
+
+func getShoppingList(c *gin.Context) {
+	portions, err := parsePortionsQuery(c.Query("recipes"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list, err := buildShoppingList(tenantFromContext(c), portions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// getShoppingListQR returns a QR code linking to the shopping list for the
+// same ?recipes= portions, so a printed plan can be reopened on a phone.
+func getShoppingListQR(c *gin.Context) {
+	portions, err := parsePortionsQuery(c.Query("recipes"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	writeQRCode(c, shoppingListURL(portions))
+}
+
+// nutritionLabelRow is one line of a nutrition panel. Style is title,
+// large, small or empty for body text. Amount is shown next to the label on
+// US panels and in its own column on EU ones; a Rule is drawn above the row,
+// Rule pixels thick.
+type nutritionLabelRow struct {
+	Label   string
+	Amount  string
+	Percent string
+	Style   string
+	Bold    bool
+	Indent  bool
+	Rule    int
+}
+
+const nutritionLabelWidth = 320
+
+var nutritionLabelRowHeights = map[string]int{"title": 34, "large": 30, "": 18, "small": 16}
+
+// US daily values (2016 FDA rule) and EU reference intakes
+// (Regulation 1169/2011, Annex XIII).
+var (
+	usDailyValues     = map[string]float64{"fat": 78, "sodium": 2300, "carbs": 275, "fiber": 28, "protein": 50}
+	euReferenceIntake = map[string]float64{"kcal": 2000, "fat": 70, "carbs": 260, "protein": 50, "salt": 6}
+)
+
+func percentOf(value, reference float64) string {
+	return fmt.Sprintf("%d%%", int(math.Round(value/reference*100)))
+}
+
+// fdaRound applies the FDA label rounding for grams: under 0.5 is 0,
+// under 5 is to the nearest half gram, otherwise to the nearest gram.
+func fdaRound(grams float64) string {
+	switch {
+	case grams < 0.5:
+		return "0g"
+	case grams < 5:
+		return strconv.FormatFloat(math.Round(grams*2)/2, 'f', -1, 64) + "g"
+	default:
+		return fmt.Sprintf("%.0fg", grams)
+	}
+}
+
+func wrapText(text string, width int) []string {
+	lines := []string{}
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func servingsLabel(servings float64) string {
+	if servings == 1 {
+		return "1 serving"
+	}
+	return strconv.FormatFloat(servings, 'f', -1, 64) + " servings"
+}
+
+// usNutritionRows lays out an FDA-style Nutrition Facts panel. Nutrients the
+// recipe has no value for are left off.
+func usNutritionRows(recipe Recipe, totals MealPlanTotals, servings float64) []nutritionLabelRow {
+	rows := []nutritionLabelRow{{Label: "Nutrition Facts", Style: "title", Bold: true}}
+	if recipe.Servings != nil && *recipe.Servings > 0 {
+		rows = append(rows, nutritionLabelRow{Label: fmt.Sprintf("%d servings per recipe", *recipe.Servings), Rule: 1})
+	}
+	rows = append(rows,
+		nutritionLabelRow{Label: "Serving size", Percent: servingsLabel(servings), Bold: true},
+		nutritionLabelRow{Label: "Amount per serving", Style: "small", Bold: true, Rule: 10},
+	)
+	if recipe.Calories != nil {
+		calories := totals.Calories
+		if calories > 50 {
+			calories = int(math.Round(float64(calories)/10) * 10)
+		}
+		rows = append(rows, nutritionLabelRow{Label: "Calories", Percent: strconv.Itoa(calories), Style: "large", Bold: true})
+	}
+	rows = append(rows, nutritionLabelRow{Percent: "% Daily Value*", Style: "small", Bold: true, Rule: 5})
+
+	if recipe.Fat != nil {
+		rows = append(rows, nutritionLabelRow{Label: "Total Fat", Amount: fdaRound(totals.Fat), Percent: percentOf(totals.Fat, usDailyValues["fat"]), Bold: true, Rule: 1})
+	}
+	if recipe.Sodium != nil {
+		sodium := math.Round(totals.Sodium/10) * 10
+		if totals.Sodium < 140 {
+			sodium = math.Round(totals.Sodium/5) * 5
+		}
+		rows = append(rows, nutritionLabelRow{Label: "Sodium", Amount: fmt.Sprintf("%.0fmg", sodium), Percent: percentOf(totals.Sodium, usDailyValues["sodium"]), Bold: true, Rule: 1})
+	}
+	if recipe.Carbs != nil {
+		rows = append(rows, nutritionLabelRow{Label: "Total Carbohydrate", Amount: fdaRound(totals.Carbs), Percent: percentOf(totals.Carbs, usDailyValues["carbs"]), Bold: true, Rule: 1})
+	}
+	if recipe.Fiber != nil {
+		rows = append(rows, nutritionLabelRow{Label: "Dietary Fiber", Amount: fdaRound(totals.Fiber), Percent: percentOf(totals.Fiber, usDailyValues["fiber"]), Indent: true, Rule: 1})
+	}
+	if recipe.Protein != nil {
+		rows = append(rows, nutritionLabelRow{Label: "Protein", Amount: fdaRound(totals.Protein), Percent: percentOf(totals.Protein, usDailyValues["protein"]), Bold: true, Rule: 1})
+	}
+
+	footnote := "* The % Daily Value (DV) tells you how much a nutrient in a serving of food contributes to a daily diet. 2,000 calories a day is used for general nutrition advice."
+	for i, line := range wrapText(footnote, 42) {
+		row := nutritionLabelRow{Label: line, Style: "small"}
+		if i == 0 {
+			row.Rule = 10
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// euNutritionRows lays out an EU nutrition declaration per portion with
+// reference intake percentages. Salt is derived from sodium.
+func euNutritionRows(recipe Recipe, totals MealPlanTotals, servings float64) []nutritionLabelRow {
+	rows := []nutritionLabelRow{
+		{Label: "Nutrition declaration", Style: "title", Bold: true},
+		{Label: "Per " + servingsLabel(servings), Amount: "Amount", Percent: "%RI*", Bold: true, Rule: 2},
+	}
+	if recipe.Calories != nil {
+		kcal := float64(totals.Calories)
+		rows = append(rows, nutritionLabelRow{Label: "Energy", Amount: fmt.Sprintf("%.0f kJ / %.0f kcal", kcal*4.184, kcal), Percent: percentOf(kcal, euReferenceIntake["kcal"]), Rule: 1})
+	}
+	for _, nutrient := range []struct {
+		label string
+		key   string
+		value *float64
+		total float64
+	}{
+		{"Fat", "fat", recipe.Fat, totals.Fat},
+		{"Carbohydrate", "carbs", recipe.Carbs, totals.Carbs},
+		{"Fibre", "", recipe.Fiber, totals.Fiber},
+		{"Protein", "protein", recipe.Protein, totals.Protein},
+		{"Salt", "salt", recipe.Sodium, totals.Sodium * 2.5 / 1000},
+	} {
+		if nutrient.value == nil {
+			continue
+		}
+		row := nutritionLabelRow{Label: nutrient.label, Amount: strconv.FormatFloat(math.Round(nutrient.total*10)/10, 'f', 1, 64) + " g", Rule: 1}
+		if reference, ok := euReferenceIntake[nutrient.key]; ok {
+			row.Percent = percentOf(nutrient.total, reference)
+		}
+		rows = append(rows, row)
+	}
+	rows = append(rows, nutritionLabelRow{Label: "* Reference intake of an average adult", Style: "small", Rule: 2})
+	rows = append(rows, nutritionLabelRow{Label: "(8400 kJ / 2000 kcal)", Style: "small"})
+	return rows
+}
+
+// nutritionLabelHeight is the panel height for rows, including the border.
+func nutritionLabelHeight(rows []nutritionLabelRow) int {
+	height := 16
+	for _, row := range rows {
+		height += nutritionLabelRowHeights[row.Style] + row.Rule
+	}
+	return height
+}
+
+// renderNutritionLabelSVG draws rows as a standalone SVG. EU panels put the
+// amount in its own column; US panels run it on after the label.
+func renderNutritionLabelSVG(rows []nutritionLabelRow, columns bool) []byte {
+	fontSizes := map[string]int{"title": 28, "large": 22, "": 13, "small": 11}
+	height := nutritionLabelHeight(rows)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Helvetica, Arial, sans-serif">`, nutritionLabelWidth, height, nutritionLabelWidth, height)
+	fmt.Fprintf(&b, `<rect x="1" y="1" width="%d" height="%d" fill="#fff" stroke="#000" stroke-width="2"/>`, nutritionLabelWidth-2, height-2)
+	y := 8
+	for _, row := range rows {
+		if row.Rule > 0 {
+			fmt.Fprintf(&b, `<rect x="8" y="%d" width="%d" height="%d"/>`, y, nutritionLabelWidth-16, row.Rule)
+			y += row.Rule
+		}
+		y += nutritionLabelRowHeights[row.Style]
+		baseline := y - 5
+		weight := "normal"
+		if row.Bold {
+			weight = "bold"
+		}
+		x := 8
+		if row.Indent {
+			x += 16
+		}
+		size := fontSizes[row.Style]
+		if row.Label != "" {
+			fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="%d" font-weight="%s">%s`, x, baseline, size, weight, template.HTMLEscapeString(row.Label))
+			if row.Amount != "" && !columns {
+				fmt.Fprintf(&b, ` <tspan font-weight="normal">%s</tspan>`, template.HTMLEscapeString(row.Amount))
+			}
+			b.WriteString(`</text>`)
+		}
+		if row.Amount != "" && columns {
+			fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="%d" font-weight="%s" text-anchor="end">%s</text>`, nutritionLabelWidth-64, baseline, size, weight, template.HTMLEscapeString(row.Amount))
+		}
+		if row.Percent != "" {
+			fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="%d" font-weight="%s" text-anchor="end">%s</text>`, nutritionLabelWidth-8, baseline, size, weight, template.HTMLEscapeString(row.Percent))
+		}
+	}
+	b.WriteString(`</svg>`)
+	return []byte(b.String())
+}
+
+// drawLabelText draws text with the 7x13 bitmap font scaled up by scale,
+// left-aligned at x or right-aligned to it. Bold is faked by a one-pixel
+// overdraw.
+func drawLabelText(dst draw.Image, x, baseline int, text string, scale int, bold, alignRight bool) {
+	face := basicfont.Face7x13
+	glyphs := image.NewAlpha(image.Rect(0, 0, utf8.RuneCountInString(text)*face.Advance+1, face.Height))
+	drawer := font.Drawer{Dst: glyphs, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+	drawer.DrawString(text)
+	if bold {
+		drawer.Dot = fixed.P(1, face.Ascent)
+		drawer.DrawString(text)
+	}
+
+	bounds := glyphs.Bounds()
+	if alignRight {
+		x -= bounds.Dx() * scale
+	}
+	top := baseline - face.Ascent*scale
+	for gy := 0; gy < bounds.Dy(); gy++ {
+		for gx := 0; gx < bounds.Dx(); gx++ {
+			if glyphs.AlphaAt(gx, gy).A < 0x80 {
+				continue
+			}
+			px, py := x+gx*scale, top+gy*scale
+			draw.Draw(dst, image.Rect(px, py, px+scale, py+scale), image.Black, image.Point{}, draw.Src)
+		}
+	}
+}
+
+// renderNutritionLabelPNG draws the same layout as the SVG with a bitmap
+// font, doubled for the title and calorie lines.
+func renderNutritionLabelPNG(rows []nutritionLabelRow, columns bool) ([]byte, error) {
+	height := nutritionLabelHeight(rows)
+	img := image.NewPaletted(image.Rect(0, 0, nutritionLabelWidth, height), color.Palette{color.White, color.Black})
+	for _, edge := range []image.Rectangle{
+		image.Rect(0, 0, nutritionLabelWidth, 2),
+		image.Rect(0, height-2, nutritionLabelWidth, height),
+		image.Rect(0, 0, 2, height),
+		image.Rect(nutritionLabelWidth-2, 0, nutritionLabelWidth, height),
+	} {
+		draw.Draw(img, edge, image.Black, image.Point{}, draw.Src)
+	}
+
+	y := 8
+	for _, row := range rows {
+		if row.Rule > 0 {
+			draw.Draw(img, image.Rect(8, y, nutritionLabelWidth-8, y+row.Rule), image.Black, image.Point{}, draw.Src)
+			y += row.Rule
+		}
+		y += nutritionLabelRowHeights[row.Style]
+		baseline := y - 5
+		scale := 1
+		if row.Style == "title" || row.Style == "large" {
+			scale = 2
+		}
+		x := 8
+		if row.Indent {
+			x += 16
+		}
+		label := row.Label
+		if row.Amount != "" && !columns {
+			label += " " + row.Amount
+		}
+		if label != "" {
+			drawLabelText(img, x, baseline, label, scale, row.Bold, false)
+		}
+		if row.Amount != "" && columns {
+			drawLabelText(img, nutritionLabelWidth-64, baseline, row.Amount, scale, row.Bold, true)
+		}
+		if row.Percent != "" {
+			drawLabelText(img, nutritionLabelWidth-8, baseline, row.Percent, scale, row.Bold, true)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// getNutritionLabel renders a nutrition panel for one recipe. ?servings=
+// scales the per-serving values; ?region=us|eu picks the panel style and
+// ?format=svg|png the output.
+func getNutritionLabel(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	format := c.DefaultQuery("format", "svg")
+	if format != "svg" && format != "png" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be svg or png"})
+		return
+	}
+	region := c.DefaultQuery("region", "us")
+	if region != "us" && region != "eu" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "region must be us or eu"})
+		return
+	}
+	servings := 1.0
+	if raw := c.Query("servings"); raw != "" {
+		servings, err = strconv.ParseFloat(raw, 64)
+		if err != nil || servings <= 0 || servings > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "servings must be between 0 and 100"})
+			return
+		}
+	}
+
+	recipes, err := selectRecipes().Where("id = ?", id).Visible(tenantFromContext(c)).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+	recipe := recipes[0]
+
+	var totals MealPlanTotals
+	addToTotals(&totals, recipe, servings)
+	rows := usNutritionRows(recipe, totals, servings)
+	if region == "eu" {
+		rows = euNutritionRows(recipe, totals, servings)
+	}
+
+	c.Header("Cache-Control", "public, max-age=3600")
+	if format == "svg" {
+		c.Data(http.StatusOK, "image/svg+xml", renderNutritionLabelSVG(rows, region == "eu"))
+		return
+	}
+	data, err := renderNutritionLabelPNG(rows, region == "eu")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "image/png", data)
+}
+
+const maxSavedSearchesPerOwner = 50
+
+// SavedSearch is a filter set that alerts its owner to new matching
+// recipes. EmailConfirmed is set once someone follows the link mailed to
+// Email; until then no alert is emailed.
+type SavedSearch struct {
+	ID             int               `json:"id"`
+	Name           string            `json:"name"`
+	Filters        map[string]string `json:"filters"`
+	Email          *string           `json:"email"`
+	EmailConfirmed bool              `json:"email_confirmed"`
+	WebhookURL     *string           `json:"webhook_url"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+type CreateSavedSearchRequest struct {
+	Name       string            `json:"name" binding:"required"`
+	Filters    map[string]string `json:"filters" binding:"required"`
+	Email      string            `json:"email"`
+	WebhookURL string            `json:"webhook_url"`
+}
+
+// apiKeyOwner identifies the caller by API key. Per-caller data such as
+// saved searches needs a stable owner, so the IP fallback apiKeyID allows
+// elsewhere is refused.
+func apiKeyOwner(c *gin.Context) (string, bool) {
+	if c.GetHeader("X-API-Key") == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-API-Key header is required"})
+		return "", false
+	}
+	return apiKeyID(c), true
+}
+
+// issuedKeyOwner is apiKeyOwner for writes that feed public aggregates,
+// such as ratings. Any string works as a personal key, so these only take
+// keys a tenant was issued.
+func issuedKeyOwner(c *gin.Context) (string, bool) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return "", false
+	}
+	if _, issued := verifiedCallerID(c); !issued {
+		c.JSON(http.StatusForbidden, gin.H{"error": "X-API-Key is not an issued key"})
+		return "", false
+	}
+	return owner, true
+}
+
+// savedSearchFilterSQL turns a saved filter set into WHERE conditions with
+// the same meaning as the /api/recipes/search parameters. Unknown keys and
+// malformed numbers are reported rather than ignored, since nobody is
+// looking at the results when an alert silently matches everything.
+func savedSearchFilterSQL(tenant *Tenant, filters map[string]string) (string, []interface{}, error) {
+	numeric := map[string]string{}
+	for _, filter := range searchNumericFilters {
+		numeric["min_"+filter.Param] = filter.Column + " >= ?"
+		numeric["max_"+filter.Param] = filter.Column + " <= ?"
+	}
+
+	query := ""
+	args := []interface{}{}
+	for _, key := range sortedKeys(filters) {
+		value := strings.TrimSpace(filters[key])
+		if value == "" {
+			continue
+		}
+		switch key {
+		case "diet":
+			plan, exists := tenant.dietPlans()[value]
+			if !exists {
+				return "", nil, fmt.Errorf("unknown diet %q", value)
+			}
+			query, args = applyDietFilters(query, args, plan.Filters)
+		case "search":
+			condition, searchArgs := textSearchSQL(value)
+			query += condition
+			args = append(args, searchArgs...)
+		case "include_ingredients", "exclude_ingredients":
+			for _, ingredient := range strings.Split(value, ",") {
+				condition, ingredientArgs := ingredientFilterSQL(ingredient, key == "exclude_ingredients")
+				query += condition
+				args = append(args, ingredientArgs...)
+			}
+		case "difficulty":
+			condition, difficultyArgs, err := difficultyFilterSQL(value)
+			if err != nil {
+				return "", nil, err
+			}
+			query += condition
+			args = append(args, difficultyArgs...)
+		case "equipment", "exclude_equipment":
+			condition, equipmentArgs, err := equipmentFilterSQL(value, key == "exclude_equipment")
+			if err != nil {
+				return "", nil, err
+			}
+			query += condition
+			args = append(args, equipmentArgs...)
+		case "kid_friendly":
+			val, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("kid_friendly must be true or false")
+			}
+			query += " AND kid_friendly = ?"
+			args = append(args, val)
+		case "has_image":
+			val, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("has_image must be true or false")
+			}
+			query += hasImageSQL(val)
+		case "macro_split":
+			tolerance := 0.0
+			if raw := strings.TrimSpace(filters["tolerance"]); raw != "" {
+				var err error
+				if tolerance, err = strconv.ParseFloat(raw, 64); err != nil {
+					return "", nil, fmt.Errorf("tolerance must be a number")
+				}
+			}
+			macro, err := parseMacroTarget(value, tolerance)
+			if err != nil {
+				return "", nil, err
+			}
+			condition, macroArgs := macro.filterSQL()
+			query += condition
+			args = append(args, macroArgs...)
+		case "tolerance":
+			if strings.TrimSpace(filters["macro_split"]) == "" {
+				return "", nil, fmt.Errorf("tolerance requires macro_split")
+			}
+		default:
+			condition, ok := numeric[key]
+			if !ok {
+				return "", nil, fmt.Errorf("unknown filter %q", key)
+			}
+			val, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s must be a number", key)
+			}
+			query += " AND " + condition
+			args = append(args, val)
+		}
+	}
+	return query, args, nil
+}
+
+func createSavedSearch(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	var req CreateSavedSearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	tenant := tenantFromContext(c)
+	if _, _, err := savedSearchFilterSQL(tenant, req.Filters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Email == "" && req.WebhookURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email or webhook_url is required"})
+		return
+	}
+	var email, webhookURL *string
+	if req.Email != "" {
+		if cfg.Alerts.SMTPHost == "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email alerts are not configured"})
+			return
+		}
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+			return
+		}
+		email = &addr.Address
+	}
+	if req.WebhookURL != "" {
+		u, err := url.ParseRequestURI(req.WebhookURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "webhook_url must be an http(s) URL"})
+			return
+		}
+		// Names are checked again on every delivery, against the address
+		// they resolve to then; see alertHTTPClient.
+		if ip := net.ParseIP(u.Hostname()); u.Hostname() == "localhost" || (ip != nil && !publicIP(ip)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "webhook_url must be a public address"})
+			return
+		}
+		webhookURL = &req.WebhookURL
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM saved_searches WHERE owner = ?", owner).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if count >= maxSavedSearchesPerOwner {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("At most %d saved searches per API key", maxSavedSearchesPerOwner)})
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	secret := hex.EncodeToString(raw)
+	filtersJSON, _ := json.Marshal(req.Filters)
+
+	// An address gets alerts only once someone reading it confirms, so a
+	// saved search can't be used to mail strangers.
+	var confirmToken string
+	var confirmHash *string
+	if email != nil {
+		if _, err := rand.Read(raw); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		confirmToken = hex.EncodeToString(raw)
+		hash := hashToken(confirmToken)
+		confirmHash = &hash
+	}
+
+	var tenantID *string
+	if tenant != nil {
+		tenantID = &tenant.ID
+	}
+	res, err := db.Exec("INSERT INTO saved_searches (owner, name, filters, email, webhook_url, webhook_secret, tenant_id, email_confirm_token) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		owner, req.Name, string(filtersJSON), email, webhookURL, secret, tenantID, confirmHash)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	if email != nil {
+		if err := sendSavedSearchConfirmation(*email, req.Name, confirmToken); err != nil {
+			requestLogger(c).Warn("saved search confirmation failed", "saved_search_id", id, "error", err)
+			db.Exec("DELETE FROM saved_searches WHERE id = ?", id)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Could not send the confirmation email"})
+			return
+		}
+	}
+
+	// The webhook secret is only returned here, for verifying
+	// X-Emeal-Signature on deliveries.
+	response := gin.H{
+		"id":              id,
+		"name":            req.Name,
+		"filters":         req.Filters,
+		"email":           email,
+		"email_confirmed": false,
+		"webhook_url":     webhookURL,
+	}
+	if webhookURL != nil {
+		response["webhook_secret"] = secret
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// sendSavedSearchConfirmation mails the link that turns on email alerts
+// for a saved search.
+func sendSavedSearchConfirmation(to, name, token string) error {
+	link := strings.TrimSuffix(cfg.PublicBaseURL, "/") + "/api/saved-searches/confirm?token=" + token
+	text := fmt.Sprintf("Someone asked for new recipes matching the saved search %q to be sent to this address.\n\n"+
+		"To receive them, confirm here:\n%s\n\nIf this wasn't you, ignore this message and nothing will be sent.\n", name, link)
+	return sendEmail(to, fmt.Sprintf("Confirm recipe alerts for %q", name), text)
+}
+
+// confirmSavedSearchEmail is the link in the confirmation email. It needs
+// no API key: the token is the proof.
+func confirmSavedSearchEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+	var id int
+	err := db.QueryRow("SELECT id FROM saved_searches WHERE email_confirm_token = ?", hashToken(token)).Scan(&id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Confirmation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := db.Exec("UPDATE saved_searches SET email_confirmed_at = NOW(), email_confirm_token = NULL WHERE id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "email_confirmed": true})
+}
+
+func listSavedSearches(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query("SELECT id, name, filters, email, email_confirmed_at IS NOT NULL, webhook_url, created_at FROM saved_searches WHERE owner = ? ORDER BY id", owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		var search SavedSearch
+		var filtersJSON string
+		if err := rows.Scan(&search.ID, &search.Name, &filtersJSON, &search.Email, &search.EmailConfirmed, &search.WebhookURL, &search.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		json.Unmarshal([]byte(filtersJSON), &search.Filters)
+		searches = append(searches, search)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"saved_searches": searches})
+}
+
+func deleteSavedSearch(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid saved search ID"})
+		return
+	}
+
+	// Pending alerts go with the search, so none is delivered after it.
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM saved_searches WHERE id = ? AND owner = ?", id, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Saved search not found"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM saved_search_notifications WHERE saved_search_id = ? AND status = 'pending'", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+// matchSavedSearches queues a notification per channel for every saved
+// search the newly published recipe satisfies, then tries to deliver them.
+// The unique key on the outbox makes a re-publish a no-op.
+func matchSavedSearches(recipeID int) {
+	type candidate struct {
+		id       int
+		filters  string
+		tenantID sql.NullString
+		channels []string
+	}
+
+	rows, err := db.Query("SELECT id, filters, tenant_id, email IS NOT NULL AND email_confirmed_at IS NOT NULL, webhook_url IS NOT NULL FROM saved_searches")
+	if err != nil {
+		slog.Error("saved search lookup failed", "recipe_id", recipeID, "error", err)
+		return
+	}
+	candidates := []candidate{}
+	for rows.Next() {
+		var cand candidate
+		var hasEmail, hasWebhook bool
+		if err := rows.Scan(&cand.id, &cand.filters, &cand.tenantID, &hasEmail, &hasWebhook); err != nil {
+			continue
+		}
+		if hasEmail {
+			cand.channels = append(cand.channels, "email")
+		}
+		if hasWebhook {
+			cand.channels = append(cand.channels, "webhook")
+		}
+		candidates = append(candidates, cand)
+	}
+	rows.Close()
+
+	matched := 0
+	for _, cand := range candidates {
+		var tenant *Tenant
+		if cand.tenantID.Valid {
+			if tenant, err = tenants.get(cand.tenantID.String); err != nil || tenant == nil {
+				// A deleted tenant's searches match nothing.
+				continue
+			}
+		}
+		var filters map[string]string
+		json.Unmarshal([]byte(cand.filters), &filters)
+		conditions, args, err := savedSearchFilterSQL(tenant, filters)
+		if err != nil {
+			continue
+		}
+
+		scope, scopeArgs := tenant.recipeScope()
+		var match bool
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ? AND "+scope+conditions+")",
+			append(append([]interface{}{recipeID}, scopeArgs...), args...)...).Scan(&match)
+		if err != nil {
+			slog.Error("saved search match failed", "saved_search_id", cand.id, "recipe_id", recipeID, "error", err)
+			continue
+		}
+		if !match {
+			continue
+		}
+		matched++
+		for _, channel := range cand.channels {
+			if _, err := db.Exec("INSERT IGNORE INTO saved_search_notifications (saved_search_id, recipe_id, channel) VALUES (?, ?, ?)", cand.id, recipeID, channel); err != nil {
+				slog.Error("saved search notification insert failed", "saved_search_id", cand.id, "error", err)
+			}
+		}
+	}
+	slog.Info("saved searches matched", "recipe_id", recipeID, "matched", matched, "checked", len(candidates))
+
+	deliverPendingAlerts()
+}
+
+// savedSearchAlert is one queued notification with what is needed to send it.
+type savedSearchAlert struct {
+	ID            int64
+	Channel       string
+	Attempts      int
+	SearchID      int
+	SearchName    string
+	Email         sql.NullString
+	WebhookURL    sql.NullString
+	WebhookSecret string
+	Recipe        Recipe
+}
+
+// alertHTTPClient posts webhooks.
+var alertHTTPClient = publicHTTPClient(0)
+
+// publicHTTPClient returns a client for caller-supplied URLs. It only
+// connects to public addresses, checked on the address actually dialled so
+// a name can't be pointed at the internal network after any earlier check,
+// and it doesn't follow redirects, whose targets were never checked at all.
+// A zero timeout leaves requests to their context.
+func publicHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+						return fmt.Errorf("address %s is not public", host)
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicIP reports whether ip is routable on the internet, as opposed to
+// loopback, private, link-local, multicast or unspecified.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+var (
+	alertDeliveryMu     sync.Mutex
+	alertDispatcherOnce sync.Once
+)
+
+// startAlertDispatcher retries pending notifications every
+// ALERTS_RETRY_INTERVAL, so deliveries that failed or were cut off by a
+// restart still go out. Serverless deployments, which never call it, have
+// the platform's cron run the saved_search_alerts task instead.
+func startAlertDispatcher() {
+	alertDispatcherOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(cfg.Alerts.RetryInterval)
+			for range ticker.C {
+				deliverPendingAlerts()
+			}
+		}()
+	})
+}
+
+// deliverPendingAlerts sends queued notifications, marking each sent, or
+// failed once it has used ALERTS_MAX_ATTEMPTS, and counts the outcomes.
+// Only one pass runs at a time on an instance; a caller that finds one
+// running leaves the work to it.
+func deliverPendingAlerts() (sent, failed int) {
+	if !alertDeliveryMu.TryLock() {
+		return 0, 0
+	}
+	defer alertDeliveryMu.Unlock()
+
+	rows, err := db.Query(`SELECT n.id, n.channel, n.attempts, s.id, s.name, s.email, s.webhook_url, s.webhook_secret, r.id, r.name, r.description, r.image, r.calories
+		FROM saved_search_notifications n
+		JOIN saved_searches s ON s.id = n.saved_search_id
+		JOIN recipes r ON r.id = n.recipe_id
+		WHERE n.status = 'pending' ORDER BY n.id LIMIT 100`)
+	if err != nil {
+		slog.Error("pending alert lookup failed", "error", err)
+		return 0, 0
+	}
+	alerts := []savedSearchAlert{}
+	for rows.Next() {
+		var alert savedSearchAlert
+		err := rows.Scan(&alert.ID, &alert.Channel, &alert.Attempts, &alert.SearchID, &alert.SearchName, &alert.Email, &alert.WebhookURL, &alert.WebhookSecret,
+			&alert.Recipe.ID, &alert.Recipe.Name, &alert.Recipe.Description, &alert.Recipe.Image, &alert.Recipe.Calories)
+		if err != nil {
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+	rows.Close()
+
+	for _, alert := range alerts {
+		err := sendSavedSearchAlert(alert)
+		if err == nil {
+			db.Exec("UPDATE saved_search_notifications SET status = 'sent', attempts = attempts + 1, sent_at = NOW(), last_error = NULL WHERE id = ?", alert.ID)
+			alertsSentTotal.inc(alert.Channel, "sent")
+			sent++
+			continue
+		}
+		failed++
+
+		status := "pending"
+		if alert.Attempts+1 >= cfg.Alerts.MaxAttempts {
+			status = "failed"
+		}
+		db.Exec("UPDATE saved_search_notifications SET status = ?, attempts = attempts + 1, last_error = ? WHERE id = ?", status, err.Error(), alert.ID)
+		alertsSentTotal.inc(alert.Channel, "error")
+		slog.Warn("saved search alert failed", "notification_id", alert.ID, "channel", alert.Channel, "attempt", alert.Attempts+1, "error", err)
+	}
+	return sent, failed
+}
+
+// alertRecipeURL links to the recipe's share page, which reads better in an
+// inbox than the JSON endpoint; the API URL is the fallback.
+func alertRecipeURL(recipeID int) string {
+	if token, err := shareTokenFor(recipeID); err == nil {
+		return shareURL(token)
+	}
+	return fmt.Sprintf("%s/api/recipe/%d", strings.TrimSuffix(cfg.PublicBaseURL, "/"), recipeID)
+}
+
+func sendSavedSearchAlert(alert savedSearchAlert) error {
+	recipeURL := alertRecipeURL(alert.Recipe.ID)
+
+	switch alert.Channel {
+	case "webhook":
+		if !alert.WebhookURL.Valid {
+			return errors.New("saved search has no webhook_url")
+		}
+		body, _ := json.Marshal(gin.H{
+			"event":        "saved_search.match",
+			"saved_search": gin.H{"id": alert.SearchID, "name": alert.SearchName},
+			"recipe": gin.H{
+				"id":          alert.Recipe.ID,
+				"name":        alert.Recipe.Name,
+				"description": alert.Recipe.Description,
+				"image":       alert.Recipe.Image,
+				"calories":    alert.Recipe.Calories,
+				"url":         recipeURL,
+			},
+			"notification_id": alert.ID,
+		})
+		mac := hmac.New(sha256.New, []byte(alert.WebhookSecret))
+		mac.Write(body)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Alerts.WebhookTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, alert.WebhookURL.String, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Emeal-Event", "saved_search.match")
+		req.Header.Set("X-Emeal-Delivery", strconv.FormatInt(alert.ID, 10))
+		req.Header.Set("X-Emeal-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		resp, err := alertHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+		}
+		return nil
+
+	case "email":
+		if !alert.Email.Valid {
+			return errors.New("saved search has no email")
+		}
+		if cfg.Alerts.SMTPHost == "" {
+			return errors.New("email alerts are not configured")
+		}
+		var text strings.Builder
+		fmt.Fprintf(&text, "A new recipe matches your saved search %q.\n\n%s\n", alert.SearchName, alert.Recipe.Name)
+		if alert.Recipe.Description != "" {
+			fmt.Fprintf(&text, "%s\n", alert.Recipe.Description)
+		}
+		fmt.Fprintf(&text, "\n%s\n", recipeURL)
+		return sendEmail(alert.Email.String, fmt.Sprintf("New recipe for %q: %s", alert.SearchName, alert.Recipe.Name), text.String())
+	}
+	return fmt.Errorf("unknown channel %q", alert.Channel)
+}
+
+type emailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// sendEmail sends a plain-text message through the alert SMTP settings,
+// as multipart/mixed when there are attachments.
+func sendEmail(to, subject, text string, attachments ...emailAttachment) error {
+	if cfg.Alerts.SMTPHost == "" {
+		return errors.New("email is not configured")
+	}
+	// Subjects can carry user-supplied names; folding whitespace keeps
+	// CR/LF out of the header.
+	subject = strings.Join(strings.Fields(subject), " ")
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.Alerts.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	if len(attachments) == 0 {
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.WriteString(text)
+	} else {
+		parts := multipart.NewWriter(&msg)
+		fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+		part, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+		if err != nil {
+			return err
+		}
+		io.WriteString(part, text)
+		for _, attachment := range attachments {
+			part, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {attachment.ContentType},
+				"Content-Transfer-Encoding": {"base64"},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+			})
+			if err != nil {
+				return err
+			}
+			encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+			for len(encoded) > 76 {
+				io.WriteString(part, encoded[:76]+"\r\n")
+				encoded = encoded[76:]
+			}
+			io.WriteString(part, encoded+"\r\n")
+		}
+		if err := parts.Close(); err != nil {
+			return err
+		}
+	}
+
+	var auth smtp.Auth
+	if cfg.Alerts.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.Alerts.SMTPUsername, cfg.Alerts.SMTPPassword, cfg.Alerts.SMTPHost)
+	}
+	return smtp.SendMail(cfg.Alerts.SMTPHost+":"+cfg.Alerts.SMTPPort, auth, cfg.Alerts.From, []string{to}, msg.Bytes())
+}
+
+// SynonymGroup is a set of interchangeable ingredient names. Localized
+// holds the group's names in other languages by locale; they match in
+// search like any term and name the ingredient in localized responses.
+type SynonymGroup struct {
+	Canonical string              `json:"canonical"`
+	Terms     []string            `json:"terms"`
+	Localized map[string][]string `json:"localized,omitempty"`
+}
+
+type PutSynonymGroupRequest struct {
+	Terms     []string            `json:"terms" binding:"required"`
+	Localized map[string][]string `json:"localized"`
+}
+
+func listSynonyms(c *gin.Context) {
+	rows, err := db.Query("SELECT canonical, term, locale FROM ingredient_synonyms ORDER BY canonical, term")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	groups := []SynonymGroup{}
+	for rows.Next() {
+		var canonical, term string
+		var locale sql.NullString
+		if err := rows.Scan(&canonical, &term, &locale); err != nil {
+			continue
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Canonical != canonical {
+			groups = append(groups, SynonymGroup{Canonical: canonical, Terms: []string{}})
+		}
+		group := &groups[len(groups)-1]
+		if !locale.Valid {
+			group.Terms = append(group.Terms, term)
+			continue
+		}
+		if group.Localized == nil {
+			group.Localized = map[string][]string{}
+		}
+		group.Localized[locale.String] = append(group.Localized[locale.String], term)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"groups": groups})
+}
+
+// putSynonymGroup replaces the group named by :canonical. The canonical
+// term is always a member; a term may only belong to one group.
+func putSynonymGroup(c *gin.Context) {
+	canonical := strings.ToLower(strings.TrimSpace(c.Param("canonical")))
+	var req PutSynonymGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil || canonical == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	terms := []string{canonical}
+	localeOf := map[string]interface{}{canonical: nil}
+	add := func(term string, locale interface{}) {
+		term = strings.Join(strings.Fields(strings.ToLower(term)), " ")
+		if term != "" && len(term) <= 128 && !slices.Contains(terms, term) {
+			terms = append(terms, term)
+			localeOf[term] = locale
+		}
+	}
+	for _, term := range req.Terms {
+		add(term, nil)
+	}
+	for _, locale := range sortedKeys(req.Localized) {
+		normalized, ok := normalizeLocale(locale)
+		if !ok || normalized == sourceLocale {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid locale " + locale})
+			return
+		}
+		for _, term := range req.Localized[locale] {
+			add(term, normalized)
+		}
+	}
+	if len(terms) < 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A synonym group needs at least two terms"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	placeholders := make([]string, len(terms))
+	args := []interface{}{canonical}
+	for i, term := range terms {
+		placeholders[i] = "?"
+		args = append(args, term)
+	}
+	var conflict, other string
+	err = tx.QueryRow("SELECT term, canonical FROM ingredient_synonyms WHERE canonical <> ? AND term IN ("+strings.Join(placeholders, ",")+") LIMIT 1", args...).Scan(&conflict, &other)
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%q already belongs to the %q group", conflict, other)})
+		return
+	}
+	if err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM ingredient_synonyms WHERE canonical = ?", canonical); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, term := range terms {
+		if _, err := tx.Exec("INSERT INTO ingredient_synonyms (term, canonical, locale) VALUES (?, ?, ?)", term, canonical, localeOf[term]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ingredientSynonyms.invalidate()
+
+	sort.Strings(terms)
+	group := SynonymGroup{Canonical: canonical, Terms: []string{}}
+	for _, term := range terms {
+		if locale, ok := localeOf[term].(string); ok {
+			if group.Localized == nil {
+				group.Localized = map[string][]string{}
+			}
+			group.Localized[locale] = append(group.Localized[locale], term)
+		} else {
+			group.Terms = append(group.Terms, term)
+		}
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+func deleteSynonymGroup(c *gin.Context) {
+	canonical := strings.ToLower(strings.TrimSpace(c.Param("canonical")))
+	res, err := db.Exec("DELETE FROM ingredient_synonyms WHERE canonical = ?", canonical)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Synonym group not found"})
+		return
+	}
+	ingredientSynonyms.invalidate()
+
+	c.JSON(http.StatusOK, gin.H{"canonical": canonical, "deleted": true})
+}
+
+// IngredientPrice is what one unit of an ingredient costs, in the currency
+// the deployment's prices are entered in.
+type IngredientPrice struct {
+	Ingredient string    `json:"ingredient"`
+	Unit       string    `json:"unit"`
+	Price      float64   `json:"price"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type PutIngredientPriceRequest struct {
+	Unit  string   `json:"unit" binding:"required"`
+	Price *float64 `json:"price" binding:"required"`
+}
+
+// unitAmounts converts measured units to grams or millilitres so a factor per
+// one unit applies to quantities given in another unit of the same kind.
+// Count units such as clove and can, and "each", only match themselves.
+var unitAmounts = map[string]struct {
+	Kind   string
+	Amount float64
+}{
+	"g": {"mass", 1}, "kg": {"mass", 1000}, "oz": {"mass", 28.3495}, "lb": {"mass", 453.592},
+	"ml": {"volume", 1}, "l": {"volume", 1000}, "cup": {"volume", 236.588}, "tbsp": {"volume", 14.787}, "tsp": {"volume", 4.929},
+}
+
+// convertQuantity expresses qty of from in units of to. An ingredient line
+// without a unit counts items, which matches factors given per "each".
+func convertQuantity(qty float64, from, to string) (float64, bool) {
+	if from == "" {
+		from = "each"
+	}
+	if from == to {
+		return qty, true
+	}
+	src, ok1 := unitAmounts[from]
+	dst, ok2 := unitAmounts[to]
+	if !ok1 || !ok2 || src.Kind != dst.Kind {
+		return 0, false
+	}
+	return qty * src.Amount / dst.Amount, true
+}
+
+// validFactorUnit accepts the canonical units parseIngredientLine produces,
+// plus "each", as the unit of a price or emission factor.
+func validFactorUnit(unit string) bool {
+	if unit == "each" {
+		return true
+	}
+	for _, canonical := range ingredientUnits {
+		if canonical == unit {
+			return true
+		}
+	}
+	return false
+}
+
+// ingredientFactor is one row of an ingredient table such as
+// ingredient_prices: a value per unit, with a pattern matching the
+// ingredient name, its plural and its synonyms.
+type ingredientFactor struct {
+	pattern    *regexp.Regexp
+	Ingredient string
+	Unit       string
+	Value      float64
+}
+
+// minFactorCoverage is the share of a recipe's measured ingredient lines
+// that must match a factor before the recipe gets an estimate; below that
+// the figure mostly reflects what happens to be in the table.
+const minFactorCoverage = 0.5
+
+// recipeEstimate is a per-serving figure estimated from an ingredient
+// factor table and stored on recipes, like cost_per_serving.
+type recipeEstimate struct {
+	Name         string
+	Table        string
+	Column       string
+	RecipeColumn string
+	// Decimals is how many places the stored value is rounded to.
+	Decimals int
+	current  func(Recipe) *float64
+
+	// mu serializes recomputes, so a factor edited during one run is picked
+	// up by the run it triggered.
+	mu      sync.Mutex
+	factors factorCache[ingredientFactor]
+}
+
+var (
+	costEstimate = newRecipeEstimate(&recipeEstimate{Name: "cost", Table: "ingredient_prices", Column: "price", RecipeColumn: "cost_per_serving", Decimals: 2,
+		current: func(recipe Recipe) *float64 { return recipe.CostPerServing }})
+	emissionsEstimate = newRecipeEstimate(&recipeEstimate{Name: "co2e", Table: "ingredient_emissions", Column: "co2e", RecipeColumn: "co2e_per_serving", Decimals: 3,
+		current: func(recipe Recipe) *float64 { return recipe.CO2ePerServing }})
+)
+
+func newRecipeEstimate(e *recipeEstimate) *recipeEstimate {
+	e.factors.load = e.loadFactors
+	return e
+}
+
+// factorCache holds a factor table with its compiled patterns, so recipe
+// inserts and reindexes don't read the table and compile a pattern per row
+// for every recipe. Edits on this instance invalidate it; those made
+// elsewhere, and synonym changes the patterns depend on, are picked up
+// after SEARCH_SYNONYM_REFRESH.
+type factorCache[T any] struct {
+	mu       sync.Mutex
+	load     func() ([]T, error)
+	factors  []T
+	loadedAt time.Time
+}
+
+func (c *factorCache[T]) get() ([]T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.factors != nil && time.Since(c.loadedAt) < cfg.Search.SynonymRefresh {
+		return c.factors, nil
+	}
+	factors, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.factors, c.loadedAt = factors, time.Now()
+	return factors, nil
+}
+
+func (c *factorCache[T]) invalidate() {
+	c.mu.Lock()
+	c.factors = nil
+	c.mu.Unlock()
+}
+
+// ingredientPattern matches an ingredient name, its plural and its synonyms.
+func ingredientPattern(ingredient string) *regexp.Regexp {
+	names := []string{}
+	for _, name := range ingredientSynonyms.expand(ingredient) {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(names, "|") + `)(?:es|s)?\b`)
+}
+
+// loadFactors reads the factor table longest name first, so "brown sugar"
+// is preferred over "sugar" for a line that mentions both.
+func (e *recipeEstimate) loadFactors() ([]ingredientFactor, error) {
+	rows, err := db.Query("SELECT ingredient, unit, " + e.Column + " FROM " + e.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	factors := []ingredientFactor{}
+	for rows.Next() {
+		var factor ingredientFactor
+		if err := rows.Scan(&factor.Ingredient, &factor.Unit, &factor.Value); err != nil {
+			return nil, err
+		}
+		factor.pattern = ingredientPattern(factor.Ingredient)
+		factors = append(factors, factor)
+	}
+	sort.SliceStable(factors, func(i, j int) bool {
+		return len(factors[i].Ingredient) > len(factors[j].Ingredient)
+	})
+	return factors, rows.Err()
+}
+
+// perServing applies factors to each measured ingredient line and divides
+// by the recipe's servings. Lines without a quantity ("salt to taste") are
+// ignored; nil means too little of the recipe matched.
+func (e *recipeEstimate) perServing(recipe Recipe, factors []ingredientFactor) *float64 {
+	total := 0.0
+	measured, matched := 0, 0
+	for _, line := range recipe.Ingredients {
+		parsed := parseIngredientLine(line)
+		if parsed.Quantity <= 0 || parsed.Name == "" {
+			continue
+		}
+		measured++
+		for _, factor := range factors {
+			if !factor.pattern.MatchString(parsed.Name) {
+				continue
+			}
+			if qty, ok := convertQuantity(parsed.Quantity, parsed.Unit, factor.Unit); ok {
+				total += qty * factor.Value
+				matched++
+			}
+			break
+		}
+	}
+	if measured == 0 || float64(matched) < float64(measured)*minFactorCoverage {
+		return nil
+	}
+
+	servings := 1
+	if recipe.Servings != nil && *recipe.Servings > 0 {
+		servings = *recipe.Servings
+	}
+	scale := math.Pow(10, float64(e.Decimals))
+	value := math.Round(total/float64(servings)*scale) / scale
+	return &value
+}
+
+// estimate computes the figure for a recipe not yet stored from the cached
+// factors. A missing factor table only costs the estimate, so errors are
+// logged and yield nil.
+func (e *recipeEstimate) estimate(recipe Recipe) *float64 {
+	factors, err := e.factors.get()
+	if err != nil {
+		slog.Warn("recipe estimate factors unavailable", "estimate", e.Name, "error", err)
+		return nil
+	}
+	return e.perServing(recipe, factors)
+}
+
+// recompute re-estimates the stored figure for every recipe, or with
+// onlyMissing for those without one, and returns how many changed.
+func (e *recipeEstimate) recompute(onlyMissing bool) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.factors.invalidate()
+	factors, err := e.factors.get()
+	if err != nil {
+		return 0, err
+	}
+
+	const batchSize = 500
+	changed := 0
+	lastID := 0
+	for {
+		query := selectRecipes().Where("id > ?", lastID)
+		if onlyMissing {
+			query.Where(e.RecipeColumn + " IS NULL")
+		}
+		recipes, err := query.OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return changed, err
+		}
+		for _, recipe := range recipes {
+			lastID = recipe.ID
+			value, current := e.perServing(recipe, factors), e.current(recipe)
+			if (value == nil) == (current == nil) && (value == nil || *value == *current) {
+				continue
+			}
+			if _, err := db.Exec("UPDATE recipes SET "+e.RecipeColumn+" = ? WHERE id = ?", value, recipe.ID); err != nil {
+				return changed, err
+			}
+			changed++
+		}
+		if len(recipes) < batchSize {
+			return changed, nil
+		}
+	}
+}
+
+// recomputeAsync refreshes the stored figures after a factor change without
+// holding up the admin request. The cached factors are dropped at once, so
+// recipes inserted meanwhile already see the change.
+func (e *recipeEstimate) recomputeAsync() {
+	e.factors.invalidate()
+	go func() {
+		if changed, err := e.recompute(false); err != nil {
+			slog.Error("recipe estimate recompute failed", "estimate", e.Name, "error", err)
+		} else {
+			slog.Info("recipe estimates recomputed", "estimate", e.Name, "changed", changed)
+		}
+	}()
+}
+
+func listIngredientPrices(c *gin.Context) {
+	rows, err := db.Query("SELECT ingredient, unit, price, updated_at FROM ingredient_prices ORDER BY ingredient")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	prices := []IngredientPrice{}
+	for rows.Next() {
+		var price IngredientPrice
+		if err := rows.Scan(&price.Ingredient, &price.Unit, &price.Price, &price.UpdatedAt); err != nil {
+			continue
+		}
+		prices = append(prices, price)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"prices": prices})
+}
+
+// putIngredientPrice sets the price of one unit of :ingredient and
+// recomputes recipe costs in the background.
+func putIngredientPrice(c *gin.Context) {
+	ingredient := strings.Join(strings.Fields(strings.ToLower(c.Param("ingredient"))), " ")
+	var req PutIngredientPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil || ingredient == "" || len(ingredient) > 128 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	unit := strings.ToLower(strings.TrimSpace(req.Unit))
+	if canonical, ok := ingredientUnits[unit]; ok {
+		unit = canonical
+	}
+	if !validFactorUnit(unit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown unit %q", req.Unit)})
+		return
+	}
+	if *req.Price < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price must not be negative"})
+		return
+	}
+
+	if _, err := db.Exec("INSERT INTO ingredient_prices (ingredient, unit, price) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE unit = VALUES(unit), price = VALUES(price), updated_at = NOW()",
+		ingredient, unit, *req.Price); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	costEstimate.recomputeAsync()
+
+	c.JSON(http.StatusOK, gin.H{"ingredient": ingredient, "unit": unit, "price": *req.Price})
+}
+
+func deleteIngredientPrice(c *gin.Context) {
+	ingredient := strings.Join(strings.Fields(strings.ToLower(c.Param("ingredient"))), " ")
+	res, err := db.Exec("DELETE FROM ingredient_prices WHERE ingredient = ?", ingredient)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ingredient price not found"})
+		return
+	}
+	costEstimate.recomputeAsync()
+
+	c.JSON(http.StatusOK, gin.H{"ingredient": ingredient, "deleted": true})
+}
+
+// recomputeIngredientCosts reruns the cost estimate synchronously, for
+// after synonym edits or a bulk price import done directly in the database.
+func recomputeIngredientCosts(c *gin.Context) {
+	changed, err := costEstimate.recompute(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "changed": changed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": changed})
+}
+
+// IngredientEmission is the kg CO2e of one unit of an ingredient.
+type IngredientEmission struct {
+	Ingredient string    `json:"ingredient"`
+	Unit       string    `json:"unit"`
+	CO2e       float64   `json:"co2e"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type PutIngredientEmissionRequest struct {
+	Unit string   `json:"unit" binding:"required"`
+	CO2e *float64 `json:"co2e" binding:"required"`
+}
+
+func listIngredientEmissions(c *gin.Context) {
+	rows, err := db.Query("SELECT ingredient, unit, co2e, updated_at FROM ingredient_emissions ORDER BY ingredient")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	emissions := []IngredientEmission{}
+	for rows.Next() {
+		var emission IngredientEmission
+		if err := rows.Scan(&emission.Ingredient, &emission.Unit, &emission.CO2e, &emission.UpdatedAt); err != nil {
+			continue
+		}
+		emissions = append(emissions, emission)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"emissions": emissions})
+}
+
+// putIngredientEmission sets the footprint of one unit of :ingredient and
+// recomputes recipe footprints in the background.
+func putIngredientEmission(c *gin.Context) {
+	ingredient := strings.Join(strings.Fields(strings.ToLower(c.Param("ingredient"))), " ")
+	var req PutIngredientEmissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || ingredient == "" || len(ingredient) > 128 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	unit := strings.ToLower(strings.TrimSpace(req.Unit))
+	if canonical, ok := ingredientUnits[unit]; ok {
+		unit = canonical
+	}
+	if !validFactorUnit(unit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown unit %q", req.Unit)})
+		return
+	}
+	if *req.CO2e < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "co2e must not be negative"})
+		return
+	}
+
+	if _, err := db.Exec("INSERT INTO ingredient_emissions (ingredient, unit, co2e) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE unit = VALUES(unit), co2e = VALUES(co2e), updated_at = NOW()",
+		ingredient, unit, *req.CO2e); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	emissionsEstimate.recomputeAsync()
+
+	c.JSON(http.StatusOK, gin.H{"ingredient": ingredient, "unit": unit, "co2e": *req.CO2e})
+}
+
+func deleteIngredientEmission(c *gin.Context) {
+	ingredient := strings.Join(strings.Fields(strings.ToLower(c.Param("ingredient"))), " ")
+	res, err := db.Exec("DELETE FROM ingredient_emissions WHERE ingredient = ?", ingredient)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ingredient emission factor not found"})
+		return
+	}
+	emissionsEstimate.recomputeAsync()
+
+	c.JSON(http.StatusOK, gin.H{"ingredient": ingredient, "deleted": true})
+}
+
+// recomputeIngredientEmissions reruns the CO2e estimate synchronously.
+func recomputeIngredientEmissions(c *gin.Context) {
+	changed, err := emissionsEstimate.recompute(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "changed": changed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": changed})
+}
+
+// IngredientNutrition is USDA-style nutrition per 100 g of an ingredient.
+// GramsPerML converts cups and spoons to grams and GramsEach converts
+// counted items, cloves and slices; without them such lines go unmatched.
+type IngredientNutrition struct {
+	Ingredient string   `json:"ingredient"`
+	Calories   float64  `json:"calories"`
+	Protein    float64  `json:"protein"`
+	Fat        float64  `json:"fat"`
+	Carbs      float64  `json:"carbs"`
+	Fiber      float64  `json:"fiber"`
+	Sodium     float64  `json:"sodium"`
+	GramsPerML *float64 `json:"grams_per_ml"`
+	GramsEach  *float64 `json:"grams_each"`
+	FDCID      *int     `json:"fdc_id"`
+	// GlycemicIndex is relative to glucose at 100; nil for ingredients
+	// whose carbs haven't been measured for it.
+	GlycemicIndex *float64  `json:"glycemic_index"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type PutIngredientNutritionRequest struct {
+	Calories      *float64 `json:"calories" binding:"required"`
+	Protein       *float64 `json:"protein" binding:"required"`
+	Fat           *float64 `json:"fat" binding:"required"`
+	Carbs         *float64 `json:"carbs" binding:"required"`
+	Fiber         float64  `json:"fiber"`
+	Sodium        float64  `json:"sodium"`
+	GramsPerML    *float64 `json:"grams_per_ml"`
+	GramsEach     *float64 `json:"grams_each"`
+	FDCID         *int     `json:"fdc_id"`
+	GlycemicIndex *float64 `json:"glycemic_index"`
+}
+
+// NutritionEstimate is per-serving nutrition summed from ingredient lines.
+// Confidence is the share of named ingredient lines that were measured and
+// matched, so "salt to taste" lowers it without blocking the estimate.
+type NutritionEstimate struct {
+	Calories   int     `json:"calories"`
+	Protein    float64 `json:"protein"`
+	Fat        float64 `json:"fat"`
+	Carbs      float64 `json:"carbs"`
+	Fiber      float64 `json:"fiber"`
+	Sodium     float64 `json:"sodium"`
+	Confidence float64 `json:"confidence"`
+}
+
+// countUnitGrams weighs units that mean the same amount whatever the
+// ingredient.
+var countUnitGrams = map[string]float64{"can": 400, "pinch": 0.36}
+
+type nutritionFactor struct {
+	IngredientNutrition
+	pattern *regexp.Regexp
+}
+
+// ingredientGrams weighs a parsed ingredient line using the factor's
+// density or piece weight where the unit needs one.
+func ingredientGrams(parsed ParsedIngredient, factor nutritionFactor) (float64, bool) {
+	if amount, ok := unitAmounts[parsed.Unit]; ok {
+		if amount.Kind == "mass" {
+			return parsed.Quantity * amount.Amount, true
+		}
+		if factor.GramsPerML != nil {
+			return parsed.Quantity * amount.Amount * *factor.GramsPerML, true
+		}
+		return 0, false
+	}
+	if grams, ok := countUnitGrams[parsed.Unit]; ok {
+		return parsed.Quantity * grams, true
+	}
+	switch parsed.Unit {
+	case "", "clove", "slice":
+		if factor.GramsEach != nil {
+			return parsed.Quantity * *factor.GramsEach, true
+		}
+	}
+	return 0, false
+}
+
+// nutritionEstimateMu serializes nutrition recomputes, as recipeEstimate.mu
+// does for cost and CO2e, and nutritionFactors caches the table as
+// recipeEstimate.factors does.
+var (
+	nutritionEstimateMu sync.Mutex
+	nutritionFactors    = factorCache[nutritionFactor]{load: loadNutritionFactors}
+)
+
+func loadNutritionFactors() ([]nutritionFactor, error) {
+	rows, err := db.Query("SELECT ingredient, calories, protein, fat, carbs, fiber, sodium, grams_per_ml, grams_each, fdc_id, glycemic_index, updated_at FROM ingredient_nutrition")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	factors := []nutritionFactor{}
+	for rows.Next() {
+		var factor nutritionFactor
+		if err := rows.Scan(&factor.Ingredient, &factor.Calories, &factor.Protein, &factor.Fat, &factor.Carbs, &factor.Fiber, &factor.Sodium,
+			&factor.GramsPerML, &factor.GramsEach, &factor.FDCID, &factor.GlycemicIndex, &factor.UpdatedAt); err != nil {
+			return nil, err
+		}
+		factor.pattern = ingredientPattern(factor.Ingredient)
+		factors = append(factors, factor)
+	}
+	sort.SliceStable(factors, func(i, j int) bool {
+		return len(factors[i].Ingredient) > len(factors[j].Ingredient)
+	})
+	return factors, rows.Err()
+}
+
+// estimateNutrition sums the matched lines per serving. Like the cost and
+// CO2e estimates it gives nil when under minFactorCoverage of the measured
+// lines matched.
+func estimateNutrition(recipe Recipe, factors []nutritionFactor) *NutritionEstimate {
+	var total NutritionEstimate
+	calories := 0.0
+	named, measured, matched := 0, 0, 0
+	for _, line := range recipe.Ingredients {
+		parsed := parseIngredientLine(line)
+		if parsed.Name == "" {
+			continue
+		}
+		named++
+		if parsed.Quantity <= 0 {
+			continue
+		}
+		measured++
+		for _, factor := range factors {
+			if !factor.pattern.MatchString(parsed.Name) {
+				continue
+			}
+			if grams, ok := ingredientGrams(parsed, factor); ok {
+				scale := grams / 100
+				calories += factor.Calories * scale
+				total.Protein += factor.Protein * scale
+				total.Fat += factor.Fat * scale
+				total.Carbs += factor.Carbs * scale
+				total.Fiber += factor.Fiber * scale
+				total.Sodium += factor.Sodium * scale
+				matched++
+			}
+			break
+		}
+	}
+	if measured == 0 || float64(matched) < float64(measured)*minFactorCoverage {
+		return nil
+	}
+
+	servings := 1.0
+	if recipe.Servings != nil && *recipe.Servings > 0 {
+		servings = float64(*recipe.Servings)
+	}
+	round1 := func(v float64) float64 { return math.Round(v/servings*10) / 10 }
+	return &NutritionEstimate{
+		Calories:   int(math.Round(calories / servings)),
+		Protein:    round1(total.Protein),
+		Fat:        round1(total.Fat),
+		Carbs:      round1(total.Carbs),
+		Fiber:      round1(total.Fiber),
+		Sodium:     math.Round(total.Sodium / servings),
+		Confidence: math.Round(float64(matched)/float64(named)*100) / 100,
+	}
+}
+
+// recomputeNutritionEstimates re-estimates recipes that have no nutrition
+// or an earlier estimate, or with onlyMissing just the former, and returns
+// how many changed. Estimated values are flagged on the recipe; nutrition
+// entered any other way is never touched. A recipe whose estimate no longer
+// holds is cleared.
+func recomputeNutritionEstimates(onlyMissing bool) (int, error) {
+	nutritionEstimateMu.Lock()
+	defer nutritionEstimateMu.Unlock()
+
+	nutritionFactors.invalidate()
+	factors, err := nutritionFactors.get()
+	if err != nil {
+		return 0, err
+	}
+
+	const batchSize = 500
+	changed := 0
+	lastID := 0
+	eligible := "(calories IS NULL AND protein IS NULL AND fat IS NULL AND carbs IS NULL AND NOT nutrition_estimated)"
+	if !onlyMissing {
+		eligible = "(nutrition_estimated OR " + eligible + ")"
+	}
+	for {
+		recipes, err := selectRecipes().Where("id > ?", lastID).Where(eligible).OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return changed, err
+		}
+		for _, recipe := range recipes {
+			lastID = recipe.ID
+			stored, err := storeNutritionEstimate(recipe, factors)
+			if err != nil {
+				return changed, err
+			}
+			if stored {
+				changed++
+			}
+		}
+		if len(recipes) < batchSize {
+			return changed, nil
+		}
+	}
+}
+
+// storeNutritionEstimate writes the estimate for one recipe, or clears an
+// estimate that no longer holds, and reports whether the row changed.
+// Nutrition entered any other way is left alone.
+func storeNutritionEstimate(recipe Recipe, factors []nutritionFactor) (bool, error) {
+	var res sql.Result
+	var err error
+	if estimate := estimateNutrition(recipe, factors); estimate != nil {
+		res, err = db.Exec(`UPDATE recipes SET calories = ?, protein = ?, fat = ?, carbs = ?, fiber = ?, sodium = ?, nutrition_estimated = TRUE, nutrition_confidence = ?
+			WHERE id = ? AND (nutrition_estimated OR (calories IS NULL AND protein IS NULL AND fat IS NULL AND carbs IS NULL))`,
+			estimate.Calories, estimate.Protein, estimate.Fat, estimate.Carbs, estimate.Fiber, estimate.Sodium, estimate.Confidence, recipe.ID)
+	} else {
+		res, err = db.Exec(`UPDATE recipes SET calories = NULL, protein = NULL, fat = NULL, carbs = NULL, fiber = NULL, sodium = NULL, nutrition_estimated = FALSE, nutrition_confidence = NULL
+			WHERE id = ? AND nutrition_estimated`, recipe.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// GlycemicEstimate is a recipe's glycemic index and load per serving,
+// estimated from ingredient_nutrition. GL is the grams of available carbs
+// (carbs less fiber) weighted by each ingredient's GI over 100; the GI is
+// that weighting's average. A recipe with almost no available carbs has a
+// GL of 0 and no GI.
+type GlycemicEstimate struct {
+	Index *float64
+	Load  float64
+}
+
+// minGlycemicCarbs is the available carbs per serving below which a
+// recipe's GI is left unset.
+const minGlycemicCarbs = 1.0
+
+// estimateGlycemic needs minFactorCoverage of the measured lines matched,
+// as estimateNutrition does, and GIs for that share of the available carbs.
+func estimateGlycemic(recipe Recipe, factors []nutritionFactor) *GlycemicEstimate {
+	carbs, indexedCarbs, weighted := 0.0, 0.0, 0.0
+	measured, matched := 0, 0
+	for _, line := range recipe.Ingredients {
+		parsed := parseIngredientLine(line)
+		if parsed.Quantity <= 0 || parsed.Name == "" {
+			continue
+		}
+		measured++
+		for _, factor := range factors {
+			if !factor.pattern.MatchString(parsed.Name) {
+				continue
+			}
+			if grams, ok := ingredientGrams(parsed, factor); ok {
+				available := max(0, factor.Carbs-factor.Fiber) * grams / 100
+				carbs += available
+				if factor.GlycemicIndex != nil {
+					indexedCarbs += available
+					weighted += *factor.GlycemicIndex * available
+				}
+				matched++
+			}
+			break
+		}
+	}
+	if measured == 0 || float64(matched) < float64(measured)*minFactorCoverage {
+		return nil
+	}
+	if carbs > 0 && indexedCarbs < carbs*minFactorCoverage {
+		return nil
+	}
+
+	servings := 1.0
+	if recipe.Servings != nil && *recipe.Servings > 0 {
+		servings = float64(*recipe.Servings)
+	}
+	estimate := &GlycemicEstimate{}
+	if carbs/servings >= minGlycemicCarbs {
+		index := math.Round(weighted / indexedCarbs)
+		// Scale the GI-weighted carbs up to all available carbs, so
+		// unindexed lines count at the recipe's average GI.
+		estimate.Load = math.Round(index*carbs/100/servings*10) / 10
+		estimate.Index = &index
+	}
+	return estimate
+}
+
+// storeGlycemicEstimate writes the estimate for one recipe, or clears it
+// when there is none, and reports whether the row changed.
+func storeGlycemicEstimate(recipe Recipe, factors []nutritionFactor) (bool, error) {
+	return writeGlycemicEstimate(db, recipe, factors)
+}
+
+func writeGlycemicEstimate(q sqlExecutor, recipe Recipe, factors []nutritionFactor) (bool, error) {
+	var index, load *float64
+	if estimate := estimateGlycemic(recipe, factors); estimate != nil {
+		index, load = estimate.Index, &estimate.Load
+	}
+	res, err := q.Exec("UPDATE recipes SET glycemic_index = ?, glycemic_load = ? WHERE id = ? AND NOT (glycemic_index <=> ? AND glycemic_load <=> ?)",
+		index, load, recipe.ID, index, load)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// recomputeGlycemicEstimates re-estimates every recipe, or with onlyMissing
+// those without a glycemic load, and returns how many changed.
+func recomputeGlycemicEstimates(onlyMissing bool) (int, error) {
+	factors, err := nutritionFactors.get()
+	if err != nil {
+		return 0, err
+	}
+
+	const batchSize = 500
+	changed := 0
+	lastID := 0
+	for {
+		query := selectRecipes().Where("id > ?", lastID)
+		if onlyMissing {
+			query.Where("glycemic_load IS NULL")
+		}
+		recipes, err := query.OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return changed, err
+		}
+		for _, recipe := range recipes {
+			lastID = recipe.ID
+			stored, err := storeGlycemicEstimate(recipe, factors)
+			if err != nil {
+				return changed, err
+			}
+			if stored {
+				changed++
+			}
+		}
+		if len(recipes) < batchSize {
+			return changed, nil
+		}
+	}
+}
+
+// recomputeNutritionEstimatesAsync re-estimates after a nutrition change,
+// dropping the cached factors at once as recipeEstimate.recomputeAsync does.
+func recomputeNutritionEstimatesAsync() {
+	nutritionFactors.invalidate()
+	go func() {
+		if changed, err := recomputeNutritionEstimates(false); err != nil {
+			slog.Error("nutrition estimate recompute failed", "error", err)
+		} else {
+			slog.Info("nutrition estimates recomputed", "changed", changed)
+		}
+		if changed, err := recomputeGlycemicEstimates(false); err != nil {
+			slog.Error("glycemic estimate recompute failed", "error", err)
+		} else {
+			slog.Info("glycemic estimates recomputed", "changed", changed)
+		}
+	}()
+}
+
+// loadNutritionEstimate flags a recipe whose nutrition was estimated.
+func loadNutritionEstimate(recipe *Recipe) error {
+	err := db.QueryRow("SELECT nutrition_confidence FROM recipes WHERE id = ? AND nutrition_estimated", recipe.ID).Scan(&recipe.NutritionConfidence)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	recipe.NutritionEstimated = err == nil
+	return err
+}
+
+func listIngredientNutrition(c *gin.Context) {
+	factors, err := loadNutritionFactors()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sort.Slice(factors, func(i, j int) bool { return factors[i].Ingredient < factors[j].Ingredient })
+
+	nutrition := make([]IngredientNutrition, len(factors))
+	for i, factor := range factors {
+		nutrition[i] = factor.IngredientNutrition
+	}
+	c.JSON(http.StatusOK, gin.H{"nutrition": nutrition})
+}
+
+// putIngredientNutrition sets the per-100 g nutrition of :ingredient and
+// re-estimates recipes in the background.
+func putIngredientNutrition(c *gin.Context) {
+	ingredient := strings.Join(strings.Fields(strings.ToLower(c.Param("ingredient"))), " ")
+	var req PutIngredientNutritionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || ingredient == "" || len(ingredient) > 128 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	for _, value := range []*float64{req.Calories, req.Protein, req.Fat, req.Carbs, &req.Fiber, &req.Sodium} {
+		if *value < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "nutrition values must not be negative"})
+			return
+		}
+	}
+	if (req.GramsPerML != nil && *req.GramsPerML <= 0) || (req.GramsEach != nil && *req.GramsEach <= 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "grams_per_ml and grams_each must be positive"})
+		return
+	}
+	if req.GlycemicIndex != nil && (*req.GlycemicIndex < 0 || *req.GlycemicIndex > 150) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "glycemic_index must be between 0 and 150"})
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO ingredient_nutrition (ingredient, calories, protein, fat, carbs, fiber, sodium, grams_per_ml, grams_each, fdc_id, glycemic_index) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE calories = VALUES(calories), protein = VALUES(protein), fat = VALUES(fat), carbs = VALUES(carbs), fiber = VALUES(fiber), sodium = VALUES(sodium),
+			grams_per_ml = VALUES(grams_per_ml), grams_each = VALUES(grams_each), fdc_id = VALUES(fdc_id), glycemic_index = VALUES(glycemic_index), updated_at = NOW()`,
+		ingredient, *req.Calories, *req.Protein, *req.Fat, *req.Carbs, req.Fiber, req.Sodium, req.GramsPerML, req.GramsEach, req.FDCID, req.GlycemicIndex)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recomputeNutritionEstimatesAsync()
+
+	c.JSON(http.StatusOK, gin.H{"ingredient": ingredient, "updated": true})
+}
+
+func deleteIngredientNutrition(c *gin.Context) {
+	ingredient := strings.Join(strings.Fields(strings.ToLower(c.Param("ingredient"))), " ")
+	res, err := db.Exec("DELETE FROM ingredient_nutrition WHERE ingredient = ?", ingredient)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ingredient nutrition not found"})
+		return
+	}
+	recomputeNutritionEstimatesAsync()
+
+	c.JSON(http.StatusOK, gin.H{"ingredient": ingredient, "deleted": true})
+}
+
+// recomputeIngredientNutrition reruns the nutrition and glycemic estimates
+// synchronously.
+func recomputeIngredientNutrition(c *gin.Context) {
+	changed, err := recomputeNutritionEstimates(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "changed": changed})
+		return
+	}
+	glycemic, err := recomputeGlycemicEstimates(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "changed": changed, "glycemic_changed": glycemic})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": changed, "glycemic_changed": glycemic})
+}
+
+// Catalog statistics, for filter UIs. They are computed over the recipes
+// the tenant can see and kept for catalogStatsRefresh.
+const (
+	catalogStatsRefresh    = 15 * time.Minute
+	defaultIngredientStats = 50
+	maxIngredientStats     = 500
+)
+
+var statsPercentiles = []int{5, 25, 50, 75, 95}
+
+type IngredientCount struct {
+	Name    string `json:"name"`
+	Recipes int    `json:"recipes"`
+}
+
+// Distribution summarizes one nutrient across the recipes that have it.
+type Distribution struct {
+	Count       int                `json:"count"`
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Mean        float64            `json:"mean"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+type catalogStats struct {
+	recipes     int
+	ingredients []IngredientCount
+	nutrition   map[string]*Distribution
+	loadedAt    time.Time
+}
+
+// catalogStatsCache holds catalogStats per tenant, "" being the global
+// catalog.
+type catalogStatsCache struct {
+	mu      sync.Mutex
+	entries map[string]*catalogStats
+}
+
+var catalogStatistics = &catalogStatsCache{}
+
+func (s *catalogStatsCache) get(tenant *Tenant) (*catalogStats, error) {
+	key := ""
+	if tenant != nil {
+		key = tenant.ID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stats := s.entries[key]; stats != nil && time.Since(stats.loadedAt) < catalogStatsRefresh {
+		recordCacheLookup("catalog_stats", true)
+		return stats, nil
+	}
+	recordCacheLookup("catalog_stats", false)
+
+	stats, err := computeCatalogStats(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if s.entries == nil {
+		s.entries = map[string]*catalogStats{}
+	}
+	s.entries[key] = stats
+	return stats, nil
+}
+
+func (s *catalogStatsCache) invalidate() {
+	s.mu.Lock()
+	s.entries = nil
+	s.mu.Unlock()
+}
+
+// computeCatalogStats counts each ingredient once per recipe, folding
+// synonyms into the first term of their group, and collects every
+// nutrient's distribution.
+func computeCatalogStats(tenant *Tenant) (*catalogStats, error) {
+	condition, args := tenant.recipeScope()
+	rows, err := db.Query("SELECT ingredients, calories, protein, fat, carbs, fiber, sodium FROM recipes WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	synonyms := ingredientSynonyms.load()
+	counts := map[string]int{}
+	values := map[string][]float64{}
+	recipes := 0
+	for rows.Next() {
+		var ingredientsJSON string
+		var calories sql.NullInt64
+		var protein, fat, carbs, fiber, sodium sql.NullFloat64
+		if err := rows.Scan(&ingredientsJSON, &calories, &protein, &fat, &carbs, &fiber, &sodium); err != nil {
+			return nil, err
+		}
+		recipes++
+
+		var lines []string
+		json.Unmarshal([]byte(ingredientsJSON), &lines)
+		names := map[string]bool{}
+		for _, line := range lines {
+			name := parseIngredientLine(line).Name
+			if group := synonyms[name]; len(group) > 0 {
+				name = slices.Min(group)
+			}
+			if name != "" {
+				names[name] = true
+			}
+		}
+		for name := range names {
+			counts[name]++
+		}
+
+		if calories.Valid {
+			values["calories"] = append(values["calories"], float64(calories.Int64))
+		}
+		for nutrient, value := range map[string]sql.NullFloat64{"protein": protein, "fat": fat, "carbs": carbs, "fiber": fiber, "sodium": sodium} {
+			if value.Valid {
+				values[nutrient] = append(values[nutrient], value.Float64)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := &catalogStats{recipes: recipes, ingredients: []IngredientCount{}, nutrition: map[string]*Distribution{}, loadedAt: time.Now()}
+	for name, n := range counts {
+		stats.ingredients = append(stats.ingredients, IngredientCount{Name: name, Recipes: n})
+	}
+	sort.Slice(stats.ingredients, func(i, j int) bool {
+		a, b := stats.ingredients[i], stats.ingredients[j]
+		return a.Recipes > b.Recipes || a.Recipes == b.Recipes && a.Name < b.Name
+	})
+	for nutrient := range nutrientUnits {
+		stats.nutrition[nutrient] = distribution(values[nutrient])
+	}
+	return stats, nil
+}
+
+// distribution summarizes values, interpolating percentiles between the
+// nearest ranks. It is nil for no values.
+func distribution(values []float64) *Distribution {
+	if len(values) == 0 {
+		return nil
+	}
+	slices.Sort(values)
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	d := &Distribution{
+		Count:       len(values),
+		Min:         values[0],
+		Max:         values[len(values)-1],
+		Mean:        math.Round(sum/float64(len(values))*10) / 10,
+		Percentiles: map[string]float64{},
+	}
+	for _, p := range statsPercentiles {
+		rank := float64(p) / 100 * float64(len(values)-1)
+		low := int(rank)
+		value := values[low]
+		if low+1 < len(values) {
+			value += (rank - float64(low)) * (values[low+1] - value)
+		}
+		d.Percentiles[fmt.Sprintf("p%d", p)] = math.Round(value*10) / 10
+	}
+	return d
+}
+
+// getIngredientStats lists the most common ingredients with how many
+// recipes use each; ?limit= caps the list.
+func getIngredientStats(c *gin.Context) {
+	limit := defaultIngredientStats
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= maxIngredientStats {
+		limit = val
+	}
+	stats, err := catalogStatistics.get(tenantFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ingredients := stats.ingredients
+	if len(ingredients) > limit {
+		ingredients = ingredients[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"ingredients": ingredients, "count": len(ingredients), "total_ingredients": len(stats.ingredients), "recipes": stats.recipes})
+}
+
+// getNutritionStats reports the distribution of each nutrient per serving
+// across the catalog.
+func getNutritionStats(c *gin.Context) {
+	stats, err := catalogStatistics.get(tenantFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nutrition": stats.nutrition, "units": nutrientUnits, "recipes": stats.recipes})
+}
+
+// maxExcludeIDs bounds exclude_ids so the NOT IN list stays reasonable.
+const maxExcludeIDs = 500
+
+var hiddenRecipeReasons = []string{"cooked", "disliked"}
+
+// parseIDList reads a comma-separated list of recipe IDs.
+func parseIDList(raw string) ([]int, error) {
+	ids := []int{}
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid recipe ID %q in exclude_ids", part)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > maxExcludeIDs {
+		return nil, fmt.Errorf("exclude_ids may list at most %d recipes", maxExcludeIDs)
+	}
+	return ids, nil
+}
+
+// excludeRecipesSQL drops the given IDs and, when owner is set, every recipe
+// that owner has hidden or cooked within repeatWindow.
+func excludeRecipesSQL(ids []int, owner string) (string, []interface{}) {
+	query := ""
+	args := []interface{}{}
+	if len(ids) > 0 {
+		placeholders := make([]string, len(ids))
+		for i, id := range ids {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		query += " AND id NOT IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	if owner != "" {
+		query += " AND id NOT IN (SELECT recipe_id FROM hidden_recipes WHERE owner = ?)" +
+			" AND id NOT IN (SELECT recipe_id FROM recipe_history WHERE owner = ? AND event = ? AND created_at >= ?)"
+		args = append(args, owner, owner, historyCooked, time.Now().Add(-repeatWindow).UTC())
+	}
+	return query, args
+}
+
+type HideRecipeRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// hideRecipe marks a recipe as cooked or disliked for the calling API key,
+// so searches and meal plans with exclude_hidden skip it. Hiding again
+// updates the reason.
+func hideRecipe(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+	var req HideRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !slices.Contains(hiddenRecipeReasons, req.Reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be cooked or disliked"})
+		return
+	}
+
+	exists, err := recipeVisible(tenantFromContext(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	if _, err := db.Exec("INSERT INTO hidden_recipes (owner, recipe_id, reason) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE reason = VALUES(reason)", owner, id, req.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "hidden": true, "reason": req.Reason})
+}
+
+func unhideRecipe(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM hidden_recipes WHERE owner = ? AND recipe_id = ?", owner, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe is not hidden"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "hidden": false})
+}
+
+// listHiddenRecipes returns the caller's hidden recipe IDs, optionally for
+// one ?reason=.
+func listHiddenRecipes(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	query := "SELECT recipe_id, reason, created_at FROM hidden_recipes WHERE owner = ?"
+	args := []interface{}{owner}
+	if reason := c.Query("reason"); reason != "" {
+		if !slices.Contains(hiddenRecipeReasons, reason) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be cooked or disliked"})
+			return
+		}
+		query += " AND reason = ?"
+		args = append(args, reason)
+	}
+
+	rows, err := db.Query(query+" ORDER BY created_at DESC", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	hidden := []gin.H{}
+	for rows.Next() {
+		var id int
+		var reason string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &reason, &createdAt); err != nil {
+			continue
+		}
+		hidden = append(hidden, gin.H{"id": id, "reason": reason, "hidden_at": createdAt})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recipes": hidden, "count": len(hidden)})
+}
+
+// History. Recipe views by callers with an API key are recorded, as are
+// the recipes they report cooking. The history feeds recommendations, and
+// exclude_hidden skips anything cooked within repeatWindow.
+const (
+	historyViewed = "viewed"
+	historyCooked = "cooked"
+
+	// viewDedupWindow folds repeated views of a recipe into one event.
+	viewDedupWindow = 30 * time.Minute
+	// repeatWindow is how long a cooked recipe stays out of searches and
+	// plans with exclude_hidden.
+	repeatWindow = 14 * 24 * time.Hour
+	// historyProfileWindow and historyProfileRecipes bound the history
+	// recommendations are drawn from.
+	historyProfileWindow  = 90 * 24 * time.Hour
+	historyProfileRecipes = 50
+	// recommendationPool is how many top-rated candidates are scored.
+	recommendationPool = 500
+)
+
+var historyEvents = []string{historyViewed, historyCooked}
+
+type HistoryEntry struct {
+	ID         int64     `json:"id"`
+	RecipeID   int       `json:"recipe_id"`
+	RecipeName string    `json:"recipe_name"`
+	Event      string    `json:"event"`
+	At         time.Time `json:"at"`
+}
+
+type CookedRequest struct {
+	// CookedAt backdates the event; it defaults to now.
+	CookedAt *time.Time `json:"cooked_at"`
+}
+
+// recordRecipeView counts a view of a recipe and adds it to the caller's
+// history. Anonymous callers have no history, so each of their views
+// counts; a keyed caller's repeat views within viewDedupWindow count once.
+// Views answered by a CDN never get here. A failure only costs the event.
+func recordRecipeView(c *gin.Context, id int) {
+	if c.GetBool(snapshotRenderKey) {
+		return
+	}
+	counted := true
+	if c.GetHeader("X-API-Key") != "" {
+		owner := apiKeyID(c)
+		res, err := db.Exec(`INSERT INTO recipe_history (owner, recipe_id, event)
+			SELECT ?, ?, ? FROM DUAL WHERE NOT EXISTS (
+				SELECT 1 FROM recipe_history WHERE owner = ? AND recipe_id = ? AND event = ? AND created_at >= ?)`,
+			owner, id, historyViewed, owner, id, historyViewed, time.Now().Add(-viewDedupWindow).UTC())
+		if err != nil {
+			requestLogger(c).Warn("view not recorded", "recipe_id", id, "error", err)
+			return
+		}
+		n, _ := res.RowsAffected()
+		counted = n > 0
+	}
+	if counted {
+		if _, err := db.Exec("UPDATE recipes SET views = views + 1 WHERE id = ?", id); err != nil {
+			requestLogger(c).Warn("view not counted", "recipe_id", id, "error", err)
+		}
+	}
+}
+
+// madeDedupWindow is how long a caller's repeat "made it" events for a
+// recipe count once.
+const madeDedupWindow = 24 * time.Hour
+
+// countRecipeMade adds one to a recipe's times_made unless the caller
+// already made it within madeDedupWindow. Callers are issued keys or, for
+// any other key, their IP, so rotating made-up keys doesn't inflate the
+// count. It reports whether the event counted.
+func countRecipeMade(c *gin.Context, id int) (bool, error) {
+	caller, _ := verifiedCallerID(c)
+	// recipe_made keeps each caller's latest counted event. On duplicate
+	// keys MySQL reports 2 rows affected when made_at moved and 0 when the
+	// row was left alone.
+	res, err := db.Exec(`INSERT INTO recipe_made (recipe_id, caller, made_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE made_at = IF(made_at < ?, VALUES(made_at), made_at)`,
+		id, hashToken(caller)[:32], time.Now().UTC(), time.Now().Add(-madeDedupWindow).UTC())
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	_, err = db.Exec("UPDATE recipes SET times_made = times_made + 1 WHERE id = ?", id)
+	return err == nil, err
+}
+
+// markMade records a "made it" event. Unlike markCooked it needs no API
+// key and keeps no history; it only feeds the counter behind
+// sort_by=times_made.
+func markMade(c *gin.Context) {
+	id, ok := visibleRecipeID(c)
+	if !ok {
+		return
+	}
+	counted, err := countRecipeMade(c, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var timesMade int
+	if err := db.QueryRow("SELECT times_made FROM recipes WHERE id = ?", id).Scan(&timesMade); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recipe_id": id, "times_made": timesMade, "counted": counted})
+}
+
+// Featured recipes are editor's picks for a named slot of a client page,
+// such as "home". Each entry may be scheduled: it shows from StartsAt until
+// EndsAt, either of which may be left open.
+const defaultFeaturedSlot = "home"
+
+var featuredSlotPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+type FeaturedEntry struct {
+	ID        int        `json:"id"`
+	RecipeID  int        `json:"recipe_id"`
+	Slot      string     `json:"slot"`
+	Position  int        `json:"position"`
+	Headline  string     `json:"headline"`
+	StartsAt  *time.Time `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at"`
+	CreatedBy string     `json:"created_by"`
+	// Status is scheduled, active or expired, as of the request.
+	Status string  `json:"status"`
+	Recipe *Recipe `json:"recipe,omitempty"`
+}
+
+type FeaturedRequest struct {
+	RecipeID int        `json:"recipe_id" binding:"required"`
+	Slot     string     `json:"slot"`
+	Position int        `json:"position"`
+	Headline string     `json:"headline"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+}
+
+// validate fills the default slot and lists what is wrong with the entry.
+func (req *FeaturedRequest) validate() []string {
+	problems := []string{}
+	req.Slot = cmp.Or(strings.TrimSpace(req.Slot), defaultFeaturedSlot)
+	if !featuredSlotPattern.MatchString(req.Slot) {
+		problems = append(problems, "slot must be 1-32 lowercase letters, digits, dashes or underscores")
+	}
+	if len(req.Headline) > 200 {
+		problems = append(problems, "headline must be at most 200 characters")
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && !req.EndsAt.After(*req.StartsAt) {
+		problems = append(problems, "ends_at must be after starts_at")
+	}
+	return problems
+}
+
+// activeFeaturedSQL is the condition for entries showing at a given time,
+// bound twice.
+const activeFeaturedSQL = "(starts_at IS NULL OR starts_at <= ?) AND (ends_at IS NULL OR ends_at > ?)"
+
+const featuredColumns = "id, recipe_id, slot, position, headline, starts_at, ends_at, created_by"
+
+func scanFeaturedEntry(row interface{ Scan(...interface{}) error }, now time.Time) (FeaturedEntry, error) {
+	var entry FeaturedEntry
+	var startsAt, endsAt sql.NullTime
+	if err := row.Scan(&entry.ID, &entry.RecipeID, &entry.Slot, &entry.Position, &entry.Headline, &startsAt, &endsAt, &entry.CreatedBy); err != nil {
+		return entry, err
+	}
+	entry.Status = "active"
+	if startsAt.Valid {
+		entry.StartsAt = &startsAt.Time
+		if startsAt.Time.After(now) {
+			entry.Status = "scheduled"
+		}
+	}
+	if endsAt.Valid {
+		entry.EndsAt = &endsAt.Time
+		if !endsAt.Time.After(now) {
+			entry.Status = "expired"
+		}
+	}
+	return entry, nil
+}
+
+// getFeaturedRecipes lists the entries of a ?slot= (home by default)
+// showing now, by position, each with its recipe. Entries whose recipe
+// the caller can't see are left out.
+func getFeaturedRecipes(c *gin.Context) {
+	slot := c.DefaultQuery("slot", defaultFeaturedSlot)
+	if !featuredSlotPattern.MatchString(slot) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot"})
+		return
+	}
+	now := time.Now().UTC()
+
+	recipes, err := selectRecipes().
+		Where("id IN (SELECT recipe_id FROM featured_recipes WHERE slot = ? AND "+activeFeaturedSQL+")", slot, now, now).
+		Visible(tenantFromContext(c)).Prepared().All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	byID := map[int]*Recipe{}
+	for i := range recipes {
+		byID[recipes[i].ID] = &recipes[i]
+	}
+
+	rows, err := db.Query("SELECT "+featuredColumns+" FROM featured_recipes WHERE slot = ? AND "+activeFeaturedSQL+" ORDER BY position, id", slot, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	featured := []FeaturedEntry{}
+	for rows.Next() {
+		entry, err := scanFeaturedEntry(rows, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// A recipe featured twice in a slot is shown once, at its first
+		// position.
+		if recipe := byID[entry.RecipeID]; recipe != nil {
+			entry.Recipe = recipe
+			featured = append(featured, entry)
+			delete(byID, entry.RecipeID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"slot": slot, "featured": featured, "count": len(featured)})
+}
+
+// listFeatured lists every entry, including scheduled and expired ones,
+// optionally for one ?slot=.
+func listFeatured(c *gin.Context) {
+	query := "SELECT " + featuredColumns + " FROM featured_recipes"
+	args := []interface{}{}
+	if slot := c.Query("slot"); slot != "" {
+		query += " WHERE slot = ?"
+		args = append(args, slot)
+	}
+	rows, err := db.Query(query+" ORDER BY slot, position, id", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	entries := []FeaturedEntry{}
+	for rows.Next() {
+		entry, err := scanFeaturedEntry(rows, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"featured": entries, "count": len(entries)})
+}
+
+// bindFeaturedRequest reads and validates an entry, answering the request
+// itself when it is invalid or its recipe isn't published.
+func bindFeaturedRequest(c *gin.Context) (FeaturedRequest, bool) {
+	var req FeaturedRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return req, false
+	}
+	if problems := req.validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid featured entry", "problems": problems})
+		return req, false
+	}
+	var published bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ? AND "+publishedRecipe+")", req.RecipeID).Scan(&published); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return req, false
+	}
+	if !published {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
+		return req, false
+	}
+	return req, true
+}
+
+// writeFeaturedEntry answers with an entry as stored.
+func writeFeaturedEntry(c *gin.Context, status, id int) {
+	entry, err := scanFeaturedEntry(db.QueryRow("SELECT "+featuredColumns+" FROM featured_recipes WHERE id = ?", id), time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, entry)
+}
+
+func createFeatured(c *gin.Context) {
+	req, ok := bindFeaturedRequest(c)
+	if !ok {
+		return
+	}
+	res, err := db.Exec("INSERT INTO featured_recipes (recipe_id, slot, position, headline, starts_at, ends_at, created_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		req.RecipeID, req.Slot, req.Position, req.Headline, req.StartsAt, req.EndsAt, adminFromContext(c).Subject)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	id, _ := res.LastInsertId()
+	requestLogger(c).Info("recipe featured", "featured_id", id, "recipe_id", req.RecipeID, "slot", req.Slot, "by", adminFromContext(c).Subject)
+	writeFeaturedEntry(c, http.StatusCreated, int(id))
+}
+
+// updateFeatured replaces an entry, which is also how it is rescheduled.
+func updateFeatured(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid featured ID"})
+		return
+	}
+	req, ok := bindFeaturedRequest(c)
+	if !ok {
+		return
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM featured_recipes WHERE id = ?)", id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Featured entry not found"})
+		return
+	}
+	if _, err := db.Exec("UPDATE featured_recipes SET recipe_id = ?, slot = ?, position = ?, headline = ?, starts_at = ?, ends_at = ? WHERE id = ?",
+		req.RecipeID, req.Slot, req.Position, req.Headline, req.StartsAt, req.EndsAt, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeFeaturedEntry(c, http.StatusOK, id)
+}
+
+func deleteFeatured(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid featured ID"})
+		return
+	}
+	res, err := db.Exec("DELETE FROM featured_recipes WHERE id = ?", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Featured entry not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+// Collections are editor-curated, public lists of recipes on a theme, such
+// as "30-minute weeknight dinners", addressed by slug. Unpublished ones are
+// drafts only admins see.
+var collectionSlugPattern = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+const maxCollectionRecipes = 200
+
+type Collection struct {
+	Slug        string    `json:"slug"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	CoverImage  string    `json:"cover_image"`
+	Published   bool      `json:"published"`
+	RecipeCount int       `json:"recipe_count"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type PutCollectionRequest struct {
+	Title       string `json:"title" binding:"required"`
+	Description string `json:"description"`
+	// CoverImage defaults to the image of the first recipe.
+	CoverImage string `json:"cover_image"`
+	Published  *bool  `json:"published"`
+	// RecipeIDs are the recipes in display order.
+	RecipeIDs []int `json:"recipe_ids"`
+}
+
+// collectionSQL selects collections with the number of their recipes the
+// tenant may see, and a cover falling back to the first such recipe's
+// image. Its arguments are the scope's, twice.
+func collectionSQL(tenant *Tenant) (string, []interface{}) {
+	scope, args := tenant.recipeScope()
+	visible := "SELECT id FROM recipes WHERE " + scope
+	query := `SELECT c.slug, c.title, c.description,
+		COALESCE(NULLIF(c.cover_image, ''), (SELECT image FROM recipes WHERE id = (
+			SELECT cr.recipe_id FROM collection_recipes cr
+			WHERE cr.collection_id = c.id AND cr.recipe_id IN (` + visible + `) ORDER BY cr.position LIMIT 1)), ''),
+		c.published,
+		(SELECT COUNT(*) FROM collection_recipes cr WHERE cr.collection_id = c.id AND cr.recipe_id IN (` + visible + `)),
+		c.updated_at
+		FROM collections c`
+	return query, append(slices.Clone(args), args...)
+}
+
+func scanCollection(row interface{ Scan(...interface{}) error }) (Collection, error) {
+	var collection Collection
+	err := row.Scan(&collection.Slug, &collection.Title, &collection.Description, &collection.CoverImage, &collection.Published, &collection.RecipeCount, &collection.UpdatedAt)
+	return collection, err
+}
+
+// queryCollections runs a collectionSQL query.
+func queryCollections(query string, args ...interface{}) ([]Collection, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	collections := []Collection{}
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	return collections, rows.Err()
+}
+
+// listCollections pages through the published collections, most recently
+// updated first.
+func listCollections(c *gin.Context) {
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM collections WHERE published").Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	query, args := collectionSQL(tenantFromContext(c))
+	collections, err := queryCollections(query+" WHERE c.published ORDER BY c.updated_at DESC, c.id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"collections": collections, "count": len(collections), "total": total, "limit": limit, "offset": offset})
+}
+
+// getCollection returns a published collection with a page of its
+// recipes, in the curated order.
+func getCollection(c *gin.Context) {
+	tenant := tenantFromContext(c)
+	query, args := collectionSQL(tenant)
+	collection, err := scanCollection(db.QueryRow(query+" WHERE c.slug = ? AND c.published", append(args, c.Param("slug"))...))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+	scope, scopeArgs := tenant.recipeScope()
+	rows, err := db.Query(`SELECT cr.recipe_id FROM collection_recipes cr JOIN collections c ON c.id = cr.collection_id
+		WHERE c.slug = ? AND cr.recipe_id IN (SELECT id FROM recipes WHERE `+scope+`)
+		ORDER BY cr.position LIMIT ? OFFSET ?`, append(append([]interface{}{collection.Slug}, scopeArgs...), limit, offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	recipes := []Recipe{}
+	if len(ids) > 0 {
+		placeholders := make([]string, len(ids))
+		idArgs := make([]interface{}, len(ids))
+		for i, id := range ids {
+			placeholders[i] = "?"
+			idArgs[i] = id
+		}
+		found, err := selectRecipes().Where("id IN ("+strings.Join(placeholders, ", ")+")", idArgs...).All()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sort.Slice(found, func(i, j int) bool { return slices.Index(ids, found[i].ID) < slices.Index(ids, found[j].ID) })
+		recipes = found
+	}
+
+	c.JSON(http.StatusOK, gin.H{"collection": collection, "recipes": recipes, "count": len(recipes), "limit": limit, "offset": offset})
+}
+
+// listAdminCollections lists every collection, drafts included, with
+// recipe counts over the global catalog.
+func listAdminCollections(c *gin.Context) {
+	query, args := collectionSQL(nil)
+	collections, err := queryCollections(query+" ORDER BY c.slug", args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"collections": collections, "count": len(collections)})
+}
+
+// putCollection creates or replaces a collection, including its recipes
+// and their order. Collections are published unless published is false.
+func putCollection(c *gin.Context) {
+	slug := c.Param("slug")
+	var req PutCollectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	problems := []string{}
+	if len(slug) > 64 || !collectionSlugPattern.MatchString(slug) {
+		problems = append(problems, "slug must be lowercase words of letters and digits joined by dashes, at most 64 characters")
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" || len(req.Title) > 200 {
+		problems = append(problems, "title must be 1-200 characters")
+	}
+	if req.CoverImage != "" && !strings.HasPrefix(req.CoverImage, "https://") && !strings.HasPrefix(req.CoverImage, "http://") && !strings.HasPrefix(req.CoverImage, "/") {
+		problems = append(problems, "cover_image must be a URL or an absolute path")
+	}
+	if len(req.RecipeIDs) > maxCollectionRecipes {
+		problems = append(problems, fmt.Sprintf("a collection holds at most %d recipes", maxCollectionRecipes))
+	}
+	seen := map[int]bool{}
+	for _, id := range req.RecipeIDs {
+		if seen[id] {
+			problems = append(problems, fmt.Sprintf("recipe %d is listed more than once", id))
+		}
+		seen[id] = true
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection", "problems": problems})
+		return
+	}
+
+	missing := []int{}
+	for _, id := range req.RecipeIDs {
+		var published bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes WHERE id = ? AND "+publishedRecipe+")", id).Scan(&published); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !published {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some recipes are not published", "recipe_ids": missing})
+		return
+	}
+	published := req.Published == nil || *req.Published
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO collections (slug, title, description, cover_image, published, created_by) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE title = VALUES(title), description = VALUES(description), cover_image = VALUES(cover_image),
+			published = VALUES(published), updated_at = CURRENT_TIMESTAMP`,
+		slug, req.Title, req.Description, req.CoverImage, published, adminFromContext(c).Subject); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var id int
+	if err := tx.QueryRow("SELECT id FROM collections WHERE slug = ?", slug).Scan(&id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM collection_recipes WHERE collection_id = ?", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for position, recipeID := range req.RecipeIDs {
+		if _, err := tx.Exec("INSERT INTO collection_recipes (collection_id, recipe_id, position) VALUES (?, ?, ?)", id, recipeID, position); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	requestLogger(c).Info("collection saved", "slug", slug, "recipes", len(req.RecipeIDs), "by", adminFromContext(c).Subject)
+
+	query, args := collectionSQL(nil)
+	collection, err := scanCollection(db.QueryRow(query+" WHERE c.slug = ?", append(args, slug)...))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"collection": collection, "recipe_ids": req.RecipeIDs})
+}
+
+func deleteCollection(c *gin.Context) {
+	slug := c.Param("slug")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	var id int
+	err = tx.QueryRow("SELECT id FROM collections WHERE slug = ?", slug).Scan(&id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, query := range []string{"DELETE FROM collection_recipes WHERE collection_id = ?", "DELETE FROM collections WHERE id = ?"} {
+		if _, err := tx.Exec(query, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"slug": slug, "deleted": true})
+}
+
+// markCooked records that the caller cooked a recipe, which also counts
+// as making it.
+func markCooked(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, ok := visibleRecipeID(c)
+	if !ok {
+		return
+	}
+	var req CookedRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+	cookedAt := time.Now()
+	if req.CookedAt != nil {
+		if req.CookedAt.After(cookedAt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cooked_at must not be in the future"})
+			return
+		}
+		cookedAt = *req.CookedAt
+	}
+
+	res, err := db.Exec("INSERT INTO recipe_history (owner, recipe_id, event, created_at) VALUES (?, ?, ?, ?)", owner, id, historyCooked, cookedAt.UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := countRecipeMade(c, id); err != nil {
+		requestLogger(c).Warn("made event not counted", "recipe_id", id, "error", err)
+	}
+	entryID, _ := res.LastInsertId()
+	c.JSON(http.StatusCreated, gin.H{"id": entryID, "recipe_id": id, "event": historyCooked, "at": cookedAt})
+}
+
+// getHistory lists the caller's history newest first, optionally for one
+// ?event= and between ?from= and ?to= (inclusive dates in tz).
+func getHistory(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	loc, ok := requestLocation(c)
+	if !ok {
+		return
+	}
+	query := `SELECT h.id, h.recipe_id, r.name, h.event, h.created_at
+		FROM recipe_history h JOIN recipes r ON r.id = h.recipe_id
+		WHERE h.owner = ?`
+	args := []interface{}{owner}
+	if event := c.Query("event"); event != "" {
+		if !slices.Contains(historyEvents, event) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "event must be viewed or cooked"})
+			return
+		}
+		query += " AND h.event = ?"
+		args = append(args, event)
+	}
+	for _, param := range []struct {
+		name, condition string
+		days            int
+	}{{"from", " AND h.created_at >= ?", 0}, {"to", " AND h.created_at < ?", 1}} {
+		if raw := c.Query(param.name); raw != "" {
+			date, err := time.ParseInLocation(time.DateOnly, raw, loc)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param.name + " must be a date like 2024-01-15"})
+				return
+			}
+			query += param.condition
+			args = append(args, date.AddDate(0, 0, param.days).UTC())
+		}
+	}
+
+	limit := cfg.Search.DefaultLimit
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.Query("offset")); err == nil && val > 0 {
+		offset = val
+	}
+	query += " ORDER BY h.created_at DESC, h.id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-	
-	var recipes []Recipe
-	for rows.Next() {
-		var recipe Recipe
-		var ingredientsJSON, instructionsJSON string
-		
-		err := rows.Scan(&recipe.ID, &recipe.Name, &recipe.Description, &recipe.Image,
-			&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes, &recipe.TotalTimeMinutes,
-			&recipe.Servings, &recipe.Rating, &ingredientsJSON, &instructionsJSON,
-			&recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium)
-		
+	defer rows.Close()
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		if err := rows.Scan(&entry.ID, &entry.RecipeID, &entry.RecipeName, &entry.Event, &entry.At); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entry.At = entry.At.In(loc)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"history": entries, "count": len(entries), "limit": limit, "offset": offset})
+}
+
+func deleteHistoryEntry(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid history entry ID"})
+		return
+	}
+	res, err := db.Exec("DELETE FROM recipe_history WHERE id = ? AND owner = ?", id, owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "History entry not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+// historyProfile weighs the recipes in the caller's recent history, a
+// cook counting three views.
+func historyProfile(owner string) (map[int]float64, error) {
+	rows, err := db.Query(`SELECT recipe_id, SUM(IF(event = ?, 3, 1)) FROM recipe_history
+		WHERE owner = ? AND created_at >= ?
+		GROUP BY recipe_id ORDER BY MAX(created_at) DESC LIMIT ?`,
+		historyCooked, owner, time.Now().Add(-historyProfileWindow).UTC(), historyProfileRecipes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	weights := map[int]float64{}
+	for rows.Next() {
+		var id int
+		var weight float64
+		if err := rows.Scan(&id, &weight); err != nil {
+			return nil, err
+		}
+		weights[id] = weight
+	}
+	return weights, rows.Err()
+}
+
+// recommendRecipes suggests recipes sharing ingredients with what the
+// caller has cooked and viewed lately, plus a little for rating. Recipes
+// already in that history, hidden or cooked within repeatWindow are left
+// out; with no history the best rated come first.
+func recommendRecipes(c *gin.Context) {
+	owner, ok := apiKeyOwner(c)
+	if !ok {
+		return
+	}
+	limit := 10
+	if val, err := strconv.Atoi(c.Query("limit")); err == nil && val >= 1 && val <= cfg.Search.MaxLimit {
+		limit = val
+	}
+	tenant := tenantFromContext(c)
+
+	weights, err := historyProfile(owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	profile := map[string]float64{}
+	if len(weights) > 0 {
+		seen := sortedKeys(weights)
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(seen)), ",")
+		args := make([]interface{}, len(seen))
+		for i, id := range seen {
+			args[i] = id
+		}
+		history, err := selectRecipes().Where("id IN ("+placeholders+")", args...).All()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, recipe := range history {
+			for name := range ingredientNames(recipe) {
+				profile[name] += weights[recipe.ID]
+			}
+		}
+	}
+
+	query := selectRecipes().Visible(tenant)
+	if condition, args := excludeRecipesSQL(sortedKeys(weights), owner); condition != "" {
+		query.Where(strings.TrimPrefix(condition, " AND "), args...)
+	}
+	candidates, err := query.OrderBy("rating DESC, id").Limit(recommendationPool).All()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	total := 0.0
+	for _, weight := range profile {
+		total += weight
+	}
+	scores := make(map[int]float64, len(candidates))
+	for _, recipe := range candidates {
+		score := 0.0
+		if total > 0 {
+			for name := range ingredientNames(recipe) {
+				score += profile[name]
+			}
+			score /= total
+		}
+		if recipe.Rating != nil {
+			score += *recipe.Rating / 50
+		}
+		scores[recipe.ID] = score
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return scores[candidates[i].ID] > scores[candidates[j].ID] })
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"recipes": candidates, "count": len(candidates), "history_recipes": len(weights)})
+}
+
+func setupRoutes() *gin.Engine {
+	r := gin.New()
+	r.Use(loggingMiddleware(), gin.Recovery(), metricsMiddleware())
+	
+	r.Use(func(c *gin.Context) {
+		if origin := allowedCORSOrigin(c.GetHeader("Origin")); origin != "" {
+			c.Header("Access-Control-Allow-Origin", origin)
+			if origin != "*" {
+				c.Header("Vary", "Origin")
+			}
+		}
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, Mcp-Session-Id, MCP-Protocol-Version, X-Request-ID")
+		c.Header("Access-Control-Expose-Headers", "Mcp-Session-Id, X-Request-ID")
+		
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+		
+		c.Next()
+	})
+	
+	r.GET("/metrics", handleMetrics)
+	r.Use(requireDB(), resolveTenant())
+
+	// MCP Server endpoint
+	r.POST("/mcp", requireMCPToken(), handleMCPRequest)
+	r.GET("/mcp", requireMCPToken(), handleMCPStream)
+	r.DELETE("/mcp", requireMCPToken(), handleMCPDelete)
+	r.GET("/r/:token", getShareLink)
+	r.GET("/api/cron/:task", runCronTask)
+	
+	// Original API endpoints
+	api := r.Group("/api", negotiateEncoding(), formatForLocale(), localizeResponses(), meterUsage(), cacheControl(), serveSnapshots())
+	{
+		api.GET("/recipes/search", searchRecipes)
+		api.POST("/recipes/search-by-image", searchByImage)
+		api.POST("/recipes/import-image", importRecipeImage)
+		api.POST("/recipes/parse-text", parseRecipeText)
+		api.GET("/recipes/use-up", useUpRecipes)
+		api.GET("/recipes/filter-bounds", getFilterBounds)
+		api.GET("/recipes/featured", getFeaturedRecipes)
+		api.GET("/collections", listCollections)
+		api.GET("/collections/:slug", getCollection)
+		api.GET("/stats/ingredients", getIngredientStats)
+		api.GET("/stats/nutrition", getNutritionStats)
+		api.POST("/search/clicks", recordSearchClick)
+		api.POST("/recipes/generate", auditLog(), generateRecipe)
+		api.POST("/meal-plans", createMealPlan)
+		api.POST("/meal-plans/generate", generateMealPlan)
+		api.POST("/meal-plans/batch", createBatchPlan)
+		api.POST("/day-plan", createDayPlan)
+		api.GET("/shopping-list", getShoppingList)
+		api.POST("/shopping-list", createShoppingList)
+		api.POST("/shopping-list/cart", createRetailerCart)
+		api.GET("/shopping-list/qr.png", getShoppingListQR)
+		api.POST("/nutrition/summary", createNutritionSummary)
+		api.POST("/party-plans", createPartyPlan)
+		api.GET("/menus/generate", generateOccasionMenu)
+		api.POST("/cook-plan", createCookPlan)
+		api.GET("/recipe/:id", getRecipeByID)
+		api.POST("/recipe/:id/ask", askRecipe)
+		api.GET("/recipe/:id/pairings", getRecipePairings)
+		api.GET("/recipe/:id/menu", getRecipeMenu)
+		api.GET("/recipe/:id/steps", getRecipeSteps)
+		api.POST("/recipe/:id/share", createShareLink)
+		api.POST("/recipe/:id/report", reportRecipe)
+		api.GET("/recipe/:id/comments", listComments)
+		api.GET("/recipe/:id/comments/:commentId/replies", listReplies)
+		api.POST("/recipe/:id/comments", createComment)
+		api.PUT("/recipe/:id/comments/:commentId", updateComment)
+		api.DELETE("/recipe/:id/comments/:commentId", deleteComment)
+		api.PUT("/recipe/:id/rating", rateRecipe)
+		api.DELETE("/recipe/:id/rating", unrateRecipe)
+		api.GET("/recipe/:id/qr.png", getRecipeQR)
+		api.GET("/recipe/:id/placeholder.svg", getRecipePlaceholder)
+		api.GET("/recipe/:id/nutrition-label", getNutritionLabel)
+		api.GET("/images/*key", serveImage)
+		api.POST("/recipe/:id/image", auditLog(), requireAdmin(), requirePermission(permRecipesWrite), uploadRecipeImage)
+		api.POST("/recipe/:id/images", auditLog(), requireAdmin(), requirePermission(permRecipesWrite), createRecipeImage)
+		api.PUT("/recipe/:id/images/order", auditLog(), requireAdmin(), requirePermission(permRecipesWrite), reorderRecipeImages)
+		api.PUT("/recipe/:id/images/:imageId", auditLog(), requireAdmin(), requirePermission(permRecipesWrite), updateRecipeImage)
+		api.DELETE("/recipe/:id/images/:imageId", auditLog(), requireAdmin(), requirePermission(permRecipesWrite), deleteRecipeImage)
+		api.GET("/diet-plans", getDietPlans)
+		api.GET("/saved-searches", listSavedSearches)
+		api.POST("/saved-searches", createSavedSearch)
+		api.GET("/saved-searches/confirm", confirmSavedSearchEmail)
+		api.DELETE("/saved-searches/:id", deleteSavedSearch)
+		api.GET("/users/me/diary", listDiary)
+		api.POST("/users/me/diary", createDiaryEntry)
+		api.GET("/users/me/diary/summary", getDiarySummary)
+		api.GET("/users/me/diary/export", exportDiary)
+		api.PUT("/users/me/diary/:id", updateDiaryEntry)
+		api.DELETE("/users/me/diary/:id", deleteDiaryEntry)
+		api.GET("/users/me/reports/weekly", getWeeklyReport)
+		api.POST("/users/me/reports/weekly/email", emailWeeklyReport)
+		api.GET("/users/me/targets", getNutritionTargets)
+		api.PUT("/users/me/targets", putNutritionTargets)
+		api.DELETE("/users/me/targets", deleteNutritionTargets)
+		api.GET("/users/me/recipes", listSubmissions)
+		api.POST("/users/me/recipes", auditLog(), createSubmission)
+		api.GET("/users/me/recipes/:id", getSubmission)
+		api.PUT("/users/me/recipes/:id", auditLog(), updateSubmission)
+		api.POST("/users/me/recipes/:id/image", uploadSubmissionImage)
+		api.GET("/hidden-recipes", listHiddenRecipes)
+		api.PUT("/hidden-recipes/:id", hideRecipe)
+		api.DELETE("/hidden-recipes/:id", unhideRecipe)
+		api.POST("/recipe/:id/cooked", markCooked)
+		api.POST("/recipe/:id/made", markMade)
+		api.GET("/users/me/history", getHistory)
+		api.DELETE("/users/me/history/:id", deleteHistoryEntry)
+		api.GET("/users/me/recommendations", recommendRecipes)
+		api.GET("/users/me/cook-sessions", listCookSessions)
+		api.POST("/users/me/cook-sessions", startCookSession)
+		api.GET("/users/me/cook-sessions/:id", getCookSession)
+		api.PUT("/users/me/cook-sessions/:id/steps/:step", updateCookStep)
+		api.POST("/users/me/cook-sessions/:id/timers", startCookTimer)
+		api.DELETE("/users/me/cook-sessions/:id/timers/:timerId", cancelCookTimer)
+		api.POST("/users/me/cook-sessions/:id/finish", finishCookSession)
+		r.POST("/chat", handleChat)
+		api.GET("/warmup", warmup)
+		api.GET("/usage", getUsage)
+		api.GET("/features", getFeatures)
+		api.GET("/health", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"status": "healthy"})
+		})
+	}
+
+	admin := api.Group("/admin", auditLog(), requireAdmin())
+	{
+		admin.GET("/me", getAdminMe)
+		admin.GET("/config", requirePermission(permConfigRead), getAdminConfig)
+		admin.GET("/llm-usage", requirePermission(permUsageRead), getLLMUsage)
+		admin.GET("/quotas", requirePermission(permUsageRead), listQuotas)
+		admin.PUT("/quotas", requirePermission(permQuotasWrite), putQuota)
+		admin.DELETE("/quotas", requirePermission(permQuotasWrite), deleteQuota)
+		admin.GET("/feature-flags", requirePermission(permConfigRead), listFeatureFlags)
+		admin.PUT("/feature-flags/:name", requirePermission(permFeaturesWrite), putFeatureFlag)
+		admin.DELETE("/feature-flags/:name", requirePermission(permFeaturesWrite), deleteFeatureFlag)
+		admin.GET("/experiments", requirePermission(permUsageRead), listExperiments)
+		admin.PUT("/experiments/:name", requirePermission(permFeaturesWrite), putExperiment)
+		admin.POST("/experiments/:name/stop", requirePermission(permFeaturesWrite), stopExperiment)
+		admin.GET("/audit-log", requirePermission(permAuditRead), getAuditLog)
+		admin.POST("/cache/purge", requirePermission(permCachePurge), purgeCache)
+		admin.POST("/reindex", requirePermission(permSearchReindex), reindex)
+		admin.POST("/ratings/recalculate", requirePermission(permSearchReindex), recalculateRatingAggregates)
+		admin.POST("/seed", requirePermission(permRecipesWrite), seedRecipesHandler)
+		admin.POST("/snapshots/publish", requirePermission(permCachePurge), startSnapshotPublish)
+		admin.GET("/export", requirePermission(permBackupManage), exportBackup)
+		admin.POST("/import", requirePermission(permBackupManage), importBackup)
+		admin.GET("/tenants", requirePermission(permTenantsManage), listTenants)
+		admin.PUT("/tenants/:id", requirePermission(permTenantsManage), putTenant)
+		admin.DELETE("/tenants/:id", requirePermission(permTenantsManage), deleteTenant)
+		admin.GET("/tenants/:id/api-keys", requirePermission(permTenantsManage), listTenantKeys)
+		admin.POST("/tenants/:id/api-keys", requirePermission(permTenantsManage), createTenantKey)
+		admin.DELETE("/tenants/:id/api-keys/:key_id", requirePermission(permTenantsManage), revokeTenantKey)
+		admin.PUT("/recipes/:id/tenant", requirePermission(permRecipesWrite), setRecipeTenant)
+		admin.GET("/featured", requirePermission(permCurationWrite), listFeatured)
+		admin.POST("/featured", requirePermission(permCurationWrite), createFeatured)
+		admin.PUT("/featured/:id", requirePermission(permCurationWrite), updateFeatured)
+		admin.DELETE("/featured/:id", requirePermission(permCurationWrite), deleteFeatured)
+		admin.GET("/collections", requirePermission(permCurationWrite), listAdminCollections)
+		admin.PUT("/collections/:slug", requirePermission(permCurationWrite), putCollection)
+		admin.DELETE("/collections/:slug", requirePermission(permCurationWrite), deleteCollection)
+		admin.GET("/recipes/:id/translations", requirePermission(permRecipesModerate), listRecipeTranslations)
+		admin.PUT("/recipes/:id/translations/:locale", requirePermission(permRecipesWrite), putRecipeTranslation)
+		admin.DELETE("/recipes/:id/translations/:locale", requirePermission(permRecipesWrite), deleteRecipeTranslation)
+		admin.POST("/translations/backfill", requirePermission(permRecipesWrite), backfillTranslations)
+		admin.GET("/jobs/:id", requirePermission(permSearchReindex), getJob)
+		admin.GET("/tasks", requirePermission(permConfigRead), listScheduledTasks)
+		admin.GET("/mcp-tokens", requirePermission(permMCPTokensManage), listMCPTokens)
+		admin.POST("/mcp-tokens", requirePermission(permMCPTokensManage), createMCPToken)
+		admin.PUT("/mcp-tokens/:id", requirePermission(permMCPTokensManage), updateMCPToken)
+		admin.DELETE("/mcp-tokens/:id", requirePermission(permMCPTokensManage), revokeMCPToken)
+		admin.GET("/recipes", requirePermission(permRecipesModerate), listModerationRecipes)
+		admin.GET("/recipes/:id", requirePermission(permRecipesModerate), getModerationRecipe)
+		admin.POST("/recipes/:id/submit", requirePermission(permRecipesModerate), submitRecipe)
+		admin.POST("/recipes/:id/approve", requirePermission(permRecipesModerate), approveRecipe)
+		admin.POST("/recipes/:id/reject", requirePermission(permRecipesModerate), rejectRecipe)
+		admin.DELETE("/recipes/:id", requirePermission(permRecipesModerate), deleteRecipe)
+		admin.POST("/recipes/:id/restore", requirePermission(permRecipesModerate), restoreRecipe)
+		admin.GET("/recipes/duplicates", requirePermission(permRecipesModerate), listDuplicates)
+		admin.GET("/reports", requirePermission(permRecipesModerate), listReports)
+		admin.POST("/recipes/:id/reports/resolve", requirePermission(permRecipesModerate), resolveReports)
+		admin.DELETE("/comments/:id", requirePermission(permRecipesModerate), moderateComment)
+		admin.POST("/recipes/:id/merge", requirePermission(permRecipesModerate), mergeRecipes)
+		admin.GET("/quality-report", requirePermission(permRecipesModerate), getQualityReport)
+		admin.POST("/quality-report/fix", requirePermission(permRecipesWrite), fixQualityIssues)
+		admin.GET("/images/broken", requirePermission(permRecipesModerate), listBrokenImages)
+		admin.POST("/images/check", requirePermission(permRecipesWrite), runImageCheck)
+		admin.PUT("/recipes/:id/difficulty", requirePermission(permRecipesWrite), setRecipeDifficulty)
+		admin.POST("/recipes/difficulty", requirePermission(permRecipesWrite), inferDifficulties)
+		admin.PUT("/recipes/:id/equipment", requirePermission(permRecipesWrite), setRecipeEquipment)
+		admin.DELETE("/recipes/:id/equipment", requirePermission(permRecipesWrite), resetRecipeEquipment)
+		admin.POST("/recipes/equipment", requirePermission(permRecipesWrite), inferEquipmentTags)
+		admin.PUT("/recipes/:id/traits", requirePermission(permRecipesWrite), setRecipeTraits)
+		admin.DELETE("/recipes/:id/traits", requirePermission(permRecipesWrite), resetRecipeTraits)
+		admin.POST("/recipes/traits", requirePermission(permRecipesWrite), inferTraits)
+		admin.PUT("/recipes/:id/cuisines", requirePermission(permRecipesWrite), setRecipeCuisines)
+		admin.POST("/recipes/:id/cuisines/review", requirePermission(permRecipesModerate), reviewRecipeCuisines)
+		admin.GET("/cuisines", requirePermission(permRecipesModerate), listCuisineProposals)
+		admin.POST("/cuisines/approve", requirePermission(permRecipesModerate), approveCuisineProposals)
+		admin.POST("/cuisines/classify", requirePermission(permRecipesWrite), startCuisineClassification)
+		admin.PUT("/recipes/:id/storage", requirePermission(permRecipesWrite), setRecipeStorage)
+		admin.DELETE("/recipes/:id/storage", requirePermission(permRecipesWrite), resetRecipeStorage)
+		admin.GET("/synonyms", requirePermission(permSynonymsWrite), listSynonyms)
+		admin.PUT("/synonyms/:canonical", requirePermission(permSynonymsWrite), putSynonymGroup)
+		admin.DELETE("/synonyms/:canonical", requirePermission(permSynonymsWrite), deleteSynonymGroup)
+		admin.GET("/ingredient-prices", requirePermission(permPricesWrite), listIngredientPrices)
+		admin.PUT("/ingredient-prices/:ingredient", requirePermission(permPricesWrite), putIngredientPrice)
+		admin.DELETE("/ingredient-prices/:ingredient", requirePermission(permPricesWrite), deleteIngredientPrice)
+		admin.POST("/ingredient-prices/recompute", requirePermission(permPricesWrite), recomputeIngredientCosts)
+		admin.GET("/ingredient-emissions", requirePermission(permEmissionsWrite), listIngredientEmissions)
+		admin.PUT("/ingredient-emissions/:ingredient", requirePermission(permEmissionsWrite), putIngredientEmission)
+		admin.DELETE("/ingredient-emissions/:ingredient", requirePermission(permEmissionsWrite), deleteIngredientEmission)
+		admin.POST("/ingredient-emissions/recompute", requirePermission(permEmissionsWrite), recomputeIngredientEmissions)
+		admin.GET("/ingredient-nutrition", requirePermission(permNutritionWrite), listIngredientNutrition)
+		admin.PUT("/ingredient-nutrition/:ingredient", requirePermission(permNutritionWrite), putIngredientNutrition)
+		admin.DELETE("/ingredient-nutrition/:ingredient", requirePermission(permNutritionWrite), deleteIngredientNutrition)
+		admin.POST("/ingredient-nutrition/recompute", requirePermission(permNutritionWrite), recomputeIngredientNutrition)
+		admin.GET("/pairings", requirePermission(permPairingsWrite), listPairingRules)
+		admin.POST("/pairings", requirePermission(permPairingsWrite), createPairingRule)
+		admin.DELETE("/pairings/:id", requirePermission(permPairingsWrite), deletePairingRule)
+	}
+	
+	return r
+}
+
+var (
+	routerOnce sync.Once
+	router     *gin.Engine
+)
+
+// Handler is the serverless entry point. A warm instance reuses the router
+// built on its first request; the database is opened lazily by requireDB.
+// An invalid configuration fails every request rather than serving with
+// settings nobody chose.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	routerOnce.Do(func() {
+		if err := initConfig(); err != nil {
+			slog.Error("configuration problem", "error", err)
+		}
+		initLogging()
+		router = setupRoutes()
+	})
+	if cfgErr != nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(gin.H{"error": "Server configuration is invalid"})
+		return
+	}
+	router.ServeHTTP(w, r)
+}
+
+// warmup readies a fresh instance: the database connection, schema and
+// caches. Platforms can call it after a deploy or on a schedule to keep
+// an instance warm.
+func warmup(c *gin.Context) {
+	start := time.Now()
+	caches, err := warmCaches(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "warm", "caches": caches, "took_ms": time.Since(start).Milliseconds()})
+}
+
+// lambdaEvent is an API Gateway proxy event, either the REST API (version
+// 1.0) or HTTP API (version 2.0) payload. Function URLs send 2.0.
+type lambdaEvent struct {
+	Version                         string              `json:"version"`
+	HTTPMethod                      string              `json:"httpMethod"`
+	Path                            string              `json:"path"`
+	MultiValueHeaders               map[string][]string `json:"multiValueHeaders"`
+	Headers                         map[string]string   `json:"headers"`
+	MultiValueQueryStringParameters map[string][]string `json:"multiValueQueryStringParameters"`
+	RawPath                         string              `json:"rawPath"`
+	RawQueryString                  string              `json:"rawQueryString"`
+	Cookies                         []string            `json:"cookies"`
+	Body                            string              `json:"body"`
+	IsBase64Encoded                 bool                `json:"isBase64Encoded"`
+	RequestContext                  struct {
+		HTTP struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+}
+
+// lambdaResult is the proxy response. Version 1.0 takes multi-value
+// headers; 2.0 takes cookies separately and joins other repeats.
+type lambdaResult struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// lambdaResponseWriter buffers a response, since a proxy result is sent
+// whole. Streams such as GET /mcp therefore only return when they end.
+type lambdaResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *lambdaResponseWriter) Header() http.Header { return w.header }
+
+func (w *lambdaResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+func (w *lambdaResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *lambdaResponseWriter) Flush() {}
+
+// lambdaTextTypes are the content types returned as text; anything else
+// is base64-encoded for API Gateway.
+var lambdaTextTypes = []string{"text/", "application/json", "application/xml", "application/javascript", "image/svg+xml", "application/x-ndjson"}
+
+// handleLambdaEvent translates an API Gateway event into a request for h
+// and its response back into a proxy result.
+func handleLambdaEvent(ctx context.Context, h http.Handler, payload []byte) (lambdaResult, error) {
+	var event lambdaEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return lambdaResult{}, fmt.Errorf("decoding event: %w", err)
+	}
+	v2 := event.Version == "2.0"
+
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(event.Body)
 		if err != nil {
-			continue
-		}
-		
-		// Parse JSON strings into slices
-		if ingredientsJSON != "" {
-			json.Unmarshal([]byte(ingredientsJSON), &recipe.Ingredients)
+			return lambdaResult{}, fmt.Errorf("decoding body: %w", err)
 		}
-		if instructionsJSON != "" {
-			json.Unmarshal([]byte(instructionsJSON), &recipe.Instructions)
+		body = decoded
+	}
+
+	method, target, sourceIP := event.HTTPMethod, event.Path, event.RequestContext.Identity.SourceIP
+	if v2 {
+		method, target, sourceIP = event.RequestContext.HTTP.Method, event.RawPath, event.RequestContext.HTTP.SourceIP
+		if event.RawQueryString != "" {
+			target += "?" + event.RawQueryString
 		}
-		
-		recipes = append(recipes, recipe)
+	} else if len(event.MultiValueQueryStringParameters) > 0 {
+		target += "?" + url.Values(event.MultiValueQueryStringParameters).Encode()
 	}
-	
-	response := gin.H{
-		"recipes": recipes,
-		"count":   len(recipes),
+
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return lambdaResult{}, err
 	}
-	
-	// Include diet plan info if used
-	if diet := c.Query("diet"); diet != "" {
-		if plan, exists := dietPlans[diet]; exists {
-			response["diet_plan"] = plan
+	for name, value := range event.Headers {
+		req.Header.Set(name, value)
+	}
+	for name, values := range event.MultiValueHeaders {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if len(event.Cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	req.Host = req.Header.Get("Host")
+	req.ContentLength = int64(len(body))
+	req.RemoteAddr = net.JoinHostPort(sourceIP, "0")
+
+	w := &lambdaResponseWriter{header: http.Header{}}
+	h.ServeHTTP(w, req)
+
+	result := lambdaResult{StatusCode: cmp.Or(w.status, http.StatusOK)}
+	if v2 {
+		result.Headers = map[string]string{}
+		for name, values := range w.header {
+			if name == "Set-Cookie" {
+				result.Cookies = values
+				continue
+			}
+			result.Headers[name] = strings.Join(values, ", ")
 		}
+	} else {
+		result.MultiValueHeaders = w.header
 	}
-	
-	c.JSON(http.StatusOK, response)
+	contentType := w.header.Get("Content-Type")
+	text := w.body.Len() == 0 || slices.ContainsFunc(lambdaTextTypes, func(prefix string) bool {
+		return strings.HasPrefix(contentType, prefix)
+	})
+	if text {
+		result.Body = w.body.String()
+	} else {
+		result.Body = base64.StdEncoding.EncodeToString(w.body.Bytes())
+		result.IsBase64Encoded = true
+	}
+	return result, nil
 }
 
-func applyDietFilters(query string, args []interface{}, filters map[string]interface{}) (string, []interface{}) {
-	for key, value := range filters {
-		switch key {
-		case "max_carbs":
-			if val, ok := value.(int); ok {
-				query += " AND carbs <= ?"
-				args = append(args, val)
-			}
-		case "min_carbs":
-			if val, ok := value.(int); ok {
-				query += " AND carbs >= ?"
-				args = append(args, val)
-			}
-		case "max_calories":
-			if val, ok := value.(int); ok {
-				query += " AND calories <= ?"
-				args = append(args, val)
-			}
-		case "min_calories":
-			if val, ok := value.(int); ok {
-				query += " AND calories >= ?"
-				args = append(args, val)
-			}
-		case "max_protein":
-			if val, ok := value.(int); ok {
-				query += " AND protein <= ?"
-				args = append(args, val)
+// ServeLambda runs the API as an AWS Lambda function behind API Gateway or
+// a function URL, on the provided.al2023 runtime (see cmd/recipe-api-lambda),
+// sharing the router Handler builds. A configuration problem fails the
+// init phase rather than every invocation.
+func ServeLambda() error {
+	runtimeAPI := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if runtimeAPI == "" {
+		return errors.New("AWS_LAMBDA_RUNTIME_API is not set; this binary runs under AWS Lambda")
+	}
+	if err := initConfig(); err != nil {
+		if reportErr := reportLambdaInitError(runtimeAPI, err); reportErr != nil {
+			slog.Error("reporting lambda init error failed", "error", reportErr)
+		}
+		return err
+	}
+
+	h := http.HandlerFunc(Handler)
+	lambda.Start(func(ctx context.Context, payload json.RawMessage) (lambdaResult, error) {
+		result, err := handleLambdaEvent(ctx, h, payload)
+		if err != nil {
+			requestID := ""
+			if lc, ok := lambdacontext.FromContext(ctx); ok {
+				requestID = lc.AwsRequestID
 			}
-		case "min_protein":
-			if val, ok := value.(int); ok {
-				query += " AND protein >= ?"
-				args = append(args, val)
+			slog.Error("lambda invocation failed", "request_id", requestID, "error", err)
+		}
+		return result, err
+	})
+	return nil
+}
+
+// reportLambdaInitError tells the Lambda Runtime API the function can't
+// start, so the failure shows as an init error instead of a timeout.
+func reportLambdaInitError(runtimeAPI string, initErr error) error {
+	data, err := json.Marshal(gin.H{"errorMessage": initErr.Error(), "errorType": "Runtime.ConfigError"})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+runtimeAPI+"/2018-06-01/runtime/init/error", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Lambda-Runtime-Function-Error-Type", "Runtime.ConfigError")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("runtime API returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Main runs the API as a standalone binary (see cmd/recipe-api). With
+// --mcp-stdio it serves MCP over stdin/stdout instead of HTTP.
+func Main() {
+	if err := initConfig(); err != nil {
+		log.Fatal(err)
+	}
+	initLogging()
+	if err := initDB(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, arg := range os.Args[1:] {
+		if arg == "--mcp-stdio" {
+			err := ServeMCPStdio(os.Stdin, os.Stdout)
+			db.Close()
+			if err != nil {
+				log.Fatal(err)
 			}
-		case "max_fat":
-			if val, ok := value.(int); ok {
-				query += " AND fat <= ?"
-				args = append(args, val)
+			return
+		}
+	}
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           setupRoutes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	startAlertDispatcher()
+	startScheduler()
+
+	// Recipes imported before difficulty, equipment tags, spice level,
+	// kid_friendly and CO2e existed, or inserted without them, are filled in
+	// in the background.
+	go func() {
+		if updated, err := inferRecipeDifficulties(false); err != nil {
+			slog.Error("difficulty inference failed", "error", err)
+		} else if updated > 0 {
+			slog.Info("difficulty inferred", "recipes", updated)
+		}
+		if tagged, err := inferRecipeEquipment(false); err != nil {
+			slog.Error("equipment inference failed", "error", err)
+		} else if tagged > 0 {
+			slog.Info("equipment inferred", "recipes", tagged)
+		}
+		if updated, err := inferRecipeTraits(false); err != nil {
+			slog.Error("spice and kid-friendly inference failed", "error", err)
+		} else if updated > 0 {
+			slog.Info("spice and kid-friendly inferred", "recipes", updated)
+		}
+		if changed, err := emissionsEstimate.recompute(true); err != nil {
+			slog.Error("co2e estimate failed", "error", err)
+		} else if changed > 0 {
+			slog.Info("co2e estimated", "recipes", changed)
+		}
+		if changed, err := recomputeNutritionEstimates(true); err != nil {
+			slog.Error("nutrition estimate failed", "error", err)
+		} else if changed > 0 {
+			slog.Info("nutrition estimated", "recipes", changed)
+		}
+		if changed, err := recomputeGlycemicEstimates(true); err != nil {
+			slog.Error("glycemic estimate failed", "error", err)
+		} else if changed > 0 {
+			slog.Info("glycemic load estimated", "recipes", changed)
+		}
+	}()
+
+	// Long-lived MCP event streams would otherwise hold Shutdown until the
+	// drain timeout.
+	srv.RegisterOnShutdown(mcpStreams.closeAll)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	slog.Info("server started", "addr", srv.Addr)
+
+	<-ctx.Done()
+	stop()
+
+	// Stop accepting connections and let in-flight requests finish before the
+	// DB pool goes away underneath them.
+	timeout := cfg.ShutdownTimeout
+	slog.Info("shutting down", "drain_timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("graceful shutdown incomplete", "error", err)
+	}
+
+	if err := db.Close(); err != nil {
+		slog.Error("closing database failed", "error", err)
+	}
+	slog.Info("server stopped")
+}
+
+// ctlCommand is the emealctl command tree. Subcommands run against the
+// configured database once the schema is in place.
+func ctlCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "emealctl",
+		Short:         "Manage recipe data without going through the admin API or writing SQL",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	for _, cmd := range []*cobra.Command{
+		{
+			Use:   "migrate",
+			Short: "Apply schema changes",
+			Args:  cobra.NoArgs,
+			RunE:  func(*cobra.Command, []string) error { return nil },
+		},
+		ctlExportCommand(),
+		ctlImportCommand(),
+		ctlRecomputeNutritionCommand(),
+		ctlReindexCommand(),
+		ctlSeedCommand(),
+		ctlAPIKeysCommand(),
+	} {
+		// Set here rather than on root so help and completion work
+		// without a database.
+		cmd.PersistentPreRunE = ctlConnect
+		root.AddCommand(cmd)
+	}
+	return root
+}
+
+func ctlConnect(*cobra.Command, []string) error {
+	if err := initConfig(); err != nil {
+		return err
+	}
+	initLogging()
+	if err := openDB(); err != nil {
+		return err
+	}
+	return ensureSchema()
+}
+
+// Ctl runs an emealctl command, so operators can manage data without
+// going through the admin API or writing SQL.
+func Ctl(args []string) error {
+	root := ctlCommand()
+	root.SetArgs(args)
+	defer func() {
+		if db != nil {
+			db.Close()
+		}
+	}()
+	return root.Execute()
+}
+
+func ctlPrintJSON(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func ctlExportCommand() *cobra.Command {
+	var status, file string
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write recipes as JSON Lines",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			out := cmd.OutOrStdout()
+			if file != "" {
+				f, err := os.Create(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
 			}
-		case "min_fat":
-			if val, ok := value.(int); ok {
-				query += " AND fat >= ?"
-				args = append(args, val)
+			n, err := exportRecipes(out, status)
+			if err != nil {
+				return err
 			}
-		case "max_fiber":
-			if val, ok := value.(int); ok {
-				query += " AND fiber <= ?"
-				args = append(args, val)
+			slog.Info("recipes exported", "count", n)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&status, "status", "published", "recipe status to export, or all")
+	cmd.Flags().StringVarP(&file, "output", "o", "", "write to file instead of stdout")
+	return cmd
+}
+
+// exportRecipes writes every live recipe with the status, or with "all"
+// every status, as one JSON object per line, and returns how many it wrote.
+func exportRecipes(w io.Writer, status string) (int, error) {
+	encoder := json.NewEncoder(w)
+	return eachRecipeBatch(status, func(recipes []Recipe) error {
+		for _, recipe := range recipes {
+			if err := encoder.Encode(recipe); err != nil {
+				return err
 			}
-		case "min_fiber":
-			if val, ok := value.(int); ok {
-				query += " AND fiber >= ?"
-				args = append(args, val)
+		}
+		return nil
+	})
+}
+
+// eachRecipeBatch calls fn with every live recipe with the status, or with
+// "all" every status, a few hundred at a time in ID order, and returns how
+// many recipes it passed.
+func eachRecipeBatch(status string, fn func([]Recipe) error) (int, error) {
+	const batchSize = 500
+	passed := 0
+	lastID := 0
+	for {
+		query := selectRecipes().Where("id > ?", lastID).Where("deleted_at IS NULL")
+		if status != "all" {
+			query.Where("status = ?", status)
+		}
+		recipes, err := query.OrderBy("id").Limit(batchSize).Prepared().All()
+		if err != nil {
+			return passed, err
+		}
+		if len(recipes) > 0 {
+			lastID = recipes[len(recipes)-1].ID
+			if err := fn(recipes); err != nil {
+				return passed, err
 			}
-		case "max_sodium":
-			if val, ok := value.(int); ok {
-				query += " AND sodium <= ?"
-				args = append(args, val)
+			passed += len(recipes)
+		}
+		if len(recipes) < batchSize {
+			return passed, nil
+		}
+	}
+}
+
+func ctlImportCommand() *cobra.Command {
+	var status, tenant string
+	cmd := &cobra.Command{
+		Use:   "import file|-",
+		Short: "Add recipes from JSON Lines, skipping names that exist",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if tenant != "" {
+				if t, err := tenants.get(tenant); err != nil || t == nil {
+					return fmt.Errorf("unknown tenant %q", tenant)
+				}
 			}
-		case "min_sodium":
-			if val, ok := value.(int); ok {
-				query += " AND sodium >= ?"
-				args = append(args, val)
+			switch status {
+			case recipeStatusDraft, recipeStatusPending, recipeStatusPublished:
+			default:
+				return fmt.Errorf("unknown status %q", status)
 			}
-		case "exclude_ingredients":
-			if ingredients, ok := value.([]string); ok {
-				for _, ingredient := range ingredients {
-					query += " AND ingredients NOT LIKE ?"
-					args = append(args, "%"+ingredient+"%")
+
+			in := cmd.InOrStdin()
+			if name := args[0]; name != "-" {
+				f, err := os.Open(name)
+				if err != nil {
+					return err
 				}
+				defer f.Close()
+				in = f
 			}
-		case "include_ingredients":
-			if ingredients, ok := value.([]string); ok {
-				for _, ingredient := range ingredients {
-					query += " AND ingredients LIKE ?"
-					args = append(args, "%"+ingredient+"%")
-				}
+			result, err := importRecipes(in, status, tenant)
+			if err != nil {
+				return err
 			}
-		}
+			return ctlPrintJSON(cmd.OutOrStdout(), result)
+		},
 	}
-	return query, args
+	cmd.Flags().StringVar(&status, "status", "published", "status to give imported recipes")
+	cmd.Flags().StringVar(&tenant, "tenant", "", "tenant to import into, overriding tenant_id in the file")
+	return cmd
 }
 
-func getDietPlans(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"diet_plans": dietPlans})
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Skipped  []string `json:"skipped"`
 }
 
-func getRecipeByID(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipe ID"})
-		return
-	}
-	
-	query := "SELECT id, name, description, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium FROM recipes WHERE id = ?"
-	
-	var recipe Recipe
-	var ingredientsJSON, instructionsJSON string
-	
-	err = db.QueryRow(query, id).Scan(
-		&recipe.ID, &recipe.Name, &recipe.Description, &recipe.Image,
-		&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes, &recipe.TotalTimeMinutes,
-		&recipe.Servings, &recipe.Rating, &ingredientsJSON, &instructionsJSON,
-		&recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium)
-	
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Recipe not found"})
-		return
+// importRecipes adds recipes read as JSON Lines with the given status. IDs
+// in the input are ignored and a recipe named like a live one is skipped,
+// so an import can be rerun.
+func importRecipes(r io.Reader, status, tenantID string) (ImportResult, error) {
+	result := ImportResult{Skipped: []string{}}
+	decoder := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var recipe Recipe
+		if err := decoder.Decode(&recipe); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return result, fmt.Errorf("recipe %d: %w", line, err)
+		}
+		if strings.TrimSpace(recipe.Name) == "" || len(recipe.Ingredients) == 0 {
+			return result, fmt.Errorf("recipe %d: name and ingredients are required", line)
+		}
+
+		if tenantID != "" {
+			recipe.TenantID = &tenantID
+		}
+		_, existed, err := importRecipe(recipe, status)
+		if err != nil {
+			return result, fmt.Errorf("recipe %d: %w", line, err)
+		}
+		if existed {
+			result.Skipped = append(result.Skipped, recipe.Name)
+			continue
+		}
+		result.Imported++
 	}
-	
+}
+
+// importRecipe adds an exported recipe unless a live one with its name is
+// already in its tenant, and returns the ID it has either way.
+func importRecipe(recipe Recipe, status string) (id int, existed bool, err error) {
+	tx, err := db.Begin()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	
-	// Parse JSON strings into slices
-	if ingredientsJSON != "" {
-		json.Unmarshal([]byte(ingredientsJSON), &recipe.Ingredients)
+		return 0, false, err
 	}
-	if instructionsJSON != "" {
-		json.Unmarshal([]byte(instructionsJSON), &recipe.Instructions)
+	defer tx.Rollback()
+	if id, existed, err = importRecipeTx(tx, recipe, status); err != nil {
+		return 0, false, err
 	}
-	
-	c.JSON(http.StatusOK, recipe)
-}
-type ChatRequest struct {
-	Message string `json:"message" binding:"required"`
+	return id, existed, tx.Commit()
 }
 
-type ChatResponse struct {
-	GeneratedURL string `json:"generated_url"`
-	ParsedQuery  string `json:"parsed_query"`
-	Recipes      interface{} `json:"recipes,omitempty"`
+// importRecipeTx is importRecipe inside the caller's transaction.
+func importRecipeTx(tx *sql.Tx, recipe Recipe, status string) (id int, existed bool, err error) {
+	err = tx.QueryRow("SELECT id FROM recipes WHERE name = ? AND tenant_id <=> ? AND deleted_at IS NULL ORDER BY id LIMIT 1", recipe.Name, recipe.TenantID).Scan(&id)
+	if err == nil {
+		return id, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+	if recipe.ImagePlaceholder {
+		// Exports carry placeholders for dead images; don't import them.
+		recipe.Image = ""
+	}
+	id, err = insertRecipeTx(tx, recipe, status, false)
+	return id, false, err
 }
 
-func GenerateRecipeURL(message string) (string, error) {
-	systemPrompt := `You are a recipe search API parameter generator. Convert natural language requests into URL query parameters for a recipe search API.
-
-Available parameters:
-- search: text search in recipe name/description
-- diet: keto, paleo, mediterranean, vegan, vegetarian, low_carb, high_protein, low_sodium, heart_healthy, low_sugar
-- include_ingredients: comma-separated ingredients to include
-- exclude_ingredients: comma-separated ingredients to exclude
-- min_calories, max_calories: calorie range
-- min_protein, max_protein: protein range in grams
-- min_carbs, max_carbs: carbs range in grams
-- min_fat, max_fat: fat range in grams
-- min_fiber, max_fiber: fiber range in grams
-- min_sodium, max_sodium: sodium range in mg
-- min_prep_time, max_prep_time: preparation time in minutes
-- min_cook_time, max_cook_time: cooking time in minutes
-- min_total_time, max_total_time: total time in minutes
-- min_servings, max_servings: serving size range
-- min_rating, max_rating: rating range (0-5)
-- sort_by: rating, calories, protein, carbs, prep_time_minutes, etc.
-- sort_order: asc or desc
-
-Examples:
-"high calorie meal with potato" -> "?min_calories=800&include_ingredients=potato&sort_by=calories&sort_order=desc"
-"vegan low carb under 30 minutes" -> "?diet=vegan&max_carbs=20&max_prep_time=30"
-"keto recipes with chicken" -> "?diet=keto&include_ingredients=chicken"
-"healthy low sodium meals" -> "?max_sodium=1000&diet=heart_healthy"
-
-Respond ONLY with the URL query string starting with "?". No explanations.`
+// seedRecipes is a small sample dataset for new deployments and test
+// databases, one recipe per line.
+//
+//go:embed seed/recipes.jsonl
+var seedRecipes []byte
 
-	reqBody := map[string]interface{}{
-		"messages": []map[string]interface{}{
-			{"role": "system", "content": systemPrompt},
-			{"role": "user", "content": fmt.Sprintf("Convert this request to URL parameters: %s", message)},
-		},
-		"model":  "meta-llama/Llama-3.3-70B-Instruct:fireworks-ai",
-		"stream": false,
-	}
+var errDatabaseNotEmpty = errors.New("database already has recipes")
 
-	reqBodyJSON, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", "https://router.huggingface.co/v1/chat/completions", bytes.NewBuffer(reqBodyJSON))
-	req.Header.Set("Authorization", "Bearer " + os.Getenv("HF_TOKEN"))
-	req.Header.Set("Content-Type", "application/json")
+// seedDatabase loads the sample recipes as published. It refuses a
+// database that already has recipes unless forced, and even then skips
+// any that are already there.
+func seedDatabase(force bool) (ImportResult, error) {
+	if !force {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM recipes)").Scan(&exists); err != nil {
+			return ImportResult{}, err
+		}
+		if exists {
+			return ImportResult{}, errDatabaseNotEmpty
+		}
+	}
+	return importRecipes(bytes.NewReader(seedRecipes), recipeStatusPublished, "")
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// seedRecipesHandler loads the sample dataset; ?force=true loads it into a
+// database that already has recipes.
+func seedRecipesHandler(c *gin.Context) {
+	result, err := seedDatabase(c.Query("force") == "true")
+	if errors.Is(err, errDatabaseNotEmpty) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error() + "; pass force=true to seed anyway"})
+		return
+	}
 	if err != nil {
-		return "", err
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	defer resp.Body.Close()
+	requestLogger(c).Info("sample recipes seeded", "imported", result.Imported, "skipped", len(result.Skipped), "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, result)
+}
 
-	var aiResponse struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
+func ctlSeedCommand() *cobra.Command {
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "seed",
+		Short: "Load the bundled sample recipes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			result, err := seedDatabase(force)
+			if err != nil {
+				return err
+			}
+			return ctlPrintJSON(cmd.OutOrStdout(), result)
+		},
 	}
+	cmd.Flags().BoolVar(&force, "force", false, "seed even if the database has recipes")
+	return cmd
+}
 
-	json.NewDecoder(resp.Body).Decode(&aiResponse)
-	
-	if len(aiResponse.Choices) == 0 {
-		return "", fmt.Errorf("empty response")
-	}
+// Backups are streams of BackupRecords, as JSON Lines or as one JSON
+// array: a header, every recipe with its status, optionally every row of
+// backupUserTables, and an end record with the counts, so a restore can
+// tell a complete dump from a truncated one.
+const backupVersion = 1
 
-	generatedURL := strings.TrimSpace(aiResponse.Choices[0].Message.Content)
-	if !strings.HasPrefix(generatedURL, "?") {
-		generatedURL = "?" + generatedURL
-	}
+// backupUserTables hold what callers have saved or done, in restore order.
+// Rows keep their own IDs; recipe_id is mapped to the restored recipe.
+var backupUserTables = []string{
+	"saved_searches", "meal_log", "hidden_recipes", "recipe_ratings", "recipe_history", "cook_sessions", "recipe_comments",
+	"nutrition_targets",
+}
+
+var backupColumnPattern = regexp.MustCompile(`^[a-z_]+$`)
 
-	return generatedURL, nil
+type BackupRecord struct {
+	Kind string `json:"kind"`
+	// Header fields.
+	Version    int        `json:"version,omitempty"`
+	ExportedAt *time.Time `json:"exported_at,omitempty"`
+	// Recipe fields.
+	Status string  `json:"status,omitempty"`
+	Recipe *Recipe `json:"recipe,omitempty"`
+	// Row fields.
+	Table string                 `json:"table,omitempty"`
+	Row   map[string]interface{} `json:"row,omitempty"`
+	// End fields.
+	Recipes *int   `json:"recipes,omitempty"`
+	Rows    *int   `json:"rows,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
 
-func ExecuteSearch(urlParams string) (interface{}, error) {
-	u, err := url.Parse("https://emealapi.ledraa.com/api" + urlParams)
+// backupWriter writes records as JSON Lines or a JSON array, flushing as
+// it goes so the dump is never held in memory.
+type backupWriter struct {
+	w       gin.ResponseWriter
+	array   bool
+	written int
+}
+
+func (b *backupWriter) write(record BackupRecord) error {
+	data, err := json.Marshal(record)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse URL: %v", err)
+		return err
 	}
+	switch {
+	case !b.array:
+		data = append(data, '\n')
+	case b.written == 0:
+		data = append([]byte("[\n"), data...)
+	default:
+		data = append([]byte(",\n"), data...)
+	}
+	b.written++
+	_, err = b.w.Write(data)
+	return err
+}
 
-	query := "SELECT id, name, description, image, prep_time_minutes, cook_time_minutes, total_time_minutes, servings, rating, ingredients, instructions, calories, protein, fat, carbs, fiber, sodium FROM recipes WHERE 1=1"
-	args := []interface{}{}
-
-	params := u.Query()
+func (b *backupWriter) close() {
+	if b.array {
+		b.w.WriteString("\n]\n")
+	}
+	b.w.Flush()
+}
 
-	if diet := params.Get("diet"); diet != "" {
-		if plan, exists := dietPlans[diet]; exists {
-			query, args = applyDietFilters(query, args, plan.Filters)
+// backupRow reads a row scanned into interface values as JSON-friendly
+// values. Times are written the way MySQL reads them back.
+func backupRow(columns []string, values []interface{}) map[string]interface{} {
+	row := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		switch value := values[i].(type) {
+		case []byte:
+			row[column] = string(value)
+		case time.Time:
+			row[column] = value.Format("2006-01-02 15:04:05.999999")
+		default:
+			row[column] = value
 		}
 	}
+	return row
+}
 
-	filterMap := map[string]string{
-		"min_calories": "AND calories >= ?",
-		"max_calories": "AND calories <= ?",
-		"min_protein":  "AND protein >= ?",
-		"max_protein":  "AND protein <= ?",
-		"min_carbs":    "AND carbs >= ?",
-		"max_carbs":    "AND carbs <= ?",
-		"min_fat":      "AND fat >= ?",
-		"max_fat":      "AND fat <= ?",
-		"min_fiber":    "AND fiber >= ?",
-		"max_fiber":    "AND fiber <= ?",
-		"min_sodium":   "AND sodium >= ?",
-		"max_sodium":   "AND sodium <= ?",
-		"max_prep_time": "AND prep_time_minutes <= ?",
-		"min_prep_time": "AND prep_time_minutes >= ?",
+// exportBackup streams recipes with the given status (default all) and,
+// with include_user_data=true, the user data tables. format is ndjson
+// (default) or json.
+func exportBackup(c *gin.Context) {
+	status := c.DefaultQuery("status", "all")
+	switch status {
+	case "all", recipeStatusDraft, recipeStatusPending, recipeStatusPublished:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be all, draft, pending or published"})
+		return
+	}
+	format := c.DefaultQuery("format", "ndjson")
+	contentType := map[string]string{"ndjson": "application/x-ndjson", "json": "application/json"}[format]
+	if contentType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be ndjson or json"})
+		return
 	}
+	includeUsers := c.Query("include_user_data") == "true"
 
-	for param, condition := range filterMap {
-		if value := params.Get(param); value != "" {
-			if val, err := strconv.ParseFloat(value, 64); err == nil {
-				query += " " + condition
-				args = append(args, val)
+	now := time.Now().UTC()
+	c.Header("Content-Type", contentType+"; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="backup-%s.%s"`, now.Format(time.DateOnly), format))
+	c.Status(http.StatusOK)
+	out := &backupWriter{w: c.Writer, array: format == "json"}
+	defer out.close()
+
+	recipes, rows := 0, 0
+	err := func() error {
+		if err := out.write(BackupRecord{Kind: "header", Version: backupVersion, ExportedAt: &now}); err != nil {
+			return err
+		}
+		var err error
+		recipes, err = eachRecipeBatch(status, func(batch []Recipe) error {
+			statuses, err := recipeStatuses(batch)
+			if err != nil {
+				return err
 			}
+			for i := range batch {
+				if err := out.write(BackupRecord{Kind: "recipe", Status: statuses[batch[i].ID], Recipe: &batch[i]}); err != nil {
+					return err
+				}
+			}
+			out.w.Flush()
+			return nil
+		})
+		if err != nil || !includeUsers {
+			return err
 		}
-	}
-
-	if includeIngredients := params.Get("include_ingredients"); includeIngredients != "" {
-		ingredients := strings.Split(includeIngredients, ",")
-		for _, ingredient := range ingredients {
-			query += " AND ingredients LIKE ?"
-			args = append(args, "%"+strings.TrimSpace(ingredient)+"%")
+		for _, table := range backupUserTables {
+			n, err := exportBackupTable(out, table)
+			rows += n
+			if err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
 		}
+		return nil
+	}()
+
+	// The status is already sent, so a failure is reported in the stream;
+	// a restore refuses a dump without a clean end record.
+	end := BackupRecord{Kind: "end", Recipes: &recipes, Rows: &rows}
+	if err != nil {
+		requestLogger(c).Error("backup export failed", "error", err)
+		end = BackupRecord{Kind: "error", Error: err.Error()}
 	}
+	out.write(end)
+	requestLogger(c).Info("backup exported", "recipes", recipes, "rows", rows, "complete", err == nil, "by", adminFromContext(c).Subject)
+}
 
-	if excludeIngredients := params.Get("exclude_ingredients"); excludeIngredients != "" {
-		ingredients := strings.Split(excludeIngredients, ",")
-		for _, ingredient := range ingredients {
-			query += " AND ingredients NOT LIKE ?"
-			args = append(args, "%"+strings.TrimSpace(ingredient)+"%")
+// recipeStatuses looks up the moderation status of a batch of recipes.
+func recipeStatuses(recipes []Recipe) (map[int]string, error) {
+	statuses := make(map[int]string, len(recipes))
+	if len(recipes) == 0 {
+		return statuses, nil
+	}
+	placeholders := make([]string, len(recipes))
+	args := make([]interface{}, len(recipes))
+	for i, recipe := range recipes {
+		placeholders[i], args[i] = "?", recipe.ID
+	}
+	rows, err := db.Query("SELECT id, status FROM recipes WHERE id IN ("+strings.Join(placeholders, ",")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var status string
+		if err := rows.Scan(&id, &status); err != nil {
+			return nil, err
 		}
+		statuses[id] = status
 	}
+	return statuses, rows.Err()
+}
 
-	if search := params.Get("search"); search != "" {
-		query += " AND (name LIKE ? OR description LIKE ?)"
-		searchTerm := "%" + search + "%"
-		args = append(args, searchTerm, searchTerm)
+// exportBackupTable writes every row of a user data table.
+func exportBackupTable(out *backupWriter, table string) (int, error) {
+	rows, err := db.Query("SELECT * FROM " + table)
+	if err != nil {
+		return 0, err
 	}
-
-	sortBy := params.Get("sort_by")
-	if sortBy == "" {
-		sortBy = "id"
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
 	}
-	sortOrder := params.Get("sort_order")
-	if sortOrder == "" {
-		sortOrder = "asc"
+	written := 0
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return written, err
+		}
+		if err := out.write(BackupRecord{Kind: "row", Table: table, Row: backupRow(columns, values)}); err != nil {
+			return written, err
+		}
+		written++
+		if written%500 == 0 {
+			out.w.Flush()
+		}
 	}
+	return written, rows.Err()
+}
 
-	validSortColumns := map[string]bool{
-		"id": true, "name": true, "prep_time_minutes": true, "cook_time_minutes": true,
-		"total_time_minutes": true, "servings": true, "rating": true, "calories": true,
-		"protein": true, "fat": true, "carbs": true, "fiber": true, "sodium": true,
+// RestoreResult counts what a backup import restored. Recipes that
+// already exist by name are skipped, and rows whose key already exists are
+// left as they are. A failed import restores nothing; its result counts
+// what was read before the failure.
+type RestoreResult struct {
+	Recipes  ImportResult           `json:"recipes"`
+	Rows     map[string]RestoreRows `json:"rows"`
+	Complete bool                   `json:"complete"`
+}
+
+type RestoreRows struct {
+	Restored int `json:"restored"`
+	Skipped  int `json:"skipped"`
+}
+
+// importBackup restores a backup from the request body, read a record at
+// a time. Plain recipe lines, as emealctl export writes, are accepted too
+// and get ?status (default published).
+func importBackup(c *gin.Context) {
+	status := c.DefaultQuery("status", recipeStatusPublished)
+	switch status {
+	case recipeStatusDraft, recipeStatusPending, recipeStatusPublished:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be draft, pending or published"})
+		return
 	}
 
-	if validSortColumns[sortBy] {
-		if sortOrder == "desc" {
-			query += " ORDER BY " + sortBy + " DESC"
-		} else {
-			query += " ORDER BY " + sortBy + " ASC"
+	result, err := restoreBackup(c.Request.Body, status)
+	if err != nil {
+		var syntaxErr *backupRecordError
+		code := http.StatusInternalServerError
+		if errors.As(err, &syntaxErr) {
+			code = http.StatusBadRequest
 		}
+		c.JSON(code, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+	if result.Recipes.Imported > 0 {
+		notifyMCPListChanged("resources")
 	}
+	requestLogger(c).Info("backup imported", "recipes", result.Recipes.Imported, "complete", result.Complete, "by", adminFromContext(c).Subject)
+	c.JSON(http.StatusOK, result)
+}
+
+// backupRecordError is a record restoreBackup can't use.
+type backupRecordError struct {
+	record int
+	err    error
+}
 
-	query += " LIMIT 20"
+func (e *backupRecordError) Error() string { return fmt.Sprintf("record %d: %v", e.record, e.err) }
 
-	rows, err := db.Query(query, args...)
+func (e *backupRecordError) Unwrap() error { return e.err }
+
+// restoreBackup reads records from r, restoring recipes before the rows
+// that refer to them, in one transaction: a dump that is truncated or
+// fails part way is rolled back. A dump with a header must have its end
+// record; plain recipe lines need none.
+func restoreBackup(r io.Reader, status string) (RestoreResult, error) {
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return RestoreResult{Recipes: ImportResult{Skipped: []string{}}, Rows: map[string]RestoreRows{}}, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
+	result, err := restoreBackupTx(tx, r, status)
+	if err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
 
-	var recipes []Recipe
-	for rows.Next() {
-		var recipe Recipe
-		var ingredientsJSON, instructionsJSON string
+func restoreBackupTx(tx *sql.Tx, r io.Reader, status string) (RestoreResult, error) {
+	result := RestoreResult{Recipes: ImportResult{Skipped: []string{}}, Rows: map[string]RestoreRows{}}
+	in := bufio.NewReader(r)
+	decoder := json.NewDecoder(in)
+	if skipSpace(in) == '[' {
+		if _, err := decoder.Token(); err != nil {
+			return result, &backupRecordError{1, err}
+		}
+	}
+
+	recipeIDs := map[int]int{}
+	header := false
+	n := 1
+	for ; decoder.More(); n++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return result, &backupRecordError{n, err}
+		}
+		// Numbers in rows stay json.Numbers, so BIGINT IDs come back exact.
+		var record BackupRecord
+		recordDecoder := json.NewDecoder(bytes.NewReader(raw))
+		recordDecoder.UseNumber()
+		if err := recordDecoder.Decode(&record); err != nil {
+			return result, &backupRecordError{n, err}
+		}
+		if result.Complete {
+			return result, &backupRecordError{n, errors.New("record after the end record")}
+		}
 
-		err := rows.Scan(&recipe.ID, &recipe.Name, &recipe.Description, &recipe.Image,
-			&recipe.PrepTimeMinutes, &recipe.CookTimeMinutes, &recipe.TotalTimeMinutes,
-			&recipe.Servings, &recipe.Rating, &ingredientsJSON, &instructionsJSON,
-			&recipe.Calories, &recipe.Protein, &recipe.Fat, &recipe.Carbs, &recipe.Fiber, &recipe.Sodium)
+		switch record.Kind {
+		case "header":
+			if record.Version > backupVersion {
+				return result, &backupRecordError{n, fmt.Errorf("backup version %d is newer than this server's %d", record.Version, backupVersion)}
+			}
+			header = true
+		case "", "recipe":
+			recipe, recipeStatus := record.Recipe, record.Status
+			if record.Kind == "" {
+				recipe, recipeStatus = &Recipe{}, status
+				if err := json.Unmarshal(raw, recipe); err != nil {
+					return result, &backupRecordError{n, err}
+				}
+			}
+			if recipe == nil {
+				return result, &backupRecordError{n, errors.New("recipe record without a recipe")}
+			}
+			switch recipeStatus {
+			case recipeStatusDraft, recipeStatusPending, recipeStatusPublished:
+			default:
+				recipeStatus = status
+			}
+			oldID := recipe.ID
+			id, existed, err := importRecipeTx(tx, *recipe, recipeStatus)
+			if err != nil {
+				return result, &backupRecordError{n, err}
+			}
+			if existed {
+				result.Recipes.Skipped = append(result.Recipes.Skipped, recipe.Name)
+			} else {
+				result.Recipes.Imported++
+			}
+			if oldID > 0 {
+				recipeIDs[oldID] = id
+			}
+		case "row":
+			restored, err := restoreBackupRow(tx, record.Table, record.Row, recipeIDs)
+			if err != nil {
+				return result, &backupRecordError{n, err}
+			}
+			counts := result.Rows[record.Table]
+			if restored {
+				counts.Restored++
+			} else {
+				counts.Skipped++
+			}
+			result.Rows[record.Table] = counts
+		case "end":
+			result.Complete = true
+		case "error":
+			return result, &backupRecordError{n, fmt.Errorf("the backup failed while exporting: %s", record.Error)}
+		default:
+			return result, &backupRecordError{n, fmt.Errorf("unknown record kind %q", record.Kind)}
+		}
+	}
+	if header && !result.Complete {
+		return result, &backupRecordError{n, errors.New("backup ends without an end record")}
+	}
+	return result, nil
+}
 
+// skipSpace discards leading whitespace and returns the next byte, or 0
+// at the end of input.
+func skipSpace(in *bufio.Reader) byte {
+	for {
+		b, err := in.Peek(1)
 		if err != nil {
-			continue
+			return 0
 		}
+		if !unicode.IsSpace(rune(b[0])) {
+			return b[0]
+		}
+		in.Discard(1)
+	}
+}
 
-		if ingredientsJSON != "" {
-			json.Unmarshal([]byte(ingredientsJSON), &recipe.Ingredients)
+// restoreBackupRow inserts a user data row unless its key already exists.
+// A row about a recipe the dump didn't restore is skipped, since its
+// recipe_id would point at whatever recipe has that ID here.
+func restoreBackupRow(tx *sql.Tx, table string, row map[string]interface{}, recipeIDs map[int]int) (bool, error) {
+	if !slices.Contains(backupUserTables, table) {
+		return false, fmt.Errorf("unknown table %q", table)
+	}
+	if len(row) == 0 {
+		return false, errors.New("empty row")
+	}
+	columns := sortedKeys(row)
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if !backupColumnPattern.MatchString(column) {
+			return false, fmt.Errorf("invalid column %q", column)
+		}
+		args[i] = row[column]
+		if number, ok := row[column].(json.Number); ok {
+			args[i] = number.String()
 		}
-		if instructionsJSON != "" {
-			json.Unmarshal([]byte(instructionsJSON), &recipe.Instructions)
+	}
+	if i := slices.Index(columns, "recipe_id"); i >= 0 && args[i] != nil {
+		old, err := strconv.Atoi(fmt.Sprint(args[i]))
+		if err != nil {
+			return false, fmt.Errorf("invalid recipe_id %v", args[i])
 		}
+		id, ok := recipeIDs[old]
+		if !ok {
+			return false, nil
+		}
+		args[i] = id
+	}
+	res, err := tx.Exec("INSERT IGNORE INTO "+table+" ("+strings.Join(columns, ", ")+") VALUES ("+strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")+")", args...)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
 
-		recipes = append(recipes, recipe)
+func ctlRecomputeNutritionCommand() *cobra.Command {
+	var all bool
+	cmd := &cobra.Command{
+		Use:   "recompute-nutrition",
+		Short: "Estimate missing nutrition from the ingredient table",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			changed, err := recomputeNutritionEstimates(!all)
+			if err != nil {
+				return err
+			}
+			return ctlPrintJSON(cmd.OutOrStdout(), gin.H{"changed": changed})
+		},
 	}
+	cmd.Flags().BoolVar(&all, "all", false, "also redo existing estimates")
+	return cmd
+}
 
-	return map[string]interface{}{
-		"recipes": recipes,
-		"count":   len(recipes),
-	}, nil
+func ctlReindexCommand() *cobra.Command {
+	var recipeID int
+	cmd := &cobra.Command{
+		Use:   "reindex",
+		Short: "Recompute derived recipe fields and search dictionaries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			kind, run := "reindex", reindexAll
+			req := ReindexRequest{}
+			if recipeID > 0 {
+				id := recipeID
+				kind, req.RecipeID = "reindex_recipe", &id
+				run = func(ctx context.Context) (interface{}, error) { return reindexRecipe(ctx, id) }
+			}
+			id, err := startJob(kind, req, "emealctl", true, run)
+			if err != nil {
+				return err
+			}
+			job, err := loadJob(id)
+			if err != nil {
+				return err
+			}
+			if err := ctlPrintJSON(cmd.OutOrStdout(), job); err != nil {
+				return err
+			}
+			if job.Status == jobFailed {
+				return errors.New(job.Error)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&recipeID, "recipe", 0, "reindex only this recipe")
+	return cmd
 }
-func handleChat(c *gin.Context) {
-	var req ChatRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
-		return
+
+func ctlAPIKeysCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "api-keys",
+		Short: "Manage MCP tokens",
 	}
 
-	generatedURL, err := GenerateRecipeURL(req.Message)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process message: " + err.Error()})
-		return
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List tokens that aren't revoked",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			rows, err := db.Query("SELECT id, name, tools, created_at, last_used_at FROM mcp_tokens WHERE revoked_at IS NULL ORDER BY id")
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tTOOLS\tCREATED\tLAST USED")
+			for rows.Next() {
+				var id int
+				var name, tools string
+				var createdAt time.Time
+				var lastUsedAt sql.NullTime
+				if err := rows.Scan(&id, &name, &tools, &createdAt, &lastUsedAt); err != nil {
+					return err
+				}
+				lastUsed := "never"
+				if lastUsedAt.Valid {
+					lastUsed = lastUsedAt.Time.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", id, name, tools, createdAt.Format(time.RFC3339), lastUsed)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return w.Flush()
+		},
 	}
 
-	response := ChatResponse{
-		GeneratedURL: generatedURL,
-		ParsedQuery:  req.Message,
+	var name, tools string
+	create := &cobra.Command{
+		Use:   "create",
+		Short: "Mint a token; the plaintext is only shown here",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			allowed := mcpReadOnlyTools
+			if tools != "" {
+				var err error
+				if allowed, err = parseMCPTools(tools); err != nil {
+					return err
+				}
+			}
+			id, token, err := mintMCPToken(name, allowed, nil)
+			if err != nil {
+				return err
+			}
+			return ctlPrintJSON(cmd.OutOrStdout(), gin.H{"id": id, "name": name, "tools": allowed, "token": token})
+		},
 	}
+	create.Flags().StringVar(&name, "name", "", "who the token is for")
+	create.Flags().StringVar(&tools, "tools", "", "comma-separated tool allowlist, or * for every tool; read-only tools by default")
+	create.MarkFlagRequired("name")
 
-	if c.Query("execute") == "true" {
-		recipes, err := ExecuteSearch(generatedURL)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to execute search: " + err.Error()})
-			return
-		}
-		response.Recipes = recipes
+	revoke := &cobra.Command{
+		Use:   "revoke id",
+		Short: "Revoke a token",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid token ID %q", args[0])
+			}
+			res, err := db.Exec("UPDATE mcp_tokens SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", id)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return fmt.Errorf("token %d not found", id)
+			}
+			return ctlPrintJSON(cmd.OutOrStdout(), gin.H{"id": id, "revoked": true})
+		},
 	}
 
-	c.JSON(http.StatusOK, response)
+	cmd.AddCommand(list, create, revoke)
+	return cmd
 }
 
-func setupRoutes() *gin.Engine {
-	r := gin.Default()
-	
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+// parseMCPTools reads a comma-separated tool allowlist, rejecting names
+// that aren't tools.
+func parseMCPTools(list string) ([]string, error) {
+	known := map[string]bool{"*": true}
+	for _, tool := range mcpTools(nil) {
+		known[tool.Name] = true
+	}
+	tools := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
 		}
-		
-		c.Next()
-	})
-	
-	// MCP Server endpoint
-	r.POST("/mcp", handleMCPRequest)
-	
-	// Original API endpoints
-	api := r.Group("/api")
-	{
-		api.GET("/recipes/search", searchRecipes)
-		api.GET("/recipe/:id", getRecipeByID)
-		api.GET("/diet-plans", getDietPlans)
-		r.POST("/chat", handleChat)
-		api.GET("/health", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"status": "healthy"})
-		})
+		if !known[name] {
+			return nil, fmt.Errorf("unknown tool %q", name)
+		}
+		tools = append(tools, name)
 	}
-	
-	return r
-}
-
-func Handler(w http.ResponseWriter, r *http.Request) {
-	if db == nil {
-		initDB()
+	if len(tools) == 0 {
+		return nil, errors.New("no tools given")
 	}
-	
-	router := setupRoutes()
-	router.ServeHTTP(w, r)
+	return tools, nil
 }
-
-func main() {
-	initDB()
-	
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	
-}
\ No newline at end of file
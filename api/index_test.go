@@ -0,0 +1,611 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/webp"
+)
+
+func TestMergeShoppingList(t *testing.T) {
+	four, two := 4, 2
+	recipes := map[int]Recipe{
+		1: {ID: 1, Servings: &four, Ingredients: []string{"2 cups flour", "1/3 cup sugar", "salt to taste"}},
+		2: {ID: 2, Servings: &two, Ingredients: []string{"1 cup flour", "1/3 cup sugar", "Salt to taste", "3 eggs"}},
+	}
+	list := mergeShoppingList([]RecipePortion{{ID: 1, Servings: 2}, {ID: 2, Servings: 3}}, recipes)
+
+	want := []ShoppingListItem{
+		{Name: "eggs", Quantity: 4.5, Aisle: "dairy & eggs", Recipes: []int{2}},
+		{Name: "flour", Quantity: 2.5, Unit: "cup", Aisle: "pantry", Recipes: []int{1, 2}},
+		{Name: "salt to taste", Aisle: "spices", Recipes: []int{1, 2}, Notes: []string{"salt to taste", "Salt to taste"}},
+		{Name: "sugar", Quantity: 0.67, Unit: "cup", Aisle: "pantry", Recipes: []int{1, 2}},
+	}
+	if !reflect.DeepEqual(list.Items, want) {
+		t.Errorf("mergeShoppingList items =\n%+v\nwant\n%+v", list.Items, want)
+	}
+}
+
+func TestEncodeWebPLosslessRoundTrip(t *testing.T) {
+	noise := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	rng := rand.New(rand.NewSource(1))
+	rng.Read(noise.Pix)
+	gradient := image.NewNRGBA(image.Rect(0, 0, 600, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 600; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y * 6), uint8(x + y), uint8(255 - y)})
+		}
+	}
+	flat := image.NewNRGBA(image.Rect(0, 0, 300, 300))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.NRGBA{200, 40, 90, 255}), image.Point{}, draw.Src)
+	draw.Draw(flat, image.Rect(50, 50, 120, 260), image.NewUniform(color.NRGBA{0, 0, 0, 0}), image.Point{}, draw.Src)
+	single := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	single.SetNRGBA(0, 0, color.NRGBA{1, 2, 3, 4})
+
+	for name, img := range map[string]*image.NRGBA{"noise": noise, "gradient": gradient, "flat": flat, "single": single} {
+		var out bytes.Buffer
+		if err := encodeWebPLossless(&out, img); err != nil {
+			t.Fatalf("%s: encode: %v", name, err)
+		}
+		decoded, err := webp.Decode(&out)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		got := image.NewNRGBA(img.Bounds())
+		draw.Draw(got, got.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+		if !bytes.Equal(got.Pix, img.Pix) {
+			t.Errorf("%s: decoded pixels differ from the original", name)
+		}
+	}
+}
+
+func TestNegotiateImageEncoder(t *testing.T) {
+	tests := []struct {
+		accept string
+		opaque bool
+		want   string
+	}{
+		{"", true, "image/jpeg"},
+		{"", false, "image/png"},
+		{"image/avif,image/webp,image/*,*/*;q=0.8", true, "image/jpeg"},
+		{"image/avif,image/webp,image/*,*/*;q=0.8", false, "image/webp"},
+		{"image/png,image/*;q=0.8", false, "image/png"},
+		{"image/webp;q=0,image/*", false, "image/png"},
+		{"image/jpeg;q=0, image/png", true, "image/png"},
+	}
+	for _, tt := range tests {
+		if got := imageEncoders[negotiateImageEncoder(tt.accept, tt.opaque)].ContentType; got != tt.want {
+			t.Errorf("negotiateImageEncoder(%q, %v) = %s, want %s", tt.accept, tt.opaque, got, tt.want)
+		}
+	}
+}
+
+func TestSpokenUnits(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Bake at 350°F for 25 mins.", "Bake at 350 degrees Fahrenheit for 25 minutes."},
+		{"Heat to 180 °C", "Heat to 180 degrees Celsius"},
+		{"Simmer 1 min, then rest 10min", "Simmer 1 minutes, then rest 10 minutes"},
+		{"Add 2 Tbsp oil and a tsp of salt", "Add 2 tablespoons oil and a teaspoons of salt"},
+		{"8 oz pasta, 1 lb beef, 2lbs potatoes", "8 ounces pasta, 1 pounds beef, 2 pounds potatoes"},
+		{"½ oz yeast", "½ ounces yeast"},
+		{"Roast 1 hr", "Roast 1 hours"},
+		{"Stir in the mint and minced ozone-free lbsalt", "Stir in the mint and minced ozone-free lbsalt"},
+		{"Season the minestrone with oregano", "Season the minestrone with oregano"},
+		{"Cook 5 minutes over low heat", "Cook 5 minutes over low heat"},
+	}
+	for _, tt := range tests {
+		if got := spokenUnits(tt.text); got != tt.want {
+			t.Errorf("spokenUnits(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRecipeQuerySQL(t *testing.T) {
+	selectAll := "SELECT " + recipeColumns + " FROM recipes"
+	tenant := &Tenant{ID: "acme"}
+	shared := &Tenant{ID: "acme", IncludeGlobal: true}
+	tests := []struct {
+		name  string
+		query *recipeQuery
+		want  string
+		args  []interface{}
+	}{
+		{"bare", selectRecipes(), selectAll, []interface{}{}},
+		{"where", selectRecipes().Where("id = ?", 7), selectAll + " WHERE id = ?", []interface{}{7}},
+		{
+			"where twice",
+			selectRecipes().Where("cuisine = ?", "thai").Where("total_time BETWEEN ? AND ?", 10, 30),
+			selectAll + " WHERE cuisine = ? AND total_time BETWEEN ? AND ?",
+			[]interface{}{"thai", 10, 30},
+		},
+		{"visible to no tenant", selectRecipes().Visible(nil), selectAll + " WHERE " + publishedRecipe + " AND tenant_id IS NULL", []interface{}{}},
+		{"visible to a tenant", selectRecipes().Visible(tenant), selectAll + " WHERE " + publishedRecipe + " AND tenant_id = ?", []interface{}{"acme"}},
+		{
+			"visible with the global catalog",
+			selectRecipes().Where("id = ?", 3).Visible(shared),
+			selectAll + " WHERE id = ? AND " + publishedRecipe + " AND (tenant_id = ? OR tenant_id IS NULL)",
+			[]interface{}{3, "acme"},
+		},
+		{"order", selectRecipes().OrderBy("created_at DESC"), selectAll + " ORDER BY created_at DESC", []interface{}{}},
+		{
+			"order and limit",
+			selectRecipes().Visible(tenant).Where("rating >= ?", 4.5).OrderBy("rating DESC").Limit(10),
+			selectAll + " WHERE " + publishedRecipe + " AND tenant_id = ? AND rating >= ? ORDER BY rating DESC LIMIT ?",
+			[]interface{}{"acme", 4.5, 10},
+		},
+		{"zero limit", selectRecipes().Limit(0), selectAll, []interface{}{}},
+		{"prepared", selectRecipes().Where("id = ?", 7).Limit(1).Prepared(), selectAll + " WHERE id = ? LIMIT ?", []interface{}{7, 1}},
+	}
+	for _, tt := range tests {
+		query, args := tt.query.SQL()
+		if query != tt.want {
+			t.Errorf("%s: SQL =\n%s\nwant\n%s", tt.name, query, tt.want)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: args = %v, want %v", tt.name, args, tt.args)
+		}
+	}
+}
+
+func TestRecipeQueryState(t *testing.T) {
+	query := selectRecipes().Where("id = ?", 7).Limit(5)
+	query.SQL()
+	if _, args := query.SQL(); !reflect.DeepEqual(args, []interface{}{7, 5}) {
+		t.Errorf("second SQL args = %v, want [7 5]", args)
+	}
+	if !selectRecipes().Prepared().prepared {
+		t.Error("Prepared did not mark the query prepared")
+	}
+}
+
+func TestHandleLambdaEvent(t *testing.T) {
+	type seen struct {
+		method, path, remote, cookie, body string
+		query                              url.Values
+		header                             http.Header
+	}
+	var got seen
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = seen{r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get("Cookie"), string(body), r.URL.Query(), r.Header}
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Add("X-Tag", "one")
+		w.Header().Add("X-Tag", "two")
+		if r.URL.Query().Get("binary") != "" {
+			w.Header().Set("Content-Type", "image/png")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte{0x89, 'P', 'N', 'G', 0})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	t.Run("rest v1", func(t *testing.T) {
+		payload := `{
+			"httpMethod": "POST",
+			"path": "/api/recipes",
+			"headers": {"Content-Type": "text/plain", "Host": "api.example.com"},
+			"multiValueHeaders": {"accept": ["application/json", "text/plain"]},
+			"multiValueQueryStringParameters": {"tag": ["quick", "vegan"], "binary": ["1"]},
+			"body": "aGVsbG8gd29ybGQ=",
+			"isBase64Encoded": true,
+			"requestContext": {"identity": {"sourceIp": "203.0.113.7"}}
+		}`
+		result, err := handleLambdaEvent(context.Background(), handler, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.method != "POST" || got.path != "/api/recipes" || got.body != "hello world" || got.remote != "203.0.113.7:0" {
+			t.Errorf("request = %s %s body %q from %s", got.method, got.path, got.body, got.remote)
+		}
+		if tags := got.query["tag"]; !reflect.DeepEqual(tags, []string{"quick", "vegan"}) {
+			t.Errorf("tag query = %v, want [quick vegan]", tags)
+		}
+		if accept := got.header["Accept"]; !reflect.DeepEqual(accept, []string{"application/json", "text/plain"}) {
+			t.Errorf("Accept = %v, want both values", accept)
+		}
+		if got.header.Get("Content-Type") != "text/plain" {
+			t.Errorf("Content-Type = %q, want text/plain", got.header.Get("Content-Type"))
+		}
+
+		if result.StatusCode != http.StatusCreated {
+			t.Errorf("status = %d, want 201", result.StatusCode)
+		}
+		if !reflect.DeepEqual(result.MultiValueHeaders["Set-Cookie"], []string{"a=1", "b=2"}) || !reflect.DeepEqual(result.MultiValueHeaders["X-Tag"], []string{"one", "two"}) {
+			t.Errorf("multi-value headers = %v", result.MultiValueHeaders)
+		}
+		if result.Headers != nil || result.Cookies != nil {
+			t.Errorf("v1 result has v2 fields: headers %v, cookies %v", result.Headers, result.Cookies)
+		}
+		if !result.IsBase64Encoded || result.Body != base64.StdEncoding.EncodeToString([]byte{0x89, 'P', 'N', 'G', 0}) {
+			t.Errorf("body = %q (base64 %v), want the PNG bytes encoded", result.Body, result.IsBase64Encoded)
+		}
+	})
+
+	t.Run("http v2", func(t *testing.T) {
+		payload := `{
+			"version": "2.0",
+			"rawPath": "/api/search",
+			"rawQueryString": "q=soup&tag=quick&tag=vegan",
+			"headers": {"accept": "application/json, text/plain", "host": "api.example.com"},
+			"cookies": ["session=abc", "theme=dark"],
+			"body": "{\"name\":\"soup\"}",
+			"isBase64Encoded": false,
+			"requestContext": {"http": {"method": "PUT", "sourceIp": "198.51.100.4"}}
+		}`
+		result, err := handleLambdaEvent(context.Background(), handler, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.method != "PUT" || got.path != "/api/search" || got.body != `{"name":"soup"}` || got.remote != "198.51.100.4:0" {
+			t.Errorf("request = %s %s body %q from %s", got.method, got.path, got.body, got.remote)
+		}
+		if tags := got.query["tag"]; got.query.Get("q") != "soup" || !reflect.DeepEqual(tags, []string{"quick", "vegan"}) {
+			t.Errorf("query = %v", got.query)
+		}
+		if got.header.Get("Accept") != "application/json, text/plain" || got.cookie != "session=abc; theme=dark" {
+			t.Errorf("Accept = %q, Cookie = %q", got.header.Get("Accept"), got.cookie)
+		}
+
+		if result.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want 200", result.StatusCode)
+		}
+		if !reflect.DeepEqual(result.Cookies, []string{"a=1", "b=2"}) || result.Headers["X-Tag"] != "one, two" {
+			t.Errorf("cookies = %v, headers = %v", result.Cookies, result.Headers)
+		}
+		if _, ok := result.Headers["Set-Cookie"]; ok || result.MultiValueHeaders != nil {
+			t.Errorf("v2 result repeats cookies in headers: %v, %v", result.Headers, result.MultiValueHeaders)
+		}
+		if result.IsBase64Encoded || result.Body != `{"ok":true}` {
+			t.Errorf("body = %q (base64 %v), want the JSON as text", result.Body, result.IsBase64Encoded)
+		}
+	})
+
+	t.Run("bad base64", func(t *testing.T) {
+		if _, err := handleLambdaEvent(context.Background(), handler, []byte(`{"httpMethod":"POST","path":"/","body":"%%%","isBase64Encoded":true}`)); err == nil {
+			t.Error("expected an error for a body that isn't base64")
+		}
+	})
+}
+
+func TestReedSolomon(t *testing.T) {
+	// Version 1-M examples: "01234567" in numeric mode from ISO/IEC 18004
+	// Annex I, and "HELLO WORLD" in alphanumeric mode.
+	tests := []struct {
+		data []byte
+		want []byte
+	}{
+		{
+			[]byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11},
+			[]byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55},
+		},
+		{
+			[]byte{0x20, 0x5B, 0x0B, 0x78, 0xD1, 0x72, 0xDC, 0x4D, 0x43, 0x40, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11},
+			[]byte{0xC4, 0x23, 0x27, 0x77, 0xEB, 0xD7, 0xE7, 0xE2, 0x5D, 0x17},
+		},
+	}
+	for _, tt := range tests {
+		if got := reedSolomon(tt.data, len(tt.want)); !bytes.Equal(got, tt.want) {
+			t.Errorf("reedSolomon(% X) = % X, want % X", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	// Version 3-M with mask 7, matching rsc.io/qr/coding for the same plan.
+	want := []string{
+		"#######..##.##..#..#..#######",
+		"#.....#..#######....#.#.....#",
+		"#.###.#...#..#..#####.#.###.#",
+		"#.###.#..#######......#.###.#",
+		"#.###.#....####.###.#.#.###.#",
+		"#.....#.#....##..###..#.....#",
+		"#######.#.#.#.#.#.#.#.#######",
+		"............#.#..##.#........",
+		"#..#.##.#####..#.#...#.#.....",
+		"####...###....##..#.###..#..#",
+		"########.#.##...#.##########.",
+		"#..#...#..###.##...#.#....##.",
+		".#....###.#.....##.##.#..#.##",
+		"#...#....#.#...#...###.......",
+		"###.#.#..##.#..##.#..#..#####",
+		"#..#.....#.####.####.##..#.#.",
+		"#.##.######..#######.#.....#.",
+		".##.##.....##..#..#..###.#..#",
+		"#...#.#.#.##.#...##..####..##",
+		"...#.#..#..###.####.#.#.#..##",
+		"#.....#.#.#.#.#.#..######.#..",
+		"........#..###.######...#.###",
+		"#######.....####..#.#.#.#..#.",
+		"#.....#.#.#..#..#...#...#####",
+		"#.###.#...#...###...#####..#.",
+		"#.###.#.#.##..######..#####.#",
+		"#.###.#...###.#..##..#..###.#",
+		"#.....#....#...#.######....#.",
+		"#######.#.#.##.####.#..###.#.",
+	}
+	qr, err := encodeQR("https://emeal.example/r/Xk3pQ9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qr.size != len(want) {
+		t.Fatalf("size = %d, want %d", qr.size, len(want))
+	}
+	for y, row := range want {
+		got := make([]byte, qr.size)
+		for x := range got {
+			got[x] = '.'
+			if qr.modules[y][x] {
+				got[x] = '#'
+			}
+		}
+		if string(got) != row {
+			t.Errorf("row %d = %s, want %s", y, got, row)
+		}
+	}
+
+	if _, err := encodeQR(strings.Repeat("x", 213)); err != nil {
+		t.Errorf("encodeQR of 213 bytes: %v", err)
+	}
+	if _, err := encodeQR(strings.Repeat("x", 214)); err != errQRTooLong {
+		t.Errorf("encodeQR of 214 bytes: err = %v, want errQRTooLong", err)
+	}
+}
+
+func TestMCPSessionExpiry(t *testing.T) {
+	defer func(ttl time.Duration) { cfg.MCP.SessionTTL = ttl }(cfg.MCP.SessionTTL)
+	cfg.MCP.SessionTTL = time.Hour
+	signed := func(issued time.Time) string {
+		nonce := "00-" + strconv.FormatInt(issued.Unix(), 10)
+		return nonce + "." + signMCPSession(nonce)
+	}
+
+	id := newMCPSessionID()
+	if !validMCPSession(id) {
+		t.Fatal("new session is not valid")
+	}
+	if validMCPSession(id[:len(id)-1] + "x") {
+		t.Error("session with a bad signature is valid")
+	}
+	if validMCPSession(signed(time.Now().Add(-2 * time.Hour))) {
+		t.Error("expired session is valid")
+	}
+
+	stale := signed(time.Now().Add(-2 * time.Hour))
+	mcpClosedSessions.Store(stale, time.Now().Add(-time.Hour))
+	closeMCPSession(id)
+	if validMCPSession(id) {
+		t.Error("closed session is still valid")
+	}
+	if _, ok := mcpClosedSessions.Load(stale); ok {
+		t.Error("closing a session kept an entry past its expiry")
+	}
+}
+
+func TestMCPBatchInitialize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/mcp", strings.NewReader(
+		`[{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}},{"jsonrpc":"2.0","id":2,"method":"ping"}]`))
+	handleMCPRequest(c)
+
+	if w.Header().Get("Mcp-Session-Id") != "" {
+		t.Error("batched initialize started a session")
+	}
+	var responses []MCPResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body.String(), err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("got %d responses, want 2", len(responses))
+	}
+	if responses[0].Error == nil || responses[0].Error.Code != -32600 {
+		t.Errorf("initialize response = %+v, want an invalid request error", responses[0])
+	}
+	if responses[1].Error != nil {
+		t.Errorf("ping response = %+v, want a result", responses[1])
+	}
+}
+
+func TestMCPStreamUnsubscribe(t *testing.T) {
+	hub := &mcpStreamHub{streams: map[chan []byte]string{}}
+	ch := hub.subscribe("s1")
+	hub.unsubscribe(ch)
+	if _, ok := <-ch; ok {
+		t.Error("unsubscribed stream is still open")
+	}
+
+	ch = hub.subscribe("s2")
+	hub.closeSession("s2")
+	hub.unsubscribe(ch) // must not close it twice
+	if len(hub.streams) != 0 {
+		t.Errorf("hub still holds %d streams", len(hub.streams))
+	}
+}
+
+func TestPublicHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	if err := checkImageURL(context.Background(), server.URL); err == nil {
+		t.Error("checkImageURL reached a loopback address")
+	}
+	if _, err := fetchImageHash(context.Background(), server.URL); err == nil {
+		t.Error("fetchImageHash reached a loopback address")
+	}
+}
+
+func TestParseMCPTools(t *testing.T) {
+	tools, err := parseMCPTools(" search_recipes, get_recipe ,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tools, []string{"search_recipes", "get_recipe"}) {
+		t.Errorf("tools = %q, want search_recipes and get_recipe", tools)
+	}
+	if _, err := parseMCPTools("search_recipes,delete_everything"); err == nil {
+		t.Error("unknown tool accepted")
+	}
+	if _, err := parseMCPTools(" , "); err == nil {
+		t.Error("empty allowlist accepted")
+	}
+}
+
+func TestReportLambdaInitError(t *testing.T) {
+	var path, errorType string
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, errorType = r.URL.Path, r.Header.Get("Lambda-Runtime-Function-Error-Type")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	if err := reportLambdaInitError(strings.TrimPrefix(server.URL, "http://"), errors.New("bad config")); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/2018-06-01/runtime/init/error" {
+		t.Errorf("posted to %s", path)
+	}
+	if errorType != "Runtime.ConfigError" || body["errorMessage"] != "bad config" {
+		t.Errorf("error type %q, body %v", errorType, body)
+	}
+}
+
+func TestSearchVariants(t *testing.T) {
+	defer func(saved *synonymIndex) { ingredientSynonyms = saved }(ingredientSynonyms)
+	group := []string{"aubergine", "eggplant"}
+	ingredientSynonyms = &synonymIndex{
+		groups: map[string][]string{"aubergine": group, "eggplant": group},
+		patterns: []synonymPattern{
+			{term: "aubergine", pattern: termPattern("aubergine"), group: group},
+			{term: "eggplant", pattern: termPattern("eggplant"), group: group},
+		},
+		loadedAt: time.Now(),
+	}
+
+	want := []string{"Eggplant curry", "Aubergine curry"}
+	if got := searchVariants("Eggplant curry"); !reflect.DeepEqual(got, want) {
+		t.Errorf("searchVariants = %q, want %q", got, want)
+	}
+	if got := searchVariants("eggplanter"); !reflect.DeepEqual(got, []string{"eggplanter"}) {
+		t.Errorf("searchVariants matched inside a word: %q", got)
+	}
+}
+
+func TestFactorCache(t *testing.T) {
+	loads := 0
+	cache := factorCache[int]{load: func() ([]int, error) {
+		loads++
+		return []int{loads}, nil
+	}}
+	for i := 0; i < 3; i++ {
+		if got, err := cache.get(); err != nil || !reflect.DeepEqual(got, []int{1}) {
+			t.Fatalf("get = %v, %v; want [1]", got, err)
+		}
+	}
+	cache.invalidate()
+	if got, _ := cache.get(); !reflect.DeepEqual(got, []int{2}) || loads != 2 {
+		t.Errorf("after invalidate get = %v with %d loads, want [2] with 2", got, loads)
+	}
+}
+
+func TestLocalizeRecipeJSONWithoutRecipes(t *testing.T) {
+	raw := []byte(`{"count":2,"items":[{"id":1,"name":"not a recipe"}]}`)
+	got, err := localizeRecipeJSON(raw, []string{"fr"})
+	if err != nil || !bytes.Equal(got, raw) {
+		t.Errorf("localizeRecipeJSON = %s, %v; want the body unchanged", got, err)
+	}
+	if _, err := localizeRecipeJSON([]byte(`{"id":`), []string{"fr"}); err == nil {
+		t.Error("localizeRecipeJSON accepted a truncated body")
+	}
+}
+
+func TestFormatForLocalePassesThroughUndecodableJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/broken", formatForLocale(), func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", []byte(`{"calories": 12,`))
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/broken?lang=de", nil))
+	if w.Body.String() != `{"calories": 12,` {
+		t.Errorf("body = %q, want the handler's bytes", w.Body.String())
+	}
+}
+
+func TestNegotiateEncodingPassesThroughUndecodableJSON(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/broken", negotiateEncoding(), func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", []byte(`[1, 2`))
+	})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/broken", nil)
+	req.Header.Set("Accept", "application/xml")
+	r.ServeHTTP(w, req)
+	if w.Body.String() != `[1, 2` || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got %q as %s, want the handler's JSON", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+}
+
+func TestSearchRecipesSchemaLimit(t *testing.T) {
+	defer func(search SearchConfig) { cfg.Search = search }(cfg.Search)
+	cfg.Search.MaxLimit, cfg.Search.MCPDefaultLimit = 250, 40
+
+	limit := searchRecipesSchema(nil)["properties"].(map[string]interface{})["limit"].(map[string]interface{})
+	if limit["maximum"] != 250 || limit["default"] != 40 || limit["description"] != "Maximum number of results (1-250, default 40)" {
+		t.Errorf("limit schema = %v, want the configured bounds", limit)
+	}
+}
+
+func TestLocalizeIngredients(t *testing.T) {
+	names := []localizedName{
+		{term: "spring onion", pattern: termPattern("spring onion"), name: "ciboule"},
+		{term: "onion", pattern: termPattern("onion"), name: "oignon"},
+	}
+	got := localizeIngredients([]string{"2 Spring onions, sliced", "1 onion", "1 tsp onion powder", "oniony salt"}, names)
+	want := []string{"2 Ciboule, sliced", "1 oignon", "1 tsp oignon powder", "oniony salt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("localizeIngredients = %q, want %q", got, want)
+	}
+}
+
+func TestDietBorderline(t *testing.T) {
+	defer func(saved *synonymIndex) { ingredientSynonyms = saved }(ingredientSynonyms)
+	ingredientSynonyms = &synonymIndex{groups: map[string][]string{}, loadedAt: time.Now()}
+
+	plan := DietPlan{Name: "Pescatarian", Filters: map[string]interface{}{"exclude_ingredients": []string{"meat"}}}
+	recipes := []Recipe{{ID: 7, Ingredients: []string{"200 g bacon, diced", "1 tbsp butter", "2 hamburger buns"}}}
+	want := []DietFlag{{RecipeID: 7, Ingredient: "200 g bacon, diced", Matched: "bacon", Excluded: "meat"}}
+	for i := 0; i < 2; i++ {
+		if got := dietBorderline(recipes, plan); !reflect.DeepEqual(got, want) {
+			t.Errorf("dietBorderline = %+v, want %+v", got, want)
+		}
+	}
+	if first, second := strictDietPatterns(plan), strictDietPatterns(plan); &first[0] != &second[0] {
+		t.Error("strictDietPatterns recompiled the plan's patterns")
+	}
+}
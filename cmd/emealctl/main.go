@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	handler "recipe-api/api"
+)
+
+func main() {
+	if err := handler.Ctl(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "emealctl:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+
+	handler "recipe-api/api"
+)
+
+// Build with GOOS=linux and name the binary bootstrap for the
+// provided.al2023 runtime.
+func main() {
+	if err := handler.ServeLambda(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import handler "recipe-api/api"
+
+func main() {
+	handler.Main()
+}